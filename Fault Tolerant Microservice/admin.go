@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	bh := s.bulkhead.Stats()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"requests":  atomic.LoadInt64(&s.stats.requests),
+		"successes": atomic.LoadInt64(&s.stats.successes),
+		"failures":  atomic.LoadInt64(&s.stats.failures),
+		"rejected": map[string]int64{
+			"circuit_open": atomic.LoadInt64(&s.stats.rejectedCircuit),
+			"bulkhead":     atomic.LoadInt64(&s.stats.rejectedBulkhead),
+			"overload":     atomic.LoadInt64(&s.stats.rejectedOverload),
+			"rate_limited": atomic.LoadInt64(&s.limiter.rejected),
+		},
+		"in_flight":          atomic.LoadInt32(&s.inFlight),
+		"bulkhead_used":      bh.InUse,
+		"bulkhead_size":      bh.Size,
+		"bulkhead_queue":     bulkheadQueueStats(bh),
+		"client_cancelled":   atomic.LoadInt64(&s.stats.clientCancelled),
+		"partial_failures":   atomic.LoadInt64(&s.stats.partial),
+		"total_checked":      atomic.LoadInt64(&s.stats.checkTotal),
+		"oversized_requests": atomic.LoadInt64(&s.stats.oversized),
+		"products":           s.store.size(),
+		"circuit":            resilience.StateName(s.breaker.State()),
+		"chaos_rate":         s.chaos.Rate(),
+		"auth":               s.apiKeyStats(),
+		"webhooks":           s.cfg.Webhooks.stats(),
+		"recorder":           recorderStats(),
+		"trigram_index":      s.store.trigramStats(),
+		"index_file":         s.indexFile.stats(),
+		"wal":                s.wal.stats(),
+		"catalog_snapshot":   s.catalogSnaps.stats(),
+		"brownout":           s.brownout.stats(),
+		"backpressure":       s.backpressure.stats(),
+		"search_cost":        s.costs.stats(s.cfg.SearchWorkBudget),
+		"rate_limit_store":   s.limiter.storeStats(),
+		"audit":              audit.stats(),
+		"admin_allowlist":    s.adminAllowlistStats(),
+		"idempotency":        s.idem.stats(),
+		"inventory":          s.inventoryStats(),
+		"hedging":            s.hedgeStats(),
+		"operations":         s.ops.stats(),
+		"shards":             s.shardStats(),
+		"cardinality":        s.cardinalityStats(),
+		"features":           s.features.stats(),
+		"matchers":           s.matcherStats(),
+		"checks_tuner":       s.checksTuner.stats(),
+		"coalescing":         s.coalescer.stats(),
+		"circuit_waits":      s.circuitWaitStats(),
+		"events":             s.store.events.stats(),
+		"response_cache":     s.responseCacheStats(),
+		"snapshots":          s.snapshots.stats(),
+		"export_snapshots":   s.exports.stats(),
+		"streams":            s.streamStats(),
+		"rejection_status":   s.cfg.RejectionStatus,
+		"signing":            s.signingStats(),
+		"spill":              s.spillStats(),
+		"tenants":            s.tenants.stats(),
+		"memory":             s.memoryStats(),
+		"routes":             s.metrics.stats(),
+		"windows":            s.windows.stats(),
+	})
+}
+
+func bulkheadQueueStats(bh resilience.BulkheadStats) map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":     bh.Queue > 0,
+		"order":       bh.Order,
+		"capacity":    bh.Queue,
+		"timeout_ms":  durationMS(bh.Timeout),
+		"waiting":     bh.Waiting,
+		"queued":      bh.Queued,
+		"timed_out":   bh.TimedOut,
+		"abandoned":   bh.Abandoned,
+		"max_wait_ms": durationMS(bh.MaxWait),
+	}
+}
+
+func (s *Server) hedgeStats() map[string]interface{} {
+	if s.hedger == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return s.hedger.stats()
+}
+
+func (s *Server) inventoryStats() map[string]interface{} {
+	if s.inventory == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	st := s.inventory.stats()
+	st["enabled"] = true
+	return st
+}
+
+// zeroResultsHandler lists the most frequent queries that matched nothing
+func (s *Server) zeroResultsHandler(w http.ResponseWriter, r *http.Request) {
+	queries, total := s.zeroResults.top()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"queries":  queries,
+		"total":    total,
+		"capacity": s.zeroResults.guard.max,
+		"overflow": atomic.LoadInt64(&s.zeroResults.guard.overflow),
+	})
+}
+
+func (s *Server) circuitHandler(w http.ResponseWriter, r *http.Request) {
+	cs := breakerCircuitState(s.breaker)
+	if s.inventory != nil {
+		cs.Dependencies = s.inventory.circuitStates()
+	}
+	writeJSON(w, http.StatusOK, cs)
+}
+
+// adminCircuitHandler forces the breaker open or closes it.
+// A forced open breaker stays open until closed again.
+func (s *Server) adminCircuitHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+		return
+	}
+	before := resilience.StateName(s.breaker.State())
+	switch body.State {
+	case "open":
+		s.breaker.ForceOpen()
+	case "closed":
+		s.breaker.Reset()
+	default:
+		writeErr(w, r, invalid("state", `state must be "open" or "closed"`))
+		return
+	}
+	noteAudit(r, "circuit", before, resilience.StateName(s.breaker.State()))
+	writeJSON(w, http.StatusOK, breakerCircuitState(s.breaker))
+}
+
+// chaosSettings is the body of GET and PUT /admin/chaos. FailureRate is
+// the base rate when set and the rate in force when read; a schedule or
+// spike can hold it somewhere else for a while.
+type chaosSettings struct {
+	FailureRate *float64                       `json:"failure_rate"`
+	BaseRate    *float64                       `json:"base_rate,omitempty"`
+	LatencyMS   *float64                       `json:"latency_ms,omitempty"`
+	Schedule    *resilience.ChaosScheduleState `json:"schedule,omitempty"`
+	Spike       *resilience.ChaosSpikeState    `json:"spike,omitempty"`
+	Disabled    bool                           `json:"disabled,omitempty"`
+	// Guard is read only, set while the chaos guard is on
+	Guard *chaosGuardState `json:"guard,omitempty"`
+	// Partial is read only: failures keep the results matched, per
+	// -chaos-partial
+	Partial bool `json:"partial,omitempty"`
+}
+
+func (s *Server) chaosHandler(w http.ResponseWriter, r *http.Request) {
+	rate, schedule, spike := s.chaos.State()
+	base := s.chaos.BaseRate()
+	latency := durationMS(s.chaos.Delay())
+	writeJSON(w, http.StatusOK, chaosSettings{FailureRate: &rate, BaseRate: &base, LatencyMS: &latency, Schedule: schedule, Spike: spike, Disabled: s.chaos.Disabled(), Guard: s.chaosGuard.status(), Partial: s.cfg.ChaosPartial})
+}
+
+// chaosSummary is the chaos settings as the audit log shows them
+func (s *Server) chaosSummary() string {
+	rate, schedule, spike := s.chaos.State()
+	sum := fmt.Sprintf("failure rate %g (base %g), latency %gms", rate, s.chaos.BaseRate(), durationMS(s.chaos.Delay()))
+	if schedule != nil {
+		sum += ", schedule running"
+	}
+	if spike != nil {
+		sum += ", spike running"
+	}
+	if ceiling, ok := s.chaos.Ceiling(); ok {
+		sum += fmt.Sprintf(", capped at %g", ceiling)
+	}
+	return sum
+}
+
+// maxChaosLatencyMS bounds the latency chaos adds to a search
+const maxChaosLatencyMS = 10000
+
+// setChaosHandler sets the base rate, a schedule, the added latency or
+// any of them together. Setting a rate drops any running schedule.
+func (s *Server) setChaosHandler(w http.ResponseWriter, r *http.Request) {
+	var body chaosSettings
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+		return
+	}
+	if body.FailureRate == nil && body.Schedule == nil && body.LatencyMS == nil {
+		writeErr(w, r, invalid("", "failure_rate, schedule or latency_ms is required"))
+		return
+	}
+	if body.LatencyMS != nil && (*body.LatencyMS < 0 || *body.LatencyMS > maxChaosLatencyMS) {
+		writeErr(w, r, invalid("latency_ms", fmt.Sprintf("latency_ms must be between 0 and %d", maxChaosLatencyMS)))
+		return
+	}
+	if body.FailureRate != nil && (*body.FailureRate < 0 || *body.FailureRate > 1) {
+		writeErr(w, r, invalid("failure_rate", "failure_rate must be between 0 and 1"))
+		return
+	}
+	if body.Schedule != nil {
+		if err := body.Schedule.Validate(); err != nil {
+			writeErr(w, r, invalid("schedule", err.Error()))
+			return
+		}
+	}
+	if s.chaos.Disabled() {
+		writeErr(w, r, newError(ErrConflict, "Chaos is disabled in deterministic mode"))
+		return
+	}
+	before := s.chaosSummary()
+	if body.FailureRate != nil {
+		s.chaos.SetRate(*body.FailureRate)
+	}
+	if body.Schedule != nil {
+		s.chaos.SetSchedule(body.Schedule.ChaosSchedule)
+	}
+	if body.LatencyMS != nil {
+		s.chaos.SetDelay(time.Duration(*body.LatencyMS * float64(time.Millisecond)))
+	}
+	noteAudit(r, "chaos", before, s.chaosSummary())
+	s.chaosHandler(w, r)
+}
+
+// chaosSpikeRequest is the optional body of POST /admin/chaos/spike
+type chaosSpikeRequest struct {
+	FailureRate *float64 `json:"failure_rate"`
+	DurationS   *float64 `json:"duration_s"`
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Spike defaults: every search fails for half a minute
+const (
+	defaultSpikeRate     = 1.0
+	defaultSpikeDuration = 30.0
+	maxSpikeDuration     = 3600.0
+)
+
+func (s *Server) chaosSpikeHandler(w http.ResponseWriter, r *http.Request) {
+	var body chaosSpikeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+		return
+	}
+	rate, duration := defaultSpikeRate, defaultSpikeDuration
+	if body.FailureRate != nil {
+		rate = *body.FailureRate
+	}
+	if body.DurationS != nil {
+		duration = *body.DurationS
+	}
+	if rate < 0 || rate > 1 {
+		writeErr(w, r, invalid("failure_rate", "failure_rate must be between 0 and 1"))
+		return
+	}
+	if duration <= 0 || duration > maxSpikeDuration {
+		writeErr(w, r, invalid("duration_s", fmt.Sprintf("duration_s must be in (0, %g]", maxSpikeDuration)))
+		return
+	}
+	if s.chaos.Disabled() {
+		writeErr(w, r, newError(ErrConflict, "Chaos is disabled in deterministic mode"))
+		return
+	}
+	before := s.chaosSummary()
+	s.chaos.Spike(rate, seconds(duration))
+	noteAudit(r, "chaos", before, s.chaosSummary())
+	s.chaosHandler(w, r)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Audit log defaults: the events waiting to be written, and the newest
+// kept in memory for /admin/audit
+const (
+	defaultAuditBuffer = 1024
+	auditRecent        = 1000
+	// defaultAuditLimit is how many events /admin/audit returns when the
+	// caller doesn't say
+	defaultAuditLimit = 100
+)
+
+// auditEvent is one audited call, a line of the audit file
+type auditEvent struct {
+	Time time.Time `json:"ts"`
+	// Actor is the caller's API key, as key:name, or else its address
+	Actor  string `json:"actor"`
+	IP     string `json:"ip,omitempty"`
+	Action string `json:"action"`
+	// Target is what the call acted on, like product:42 or chaos, and the
+	// path when the handler didn't say
+	Target string `json:"target"`
+	Status int    `json:"status"`
+	// Before and After summarise what changed, when the handler knows
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// auditNote is what a handler adds to its request's event
+type auditNote struct {
+	target, before, after string
+}
+
+// noteAudit describes the change a handler is making. It does nothing
+// for routes that aren't audited.
+func noteAudit(r *http.Request, target, before, after string) {
+	if info := requestInfoFrom(r); info != nil && info.audit != nil {
+		*info.audit = auditNote{target: target, before: before, after: after}
+	}
+}
+
+// auditLog records every admin call and product mutation. Recording only
+// hands the event to a buffered channel, so a slow disk can never hold up
+// a request; once the buffer is full events are dropped, and counted.
+// run writes them to the file, when there is one, and keeps the newest
+// for /admin/audit.
+type auditLog struct {
+	events chan auditEvent
+	// file, when set, is appended to and rotated by run alone
+	file     *os.File
+	path     string
+	size     int64
+	maxBytes int64
+	keep     int
+	failing  bool
+	statsd   *statsdClient
+
+	recorded int64
+	dropped  int64
+	written  int64
+	failed   int64
+	rotated  int64
+
+	mu     sync.Mutex
+	recent []auditEvent
+	next   int
+}
+
+var audit = newAuditLog(defaultAuditBuffer)
+
+func newAuditLog(buffer int) *auditLog {
+	return &auditLog{events: make(chan auditEvent, buffer), recent: make([]auditEvent, 0, auditRecent)}
+}
+
+// openFile appends events to path, rotating it once it would grow past
+// maxBytes; the previous keep files are kept as path.1 (the newest) on
+// up. A maxBytes of 0 never rotates.
+func (a *auditLog) openFile(path string, maxBytes int64, keep int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.path, a.size, a.maxBytes, a.keep = f, path, fi.Size(), maxBytes, keep
+	return nil
+}
+
+func (a *auditLog) record(ev auditEvent) {
+	atomic.AddInt64(&a.recorded, 1)
+	select {
+	case a.events <- ev:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+		a.statsd.incr("audit.dropped")
+	}
+}
+
+// run writes events as they come; main starts it
+func (a *auditLog) run() {
+	for ev := range a.events {
+		a.mu.Lock()
+		if len(a.recent) < cap(a.recent) {
+			a.recent = append(a.recent, ev)
+		} else {
+			a.recent[a.next] = ev
+		}
+		a.next = (a.next + 1) % cap(a.recent)
+		a.mu.Unlock()
+		if a.file != nil {
+			a.write(ev)
+		}
+	}
+}
+
+func (a *auditLog) write(ev auditEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			a.fail(err)
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		a.fail(err)
+		return
+	}
+	a.failing = false
+	atomic.AddInt64(&a.written, 1)
+}
+
+// rotate shifts path.1 and on up one, dropping the oldest, and starts a
+// new path
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.keep > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	a.file, a.size = f, 0
+	atomic.AddInt64(&a.rotated, 1)
+	return nil
+}
+
+// fail counts a write that failed, logging the first in a row. The file
+// stays the target, so writes resume if the disk recovers.
+func (a *auditLog) fail(err error) {
+	atomic.AddInt64(&a.failed, 1)
+	if !a.failing {
+		a.failing = true
+		log.Printf("Audit log %s: %v", a.path, err)
+		adminErrors.record("audit", err.Error())
+	}
+}
+
+// auditFilter selects events for /admin/audit, each field matching when
+// empty
+type auditFilter struct {
+	actor, action, target, requestID string
+	since                            time.Time
+	limit                            int
+}
+
+func (f auditFilter) match(ev auditEvent) bool {
+	switch {
+	case f.actor != "" && ev.Actor != f.actor && ev.IP != f.actor:
+		return false
+	case f.action != "" && !strings.Contains(ev.Action, f.action):
+		return false
+	case f.target != "" && ev.Target != f.target:
+		return false
+	case f.requestID != "" && ev.RequestID != f.requestID:
+		return false
+	case !f.since.IsZero() && ev.Time.Before(f.since):
+		return false
+	}
+	return true
+}
+
+// query returns the newest events matching f, newest first
+func (a *auditLog) query(f auditFilter) []auditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []auditEvent{}
+	for i := 1; i <= len(a.recent) && len(out) < f.limit; i++ {
+		if ev := a.recent[(a.next-i+len(a.recent))%len(a.recent)]; f.match(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func (a *auditLog) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"file":     a.path,
+		"recorded": atomic.LoadInt64(&a.recorded),
+		"dropped":  atomic.LoadInt64(&a.dropped),
+		"pending":  len(a.events),
+		"written":  atomic.LoadInt64(&a.written),
+		"failed":   atomic.LoadInt64(&a.failed),
+		"rotated":  atomic.LoadInt64(&a.rotated),
+	}
+}
+
+// audited records an event for every call of the route once it returns,
+// those refused for the caller's address or key included, so it is the
+// outermost route layer
+func (s *Server) audited(rt route) middleware {
+	action := rt.Method + " " + rt.Path
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			info := requestInfoFrom(r)
+			if info == nil {
+				next(w, r)
+				return
+			}
+			note := &auditNote{}
+			info.audit = note
+			rec := &statusRecorder{ResponseWriter: w}
+			next(rec, r)
+			ev := auditEvent{
+				Time:      time.Now().UTC(),
+				Action:    action,
+				Target:    note.target,
+				Status:    rec.status,
+				Before:    note.before,
+				After:     note.after,
+				RequestID: info.RequestID,
+				Tenant:    s.tenant,
+			}
+			if ip := clientIP(r, s.cfg.TrustedProxies); ip != nil {
+				ev.IP = ip.String()
+			}
+			ev.Actor = ev.IP
+			if info.KeyName != "" {
+				ev.Actor = "key:" + info.KeyName
+			}
+			if ev.Target == "" {
+				ev.Target = r.URL.Path
+			}
+			if ev.Status == 0 {
+				ev.Status = http.StatusOK
+			}
+			audit.record(ev)
+		}
+	}
+}
+
+// auditHandler lists recent audit events, newest first, filtered by
+// actor (a key:name or an address), action (any part of it, like
+// /admin/chaos or DELETE), target, request_id and since
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := auditFilter{actor: q.Get("actor"), action: q.Get("action"), target: q.Get("target"), requestID: q.Get("request_id"), limit: defaultAuditLimit}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeErr(w, r, invalid("since", "since must be an RFC 3339 time"))
+			return
+		}
+		f.since = t
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > auditRecent {
+			writeErr(w, r, invalid("limit", fmt.Sprintf("limit must be between 1 and %d", auditRecent)))
+			return
+		}
+		f.limit = n
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"recorded": atomic.LoadInt64(&audit.recorded),
+		"dropped":  atomic.LoadInt64(&audit.dropped),
+		"events":   audit.query(f),
+	})
+}
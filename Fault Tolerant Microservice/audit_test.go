@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestAuditLog swaps in a fresh audit log for the test, written by
+// run as main starts it
+func useTestAuditLog(t *testing.T, buffer int) *auditLog {
+	a := newAuditLog(buffer)
+	old := audit
+	audit = a
+	done := make(chan struct{})
+	go func() {
+		a.run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		audit = old
+		close(a.events)
+		<-done
+		if a.file != nil {
+			a.file.Close()
+		}
+	})
+	return a
+}
+
+// waitAudit waits for a's writer to take in want events
+func waitAudit(t *testing.T, a *auditLog, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); len(a.query(auditFilter{limit: auditRecent})) < want; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("fewer than %d events audited", want)
+		}
+	}
+}
+
+// auditEvents queries /admin/audit as header's caller
+func auditEvents(t *testing.T, h http.Handler, query string, header http.Header) []auditEvent {
+	t.Helper()
+	rec := serve(h, http.MethodGet, "/admin/audit?"+query, "", header)
+	var res struct {
+		Events []auditEvent `json:"events"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/audit?%s: %d %s", query, rec.Code, rec.Body)
+	}
+	return res.Events
+}
+
+// TestAuditRecordsChanges audits admin calls and product changes with
+// who made them and what changed, not reads, and filters them
+func TestAuditRecordsChanges(t *testing.T) {
+	a := useTestAuditLog(t, defaultAuditBuffer)
+	keys, err := loadAPIKeys("", "ops:admin:ops-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, func(cfg *Config) { cfg.APIKeys = keys }).Routes()
+	ops := http.Header{"Content-Type": {"application/json"}}
+	ops.Set("X-API-Key", "ops-secret")
+
+	circuit := serve(h, http.MethodPost, "/admin/circuit", `{"state":"open"}`, ops)
+	create := serve(h, http.MethodPost, "/products", `{"name":"Audited Lamp","category":"Home","brand":"Delta","description":"d"}`, ops)
+	var p Product
+	if err := json.Unmarshal(create.Body.Bytes(), &p); err != nil || circuit.Code != http.StatusOK || create.Code != http.StatusCreated {
+		t.Fatalf("circuit %d, create %d %s", circuit.Code, create.Code, create.Body)
+	}
+	serve(h, http.MethodDelete, fmt.Sprintf("/products/%d", p.ID), "", ops)
+	serve(h, http.MethodGet, "/products/search?q=lamp", "", ops)
+	// Refused calls are audited too
+	if rec := serve(h, http.MethodPost, "/admin/circuit", `{"state":"closed"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without a key: %d", rec.Code)
+	}
+
+	waitAudit(t, a, 4)
+	// Newest first, and the search not among them
+	events := auditEvents(t, h, "actor=key:ops&limit=10", ops)
+	if len(events) != 3 {
+		t.Fatalf("events %+v, want the circuit, create and delete calls", events)
+	}
+	del, made, opened := events[0], events[1], events[2]
+	if opened.Action != "POST /admin/circuit" || opened.Target != "circuit" || opened.Before != "closed" || opened.After != "open" ||
+		opened.Status != http.StatusOK || opened.IP != "192.0.2.1" || opened.RequestID != circuit.Header().Get("X-Request-Id") {
+		t.Errorf("circuit event %+v", opened)
+	}
+	target := productTarget(p.ID)
+	if made.Action != "POST /products" || made.Target != target || made.Before != "" || made.After != productSummary(p) || made.Status != http.StatusCreated {
+		t.Errorf("create event %+v", made)
+	}
+	if del.Action != "DELETE /products/{id}" || del.Target != target || del.Before != productSummary(p) || del.After != "" {
+		t.Errorf("delete event %+v", del)
+	}
+	refused := auditEvents(t, h, "actor=192.0.2.1&action=/admin/circuit&limit=1", ops)
+	if len(refused) != 1 || refused[0].Actor != "192.0.2.1" || refused[0].Status != http.StatusUnauthorized {
+		t.Errorf("refused call %+v", refused)
+	}
+
+	for query, want := range map[string]int{
+		"target=" + url.QueryEscape(target):                       2,
+		"action=DELETE":                                           1,
+		"request_id=" + circuit.Header().Get("X-Request-Id"):      1,
+		"since=" + time.Now().Add(time.Hour).Format(time.RFC3339): 0,
+	} {
+		if got := auditEvents(t, h, query, ops); len(got) != want {
+			t.Errorf("%s: %d events, want %d", query, len(got), want)
+		}
+	}
+	for _, query := range []string{"since=yesterday", "limit=0", "limit=1001"} {
+		if rec := serve(h, http.MethodGet, "/admin/audit?"+query, "", ops); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", query, rec.Code)
+		}
+	}
+}
+
+// TestAuditFileRotates writes events a line each, rotating the file
+// past its size and keeping the newest rotated files
+func TestAuditFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a := useTestAuditLog(t, defaultAuditBuffer)
+	if err := a.openFile(path, 600, 2); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, nil).Routes()
+	for i := 0; i < 20; i++ {
+		serve(h, http.MethodPost, "/admin/circuit", `{"state":"open"}`, nil)
+	}
+	for deadline := time.Now().Add(10 * time.Second); a.stats()["written"] != int64(20) && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	if st := a.stats(); st["written"] != int64(20) || st["rotated"].(int64) < 2 || st["failed"] != int64(0) {
+		t.Fatalf("stats %v", st)
+	}
+	lines := 0
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := f.Stat()
+		if info.Size() > 600 {
+			t.Errorf("%s is %d bytes, over the 600 it rotates at", name, info.Size())
+		}
+		sc := bufio.NewScanner(f)
+		for ; sc.Scan(); lines++ {
+			var ev auditEvent
+			if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || ev.Action != "POST /admin/circuit" {
+				t.Errorf("%s: %q: %v", name, sc.Text(), err)
+			}
+		}
+		f.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("a third rotated file kept: %v", err)
+	}
+	if lines == 0 || lines >= 20 {
+		t.Errorf("%d events in the kept files, want some of the 20 rotated away", lines)
+	}
+}
+
+// TestAuditDropsWhenFull counts events dropped once the buffer is full,
+// without holding up the calls
+func TestAuditDropsWhenFull(t *testing.T) {
+	a := newAuditLog(2)
+	old := audit
+	audit = a
+	defer func() { audit = old }()
+	h := newTestServer(t, nil).Routes()
+	for i := 0; i < 5; i++ {
+		if rec := serve(h, http.MethodPost, "/admin/circuit", `{"state":"open"}`, nil); rec.Code != http.StatusOK {
+			t.Fatalf("call %d: %d", i, rec.Code)
+		}
+	}
+	var st struct {
+		Audit map[string]interface{} `json:"audit"`
+	}
+	if err := json.Unmarshal(serve(h, http.MethodGet, "/stats", "", nil).Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Audit["recorded"] != 5.0 || st.Audit["dropped"] != 3.0 || st.Audit["pending"] != 2.0 {
+		t.Errorf("stats %v", st.Audit)
+	}
+}
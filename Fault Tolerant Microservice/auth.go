@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Roles are ordered: each one includes the permissions of those before it
+const (
+	roleNone  = ""
+	roleRead  = "read"
+	roleWrite = "write"
+	roleAdmin = "admin"
+)
+
+var roleRank = map[string]int{roleNone: 0, roleRead: 1, roleWrite: 2, roleAdmin: 3}
+
+type apiKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Role string `json:"role"`
+
+	requests int64
+	denied   int64
+}
+
+// loadAPIKeys reads keys from a JSON file ([{"name","key","role"}]) and/or
+// an env style list "name:role:key,...". Either may be empty.
+func loadAPIKeys(file, env string) ([]*apiKey, error) {
+	var keys []*apiKey
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	for i, entry := range strings.Split(env, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			// The entry may well be a bare key, so it isn't echoed
+			return nil, fmt.Errorf("API key entry %d is not name:role:key", i+1)
+		}
+		keys = append(keys, &apiKey{Name: parts[0], Role: parts[1], Key: parts[2]})
+	}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if _, ok := roleRank[k.Role]; !ok || k.Role == roleNone {
+			return nil, fmt.Errorf("API key %q has unknown role %q", k.Name, k.Role)
+		}
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("API key entries need a name and a key")
+		}
+		if seen[k.Name] {
+			return nil, fmt.Errorf("API key name %q used twice", k.Name)
+		}
+		seen[k.Name] = true
+	}
+	return keys, nil
+}
+
+// presentedKey extracts the key from Authorization: Bearer or X-API-Key
+func presentedKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// lookupAPIKey compares against every key in constant time so the
+// response time doesn't reveal how much of a key matched
+func (s *Server) lookupAPIKey(presented string) *apiKey {
+	var found *apiKey
+	for _, k := range s.cfg.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(k.Key)) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+func (s *Server) authEnabled() bool {
+	return len(s.cfg.APIKeys) > 0
+}
+
+// requireRole wraps a handler so it only runs for keys holding role.
+// Read routes stay open unless -require-auth-for-reads is set, but a
+// presented key is still identified for logging and counters.
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() || role == roleNone {
+			next(w, r)
+			return
+		}
+		enforce := role != roleRead || s.cfg.RequireAuthForReads
+		presented := presentedKey(r)
+		if presented == "" {
+			if enforce {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="productsearch"`)
+				writeErr(w, r, newError(ErrUnauthorized, "API key required"))
+				return
+			}
+			next(w, r)
+			return
+		}
+		key := s.lookupAPIKey(presented)
+		if key == nil {
+			atomic.AddInt64(&s.unknownKeyDenials, 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="productsearch", error="invalid_token"`)
+			writeErr(w, r, newError(ErrUnauthorized, "Invalid API key"))
+			return
+		}
+		if info := requestInfoFrom(r); info != nil {
+			info.KeyName = key.Name
+		}
+		if roleRank[key.Role] < roleRank[role] {
+			atomic.AddInt64(&key.denied, 1)
+			writeErr(w, r, newError(ErrForbidden, "API key lacks the "+role+" role"))
+			return
+		}
+		atomic.AddInt64(&key.requests, 1)
+		next(w, r)
+	}
+}
+
+// apiKeyStats reports per key request counters for /stats
+func (s *Server) apiKeyStats() map[string]interface{} {
+	keys := make(map[string]interface{}, len(s.cfg.APIKeys))
+	for _, k := range s.cfg.APIKeys {
+		keys[k.Name] = map[string]interface{}{
+			"role":     k.Role,
+			"requests": atomic.LoadInt64(&k.requests),
+			"denied":   atomic.LoadInt64(&k.denied),
+		}
+	}
+	return map[string]interface{}{
+		"enabled":             s.authEnabled(),
+		"require_auth_reads":  s.cfg.RequireAuthForReads,
+		"invalid_key_denials": atomic.LoadInt64(&s.unknownKeyDenials),
+		"keys":                keys,
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadAPIKeysEnv(t *testing.T) {
+	keys, err := loadAPIKeys("", "ops:admin:s3cret, ci:read:abc:def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Name != "ops" || keys[0].Role != "admin" || keys[1].Key != "abc:def" {
+		t.Errorf("got %+v %+v", keys[0], keys[1])
+	}
+	// A malformed entry is reported by position, never by its text
+	_, err = loadAPIKeys("", "ops:admin:s3cret,hunter2")
+	if err == nil || strings.Contains(err.Error(), "hunter2") || !strings.Contains(err.Error(), "entry 2") {
+		t.Errorf("bare key entry: %v", err)
+	}
+}
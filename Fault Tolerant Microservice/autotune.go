@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// checksTuneSamples is how many sampled searches each decision looks
+	// at. They are all taken at the value in force, since the window
+	// starts afresh after every decision; a window straddling a change
+	// would judge the new value by the old one's latency.
+	checksTuneSamples = 128
+	// checksTunePercentile is the latency the tuner holds to the target
+	checksTunePercentile = 0.95
+	// checksTuneHeadroom is how far below the target the percentile must
+	// be before the sample grows
+	checksTuneHeadroom = 0.7
+	// checksTuneAim is where in the band between the headroom and the
+	// target a change aims the percentile
+	checksTuneAim = 0.85
+	// checksTuneStep bounds one change to this factor either way
+	checksTuneStep = 2
+)
+
+// checksTuner sets ChecksPerSearch from the latency of sampled searches.
+// While their p95 is above the target, or below checksTuneHeadroom of it,
+// the sample is scaled by how far off it is, aiming at checksTuneAim of
+// the target; in between it holds. It stays within [min, max].
+//
+// It doesn't oscillate under steady load because a change lands in the
+// band it holds in. Search latency grows about linearly with the sample,
+// so aiming at the middle leaves room either side for noise and for the
+// line not being quite straight, and bounding a step keeps a far-off
+// reading, like one from a cold cache, from throwing the sample across
+// the whole range.
+type checksTuner struct {
+	target   time.Duration
+	min, max int
+	current  int64
+
+	mu      sync.Mutex
+	samples []time.Duration
+	last    time.Duration
+	raised  int64
+	lowered int64
+	held    int64
+}
+
+// newChecksTuner starts at start, brought into [min, max]
+func newChecksTuner(target time.Duration, min, max, start int) *checksTuner {
+	if start < min {
+		start = min
+	}
+	if start > max {
+		start = max
+	}
+	return &checksTuner{target: target, min: min, max: max, current: int64(start), samples: make([]time.Duration, 0, checksTuneSamples)}
+}
+
+// checks is the sample size in force
+func (t *checksTuner) checks() int {
+	return int(atomic.LoadInt64(&t.current))
+}
+
+// observe adds the latency of a sampled search that checked the tuned
+// count, deciding once the window is full
+func (t *checksTuner) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, d)
+	if len(t.samples) < checksTuneSamples {
+		return
+	}
+	sort.Slice(t.samples, func(i, j int) bool { return t.samples[i] < t.samples[j] })
+	p := t.samples[int(checksTunePercentile*float64(len(t.samples)-1))]
+	t.samples = t.samples[:0]
+	t.last = p
+
+	n := t.checks()
+	over := p > t.target && n > t.min
+	under := float64(p) < checksTuneHeadroom*float64(t.target) && n < t.max
+	if !over && !under {
+		t.held++
+		return
+	}
+	scale := float64(checksTuneStep)
+	if p > 0 {
+		scale = math.Max(1/scale, math.Min(scale, checksTuneAim*float64(t.target)/float64(p)))
+	}
+	next := int(float64(n) * scale)
+	switch {
+	case over:
+		next = min(next, n-1)
+		if next < t.min {
+			next = t.min
+		}
+		t.lowered++
+	default:
+		next = max(next, n+1)
+		if next > t.max {
+			next = t.max
+		}
+		t.raised++
+	}
+	atomic.StoreInt64(&t.current, int64(next))
+}
+
+func (t *checksTuner) stats() map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":           true,
+		"target_ms":         durationMS(t.target),
+		"min":               t.min,
+		"max":               t.max,
+		"checks_per_search": t.checks(),
+		"p95_ms":            durationMS(t.last),
+		"window":            len(t.samples),
+		"raised":            t.raised,
+		"lowered":           t.lowered,
+		"held":              t.held,
+	}
+}
+
+// checksPerSearch is the sample size for sampled searches: the tuner's
+// while it is on, otherwise Config.ChecksPerSearch
+func (s *Server) checksPerSearch() int {
+	if s.checksTuner != nil {
+		return s.checksTuner.checks()
+	}
+	return s.cfg.ChecksPerSearch
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tuner test settings: a latency target, the bounds, and how many
+// decision windows each load runs for, the first half to settle in
+const (
+	tuneTestTarget  = 20 * time.Millisecond
+	tuneTestMin     = 10
+	tuneTestMax     = 1000
+	tuneTestWindows = 60
+)
+
+// TestChecksTunerSettles drives a tuner with simulated searches on a
+// manual clock, each taking the sample size times a per-check cost, plus
+// up to a tenth either way of noise. Under each load the tuner must settle
+// within the first half of the windows and then hold still: no change in
+// the second half, its p95 under the target and, unless a bound stops it,
+// not so far under that a raise would be due. The loads step from cheap
+// to dear to beyond what even the minimum can meet, then back.
+func TestChecksTunerSettles(t *testing.T) {
+	clock := newManualClock(time.Unix(0, 0).UTC())
+	tuner := newChecksTuner(tuneTestTarget, tuneTestMin, tuneTestMax, 100)
+	rnd := rand.New(rand.NewSource(1))
+	for _, load := range []struct {
+		perCheck time.Duration
+		want     int
+	}{
+		{10 * time.Microsecond, tuneTestMax},
+		{50 * time.Microsecond, 0},
+		{200 * time.Microsecond, 0},
+		{5 * time.Millisecond, tuneTestMin},
+		{50 * time.Microsecond, 0},
+	} {
+		settled := 0
+		for w := 0; w < tuneTestWindows; w++ {
+			if w == tuneTestWindows/2 {
+				settled = tuner.checks()
+			}
+			for i := 0; i < checksTuneSamples; i++ {
+				start := clock.Now()
+				cost := time.Duration(tuner.checks()) * load.perCheck
+				clock.Advance(cost + time.Duration((rnd.Float64()*0.2-0.1)*float64(cost)))
+				tuner.observe(clock.Since(start))
+			}
+			if w >= tuneTestWindows/2 && tuner.checks() != settled {
+				t.Fatalf("at %v a check: sample size moved from %d to %d after settling", load.perCheck, settled, tuner.checks())
+			}
+		}
+		n, p := tuner.checks(), tuner.last
+		switch {
+		case load.want != 0 && n != load.want:
+			t.Errorf("at %v a check: settled at %d, want the bound %d", load.perCheck, n, load.want)
+		case load.want == 0 && p > tuneTestTarget:
+			t.Errorf("at %v a check: p95 %v over the %v target at %d", load.perCheck, p, tuneTestTarget, n)
+		case load.want == 0 && float64(p) < checksTuneHeadroom*float64(tuneTestTarget):
+			t.Errorf("at %v a check: p95 %v left headroom unused at %d", load.perCheck, p, n)
+		}
+	}
+}
+
+// TestChecksTunerDecisions checks one window's decision: a p95 over the
+// target lowers the sample, one under the headroom raises it, each aiming
+// at checksTuneAim of the target but by no more than checksTuneStep, and
+// one in between holds
+func TestChecksTunerDecisions(t *testing.T) {
+	for _, tc := range []struct {
+		start int
+		p95   time.Duration
+		want  int
+	}{
+		{100, 17 * time.Millisecond, 100},
+		{100, 20 * time.Millisecond, 100},
+		{100, 34 * time.Millisecond, 50},
+		{100, time.Second, 50},
+		{100, 10 * time.Millisecond, 170},
+		{100, time.Millisecond, 200},
+		{100, 0, 200},
+		{15, time.Second, tuneTestMin},
+		{tuneTestMin, time.Second, tuneTestMin},
+		{900, time.Millisecond, tuneTestMax},
+		{5000, 17 * time.Millisecond, tuneTestMax},
+	} {
+		tuner := newChecksTuner(tuneTestTarget, tuneTestMin, tuneTestMax, tc.start)
+		for i := 0; i < checksTuneSamples-1; i++ {
+			tuner.observe(tc.p95)
+			if i == 0 && tuner.checks() != min(max(tc.start, tuneTestMin), tuneTestMax) {
+				t.Fatalf("start %d: changed to %d before the window filled", tc.start, tuner.checks())
+			}
+		}
+		tuner.observe(tc.p95)
+		if got := tuner.checks(); got != tc.want {
+			t.Errorf("start %d with p95 %v: %d, want %d", tc.start, tc.p95, got, tc.want)
+		}
+	}
+}
+
+// TestChecksTunerSetsSearches checks sampled searches check the tuned
+// count, and feed the tuner, while exhaustive ones do neither
+func TestChecksTunerSetsSearches(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ChecksTuneTarget, cfg.ChecksTuneMin, cfg.ChecksTuneMax = tuneTestTarget, 5, 50
+		cfg.ChecksPerSearch = 40
+	})
+	h := s.Routes()
+	if res := search(t, h, "/products/search?debug=1&q=product"); res.CheckedCount != 40 {
+		t.Errorf("checked %d, want the 40 the tuner starts from", res.CheckedCount)
+	}
+	atomic.StoreInt64(&s.checksTuner.current, 7)
+	if res := search(t, h, "/products/search?debug=1&q=product"); res.CheckedCount != 7 {
+		t.Errorf("checked %d, want the tuned 7", res.CheckedCount)
+	}
+	search(t, h, "/products/search?mode=exhaustive&q=product")
+	if st := s.checksTuner.stats(); st["window"] != 2 {
+		t.Errorf("the tuner saw %v searches, want the 2 sampled", st["window"])
+	}
+
+	// A deterministic clock reads every search as instant, so no tuner
+	s = newTestServer(t, func(cfg *Config) { cfg.ChecksTuneTarget, cfg.Deterministic = tuneTestTarget, true })
+	if s.checksTuner != nil {
+		t.Errorf("tuning in deterministic mode")
+	}
+}
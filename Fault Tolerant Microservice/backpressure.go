@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backpressureHeader carries the suggested delay, in milliseconds, on
+// every response while searches are busy past the threshold
+const backpressureHeader = "X-Backpressure"
+
+// backpressureInterval is how often the suggested delay is recomputed;
+// responses in between all carry the same one
+const backpressureInterval = 250 * time.Millisecond
+
+// backpressureMinLatency stands in for the search latency before any
+// search has been timed
+const backpressureMinLatency = 10 * time.Millisecond
+
+// backpressure asks cooperative clients to slow down before the overload
+// check has to start rejecting them. Every backpressureInterval, run
+// turns utilization (searches in flight or spilled, over MaxConcurrent),
+// the searches queued for a bulkhead slot and the mean search latency
+// since the last refresh into one suggested delay, which every response
+// then only has to read.
+type backpressure struct {
+	threshold float64
+	maxDelay  time.Duration
+	delayMS   int64
+	signalled int64
+
+	// mu guards what refresh keeps between runs and reports to /stats
+	mu        sync.Mutex
+	lastCount int64
+	lastSum   time.Duration
+	latency   time.Duration
+	util      float64
+	queued    int
+}
+
+// newBackpressure returns a backpressure that never signals when
+// threshold is 0
+func newBackpressure(threshold float64, maxDelay time.Duration) *backpressure {
+	return &backpressure{threshold: threshold, maxDelay: maxDelay}
+}
+
+func (b *backpressure) enabled() bool {
+	return b.threshold > 0
+}
+
+// refresh recomputes the suggested delay. Above the threshold it is the
+// latency scaled by how far into the remaining headroom utilization has
+// gone, plus the time a slot takes to work through each queued search,
+// capped at maxDelay.
+func (b *backpressure) refresh(s *Server) {
+	slots := float64(s.cfg.MaxConcurrent)
+	load := atomic.LoadInt32(&s.inFlight) + s.spill.depth()
+	util := float64(load) / slots
+	queued := s.bulkhead.Stats().Waiting + int(s.spill.depth())
+	count, sum := s.metrics.totals("/products/search")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := count - b.lastCount; n > 0 {
+		mean := (sum - b.lastSum) / time.Duration(n)
+		if b.latency == 0 {
+			b.latency = mean
+		} else {
+			// Smoothed, so one slow or idle interval doesn't swing it
+			b.latency = (3*b.latency + mean) / 4
+		}
+	}
+	b.lastCount, b.lastSum = count, sum
+	b.util, b.queued = util, queued
+
+	var delay time.Duration
+	if util > b.threshold {
+		latency := b.latency
+		if latency < backpressureMinLatency {
+			latency = backpressureMinLatency
+		}
+		excess := math.Min(1, (util-b.threshold)/(1-b.threshold))
+		delay = time.Duration(float64(latency) * (excess + float64(queued)/slots))
+		if delay > b.maxDelay {
+			delay = b.maxDelay
+		}
+	}
+	atomic.StoreInt64(&b.delayMS, int64(math.Ceil(durationMS(delay))))
+}
+
+// run refreshes the delay every backpressureInterval; main starts it
+func (b *backpressure) run(s *Server) {
+	for {
+		time.Sleep(backpressureInterval)
+		b.refresh(s)
+	}
+}
+
+// hint sets or clears the header with the current delay, noting it in
+// the requestInfo for envelopes to repeat. A tenant's server calls it
+// again for its own requests, so they carry its delay rather than the
+// instance's.
+func (b *backpressure) hint(w http.ResponseWriter, r *http.Request) {
+	delay := atomic.LoadInt64(&b.delayMS)
+	if info := requestInfoFrom(r); info != nil {
+		info.Backpressure = int(delay)
+	}
+	if delay == 0 {
+		w.Header().Del(backpressureHeader)
+		return
+	}
+	w.Header().Set(backpressureHeader, strconv.FormatInt(delay, 10))
+	atomic.AddInt64(&b.signalled, 1)
+}
+
+// middleware sets the header before the handler runs, so it is on every
+// response, those written by the coalescing and cache layers included
+func (b *backpressure) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b.hint(w, r)
+		next(w, r)
+	}
+}
+
+func (b *backpressure) stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":      b.enabled(),
+		"threshold":    b.threshold,
+		"max_delay_ms": durationMS(b.maxDelay),
+		"delay_ms":     atomic.LoadInt64(&b.delayMS),
+		"utilization":  b.util,
+		"queued":       b.queued,
+		"latency_ms":   durationMS(b.latency),
+		"signalled":    atomic.LoadInt64(&b.signalled),
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"productsearch/resilience"
+)
+
+// circuitState is the breaker state as reported by /circuit. Threshold
+// applies to the consecutive policy and the window fields to the windowed
+// one.
+type circuitState struct {
+	State string `json:"state"`
+	// OpenReason is why the breaker last opened: failures, latency or
+	// forced. Empty while closed.
+	OpenReason  string `json:"open_reason,omitempty"`
+	Policy      string `json:"policy"`
+	Forced      bool   `json:"forced"`
+	Failures    int64  `json:"failures"`
+	Threshold   int    `json:"threshold,omitempty"`
+	CooldownMS  int64  `json:"cooldown_ms"`
+	LastFailure string `json:"last_failure,omitempty"`
+	// RestoredFrom is when the state this breaker started from was saved,
+	// empty if it started fresh
+	RestoredFrom string `json:"restored_from,omitempty"`
+
+	WindowMS             int64   `json:"window_ms,omitempty"`
+	WindowRequests       int64   `json:"window_requests,omitempty"`
+	WindowFailures       int64   `json:"window_failures,omitempty"`
+	FailureRate          float64 `json:"failure_rate,omitempty"`
+	FailureRateThreshold float64 `json:"failure_rate_threshold,omitempty"`
+	MinRequests          int     `json:"min_requests,omitempty"`
+	FailureOpens         int64   `json:"failure_opens"`
+
+	// Latency is the slow call detector, absent when it is off
+	Latency *latencyState `json:"latency,omitempty"`
+
+	// Dependencies are the breakers guarding downstream calls, by name
+	Dependencies map[string]circuitState `json:"dependencies,omitempty"`
+}
+
+// latencyState reports the slow call detector in /circuit
+type latencyState struct {
+	SlowCallMS   float64 `json:"slow_call_ms"`
+	Percentile   float64 `json:"percentile"`
+	WindowMS     int64   `json:"window_ms"`
+	SustainMS    int64   `json:"sustain_ms"`
+	MinCalls     int     `json:"min_calls"`
+	SlowCalls    int64   `json:"slow_calls"`
+	Opens        int64   `json:"opens"`
+	Samples      int64   `json:"window_samples"`
+	WindowSlow   int64   `json:"window_slow"`
+	PercentileMS float64 `json:"percentile_ms"`
+	SlowSince    string  `json:"slow_since,omitempty"`
+}
+
+func breakerCircuitState(b *resilience.Breaker) circuitState {
+	cfg, snap := b.Config(), b.Snapshot()
+	cs := circuitState{
+		State:        resilience.StateName(snap.State),
+		OpenReason:   snap.OpenReason,
+		Policy:       cfg.Policy,
+		Forced:       snap.Forced,
+		Failures:     snap.Failures,
+		CooldownMS:   cfg.Cooldown.Milliseconds(),
+		FailureOpens: snap.FailureOpens,
+	}
+	if cfg.SlowCall > 0 {
+		cs.Latency = &latencyState{
+			SlowCallMS:   durationMS(cfg.SlowCall),
+			Percentile:   cfg.SlowPercentile,
+			WindowMS:     cfg.SlowWindow.Milliseconds(),
+			SustainMS:    cfg.SlowSustain.Milliseconds(),
+			MinCalls:     cfg.SlowMinCalls,
+			SlowCalls:    snap.SlowCalls,
+			Opens:        snap.LatencyOpens,
+			Samples:      snap.LatencySamples,
+			WindowSlow:   snap.LatencySlow,
+			PercentileMS: durationMS(snap.LatencyPercentile),
+		}
+		if !snap.SlowSince.IsZero() {
+			cs.Latency.SlowSince = snap.SlowSince.Format(time.RFC3339Nano)
+		}
+	}
+	if cfg.Policy == resilience.PolicyWindowed {
+		cs.WindowMS = cfg.Window.Milliseconds()
+		cs.WindowRequests, cs.WindowFailures = snap.WindowRequests, snap.WindowFailures
+		if cs.WindowRequests > 0 {
+			cs.FailureRate = float64(cs.WindowFailures) / float64(cs.WindowRequests)
+		}
+		cs.FailureRateThreshold = cfg.FailureRate
+		cs.MinRequests = cfg.MinRequests
+	} else {
+		cs.Threshold = cfg.Threshold
+	}
+	if !snap.LastFailure.IsZero() {
+		cs.LastFailure = snap.LastFailure.Format(time.RFC3339Nano)
+	}
+	if !snap.RestoredFrom.IsZero() {
+		cs.RestoredFrom = snap.RestoredFrom.Format(time.RFC3339Nano)
+	}
+	return cs
+}
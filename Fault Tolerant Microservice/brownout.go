@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// brownoutStep is how much work a search may do at one brownout level
+type brownoutStep struct {
+	// checks is the fraction of ChecksPerSearch sampled
+	checks float64
+	// scanLimit caps the products checked by exhaustive, filtered and
+	// indexed searches; 0 leaves them whole
+	scanLimit int
+}
+
+// brownoutLadder holds levels 1 and up; level 0 is full quality. Each
+// threshold configured enables the next step.
+var brownoutLadder = []brownoutStep{
+	{checks: 0.5},
+	{checks: 0.25, scanLimit: 20000},
+	{checks: 0.1, scanLimit: 5000},
+}
+
+// brownout degrades searches as utilization (in-flight searches over
+// MaxConcurrent) crosses its thresholds, before the overload check starts
+// rejecting them
+type brownout struct {
+	thresholds []float64
+	level      int32
+	// degraded counts searches served at each level, index 0 unused
+	degraded []int64
+}
+
+// newBrownout validates ascending thresholds in (0, 1]. No thresholds
+// disables it.
+func newBrownout(thresholds []float64) (*brownout, error) {
+	if len(thresholds) > len(brownoutLadder) {
+		return nil, fmt.Errorf("brownout: at most %d thresholds, got %d", len(brownoutLadder), len(thresholds))
+	}
+	for i, t := range thresholds {
+		if t <= 0 || t > 1 || (i > 0 && t <= thresholds[i-1]) {
+			return nil, fmt.Errorf("brownout: thresholds must be ascending and in (0, 1], got %v", thresholds)
+		}
+	}
+	return &brownout{thresholds: thresholds, degraded: make([]int64, len(thresholds)+1)}, nil
+}
+
+// parseThresholds reads a comma separated list such as "0.5,0.7,0.9"
+func parseThresholds(s string) ([]float64, error) {
+	var out []float64
+	for _, f := range parseList(s) {
+		t, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("brownout: bad threshold %q", f)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// observe picks the level for a search at the given utilization
+func (b *brownout) observe(util float64) int {
+	level := 0
+	for _, t := range b.thresholds {
+		if util >= t {
+			level++
+		}
+	}
+	atomic.StoreInt32(&b.level, int32(level))
+	if level > 0 {
+		atomic.AddInt64(&b.degraded[level], 1)
+	}
+	return level
+}
+
+// degradation tells the client what a search skipped: "sample" when
+// brownout sampled fewer products, "scan" when it cut an exhaustive
+// candidate list short, "budget" when the work budget did, and "stock"
+// when the inventory dependency was unavailable
+type degradation struct {
+	Level           int      `json:"level"`
+	ChecksPerSearch int      `json:"checks_per_search,omitempty"`
+	ScanLimit       int      `json:"scan_limit,omitempty"`
+	Skipped         []string `json:"skipped"`
+	// StockSkipped are the inventory categories whose results went out
+	// without stock, when Skipped has "stock"
+	StockSkipped []string `json:"stock_skipped,omitempty"`
+}
+
+// header renders d for X-Degraded, e.g. "level=2; skipped=scan" or
+// "level=0; skipped=stock; stock=Books"
+func (d *degradation) header() string {
+	h := fmt.Sprintf("level=%d; skipped=%s", d.Level, strings.Join(d.Skipped, ","))
+	if len(d.StockSkipped) > 0 {
+		h += "; stock=" + strings.Join(d.StockSkipped, ",")
+	}
+	return h
+}
+
+func (b *brownout) stats() map[string]interface{} {
+	degraded := make(map[string]int64, len(b.thresholds))
+	for level := 1; level < len(b.degraded); level++ {
+		degraded[strconv.Itoa(level)] = atomic.LoadInt64(&b.degraded[level])
+	}
+	return map[string]interface{}{
+		"enabled":    len(b.thresholds) > 0,
+		"thresholds": b.thresholds,
+		"level":      atomic.LoadInt32(&b.level),
+		"degraded":   degraded,
+	}
+}
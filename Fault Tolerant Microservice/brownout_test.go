@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseThresholds(t *testing.T) {
+	got, err := parseThresholds(" 0.3, 0.6,0.9 ")
+	if err != nil || fmt.Sprint(got) != "[0.3 0.6 0.9]" {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if got, err := parseThresholds(""); err != nil || got != nil {
+		t.Errorf("empty: %v, %v", got, err)
+	}
+	if _, err := parseThresholds("0.5,high"); err == nil {
+		t.Errorf("a threshold that isn't a number was accepted")
+	}
+	for _, bad := range [][]float64{{0}, {0.5, 1.1}, {0.6, 0.5}, {0.5, 0.5}, {0.2, 0.4, 0.6, 0.8}} {
+		if _, err := newBrownout(bad); err == nil {
+			t.Errorf("%v was accepted", bad)
+		}
+	}
+}
+
+// brownoutResponse is the part of a search response brownout shows in
+type brownoutResponse struct {
+	CheckedCount int          `json:"checked_request"`
+	Degraded     *degradation `json:"degraded"`
+}
+
+// TestBrownoutLadder walks utilization up past each threshold and back
+// down, checking searches do less at each step and recover on the way
+// down
+func TestBrownoutLadder(t *testing.T) {
+	thresholds, err := parseThresholds("0.3,0.6,0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.BrownoutThresholds = thresholds
+		cfg.MaxConcurrent = 10
+		cfg.ChecksPerSearch = testProducts
+		cfg.ResponseCache = 0
+	})
+	h := s.Routes()
+	// The search counts itself, so k in flight is k-1 others
+	levelAt := func(load int) int {
+		switch {
+		case load >= 9:
+			return 3
+		case load >= 6:
+			return 2
+		case load >= 3:
+			return 1
+		}
+		return 0
+	}
+	loads := []int{1, 2, 3, 5, 6, 8, 9, 10, 9, 7, 4, 2, 1}
+	for _, load := range loads {
+		atomic.StoreInt32(&s.inFlight, int32(load-1))
+		rec := serve(h, http.MethodGet, "/products/search?debug=1&q=product", "", nil)
+		atomic.StoreInt32(&s.inFlight, 0)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("load %d: %d %s", load, rec.Code, rec.Body)
+		}
+		var got brownoutResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		level := levelAt(load)
+		if level == 0 {
+			if got.Degraded != nil || rec.Header().Get("X-Degraded") != "" || got.CheckedCount != testProducts {
+				t.Errorf("load %d: degraded %+v, %d checked, want full quality", load, got.Degraded, got.CheckedCount)
+			}
+			continue
+		}
+		checks := int(float64(testProducts) * brownoutLadder[level-1].checks)
+		if got.Degraded == nil || got.Degraded.Level != level || got.Degraded.ChecksPerSearch != checks || got.CheckedCount != checks {
+			t.Errorf("load %d: degraded %+v, %d checked, want level %d checking %d", load, got.Degraded, got.CheckedCount, level, checks)
+			continue
+		}
+		if want := fmt.Sprintf("level=%d; skipped=sample", level); rec.Header().Get("X-Degraded") != want {
+			t.Errorf("load %d: X-Degraded %q, want %q", load, rec.Header().Get("X-Degraded"), want)
+		}
+	}
+
+	st := s.brownout.stats()
+	if st["level"] != int32(0) {
+		t.Errorf("level %v after the load went back down", st["level"])
+	}
+	counts := map[int]int64{}
+	for _, load := range loads {
+		if level := levelAt(load); level > 0 {
+			counts[level]++
+		}
+	}
+	degraded := st["degraded"].(map[string]int64)
+	for level := 1; level <= len(thresholds); level++ {
+		if got := degraded[fmt.Sprint(level)]; got != counts[level] {
+			t.Errorf("level %d counted %d searches, want %d", level, got, counts[level])
+		}
+	}
+}
+
+// TestBrownoutScanLimit cuts an exhaustive search's candidates at the
+// top step, where the sample cut doesn't apply
+func TestBrownoutScanLimit(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.NumProducts = 6000
+		cfg.BrownoutThresholds = []float64{0.3, 0.6, 0.9}
+		cfg.MaxConcurrent = 10
+		cfg.MaxResults = 1
+		cfg.ResponseCache = 0
+	})
+	h := s.Routes()
+	for _, tc := range []struct {
+		load    int
+		checked int
+		header  string
+	}{
+		{6, 6000, ""},
+		{9, brownoutLadder[2].scanLimit, "level=3; skipped=scan"},
+		{1, 6000, ""},
+	} {
+		atomic.StoreInt32(&s.inFlight, int32(tc.load-1))
+		rec := serve(h, http.MethodGet, "/products/search?debug=1&mode=exhaustive&q=product", "", nil)
+		atomic.StoreInt32(&s.inFlight, 0)
+		var got brownoutResponse
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		if rec.Code != http.StatusOK || got.CheckedCount != tc.checked || rec.Header().Get("X-Degraded") != tc.header {
+			t.Errorf("load %d: %d, %d checked, X-Degraded %q; want %d checked, %q",
+				tc.load, rec.Code, got.CheckedCount, rec.Header().Get("X-Degraded"), tc.checked, tc.header)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// responseCache keeps encoded search responses. Entries are spread over
+// shards by a consistent hash of the normalized request, so a hot query
+// always lands on the same shard and each shard has its own lock and LRU.
+//
+// Only searches whose response is a function of the catalog are cached:
+// exhaustive and indexed ones, without debug output, brownout, stock,
+// suggestions or snapshots. An entry keeps its query, so a mutation only
+// drops the entries the product matched before or after it; a change to
+// fields no search looks at only drops entries whose page contains the
+// product, and a per shard bloom filter of those IDs lets most shards
+// skip even that.
+type responseCache struct {
+	shards []*cacheShard
+	// latest is the catalog's latest event ID
+	latest func() int64
+	// raced counts fills dropped because the catalog changed while the
+	// response was being computed
+	raced int64
+}
+
+type cacheShard struct {
+	mu      sync.Mutex
+	cap     int
+	entries map[string]*cacheEntry
+	lru     list.List // of *cacheEntry, most recently used at the front
+	bloom   idBloom
+	// removed counts entries gone since the bloom was last rebuilt; the
+	// bloom can't forget their IDs, so it is rebuilt once they outnumber
+	// the live ones
+	removed int
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	invalidated int64
+	bloomSkips  int64
+}
+
+// cacheEntry is one stored response and the query it answered
+type cacheEntry struct {
+	key             string
+	status          int
+	header          http.Header
+	body            []byte
+	text            searchText
+	brand, category string
+	// ids are the products in the body, sorted
+	ids  []ProductID
+	elem *list.Element
+}
+
+// cacheFill is how the search handler tells the cache layer its response
+// may be stored and what it depends on. event is the catalog's latest
+// event ID before the search ran.
+type cacheFill struct {
+	ok              bool
+	event           int64
+	text            searchText
+	brand, category string
+	ids             []ProductID
+}
+
+type cacheFillKey struct{}
+
+// cacheFillFrom returns the fill for r, nil unless the cache layer is on
+func cacheFillFrom(r *http.Request) *cacheFill {
+	fill, _ := r.Context().Value(cacheFillKey{}).(*cacheFill)
+	return fill
+}
+
+func newResponseCache(entries, shards, maxResults int, latest func() int64) (*responseCache, error) {
+	if shards < 1 || entries < shards {
+		return nil, fmt.Errorf("response cache: need at least 1 shard and at least one entry per shard")
+	}
+	c := &responseCache{latest: latest}
+	shardCap := (entries + shards - 1) / shards
+	// About 10 bits per ID for a full shard keeps false positives near 1%
+	bits := 1024
+	for bits < shardCap*maxResults*10 {
+		bits <<= 1
+	}
+	for i := 0; i < shards; i++ {
+		c.shards = append(c.shards, &cacheShard{cap: shardCap, entries: make(map[string]*cacheEntry), bloom: newIDBloom(bits)})
+	}
+	return c, nil
+}
+
+// resize changes how many entries the cache holds, evicting the least
+// recently used in each shard beyond its share
+func (c *responseCache) resize(entries int) {
+	shardCap := max(1, (entries+len(c.shards)-1)/len(c.shards))
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		sh.cap = shardCap
+		for sh.lru.Len() > sh.cap {
+			sh.evictions++
+			sh.removeLocked(sh.lru.Back().Value.(*cacheEntry))
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// shard picks key's shard with a jump consistent hash, so changing the
+// shard count moves as few queries as possible
+func (c *responseCache) shard(key string) *cacheShard {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return c.shards[jumpHash(h.Sum64(), len(c.shards))]
+}
+
+// jumpHash is Lamping and Veach's jump consistent hash
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (sh *cacheShard) get(key string) (*cacheEntry, bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.entries[key]
+	if !ok {
+		sh.misses++
+		return nil, false
+	}
+	sh.hits++
+	sh.lru.MoveToFront(e.elem)
+	return e, true
+}
+
+// add stores e unless the catalog changed since fill.event. The check is
+// made under the shard lock, which invalidation also takes after the
+// change is published, so a fill computed before a change is either
+// refused here or dropped by the invalidation.
+func (c *responseCache) add(sh *cacheShard, e *cacheEntry, event int64) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if c.latest() != event {
+		atomic.AddInt64(&c.raced, 1)
+		return false
+	}
+	if old, ok := sh.entries[e.key]; ok {
+		sh.removeLocked(old)
+	}
+	for sh.lru.Len() >= sh.cap {
+		sh.evictions++
+		sh.removeLocked(sh.lru.Back().Value.(*cacheEntry))
+	}
+	e.elem = sh.lru.PushFront(e)
+	sh.entries[e.key] = e
+	for _, id := range e.ids {
+		sh.bloom.add(id)
+	}
+	return true
+}
+
+func (sh *cacheShard) removeLocked(e *cacheEntry) {
+	delete(sh.entries, e.key)
+	sh.lru.Remove(e.elem)
+	sh.removed++
+	if sh.removed > len(sh.entries) {
+		sh.bloom.reset()
+		for _, e := range sh.entries {
+			for _, id := range e.ids {
+				sh.bloom.add(id)
+			}
+		}
+		sh.removed = 0
+	}
+}
+
+// matches reports whether sp, if set, is in e's match set
+func (e *cacheEntry) matches(sp *storedProduct) bool {
+	return sp != nil && sp.scanMatch(e.text, e.brand, e.category) == ""
+}
+
+func (e *cacheEntry) contains(id ProductID) bool {
+	i := searchID(e.ids, id)
+	return i < len(e.ids) && e.ids[i] == id
+}
+
+// changed drops the entries a mutation may have made stale. old and new
+// are the product before and after, nil for a create or a delete; moved
+// is the product a delete swapped into the freed catalog position, whose
+// place in exhaustive results changed with it.
+func (c *responseCache) changed(old, new, moved *storedProduct) {
+	stale := func(e *cacheEntry) bool { return e.matches(old) || e.matches(new) || e.matches(moved) }
+	contentOnly := old != nil && new != nil && sameMatchFields(old, new)
+	if contentOnly {
+		// Every match set is as it was; only pages showing it are stale
+		stale = func(e *cacheEntry) bool { return e.contains(old.ID) }
+	}
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		if contentOnly && !sh.bloom.mayContain(old.ID) {
+			sh.bloomSkips++
+			sh.mu.Unlock()
+			continue
+		}
+		for _, e := range sh.entries {
+			if stale(e) {
+				sh.invalidated++
+				sh.removeLocked(e)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// sameMatchFields reports whether no search could tell a and b apart:
+// they differ at most in fields that are shown but never matched on
+func sameMatchFields(a, b *storedProduct) bool {
+	if a.Name != b.Name || a.Category != b.Category || a.Brand != b.Brand || len(a.Names) != len(b.Names) {
+		return false
+	}
+	if (a.Price == nil) != (b.Price == nil) || (a.Price != nil && *a.Price != *b.Price) {
+		return false
+	}
+	for locale, n := range a.Names {
+		if b.Names[locale] != n {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *responseCache) stats() map[string]interface{} {
+	shards := make([]map[string]interface{}, len(c.shards))
+	var entries, capacity int
+	var hits, misses, evictions, invalidated, skips int64
+	for i, sh := range c.shards {
+		sh.mu.Lock()
+		shards[i] = map[string]interface{}{
+			"entries":     len(sh.entries),
+			"hits":        sh.hits,
+			"misses":      sh.misses,
+			"evictions":   sh.evictions,
+			"invalidated": sh.invalidated,
+			"bloom_skips": sh.bloomSkips,
+			"bloom_fill":  sh.bloom.fill(),
+		}
+		entries += len(sh.entries)
+		capacity += sh.cap
+		hits += sh.hits
+		misses += sh.misses
+		evictions += sh.evictions
+		invalidated += sh.invalidated
+		skips += sh.bloomSkips
+		sh.mu.Unlock()
+	}
+	return map[string]interface{}{
+		"enabled":     true,
+		"entries":     entries,
+		"capacity":    capacity,
+		"hits":        hits,
+		"misses":      misses,
+		"evictions":   evictions,
+		"invalidated": invalidated,
+		"bloom_skips": skips,
+		"raced":       atomic.LoadInt64(&c.raced),
+		"shards":      shards,
+	}
+}
+
+func (s *Server) responseCacheStats() map[string]interface{} {
+	if s.responses == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return s.responses.stats()
+}
+
+// cache wraps the search handler with the response cache. It sits outside
+// coalescing, so a hit needs no execution at all and a miss can still
+// share one; only the execution's own request stores its response. Hits
+// carry X-Cache: hit.
+func (s *Server) cache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := s.responses
+		if c == nil || !coalescable(r) {
+			next(w, r)
+			return
+		}
+		key := searchKey(r)
+		sh := c.shard(key)
+		if e, ok := sh.get(key); ok {
+			s.countPopular(key)
+			s.statsd.incr("search.cache", "result:hit")
+			w.Header().Set("X-Cache", "hit")
+			(&coalescedCall{status: e.status, header: e.header, body: e.body}).writeTo(w)
+			return
+		}
+		s.statsd.incr("search.cache", "result:miss")
+		fill := &cacheFill{event: c.latest()}
+		rec := &coalesceRecorder{header: make(http.Header)}
+		next(rec, r.WithContext(context.WithValue(r.Context(), cacheFillKey{}, fill)))
+		if rec.status == 0 {
+			return
+		}
+		if fill.ok && rec.status == http.StatusOK {
+			sortIDs(fill.ids)
+			e := &cacheEntry{
+				key: key, status: rec.status, header: rec.header, body: rec.body.Bytes(),
+				text: fill.text, brand: fill.brand, category: fill.category, ids: fill.ids,
+			}
+			c.add(sh, e, fill.event)
+			s.countPopular(key)
+		}
+		(&coalescedCall{status: rec.status, header: rec.header, body: rec.body.Bytes()}).writeTo(w)
+	}
+}
+
+// countPopular counts a search the cache could answer, for the next
+// start's warmup. A truncated key couldn't be replayed, so long ones
+// aren't counted.
+func (s *Server) countPopular(key string) {
+	if s.popular != nil && s.popular.guard.fits(key) {
+		s.popular.record(key)
+	}
+}
+
+// idBloom is a bloom filter of product IDs with three probes per ID. Its
+// size is a power of two so a probe is a mask.
+type idBloom struct {
+	bits []uint64
+	mask uint64
+	set  int
+}
+
+func newIDBloom(bits int) idBloom {
+	return idBloom{bits: make([]uint64, bits/64), mask: uint64(bits - 1)}
+}
+
+// probes derives the three bit positions for id from one 64 bit mix
+func (b *idBloom) probes(id ProductID) [3]uint64 {
+	x := uint64(id) + 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	h1, h2 := x&0xffffffff, x>>32|1
+	return [3]uint64{h1 & b.mask, (h1 + h2) & b.mask, (h1 + 2*h2) & b.mask}
+}
+
+func (b *idBloom) add(id ProductID) {
+	for _, p := range b.probes(id) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			b.bits[p/64] |= 1 << (p % 64)
+			b.set++
+		}
+	}
+}
+
+func (b *idBloom) mayContain(id ProductID) bool {
+	for _, p := range b.probes(id) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *idBloom) reset() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+	b.set = 0
+}
+
+// fill is the fraction of bits set, which decides the false positive rate
+func (b *idBloom) fill() float64 {
+	return float64(b.set) / float64(len(b.bits)*64)
+}
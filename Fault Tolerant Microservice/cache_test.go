@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJumpHashMovesOnlyToNewBucket(t *testing.T) {
+	const keys = 10000
+	for buckets := 1; buckets < 20; buckets++ {
+		moved := 0
+		for k := uint64(0); k < keys; k++ {
+			from, to := jumpHash(k, buckets), jumpHash(k, buckets+1)
+			if from < 0 || from >= buckets {
+				t.Fatalf("key %d hashed to %d of %d buckets", k, from, buckets)
+			}
+			if from != to {
+				if to != buckets {
+					t.Fatalf("key %d moved from %d to %d growing to %d buckets", k, from, to, buckets+1)
+				}
+				moved++
+			}
+		}
+		// The new bucket's share, allowing for the hash's skew
+		if want := keys / (buckets + 1); moved < want*3/4 || moved > want*5/4 {
+			t.Errorf("growing to %d buckets moved %d keys, want about %d", buckets+1, moved, want)
+		}
+	}
+}
+
+func TestResponseCacheShardIsStable(t *testing.T) {
+	c, err := newResponseCache(64, 16, 20, func() int64 { return 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := map[*cacheShard]bool{}
+	for i := 0; i < 200; i++ {
+		key := "q=" + strconv.Itoa(i)
+		sh := c.shard(key)
+		if c.shard(key) != sh {
+			t.Fatalf("%s picked two shards", key)
+		}
+		used[sh] = true
+	}
+	if len(used) != len(c.shards) {
+		t.Errorf("200 keys used %d of %d shards", len(used), len(c.shards))
+	}
+}
+
+// TestResponseCacheInvalidation checks a mutation drops exactly the
+// entries it could have changed: those whose query matches the product,
+// or for a change to the description alone, those whose page shows it
+func TestResponseCacheInvalidation(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.ResponseCache = 64 })
+	h := s.Routes()
+	cached := func(target string) bool {
+		t.Helper()
+		rec := serve(h, http.MethodGet, target, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+		return rec.Header().Get("X-Cache") == "hit"
+	}
+	const alpha, beta = "/products/search?mode=exhaustive&sort=id&q=alpha", "/products/search?mode=exhaustive&sort=id&q=beta"
+	for _, target := range []string{alpha, beta} {
+		if first, second := cached(target), cached(target); first || !second {
+			t.Fatalf("%s: the first search hit or the second missed", target)
+		}
+	}
+	// Sampled searches depend on more than the catalog
+	if cached("/products/search?q=alpha") || cached("/products/search?q=alpha") {
+		t.Errorf("a sampled search was cached")
+	}
+
+	// A product named for Alpha changes alpha's match set only
+	if _, err := s.store.create(Product{Name: "New Alpha", Category: "Books", Brand: "Alpha"}); err != nil {
+		t.Fatal(err)
+	}
+	if cached(alpha) || !cached(beta) {
+		t.Errorf("creating an Alpha product: alpha hit or beta missed")
+	}
+
+	// Product 0 is on alpha's first page, product 2 on no page
+	for _, tc := range []struct {
+		id        ProductID
+		alphaStay bool
+	}{{2, true}, {0, false}} {
+		p, _ := s.store.get(tc.id)
+		p.Description = "Changed"
+		if err := s.store.update(p); err != nil {
+			t.Fatal(err)
+		}
+		if a, b := cached(alpha), cached(beta); a != tc.alphaStay || !b {
+			t.Errorf("describing product %d: alpha hit %v and beta %v, want %v and true", tc.id, a, b, tc.alphaStay)
+		}
+	}
+}
+
+func TestIDBloomHasNoFalseNegatives(t *testing.T) {
+	b := newIDBloom(1024)
+	for id := ProductID(0); id < 1000; id += 7 {
+		b.add(id)
+	}
+	for id := ProductID(0); id < 1000; id += 7 {
+		if !b.mayContain(id) {
+			t.Fatalf("added %d but the filter says not", id)
+		}
+	}
+	b.reset()
+	if b.mayContain(7) || b.fill() != 0 {
+		t.Errorf("a reset filter still holds IDs")
+	}
+}
+
+// BenchmarkResponseCache looks up hot queries from parallel goroutines,
+// filling misses, while one operation in 100 changes a product's
+// description, against one shard, a single lock, and 16. The cache has
+// room for every query, so misses are only those invalidation caused.
+func BenchmarkResponseCache(b *testing.B) {
+	const queries = 256
+	keys := make([]string, queries)
+	texts := make([]searchText, queries)
+	for i := range keys {
+		keys[i] = "q=alpha+" + strconv.Itoa(i)
+		texts[i] = newSearchText(parseQuery("alpha "+strconv.Itoa(i)), defaultLocale, false)
+	}
+	old := newStoredProduct(generatedProduct(7))
+	described := old
+	described.Description = "Changed"
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			c, err := newResponseCache(4*queries, shards, 20, func() int64 { return 0 })
+			if err != nil {
+				b.Fatal(err)
+			}
+			var seed int64
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					i := rnd.Intn(queries)
+					if rnd.Intn(100) == 0 {
+						c.changed(&old, &described, nil)
+						continue
+					}
+					sh := c.shard(keys[i])
+					if _, ok := sh.get(keys[i]); !ok {
+						c.add(sh, &cacheEntry{key: keys[i], text: texts[i], ids: []ProductID{ProductID(i)}}, 0)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// maxTrackedQueries caps Config.TrackedQueries
+const maxTrackedQueries = 100000
+
+// keyGuard bounds an aggregation keyed by user input, which a client
+// could otherwise grow without limit by sending ever new keys: it holds
+// at most max distinct keys, each cut to maxLen bytes. The aggregation
+// decides what becomes of a key it has no room for, whether it displaces
+// a less counted one or is turned away; the guard counts those as
+// overflow, so /stats shows how much traffic the aggregation saw only in
+// its totals.
+type keyGuard struct {
+	max    int
+	maxLen int
+	// overflow counts the new keys there was no room for
+	overflow int64
+}
+
+func newKeyGuard(max, maxLen int) *keyGuard {
+	return &keyGuard{max: max, maxLen: maxLen}
+}
+
+// cut shortens k to at most maxLen bytes without splitting a character
+func (g *keyGuard) cut(k string) string {
+	if len(k) <= g.maxLen {
+		return k
+	}
+	n := g.maxLen
+	for n > 0 && !utf8.RuneStart(k[n]) {
+		n--
+	}
+	return k[:n]
+}
+
+// fits reports whether k is kept whole, for aggregations that would
+// rather skip a long key than keep it cut
+func (g *keyGuard) fits(k string) bool {
+	return len(k) <= g.maxLen
+}
+
+// admit reports whether an aggregation holding held keys has room for a
+// new one, counting it as overflow when not
+func (g *keyGuard) admit(held int) bool {
+	if held < g.max {
+		return true
+	}
+	atomic.AddInt64(&g.overflow, 1)
+	return false
+}
+
+func (g *keyGuard) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"max_keys":      g.max,
+		"max_key_bytes": g.maxLen,
+		"overflow":      atomic.LoadInt64(&g.overflow),
+	}
+}
+
+// queryTracker keeps approximate counts of the most frequent queries in
+// bounded memory: those that matched nothing, and the cached searches
+// the cache warmup replays. It uses the Space-Saving algorithm: once its
+// guard is full, a new query replaces the least counted one and inherits
+// its count, so counts may be overestimated by at most that inherited
+// error. A min-heap on the counts finds the least counted in log time,
+// so a flood of distinct queries costs no more than repeats of one.
+type queryTracker struct {
+	guard *keyGuard
+
+	mu     sync.Mutex
+	counts map[string]*queryCount
+	least  queryHeap
+	total  int64
+}
+
+type queryCount struct {
+	Query string `json:"query"`
+	Count int64  `json:"count"`
+	// Error bounds how much of Count was inherited from an evicted query
+	Error int64 `json:"error,omitempty"`
+	// at is the count's place in the tracker's heap
+	at int
+}
+
+func newQueryTracker(guard *keyGuard) *queryTracker {
+	return &queryTracker{guard: guard, counts: make(map[string]*queryCount)}
+}
+
+func (zt *queryTracker) record(q string) {
+	q = zt.guard.cut(q)
+	zt.mu.Lock()
+	defer zt.mu.Unlock()
+	zt.total++
+	if c, ok := zt.counts[q]; ok {
+		c.Count++
+		heap.Fix(&zt.least, c.at)
+		return
+	}
+	if zt.guard.admit(len(zt.counts)) {
+		c := &queryCount{Query: q, Count: 1}
+		zt.counts[q] = c
+		heap.Push(&zt.least, c)
+		return
+	}
+	if len(zt.least) == 0 {
+		// A guard allowing no keys leaves only the total
+		return
+	}
+	c := zt.least[0]
+	delete(zt.counts, c.Query)
+	c.Query, c.Error = q, c.Count
+	c.Count++
+	zt.counts[q] = c
+	heap.Fix(&zt.least, 0)
+}
+
+// top returns the tracked queries, most frequent first
+func (zt *queryTracker) top() (queries []queryCount, total int64) {
+	zt.mu.Lock()
+	defer zt.mu.Unlock()
+	queries = make([]queryCount, 0, len(zt.counts))
+	for _, c := range zt.counts {
+		queries = append(queries, *c)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Count != queries[j].Count {
+			return queries[i].Count > queries[j].Count
+		}
+		return queries[i].Query < queries[j].Query
+	})
+	return queries, zt.total
+}
+
+// stats is the tracker's guard and how much it holds, for /stats
+func (zt *queryTracker) stats() map[string]interface{} {
+	if zt == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	zt.mu.Lock()
+	tracked, total := len(zt.counts), zt.total
+	zt.mu.Unlock()
+	out := zt.guard.stats()
+	out["enabled"] = true
+	out["tracked"] = tracked
+	out["total"] = total
+	return out
+}
+
+// queryHeap orders a tracker's counts least first
+type queryHeap []*queryCount
+
+func (h queryHeap) Len() int           { return len(h) }
+func (h queryHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h queryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].at, h[j].at = i, j
+}
+
+func (h *queryHeap) Push(x interface{}) {
+	c := x.(*queryCount)
+	c.at = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *queryHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// cardinalityStats reports every aggregation keyed by user input: its
+// guard's caps, what it holds and how much traffic overflowed
+func (s *Server) cardinalityStats() map[string]interface{} {
+	out := map[string]interface{}{
+		"zero_results": s.zeroResults.stats(),
+		"popular":      s.popular.stats(),
+	}
+	if s.tenants != nil {
+		out["tenants"] = s.tenants.guard.stats()
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// cardinalityKeys is how many distinct keys TestKeyGuardBoundsCardinality
+// feeds each guarded aggregation
+const cardinalityKeys = 1000000
+
+// cardinalityHeapSlack is how much more heap than its keys' bytes a full
+// query tracker may hold after the flood
+const cardinalityHeapSlack = 1 << 20
+
+// TestKeyGuardBoundsCardinality floods a query tracker and an auto
+// provisioning tenant router with distinct keys, some far longer than
+// allowed, expecting each to hold no more keys, or key bytes, than its
+// guard allows, the heap to stay near that, and every key past the cap to
+// be counted as overflow
+func TestKeyGuardBoundsCardinality(t *testing.T) {
+	cfg := DefaultConfig()
+	guard := newKeyGuard(cfg.TrackedQueries, cfg.TrackedQueryBytes)
+	zt := newQueryTracker(guard)
+	// After six digits and a dash, an even cut lands in mid-character
+	long := strings.Repeat("é", cfg.TrackedQueryBytes)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < cardinalityKeys; i++ {
+		q := strconv.Itoa(i)
+		if i%10 == 0 {
+			q += "-" + long
+		}
+		zt.record(q)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	queries, total := zt.top()
+	bytes := 0
+	for _, q := range queries {
+		if len(q.Query) > guard.maxLen || !utf8.ValidString(q.Query) {
+			t.Fatalf("tracked a query of %d bytes, over the %d allowed or cut mid-character", len(q.Query), guard.maxLen)
+		}
+		bytes += len(q.Query)
+	}
+	switch {
+	case len(queries) > guard.max:
+		t.Errorf("tracked %d queries, more than the %d allowed", len(queries), guard.max)
+	case total != cardinalityKeys:
+		t.Errorf("counted %d searches of %d", total, cardinalityKeys)
+	case guard.overflow != int64(cardinalityKeys-guard.max):
+		t.Errorf("counted %d overflowing searches, expected %d", guard.overflow, cardinalityKeys-guard.max)
+	case after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > uint64(bytes+cardinalityHeapSlack):
+		t.Errorf("the heap grew by %d bytes tracking %d queries of %d bytes", after.HeapAlloc-before.HeapAlloc, len(queries), bytes)
+	}
+	runtime.KeepAlive(zt)
+
+	// Provisioning is refused before a server is built, so the router
+	// needs no base and tenantMax of 0 costs nothing per key
+	tr := &tenantRouter{auto: true, guard: newKeyGuard(0, maxTenantIDLen), tenants: make(map[string]*tenant)}
+	for i := 0; i < cardinalityKeys; i++ {
+		if srv, _ := tr.server("t" + strconv.Itoa(i)); srv != nil {
+			t.Fatalf("tenant %d was provisioned past the cap", i)
+		}
+	}
+	if len(tr.tenants) != 0 || tr.guard.overflow != cardinalityKeys {
+		t.Errorf("tenant router holds %d tenants and counted %d overflowing of %d", len(tr.tenants), tr.guard.overflow, cardinalityKeys)
+	}
+}
+
+func TestKeyGuardCut(t *testing.T) {
+	g := newKeyGuard(1, 4)
+	for k, want := range map[string]string{
+		"":       "",
+		"abcd":   "abcd",
+		"abcdef": "abcd",
+		"abcé":   "abc",
+		"aé€":    "aé",
+		"€€":     "€",
+		"😀x":     "😀",
+	} {
+		if got := g.cut(k); got != want {
+			t.Errorf("cut %q to %q, want %q", k, got, want)
+		}
+		if g.fits(k) != (len(k) <= 4) {
+			t.Errorf("%q fits %v", k, g.fits(k))
+		}
+	}
+}
+
+// TestQueryTrackerSpaceSaving checks a full tracker keeps its frequent
+// queries, while each new one displaces the least counted and inherits
+// its count as the error bound
+func TestQueryTrackerSpaceSaving(t *testing.T) {
+	zt := newQueryTracker(newKeyGuard(3, 16))
+	for q, n := range map[string]int{"often": 10, "sometimes": 5, "once": 1} {
+		for i := 0; i < n; i++ {
+			zt.record(q)
+		}
+	}
+	zt.record("new")
+	zt.record("newer")
+	queries, total := zt.top()
+	want := []queryCount{{Query: "often", Count: 10}, {Query: "sometimes", Count: 5}, {Query: "newer", Count: 3, Error: 2}}
+	if total != 18 || len(queries) != len(want) {
+		t.Fatalf("%d searches, tracked %+v", total, queries)
+	}
+	for i := range want {
+		if got := queries[i]; got.Query != want[i].Query || got.Count != want[i].Count || got.Error != want[i].Error {
+			t.Errorf("rank %d: %+v, want %+v", i, got, want[i])
+		}
+	}
+	if zt.guard.overflow != 2 {
+		t.Errorf("counted %d overflowing queries, want 2", zt.guard.overflow)
+	}
+}
+
+// TestZeroResultsBounded checks the zero result tracker /stats reports
+// holds to -tracked-queries, cutting each query, and that NewServer
+// refuses caps out of range
+func TestZeroResultsBounded(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) { cfg.TrackedQueries, cfg.TrackedQueryBytes = 2, 8 }).Routes()
+	for _, q := range []string{"nothing-like-it", "nothing-like-it", "nothing-at-all", "absent", "gone"} {
+		search(t, h, "/products/search?mode=exhaustive&q="+q)
+	}
+	rec := serve(h, http.MethodGet, "/stats/zero-results", "", nil)
+	var res struct {
+		Queries  []queryCount `json:"queries"`
+		Total    int64        `json:"total"`
+		Capacity int          `json:"capacity"`
+		Overflow int64        `json:"overflow"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if res.Total != 5 || res.Capacity != 2 || res.Overflow != 1 || len(res.Queries) != 2 || res.Queries[0] != (queryCount{Query: "nothing-", Count: 3}) {
+		t.Errorf("/stats/zero-results: %s", rec.Body)
+	}
+
+	for _, limits := range [][2]int{{0, 200}, {maxTrackedQueries + 1, 200}, {100, 0}} {
+		cfg := DefaultConfig()
+		cfg.TrackedQueries, cfg.TrackedQueryBytes = limits[0], limits[1]
+		if _, err := NewServer(cfg); err == nil {
+			t.Errorf("tracking %d queries of %d bytes was accepted", limits[0], limits[1])
+		}
+	}
+}
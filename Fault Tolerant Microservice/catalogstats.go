@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// catalogStatsTop is how many brands and categories /stats/catalog lists,
+// most products first
+const catalogStatsTop = 50
+
+// postingEntryBytes and postingKeyBytes estimate the memory of one brand
+// or category posting entry and of one index key with its slice header,
+// as the trigram index does
+const (
+	postingEntryBytes = 8
+	postingKeyBytes   = 48
+)
+
+// catalogTotals are sums over the catalog maintained with the indexes, so
+// /stats/catalog never scans the products. listLock guards them.
+type catalogTotals struct {
+	descriptionRunes int64
+	// tokens counts each product's distinct vocabulary tokens, so it is
+	// the vocabulary's posting count
+	tokens int64
+}
+
+func (t *catalogTotals) add(sp *storedProduct, sign int64) {
+	t.descriptionRunes += sign * int64(utf8.RuneCountInString(sp.Description))
+}
+
+// valueCount is one brand or category and how many products have it
+type valueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// topValues returns ix's values by product count, at most n of them.
+// Keys are lowercased, so each value is reported as name spells it for
+// the first product holding it.
+func (ix postingIndex) topValues(n int, name func(id ProductID) string) []valueCount {
+	out := make([]valueCount, 0, len(ix))
+	for v, ids := range ix {
+		out = append(out, valueCount{Value: v, Count: len(ids)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	for i := range out {
+		// A product being updated may already hold another value
+		if v := name(ix[out[i].Value][0]); strings.ToLower(v) == out[i].Value {
+			out[i].Value = v
+		}
+	}
+	return out
+}
+
+// entries is how many IDs ix holds over all values
+func (ix postingIndex) entries() int64 {
+	var n int64
+	for _, ids := range ix {
+		n += int64(len(ids))
+	}
+	return n
+}
+
+// catalogStats reads the catalog's shape under one read lock, so it is a
+// consistent view however mutations interleave. Its cost depends on the
+// number of brands and categories, not of products.
+func (s *productStore) catalogStats() map[string]interface{} {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	products := len(s.list)
+	var avgDescription float64
+	if products > 0 {
+		avgDescription = float64(s.totals.descriptionRunes) / float64(products)
+	}
+	index := func(ix postingIndex) map[string]interface{} {
+		entries := ix.entries()
+		return map[string]interface{}{
+			"values":          len(ix),
+			"postings":        entries,
+			"estimated_bytes": entries*postingEntryBytes + int64(len(ix))*postingKeyBytes,
+		}
+	}
+	brand := func(id ProductID) string {
+		sp, _ := s.lookup(id)
+		return sp.Brand
+	}
+	category := func(id ProductID) string {
+		sp, _ := s.lookup(id)
+		return sp.Category
+	}
+	return map[string]interface{}{
+		"products":               products,
+		"brands":                 s.brandIndex.topValues(catalogStatsTop, brand),
+		"categories":             s.categoryIndex.topValues(catalogStatsTop, category),
+		"avg_description_length": avgDescription,
+		"indexes": map[string]interface{}{
+			"brand":    index(s.brandIndex),
+			"category": index(s.categoryIndex),
+			"vocabulary": map[string]interface{}{
+				"tokens":   len(s.vocab),
+				"postings": s.totals.tokens,
+			},
+			"trigram": s.trigramStatsLocked(),
+		},
+	}
+}
+
+// catalogStatsHandler describes the data itself, for sizing and for
+// checking a generated catalog looks real
+func (s *Server) catalogStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.store.catalogStats())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// catalogStatsResponse is the part of /stats/catalog the tests read
+type catalogStatsResponse struct {
+	Products   int          `json:"products"`
+	Brands     []valueCount `json:"brands"`
+	Categories []valueCount `json:"categories"`
+	Indexes    struct {
+		Brand struct {
+			Values   int   `json:"values"`
+			Postings int64 `json:"postings"`
+		} `json:"brand"`
+	} `json:"indexes"`
+}
+
+func catalogStats(t *testing.T, h http.Handler) catalogStatsResponse {
+	t.Helper()
+	rec := serve(h, http.MethodGet, "/stats/catalog", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /stats/catalog: %d %s", rec.Code, rec.Body)
+	}
+	var res catalogStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return res
+}
+
+func TestCatalogStatsCounts(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	res := catalogStats(t, h)
+	if res.Products != testProducts || res.Indexes.Brand.Values != len(brands) || res.Indexes.Brand.Postings != testProducts {
+		t.Errorf("%d products, %d brands with %d postings", res.Products, res.Indexes.Brand.Values, res.Indexes.Brand.Postings)
+	}
+	// The generated catalog spreads products evenly, so ties sort by name
+	if len(res.Brands) != len(brands) || res.Brands[0] != (valueCount{Value: "Alpha", Count: testProducts / len(brands)}) {
+		t.Errorf("brands: %+v", res.Brands)
+	}
+	if len(res.Categories) != len(categories) || res.Categories[0] != (valueCount{Value: "Books", Count: testProducts / len(categories)}) {
+		t.Errorf("categories: %+v", res.Categories)
+	}
+}
+
+// TestCatalogStatsSpelling checks values are reported as the catalog
+// spells them, counting products whatever their case, and follow updates
+func TestCatalogStatsSpelling(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	for i := 0; i < 30; i++ {
+		if _, err := s.store.create(Product{Name: "Gadget", Category: "Books", Brand: "McKinley"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.store.create(Product{Name: "Gadget", Category: "BOOKS", Brand: "MCKINLEY"}); err != nil {
+		t.Fatal(err)
+	}
+	res := catalogStats(t, h)
+	if res.Brands[0] != (valueCount{Value: "McKinley", Count: 31}) {
+		t.Errorf("top brand %+v, want McKinley with 31", res.Brands[0])
+	}
+	if res.Categories[0] != (valueCount{Value: "Books", Count: 51}) {
+		t.Errorf("top category %+v, want Books with 51", res.Categories[0])
+	}
+
+	// Product 0 is the first Alpha product, so its spelling is Alpha's
+	p, _ := s.store.get(0)
+	p.Brand = "ALPHA"
+	if err := s.store.update(p); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, v := range catalogStats(t, h).Brands {
+		if strings.EqualFold(v.Value, "alpha") {
+			found = true
+			if v != (valueCount{Value: "ALPHA", Count: testProducts / len(brands)}) {
+				t.Errorf("after renaming product 0's brand: %+v, want ALPHA with %d", v, testProducts/len(brands))
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Alpha is missing after an update")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+var (
+	defaultChangesLimit = 500
+	maxChangesLimit     = 1000
+)
+
+// catalogChange is one journal entry of GET /products/changes. Product is
+// the new value, or the removed one for a delete.
+type catalogChange struct {
+	Seq     int64     `json:"seq"`
+	Type    string    `json:"type"`
+	ID      ProductID `json:"id"`
+	Product Product   `json:"product"`
+}
+
+// catalogSeqHeader carries the journal position a full listing is
+// consistent with. It is read before the listing, so replaying changes
+// after it can only repeat a change, never miss one.
+const catalogSeqHeader = "X-Catalog-Seq"
+
+// productChangesHandler lets a cache sync incrementally: it returns the
+// changes after since, oldest first, from the event log. Sequence numbers
+// are the event IDs, assigned under the store's mutation lock, so they
+// have no gaps. A since the log no longer reaches is a 410, meaning
+// refetch the catalog and sync from its X-Catalog-Seq.
+func (s *Server) productChangesHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		writeErr(w, r, invalid("since", "since must be a non-negative sequence number"))
+		return
+	}
+	limit := defaultChangesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChangesLimit {
+			writeErr(w, r, invalid("limit", fmt.Sprintf("limit must be between 1 and %d", maxChangesLimit)))
+			return
+		}
+		limit = n
+	}
+	events := s.store.events
+	latest := events.lastID()
+	if since > latest {
+		writeErr(w, r, invalid("since", fmt.Sprintf("since is ahead of the latest sequence %d", latest)))
+		return
+	}
+	evs, ok := events.since(since)
+	if !ok {
+		writeErr(w, r, newError(ErrGone, "Changes after that sequence are no longer retained; refetch the catalog"))
+		return
+	}
+	// Changes may have landed since the first read
+	latest = events.lastID()
+	more := len(evs) > limit
+	if more {
+		evs = evs[:limit]
+	}
+	changes := make([]catalogChange, len(evs))
+	for i, ev := range evs {
+		c := catalogChange{Seq: ev.ID, Type: ev.Type}
+		if ev.Product != nil {
+			c.Product = *ev.Product
+		} else if ev.Old != nil {
+			c.Product = *ev.Old
+		}
+		c.ID = c.Product.ID
+		changes[i] = c
+	}
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"changes": changes,
+		"next":    next,
+		"latest":  latest,
+		"more":    more,
+	})
+}
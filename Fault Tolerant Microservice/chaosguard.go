@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// Chaos guard states. Armed watches the burn rate; tripped holds chaos
+// at the cap until an admin acknowledges; acknowledged has chaos back as
+// it was, and re-arms once the burn rate falls under the threshold, so an
+// acknowledgment isn't undone by the burn that led to it.
+const (
+	guardArmed        = "armed"
+	guardTripped      = "tripped"
+	guardAcknowledged = "acknowledged"
+)
+
+var errGuardNotTripped = newError(ErrConflict, "The chaos guard hasn't tripped")
+
+// chaosGuard caps chaos once the error budget has burned at threshold or
+// faster over the SLO's shortest window for sustain, while chaos is
+// adding failures or latency; burning from real failures alone doesn't
+// trip it. It stays tripped, chaos held at ceiling, until an admin
+// acknowledges, so a drill left running over a weekend costs one page at
+// most.
+type chaosGuard struct {
+	// onChange announces the guard tripping, being acknowledged and
+	// re-arming, with what it saw
+	onChange func(state string, data map[string]interface{})
+
+	clock     resilience.Clock
+	chaos     *resilience.ChaosInjector
+	slo       *sloTracker
+	threshold float64
+	sustain   time.Duration
+	ceiling   float64
+
+	mu    sync.Mutex
+	state string
+	since time.Time
+	// over is when the burn rate went over the threshold, zero while under
+	over  time.Time
+	burn  *float64
+	trips int64
+}
+
+func newChaosGuard(clock resilience.Clock, chaos *resilience.ChaosInjector, slo *sloTracker, threshold float64, sustain time.Duration, ceiling float64, onChange func(string, map[string]interface{})) *chaosGuard {
+	return &chaosGuard{onChange: onChange, clock: clock, chaos: chaos, slo: slo, threshold: threshold, sustain: sustain, ceiling: ceiling, state: guardArmed, since: clock.Now()}
+}
+
+// check trips or re-arms the guard; run calls it
+func (g *chaosGuard) check() {
+	now := g.clock.Now()
+	burn, counted := g.slo.burnRate(sloWindows[0].minutes)
+	hot := counted >= sloMinRequests && burn >= g.threshold
+	g.mu.Lock()
+	g.burn = nil
+	if counted > 0 {
+		g.burn = &burn
+	}
+	rearm := false
+	switch {
+	case !hot:
+		g.over = time.Time{}
+		if g.state == guardAcknowledged {
+			g.state, g.since = guardArmed, now
+			rearm = true
+		}
+	case g.over.IsZero():
+		g.over = now
+	}
+	trip := hot && g.state == guardArmed && now.Sub(g.over) >= g.sustain &&
+		(g.chaos.Rate() > g.ceiling || g.chaos.Delay() > 0)
+	if trip {
+		g.state, g.since = guardTripped, now
+		g.trips++
+	}
+	g.mu.Unlock()
+	switch {
+	case trip:
+		g.chaos.Cap(g.ceiling)
+		g.onChange(guardTripped, map[string]interface{}{
+			"burn_rate": burn,
+			"window":    sloWindows[0].name,
+			"threshold": g.threshold,
+			"sustain_s": g.sustain.Seconds(),
+			"cap":       g.ceiling,
+			"base_rate": g.chaos.BaseRate(),
+		})
+	case rearm:
+		g.onChange(guardArmed, map[string]interface{}{"threshold": g.threshold})
+	}
+}
+
+// acknowledge lifts the cap of a tripped guard
+func (g *chaosGuard) acknowledge() error {
+	g.mu.Lock()
+	if g.state != guardTripped {
+		g.mu.Unlock()
+		return errGuardNotTripped
+	}
+	g.state, g.since = guardAcknowledged, g.clock.Now()
+	g.mu.Unlock()
+	g.chaos.Uncap()
+	g.onChange(guardAcknowledged, map[string]interface{}{"base_rate": g.chaos.BaseRate()})
+	return nil
+}
+
+// run checks the guard every sloCheckInterval; main starts it
+func (g *chaosGuard) run() {
+	for {
+		time.Sleep(sloCheckInterval)
+		g.check()
+	}
+}
+
+// chaosGuardState is the guard as GET /admin/chaos reports it
+type chaosGuardState struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Threshold float64   `json:"threshold"`
+	SustainS  float64   `json:"sustain_s"`
+	Cap       float64   `json:"cap"`
+	// BurnRate is the burn over the SLO's shortest window at the last
+	// check, nil while nothing was counted
+	BurnRate *float64 `json:"burn_rate"`
+	// OverS is how long the burn rate has been over the threshold
+	OverS float64 `json:"over_s,omitempty"`
+	Trips int64   `json:"trips"`
+}
+
+func (g *chaosGuard) status() *chaosGuardState {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := &chaosGuardState{
+		State:     g.state,
+		Since:     g.since.UTC(),
+		Threshold: g.threshold,
+		SustainS:  g.sustain.Seconds(),
+		Cap:       g.ceiling,
+		BurnRate:  g.burn,
+		Trips:     g.trips,
+	}
+	if !g.over.IsZero() {
+		st.OverS = g.clock.Since(g.over).Seconds()
+	}
+	return st
+}
+
+// onChaosGuardChange logs the guard's changes, and sends the trip and
+// the acknowledgment to the webhooks as chaos.guard_tripped and
+// chaos.guard_acknowledged
+func (s *Server) onChaosGuardChange(state string, data map[string]interface{}) {
+	switch state {
+	case guardTripped:
+		log.Printf("Chaos guard tripped: error budget burning at %.1fx over %s for %s, threshold %.1fx; chaos capped at %.2f until acknowledged",
+			data["burn_rate"], data["window"], s.cfg.ChaosGuardSustain, data["threshold"], data["cap"])
+		s.statsd.incr("chaos.guard.tripped")
+		adminErrors.record("chaos_guard", "chaos capped: error budget burn over the threshold")
+	case guardAcknowledged:
+		log.Println("Chaos guard acknowledged, chaos back as it was set")
+	case guardArmed:
+		log.Println("Chaos guard re-armed")
+		return
+	}
+	s.cfg.Webhooks.notify("chaos.guard_"+state, data)
+}
+
+// chaosGuardAckHandler lifts a tripped guard's cap
+func (s *Server) chaosGuardAckHandler(w http.ResponseWriter, r *http.Request) {
+	if s.chaosGuard == nil {
+		writeErr(w, r, newError(ErrNotFound, "The chaos guard is off; start with -chaos-guard-burn"))
+		return
+	}
+	before := s.chaosSummary()
+	if err := s.chaosGuard.acknowledge(); err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	noteAudit(r, "chaos", before, s.chaosSummary())
+	s.chaosHandler(w, r)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// Chaos guard test settings: the guard's threshold and sustain, and the
+// failed requests recorded each minute, enough to count and to burn far
+// past it
+const (
+	guardTestBurn    = 14.4
+	guardTestSustain = 10 * time.Minute
+	guardTestBad     = 2 * sloMinRequests
+)
+
+// TestChaosGuard walks a guard through a drill left running on a manual
+// clock. It must stay armed until the burn has lasted the sustain, then
+// trip once and hold chaos at the cap however long the burn goes on; an
+// acknowledgment restores chaos, re-arming only once the burn stops; and
+// failures with no chaos running never trip it.
+func TestChaosGuard(t *testing.T) {
+	// Far enough on that the SLO windows don't reach back before the epoch
+	clock := newManualClock(time.Unix(0, 0).UTC().Add(sloMinutes * time.Minute))
+	slo := newSLOTracker(clock, 0.995, guardTestBurn, false)
+	chaos := resilience.NewChaosInjector(0.8, clock)
+	chaos.Logf = func(string, ...interface{}) {}
+	changes := map[string]int{}
+	g := newChaosGuard(clock, chaos, slo, guardTestBurn, guardTestSustain, 0, func(state string, _ map[string]interface{}) { changes[state]++ })
+	minutes := func(n int, status int) {
+		for i := 0; i < n; i++ {
+			for j := 0; j < guardTestBad; j++ {
+				slo.record(status, "")
+			}
+			g.check()
+			clock.Advance(time.Minute)
+		}
+	}
+	state := func() string { return g.status().State }
+
+	minutes(int(guardTestSustain/time.Minute), http.StatusInternalServerError)
+	if state() != guardArmed || chaos.Rate() != 0.8 {
+		t.Fatalf("guard %s, chaos at %g, before the burn lasted %v", state(), chaos.Rate(), guardTestSustain)
+	}
+	minutes(30, http.StatusInternalServerError)
+	if state() != guardTripped || chaos.Rate() != 0 || changes[guardTripped] != 1 {
+		t.Fatalf("after a sustained burn: guard %s, chaos at %g, tripped %d times", state(), chaos.Rate(), changes[guardTripped])
+	}
+	if err := g.acknowledge(); err != nil {
+		t.Fatal(err)
+	}
+	minutes(1, http.StatusInternalServerError)
+	if state() != guardAcknowledged || chaos.Rate() != 0.8 {
+		t.Fatalf("after acknowledging while still burning: guard %s, chaos at %g", state(), chaos.Rate())
+	}
+	if g.acknowledge() != errGuardNotTripped {
+		t.Errorf("an acknowledged guard took a second acknowledgment")
+	}
+	minutes(sloWindows[0].minutes+1, http.StatusOK)
+	if state() != guardArmed {
+		t.Fatalf("guard %s once the burn stopped, want %s", state(), guardArmed)
+	}
+	chaos.SetRate(0)
+	minutes(30, http.StatusInternalServerError)
+	if state() != guardArmed || changes[guardTripped] != 1 {
+		t.Errorf("failures with chaos off tripped the guard")
+	}
+}
+
+// TestChaosGuardSustain checks a burn that lets up before the sustain
+// starts the count again, and that added latency alone, with no failures
+// injected, is chaos enough to trip the guard
+func TestChaosGuardSustain(t *testing.T) {
+	clock := newManualClock(time.Unix(0, 0).UTC().Add(sloMinutes * time.Minute))
+	slo := newSLOTracker(clock, 0.995, guardTestBurn, false)
+	chaos := resilience.NewChaosInjector(0, clock)
+	chaos.Logf = func(string, ...interface{}) {}
+	chaos.SetDelay(time.Second)
+	g := newChaosGuard(clock, chaos, slo, guardTestBurn, guardTestSustain, 0, func(string, map[string]interface{}) {})
+	minutes := func(n int, status int) {
+		for i := 0; i < n; i++ {
+			for j := 0; j < guardTestBad; j++ {
+				slo.record(status, "")
+			}
+			g.check()
+			clock.Advance(time.Minute)
+		}
+	}
+	// The burn over the window outlasts the failures by the window
+	short := int(guardTestSustain/time.Minute) - sloWindows[0].minutes - 1
+	minutes(short, http.StatusInternalServerError)
+	minutes(sloWindows[0].minutes+1, http.StatusOK)
+	if st := g.status(); st.State != guardArmed || st.OverS != 0 {
+		t.Fatalf("after the burn let up: %+v", st)
+	}
+	minutes(short, http.StatusInternalServerError)
+	if g.status().State != guardArmed {
+		t.Fatalf("tripped before a fresh burn lasted %v", guardTestSustain)
+	}
+	minutes(int(guardTestSustain/time.Minute)-short+1, http.StatusInternalServerError)
+	if st := g.status(); st.State != guardTripped || st.Trips != 1 || chaos.Delay() != 0 {
+		t.Errorf("latency drill burning the budget: %+v, delay %v", st, chaos.Delay())
+	}
+}
+
+func TestChaosGuardAckHandler(t *testing.T) {
+	rec := serve(newTestServer(t, nil).Routes(), http.MethodPost, "/admin/chaos/guard/ack", "", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("with the guard off: %d %s", rec.Code, rec.Body)
+	}
+	s := newTestServer(t, func(cfg *Config) { cfg.ChaosRate, cfg.ChaosGuardBurn = 0.5, guardTestBurn })
+	h := s.Routes()
+	if rec := serve(h, http.MethodPost, "/admin/chaos/guard/ack", "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("with the guard armed: %d %s", rec.Code, rec.Body)
+	}
+	s.chaosGuard.mu.Lock()
+	s.chaosGuard.state = guardTripped
+	s.chaosGuard.mu.Unlock()
+	s.chaos.Cap(0)
+	rec = serve(h, http.MethodPost, "/admin/chaos/guard/ack", "", nil)
+	if rec.Code != http.StatusOK || s.chaos.Rate() != 0.5 || s.chaosGuard.status().State != guardAcknowledged {
+		t.Errorf("acknowledging a tripped guard: %d, chaos at %g, guard %s", rec.Code, s.chaos.Rate(), s.chaosGuard.status().State)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+const (
+	// maxCircuitWaiters caps concurrent GET /circuit/wait calls; each is
+	// one parked request and one subscription, nothing more
+	maxCircuitWaiters int32 = 1000
+	// defaultCircuitWait and maxCircuitWait bound timeout_s
+	defaultCircuitWait = 30 * time.Second
+	maxCircuitWait     = 5 * time.Minute
+	// transitionWebhookBuffer and circuitWaitBuffer are how many
+	// transitions the webhook forwarder and a waiter may fall behind by
+	// before they start missing them. A waiter only falls behind while a
+	// burst of transitions outruns it.
+	transitionWebhookBuffer = 64
+	circuitWaitBuffer       = 8
+)
+
+// circuitTransition is one breaker state change, as GET /circuit/wait
+// returns it and as the breaker webhooks carry it
+type circuitTransition struct {
+	// Seq numbers transitions from 1; pass it back as since so a change
+	// between two waits isn't missed
+	Seq      int64  `json:"seq"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Reason   string `json:"reason,omitempty"`
+	Failures int64  `json:"failures"`
+	Forced   bool   `json:"forced"`
+	// LatencyPercentileMS is set on latency opens
+	LatencyPercentileMS float64 `json:"latency_percentile_ms,omitempty"`
+	At                  string  `json:"at"`
+}
+
+// transitionHub fans breaker transitions out to subscribers. Sends
+// never block: a subscriber that hasn't taken its last transition misses
+// the next one, which is counted. Each waiter unsubscribes as it
+// returns, so a parked request is all a subscription ever costs.
+type transitionHub struct {
+	mu      sync.Mutex
+	seq     int64
+	last    *circuitTransition
+	subs    map[*transitionSub]struct{}
+	dropped int64
+}
+
+type transitionSub struct {
+	C chan circuitTransition
+}
+
+func newTransitionHub() *transitionHub {
+	return &transitionHub{subs: make(map[*transitionSub]struct{})}
+}
+
+// subscribe registers a subscriber and returns the latest transition,
+// nil before the first, read under the same lock so no transition falls
+// between the two
+func (h *transitionHub) subscribe(buffer int) (*transitionSub, *circuitTransition) {
+	sub := &transitionSub{C: make(chan circuitTransition, buffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[sub] = struct{}{}
+	return sub, h.last
+}
+
+func (h *transitionHub) unsubscribe(sub *transitionSub) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// publish numbers t and offers it to every subscriber
+func (h *transitionHub) publish(t circuitTransition) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	t.Seq = h.seq
+	h.last = &t
+	for sub := range h.subs {
+		select {
+		case sub.C <- t:
+		default:
+			h.dropped++
+		}
+	}
+}
+
+func (s *Server) circuitWaitStats() map[string]interface{} {
+	h := s.transitions
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return map[string]interface{}{
+		"waiters":     atomic.LoadInt32(&s.circuitWaiters),
+		"transitions": h.seq,
+		"subscribers": len(h.subs),
+		"dropped":     h.dropped,
+	}
+}
+
+// forwardTransitions delivers every transition sub receives as a
+// breaker.<state> webhook. main subscribes before the first transition
+// can happen and runs this for the life of the process.
+func (h *webhookSender) forwardTransitions(sub *transitionSub) {
+	for t := range sub.C {
+		data := map[string]interface{}{
+			"from":     t.From,
+			"to":       t.To,
+			"failures": t.Failures,
+			"forced":   t.Forced,
+		}
+		if t.Reason != "" {
+			data["reason"] = t.Reason
+		}
+		if t.LatencyPercentileMS > 0 {
+			data["latency_percentile_ms"] = t.LatencyPercentileMS
+		}
+		h.notify("breaker."+t.To, data)
+	}
+}
+
+// circuitWaitHandler long-polls for a breaker transition: into state if
+// given, otherwise any. With since, a transition already past that
+// sequence answers at once, as long as the latest one goes to state; a
+// sidecar loops passing back the seq it was given. A timeout is a 204.
+func (s *Server) circuitWaitHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	want := q.Get("state")
+	switch want {
+	case "", "open", "half_open", "closed":
+	default:
+		writeErr(w, r, invalid("state", "state must be open, half_open or closed"))
+		return
+	}
+	timeout := defaultCircuitWait
+	if v := q.Get("timeout_s"); v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil || secs <= 0 || secs > maxCircuitWait.Seconds() {
+			writeErr(w, r, invalid("timeout_s", "timeout_s must be in (0, "+strconv.Itoa(int(maxCircuitWait.Seconds()))+"]"))
+			return
+		}
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+	since := int64(-1)
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeErr(w, r, invalid("since", "since must be a non-negative sequence number"))
+			return
+		}
+		since = n
+	}
+	if atomic.AddInt32(&s.circuitWaiters, 1) > maxCircuitWaiters {
+		atomic.AddInt32(&s.circuitWaiters, -1)
+		writeErr(w, r, s.cfg.RejectionStatus.reject(ErrOverloaded, rejectSubscribers, "Too many circuit waiters"))
+		return
+	}
+	defer atomic.AddInt32(&s.circuitWaiters, -1)
+
+	sub, last := s.transitions.subscribe(circuitWaitBuffer)
+	defer s.transitions.unsubscribe(sub)
+	if last != nil && since >= 0 && last.Seq > since && (want == "" || last.To == want) {
+		writeJSON(w, http.StatusOK, last)
+		return
+	}
+	// A long poll's timeout is wall time, whatever clock the server keeps
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	for {
+		select {
+		case tr := <-sub.C:
+			if want == "" || tr.To == want {
+				writeJSON(w, http.StatusOK, tr)
+				return
+			}
+		case <-ctx.Done():
+			if r.Context().Err() == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+	}
+}
+
+// publishTransition builds the transition record for the hub from the
+// breaker's current snapshot
+func (s *Server) publishTransition(from, to int32, snap resilience.BreakerSnapshot) {
+	t := circuitTransition{
+		From:     resilience.StateName(from),
+		To:       resilience.StateName(to),
+		Failures: snap.Failures,
+		Forced:   snap.Forced,
+		At:       s.clock.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if to == resilience.StateOpen {
+		t.Reason = snap.OpenReason
+		if snap.OpenReason == resilience.ReasonLatency {
+			t.LatencyPercentileMS = durationMS(snap.LatencyPercentile)
+		}
+	}
+	s.transitions.publish(t)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// TestCircuitWaitTimesOut checks the long poll's timeout runs on wall
+// time: the test server's manual clock never moves, yet the wait ends
+func TestCircuitWaitTimesOut(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	start := time.Now()
+	rec := serve(h, http.MethodGet, "/v1/circuit/wait?timeout_s=0.05", "", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got %d %s, want 204", rec.Code, rec.Body)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("a 50ms wait took %s", d)
+	}
+}
+
+func TestCircuitWaitReturnsTransition(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(h, http.MethodGet, "/v1/circuit/wait?state=open&timeout_s=5", "", nil) }()
+	for atomic.LoadInt32(&s.circuitWaiters) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	for s.breaker.State() != resilience.StateOpen {
+		s.breaker.RecordFailure()
+	}
+	rec := <-done
+	var tr circuitTransition
+	if err := json.Unmarshal(rec.Body.Bytes(), &tr); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s: %v", rec.Code, rec.Body, err)
+	}
+	if tr.To != "open" || tr.From != "closed" || tr.Seq != 1 {
+		t.Errorf("transition %+v, want the first, closed to open", tr)
+	}
+
+	// A transition past since answers at once; none past it waits
+	rec = serve(h, http.MethodGet, "/v1/circuit/wait?since=0&timeout_s=5", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("since=0: %d, want the transition already made", rec.Code)
+	}
+	rec = serve(h, http.MethodGet, "/v1/circuit/wait?since="+strconv.FormatInt(tr.Seq, 10)+"&timeout_s=0.01", "", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("since=%d: %d, want a timeout", tr.Seq, rec.Code)
+	}
+	if n := atomic.LoadInt32(&s.circuitWaiters); n != 0 {
+		t.Errorf("%d waiters left after every wait returned", n)
+	}
+}
+
+func TestCircuitWaitParams(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for _, q := range []string{"state=broken", "timeout_s=0", "timeout_s=301", "timeout_s=x", "since=-1", "since=x"} {
+		if rec := serve(h, http.MethodGet, "/v1/circuit/wait?"+q, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", q, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ImportResult summarizes a bulk import
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+}
+
+// Stats are the service's request counters, counted since it started
+type Stats struct {
+	Requests     int64            `json:"requests"`
+	Successes    int64            `json:"successes"`
+	Failures     int64            `json:"failures"`
+	Rejected     map[string]int64 `json:"rejected"`
+	InFlight     int32            `json:"in_flight"`
+	BulkheadUsed int              `json:"bulkhead_used"`
+	BulkheadSize int              `json:"bulkhead_size"`
+	TotalChecked int64            `json:"total_checked"`
+	Products     int              `json:"products"`
+	Circuit      string           `json:"circuit"`
+	ChaosRate    float64          `json:"chaos_rate"`
+	Auth         AuthStats        `json:"auth"`
+	Windows      StatsWindows     `json:"windows"`
+}
+
+// StatsWindows are the search outcomes over recent seconds, which
+// ResetStats empties
+type StatsWindows struct {
+	// Since is when the windows started, at startup or the last reset
+	Since       time.Time   `json:"since"`
+	Resets      int64       `json:"resets"`
+	TenSeconds  StatsWindow `json:"10s"`
+	Minute      StatsWindow `json:"1m"`
+	FiveMinutes StatsWindow `json:"5m"`
+}
+
+// StatsWindow is one window's search outcomes. The ratio and averages are
+// nil while there was nothing to divide by.
+type StatsWindow struct {
+	Seconds         int64    `json:"seconds"`
+	Requests        int64    `json:"requests"`
+	Successes       int64    `json:"successes"`
+	Failures        int64    `json:"failures"`
+	Rejected        int64    `json:"rejected"`
+	Cancelled       int64    `json:"cancelled"`
+	Checked         int64    `json:"checked"`
+	RequestsPerS    float64  `json:"requests_per_s"`
+	SuccessRatio    *float64 `json:"success_ratio"`
+	MeanLatencyMS   *float64 `json:"mean_latency_ms"`
+	ChecksPerSearch *float64 `json:"checks_per_search"`
+}
+
+// AuthStats reports API key usage
+type AuthStats struct {
+	Enabled           bool                    `json:"enabled"`
+	RequireAuthReads  bool                    `json:"require_auth_reads"`
+	InvalidKeyDenials int64                   `json:"invalid_key_denials"`
+	Keys              map[string]APIKeyCounts `json:"keys"`
+}
+
+// APIKeyCounts are the counters for one API key
+type APIKeyCounts struct {
+	Role     string `json:"role"`
+	Requests int64  `json:"requests"`
+	Denied   int64  `json:"denied"`
+}
+
+// CircuitState describes the circuit breaker
+type CircuitState struct {
+	State       string `json:"state"`
+	Policy      string `json:"policy"`
+	Forced      bool   `json:"forced"`
+	Failures    int64  `json:"failures"`
+	Threshold   int    `json:"threshold,omitempty"`
+	CooldownMS  int64  `json:"cooldown_ms"`
+	LastFailure string `json:"last_failure,omitempty"`
+	// RestoredFrom is when the state the breaker started from was saved,
+	// empty if it started fresh
+	RestoredFrom string `json:"restored_from,omitempty"`
+
+	// Window fields are only set under the windowed policy
+	WindowMS             int64   `json:"window_ms,omitempty"`
+	WindowRequests       int64   `json:"window_requests,omitempty"`
+	WindowFailures       int64   `json:"window_failures,omitempty"`
+	FailureRate          float64 `json:"failure_rate,omitempty"`
+	FailureRateThreshold float64 `json:"failure_rate_threshold,omitempty"`
+	MinRequests          int     `json:"min_requests,omitempty"`
+
+	// Dependencies are the breakers guarding downstream calls, by name
+	Dependencies map[string]CircuitState `json:"dependencies,omitempty"`
+}
+
+// RateLimitState is the caller's rate limit bucket
+type RateLimitState struct {
+	Enabled     bool    `json:"enabled"`
+	Client      string  `json:"client"`
+	Limit       int     `json:"limit"`
+	Remaining   int     `json:"remaining"`
+	ResetS      float64 `json:"reset_s"`
+	RetryAfterS float64 `json:"retry_after_s"`
+	RatePerS    float64 `json:"rate_per_s"`
+}
+
+// ChaosSettings are the failure injection settings. FailureRate is the
+// rate in force, which a schedule or spike may hold away from BaseRate.
+type ChaosSettings struct {
+	FailureRate float64        `json:"failure_rate"`
+	BaseRate    float64        `json:"base_rate,omitempty"`
+	Schedule    *ChaosSchedule `json:"schedule,omitempty"`
+	Spike       *ChaosSpike    `json:"spike,omitempty"`
+}
+
+// ChaosPhase is one step of a chaos schedule
+type ChaosPhase struct {
+	DurationS   float64 `json:"duration_s"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// ChaosSchedule runs its phases in order, once or in a loop. Phase and
+// PhaseRemainingS are only filled in by the server.
+type ChaosSchedule struct {
+	Phases          []ChaosPhase `json:"phases"`
+	Loop            bool         `json:"loop,omitempty"`
+	Phase           int          `json:"phase,omitempty"`
+	PhaseRemainingS float64      `json:"phase_remaining_s,omitempty"`
+}
+
+// ChaosSpike is a running one-shot failure burst
+type ChaosSpike struct {
+	FailureRate float64 `json:"failure_rate"`
+	RemainingS  float64 `json:"remaining_s"`
+}
+
+// ImportProducts bulk creates or replaces products. Products with a zero
+// ID are sent without one so the server assigns it.
+func (c *Client) ImportProducts(ctx context.Context, ps []Product) (ImportResult, error) {
+	body := make([]map[string]interface{}, len(ps))
+	for i, p := range ps {
+		m := map[string]interface{}{
+			"name":        p.Name,
+			"category":    p.Category,
+			"description": p.Description,
+			"brand":       p.Brand,
+		}
+		if p.ID != 0 {
+			m["id"] = p.ID
+		}
+		if p.Price != nil {
+			m["price"] = *p.Price
+		}
+		body[i] = m
+	}
+	var res ImportResult
+	err := c.do(ctx, http.MethodPost, "/v1/products/import", body, &res, false)
+	return res, err
+}
+
+// Stats fetches the service counters
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var s Stats
+	err := c.do(ctx, http.MethodGet, "/v1/stats", nil, &s, true)
+	return s, err
+}
+
+// ResetStats empties the windowed counters; the lifetime ones carry on
+func (c *Client) ResetStats(ctx context.Context) (StatsWindows, error) {
+	var s StatsWindows
+	err := c.do(ctx, http.MethodPost, "/v1/stats/reset", nil, &s, true)
+	return s, err
+}
+
+// RateLimit reports the caller's bucket without consuming a token
+func (c *Client) RateLimit(ctx context.Context) (RateLimitState, error) {
+	var s RateLimitState
+	err := c.do(ctx, http.MethodGet, "/v1/ratelimit", nil, &s, true)
+	return s, err
+}
+
+// Circuit fetches the circuit breaker state
+func (c *Client) Circuit(ctx context.Context) (CircuitState, error) {
+	var s CircuitState
+	err := c.do(ctx, http.MethodGet, "/v1/circuit", nil, &s, true)
+	return s, err
+}
+
+// SetCircuit forces the breaker "open" or "closed"
+func (c *Client) SetCircuit(ctx context.Context, state string) (CircuitState, error) {
+	var s CircuitState
+	err := c.do(ctx, http.MethodPost, "/v1/admin/circuit", map[string]string{"state": state}, &s, true)
+	return s, err
+}
+
+// Chaos fetches the failure injection settings
+func (c *Client) Chaos(ctx context.Context) (ChaosSettings, error) {
+	var s ChaosSettings
+	err := c.do(ctx, http.MethodGet, "/v1/admin/chaos", nil, &s, true)
+	return s, err
+}
+
+// SetChaos changes the simulated failure rate
+func (c *Client) SetChaos(ctx context.Context, rate float64) (ChaosSettings, error) {
+	var s ChaosSettings
+	err := c.do(ctx, http.MethodPut, "/v1/admin/chaos", map[string]float64{"failure_rate": rate}, &s, true)
+	return s, err
+}
+
+// SetChaosSchedule starts a schedule of failure rates, replacing any
+// running one
+func (c *Client) SetChaosSchedule(ctx context.Context, phases []ChaosPhase, loop bool) (ChaosSettings, error) {
+	var s ChaosSettings
+	body := map[string]interface{}{"schedule": ChaosSchedule{Phases: phases, Loop: loop}}
+	err := c.do(ctx, http.MethodPut, "/v1/admin/chaos", body, &s, true)
+	return s, err
+}
+
+// ChaosSpike fails searches at rate for d. A zero rate or duration takes
+// the server's default of every search for 30 seconds.
+func (c *Client) ChaosSpike(ctx context.Context, rate float64, d time.Duration) (ChaosSettings, error) {
+	var s ChaosSettings
+	body := map[string]float64{}
+	if rate > 0 {
+		body["failure_rate"] = rate
+	}
+	if d > 0 {
+		body["duration_s"] = d.Seconds()
+	}
+	err := c.do(ctx, http.MethodPost, "/v1/admin/chaos/spike", body, &s, true)
+	return s, err
+}
@@ -0,0 +1,484 @@
+// Package client is a typed Go client for the product search service.
+// It has no dependency on the server code.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Product mirrors the server's product representation
+type Product struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	Brand       string `json:"brand"`
+	// Price is in cents, nil when the product has none
+	Price *int `json:"price,omitempty"`
+	// Names holds the name in other languages, by language
+	Names map[string]string `json:"names,omitempty"`
+	// Stock is set on search results when the server's inventory
+	// dependency answered
+	Stock *int `json:"stock,omitempty"`
+}
+
+// SearchRequest holds the parameters of a search
+type SearchRequest struct {
+	Query string
+	// Brand and Category filter exactly, ignoring case, and make the
+	// search exhaustive rather than sampled
+	Brand    string
+	Category string
+	// MinPrice and MaxPrice, in cents, keep only products priced within
+	// them, inclusive
+	MinPrice *int
+	MaxPrice *int
+	Offset   int
+	// Limit of 0 uses the server default
+	Limit int
+	// Sort is "id" or "name"; empty keeps the server's order
+	Sort string
+	// Mode is "sample", "exhaustive" or "indexed"; empty samples
+	Mode string
+	// Seed, when set, repeats the sampling of an earlier debug search
+	Seed *int64
+	// SampleStrategy is "uniform", "stratified-by-category" or
+	// "stratified-by-brand"; the server only honours it with Debug
+	SampleStrategy string
+	// Select, when set, limits the product fields returned, e.g. id and
+	// name; the others are left zero
+	Select []string
+	// Lang asks for product names in that language, e.g. "de", falling
+	// back to the default when there is none
+	Lang  string
+	Debug bool
+}
+
+// SearchResponse is the result of a search. CheckedCount, TotalChecked,
+// Seed, Mode and SampleStrategy are only filled in for debug requests.
+type SearchResponse struct {
+	Products     []Product `json:"products"`
+	TotalFound   int       `json:"total_found"`
+	SearchTimeMS float64   `json:"search_time_ms"`
+	CheckedCount int       `json:"checked_request,omitempty"`
+	TotalChecked int64     `json:"total_checked,omitempty"`
+	Seed         *int64    `json:"seed,omitempty"`
+	Mode         string    `json:"mode,omitempty"`
+	// SampleStrategy is how a sampled search drew its products
+	SampleStrategy string `json:"sample_strategy,omitempty"`
+
+	// Sampled reports whether TotalFound only counts a random sample, in
+	// which case EstimatedTotal extrapolates it to the whole catalog
+	Sampled          bool              `json:"sampled"`
+	EstimatedTotal   int               `json:"estimated_total,omitempty"`
+	EstimateInterval *EstimateInterval `json:"estimate_interval,omitempty"`
+	SampleMatches    int               `json:"sample_matches,omitempty"`
+
+	// Suggestions are corrected queries offered when nothing matched
+	Suggestions []string `json:"suggestions,omitempty"`
+
+	// Degraded is set when the server skipped part of the work
+	Degraded *Degradation `json:"degraded,omitempty"`
+}
+
+// Degradation describes what a degraded search skipped: "sample", "scan",
+// "budget" or "stock"
+type Degradation struct {
+	Level           int      `json:"level"`
+	ChecksPerSearch int      `json:"checks_per_search,omitempty"`
+	ScanLimit       int      `json:"scan_limit,omitempty"`
+	Skipped         []string `json:"skipped"`
+	// StockSkipped are the categories whose results lack stock, when
+	// Skipped has "stock"
+	StockSkipped []string `json:"stock_skipped,omitempty"`
+}
+
+// EstimateInterval bounds SearchResponse.EstimatedTotal
+type EstimateInterval struct {
+	Low        int     `json:"low"`
+	High       int     `json:"high"`
+	Confidence float64 `json:"confidence"`
+}
+
+// RetryPolicy controls retries of idempotent calls. The zero value
+// disables retries.
+type RetryPolicy struct {
+	// MaxAttempts includes the first try
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy retries up to three times starting at 100ms
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+// DefaultBackpressureCap is the longest a client waits on an
+// X-Backpressure hint unless WithBackpressureCap says otherwise
+const DefaultBackpressureCap = time.Second
+
+// Client talks to one product search service instance
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retry      RetryPolicy
+	apiKey     string
+	// signingKeys, when set, are the keys responses must be signed with
+	signingKeys map[string][]byte
+	// backpressureCap bounds the wait an X-Backpressure hint asks for; 0
+	// ignores the hints. notBefore is when the last hint's wait ends.
+	backpressureCap time.Duration
+	mu              sync.Mutex
+	notBefore       time.Time
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey sends key as a bearer token on every request
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithSignatureKeys makes the client check every successful response's
+// X-Signature, the HMAC-SHA256 of its body, against keys by key ID. A
+// response signed with none of them, or not matching, fails with
+// ErrBadSignature. List the old and new keys while a server's keys are
+// rotated.
+func WithSignatureKeys(keys map[string]string) Option {
+	return func(c *Client) {
+		c.signingKeys = make(map[string][]byte, len(keys))
+		for id, secret := range keys {
+			c.signingKeys[id] = []byte(secret)
+		}
+	}
+}
+
+// WithBackpressureCap caps how long the client waits before a request
+// when the server's last response asked it to slow down with
+// X-Backpressure; 0 ignores the hints
+func WithBackpressureCap(d time.Duration) Option {
+	return func(c *Client) { c.backpressureCap = d }
+}
+
+// WithRetry enables retries of idempotent calls
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// New returns a client for the service at baseURL, e.g. http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:         strings.TrimSuffix(baseURL, "/"),
+		httpClient:      http.DefaultClient,
+		backpressureCap: DefaultBackpressureCap,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Search runs a product search
+func (c *Client) Search(ctx context.Context, req SearchRequest) (SearchResponse, error) {
+	q := url.Values{}
+	q.Set("q", req.Query)
+	for k, v := range map[string]string{"brand": req.Brand, "category": req.Category, "sort": req.Sort, "mode": req.Mode, "sample_strategy": req.SampleStrategy} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if req.MinPrice != nil {
+		q.Set("min_price", strconv.Itoa(*req.MinPrice))
+	}
+	if req.MaxPrice != nil {
+		q.Set("max_price", strconv.Itoa(*req.MaxPrice))
+	}
+	if req.Offset > 0 {
+		q.Set("offset", strconv.Itoa(req.Offset))
+	}
+	if req.Limit > 0 {
+		q.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.Seed != nil {
+		q.Set("seed", strconv.FormatInt(*req.Seed, 10))
+	}
+	if req.Lang != "" {
+		q.Set("lang", req.Lang)
+	}
+	if len(req.Select) > 0 {
+		q.Set("select", strings.Join(req.Select, ","))
+	}
+	if req.Debug {
+		q.Set("debug", "1")
+	}
+	var body searchBody
+	err := c.do(ctx, http.MethodGet, "/v1/products/search?"+q.Encode(), nil, &body, true)
+	return body.response(), err
+}
+
+// searchBody decodes either v1 search shape: the envelope servers send by
+// default, or the flat one of servers run with -v1-envelope=false
+type searchBody struct {
+	SearchResponse
+	Data *[]Product `json:"data"`
+	Meta struct {
+		ElapsedMS float64        `json:"elapsed_ms"`
+		Search    SearchResponse `json:"search"`
+	} `json:"meta"`
+}
+
+func (b *searchBody) response() SearchResponse {
+	if b.Data == nil {
+		return b.SearchResponse
+	}
+	resp := b.Meta.Search
+	resp.Products = *b.Data
+	resp.SearchTimeMS = b.Meta.ElapsedMS
+	return resp
+}
+
+// GetProduct fetches a product by ID
+func (c *Client) GetProduct(ctx context.Context, id int) (Product, error) {
+	var p Product
+	err := c.do(ctx, http.MethodGet, "/v1/products/"+strconv.Itoa(id), nil, &p, true)
+	return p, err
+}
+
+// CreateProduct creates a product and returns it with its assigned ID.
+// It is never retried since a retry could create a duplicate.
+func (c *Client) CreateProduct(ctx context.Context, p Product) (Product, error) {
+	var created Product
+	err := c.do(ctx, http.MethodPost, "/v1/products", p, &created, false)
+	return created, err
+}
+
+// do sends a request, retrying idempotent ones per the retry policy
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}, idempotent bool) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	attempts := 1
+	if idempotent && c.retry.MaxAttempts > 1 {
+		attempts = c.retry.MaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		if err := c.waitBackpressure(ctx); err != nil {
+			return err
+		}
+		err := c.once(ctx, method, path, payload, out)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Transport errors and overload responses are worth retrying; a
+		// bad signature is a key mismatch as often as tampering
+		if apiErr, ok := err.(*Error); (ok && !apiErr.temporary()) || errors.Is(err, ErrBadSignature) || attempt >= attempts {
+			return err
+		}
+		if werr := sleep(ctx, c.backoff(attempt, err)); werr != nil {
+			return werr
+		}
+	}
+}
+
+func (c *Client) once(ctx context.Context, method, path string, payload []byte, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	c.noteBackpressure(resp.Header.Get("X-Backpressure"))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+	if c.signingKeys != nil {
+		return c.decodeSigned(resp, out)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("productsearch: decoding response: %w", err)
+	}
+	return nil
+}
+
+// decodeSigned reads the whole body, checks its signature and only then
+// decodes it. Streamed responses carry the signature in a trailer, which
+// is only there once the body has been read.
+func (c *Client) decodeSigned(resp *http.Response, out interface{}) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	sigs := resp.Header.Values("X-Signature")
+	if len(sigs) == 0 {
+		sigs = resp.Trailer.Values("X-Signature")
+	}
+	if err := VerifySignature(c.signingKeys, body, sigs); err != nil {
+		return err
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("productsearch: decoding response: %w", err)
+	}
+	return nil
+}
+
+// VerifySignature checks body against X-Signature values, each
+// keyid=<id>,sha256=<hex>. It passes when one made with a known key
+// matches, and fails with ErrBadSignature otherwise.
+func VerifySignature(keys map[string][]byte, body []byte, values []string) error {
+	known := false
+	for _, v := range values {
+		var id, sum string
+		for _, part := range strings.Split(v, ",") {
+			k, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "keyid":
+				id = val
+			case "sha256":
+				sum = val
+			}
+		}
+		key, ok := keys[id]
+		if !ok {
+			continue
+		}
+		known = true
+		want, err := hex.DecodeString(sum)
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), want) {
+			return nil
+		}
+	}
+	if !known {
+		return fmt.Errorf("%w: not signed with a known key", ErrBadSignature)
+	}
+	return fmt.Errorf("%w: body doesn't match", ErrBadSignature)
+}
+
+// backoff returns the delay before the given retry: exponential with full
+// jitter, but never shorter than a Retry-After hint
+func (c *Client) backoff(attempt int, last error) time.Duration {
+	d := c.retry.BaseDelay << (attempt - 1)
+	if c.retry.MaxDelay > 0 && (d > c.retry.MaxDelay || d <= 0) {
+		d = c.retry.MaxDelay
+	}
+	if d > 0 {
+		d = time.Duration(rand.Int63n(int64(d)) + 1)
+	}
+	if apiErr, ok := last.(*Error); ok && apiErr.RetryAfter > d {
+		d = apiErr.RetryAfter
+		if c.retry.MaxDelay > 0 && d > c.retry.MaxDelay {
+			d = c.retry.MaxDelay
+		}
+	}
+	return d
+}
+
+// noteBackpressure records a response's X-Backpressure delay, in
+// milliseconds, for the next request to wait out, capped
+func (c *Client) noteBackpressure(v string) {
+	ms, err := strconv.Atoi(v)
+	if c.backpressureCap <= 0 || err != nil || ms <= 0 {
+		return
+	}
+	d := time.Duration(ms) * time.Millisecond
+	if d > c.backpressureCap {
+		d = c.backpressureCap
+	}
+	until := time.Now().Add(d)
+	c.mu.Lock()
+	if until.After(c.notBefore) {
+		c.notBefore = until
+	}
+	c.mu.Unlock()
+}
+
+// waitBackpressure sleeps until the last hint's wait is over
+func (c *Client) waitBackpressure(ctx context.Context) error {
+	c.mu.Lock()
+	d := time.Until(c.notBefore)
+	c.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	return sleep(ctx, d)
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sentinel errors matched with errors.Is against an *Error
+var (
+	ErrCircuitOpen = errors.New("productsearch: circuit open")
+	ErrRateLimited = errors.New("productsearch: rate limited")
+	ErrOverloaded  = errors.New("productsearch: server overloaded")
+	ErrNotFound    = errors.New("productsearch: not found")
+	ErrBadRequest  = errors.New("productsearch: bad request")
+	// ErrUnauthorized is a missing or unknown API key, ErrForbidden a key
+	// without the needed role
+	ErrUnauthorized = errors.New("productsearch: unauthorized")
+	ErrForbidden    = errors.New("productsearch: forbidden")
+	ErrServer       = errors.New("productsearch: server error")
+	// ErrBadSignature is a response that failed the WithSignatureKeys
+	// check: it may have been changed on the way
+	ErrBadSignature = errors.New("productsearch: bad response signature")
+)
+
+// Error is returned for any non-2xx response
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Field is the request field a bad request was rejected for, when the
+	// server named one
+	Field string
+	// RetryAfter is the server's Retry-After hint, zero if none was sent
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("productsearch: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is maps error codes onto the sentinel errors
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrCircuitOpen:
+		return e.Code == "circuit_open"
+	case ErrRateLimited:
+		return e.Code == "rate_limited"
+	case ErrOverloaded:
+		return e.Code == "overloaded"
+	case ErrNotFound:
+		return e.Code == "not_found"
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrBadRequest:
+		return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// temporary reports whether retrying the same request may succeed
+func (e *Error) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// responseError builds an *Error from a non-2xx response, reading the v1
+// JSON error body when there is one
+func responseError(resp *http.Response) *Error {
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(raw)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"error"`
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") &&
+		json.Unmarshal(raw, &body) == nil && body.Error.Code != "" {
+		e.Code, e.Message, e.Field = body.Error.Code, body.Error.Message, body.Error.Field
+		return e
+	}
+	e.Code = errorCode(resp.StatusCode, resp.Header.Get("X-Error-Code"), e.Message)
+	return e
+}
+
+// errorCode works out the machine readable code from the X-Error-Code
+// header, falling back to the status and body for older servers
+func errorCode(status int, header, body string) string {
+	if header != "" {
+		return header
+	}
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusServiceUnavailable && strings.Contains(body, "Circuit Open"):
+		return "circuit_open"
+	case status == http.StatusServiceUnavailable:
+		return "overloaded"
+	case status >= 500:
+		return "internal_error"
+	}
+	return "bad_request"
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"productsearch/client"
+	"productsearch/resilience"
+)
+
+// newClientServer serves a test Server's real handlers over HTTP for the
+// client package to call
+func newClientServer(t *testing.T, configure func(*Config)) (*Server, *httptest.Server) {
+	t.Helper()
+	s := newTestServer(t, configure)
+	ts := httptest.NewServer(s.Routes())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestClientCreateGetSearch(t *testing.T) {
+	_, ts := newClientServer(t, nil)
+	c := client.New(ts.URL)
+	ctx := context.Background()
+
+	price := 1299
+	created, err := c.CreateProduct(ctx, client.Product{Name: "Client Lantern", Category: "Outdoors", Brand: "Gamma", Description: "Made by the client test", Price: &price})
+	if err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	if created.ID != testProducts || created.Name != "Client Lantern" {
+		t.Fatalf("created %+v, want ID %d", created, testProducts)
+	}
+	got, err := c.GetProduct(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetProduct: %v", err)
+	}
+	if got.Name != created.Name || got.Price == nil || *got.Price != price {
+		t.Errorf("GetProduct returned %+v, want %+v", got, created)
+	}
+	res, err := c.Search(ctx, client.SearchRequest{Query: "lantern", Mode: "exhaustive", Debug: true})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if res.TotalFound != 1 || len(res.Products) != 1 || res.Products[0].ID != created.ID {
+		t.Errorf("Search found %d: %+v", res.TotalFound, res.Products)
+	}
+	if res.Mode != "exhaustive" || res.Sampled || res.CheckedCount != testProducts+1 {
+		t.Errorf("debug fields: mode %q, sampled %v, checked %d", res.Mode, res.Sampled, res.CheckedCount)
+	}
+}
+
+func TestClientSearchParams(t *testing.T) {
+	_, ts := newClientServer(t, nil)
+	c := client.New(ts.URL)
+	res, err := c.Search(context.Background(), client.SearchRequest{Query: "product", Brand: "beta", Sort: "id", Limit: 3, Offset: 1, Select: []string{"id", "brand"}})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if res.TotalFound != testProducts/len(brands) || len(res.Products) != 3 {
+		t.Fatalf("found %d, got %d", res.TotalFound, len(res.Products))
+	}
+	for i, p := range res.Products {
+		if want := 6 + 5*i; p.ID != want || p.Brand != "Beta" || p.Name != "" {
+			t.Errorf("product %d: %+v, want ID %d with only id and brand", i, p, want)
+		}
+	}
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	s, ts := newClientServer(t, func(cfg *Config) {
+		cfg.RateLimitRPS, cfg.RateLimitBurst = 0.001, 3
+	})
+	c := client.New(ts.URL)
+	ctx := context.Background()
+
+	_, err := c.GetProduct(ctx, 5000)
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing product: %v", err)
+	}
+
+	_, err = c.Search(ctx, client.SearchRequest{Query: "x", Limit: 1000})
+	if !errors.Is(err, client.ErrBadRequest) || !errors.As(err, &apiErr) || apiErr.Field != "limit" {
+		t.Errorf("limit=1000: %v", err)
+	}
+
+	for s.breaker.State() != resilience.StateOpen {
+		s.breaker.RecordFailure()
+	}
+	_, err = c.Search(ctx, client.SearchRequest{Query: "x"})
+	if !errors.Is(err, client.ErrCircuitOpen) || !errors.As(err, &apiErr) || apiErr.RetryAfter <= 0 {
+		t.Errorf("open circuit: %v", err)
+	}
+	s.breaker.Reset()
+
+	// The burst of three is spent by now
+	_, err = c.Search(ctx, client.SearchRequest{Query: "x"})
+	if !errors.Is(err, client.ErrRateLimited) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("past the burst: %v", err)
+	}
+}
+
+// flaky answers the first fails requests with 503 and Retry-After, then
+// hands the rest to next
+func flaky(fails int32, next http.Handler) (http.Handler, *int32) {
+	var calls int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= fails {
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("X-Error-Code", "overloaded")
+			http.Error(w, "Request overload", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &calls
+}
+
+func TestClientRetriesIdempotentCalls(t *testing.T) {
+	s := newTestServer(t, nil)
+	h, calls := flaky(2, s.Routes())
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c := client.New(ts.URL, client.WithRetry(client.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 20 * time.Millisecond}))
+
+	start := time.Now()
+	if _, err := c.GetProduct(context.Background(), 7); err != nil {
+		t.Fatalf("GetProduct after two 503s: %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("%d calls, want 3", *calls)
+	}
+	// Retry-After asks for a second, which MaxDelay caps
+	if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+		t.Errorf("retries took %s, want MaxDelay twice", d)
+	}
+
+	atomic.StoreInt32(calls, 0)
+	_, err := c.CreateProduct(context.Background(), client.Product{Name: "Once", Category: "Books", Brand: "Alpha"})
+	if !errors.Is(err, client.ErrOverloaded) || *calls != 1 {
+		t.Errorf("CreateProduct was retried: %v after %d calls", err, *calls)
+	}
+}
+
+func TestClientHonoursContext(t *testing.T) {
+	s := newTestServer(t, nil)
+	h, calls := flaky(100, s.Routes())
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	c := client.New(ts.URL, client.WithRetry(client.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: time.Second}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Search(ctx, client.SearchRequest{Query: "x"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's deadline", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond || *calls != 1 {
+		t.Errorf("gave up after %s and %d calls", d, *calls)
+	}
+}
+
+// TestClientStatsWindows counts searches, and one the open circuit
+// rejects, in the windows the client reads, then resets them through the
+// client, leaving the lifetime counters as they were
+func TestClientStatsWindows(t *testing.T) {
+	s, ts := newClientServer(t, nil)
+	c := client.New(ts.URL)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Search(ctx, client.SearchRequest{Query: "alpha", Mode: "exhaustive"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.breaker.ForceOpen()
+	if _, err := c.Search(ctx, client.SearchRequest{Query: "alpha", Mode: "exhaustive"}); err == nil {
+		t.Fatal("searched through an open circuit")
+	}
+	st, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, w := range map[string]client.StatsWindow{"10s": st.Windows.TenSeconds, "1m": st.Windows.Minute, "5m": st.Windows.FiveMinutes} {
+		if w.Requests != 3 || w.Successes != 2 || w.Rejected != 1 || w.Checked != 2*testProducts ||
+			w.SuccessRatio == nil || *w.SuccessRatio != 1 || w.ChecksPerSearch == nil || *w.ChecksPerSearch != testProducts {
+			t.Errorf("%s window: %+v", name, w)
+		}
+	}
+
+	reset, err := c.ResetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset.Resets != 1 || reset.Minute.Requests != 0 || reset.Minute.SuccessRatio != nil {
+		t.Errorf("after the reset: %+v", reset)
+	}
+	if st, err := c.Stats(ctx); err != nil || st.Requests != 3 || st.TotalChecked != 2*testProducts || st.Windows.Resets != 1 {
+		t.Errorf("lifetime counters after the reset: %d requests, %d checked: %v", st.Requests, st.TotalChecked, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// Clock is the time source for everything time based in a Server: breaker
+// cooldown, rate limit refill, chaos delays and SearchTime. It is the
+// resilience package's, so a Server's clock drives its primitives too.
+type Clock = resilience.Clock
+
+// Timer is the part of *time.Timer the service uses
+type Timer = resilience.Timer
+
+// manualClock only moves when Advance is called. Timers fire once the
+// clock has been advanced past their deadline.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+func newManualClock(start time.Time) *manualClock {
+	return &manualClock{now: start}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *manualClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward and fires every timer now due
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.at.After(c.now) {
+			t.c <- c.now
+			continue
+		}
+		pending = append(pending, t)
+	}
+	c.timers = pending
+}
+
+type manualTimer struct {
+	clock *manualClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.c }
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, pt := range t.clock.timers {
+		if pt == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"productsearch/resilience"
+)
+
+func TestManualClockTimers(t *testing.T) {
+	c := newManualClock(time.Unix(0, 0))
+	soon, later, stopped := c.NewTimer(time.Second), c.NewTimer(3*time.Second), c.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Stop should report true once, then false")
+	}
+	c.Advance(time.Second)
+	select {
+	case at := <-soon.C():
+		if !at.Equal(time.Unix(1, 0)) {
+			t.Errorf("fired at %v", at)
+		}
+	default:
+		t.Error("a timer due now didn't fire")
+	}
+	select {
+	case <-later.C():
+		t.Error("a timer fired early")
+	case <-stopped.C():
+		t.Error("a stopped timer fired")
+	default:
+	}
+	c.Advance(2 * time.Second)
+	if _, ok := <-later.C(); !ok || c.Since(time.Unix(0, 0)) != 3*time.Second {
+		t.Error("the clock didn't reach three seconds")
+	}
+	select {
+	case <-c.NewTimer(0).C():
+	default:
+		t.Error("a zero timer should fire at once")
+	}
+}
+
+// TestServerClockDrivesCooldown checks the breaker cooldown and limiter
+// refill follow the configured clock rather than the real one
+func TestServerClockDrivesCooldown(t *testing.T) {
+	clock := newManualClock(time.Unix(0, 0))
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = clock
+		cfg.RateLimitRPS, cfg.RateLimitBurst = 1, 1
+	})
+	h := s.Routes()
+	if rec := serve(h, http.MethodGet, "/products/search?q=alpha", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("first search: %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodGet, "/products/search?q=alpha", "", nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second search: %d, want 429", rec.Code)
+	}
+	clock.Advance(time.Second)
+	if rec := serve(h, http.MethodGet, "/products/search?q=alpha", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("after a second: %d, want the bucket refilled", rec.Code)
+	}
+
+	for s.breaker.State() != resilience.StateOpen {
+		s.breaker.RecordFailure()
+	}
+	if ok, remaining := s.breaker.Allow(); ok || remaining != s.cfg.Cooldown {
+		t.Fatalf("open breaker: allowed %v with %s left", ok, remaining)
+	}
+	clock.Advance(s.cfg.Cooldown - time.Millisecond)
+	if ok, _ := s.breaker.Allow(); ok {
+		t.Fatal("allowed before the cooldown")
+	}
+	clock.Advance(time.Millisecond)
+	if ok, _ := s.breaker.Allow(); !ok || s.breaker.State() != resilience.StateHalfOpen {
+		t.Fatalf("after the cooldown: allowed %v in %s", ok, resilience.StateName(s.breaker.State()))
+	}
+}
@@ -0,0 +1,423 @@
+// Command productctl queries and administers the product search service.
+//
+//	productctl [flags] <command> [args]
+//
+// Exit codes: 0 success, 1 usage or local error, 2 client error (4xx),
+// 3 server error (5xx or unreachable), 4 request shed (circuit open,
+// overloaded or rate limited).
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"productsearch/client"
+)
+
+const (
+	exitOK = iota
+	exitUsage
+	exitClient
+	exitServer
+	exitShed
+)
+
+type options struct {
+	addr    string
+	apiKey  string
+	timeout time.Duration
+	output  string
+}
+
+func addGlobalFlags(fs *flag.FlagSet, o *options) {
+	addr := os.Getenv("PRODUCTCTL_ADDR")
+	if addr == "" {
+		addr = "http://localhost:8080"
+	}
+	fs.StringVar(&o.addr, "addr", addr, "service base URL (env PRODUCTCTL_ADDR)")
+	fs.StringVar(&o.apiKey, "api-key", os.Getenv("PRODUCTCTL_API_KEY"), "API key for write and admin commands (env PRODUCTCTL_API_KEY)")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "request timeout")
+	fs.StringVar(&o.output, "output", "table", "output format: table or json")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: productctl [flags] <command> [args]
+
+Commands:
+  search [-debug] <query>      search products
+  get <id>                     fetch one product
+  import <file|->              import a JSON array or newline delimited JSON
+  stats                        show request counters
+  circuit status|open|close    show or change the circuit breaker
+  chaos get|set <rate>         show or change the simulated failure rate
+  chaos spike [rate] [secs]    fail searches in a burst (default 1 for 30s)
+  replay [-speed n] <file>     re-issue requests recorded with -record-file;
+                               -timeout applies per request
+
+Flags (accepted before or after the command):
+  -addr string      service base URL (default http://localhost:8080, env PRODUCTCTL_ADDR)
+  -api-key string   API key for write and admin commands (env PRODUCTCTL_API_KEY)
+  -timeout duration request timeout (default 10s)
+  -output string    table or json (default table)
+
+Exit codes: 0 ok, 1 usage, 2 client error, 3 server error, 4 request shed
+`)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
+}
+
+func run(args []string, out io.Writer) int {
+	var o options
+	global := flag.NewFlagSet("productctl", flag.ContinueOnError)
+	global.Usage = usage
+	addGlobalFlags(global, &o)
+	if err := global.Parse(args); err != nil {
+		return exitUsage
+	}
+	if global.NArg() == 0 {
+		usage()
+		return exitUsage
+	}
+	cmd, rest := global.Arg(0), global.Args()[1:]
+
+	// Each command gets its own flag set that also knows the global flags,
+	// seeded with whatever was given before the command
+	set := make(map[string]string)
+	global.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.Usage = usage
+	addGlobalFlags(fs, &o)
+	for name, v := range set {
+		fs.Set(name, v)
+	}
+	debug := fs.Bool("debug", false, "include debug fields (search)")
+	speed := fs.Float64("speed", 1, "replay speed multiplier, 0 sends as fast as possible (replay)")
+	if err := fs.Parse(rest); err != nil {
+		return exitUsage
+	}
+	if o.output != "table" && o.output != "json" {
+		fmt.Fprintln(os.Stderr, "output must be table or json")
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	c := client.New(o.addr, client.WithAPIKey(o.apiKey))
+	p := printer{w: out, json: o.output == "json"}
+	argv := fs.Args()
+
+	var err error
+	switch cmd {
+	case "search":
+		if len(argv) != 1 {
+			return usageError("search takes one query argument")
+		}
+		var res client.SearchResponse
+		if res, err = c.Search(ctx, client.SearchRequest{Query: argv[0], Debug: *debug}); err == nil {
+			p.search(res)
+		}
+	case "get":
+		if len(argv) != 1 {
+			return usageError("get takes one product ID")
+		}
+		id, convErr := strconv.Atoi(argv[0])
+		if convErr != nil {
+			return usageError("invalid product ID " + argv[0])
+		}
+		var prod client.Product
+		if prod, err = c.GetProduct(ctx, id); err == nil {
+			p.product(prod)
+		}
+	case "import":
+		if len(argv) != 1 {
+			return usageError("import takes a file name or -")
+		}
+		ps, readErr := readProducts(argv[0])
+		if readErr != nil {
+			fmt.Fprintln(os.Stderr, readErr)
+			return exitUsage
+		}
+		var res client.ImportResult
+		if res, err = c.ImportProducts(ctx, ps); err == nil {
+			p.kv(res, [][2]string{
+				{"imported", strconv.Itoa(res.Imported)},
+				{"created", strconv.Itoa(res.Created)},
+				{"updated", strconv.Itoa(res.Updated)},
+			})
+		}
+	case "stats":
+		var s client.Stats
+		if s, err = c.Stats(ctx); err == nil {
+			p.stats(s)
+		}
+	case "circuit":
+		if len(argv) != 1 {
+			return usageError("circuit takes status, open or close")
+		}
+		var s client.CircuitState
+		switch argv[0] {
+		case "status":
+			s, err = c.Circuit(ctx)
+		case "open":
+			s, err = c.SetCircuit(ctx, "open")
+		case "close":
+			s, err = c.SetCircuit(ctx, "closed")
+		default:
+			return usageError("circuit takes status, open or close")
+		}
+		if err == nil {
+			p.circuit(s)
+		}
+	case "chaos":
+		var s client.ChaosSettings
+		switch {
+		case len(argv) == 1 && argv[0] == "get":
+			s, err = c.Chaos(ctx)
+		case len(argv) == 2 && argv[0] == "set":
+			rate, convErr := strconv.ParseFloat(argv[1], 64)
+			if convErr != nil {
+				return usageError("invalid failure rate " + argv[1])
+			}
+			s, err = c.SetChaos(ctx, rate)
+		case len(argv) >= 1 && len(argv) <= 3 && argv[0] == "spike":
+			var rate, secs float64
+			var convErr error
+			if len(argv) > 1 {
+				if rate, convErr = strconv.ParseFloat(argv[1], 64); convErr != nil || rate <= 0 {
+					return usageError("invalid failure rate " + argv[1])
+				}
+			}
+			if len(argv) > 2 {
+				if secs, convErr = strconv.ParseFloat(argv[2], 64); convErr != nil || secs <= 0 {
+					return usageError("invalid spike duration " + argv[2])
+				}
+			}
+			s, err = c.ChaosSpike(ctx, rate, time.Duration(secs*float64(time.Second)))
+		default:
+			return usageError("chaos takes get, set <rate> or spike [rate] [secs]")
+		}
+		if err == nil {
+			rows := [][2]string{{"failure_rate", strconv.FormatFloat(s.FailureRate, 'f', -1, 64)}}
+			if s.Schedule != nil {
+				rows = append(rows, [2]string{"schedule", fmt.Sprintf("phase %d of %d, %.1fs left",
+					s.Schedule.Phase+1, len(s.Schedule.Phases), s.Schedule.PhaseRemainingS)})
+			}
+			if s.Spike != nil {
+				rows = append(rows, [2]string{"spike", fmt.Sprintf("%g for %.1fs more", s.Spike.FailureRate, s.Spike.RemainingS)})
+			}
+			p.kv(s, rows)
+		}
+	case "replay":
+		if len(argv) != 1 {
+			return usageError("replay takes a recording file")
+		}
+		if *speed < 0 {
+			return usageError("speed must not be negative")
+		}
+		recs, readErr := readRecords(argv[0])
+		if readErr != nil {
+			fmt.Fprintln(os.Stderr, readErr)
+			return exitUsage
+		}
+		p.replay(replay(o.addr, o.apiKey, o.timeout, recs, *speed))
+	default:
+		return usageError("unknown command " + cmd)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func usageError(msg string) int {
+	fmt.Fprintln(os.Stderr, msg)
+	usage()
+	return exitUsage
+}
+
+// exitCode classifies an error so scripts can tell shed requests apart
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, client.ErrCircuitOpen), errors.Is(err, client.ErrOverloaded),
+		errors.Is(err, client.ErrRateLimited):
+		return exitShed
+	case errors.Is(err, client.ErrBadRequest):
+		return exitClient
+	}
+	return exitServer
+}
+
+// readProducts loads a JSON array or newline delimited JSON file
+func readProducts(name string) ([]client.Product, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(br)
+	var ps []client.Product
+	if first == '[' {
+		err = dec.Decode(&ps)
+		return ps, err
+	}
+	for {
+		var p client.Product
+		if err := dec.Decode(&p); err == io.EOF {
+			return ps, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			return b[0], nil
+		}
+		br.ReadByte()
+	}
+}
+
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func (p printer) encode(v interface{}) {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (p printer) products(ps []client.Product) {
+	if p.json {
+		p.encode(ps)
+		return
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCATEGORY\tBRAND")
+	for _, prod := range ps {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", prod.ID, prod.Name, prod.Category, prod.Brand)
+	}
+	tw.Flush()
+}
+
+func (p printer) product(prod client.Product) {
+	if p.json {
+		p.encode(prod)
+		return
+	}
+	p.products([]client.Product{prod})
+}
+
+func (p printer) search(res client.SearchResponse) {
+	if p.json {
+		p.encode(res)
+		return
+	}
+	p.products(res.Products)
+	fmt.Fprintf(p.w, "\n%d found in %.2fms", res.TotalFound, res.SearchTimeMS)
+	if res.CheckedCount > 0 {
+		fmt.Fprintf(p.w, " (checked %d, %d total)", res.CheckedCount, res.TotalChecked)
+	}
+	fmt.Fprintln(p.w)
+}
+
+func (p printer) kv(v interface{}, rows [][2]string) {
+	if p.json {
+		p.encode(v)
+		return
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\n", r[0], r[1])
+	}
+	tw.Flush()
+}
+
+func (p printer) stats(s client.Stats) {
+	rows := [][2]string{
+		{"requests", strconv.FormatInt(s.Requests, 10)},
+		{"successes", strconv.FormatInt(s.Successes, 10)},
+		{"failures", strconv.FormatInt(s.Failures, 10)},
+	}
+	for _, reason := range []string{"circuit_open", "bulkhead", "overload", "rate_limited"} {
+		rows = append(rows, [2]string{"rejected." + reason, strconv.FormatInt(s.Rejected[reason], 10)})
+	}
+	for name, k := range s.Auth.Keys {
+		rows = append(rows, [2]string{"key." + name, fmt.Sprintf("%s requests=%d denied=%d", k.Role, k.Requests, k.Denied)})
+	}
+	rows = append(rows,
+		[2]string{"in_flight", strconv.Itoa(int(s.InFlight))},
+		[2]string{"bulkhead", fmt.Sprintf("%d/%d", s.BulkheadUsed, s.BulkheadSize)},
+		[2]string{"total_checked", strconv.FormatInt(s.TotalChecked, 10)},
+		[2]string{"products", strconv.Itoa(s.Products)},
+		[2]string{"circuit", s.Circuit},
+		[2]string{"chaos_rate", strconv.FormatFloat(s.ChaosRate, 'f', -1, 64)},
+	)
+	p.kv(s, rows)
+}
+
+func (p printer) circuit(s client.CircuitState) {
+	rows := [][2]string{
+		{"state", s.State},
+		{"policy", s.Policy},
+		{"forced", strconv.FormatBool(s.Forced)},
+	}
+	if s.Policy == "windowed" {
+		rows = append(rows,
+			[2]string{"window", (time.Duration(s.WindowMS) * time.Millisecond).String()},
+			[2]string{"failures", fmt.Sprintf("%d/%d (%.1f%% of %.1f%%, min %d)", s.WindowFailures, s.WindowRequests,
+				s.FailureRate*100, s.FailureRateThreshold*100, s.MinRequests)},
+		)
+	} else {
+		rows = append(rows, [2]string{"failures", fmt.Sprintf("%d/%d", s.Failures, s.Threshold)})
+	}
+	rows = append(rows,
+		[2]string{"cooldown", (time.Duration(s.CooldownMS) * time.Millisecond).String()},
+		[2]string{"last_failure", s.LastFailure},
+	)
+	if s.RestoredFrom != "" {
+		rows = append(rows, [2]string{"restored_from", s.RestoredFrom})
+	}
+	names := make([]string, 0, len(s.Dependencies))
+	for name := range s.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := s.Dependencies[name]
+		rows = append(rows, [2]string{name, fmt.Sprintf("%s (%d failures)", d.State, d.Failures)})
+	}
+	p.kv(s, rows)
+}
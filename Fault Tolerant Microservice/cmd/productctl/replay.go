@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficRecord is one line of a recording made with the service's
+// -record-file flag
+type trafficRecord struct {
+	OffsetMS float64           `json:"t_ms"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Query    string            `json:"query,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// replayReport summarises a replay
+type replayReport struct {
+	Sent     int            `json:"sent"`
+	Errors   int            `json:"errors"`
+	ByStatus map[string]int `json:"by_status"`
+	ElapsedS float64        `json:"elapsed_s"`
+}
+
+// replayConcurrency caps requests in flight so a slow target can't make
+// replay open unbounded connections
+var replayConcurrency = 256
+
+func readRecords(name string) ([]trafficRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []trafficRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var r trafficRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		recs = append(recs, r)
+	}
+	return recs, sc.Err()
+}
+
+// replay re-issues recorded requests against base, keeping the recorded
+// inter-arrival times divided by speed. A speed of 0 sends as fast as the
+// concurrency cap allows.
+func replay(base, apiKey string, timeout time.Duration, recs []trafficRecord, speed float64) replayReport {
+	hc := &http.Client{Timeout: timeout}
+	rep := replayReport{ByStatus: make(map[string]int)}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	slots := make(chan struct{}, replayConcurrency)
+	start := time.Now()
+	for _, rec := range recs {
+		if speed > 0 {
+			// Offsets count from recorder start; replay from the first record
+			due := time.Duration((rec.OffsetMS - recs[0].OffsetMS) / speed * float64(time.Millisecond))
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(rec trafficRecord) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			status, err := replayOne(hc, base, apiKey, rec)
+			mu.Lock()
+			defer mu.Unlock()
+			rep.Sent++
+			if err != nil {
+				rep.Errors++
+				return
+			}
+			rep.ByStatus[strconv.Itoa(status)]++
+		}(rec)
+	}
+	wg.Wait()
+	rep.ElapsedS = time.Since(start).Seconds()
+	return rep
+}
+
+func replayOne(hc *http.Client, base, apiKey string, rec trafficRecord) (int, error) {
+	u := strings.TrimRight(base, "/") + rec.Path
+	if rec.Query != "" {
+		u += "?" + rec.Query
+	}
+	req, err := http.NewRequest(rec.Method, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range rec.Headers {
+		req.Header.Set(k, v)
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (p printer) replay(rep replayReport) {
+	rows := [][2]string{
+		{"sent", strconv.Itoa(rep.Sent)},
+		{"errors", strconv.Itoa(rep.Errors)},
+		{"elapsed", (time.Duration(rep.ElapsedS * float64(time.Second))).Round(time.Millisecond).String()},
+	}
+	statuses := make([]string, 0, len(rep.ByStatus))
+	for s := range rep.ByStatus {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		rows = append(rows, [2]string{"status." + s, strconv.Itoa(rep.ByStatus[s])})
+	}
+	p.kv(rep, rows)
+}
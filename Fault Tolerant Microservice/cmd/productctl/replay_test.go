@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRecording = `{"t_ms":1000,"method":"GET","path":"/products/search","query":"q=alpha","headers":{"X-Request-Id":"r1"}}
+
+{"t_ms":1100,"method":"GET","path":"/products/7"}
+{"t_ms":1200,"method":"HEAD","path":"/products/missing","headers":{"Accept":"application/json"}}
+`
+
+func writeRecording(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadRecords(t *testing.T) {
+	recs, err := readRecords(writeRecording(t, testRecording))
+	if err != nil || len(recs) != 3 || recs[0].Query != "q=alpha" || recs[2].Method != http.MethodHead {
+		t.Fatalf("%+v, %v", recs, err)
+	}
+	if _, err := readRecords(writeRecording(t, testRecording+"{not json\n")); err == nil || !strings.Contains(err.Error(), ":5:") {
+		t.Errorf("bad line: %v, want its line number", err)
+	}
+}
+
+// TestReplay re-issues a recording in order, with its headers and the
+// caller's key, spaced out by its offsets over the speed
+func TestReplay(t *testing.T) {
+	recs, err := readRecords(writeRecording(t, testRecording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu  sync.Mutex
+		got []*http.Request
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r)
+		mu.Unlock()
+		if r.URL.Path == "/products/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer target.Close()
+
+	rep := replay(target.URL, "replay-key", 5*time.Second, recs, 2)
+	if rep.Sent != 3 || rep.Errors != 0 || rep.ByStatus["200"] != 2 || rep.ByStatus["404"] != 1 {
+		t.Errorf("report %+v", rep)
+	}
+	// 200ms of recording at double speed
+	if rep.ElapsedS < 0.09 || rep.ElapsedS > 5 {
+		t.Errorf("replayed in %.3fs, want about 0.1s", rep.ElapsedS)
+	}
+	if len(got) != 3 {
+		t.Fatalf("target saw %d requests", len(got))
+	}
+	if got[0].URL.RequestURI() != "/products/search?q=alpha" || got[0].Header.Get("X-Request-Id") != "r1" || got[1].URL.Path != "/products/7" || got[2].Method != http.MethodHead {
+		t.Errorf("replayed %s, %s, %s %s", got[0].URL, got[1].URL, got[2].Method, got[2].URL)
+	}
+	for _, r := range got {
+		if r.Header.Get("Authorization") != "Bearer replay-key" {
+			t.Errorf("%s without the key: %v", r.URL, r.Header)
+		}
+	}
+
+	// At speed 0 the offsets are ignored; a dead target counts as errors
+	target.Close()
+	if rep := replay(target.URL, "", time.Second, recs, 0); rep.Sent != 3 || rep.Errors != 3 || rep.ElapsedS > 1 {
+		t.Errorf("against a closed target: %+v", rep)
+	}
+}
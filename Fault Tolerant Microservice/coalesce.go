@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// coalescer lets identical concurrent searches share one execution. The
+// first request with a key runs; duplicates arriving before it finishes
+// wait for its response instead of taking a bulkhead slot of their own.
+type coalescer struct {
+	enabled bool
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+
+	leaders   int64
+	coalesced int64
+	abandoned int64
+}
+
+// coalescedCall is one running execution. done is closed once the
+// response is recorded; ok is false if the leader wrote nothing, in which
+// case the waiters run the request themselves.
+type coalescedCall struct {
+	done   chan struct{}
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newCoalescer(enabled bool) *coalescer {
+	return &coalescer{enabled: enabled, calls: make(map[string]*coalescedCall)}
+}
+
+// join returns the call running for key, starting one if there is none
+func (c *coalescer) join(key string) (call *coalescedCall, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+	call = &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+func (c *coalescer) finish(key string, call *coalescedCall, rec *coalesceRecorder) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	call.ok = rec.status != 0
+	call.status, call.header, call.body = rec.status, rec.header, rec.body.Bytes()
+	close(call.done)
+}
+
+func (c *coalescer) stats() map[string]interface{} {
+	c.mu.Lock()
+	inFlight := len(c.calls)
+	c.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":   c.enabled,
+		"in_flight": inFlight,
+		"leaders":   atomic.LoadInt64(&c.leaders),
+		"coalesced": atomic.LoadInt64(&c.coalesced),
+		"abandoned": atomic.LoadInt64(&c.abandoned),
+	}
+}
+
+// coalesceRecorder buffers a response. Its header map starts empty, so
+// only what the handler set is shared, not the leader's request ID or
+// other per request headers set further out.
+type coalesceRecorder struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *coalesceRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *coalesceRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *coalesceRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// writeTo sends the recorded response, copying the header values since
+// every waiter gets the same ones
+func (call *coalescedCall) writeTo(w http.ResponseWriter) {
+	for k, v := range call.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+}
+
+// coalescable reports whether r may share another request's response.
+// A HEAD shares a GET's, so a probe of a cached search scans nothing.
+// Debug and seeded searches are about one particular execution, so they
+// always run on their own, and one that would take a 202 when shed must
+// not hand its job to a client that didn't ask for one. CSV and NDJSON
+// are streamed as they are written, which buffering them for the
+// waiters would undo.
+func coalescable(r *http.Request) bool {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || preferAsync(r) {
+		return false
+	}
+	q := r.URL.Query()
+	if f := strings.ToLower(q.Get("format")); f != "" && f != "json" {
+		return false
+	}
+	return q.Get("debug") == "" && q.Get("seed") == ""
+}
+
+// coalesceKey is the search key with the catalog's latest event ID, so a
+// request arriving after a mutation never gets a response computed
+// before it
+func coalesceKey(r *http.Request, catalogEvent int64) string {
+	return searchKey(r) + "\x00" + strconv.FormatInt(catalogEvent, 10)
+}
+
+// searchKey normalizes what a search response depends on besides the
+// catalog: the path, which carries the API version, the parameters with
+// case-insensitive ones lowercased, the resolved locale, Accept and the
+// X-Features flags, those refused too since the response warns of them
+func searchKey(r *http.Request) string {
+	q := url.Values{}
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			switch k {
+			case "q", "brand", "category", "mode", "sort", "select", "fields", "format":
+				v = strings.ToLower(strings.TrimSpace(v))
+			}
+			q.Add(k, v)
+		}
+	}
+	q.Del("lang")
+	var features string
+	if f := featuresFrom(r); f != nil {
+		features = f.label()
+		for _, w := range f.ignored {
+			features += "\x01" + w.Message
+		}
+	}
+	return strings.Join([]string{
+		r.URL.Path, q.Encode(), resolveLocale(r), r.Header.Get("Accept"), features,
+	}, "\x00")
+}
+
+// coalesce wraps a search handler so identical concurrent requests are
+// answered by one execution. Each waiter still gives up when its own
+// context ends. Followers' responses carry X-Coalesced: true.
+func (s *Server) coalesce(next http.HandlerFunc) http.HandlerFunc {
+	c := s.coalescer
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.enabled || !coalescable(r) {
+			next(w, r)
+			return
+		}
+		key := coalesceKey(r, s.store.events.lastID())
+		call, leader := c.join(key)
+		if leader {
+			atomic.AddInt64(&c.leaders, 1)
+			rec := &coalesceRecorder{header: make(http.Header)}
+			// Finish even if the handler panics, so waiters aren't stranded
+			func() {
+				defer c.finish(key, call, rec)
+				next(rec, r)
+			}()
+			if call.ok {
+				call.writeTo(w)
+			}
+			return
+		}
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			atomic.AddInt64(&c.abandoned, 1)
+			return
+		}
+		if !call.ok {
+			next(w, r)
+			return
+		}
+		atomic.AddInt64(&c.coalesced, 1)
+		s.statsd.incr("search.coalesced")
+		w.Header().Set("X-Coalesced", "true")
+		call.writeTo(w)
+	}
+}
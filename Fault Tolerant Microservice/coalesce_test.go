@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescable(t *testing.T) {
+	for target, want := range map[string]bool{
+		"/products/search?q=a":               true,
+		"/products/search?q=a&format=json":   true,
+		"/products/search?q=a&format=JSON":   true,
+		"/products/search?q=a&format=csv":    false,
+		"/products/search?q=a&format=ndjson": false,
+		"/products/search?q=a&debug=1":       false,
+		"/products/search?q=a&seed=3":        false,
+	} {
+		if got := coalescable(httptest.NewRequest(http.MethodGet, target, nil)); got != want {
+			t.Errorf("%s: coalescable %v, want %v", target, got, want)
+		}
+	}
+	if coalescable(httptest.NewRequest(http.MethodPost, "/products/search?q=a", nil)) {
+		t.Error("POST is coalescable")
+	}
+}
+
+// coalesceTwice sends two identical requests through s.coalesce, the
+// second while the first is held in the handler, and returns how many
+// times the handler ran and the second response
+func coalesceTwice(t *testing.T, s *Server, target string) (int32, *httptest.ResponseRecorder) {
+	t.Helper()
+	var calls int32
+	entered, release := make(chan struct{}, 2), make(chan struct{})
+	h := s.coalesce(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		entered <- struct{}{}
+		<-release
+		w.Write([]byte("body"))
+	})
+	first := httptest.NewRecorder()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h(first, httptest.NewRequest(http.MethodGet, target, nil))
+	}()
+	<-entered
+	second := httptest.NewRecorder()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h(second, httptest.NewRequest(http.MethodGet, target, nil))
+	}()
+	// Give the second request time to join the first or start its own
+	select {
+	case <-entered:
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+	if first.Body.String() != "body" || second.Body.String() != "body" {
+		t.Fatalf("bodies %q and %q", first.Body, second.Body)
+	}
+	return atomic.LoadInt32(&calls), second
+}
+
+func TestCoalesceSharesExecution(t *testing.T) {
+	s := newTestServer(t, nil)
+	calls, second := coalesceTwice(t, s, "/products/search?q=Alpha")
+	if calls != 1 || second.Header().Get("X-Coalesced") != "true" {
+		t.Errorf("%d executions, X-Coalesced %q", calls, second.Header().Get("X-Coalesced"))
+	}
+}
+
+func TestCoalesceSkipsStreams(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, format := range []string{"csv", "ndjson"} {
+		if calls, _ := coalesceTwice(t, s, "/products/search?q=Alpha&format="+format); calls != 2 {
+			t.Errorf("format=%s: %d executions, want 2", format, calls)
+		}
+	}
+}
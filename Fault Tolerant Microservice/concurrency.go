@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// clientConcurrency caps how many requests one client address may have in
+// flight, so a few slow connections from one place can't fill the
+// bulkhead. Each HTTP/2 stream counts, so many streams over one
+// connection are held to it too. Entries are removed as soon as a client
+// has nothing in flight. A cap of 0 disables it.
+type clientConcurrency struct {
+	perClient int
+	rejected  int64
+	statsd    *statsdClient
+	proxies   ipAllowlist
+	// status is what a rejection is sent with
+	status rejectionStatuses
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newClientConcurrency(perClient int) *clientConcurrency {
+	return &clientConcurrency{perClient: perClient, inFlight: make(map[string]int)}
+}
+
+func (c *clientConcurrency) acquire(client string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight[client] >= c.perClient {
+		return false
+	}
+	c.inFlight[client]++
+	return true
+}
+
+func (c *clientConcurrency) release(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight[client]--; c.inFlight[client] <= 0 {
+		delete(c.inFlight, client)
+	}
+}
+
+// concurrencyClient is the address the cap applies to, as resolved
+// through any trusted proxies. A RemoteAddr that isn't an IP address, such
+// as the in-process load test's, is taken whole.
+func concurrencyClient(r *http.Request, proxies ipAllowlist) string {
+	if ip := clientIP(r, proxies); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// limit wraps a handler with the per client cap, rejecting, with a 429
+// by default, before the request can reach the bulkhead
+func (c *clientConcurrency) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.perClient <= 0 {
+			next(w, r)
+			return
+		}
+		client := concurrencyClient(r, c.proxies)
+		if !c.acquire(client) {
+			atomic.AddInt64(&c.rejected, 1)
+			c.statsd.incr("concurrency.rejected")
+			w.Header().Set("Retry-After", "1")
+			writeErr(w, r, c.status.reject(ErrRateLimited, rejectClientConcurrency, "Too many concurrent requests from this client"))
+			return
+		}
+		defer c.release(client)
+		next(w, r)
+	}
+}
+
+// clientLoad is one client's in-flight count for /stats/clients
+type clientLoad struct {
+	Client   string `json:"client"`
+	InFlight int    `json:"in_flight"`
+}
+
+// top returns up to n clients with the most requests in flight
+func (c *clientConcurrency) top(n int) (clients []clientLoad, tracked int) {
+	c.mu.Lock()
+	clients = make([]clientLoad, 0, len(c.inFlight))
+	for client, count := range c.inFlight {
+		clients = append(clients, clientLoad{Client: client, InFlight: count})
+	}
+	c.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].InFlight != clients[j].InFlight {
+			return clients[i].InFlight > clients[j].InFlight
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	tracked = len(clients)
+	if len(clients) > n {
+		clients = clients[:n]
+	}
+	return clients, tracked
+}
+
+// topClientsShown is how many clients /stats/clients lists
+const topClientsShown = 20
+
+func (s *Server) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, tracked := s.concurrency.top(topClientsShown)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":  s.concurrency.perClient > 0,
+		"cap":      s.concurrency.perClient,
+		"tracked":  tracked,
+		"rejected": atomic.LoadInt64(&s.concurrency.rejected),
+		"clients":  clients,
+	})
+}
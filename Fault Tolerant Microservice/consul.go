@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceVersion is stamped at build time with
+// -ldflags "-X main.serviceVersion=..."
+var serviceVersion = "dev"
+
+// consulRegistration registers this instance with a local Consul agent
+// and keeps track of how that went for /health
+type consulRegistration struct {
+	agent   string
+	ID      string   `json:"ID"`
+	Name    string   `json:"Name"`
+	Address string   `json:"Address,omitempty"`
+	Port    int      `json:"Port"`
+	Tags    []string `json:"Tags"`
+	Check   struct {
+		HTTP                           string `json:"HTTP"`
+		Interval                       string `json:"Interval"`
+		Timeout                        string `json:"Timeout"`
+		DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+	} `json:"Check"`
+
+	mu         sync.Mutex
+	registered bool
+	attempts   int
+	lastErr    string
+	stop       chan struct{}
+}
+
+var (
+	consulClient  = &http.Client{Timeout: 5 * time.Second}
+	consulBackoff = time.Second
+	consulMaxWait = time.Minute
+)
+
+func newConsulRegistration(agent, name, address string, port int, https bool, tags []string) *consulRegistration {
+	if !strings.Contains(agent, "://") {
+		agent = "http://" + agent
+	}
+	c := &consulRegistration{
+		agent:   agent,
+		ID:      fmt.Sprintf("%s-%s-%d", name, instanceHost(), port),
+		Name:    name,
+		Address: address,
+		Port:    port,
+		Tags:    append([]string{"version=" + serviceVersion}, tags...),
+		stop:    make(chan struct{}),
+	}
+	checkHost := address
+	if checkHost == "" {
+		checkHost = instanceHost()
+	}
+	scheme := "http"
+	if https {
+		scheme = "https"
+	}
+	c.Check.HTTP = fmt.Sprintf("%s://%s:%d/readyz", scheme, checkHost, port)
+	c.Check.Interval = "10s"
+	c.Check.Timeout = "2s"
+	c.Check.DeregisterCriticalServiceAfter = "5m"
+	return c
+}
+
+// instanceHost names this machine for the service ID and health check
+func instanceHost() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return "localhost"
+}
+
+// registerLoop retries registration with capped exponential backoff until
+// it succeeds or deregister is called. It runs beside the server so an
+// unreachable agent never delays serving.
+func (c *consulRegistration) registerLoop() {
+	wait := consulBackoff
+	for {
+		err := c.put("/v1/agent/service/register", c)
+		c.mu.Lock()
+		c.attempts++
+		if err == nil {
+			c.registered = true
+			c.lastErr = ""
+		} else {
+			c.lastErr = err.Error()
+		}
+		c.mu.Unlock()
+		if err == nil {
+			log.Printf("Registered with Consul as %s", c.ID)
+			return
+		}
+		log.Printf("Consul registration failed, retrying in %s: %v", wait, err)
+		adminErrors.record("consul", err.Error())
+		select {
+		case <-time.After(wait):
+		case <-c.stop:
+			return
+		}
+		if wait *= 2; wait > consulMaxWait {
+			wait = consulMaxWait
+		}
+	}
+}
+
+// deregister stops any pending retries and removes the service from the
+// agent if it was registered
+func (c *consulRegistration) deregister() {
+	close(c.stop)
+	c.mu.Lock()
+	registered := c.registered
+	c.mu.Unlock()
+	if !registered {
+		return
+	}
+	if err := c.put("/v1/agent/service/deregister/"+url.PathEscape(c.ID), nil); err != nil {
+		log.Printf("Consul deregistration failed: %v", err)
+		return
+	}
+	c.mu.Lock()
+	c.registered = false
+	c.mu.Unlock()
+	log.Printf("Deregistered %s from Consul", c.ID)
+}
+
+func (c *consulRegistration) put(path string, body interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, c.agent+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := consulClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul %s: status %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+// status reports the registration for /health
+func (c *consulRegistration) status() map[string]interface{} {
+	if c == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":    true,
+		"registered": c.registered,
+		"service_id": c.ID,
+		"agent":      c.agent,
+		"attempts":   c.attempts,
+		"last_error": c.lastErr,
+	}
+}
+
+// parseList splits a comma separated flag value, dropping empty entries
+func parseList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is an agent refusing the first failures registrations, then
+// taking them, recording each request
+type fakeConsul struct {
+	mu       sync.Mutex
+	failures int
+	paths    []string
+	service  map[string]interface{}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.Method+" "+r.URL.Path)
+	if r.URL.Path == "/v1/agent/service/register" {
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(body, &f.service)
+	}
+}
+
+func (f *fakeConsul) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.paths...)
+}
+
+// healthRegistration reads the registration from /health
+func healthRegistration(t *testing.T, h http.Handler) map[string]interface{} {
+	t.Helper()
+	var health struct {
+		Registration map[string]interface{} `json:"registration"`
+	}
+	if err := json.Unmarshal(serve(h, http.MethodGet, "/health", "", nil).Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	return health.Registration
+}
+
+// TestConsulRegistration registers through an agent failing at first,
+// retrying while the server already answers, reports each step in
+// /health and deregisters on shutdown
+func TestConsulRegistration(t *testing.T) {
+	defer func(backoff time.Duration) { consulBackoff = backoff }(consulBackoff)
+	consulBackoff = time.Millisecond
+	agent := &fakeConsul{failures: 2}
+	ts := httptest.NewServer(agent)
+	defer ts.Close()
+	reg := newConsulRegistration(strings.TrimPrefix(ts.URL, "http://"), "productsearch", "10.0.0.7", 8080, false, []string{"blue"})
+	h := newTestServer(t, func(cfg *Config) { cfg.Consul = reg }).Routes()
+
+	if st := healthRegistration(t, h); st["enabled"] != true || st["registered"] != false || st["attempts"] != 0.0 {
+		t.Errorf("before registering: %v", st)
+	}
+	done := make(chan struct{})
+	go func() {
+		reg.registerLoop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("never registered")
+	}
+	if st := healthRegistration(t, h); st["registered"] != true || st["attempts"] != 3.0 || st["last_error"] != "" || st["service_id"] != reg.ID {
+		t.Errorf("after registering: %v", st)
+	}
+	svc := agent.service
+	check, _ := svc["Check"].(map[string]interface{})
+	tags, _ := svc["Tags"].([]interface{})
+	if svc["ID"] != reg.ID || svc["Name"] != "productsearch" || svc["Address"] != "10.0.0.7" || svc["Port"] != 8080.0 ||
+		len(tags) != 2 || tags[0] != "version="+serviceVersion || tags[1] != "blue" ||
+		check["HTTP"] != "http://10.0.0.7:8080/readyz" {
+		t.Errorf("registered %v", svc)
+	}
+
+	reg.deregister()
+	if st := healthRegistration(t, h); st["registered"] != false {
+		t.Errorf("after deregistering: %v", st)
+	}
+	paths := agent.requests()
+	if want := "PUT /v1/agent/service/deregister/" + reg.ID; len(paths) != 4 || paths[3] != want {
+		t.Errorf("agent saw %v, want three registrations and %s", paths, want)
+	}
+}
+
+// TestConsulDeregisterWhileRetrying stops retrying at shutdown, and with
+// nothing registered sends the agent nothing more
+func TestConsulDeregisterWhileRetrying(t *testing.T) {
+	defer func(backoff time.Duration) { consulBackoff = backoff }(consulBackoff)
+	consulBackoff = time.Hour
+	agent := &fakeConsul{failures: 1 << 30}
+	ts := httptest.NewServer(agent)
+	defer ts.Close()
+	reg := newConsulRegistration(ts.URL, "productsearch", "", 8080, true, nil)
+	if !strings.HasPrefix(reg.Check.HTTP, "https://") {
+		t.Errorf("TLS health check %s", reg.Check.HTTP)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		reg.registerLoop()
+		close(done)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); reg.status()["attempts"] != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no registration attempted")
+		}
+	}
+	reg.deregister()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("still retrying after deregister")
+	}
+	if st := reg.status(); st["registered"] != false || st["last_error"] == "" {
+		t.Errorf("status %v", st)
+	}
+	if paths := agent.requests(); len(paths) != 1 {
+		t.Errorf("agent saw %v, want the one failed registration", paths)
+	}
+}
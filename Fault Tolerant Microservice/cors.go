@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	corsAllowHeaders  = []string{"Content-Type", "Authorization", "X-API-Key", "X-Request-Id", "Prefer", "X-Callback-URL", "X-Tenant-Id"}
+	corsExposeHeaders = []string{"X-Request-Id", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After", "Location", "Preference-Applied", "X-Job-State", "X-Backpressure"}
+)
+
+// parseOrigins splits a comma separated origin list, dropping empty entries
+func parseOrigins(s string) []string {
+	var out []string
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o != "" {
+			out = append(out, strings.TrimSuffix(strings.ToLower(o), "/"))
+		}
+	}
+	return out
+}
+
+// originAllowed checks an Origin header against the allowlist.
+// Entries are either "*", an exact origin ("https://demo.example.com"),
+// or a wildcard subdomain ("https://*.example.com") which matches any
+// subdomain but not the bare domain itself.
+func originAllowed(origin string, allowed []string) bool {
+	origin = strings.ToLower(origin)
+	for _, a := range allowed {
+		if a == "*" || a == origin {
+			return true
+		}
+		i := strings.Index(a, "://*.")
+		if i < 0 {
+			continue
+		}
+		scheme, suffix := a[:i+3], a[i+4:]
+		if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) &&
+			len(origin) > len(scheme)+len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers
+// preflight requests directly so they never reach the search handler
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := originAllowed(origin, s.cfg.CORSOrigins)
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(s.cfg.CORSAllowMethods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowHeaders, ", "))
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(s.cfg.CORSMaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposeHeaders, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
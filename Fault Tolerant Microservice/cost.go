@@ -0,0 +1,160 @@
+package main
+
+import "sync"
+
+// Search costs are in work units, one product check each; the rest are
+// rough multiples of it
+const (
+	costCheck = 1
+	// costTrace is explaining one traced candidate in debug output
+	costTrace = 4
+	// costPin is copying one match into a new snapshot
+	costPin = 1
+	// costStock is fetching stock for one result from the inventory
+	// dependency, retries and all
+	costStock = 50
+)
+
+// searchCost is a search's estimated work, in debug output. It is worked
+// out once the candidates are known and before any is checked.
+type searchCost struct {
+	// Estimate is the search's whole cost as asked for. Checks and
+	// Extras are what it does, Checks cut to the budget when Truncated.
+	Estimate int64 `json:"estimate"`
+	Checks   int64 `json:"checks"`
+	// Extras are the features on top of checking: tracing, snapshot
+	// pinning, stock, and a hedge's second sample
+	Extras int64 `json:"extras"`
+	// Budget is Config.SearchWorkBudget, absent when unlimited;
+	// Truncated is set when the candidates were cut to fit it
+	Budget    int64 `json:"budget,omitempty"`
+	Truncated bool  `json:"truncated,omitempty"`
+	// Charged is what the search holds of Config.SearchCostBudget while
+	// it runs, absent when that is off
+	Charged int64 `json:"charged,omitempty"`
+}
+
+// estimateCost prices a search over candidates checks. Features are
+// priced at their worst case, before it is known how many matches there
+// are to trace, pin or stock.
+func (s *Server) estimateCost(candidates int, mode string, page searchPage, traceMax int, wantSnapshot bool) searchCost {
+	c := searchCost{Checks: int64(candidates) * costCheck, Budget: s.cfg.SearchWorkBudget}
+	c.Extras += int64(min(traceMax, candidates)) * costTrace
+	if wantSnapshot {
+		c.Extras += int64(min(snapshotMaxProducts, candidates)) * costPin
+	}
+	if s.inventory != nil {
+		c.Extras += int64(min(page.limit, candidates)) * costStock
+	}
+	if mode == modeSample && s.hedger != nil {
+		c.Extras += c.Checks
+	}
+	c.Estimate = c.Checks + c.Extras
+	return c
+}
+
+// fit returns how many candidates the work budget leaves room for after
+// the extras, at least one, or all of them when it is unlimited. Checks
+// drops to what is left; Estimate stays what was asked for.
+func (c *searchCost) fit(candidates int) int {
+	if c.Budget <= 0 || c.Estimate <= c.Budget {
+		return candidates
+	}
+	c.Truncated = true
+	fit := int(max64(1, (c.Budget-c.Extras)/costCheck))
+	c.Checks = int64(fit) * costCheck
+	return fit
+}
+
+// work is what the search will actually do, within the work budget
+func (c *searchCost) work() int64 {
+	return c.Checks + c.Extras
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// costGate is the admission check on the work all searches in flight
+// hold between them, so one expensive search takes the room of several
+// cheap ones where the bulkhead counts each as one slot. A search costing
+// more than the whole budget is charged the whole budget, running only
+// when nothing else is.
+type costGate struct {
+	capacity int64
+
+	mu    sync.Mutex
+	inUse int64
+
+	admitted  int64
+	rejected  int64
+	truncated int64
+	// total and highest are over every estimate, admitted or not
+	total   int64
+	highest int64
+}
+
+func newCostGate(capacity int64) *costGate {
+	return &costGate{capacity: capacity}
+}
+
+// observe counts an estimate, truncated or not, for /stats
+func (g *costGate) observe(c searchCost) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.total += c.Estimate
+	if c.Estimate > g.highest {
+		g.highest = c.Estimate
+	}
+	if c.Truncated {
+		g.truncated++
+	}
+}
+
+// acquire charges cost against the budget, reporting what was charged,
+// to release later, and false when there is no room for it. With no
+// budget it always admits and charges nothing.
+func (g *costGate) acquire(cost int64) (int64, bool) {
+	if g.capacity <= 0 {
+		return 0, true
+	}
+	if cost > g.capacity {
+		cost = g.capacity
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.inUse+cost > g.capacity {
+		g.rejected++
+		return 0, false
+	}
+	g.inUse += cost
+	g.admitted++
+	return cost, true
+}
+
+func (g *costGate) release(charged int64) {
+	if charged == 0 {
+		return
+	}
+	g.mu.Lock()
+	g.inUse -= charged
+	g.mu.Unlock()
+}
+
+func (g *costGate) stats(workBudget int64) map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return map[string]interface{}{
+		"work_budget":      workBudget,
+		"truncated":        g.truncated,
+		"concurrent_limit": g.capacity,
+		"in_use":           g.inUse,
+		"admitted":         g.admitted,
+		"rejected":         g.rejected,
+		"estimated_total":  g.total,
+		"highest_estimate": g.highest,
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// costSearch runs a v1 debug search, returning its status and response
+func costSearch(t *testing.T, h http.Handler, target string) (int, QueryResult) {
+	t.Helper()
+	rec := serve(h, http.MethodGet, target, "", nil)
+	var res QueryResult
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("GET %s: decoding %q: %v", target, rec.Body, err)
+		}
+	}
+	return rec.Code, res
+}
+
+// searchCostStats reads /stats search_cost
+func searchCostStats(t *testing.T, h http.Handler) map[string]float64 {
+	t.Helper()
+	var st struct {
+		Cost map[string]float64 `json:"search_cost"`
+	}
+	if err := json.Unmarshal(serve(h, http.MethodGet, "/stats", "", nil).Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Cost
+}
+
+// TestSearchCostEstimate prices a search at its checks plus its
+// features, in debug output and /stats
+func TestSearchCostEstimate(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) {
+		cfg.ResponseEnvelope = false
+		cfg.DebugTraceMax = 10
+	}).Routes()
+	_, res := costSearch(t, h, "/v1/products/search?debug=1&mode=exhaustive&q=product")
+	want := searchCost{Estimate: testProducts + 10*costTrace, Checks: testProducts, Extras: 10 * costTrace}
+	if res.Cost == nil || *res.Cost != want {
+		t.Errorf("exhaustive cost %+v, want %+v", res.Cost, want)
+	}
+	_, res = costSearch(t, h, "/v1/products/search?debug=1&mode=exhaustive&q=product&snapshot=true")
+	if res.Cost == nil || res.Cost.Extras != 10*costTrace+testProducts*costPin {
+		t.Errorf("cost pinning a snapshot %+v", res.Cost)
+	}
+	if _, res = costSearch(t, h, "/v1/products/search?mode=exhaustive&q=product"); res.Cost != nil {
+		t.Errorf("cost %+v outside debug output", res.Cost)
+	}
+	st := searchCostStats(t, h)
+	if st["highest_estimate"] != float64(testProducts+10*costTrace+testProducts*costPin) || st["truncated"] != 0 || st["rejected"] != 0 {
+		t.Errorf("stats %v", st)
+	}
+}
+
+// TestSearchWorkBudget cuts a search estimated over the work budget to
+// the candidates that fit, marked degraded, and leaves cheaper ones be
+func TestSearchWorkBudget(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) {
+		cfg.ResponseEnvelope = false
+		cfg.DebugTraceMax = 0
+		cfg.SearchWorkBudget = 30
+		cfg.ChecksPerSearch = 20
+	}).Routes()
+	rec := serve(h, http.MethodGet, "/v1/products/search?debug=1&mode=exhaustive&q=product", "", nil)
+	var res QueryResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	if res.CheckedCount != 30 || res.TotalFound != 30 || res.Cost == nil || !res.Cost.Truncated || res.Cost.Checks != 30 || res.Cost.Estimate != testProducts {
+		t.Errorf("over the budget: checked %d, found %d, cost %+v", res.CheckedCount, res.TotalFound, res.Cost)
+	}
+	if res.Degraded == nil || len(res.Degraded.Skipped) != 1 || res.Degraded.Skipped[0] != "budget" || rec.Header().Get("X-Degraded") == "" {
+		t.Errorf("over the budget: degraded %+v, X-Degraded %q", res.Degraded, rec.Header().Get("X-Degraded"))
+	}
+
+	_, res = costSearch(t, h, "/v1/products/search?debug=1&q=product")
+	if res.CheckedCount != 20 || res.Cost == nil || res.Cost.Truncated || res.Degraded != nil {
+		t.Errorf("within the budget: checked %d, cost %+v, degraded %+v", res.CheckedCount, res.Cost, res.Degraded)
+	}
+	if st := searchCostStats(t, h); st["work_budget"] != 30 || st["truncated"] != 1 {
+		t.Errorf("stats %v", st)
+	}
+}
+
+// TestSearchCostBudget sheds a search when the work already in flight
+// leaves no room for it, while a cheaper one still fits
+func TestSearchCostBudget(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ResponseEnvelope = false
+		cfg.DebugTraceMax = 0
+		cfg.SearchCostBudget = 150
+		cfg.ChecksPerSearch = 20
+	})
+	h := s.Routes()
+	// An exhaustive scan of the catalog in flight
+	held, ok := s.costs.acquire(testProducts)
+	if !ok {
+		t.Fatal("no room for the first search")
+	}
+	rec := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=product", "", nil)
+	var body apiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusServiceUnavailable || body.Error.Code != codeOverloaded || body.Error.Reason != rejectCost {
+		t.Errorf("a second exhaustive scan: %d %s", rec.Code, rec.Body)
+	}
+	if code, res := costSearch(t, h, "/v1/products/search?debug=1&q=product"); code != http.StatusOK || res.Cost == nil || res.Cost.Charged != 20 {
+		t.Errorf("a sampled search beside it: %d, cost %+v", code, res.Cost)
+	}
+	s.costs.release(held)
+	if code, _ := costSearch(t, h, "/v1/products/search?mode=exhaustive&q=product"); code != http.StatusOK {
+		t.Errorf("once the first finished: %d", code)
+	}
+	// A search costing more than the whole budget runs alone
+	if code, res := costSearch(t, h, "/v1/products/search?debug=1&mode=exhaustive&q=product&snapshot=true"); code != http.StatusOK || res.Cost.Charged != 150 {
+		t.Errorf("a search over the whole budget: %d, cost %+v", code, res.Cost)
+	}
+	st := searchCostStats(t, h)
+	if st["rejected"] != 1 || st["admitted"] != 4 || st["in_use"] != 0 || st["concurrent_limit"] != 150 {
+		t.Errorf("stats %v", st)
+	}
+}
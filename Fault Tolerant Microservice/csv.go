@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// csvColumns are the product fields available as CSV columns, in their
+// default order. Debug counters are per response, not per product, so
+// they never appear in CSV.
+var csvColumns = []string{"id", "name", "category", "description", "brand"}
+
+// csvFlushRows is how many rows are buffered before flushing to the client
+var csvFlushRows = 500
+
+// streamFormat describes a requested CSV or NDJSON response
+type streamFormat struct {
+	// NDJSON is set for format=ndjson, one product object per line
+	NDJSON   bool
+	Columns  []string
+	Download bool
+	// sel is the select= selection NDJSON lines are projected to
+	sel fieldSet
+}
+
+// readFormat reads format=, fields= and download=. It returns nil for a
+// JSON response. A select= selection, when given instead of fields=,
+// picks the columns.
+func readFormat(q url.Values, sel fieldSet, errs *fieldErrors) *streamFormat {
+	f := &streamFormat{Columns: csvColumns, Download: q.Get("download") == "1" || strings.ToLower(q.Get("download")) == "true", sel: sel}
+	switch strings.ToLower(q.Get("format")) {
+	case "", "json":
+		return nil
+	case "ndjson":
+		f.NDJSON = true
+		return f
+	case "csv":
+	default:
+		errs.add("format", "format must be json, ndjson or csv")
+		return nil
+	}
+	if sel != 0 {
+		if q.Get("fields") != "" {
+			errs.add("", "give fields or select, not both")
+			return nil
+		}
+		f.Columns = sel.columns()
+	}
+	if fields := q.Get("fields"); fields != "" {
+		f.Columns = nil
+		for _, c := range strings.Split(fields, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if _, ok := productField(Product{}, c); !ok {
+				errs.add("fields", fmt.Sprintf("unknown field %q, expected some of %s", c, strings.Join(selectFields, ",")))
+				return nil
+			}
+			f.Columns = append(f.Columns, c)
+		}
+	}
+	return f
+}
+
+// productField returns one CSV column of p, false if there is no such
+// column
+func productField(p Product, col string) (string, bool) {
+	switch col {
+	case "id":
+		return p.ID.String(), true
+	case "name":
+		return p.Name, true
+	case "category":
+		return p.Category, true
+	case "description":
+		return p.Description, true
+	case "brand":
+		return p.Brand, true
+	case "price":
+		if p.Price == nil {
+			return "", true
+		}
+		return strconv.Itoa(*p.Price), true
+	case "stock":
+		if p.Stock == nil {
+			return "", true
+		}
+		return strconv.Itoa(*p.Stock), true
+	}
+	return "", false
+}
+
+// csvFormulaPrefixes start a cell a spreadsheet would run as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvCell quotes a value a spreadsheet would otherwise run as a formula
+// with a leading apostrophe, which spreadsheets show as text and hide.
+// Anyone may name a product, and analysts open these exports directly.
+func csvCell(v string) string {
+	if v != "" && strings.IndexByte(csvFormulaPrefixes, v[0]) >= 0 {
+		return "'" + v
+	}
+	return v
+}
+
+// writeStream streams products in the format asked for, through a streamWriter
+// so a slow consumer can't hold the handler. next returns false when
+// there are no more.
+func (s *Server) writeStream(w http.ResponseWriter, r *http.Request, f *streamFormat, name string, next func() (Product, bool)) {
+	sw := s.newStream(w, r)
+	defer sw.finish()
+	if f.NDJSON {
+		f.writeNDJSON(sw, name, next)
+		return
+	}
+	f.writeCSV(sw, name, next)
+}
+
+// writeCSV streams products as RFC 4180 CSV with a header row, flushing
+// every csvFlushRows rows. Cells are passed through csvCell.
+func (f *streamFormat) writeCSV(w http.ResponseWriter, name string, next func() (Product, bool)) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if f.Download {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	}
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+	if cw.Write(f.Columns) != nil {
+		return
+	}
+	row := make([]string, len(f.Columns))
+	for n := 1; ; n++ {
+		p, ok := next()
+		if !ok {
+			break
+		}
+		for i, c := range f.Columns {
+			v, _ := productField(p, c)
+			row[i] = csvCell(v)
+		}
+		if cw.Write(row) != nil {
+			return
+		}
+		if n%csvFlushRows == 0 {
+			cw.Flush()
+			if cw.Error() != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	cw.Flush()
+}
+
+// writeNDJSON streams products as one JSON object per line, projected
+// like a JSON response, flushing every csvFlushRows lines
+func (f *streamFormat) writeNDJSON(w http.ResponseWriter, name string, next func() (Product, bool)) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if f.Download {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.ndjson"`)
+	}
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for n := 1; ; n++ {
+		p, ok := next()
+		if !ok {
+			break
+		}
+		if enc.Encode(projectProduct(p, f.sel)) != nil {
+			return
+		}
+		if n%csvFlushRows == 0 {
+			if bw.Flush() != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	bw.Flush()
+}
+
+// productSlice adapts a slice to writeStream's iterator
+func productSlice(ps []Product) func() (Product, bool) {
+	i := 0
+	return func() (Product, bool) {
+		if i >= len(ps) {
+			return Product{}, false
+		}
+		i++
+		return ps[i-1], true
+	}
+}
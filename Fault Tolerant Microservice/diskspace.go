@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// diskStatter reports the free and total bytes of the filesystem holding
+// path, free meaning available to this process. statfsDisk is the real
+// one; anything else can stand in for it.
+type diskStatter interface {
+	diskUsage(path string) (free, total uint64, err error)
+}
+
+// diskStatus is the persistence check as reported by /readyz and /health
+type diskStatus struct {
+	Path           string  `json:"path"`
+	Degraded       bool    `json:"degraded"`
+	FreeBytes      uint64  `json:"free_bytes"`
+	TotalBytes     uint64  `json:"total_bytes"`
+	FreePercent    float64 `json:"free_percent"`
+	MinFreeBytes   uint64  `json:"min_free_bytes,omitempty"`
+	MinFreePercent float64 `json:"min_free_percent,omitempty"`
+	Error          string  `json:"error,omitempty"`
+	CheckedAt      string  `json:"checked_at"`
+}
+
+// diskHealth watches free space where the service writes its state file
+// and watchdog captures. Persistence is degraded while free space is
+// under either minimum, or when the filesystem can't be read at all; the
+// service still serves, but automatic writes pause. Results are cached
+// for cacheFor so readiness probes don't stat on every call.
+type diskHealth struct {
+	path       string
+	minFree    uint64
+	minFreePct float64
+	cacheFor   time.Duration
+	statter    diskStatter
+	clock      Clock
+	statsd     *statsdClient
+	hooks      *webhookSender
+
+	mu      sync.Mutex
+	checked time.Time
+	status  diskStatus
+	// paused counts automatic writes skipped while degraded
+	paused int64
+}
+
+func newDiskHealth(path string, minFree uint64, minFreePct float64, cacheFor time.Duration, statter diskStatter, clock Clock) (*diskHealth, error) {
+	if minFreePct < 0 || minFreePct >= 100 {
+		return nil, fmt.Errorf("disk check: minimum free percent must be in [0, 100)")
+	}
+	return &diskHealth{path: path, minFree: minFree, minFreePct: minFreePct, cacheFor: cacheFor, statter: statter, clock: clock}, nil
+}
+
+// check returns the status, statting again once the cached one is older
+// than cacheFor, and announces a change of degraded
+func (d *diskHealth) check() diskStatus {
+	d.mu.Lock()
+	now := d.clock.Now()
+	if !d.checked.IsZero() && now.Sub(d.checked) < d.cacheFor {
+		st := d.status
+		d.mu.Unlock()
+		return st
+	}
+	wasDegraded := d.status.Degraded
+	st := diskStatus{Path: d.path, MinFreeBytes: d.minFree, MinFreePercent: d.minFreePct, CheckedAt: now.UTC().Format(time.RFC3339)}
+	free, total, err := d.statter.diskUsage(d.path)
+	switch {
+	case err != nil:
+		st.Degraded, st.Error = true, err.Error()
+	default:
+		st.FreeBytes, st.TotalBytes = free, total
+		if total > 0 {
+			st.FreePercent = float64(free) / float64(total) * 100
+		}
+		st.Degraded = free < d.minFree || (d.minFreePct > 0 && st.FreePercent < d.minFreePct)
+	}
+	d.checked, d.status = now, st
+	d.mu.Unlock()
+	// Starting out healthy isn't news
+	if st.Degraded != wasDegraded {
+		d.announce(st)
+	}
+	return st
+}
+
+// ok reports whether automatic writes may go ahead, counting the ones
+// that may not
+func (d *diskHealth) ok() bool {
+	if !d.check().Degraded {
+		return true
+	}
+	d.mu.Lock()
+	d.paused++
+	d.mu.Unlock()
+	return false
+}
+
+func (d *diskHealth) announce(st diskStatus) {
+	event := "persistence.ok"
+	msg := fmt.Sprintf("%s has %dMB free (%.1f%%), automatic writes resumed", st.Path, st.FreeBytes>>20, st.FreePercent)
+	if st.Degraded {
+		event = "persistence.degraded"
+		msg = fmt.Sprintf("%s has %dMB free (%.1f%%), automatic writes paused", st.Path, st.FreeBytes>>20, st.FreePercent)
+		if st.Error != "" {
+			msg = st.Path + " can't be checked, automatic writes paused: " + st.Error
+		}
+	}
+	log.Println("Persistence:", msg)
+	adminErrors.record("disk", msg)
+	d.statsd.incr("persistence.transition", "degraded:"+fmt.Sprint(st.Degraded))
+	d.hooks.notify(event, map[string]interface{}{
+		"path":         st.Path,
+		"degraded":     st.Degraded,
+		"free_bytes":   st.FreeBytes,
+		"free_percent": st.FreePercent,
+		"error":        st.Error,
+	})
+}
+
+// persistenceStatus is the disk check for /readyz and /health
+func (s *Server) persistenceStatus() interface{} {
+	if s.disk == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	st := s.disk.check()
+	s.disk.mu.Lock()
+	paused := s.disk.paused
+	s.disk.mu.Unlock()
+	return struct {
+		Enabled bool `json:"enabled"`
+		diskStatus
+		Paused int64 `json:"paused_writes"`
+	}{true, st, paused}
+}
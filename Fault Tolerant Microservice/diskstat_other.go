@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskCheckSupported is false without statfs; the check is left off
+const diskCheckSupported = false
+
+type statfsDisk struct{}
+
+func (statfsDisk) diskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk space check not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+const diskCheckSupported = true
+
+// statfsDisk reads free space with statfs(2)
+type statfsDisk struct{}
+
+func (statfsDisk) diskUsage(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
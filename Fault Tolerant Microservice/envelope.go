@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// envelope is the v1 shape of list-like responses, unless
+// Config.ResponseEnvelope is off: the items, what they are a page of, and
+// where the pages either side are. Legacy routes keep their own shapes.
+type envelope struct {
+	Data  interface{}   `json:"data"`
+	Meta  envelopeMeta  `json:"meta"`
+	Links envelopeLinks `json:"links"`
+}
+
+type envelopeMeta struct {
+	Total int `json:"total"`
+	// Estimated is set when Total is extrapolated from a sample
+	Estimated bool    `json:"estimated"`
+	Limit     int     `json:"limit"`
+	Offset    int     `json:"offset"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+	// Search is the rest of a search response: the sample, debug,
+	// degradation, suggestion and snapshot fields, without the products
+	// and timing already given above
+	Search *QueryResult `json:"search,omitempty"`
+	// BackpressureMS repeats the X-Backpressure delay, when there is one
+	BackpressureMS int `json:"backpressure_ms,omitempty"`
+	// Features are the X-Features flags the request turned on, and
+	// Warnings name those it was refused
+	Features []string        `json:"features,omitempty"`
+	Warnings []searchWarning `json:"warnings,omitempty"`
+}
+
+// envelopeLinks are relative URLs, absent at either end
+type envelopeLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// envelopes reports whether r is answered with an envelope
+func (s *Server) envelopes(r *http.Request) bool {
+	return (s.cfg.ResponseEnvelope || featureOn(r, featureEnvelope)) && requestAPIVersion(r) >= 1
+}
+
+// newEnvelope wraps data, the page meta describes, linking the pages
+// either side in the body and in Link headers. available is how many
+// items the links page through, which for a sampled search is the sample's
+// matches rather than the estimate. pin sets query params on the links,
+// an empty value removing one, so the next page is taken from the same
+// snapshot or sample.
+func newEnvelope(w http.ResponseWriter, r *http.Request, data interface{}, available int, meta envelopeMeta, pin map[string]string) *envelope {
+	env := &envelope{Data: data, Meta: meta}
+	// A body the response cache keeps would replay the hint long after
+	// it was current, so only the header carries it there
+	if info := requestInfoFrom(r); info != nil && cacheFillFrom(r) == nil {
+		env.Meta.BackpressureMS = info.Backpressure
+	}
+	if f := featuresFrom(r); f != nil {
+		env.Meta.Features, env.Meta.Warnings = f.active, f.ignored
+	}
+	link := func(offset int) string {
+		q := r.URL.Query()
+		for k, v := range pin {
+			if v == "" {
+				q.Del(k)
+			} else {
+				q.Set(k, v)
+			}
+		}
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(meta.Limit))
+		return r.URL.Path + "?" + q.Encode()
+	}
+	if meta.Offset+meta.Limit < available {
+		env.Links.Next = link(meta.Offset + meta.Limit)
+		w.Header().Add("Link", "<"+env.Links.Next+`>; rel="next"`)
+	}
+	if meta.Offset > 0 {
+		env.Links.Prev = link(max(0, meta.Offset-meta.Limit))
+		w.Header().Add("Link", "<"+env.Links.Prev+`>; rel="prev"`)
+	}
+	return env
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// adminErrorEntry is one recorded internal error
+type adminErrorEntry struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// errorRing keeps the most recent internal errors for /admin/errors
+type errorRing struct {
+	mu      sync.Mutex
+	entries []adminErrorEntry
+	next    int
+	total   int64
+}
+
+var adminErrors = newErrorRing(100)
+
+func newErrorRing(size int) *errorRing {
+	return &errorRing{entries: make([]adminErrorEntry, 0, size)}
+}
+
+func (e *errorRing) record(source, message string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	entry := adminErrorEntry{Time: time.Now().UTC(), Source: source, Message: message}
+	if len(e.entries) < cap(e.entries) {
+		e.entries = append(e.entries, entry)
+	} else {
+		e.entries[e.next] = entry
+	}
+	e.next = (e.next + 1) % cap(e.entries)
+	e.total++
+}
+
+// snapshot returns the entries newest first
+func (e *errorRing) snapshot() ([]adminErrorEntry, int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]adminErrorEntry, 0, len(e.entries))
+	for i := 1; i <= len(e.entries); i++ {
+		out = append(out, e.entries[(e.next-i+len(e.entries))%len(e.entries)])
+	}
+	return out, e.total
+}
+
+func adminErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, total := adminErrors.snapshot()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":  total,
+		"errors": entries,
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Machine readable error codes, sent in the X-Error-Code header and, from
+// v1 on, in the JSON error body
+const (
+	codeCircuitOpen  = "circuit_open"
+	codeOverloaded   = "overloaded"
+	codeRateLimited  = "rate_limited"
+	codeInternal     = "internal_error"
+	codeNotFound     = "not_found"
+	codeBadRequest   = "bad_request"
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+	codeConflict     = "conflict"
+	codeTooLarge     = "payload_too_large"
+	codeGone         = "gone"
+	codeUnavailable  = "unavailable"
+	codeRange        = "range_not_satisfiable"
+	codeMisdirected  = "misdirected"
+	codeMethod       = "method_not_allowed"
+)
+
+// Domain errors. The store, the search path and the handlers return
+// these, usually wrapped with a message for the client, and writeErr
+// turns them into a status and error code; nothing else picks statuses.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrValidation = errors.New("invalid request")
+	// ErrStoreUnavailable is the catalog not being there to answer: not
+	// loaded yet, or failing
+	ErrStoreUnavailable = errors.New("store unavailable")
+	// ErrTimeout is a wait that ran out, for a bulkhead slot or a
+	// dependency
+	ErrTimeout             = errors.New("timed out")
+	ErrInternal            = errors.New("internal error")
+	ErrConflict            = errors.New("conflict")
+	ErrGone                = errors.New("gone")
+	ErrTooLarge            = errors.New("payload too large")
+	ErrOverloaded          = errors.New("overloaded")
+	ErrCircuitOpen         = errors.New("circuit open")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden")
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+	// ErrMisdirected is a request for a product another shard owns
+	ErrMisdirected = errors.New("misdirected")
+	// ErrMethodNotAllowed is a method no route for the path takes
+	ErrMethodNotAllowed = errors.New("method not allowed")
+)
+
+// errorMappings is the one place domain errors meet HTTP. The first kind
+// err is finds its status and code; anything unclassified is a 500.
+var errorMappings = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{ErrValidation, http.StatusBadRequest, codeBadRequest},
+	{ErrNotFound, http.StatusNotFound, codeNotFound},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, codeMethod},
+	{ErrConflict, http.StatusConflict, codeConflict},
+	{ErrGone, http.StatusGone, codeGone},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge, codeTooLarge},
+	{ErrRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable, codeRange},
+	{ErrMisdirected, http.StatusMisdirectedRequest, codeMisdirected},
+	{ErrUnauthorized, http.StatusUnauthorized, codeUnauthorized},
+	{ErrForbidden, http.StatusForbidden, codeForbidden},
+	{ErrRateLimited, http.StatusTooManyRequests, codeRateLimited},
+	{ErrCircuitOpen, http.StatusServiceUnavailable, codeCircuitOpen},
+	{ErrOverloaded, http.StatusServiceUnavailable, codeOverloaded},
+	{ErrTimeout, http.StatusServiceUnavailable, codeOverloaded},
+	{ErrStoreUnavailable, http.StatusServiceUnavailable, codeUnavailable},
+	{ErrInternal, http.StatusInternalServerError, codeInternal},
+}
+
+// Rejection reasons: the admission check that turned a request away
+// before any work was done. The error code comes from the kind, as for
+// any error, but each reason has a status of its own, which
+// -rejection-status can change for gateways with other retry
+// conventions.
+const (
+	rejectRateLimit         = "rate_limit"
+	rejectClientConcurrency = "client_concurrency"
+	rejectCircuitOpen       = "circuit_open"
+	rejectBulkhead          = "bulkhead"
+	rejectBulkheadTimeout   = "bulkhead_timeout"
+	rejectOverload          = "overload"
+	rejectCost              = "cost_budget"
+	rejectSubscribers       = "subscribers"
+)
+
+// rejectionStatuses maps a rejection reason to the status it is sent with
+type rejectionStatuses map[string]int
+
+// defaultRejectionStatus sends a client over its own limits a 429, to
+// back off, and a service refusing everyone a 503, to try elsewhere
+var defaultRejectionStatus = rejectionStatuses{
+	rejectRateLimit:         http.StatusTooManyRequests,
+	rejectClientConcurrency: http.StatusTooManyRequests,
+	rejectCircuitOpen:       http.StatusServiceUnavailable,
+	rejectBulkhead:          http.StatusServiceUnavailable,
+	rejectBulkheadTimeout:   http.StatusServiceUnavailable,
+	rejectOverload:          http.StatusServiceUnavailable,
+	rejectCost:              http.StatusServiceUnavailable,
+	rejectSubscribers:       http.StatusServiceUnavailable,
+}
+
+// parseRejectionStatus reads reason=status pairs, like
+// "rate_limit=503,circuit_open=429", over the defaults
+func parseRejectionStatus(s string) (rejectionStatuses, error) {
+	out := make(rejectionStatuses, len(defaultRejectionStatus))
+	for reason, status := range defaultRejectionStatus {
+		out[reason] = status
+	}
+	for _, pair := range parseList(s) {
+		reason, v, ok := strings.Cut(pair, "=")
+		reason = strings.TrimSpace(reason)
+		if !ok {
+			return nil, fmt.Errorf("rejection status %q: want reason=status", pair)
+		}
+		if _, known := defaultRejectionStatus[reason]; !known {
+			return nil, fmt.Errorf("rejection status %q: unknown reason, expected one of %s", pair, strings.Join(rejectionReasons(), ", "))
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("rejection status %q: status must be a 4xx or 5xx code", pair)
+		}
+		out[reason] = status
+	}
+	return out, nil
+}
+
+func rejectionReasons() []string {
+	reasons := make([]string, 0, len(defaultRejectionStatus))
+	for reason := range defaultRejectionStatus {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// errorStatus maps err to its status and error code
+func errorStatus(err error) (int, string) {
+	status, code := http.StatusInternalServerError, codeInternal
+	for _, m := range errorMappings {
+		if errors.Is(err, m.kind) {
+			status, code = m.status, m.code
+			break
+		}
+	}
+	var rej *rejection
+	if errors.As(err, &rej) {
+		if rej.status != 0 {
+			status = rej.status
+		} else if s, ok := defaultRejectionStatus[rej.reason]; ok {
+			status = s
+		}
+	}
+	return status, code
+}
+
+// breakerFailure reports whether err says something about the health of
+// what the breaker guards. A bad request or a missing product is the
+// caller's problem; a failing or slow store is a failure. A rate limit
+// is the caller's too, whatever status it is sent with.
+func breakerFailure(err error) bool {
+	status, _ := errorStatus(err)
+	return status >= http.StatusInternalServerError && !errors.Is(err, ErrOverloaded) && !errors.Is(err, ErrCircuitOpen) &&
+		!errors.Is(err, ErrRateLimited)
+}
+
+// kindError is a domain error with the message the client sees
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string { return e.message }
+
+func (e *kindError) Unwrap() error { return e.kind }
+
+// newError returns an error of kind, one of the Err values above, that
+// reads as message
+func newError(kind error, message string) error {
+	return &kindError{kind: kind, message: message}
+}
+
+// rejection is an error of kind from admission control, naming the check
+// that refused the request
+type rejection struct {
+	reason string
+	err    *kindError
+	// status overrides the reason's default, when set
+	status int
+}
+
+func (e *rejection) Error() string { return e.err.message }
+
+func (e *rejection) Unwrap() error { return e.err }
+
+// reject returns a rejection by the reason check, of kind, that reads as
+// message
+func reject(kind error, reason, message string) error {
+	return &rejection{reason: reason, err: &kindError{kind: kind, message: message}}
+}
+
+// reject is reject sent with the status m gives reason. A nil m keeps
+// the defaults.
+func (m rejectionStatuses) reject(kind error, reason, message string) error {
+	return &rejection{reason: reason, err: &kindError{kind: kind, message: message}, status: m[reason]}
+}
+
+// ValidationError is a request that failed validation. Field is the
+// query parameter, header or body field at fault, when there is one.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+func (e *ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// invalid returns a ValidationError for field, which may be empty
+func invalid(field, message string) error {
+	return &ValidationError{Field: field, Message: message}
+}
+
+// ValidationErrors is a body that failed validation in several fields at
+// once, each reported in the 400 so the client can fix them together
+type ValidationErrors struct {
+	Violations []*ValidationError
+}
+
+func (e *ValidationErrors) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) Is(target error) bool { return target == ErrValidation }
+
+// fieldErrors collects a request's validation errors as its parameters
+// are read, so one 400 reports every parameter at fault
+type fieldErrors []*ValidationError
+
+func (fe *fieldErrors) add(field, message string) {
+	*fe = append(*fe, &ValidationError{Field: field, Message: message})
+}
+
+// err is nil when nothing was at fault, the ValidationError itself when
+// one thing was, and ValidationErrors otherwise
+func (fe fieldErrors) err() error {
+	switch len(fe) {
+	case 0:
+		return nil
+	case 1:
+		return fe[0]
+	}
+	return &ValidationErrors{Violations: fe}
+}
+
+// apiError is the v1 error body
+type apiError struct {
+	Error struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		Field     string `json:"field,omitempty"`
+		RequestID string `json:"request_id,omitempty"`
+		// Reason names the admission check that rejected the request,
+		// which the status alone may not tell
+		Reason string `json:"reason,omitempty"`
+		// Violations lists every field at fault, the first repeated in
+		// Field, when a body failed validation in more than one
+		Violations []apiViolation `json:"violations,omitempty"`
+	} `json:"error"`
+}
+
+type apiViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeErr answers with err, its status and code from errorMappings:
+// plain text on legacy routes and a JSON apiError from v1 on, naming the
+// field of a ValidationError, or each of ValidationErrors, and the reason
+// for a rejection. An unclassified error's text stays in the log, as it
+// was never meant for the client.
+func writeErr(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	message := err.Error()
+	var ke *kindError
+	var ve *ValidationError
+	var ves *ValidationErrors
+	var rej *rejection
+	if status == http.StatusInternalServerError && !errors.As(err, &ke) {
+		log.Printf("Unclassified error on %s %s: %v", r.Method, r.URL.Path, err)
+		message = "Internal server error"
+	}
+	w.Header().Set("X-Error-Code", code)
+	if requestAPIVersion(r) == 0 {
+		http.Error(w, message, status)
+		return
+	}
+	var body apiError
+	body.Error.Code = code
+	body.Error.Message = message
+	switch {
+	case errors.As(err, &ves) && len(ves.Violations) > 0:
+		body.Error.Field = ves.Violations[0].Field
+		if len(ves.Violations) > 1 {
+			for _, v := range ves.Violations {
+				body.Error.Violations = append(body.Error.Violations, apiViolation{Field: v.Field, Message: v.Message})
+			}
+		}
+	case errors.As(err, &ve):
+		body.Error.Field = ve.Field
+	case errors.As(err, &rej):
+		body.Error.Reason = rej.reason
+	}
+	body.Error.RequestID = requestID(r)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, body)
+}
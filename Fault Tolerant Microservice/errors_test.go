@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorStatusMapsEveryKind(t *testing.T) {
+	for _, m := range errorMappings {
+		for _, err := range []error{
+			m.kind,
+			newError(m.kind, "Told the client"),
+			fmt.Errorf("context: %w", newError(m.kind, "Told the client")),
+		} {
+			if status, code := errorStatus(err); status != m.status || code != m.code {
+				t.Errorf("%v: %d %s, want %d %s", err, status, code, m.status, m.code)
+			}
+		}
+	}
+	for _, err := range []error{invalid("limit", "Bad limit"), &ValidationErrors{Violations: []*ValidationError{{Field: "a"}}}} {
+		if status, _ := errorStatus(err); status != http.StatusBadRequest {
+			t.Errorf("%T: %d, want 400", err, status)
+		}
+	}
+	if status, code := errorStatus(errors.New("disk on fire")); status != http.StatusInternalServerError || code != codeInternal {
+		t.Errorf("an unclassified error: %d %s", status, code)
+	}
+}
+
+func TestWriteErr(t *testing.T) {
+	write := func(version int, err error) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/products/7", nil)
+		writeErr(rec, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)), err)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) apiError {
+		t.Helper()
+		var body apiError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body, err)
+		}
+		return body
+	}
+
+	rec := write(0, newError(ErrNotFound, "Product not found"))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-Error-Code") != codeNotFound || strings.TrimSpace(rec.Body.String()) != "Product not found" {
+		t.Errorf("legacy: %d %s %q", rec.Code, rec.Header().Get("X-Error-Code"), rec.Body)
+	}
+
+	rec = write(1, invalid("limit", "limit must be 1 to 20"))
+	body := decode(rec)
+	if rec.Code != http.StatusBadRequest || body.Error.Code != codeBadRequest || body.Error.Field != "limit" || body.Error.Message != "limit must be 1 to 20" {
+		t.Errorf("v1 validation: %d %+v", rec.Code, body.Error)
+	}
+
+	var fe fieldErrors
+	fe.add("offset", "Bad offset")
+	fe.add("limit", "Bad limit")
+	body = decode(write(1, fe.err()))
+	if body.Error.Field != "offset" || len(body.Error.Violations) != 2 || body.Error.Violations[1].Field != "limit" {
+		t.Errorf("v1 violations: %+v", body.Error)
+	}
+
+	// An unclassified error's text is for the log only
+	rec = write(1, fmt.Errorf("reading %s: %w", "/secret/path", errors.New("EIO")))
+	body = decode(rec)
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "secret") || body.Error.Message != "Internal server error" {
+		t.Errorf("unclassified: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestStoreReturnsNotFound(t *testing.T) {
+	s := newTestServer(t, nil)
+	if err := s.store.update(Product{ID: 5000, Name: "Nothing", Category: "Books", Brand: "Alpha"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("updating a missing product: %v", err)
+	}
+	if _, err := s.store.delete(5000); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting a missing product: %v", err)
+	}
+	rec := serve(s.Routes(), http.MethodDelete, "/v1/products/5000", "", nil)
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-Error-Code") != codeNotFound {
+		t.Errorf("DELETE /v1/products/5000: %d %s", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestProductReadsBeforeLoad(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NumProducts, cfg.ChaosRate = testProducts, 0
+	cfg.Clock = newManualClock(time.Unix(0, 0).UTC())
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := serve(s.Routes(), http.MethodGet, "/v1/products/1", "", nil)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Error-Code") != codeUnavailable {
+		t.Errorf("GET /v1/products/1 before the catalog loaded: %d %s", rec.Code, rec.Header().Get("X-Error-Code"))
+	}
+}
+
+func TestValidateProductNamesField(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for body, field := range map[string]string{
+		`{"category":"Books","brand":"Alpha"}`:                                         "name",
+		`{"name":"Lamp","category":"Books","brand":"Alpha","names":{"fr":"a\u0001b"}}`: "names.fr",
+	} {
+		rec := serve(h, http.MethodPost, "/v1/products", body, http.Header{"Content-Type": {"application/json"}})
+		var res apiError
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != http.StatusBadRequest || res.Error.Field != field {
+			t.Errorf("POST %s: %d field %q, want 400 naming %s", body, rec.Code, res.Error.Field, field)
+		}
+	}
+}
+
+func TestParseRejectionStatus(t *testing.T) {
+	for _, tc := range []struct {
+		flag string
+		want map[string]int
+	}{
+		{"", nil},
+		{"rate_limit=503", map[string]int{rejectRateLimit: http.StatusServiceUnavailable}},
+		{" circuit_open = 429 , bulkhead=529", map[string]int{rejectCircuitOpen: http.StatusTooManyRequests, rejectBulkhead: 529}},
+	} {
+		got, err := parseRejectionStatus(tc.flag)
+		if err != nil {
+			t.Errorf("%q: %v", tc.flag, err)
+			continue
+		}
+		for reason, status := range defaultRejectionStatus {
+			if want, ok := tc.want[reason]; ok {
+				status = want
+			}
+			if got[reason] != status {
+				t.Errorf("%q: %s answers %d, want %d", tc.flag, reason, got[reason], status)
+			}
+		}
+	}
+	for _, bad := range []string{"maintenance=503", "rate_limit", "rate_limit=200", "rate_limit=600", "rate_limit=x"} {
+		if _, err := parseRejectionStatus(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestRejectionStatus(t *testing.T) {
+	for _, tc := range []struct {
+		kind   error
+		reason string
+		status int
+		code   string
+	}{
+		{ErrRateLimited, rejectRateLimit, http.StatusTooManyRequests, codeRateLimited},
+		{ErrRateLimited, rejectClientConcurrency, http.StatusTooManyRequests, codeRateLimited},
+		{ErrCircuitOpen, rejectCircuitOpen, http.StatusServiceUnavailable, codeCircuitOpen},
+		{ErrOverloaded, rejectBulkhead, http.StatusServiceUnavailable, codeOverloaded},
+		{ErrTimeout, rejectBulkheadTimeout, http.StatusServiceUnavailable, codeOverloaded},
+		{ErrOverloaded, rejectOverload, http.StatusServiceUnavailable, codeOverloaded},
+		{ErrOverloaded, rejectCost, http.StatusServiceUnavailable, codeOverloaded},
+		{ErrOverloaded, rejectSubscribers, http.StatusServiceUnavailable, codeOverloaded},
+	} {
+		if status, code := errorStatus(reject(tc.kind, tc.reason, "Refused")); status != tc.status || code != tc.code {
+			t.Errorf("%s: %d %s, want %d %s", tc.reason, status, code, tc.status, tc.code)
+		}
+	}
+}
+
+// TestRejectionStatusOverride sends rate limited clients a 503, which
+// keeps its code and reason and still isn't a breaker failure
+func TestRejectionStatusOverride(t *testing.T) {
+	mapping, err := parseRejectionStatus("rate_limit=503")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimitRPS, cfg.RateLimitBurst = 0.001, 1
+		cfg.RejectionStatus = mapping
+	}).Routes()
+	serve(h, http.MethodGet, "/v1/products/1", "", nil)
+	rec := serve(h, http.MethodGet, "/v1/products/1", "", nil)
+	var body apiError
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusServiceUnavailable || body.Error.Code != codeRateLimited || body.Error.Reason != rejectRateLimit {
+		t.Errorf("past the burst: %d %+v", rec.Code, body.Error)
+	}
+	if breakerFailure(mapping.reject(ErrRateLimited, rejectRateLimit, "Rate limit exceeded")) {
+		t.Errorf("a rate limit sent as 503 counts against the breaker")
+	}
+}
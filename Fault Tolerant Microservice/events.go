@@ -0,0 +1,237 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+)
+
+// Subscriber kinds, the unit /stats counts deliveries and drops in
+const (
+	subscriberSSE     = "sse"
+	subscriberWatch   = "watch"
+	subscriberWebhook = "webhook"
+)
+
+// productEvent describes one catalog mutation. Product is the new value
+// (nil on delete) and Old the previous one (nil on create). ID increases
+// by one per published event.
+type productEvent struct {
+	ID      int64
+	Type    string
+	Product *Product
+	Old     *Product
+}
+
+// overflowPolicy is what publish does for a subscriber whose buffer is
+// full. Either way the writer never waits.
+type overflowPolicy int
+
+const (
+	// overflowDropOldest discards the oldest queued event to make room
+	// and sets the subscriber's resync marker. The subscriber catches up
+	// from the log, or from a fresh snapshot, once it sees the marker, so
+	// nothing is lost while the log still holds what was dropped.
+	overflowDropOldest overflowPolicy = iota
+	// overflowDisconnect unsubscribes the subscriber and closes Gone. It
+	// ends its connection, and the client resumes from the log when it
+	// reconnects.
+	overflowDisconnect
+)
+
+// eventSub is one subscriber of the event bus
+type eventSub struct {
+	C      chan productEvent
+	kind   string
+	policy overflowPolicy
+	// overflowed is the resync marker overflowDropOldest sets
+	overflowed int32
+	gone       chan struct{}
+}
+
+// Gone is closed when an overflowDisconnect subscriber was dropped
+func (s *eventSub) Gone() <-chan struct{} {
+	return s.gone
+}
+
+// takeOverflow reports and clears the resync marker. Subscribers check it
+// after receiving an event and before handling it: the event may be
+// newer than the ones dropped.
+func (s *eventSub) takeOverflow() bool {
+	return atomic.SwapInt32(&s.overflowed, 0) == 1
+}
+
+// eventKindStats count one kind of subscriber. The bus lock guards them.
+type eventKindStats struct {
+	subscribers  int
+	delivered    int64
+	dropped      int64
+	disconnected int64
+}
+
+// eventBus is the one place catalog mutations go out from: the store
+// publishes each once, and the SSE feed, WebSocket watches and product
+// webhooks subscribe. The most recent logSize events are kept so
+// subscribers that fell behind, and clients that reconnect, can resume.
+//
+// One lock covers numbering, logging, delivery and the subscriber set.
+// Delivery never blocks, so holding it is cheap, and a subscriber that
+// registers before reading the log sees every later event in one or the
+// other, in ID order, however publishes, subscribes and unsubscribes
+// interleave.
+type eventBus struct {
+	mu    sync.Mutex
+	subs  map[*eventSub]struct{}
+	kinds map[string]*eventKindStats
+	// seq is written under mu and read atomically, as lastID is on every
+	// search
+	seq     int64
+	log     []productEvent
+	logSize int
+}
+
+func newEventBus(logSize int) *eventBus {
+	return &eventBus{subs: make(map[*eventSub]struct{}), kinds: make(map[string]*eventKindStats), logSize: logSize}
+}
+
+// subscribe registers a subscriber of kind with room for buffer events,
+// at least one. It returns the ID of the last event before it, read
+// under the same lock, so every event after that ID reaches the
+// subscriber or sets its marker.
+func (b *eventBus) subscribe(kind string, buffer int, policy overflowPolicy) (*eventSub, int64) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	s := &eventSub{C: make(chan productEvent, buffer), kind: kind, policy: policy, gone: make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	b.kindLocked(kind).subscribers++
+	return s, b.seq
+}
+
+// unsubscribe removes s; it is a no-op for one already disconnected
+func (b *eventBus) unsubscribe(s *eventSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		b.kindLocked(s.kind).subscribers--
+	}
+}
+
+func (b *eventBus) kindLocked(kind string) *eventKindStats {
+	ks := b.kinds[kind]
+	if ks == nil {
+		ks = &eventKindStats{}
+		b.kinds[kind] = ks
+	}
+	return ks
+}
+
+// publish numbers the event, logs it and offers it to every subscriber
+func (b *eventBus) publish(ev productEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ev.ID = b.seq + 1
+	atomic.StoreInt64(&b.seq, ev.ID)
+	b.log = append(b.log, ev)
+	// Trim in batches so the log is copied once per logSize events
+	if len(b.log) >= 2*b.logSize {
+		b.log = append([]productEvent(nil), b.log[len(b.log)-b.logSize:]...)
+	}
+
+	for s := range b.subs {
+		ks := b.kindLocked(s.kind)
+		select {
+		case s.C <- ev:
+			ks.delivered++
+			continue
+		default:
+		}
+		ks.dropped++
+		if s.policy == overflowDisconnect {
+			delete(b.subs, s)
+			ks.subscribers--
+			ks.disconnected++
+			close(s.gone)
+			continue
+		}
+		// The marker goes first, so a subscriber that receives anything
+		// queued after the drop sees it before handling that event. Only
+		// publish sends, under mu, so once the oldest is taken the send
+		// can't fail; the subscriber may have taken it first.
+		atomic.StoreInt32(&s.overflowed, 1)
+		select {
+		case <-s.C:
+		default:
+		}
+		s.C <- ev
+		ks.delivered++
+	}
+}
+
+// resize changes how many events are kept, discarding the oldest beyond
+// it. Growing it back doesn't bring discarded events back; resuming from
+// before them reports a gap, as it does for any trimmed event.
+func (b *eventBus) resize(logSize int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logSize = logSize
+	if len(b.log) > logSize {
+		b.log = append([]productEvent(nil), b.log[len(b.log)-logSize:]...)
+	}
+}
+
+// since returns the logged events after id. It returns false when events
+// after id have already been trimmed, so the caller can't resume
+// without a gap.
+func (b *eventBus) since(id int64) ([]productEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log := b.log
+	if len(log) > b.logSize {
+		log = log[len(log)-b.logSize:]
+	}
+	if id >= b.seq {
+		return nil, true
+	}
+	if len(log) == 0 || id < log[0].ID-1 {
+		return nil, false
+	}
+	return append([]productEvent(nil), log[id-log[0].ID+1:]...), true
+}
+
+// lastID is the ID of the most recent event, 0 before any
+func (b *eventBus) lastID() int64 {
+	return atomic.LoadInt64(&b.seq)
+}
+
+func (b *eventBus) stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	byKind := make(map[string]interface{}, len(b.kinds))
+	for k, ks := range b.kinds {
+		byKind[k] = map[string]interface{}{
+			"subscribers":  ks.subscribers,
+			"delivered":    ks.delivered,
+			"dropped":      ks.dropped,
+			"disconnected": ks.disconnected,
+		}
+	}
+	logged := len(b.log)
+	if logged > b.logSize {
+		logged = b.logSize
+	}
+	return map[string]interface{}{
+		"published":   b.seq,
+		"logged":      logged,
+		"log_size":    b.logSize,
+		"subscribers": byKind,
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func publishN(b *eventBus, n int) {
+	for i := 0; i < n; i++ {
+		b.publish(productEvent{Type: eventUpdated})
+	}
+}
+
+func TestEventBusDropOldest(t *testing.T) {
+	b := newEventBus(10)
+	sub, last := b.subscribe(subscriberSSE, 2, overflowDropOldest)
+	if last != 0 {
+		t.Fatalf("subscribe returned last ID %d before any event", last)
+	}
+	publishN(b, 3)
+	if !sub.takeOverflow() || sub.takeOverflow() {
+		t.Errorf("the resync marker wasn't set once by the drop")
+	}
+	if a, c := (<-sub.C).ID, (<-sub.C).ID; a != 2 || c != 3 {
+		t.Errorf("queued %d and %d, want the newest two", a, c)
+	}
+	ks := b.stats()["subscribers"].(map[string]interface{})[subscriberSSE].(map[string]interface{})
+	if ks["delivered"] != int64(3) || ks["dropped"] != int64(1) || ks["subscribers"] != 1 {
+		t.Errorf("stats %v", ks)
+	}
+}
+
+func TestEventBusDisconnect(t *testing.T) {
+	b := newEventBus(10)
+	sub, _ := b.subscribe(subscriberWatch, 1, overflowDisconnect)
+	publishN(b, 2)
+	select {
+	case <-sub.Gone():
+	default:
+		t.Fatal("a full disconnect subscriber wasn't dropped")
+	}
+	if (<-sub.C).ID != 1 {
+		t.Errorf("the event queued before the overflow was lost")
+	}
+	b.unsubscribe(sub)
+	ks := b.stats()["subscribers"].(map[string]interface{})[subscriberWatch].(map[string]interface{})
+	if ks["subscribers"] != 0 || ks["disconnected"] != int64(1) {
+		t.Errorf("stats %v after a disconnect and an unsubscribe", ks)
+	}
+}
+
+func TestEventBusSince(t *testing.T) {
+	b := newEventBus(3)
+	publishN(b, 5)
+	if _, ok := b.since(0); ok {
+		t.Errorf("resumed from event 0 after it was trimmed")
+	}
+	evs, ok := b.since(2)
+	if !ok || len(evs) != 3 || evs[0].ID != 3 || evs[2].ID != 5 {
+		t.Errorf("since(2): %v %v", evs, ok)
+	}
+	if evs, ok := b.since(5); !ok || len(evs) != 0 {
+		t.Errorf("since the latest: %v %v", evs, ok)
+	}
+	b.resize(1)
+	if _, ok := b.since(3); ok {
+		t.Errorf("resumed from event 3 after shrinking the log to one")
+	}
+}
+
+// TestEventBusNoGaps publishes from several goroutines while subscribers
+// come and go and read slowly through small buffers. Every subscriber
+// must see each event after the ID it subscribed at exactly once and in
+// order, from its channel or, after an overflow, from the log.
+func TestEventBusNoGaps(t *testing.T) {
+	const publishers, perPublisher, subscribers = 4, 500, 8
+	b := newEventBus(publishers * perPublisher)
+	var wg sync.WaitGroup
+	for i := 0; i < subscribers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sub, last := b.subscribe(subscriberSSE, 1+i%3, overflowDropOldest)
+			defer b.unsubscribe(sub)
+			handle := func(ev productEvent) {
+				if ev.ID <= last {
+					return
+				}
+				if ev.ID != last+1 {
+					t.Errorf("subscriber %d got event %d after %d", i, ev.ID, last)
+				}
+				last = ev.ID
+			}
+			for last < publishers*perPublisher {
+				ev := <-sub.C
+				if sub.takeOverflow() {
+					missed, ok := b.since(last)
+					if !ok {
+						t.Errorf("subscriber %d can't resume from %d", i, last)
+						return
+					}
+					for _, m := range missed {
+						handle(m)
+					}
+				}
+				handle(ev)
+			}
+		}(i)
+	}
+	var pub sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		pub.Add(1)
+		go func() {
+			defer pub.Done()
+			publishN(b, perPublisher)
+		}()
+	}
+	pub.Wait()
+	wg.Wait()
+	if n := b.lastID(); n != publishers*perPublisher {
+		t.Errorf("last ID %d after %d publishes", n, publishers*perPublisher)
+	}
+}
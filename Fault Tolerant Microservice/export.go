@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exportSnapshotHeader carries the ID of a pinned export, to be passed
+// back as snapshot_id with a Range to resume it
+const exportSnapshotHeader = "X-Export-Snapshot"
+
+// exportEncoder writes products as NDJSON, one line each. A line's bytes
+// only depend on the product, so a pinned export encodes identically on
+// every request and byte offsets into it stay meaningful.
+type exportEncoder struct {
+	buf []byte
+}
+
+// line returns p's line, valid until the next call
+func (e *exportEncoder) line(p Product) ([]byte, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	e.buf = append(append(e.buf[:0], b...), '\n')
+	return e.buf, nil
+}
+
+// exportHandler streams the catalog as NDJSON. Plain requests stream the
+// live catalog, gzipped if the client accepts it. snapshot=true pins the
+// catalog first and answers with its ID in X-Export-Snapshot, its size
+// in Content-Length and Accept-Ranges: bytes; the client resumes with
+// snapshot_id and a Range header. Snapshot bodies are never compressed,
+// so offsets are into the same bytes whatever Accept-Encoding says.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Accept-Encoding")
+	q := r.URL.Query()
+	if id := q.Get("snapshot_id"); id != "" {
+		ss, ok := s.exports.get(id)
+		if !ok {
+			writeErr(w, r, newError(ErrGone, "Export snapshot expired, was evicted or never existed; start a new export"))
+			return
+		}
+		s.serveExportSnapshot(w, r, ss)
+		return
+	}
+	if v := q.Get("snapshot"); v != "" {
+		create, err := strconv.ParseBool(v)
+		if err != nil {
+			writeErr(w, r, invalid("snapshot", "snapshot must be true or false"))
+			return
+		}
+		if create {
+			if !s.exports.enabled() {
+				writeErr(w, r, invalid("snapshot", "Export snapshots are disabled"))
+				return
+			}
+			ss, err := s.pinExport(r.Context(), nil)
+			if err != nil {
+				writeErr(w, r, newError(ErrInternal, "Encoding the export failed"))
+				return
+			}
+			s.serveExportSnapshot(w, r, ss)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(catalogSeqHeader, strconv.FormatInt(s.store.events.lastID(), 10))
+	sw := s.newStream(w, r)
+	defer sw.finish()
+	var out io.Writer = sw
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(sw)
+		defer gz.Close()
+		out = gz
+	}
+	bw := bufio.NewWriter(out)
+	defer bw.Flush()
+	var enc exportEncoder
+	for _, id := range s.store.allIDs() {
+		p, ok := s.store.get(id)
+		if !ok {
+			continue
+		}
+		b, err := enc.line(p)
+		if err != nil {
+			return
+		}
+		if _, err := bw.Write(b); err != nil {
+			// The client went away
+			return
+		}
+	}
+}
+
+// pinExport copies the catalog into an export snapshot, encoding each
+// product once to index where its line ends. The lines themselves are
+// not kept: a range is served by encoding again from the line it starts
+// in, so a snapshot costs its products plus one offset each. It gives up
+// once ctx is done; op, when the export is an operation, counts products.
+func (s *Server) pinExport(ctx context.Context, op *operation) (*searchSnapshot, error) {
+	// Taken first, so the snapshot is at least as new as its generation
+	gen := s.store.events.lastID()
+	ids := s.store.allIDs()
+	ss := &searchSnapshot{gen: gen, mode: "export", products: make([]Product, 0, len(ids)), offsets: make([]int64, 0, len(ids))}
+	var enc exportEncoder
+	var end int64
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p, ok := s.store.get(id)
+		op.advance(false)
+		if !ok {
+			continue
+		}
+		b, err := enc.line(p)
+		if err != nil {
+			return nil, err
+		}
+		end += int64(len(b))
+		ss.products = append(ss.products, p)
+		ss.offsets = append(ss.offsets, end)
+	}
+	ss.checked = len(ss.products)
+	return s.exports.insert(ss), nil
+}
+
+// size is the length of the export in bytes
+func (ss *searchSnapshot) size() int64 {
+	if len(ss.offsets) == 0 {
+		return 0
+	}
+	return ss.offsets[len(ss.offsets)-1]
+}
+
+// serveExportSnapshot sends ss whole, or the one byte range asked for.
+// The snapshot ID doubles as the entity tag, so an If-Range naming
+// another export gets the whole of this one.
+func (s *Server) serveExportSnapshot(w http.ResponseWriter, r *http.Request, ss *searchSnapshot) {
+	size := ss.size()
+	etag := `"` + ss.id + `"`
+	h := w.Header()
+	h.Set("Content-Type", "application/x-ndjson")
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("ETag", etag)
+	h.Set(exportSnapshotHeader, ss.id)
+	h.Set(catalogSeqHeader, strconv.FormatInt(ss.gen, 10))
+	start, end, status := int64(0), size, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && (r.Header.Get("If-Range") == "" || r.Header.Get("If-Range") == etag) {
+		from, to, ok, satisfiable := parseByteRange(rng, size)
+		if ok && !satisfiable {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeErr(w, r, newError(ErrRangeNotSatisfiable, fmt.Sprintf("Range is outside the %d byte export", size)))
+			return
+		}
+		if ok {
+			start, end, status = from, to+1, http.StatusPartialContent
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, size))
+		}
+	}
+	h.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	sw := s.newStream(w, r)
+	defer sw.finish()
+	bw := bufio.NewWriter(sw)
+	defer bw.Flush()
+	// The first line ending after start is the one start falls in
+	i := sort.Search(len(ss.offsets), func(i int) bool { return ss.offsets[i] > start })
+	var enc exportEncoder
+	for pos := start; pos < end && i < len(ss.products); i++ {
+		b, err := enc.line(ss.products[i])
+		if err != nil {
+			return
+		}
+		lineStart := ss.offsets[i] - int64(len(b))
+		b = b[pos-lineStart:]
+		if n := end - pos; int64(len(b)) > n {
+			b = b[:n]
+		}
+		if _, err := bw.Write(b); err != nil {
+			return
+		}
+		pos += int64(len(b))
+	}
+}
+
+// parseByteRange reads a single range Range header against a body of
+// size bytes, returning the first and last byte. ok is false for a
+// header to ignore, as RFC 9110 allows: another unit, several ranges or
+// bad syntax. satisfiable is false when the range starts past the end.
+func parseByteRange(header string, size int64) (first, last int64, ok, satisfiable bool) {
+	spec := strings.TrimSpace(header)
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	spec = strings.TrimSpace(strings.TrimPrefix(spec, "bytes="))
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false, false
+	}
+	from, to := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+	// Positions are bare digits; ParseInt would take a sign too
+	if strings.Trim(from+to, "0123456789") != "" {
+		return 0, 0, false, false
+	}
+	if from == "" {
+		// A suffix: the last n bytes
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, true
+	}
+	first, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false, false
+	}
+	last = size - 1
+	if to != "" {
+		if last, err = strconv.ParseInt(to, 10, 64); err != nil || last < first {
+			return 0, 0, false, false
+		}
+		if last > size-1 {
+			last = size - 1
+		}
+	}
+	if first >= size {
+		return 0, 0, true, false
+	}
+	return first, last, true, true
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip, honouring
+// an explicit q=0
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if k, v, found := strings.Cut(strings.TrimSpace(param), "="); found && strings.TrimSpace(k) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
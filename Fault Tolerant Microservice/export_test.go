@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	const size = 100
+	for _, tc := range []struct {
+		header      string
+		first, last int64
+		ok, sat     bool
+	}{
+		{"bytes=0-9", 0, 9, true, true},
+		{"bytes=10-10", 10, 10, true, true},
+		{" bytes= 10 - 19 ", 10, 19, true, true},
+		{"bytes=90-500", 90, 99, true, true},
+		{"bytes=40-", 40, 99, true, true},
+		{"bytes=0-", 0, 99, true, true},
+		{"bytes=99-", 99, 99, true, true},
+		{"bytes=-10", 90, 99, true, true},
+		{"bytes=-500", 0, 99, true, true},
+		{"bytes=100-", 0, 0, true, false},
+		{"bytes=100-200", 0, 0, true, false},
+		{"bytes=-0", 0, 0, true, false},
+		// Ignored: served whole
+		{"bytes=0-9,20-29", 0, 0, false, false},
+		{"bytes=-5,0-1", 0, 0, false, false},
+		{"items=0-9", 0, 0, false, false},
+		{"bytes=9-0", 0, 0, false, false},
+		{"bytes=5", 0, 0, false, false},
+		{"bytes=-", 0, 0, false, false},
+		{"bytes=a-b", 0, 0, false, false},
+		{"bytes=+1-5", 0, 0, false, false},
+		{"bytes=--5", 0, 0, false, false},
+		{"bytes=0x10-", 0, 0, false, false},
+	} {
+		first, last, ok, sat := parseByteRange(tc.header, size)
+		if ok != tc.ok || sat != tc.sat || (sat && (first != tc.first || last != tc.last)) {
+			t.Errorf("%q: %d-%d ok %v satisfiable %v, want %d-%d %v %v", tc.header, first, last, ok, sat, tc.first, tc.last, tc.ok, tc.sat)
+		}
+	}
+	// Nothing in an empty body can be asked for
+	for _, header := range []string{"bytes=0-", "bytes=0-0", "bytes=-1"} {
+		if _, _, ok, sat := parseByteRange(header, 0); !ok || sat {
+			t.Errorf("%q of nothing: ok %v satisfiable %v", header, ok, sat)
+		}
+	}
+}
+
+// pinTestExport pins an export of s's catalog, returning its ID, ETag
+// and whole body
+func pinTestExport(t *testing.T, h http.Handler) (id, etag, body string) {
+	t.Helper()
+	rec := serve(h, http.MethodGet, "/products/export?snapshot=true", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("pin: %d %s", rec.Code, rec.Body)
+	}
+	id, etag = rec.Header().Get(exportSnapshotHeader), rec.Header().Get("ETag")
+	if id == "" || etag != `"`+id+`"` || rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("pin headers %v", rec.Header())
+	}
+	return id, etag, rec.Body.String()
+}
+
+// TestExportSnapshotRanges resumes a pinned export by range: one range
+// gets a 206 of exactly those bytes, anything the server ignores the
+// whole body, and a range past the end a 416 naming the size
+func TestExportSnapshotRanges(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	id, etag, whole := pinTestExport(t, h)
+	size := len(whole)
+	if size == 0 {
+		t.Fatal("empty export")
+	}
+	for _, tc := range []struct {
+		rng, ifRange string
+		status       int
+		first, last  int
+	}{
+		{"bytes=0-99", "", http.StatusPartialContent, 0, 99},
+		{"bytes=150-", "", http.StatusPartialContent, 150, size - 1},
+		{"bytes=-64", "", http.StatusPartialContent, size - 64, size - 1},
+		{fmt.Sprintf("bytes=%d-%d", size-10, size+1000), "", http.StatusPartialContent, size - 10, size - 1},
+		{"bytes=100-199", etag, http.StatusPartialContent, 100, 199},
+		{"", "", http.StatusOK, 0, size - 1},
+		{"bytes=0-9,20-29", "", http.StatusOK, 0, size - 1},
+		{"bytes=a-b", "", http.StatusOK, 0, size - 1},
+		{"bytes=100-199", `"another-export"`, http.StatusOK, 0, size - 1},
+		{"bytes=100-199", "W/" + etag, http.StatusOK, 0, size - 1},
+		{fmt.Sprintf("bytes=%d-", size), "", http.StatusRequestedRangeNotSatisfiable, 0, 0},
+		{"bytes=-0", "", http.StatusRequestedRangeNotSatisfiable, 0, 0},
+	} {
+		header := http.Header{}
+		if tc.rng != "" {
+			header.Set("Range", tc.rng)
+		}
+		if tc.ifRange != "" {
+			header.Set("If-Range", tc.ifRange)
+		}
+		rec := serve(h, http.MethodGet, "/products/export?snapshot_id="+id, "", header)
+		name := fmt.Sprintf("Range %q If-Range %q", tc.rng, tc.ifRange)
+		if rec.Code != tc.status {
+			t.Errorf("%s: %d, want %d", name, rec.Code, tc.status)
+			continue
+		}
+		cr := rec.Header().Get("Content-Range")
+		switch tc.status {
+		case http.StatusRequestedRangeNotSatisfiable:
+			if want := fmt.Sprintf("bytes */%d", size); cr != want {
+				t.Errorf("%s: Content-Range %q, want %q", name, cr, want)
+			}
+			continue
+		case http.StatusPartialContent:
+			if want := fmt.Sprintf("bytes %d-%d/%d", tc.first, tc.last, size); cr != want {
+				t.Errorf("%s: Content-Range %q, want %q", name, cr, want)
+			}
+		default:
+			if cr != "" {
+				t.Errorf("%s: Content-Range %q on a whole body", name, cr)
+			}
+		}
+		want := whole[tc.first : tc.last+1]
+		if rec.Body.String() != want {
+			t.Errorf("%s: body %q, want %q", name, rec.Body.String(), want)
+		}
+		if rec.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("%s: Content-Length %s for %d bytes", name, rec.Header().Get("Content-Length"), len(want))
+		}
+	}
+
+	if rec := serve(h, http.MethodGet, "/products/export?snapshot_id=nope", "", http.Header{"Range": {"bytes=0-"}}); rec.Code != http.StatusGone {
+		t.Errorf("unknown snapshot: %d", rec.Code)
+	}
+}
+
+// TestExportSnapshotEmpty pins an empty catalog: the whole export is
+// zero bytes, and no range of it can be satisfied
+func TestExportSnapshotEmpty(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) { cfg.NumProducts = 0 }).Routes()
+	id, _, whole := pinTestExport(t, h)
+	if whole != "" {
+		t.Fatalf("empty catalog exported %q", whole)
+	}
+	rec := serve(h, http.MethodGet, "/products/export?snapshot_id="+id, "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "0" || rec.Body.Len() != 0 {
+		t.Errorf("whole: %d, Content-Length %q, %d bytes", rec.Code, rec.Header().Get("Content-Length"), rec.Body.Len())
+	}
+	for _, rng := range []string{"bytes=0-", "bytes=0-0", "bytes=-1"} {
+		rec := serve(h, http.MethodGet, "/products/export?snapshot_id="+id, "", http.Header{"Range": {rng}})
+		if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */0" {
+			t.Errorf("%s: %d, Content-Range %q", rng, rec.Code, rec.Header().Get("Content-Range"))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Feature flags a request can opt into with X-Features
+const (
+	featureIndexed  = "indexed"
+	featurePartial  = "partial_results"
+	featureEnvelope = "envelope"
+)
+
+// featureFlags are the experiments a request can turn on for itself, each
+// a behaviour otherwise only configured for the whole instance. A new
+// experiment is a row here and a featureOn check where it takes effect;
+// the header, the allowlist, the spec and the metrics work from this
+// table.
+var featureFlags = []struct {
+	name  string
+	about string
+}{
+	{featureIndexed, "searches that don't give mode= run in indexed mode"},
+	{featurePartial, "a chaos failure answers with partial results, as with -chaos-partial"},
+	{featureEnvelope, "v1 list responses are wrapped in an envelope, as with -v1-envelope"},
+}
+
+// codeFeatureIgnored is the code of a refused flag's warning
+const codeFeatureIgnored = "feature_ignored"
+
+const (
+	// maxFeatureWarnings caps the ignored flags one request is warned of
+	maxFeatureWarnings = 8
+	// maxFeatureName cuts the ignored flag names warnings repeat back
+	maxFeatureName = 64
+)
+
+func knownFeature(name string) bool {
+	for _, f := range featureFlags {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func featureNames() []string {
+	names := make([]string, len(featureFlags))
+	for i, f := range featureFlags {
+		names[i] = f.name
+	}
+	return names
+}
+
+// featuresDescription describes each flag for the spec
+func featuresDescription() string {
+	parts := make([]string, len(featureFlags))
+	for i, f := range featureFlags {
+		parts[i] = f.name + ": " + f.about
+	}
+	return strings.Join(parts, "; ")
+}
+
+// requestFeatures are the flags a request turned on, in featureFlags
+// order, and warnings for those it asked for but didn't get
+type requestFeatures struct {
+	active  []string
+	ignored []searchWarning
+}
+
+func (f *requestFeatures) on(name string) bool {
+	if f == nil {
+		return false
+	}
+	for _, a := range f.active {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// label is the active flags as one metric label value, "" for none.
+// There are at most 2^len(featureFlags) of them.
+func (f *requestFeatures) label() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.active, ",")
+}
+
+// featureOn reports whether r turned on flag name
+func featureOn(r *http.Request, name string) bool {
+	info := requestInfoFrom(r)
+	return info != nil && info.Features.on(name)
+}
+
+// featuresFrom is what r's flags did, nil when it sent none
+func featuresFrom(r *http.Request) *requestFeatures {
+	if info := requestInfoFrom(r); info != nil {
+		return info.Features
+	}
+	return nil
+}
+
+// featureGate resolves X-Features against the registry and
+// Config.Features, the flags callers may turn on; every other flag is
+// ignored with a warning, never an error, so a client can send flags a
+// deployment doesn't take yet
+type featureGate struct {
+	allowed map[string]bool
+	// names cuts the ignored names warnings repeat back
+	names *keyGuard
+	// requests counts the requests turning each flag on, ignored the
+	// flags refused
+	requests map[string]*int64
+	ignored  int64
+}
+
+func newFeatureGate(allowed []string) (*featureGate, error) {
+	g := &featureGate{allowed: make(map[string]bool), names: newKeyGuard(maxFeatureWarnings, maxFeatureName), requests: make(map[string]*int64)}
+	for _, name := range allowed {
+		if !knownFeature(name) {
+			return nil, fmt.Errorf("unknown feature flag %q; flags are %s", name, strings.Join(featureNames(), ", "))
+		}
+		g.allowed[name] = true
+	}
+	for _, f := range featureFlags {
+		g.requests[f.name] = new(int64)
+	}
+	return g, nil
+}
+
+// resolve reads the comma separated flags in header
+func (g *featureGate) resolve(header string) *requestFeatures {
+	asked := map[string]bool{}
+	var warned int
+	f := &requestFeatures{}
+	for _, name := range strings.Split(header, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || asked[name] {
+			continue
+		}
+		asked[name] = true
+		var why string
+		switch {
+		case !knownFeature(name):
+			why = "unknown"
+		case !g.allowed[name]:
+			why = "not allowed on this deployment"
+		default:
+			continue
+		}
+		atomic.AddInt64(&g.ignored, 1)
+		if warned < maxFeatureWarnings {
+			warned++
+			if !g.names.fits(name) {
+				name = g.names.cut(name) + "..."
+			}
+			f.ignored = append(f.ignored, searchWarning{Code: codeFeatureIgnored, Message: fmt.Sprintf("feature flag %q ignored: %s", name, why)})
+		}
+	}
+	for _, ff := range featureFlags {
+		if asked[ff.name] && g.allowed[ff.name] {
+			f.active = append(f.active, ff.name)
+			atomic.AddInt64(g.requests[ff.name], 1)
+		}
+	}
+	return f
+}
+
+// middleware resolves a request's X-Features onto its requestInfo and
+// echoes the flags it turned on in the response's X-Features
+func (g *featureGate) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Features")
+		if info := requestInfoFrom(r); info != nil && header != "" {
+			info.Features = g.resolve(header)
+			if len(info.Features.active) > 0 {
+				w.Header().Set("X-Features", info.Features.label())
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (g *featureGate) stats() map[string]interface{} {
+	allowed := make([]string, 0, len(g.allowed))
+	requests := make(map[string]int64, len(g.requests))
+	for _, f := range featureFlags {
+		if g.allowed[f.name] {
+			allowed = append(allowed, f.name)
+		}
+		requests[f.name] = atomic.LoadInt64(g.requests[f.name])
+	}
+	return map[string]interface{}{
+		"allowed":  allowed,
+		"requests": requests,
+		"ignored":  atomic.LoadInt64(&g.ignored),
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestFeatureGateResolve resolves X-Features headers against an
+// allowlist: allowed flags turn on in registry order whatever their case
+// or repeats, the rest only warn, and a flood of them warns of a bounded
+// few
+func TestFeatureGateResolve(t *testing.T) {
+	g, err := newFeatureGate([]string{featureIndexed, featureEnvelope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := g.resolve(" Envelope,bogus, indexed,partial_results,envelope,,")
+	if got := f.label(); got != featureIndexed+","+featureEnvelope {
+		t.Errorf("active flags %q", got)
+	}
+	if len(f.ignored) != 2 || !strings.Contains(f.ignored[0].Message, `"bogus"`) || !strings.Contains(f.ignored[1].Message, `"`+featurePartial+`"`) {
+		t.Errorf("warnings %v, want bogus and %s", f.ignored, featurePartial)
+	}
+	flood := strings.Repeat(strings.Repeat("x", 1000)+",", 3)
+	for i := 0; i < 100; i++ {
+		flood += "flag" + strconv.Itoa(i) + ","
+	}
+	f = g.resolve(flood)
+	if len(f.active) != 0 || len(f.ignored) != maxFeatureWarnings {
+		t.Errorf("a flood of unknown flags turned on %v and warned %d times", f.active, len(f.ignored))
+	}
+	for _, w := range f.ignored {
+		if len(w.Message) > 2*maxFeatureName {
+			t.Errorf("warning of %d bytes repeats a long flag whole", len(w.Message))
+		}
+	}
+	if _, err := newFeatureGate([]string{"bogus"}); err == nil {
+		t.Errorf("an unknown flag was allowed")
+	}
+}
+
+// TestFeaturesKeySearches checks a search doesn't share a response with
+// one under other flags
+func TestFeaturesKeySearches(t *testing.T) {
+	g, err := newFeatureGate([]string{featureIndexed, featureEnvelope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyed := func(header string) string {
+		r := httptest.NewRequest(http.MethodGet, "/v1/products/search?q=shoe", nil)
+		info := &requestInfo{}
+		if header != "" {
+			info.Features = g.resolve(header)
+		}
+		return searchKey(r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	}
+	if keyed("") == keyed(featureIndexed) || keyed(featureIndexed) == keyed(featureIndexed+",bogus") {
+		t.Errorf("searches under different flags share a cache key")
+	}
+	if keyed(featureIndexed+","+featureEnvelope) != keyed("ENVELOPE, indexed") {
+		t.Errorf("the same flags spelt differently don't share a cache key")
+	}
+}
+
+// TestFeaturesNotWarmed saves plain searches for the next start's warmup
+// but not those made with flags, which a replay couldn't repeat
+func TestFeaturesNotWarmed(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Features = []string{featureIndexed}
+		cfg.ResponseCache = 100
+		cfg.StateFile = t.TempDir() + "/state.json"
+	})
+	h := s.Routes()
+	serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpha", "", nil)
+	serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=beta", "", http.Header{"X-Features": {featureIndexed}})
+	got := s.popularQueries()
+	if len(got) != 1 || got[0].Path != "/v1/products/search" || got[0].Query != "mode=exhaustive&q=alpha" {
+		t.Errorf("saved %+v, want the plain search alone", got)
+	}
+}
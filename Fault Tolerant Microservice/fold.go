@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldRunes spells the letters NFKD leaves alone, having no combining
+// mark to drop, the way their speakers write them in ASCII
+var foldRunes = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th", 'ø': "o", 'ł': "l",
+	'đ': "d", 'ħ': "h", 'ŧ': "t", 'ı': "i",
+}
+
+// foldText lowercases s and folds it for matching: it is decomposed to
+// NFKD and its nonspacing marks dropped, so diacritics go whether
+// precomposed or written as combining marks, and compatibility forms
+// like full-width letters become their plain counterparts. "Épsilon",
+// "E\u0301psilon" and "ｅｐｓｉｌｏｎ" all fold to "epsilon".
+func foldText(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return strings.ToLower(s)
+	}
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = appendFolded(b, r)
+	}
+	return string(b)
+}
+
+// appendFolded appends r as foldText folds it, which is rune by rune, to
+// b. Decomposing each rune alone only differs from decomposing the whole
+// string in the order of combining marks, which folding drops anyway.
+func appendFolded(b []byte, r rune) []byte {
+	if r < utf8.RuneSelf {
+		return append(b, byte(unicode.ToLower(r)))
+	}
+	var in [utf8.UTFMax]byte
+	var scratch [32]byte
+	for _, d := range string(norm.NFKD.Append(scratch[:0], in[:utf8.EncodeRune(in[:], r)]...)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		d = unicode.ToLower(d)
+		if f, ok := foldRunes[d]; ok {
+			b = append(b, f...)
+			continue
+		}
+		b = utf8.AppendRune(b, d)
+	}
+	return b
+}
+
+// foldLower folds an already lowercased field, returning it unchanged,
+// and sharing its memory, when folding makes no difference
+func foldLower(lower string) string {
+	if f := foldText(lower); f != lower {
+		return f
+	}
+	return lower
+}
+
+// foldNames folds lowercased localized names, returning the same map when
+// none of them change
+func foldNames(names map[string]string) map[string]string {
+	var out map[string]string
+	for l, n := range names {
+		if f := foldLower(n); f != n {
+			if out == nil {
+				out = make(map[string]string, len(names))
+				for k, v := range names {
+					out[k] = v
+				}
+			}
+			out[l] = f
+		}
+	}
+	if out == nil {
+		return names
+	}
+	return out
+}
+
+// readFold reads fold=, which defaults to true
+func readFold(q url.Values, errs *fieldErrors) bool {
+	v := q.Get("fold")
+	if v == "" {
+		return true
+	}
+	fold, err := strconv.ParseBool(v)
+	if err != nil {
+		errs.add("fold", "fold must be true or false")
+		return true
+	}
+	return fold
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestFoldText(t *testing.T) {
+	for in, want := range map[string]string{
+		"Épsilon":       "epsilon",
+		"E\u0301psilon": "epsilon",
+		"ｅｐｓｉｌｏｎ":       "epsilon",
+		"Crème Brûlée":  "creme brulee",
+		"Straße":        "strasse",
+		"Œuvre Æther":   "oeuvre aether",
+		"ＡＢＣ　１２３":       "abc 123",
+		"plain ascii":   "plain ascii",
+		"Κόσμος":        "κοσμος",
+		"Łódź":          "lodz",
+		"Tiếng Việt":    "tieng viet",
+		"Йогурт":        "иогурт",
+		"ﬁlter ½":       "filter 1⁄2",
+		"":              "",
+	} {
+		if got := foldText(in); got != want {
+			t.Errorf("foldText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFoldLowerShares(t *testing.T) {
+	names := map[string]string{"de": "produkt", "fr": "produit"}
+	if foldLower("plain") != "plain" || len(foldNames(names)) != 2 {
+		t.Fatal("folding changed unaccented text")
+	}
+	folded := foldNames(map[string]string{"de": "käse", "fr": "fromage"})
+	if folded["de"] != "kase" || folded["fr"] != "fromage" {
+		t.Errorf("folded names %v", folded)
+	}
+}
+
+func TestSearchFolds(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	if rec := serve(h, http.MethodPost, "/products", `{"name":"Crème Brûlée Torch","category":"Home","brand":"Delta","description":"d"}`,
+		http.Header{"Content-Type": {"application/json"}}); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	for _, tc := range []struct {
+		q, extra string
+		want     int
+	}{
+		{"creme brulee", "", 1},
+		{"CRÈME", "", 1},
+		{"créme", "", 1},
+		{"ｔｏｒｃｈ", "", 1},
+		{"creme", "&fold=false", 0},
+		{"crème", "&fold=false", 1},
+		{"épsilon", "", testProducts / len(brands)},
+	} {
+		target := "/products/search?mode=exhaustive&q=" + url.QueryEscape(tc.q) + tc.extra
+		if res := search(t, h, target); res.TotalFound != tc.want {
+			t.Errorf("%s found %d, want %d", target, res.TotalFound, tc.want)
+		}
+	}
+	if rec := serve(h, http.MethodGet, "/products/search?q=x&fold=maybe", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("fold=maybe: %d", rec.Code)
+	}
+}
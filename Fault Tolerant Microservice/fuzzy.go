@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxSuggestDistance is the largest edit distance at which a catalog
+// token is offered as a correction
+const maxSuggestDistance = 2
+
+// maxSuggestions is how many "did you mean" queries a search returns
+const maxSuggestions = 3
+
+// tokenize splits lowercased text into runs of letters and digits
+func tokenize(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// vocabularyToken reports whether a token is worth suggesting. Tokens
+// holding digits are mostly IDs and SKUs, which would swamp the
+// vocabulary without ever being a useful correction.
+func vocabularyToken(t string) bool {
+	if len(t) < 2 {
+		return false
+	}
+	for _, r := range t {
+		if unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// editDistance is the edit distance between a and b, counting an
+// adjacent transposition as one edit, or limit+1 once it is certain to
+// exceed limit
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+	// Rows i-2, i-1 and i of the distance table
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// vocabulary counts the catalog's searchable tokens. Callers hold
+// listLock.
+type vocabulary map[string]int
+
+// add counts sp's tokens, returning how many
+func (v vocabulary) add(sp *storedProduct) int {
+	tokens := productTokens(sp)
+	for _, t := range tokens {
+		v[t]++
+	}
+	return len(tokens)
+}
+
+// remove uncounts sp's tokens, returning how many
+func (v vocabulary) remove(sp *storedProduct) int {
+	tokens := productTokens(sp)
+	for _, t := range tokens {
+		if v[t]--; v[t] <= 0 {
+			delete(v, t)
+		}
+	}
+	return len(tokens)
+}
+
+// productTokens are the distinct vocabulary tokens of sp's names, in
+// every locale, and category
+func productTokens(sp *storedProduct) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, f := range sp.searchFields() {
+		for _, t := range tokenize(f) {
+			if _, ok := seen[t]; ok || !vocabularyToken(t) {
+				continue
+			}
+			seen[t] = struct{}{}
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// correction is a catalog token close to a query token
+type correction struct {
+	token    string
+	distance int
+	count    int
+}
+
+// corrections returns the catalog tokens within maxSuggestDistance of t,
+// closest and then most common first
+func (s *productStore) corrections(t string) []correction {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	var out []correction
+	for v, count := range s.vocab {
+		if d := editDistance(t, v, maxSuggestDistance); d >= 1 && d <= maxSuggestDistance {
+			out = append(out, correction{token: v, distance: d, count: count})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].distance != out[j].distance {
+			return out[i].distance < out[j].distance
+		}
+		if out[i].count != out[j].count {
+			return out[i].count > out[j].count
+		}
+		return out[i].token < out[j].token
+	})
+	return out
+}
+
+// suggest proposes up to maxSuggestions rewrites of q, a lowercased query
+// that found nothing. Each rewrite replaces the query's unknown tokens
+// with nearby catalog tokens; the n-th suggestion uses the n-th closest
+// correction where there are that many.
+func (s *productStore) suggest(q string) []string {
+	tokens := tokenize(q)
+	fixes := make([][]correction, len(tokens))
+	most := 0
+	for i, t := range tokens {
+		if !vocabularyToken(t) || s.hasToken(t) {
+			continue
+		}
+		fixes[i] = s.corrections(t)
+		most = max(most, len(fixes[i]))
+	}
+	var out []string
+	seen := make(map[string]struct{})
+	for n := 0; n < most && len(out) < maxSuggestions; n++ {
+		words := make([]string, len(tokens))
+		for i, t := range tokens {
+			switch {
+			case len(fixes[i]) > n:
+				words[i] = fixes[i][n].token
+			case len(fixes[i]) > 0:
+				words[i] = fixes[i][0].token
+			default:
+				words[i] = t
+			}
+		}
+		suggestion := strings.Join(words, " ")
+		if _, ok := seen[suggestion]; !ok {
+			seen[suggestion] = struct{}{}
+			out = append(out, suggestion)
+		}
+	}
+	return out
+}
+
+func (s *productStore) hasToken(t string) bool {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	return s.vocab[t] > 0
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
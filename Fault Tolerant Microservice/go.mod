@@ -1,3 +1,5 @@
 module productsearch
 
-go 1.19
+go 1.24
+
+require golang.org/x/text v0.28.0
@@ -0,0 +1,13 @@
+package main
+
+import "net/http"
+
+// enableH2C lets srv take cleartext HTTP/2 alongside HTTP/1, from
+// clients with prior knowledge such as a load balancer configured for
+// it; the HTTP/1 Upgrade: h2c dance isn't supported
+func enableH2C(srv *http.Server) {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	srv.Protocols = p
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stream cap test sizes: the per client cap, and the streams opened at
+// once over one connection, three times the cap
+const (
+	h2cTestCap     = 2
+	h2cTestStreams = 3 * h2cTestCap
+	h2cTestWait    = 5 * time.Second
+)
+
+// TestH2CStreamCap opens more concurrent streams than the per client cap
+// allows over one cleartext HTTP/2 connection, held open by the handler,
+// and checks the cap counts the streams: exactly the cap get through and
+// the rest are rejected, all on the one connection. The connection is in
+// memory, so nothing touches the network.
+func TestH2CStreamCap(t *testing.T) {
+	c := newClientConcurrency(h2cTestCap)
+	entered := make(chan struct{}, h2cTestStreams)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	free := func() { releaseOnce.Do(func() { close(release) }) }
+	defer free()
+	var notH2 int32
+	handler := c.limit(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			atomic.AddInt32(&notH2, 1)
+		}
+		entered <- struct{}{}
+		<-release
+	})
+	var conns int32
+	ln := newPipeListener()
+	srv := &http.Server{Handler: handler, ConnState: func(_ net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}}
+	enableH2C(srv)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	// One connection at a time, or the first streams each dial their own
+	// before any is up to share
+	client := &http.Client{Transport: &http.Transport{Protocols: p, DialContext: ln.dial, MaxConnsPerHost: 1}, Timeout: h2cTestWait}
+	defer client.CloseIdleConnections()
+	statuses := make(chan int, h2cTestStreams)
+	for i := 0; i < h2cTestStreams; i++ {
+		go func() {
+			resp, err := client.Get("http://h2c.test/")
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	deadline := time.NewTimer(h2cTestWait)
+	defer deadline.Stop()
+	ok, rejected := 0, 0
+	for held := 0; held < h2cTestCap || rejected < h2cTestStreams-h2cTestCap; {
+		select {
+		case <-entered:
+			held++
+		case code := <-statuses:
+			if code == 0 || code == http.StatusOK {
+				t.Fatalf("stream over the cap not rejected (status %d)", code)
+			}
+			rejected++
+		case <-deadline.C:
+			t.Fatalf("%d streams held and %d rejected, want %d and %d", held, rejected, h2cTestCap, h2cTestStreams-h2cTestCap)
+		}
+	}
+	free()
+	for ok < h2cTestCap {
+		select {
+		case code := <-statuses:
+			if code != http.StatusOK {
+				t.Fatalf("stream within the cap answered %d", code)
+			}
+			ok++
+		case <-deadline.C:
+			t.Fatalf("streams within the cap didn't finish")
+		}
+	}
+	if n := atomic.LoadInt32(&notH2); n > 0 {
+		t.Errorf("%d requests weren't HTTP/2", n)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("streams used %d connections, want 1", n)
+	}
+	if n := atomic.LoadInt64(&c.rejected); n != h2cTestStreams-h2cTestCap {
+		t.Errorf("cap counted %d rejections, want %d", n, h2cTestStreams-h2cTestCap)
+	}
+}
+
+// pipeListener accepts in-memory connections made with dial
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func (l *pipeListener) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWindow keeps the latest scan durations to pick the hedge delay
+// from. The percentile is recomputed every latencyRecompute observations
+// rather than on every search.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	n       int
+	next    int
+	cached  time.Duration
+}
+
+const (
+	latencySamples   = 256
+	latencyRecompute = 32
+	// hedgeMinSamples is how many scans must be seen before hedging starts
+	hedgeMinSamples = 20
+)
+
+func (lw *latencyWindow) observe(d time.Duration, p float64) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.samples[lw.next] = d
+	lw.next = (lw.next + 1) % latencySamples
+	if lw.n < latencySamples {
+		lw.n++
+	}
+	if lw.n >= hedgeMinSamples && (lw.n < latencySamples || lw.next%latencyRecompute == 0) {
+		sorted := append([]time.Duration(nil), lw.samples[:lw.n]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		lw.cached = sorted[int(p*float64(lw.n-1))]
+	}
+}
+
+// delay is the current percentile, or 0 until enough scans were seen
+func (lw *latencyWindow) delay() time.Duration {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.cached
+}
+
+// hedger runs a second, differently sampled scan when the first is slower
+// than the configured percentile of recent scans. Hedges draw from their
+// own small budget rather than the bulkhead, so they can't crowd out
+// first attempts.
+type hedger struct {
+	percentile float64
+	budget     chan struct{}
+	latency    latencyWindow
+
+	started   int64
+	won       int64
+	exhausted int64
+}
+
+func newHedger(percentile float64, budget int) *hedger {
+	return &hedger{percentile: percentile, budget: make(chan struct{}, budget)}
+}
+
+// hedgeInfo is reported in debug output for a sampled search while
+// hedging is on
+type hedgeInfo struct {
+	DelayMS float64 `json:"delay_ms"`
+	Started bool    `json:"started"`
+	// Winner is "primary" or "hedge"
+	Winner string `json:"winner"`
+}
+
+// hedgedScan scans ids, racing a scan of a fresh sample drawn by the same
+// strategy against it if it runs past the hedge delay. The loser is
+// cancelled and releases its own slices.
+func (s *Server) hedgedScan(ctx context.Context, ids []ProductID, n int, strategy string, text searchText, page searchPage, traceMax int, rnd *rand.Rand) (*scanResult, []ProductID, *hedgeInfo) {
+	h := s.hedger
+	delay := h.latency.delay()
+	info := &hedgeInfo{DelayMS: durationMS(delay), Winner: "primary"}
+	start := s.clock.Now()
+	defer func() { h.latency.observe(s.clock.Since(start), h.percentile) }()
+	if delay <= 0 {
+		return s.scan(ctx, ids, text, "", "", page, traceMax), ids, info
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	primary := make(chan *scanResult, 1)
+	go func(ids []ProductID) { primary <- s.scan(ctx, ids, text, "", "", page, traceMax) }(ids)
+
+	t := s.clock.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case sr := <-primary:
+		return sr, ids, info
+	case <-t.C():
+	}
+
+	select {
+	case h.budget <- struct{}{}:
+	default:
+		atomic.AddInt64(&h.exhausted, 1)
+		return <-primary, ids, info
+	}
+	info.Started = true
+	atomic.AddInt64(&h.started, 1)
+	hedgeIDs := s.store.sample(n, rnd, strategy)
+	hedge := make(chan *scanResult, 1)
+	go func(ids []ProductID) {
+		defer func() { <-h.budget }()
+		hedge <- s.scan(ctx, ids, text, "", "", page, traceMax)
+	}(hedgeIDs)
+
+	var sr *scanResult
+	loser := hedge
+	select {
+	case sr = <-primary:
+	case sr = <-hedge:
+		info.Winner = "hedge"
+		atomic.AddInt64(&h.won, 1)
+		loser, ids = primary, hedgeIDs
+	}
+	cancel()
+	go func() { (<-loser).release() }()
+	return sr, ids, info
+}
+
+func (h *hedger) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":    true,
+		"percentile": h.percentile,
+		"delay_ms":   durationMS(h.latency.delay()),
+		"budget":     cap(h.budget),
+		"in_flight":  len(h.budget),
+		"started":    atomic.LoadInt64(&h.started),
+		"won":        atomic.LoadInt64(&h.won),
+		"exhausted":  atomic.LoadInt64(&h.exhausted),
+	}
+}
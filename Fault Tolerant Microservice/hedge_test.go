@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	var lw latencyWindow
+	for i := 1; i < hedgeMinSamples; i++ {
+		lw.observe(time.Duration(i)*time.Millisecond, 0.9)
+	}
+	if d := lw.delay(); d != 0 {
+		t.Fatalf("hedging after %d samples: %s", hedgeMinSamples-1, d)
+	}
+	lw.observe(hedgeMinSamples*time.Millisecond, 0.9)
+	// The 0.9 percentile of 1ms to 20ms, by nearest rank below
+	if d := lw.delay(); d != 18*time.Millisecond {
+		t.Errorf("delay %s, want 18ms", d)
+	}
+}
+
+// TestHedgedScanAgrees races hedges for real: with a delay of a
+// nanosecond most scans start one, and whichever wins, its results must
+// be matches among the IDs it reports scanning. Run it with -race.
+func TestHedgedScanAgrees(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = nil
+		cfg.HedgePercentile, cfg.HedgeBudget = 0.5, 2
+	})
+	for i := 0; i < hedgeMinSamples; i++ {
+		s.hedger.latency.observe(time.Nanosecond, s.hedger.percentile)
+	}
+	text := searchText{q: "alpha"}
+	page := searchPage{limit: 20}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 20; i++ {
+				ids := s.store.sample(30, rnd, "")
+				sr, scanned, info := s.hedgedScan(context.Background(), ids, 30, "", text, page, 0, rnd)
+				inScan := make(map[ProductID]bool)
+				for _, id := range scanned {
+					inScan[id] = true
+				}
+				for _, p := range sr.results {
+					if !inScan[p.ID] || p.Brand != "Alpha" {
+						t.Errorf("%s returned product %d (%s) outside its scan", info.Winner, p.ID, p.Brand)
+					}
+				}
+				if sr.matches != len(sr.results) {
+					t.Errorf("%d matches, %d results", sr.matches, len(sr.results))
+				}
+				sr.release()
+			}
+		}(g)
+	}
+	wg.Wait()
+	// Losers give their budget slot back once they finish
+	for i := 0; len(s.hedger.budget) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d hedges still hold the budget", len(s.hedger.budget))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSearchReportsHedge(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) { cfg.HedgePercentile = 0.95 }).Routes()
+	rec := serve(h, http.MethodGet, "/v1/products/search?debug=1&q=alpha", "", nil)
+	var res struct {
+		Meta struct {
+			Search struct {
+				Hedge *hedgeInfo `json:"hedge"`
+			} `json:"search"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	// Too few scans seen to hedge yet
+	if hi := res.Meta.Search.Hedge; hi == nil || hi.Started || hi.Winner != "primary" || hi.DelayMS != 0 {
+		t.Errorf("hedge %+v in %s", hi, rec.Body)
+	}
+}
+
+const (
+	// hedgeBenchSlowEvery is how often BenchmarkHedgedScanTail's primary
+	// scan is slowed, standing in for chaos latency on a share of requests
+	hedgeBenchSlowEvery = 20
+	// hedgeBenchSlowdown is how many times over a slowed scan checks its
+	// sample
+	hedgeBenchSlowdown = 50
+)
+
+// BenchmarkHedgedScanTail reports the p99 of sampled scans of 1000 when
+// one in hedgeBenchSlowEvery is slowed, with and without hedging. The
+// injector's own delay lands after the scan, where no hedge can help, so
+// a slowed scan instead checks its sample hedgeBenchSlowdown times over;
+// the hedge draws a fresh one. The hedge races it on a spare CPU, so with
+// GOMAXPROCS 1 the two share one and the gain mostly goes.
+func BenchmarkHedgedScanTail(b *testing.B) {
+	for _, hedged := range []bool{false, true} {
+		name := "unhedged"
+		if hedged {
+			name = "hedged"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := newTestServer(b, func(cfg *Config) {
+				cfg.Clock = nil
+				cfg.NumProducts, cfg.ChecksPerSearch = 10000, 1000
+				if hedged {
+					cfg.HedgePercentile, cfg.HedgeBudget = 0.9, 4
+				}
+			})
+			n := s.cfg.ChecksPerSearch
+			text := newSearchText(parseQuery("alpha"), defaultLocale, false)
+			page := searchPage{limit: 20}
+			rnd := rand.New(rand.NewSource(1))
+			took := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ids := s.store.sample(n, rnd, "")
+				if i%hedgeBenchSlowEvery == 0 {
+					slow := make([]ProductID, 0, n*hedgeBenchSlowdown)
+					for j := 0; j < hedgeBenchSlowdown; j++ {
+						slow = append(slow, ids...)
+					}
+					ids = slow
+				}
+				start := time.Now()
+				var sr *scanResult
+				if hedged {
+					sr, _, _ = s.hedgedScan(context.Background(), ids, n, "", text, page, 0, rnd)
+				} else {
+					sr = s.scan(context.Background(), ids, text, "", "", page, 0)
+				}
+				took = append(took, time.Since(start))
+				sr.release()
+			}
+			b.StopTimer()
+			sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+			b.ReportMetric(float64(took[len(took)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
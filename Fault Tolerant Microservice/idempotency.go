@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted
+const maxIdempotencyKey = 255
+
+// idemEntryOverhead approximates the bookkeeping cost of one stored
+// response on top of its key and body
+const idemEntryOverhead = 256
+
+// idemEntry is one Idempotency-Key. done is closed once the first request
+// with the key finishes; until then the entry isn't in the LRU.
+type idemEntry struct {
+	key     string
+	hash    [sha256.Size]byte
+	done    chan struct{}
+	stored  bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	elem    *list.Element
+}
+
+func (e *idemEntry) size() int64 {
+	return int64(len(e.key) + len(e.body) + idemEntryOverhead)
+}
+
+// idempotencyStore remembers the responses to mutations sent with an
+// Idempotency-Key so retries get the original response instead of
+// repeating the change. It holds at most maxBytes of responses, evicting
+// the least recently used, and forgets them after ttl.
+type idempotencyStore struct {
+	ttl      time.Duration
+	maxBytes int64
+	clock    Clock
+
+	mu        sync.Mutex
+	entries   map[string]*idemEntry
+	lru       *list.List
+	bytes     int64
+	replays   int64
+	conflicts int64
+	evictions int64
+}
+
+func newIdempotencyStore(ttl time.Duration, maxBytes int64, clock Clock) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		clock:    clock,
+		entries:  make(map[string]*idemEntry),
+		lru:      list.New(),
+	}
+}
+
+// begin claims key for a request with the given payload hash. It returns
+// a stored entry to replay, or nil with owned true when the caller should
+// run the request and then call finish. conflict is set when the key was
+// used for a different payload.
+func (st *idempotencyStore) begin(key string, hash [sha256.Size]byte) (e *idemEntry, owned, conflict bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.entries[key]
+	if ok && e.stored && !st.clock.Now().Before(e.expires) {
+		st.removeLocked(e)
+		ok = false
+	}
+	if !ok {
+		e = &idemEntry{key: key, hash: hash, done: make(chan struct{})}
+		st.entries[key] = e
+		return e, true, false
+	}
+	if e.hash != hash {
+		st.conflicts++
+		return nil, false, true
+	}
+	if e.stored {
+		st.lru.MoveToFront(e.elem)
+	}
+	return e, false, false
+}
+
+func (st *idempotencyStore) noteReplay() {
+	st.mu.Lock()
+	st.replays++
+	st.mu.Unlock()
+}
+
+// finish records the outcome of an owned entry and wakes any duplicates
+// waiting on it. Server errors and rate limiting aren't stored, so a
+// retry runs the request again.
+func (st *idempotencyStore) finish(e *idemEntry, status int, header http.Header, body []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	defer close(e.done)
+	if status >= 500 || status == http.StatusTooManyRequests {
+		delete(st.entries, e.key)
+		return
+	}
+	e.status, e.header, e.body = status, header, body
+	e.expires = st.clock.Now().Add(st.ttl)
+	e.stored = true
+	e.elem = st.lru.PushFront(e)
+	st.bytes += e.size()
+	now := st.clock.Now()
+	for st.lru.Len() > 0 {
+		oldest := st.lru.Back().Value.(*idemEntry)
+		if st.bytes > st.maxBytes {
+			st.evictions++
+		} else if now.Before(oldest.expires) {
+			break
+		}
+		st.removeLocked(oldest)
+	}
+}
+
+// resize changes the byte budget, evicting the least recently used
+// responses until the store fits it
+func (st *idempotencyStore) resize(maxBytes int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.maxBytes = maxBytes
+	for st.lru.Len() > 0 && st.bytes > st.maxBytes {
+		st.evictions++
+		st.removeLocked(st.lru.Back().Value.(*idemEntry))
+	}
+}
+
+func (st *idempotencyStore) removeLocked(e *idemEntry) {
+	if st.entries[e.key] == e {
+		delete(st.entries, e.key)
+	}
+	if e.elem != nil {
+		st.lru.Remove(e.elem)
+		e.elem = nil
+		st.bytes -= e.size()
+	}
+}
+
+func (st *idempotencyStore) stats() map[string]interface{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return map[string]interface{}{
+		"entries":   st.lru.Len(),
+		"bytes":     st.bytes,
+		"max_bytes": st.maxBytes,
+		"replays":   st.replays,
+		"conflicts": st.conflicts,
+		"evictions": st.evictions,
+	}
+}
+
+// idemRecorder passes a response through while keeping a copy of it
+type idemRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *idemRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idemRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyScope is whose Idempotency-Keys a request's is among: its
+// API key's, or without one its address's, so callers can't replay each
+// other's responses
+func idempotencyScope(r *http.Request, proxies ipAllowlist) string {
+	if info := requestInfoFrom(r); info != nil && info.KeyName != "" {
+		return "key:" + info.KeyName
+	}
+	if ip := clientIP(r, proxies); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "addr:" + r.RemoteAddr
+}
+
+// idempotent makes a mutation honour Idempotency-Key. Keys are scoped by
+// idempotencyScope, and the payload hash covers method, path and body,
+// so reusing a key for anything else is a 409. A duplicate that
+// arrives while the first request is still running waits for it rather
+// than running too.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	st := s.idem
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeErr(w, r, invalid("Idempotency-Key", "Idempotency-Key must be at most 255 characters"))
+			return
+		}
+		key = idempotencyScope(r, s.cfg.TrustedProxies) + "\x00" + key
+
+		// Hash the body without consuming it. The largest write limit
+		// applies here; the handler still applies its own.
+		limit := s.cfg.MaxImportBytes
+		if s.cfg.MaxProductBytes > limit {
+			limit = s.cfg.MaxProductBytes
+		}
+		b, ok := s.readBody(w, r, limit)
+		if !ok {
+			return
+		}
+		h := sha256.New()
+		io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+		h.Write(b)
+		var hash [sha256.Size]byte
+		copy(hash[:], h.Sum(nil))
+
+		for {
+			e, owned, conflict := st.begin(key, hash)
+			if conflict {
+				writeErr(w, r, newError(ErrConflict, "Idempotency-Key was already used with a different request"))
+				return
+			}
+			if owned {
+				r.Body = io.NopCloser(bytes.NewReader(b))
+				rec := &idemRecorder{ResponseWriter: w}
+				next(rec, r)
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				st.finish(e, rec.status, rec.header, rec.body.Bytes())
+				return
+			}
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+			if !e.stored {
+				// The first attempt wasn't kept; try to run it ourselves
+				continue
+			}
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			st.noteReplay()
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postProduct sends POST /products from remote with an Idempotency-Key
+func postProduct(h http.Handler, remote, idemKey, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body))
+	r.RemoteAddr = remote
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Idempotency-Key", idemKey)
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func createdID(t *testing.T, rec *httptest.ResponseRecorder) ProductID {
+	t.Helper()
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /products: %d %s", rec.Code, rec.Body)
+	}
+	var p Product
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p.ID
+}
+
+const lampBody = `{"name":"Desk Lamp","category":"Home","brand":"Delta","description":"A lamp"}`
+
+func TestIdempotencyReplays(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	first := createdID(t, postProduct(h, "192.0.2.1:1000", "k1", lampBody, nil))
+	again := postProduct(h, "192.0.2.1:2000", "k1", lampBody, nil)
+	if createdID(t, again) != first || again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry wasn't a replay: %s", again.Body)
+	}
+	if s.store.size() != testProducts+1 {
+		t.Errorf("%d products, want one created", s.store.size())
+	}
+	if rec := postProduct(h, "192.0.2.1:1000", "k1", strings.Replace(lampBody, "Lamp", "Stool", 1), nil); rec.Code != http.StatusConflict {
+		t.Errorf("key reused for another body: %d", rec.Code)
+	}
+	if rec := postProduct(h, "192.0.2.1:1000", strings.Repeat("k", 256), lampBody, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("overlong key: %d", rec.Code)
+	}
+}
+
+// TestIdempotencyScopedByCaller checks one caller's key is never replayed
+// to another: without auth callers are told apart by address
+func TestIdempotencyScopedByCaller(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	mine := createdID(t, postProduct(h, "192.0.2.1:1000", "shared", lampBody, nil))
+	theirs := postProduct(h, "198.51.100.7:1000", "shared", lampBody, nil)
+	if createdID(t, theirs) == mine || theirs.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another address got the first caller's response: %s", theirs.Body)
+	}
+	if rec := postProduct(h, "198.51.100.7:1000", "shared", strings.Replace(lampBody, "Lamp", "Stool", 1), nil); rec.Code != http.StatusConflict {
+		t.Errorf("each address's keys should conflict among themselves: %d", rec.Code)
+	}
+
+	// With auth the API key is the scope, wherever it calls from
+	s.cfg.APIKeys = []*apiKey{{Name: "ops", Role: roleWrite, Key: "ops-secret"}}
+	auth := http.Header{"X-Api-Key": {"ops-secret"}}
+	first := createdID(t, postProduct(h, "192.0.2.1:1000", "keyed", lampBody, auth))
+	if again := postProduct(h, "203.0.113.9:1000", "keyed", lampBody, auth); createdID(t, again) != first {
+		t.Errorf("the same API key from another address wasn't replayed: %s", again.Body)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// postingIndex maps a lowercased field value to the IDs holding it. Each
+// list is kept sorted so filtered results come back in ID order and
+// intersections can binary search.
+type postingIndex map[string][]ProductID
+
+func (ix postingIndex) add(value string, id ProductID) {
+	key := strings.ToLower(value)
+	if key == "" {
+		return
+	}
+	ix[key], _ = insertID(ix[key], id)
+}
+
+func (ix postingIndex) remove(value string, id ProductID) {
+	key := strings.ToLower(value)
+	ids, _ := removeID(ix[key], id)
+	if len(ids) == 0 {
+		delete(ix, key)
+		return
+	}
+	ix[key] = ids
+}
+
+// searchID is sort.SearchInts for IDs: where id is, or would be, in a
+// sorted list
+func searchID(ids []ProductID, id ProductID) int {
+	return sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+}
+
+// sortIDs sorts a list of IDs in place
+func sortIDs(ids []ProductID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// insertID adds id to a sorted list, reporting whether it was new
+func insertID(ids []ProductID, id ProductID) ([]ProductID, bool) {
+	// Generated and created IDs arrive in order, so this is the usual case
+	if len(ids) == 0 || ids[len(ids)-1] < id {
+		return append(ids, id), true
+	}
+	i := searchID(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids, false
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids, true
+}
+
+// removeID deletes id from a sorted list, reporting whether it was there
+func removeID(ids []ProductID, id ProductID) ([]ProductID, bool) {
+	i := searchID(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids, false
+	}
+	return append(ids[:i], ids[i+1:]...), true
+}
+
+// intersect returns the IDs present in both sorted lists, walking the
+// smaller one and binary searching the other
+func intersect(a, b []ProductID) []ProductID {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	out := make([]ProductID, 0, len(a))
+	for _, id := range a {
+		if i := searchID(b, id); i < len(b) && b[i] == id {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// indexLocked adds sp to the secondary indexes and the catalog totals.
+// Callers hold listLock.
+func (s *productStore) indexLocked(sp *storedProduct) {
+	s.brandIndex.add(sp.Brand, sp.ID)
+	s.categoryIndex.add(sp.Category, sp.ID)
+	if sp.Brand == "" {
+		s.noBrand, _ = insertID(s.noBrand, sp.ID)
+	}
+	if sp.Category == "" {
+		s.noCategory, _ = insertID(s.noCategory, sp.ID)
+	}
+	s.totals.add(sp, 1)
+	if !s.indexesPending {
+		s.totals.tokens += int64(s.vocab.add(sp))
+		for _, ix := range matcherIndexers {
+			ix.indexLocked(s, sp)
+		}
+	}
+}
+
+// unindexLocked removes sp from the secondary indexes and the catalog
+// totals. Callers hold listLock.
+func (s *productStore) unindexLocked(sp *storedProduct) {
+	s.brandIndex.remove(sp.Brand, sp.ID)
+	s.categoryIndex.remove(sp.Category, sp.ID)
+	if sp.Brand == "" {
+		s.noBrand, _ = removeID(s.noBrand, sp.ID)
+	}
+	if sp.Category == "" {
+		s.noCategory, _ = removeID(s.noCategory, sp.ID)
+	}
+	s.totals.add(sp, -1)
+	if !s.indexesPending {
+		s.totals.tokens -= int64(s.vocab.remove(sp))
+		for _, ix := range matcherIndexers {
+			ix.unindexLocked(s, sp)
+		}
+	}
+}
+
+// filterIDs returns, in ID order, every product whose brand and category
+// equal the given values ignoring case. Empty values don't filter; at
+// least one must be set.
+func (s *productStore) filterIDs(brand, category string) []ProductID {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	byBrand := s.brandIndex[strings.ToLower(brand)]
+	byCategory := s.categoryIndex[strings.ToLower(category)]
+	switch {
+	case brand != "" && category != "":
+		return intersect(byBrand, byCategory)
+	case brand != "":
+		return append([]ProductID(nil), byBrand...)
+	}
+	return append([]ProductID(nil), byCategory...)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// indexFileMagic opens every index file. indexFileVersion is bumped
+// whenever the layout, or what goes into the vocabulary or trigram index,
+// changes; files of any other version are rebuilt.
+const (
+	indexFileMagic   = "PSIX"
+	indexFileVersion = 1
+)
+
+// errIndexCorrupt is any index file that doesn't decode; it is discarded
+// and rebuilt
+var errIndexCorrupt = errors.New("corrupt")
+
+// Index file states, as /stats reports them
+const (
+	indexLoading    = "loading"
+	indexLoaded     = "loaded"
+	indexRebuilding = "rebuilding"
+	indexRebuilt    = "rebuilt"
+)
+
+// indexFile persists the vocabulary and trigram index, the slow part of
+// building the catalog's indexes, in a sidecar keyed by a hash of the
+// catalog they were built from. The layout, all integers varints unless
+// noted:
+//
+//	magic "PSIX", version uint32 LE, catalog hash [32]byte
+//	trigram budget uint64 LE, 0 for off; over budget byte
+//	tokens, then per vocabulary token: length, bytes, count
+//	trigrams, then per trigram: trigram, IDs, then the IDs delta encoded
+//	CRC-32 (IEEE) of everything before it, uint32 LE
+type indexFile struct {
+	path string
+
+	mu      sync.Mutex
+	state   string
+	reason  string
+	hash    string
+	load    time.Duration
+	rebuild time.Duration
+}
+
+// builtIndexes are the vocabulary and trigram index, built or loaded
+// apart from the store and installed in one swap
+type builtIndexes struct {
+	vocab  vocabulary
+	tokens int64
+	// trigrams is nil when the index is off or overBudget
+	trigrams   *trigramIndex
+	overBudget bool
+}
+
+// deferIndexes makes generate and later writes leave the vocabulary and
+// trigram index alone until installIndexes, so they can be loaded or
+// rebuilt after the catalog is. Call it before generate.
+func (s *productStore) deferIndexes() {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	s.indexesPending = true
+	s.trigrams = nil
+}
+
+// catalogHash is the SHA-256 of every product's fields in ID order
+func (s *productStore) catalogHash() [32]byte {
+	ids := s.allIDs()
+	sortIDs(ids)
+	h := sha256.New()
+	var buf []byte
+	for _, id := range ids {
+		sp, ok := s.lookup(id)
+		if !ok {
+			continue
+		}
+		buf = binary.AppendUvarint(buf[:0], uint64(id))
+		for _, f := range []string{sp.Name, sp.Category, sp.Description, sp.Brand} {
+			buf = binary.AppendUvarint(buf, uint64(len(f)))
+			buf = append(buf, f...)
+		}
+		locales := make([]string, 0, len(sp.Names))
+		for l := range sp.Names {
+			locales = append(locales, l)
+		}
+		sort.Strings(locales)
+		buf = binary.AppendUvarint(buf, uint64(len(locales)))
+		for _, l := range locales {
+			for _, f := range []string{l, sp.Names[l]} {
+				buf = binary.AppendUvarint(buf, uint64(len(f)))
+				buf = append(buf, f...)
+			}
+		}
+		h.Write(buf)
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// buildIndexes builds the vocabulary and, when enabled, the trigram index
+// over the whole catalog. Callers hold mutationLock, so nothing changes
+// underneath it.
+func (s *productStore) buildIndexes() builtIndexes {
+	b := builtIndexes{vocab: make(vocabulary)}
+	if s.trigramBudget > 0 {
+		b.trigrams = newTrigramIndex(s.trigramBudget)
+	}
+	for _, id := range s.allIDs() {
+		sp, ok := s.lookup(id)
+		if !ok {
+			continue
+		}
+		b.tokens += int64(b.vocab.add(&sp))
+		if b.trigrams != nil && !b.trigrams.add(&sp) {
+			b.trigrams, b.overBudget = nil, true
+		}
+	}
+	return b
+}
+
+// installIndexes swaps in loaded or rebuilt indexes and ends deferral. A
+// trigram index the memory governor shed meanwhile stays shed.
+func (s *productStore) installIndexes(b builtIndexes) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	s.vocab = b.vocab
+	s.totals.tokens = b.tokens
+	s.trigramOverBudget = b.overBudget
+	if !s.trigramShed {
+		s.trigrams = b.trigrams
+	}
+	s.indexesPending = false
+	if b.overBudget {
+		log.Printf("Trigram index exceeded its %d byte budget; substring searches will scan\n", s.trigramBudget)
+	}
+}
+
+// loadIndexes installs the indexes from the index file when it was built
+// from this catalog, and otherwise rebuilds them in the background,
+// replacing the file. Until they are installed searches scan and offer
+// no suggestions. LoadCatalog calls it.
+func (s *Server) loadIndexes() {
+	f := s.indexFile
+	start := time.Now()
+	sum := s.store.catalogHash()
+	hashed := time.Since(start)
+	f.mu.Lock()
+	f.state, f.hash = indexLoading, hex.EncodeToString(sum[:8])
+	f.mu.Unlock()
+
+	b, err := readIndexFile(f.path, sum, s.store.trigramBudget)
+	if err == nil {
+		s.store.installIndexes(b)
+		f.mu.Lock()
+		f.state, f.load = indexLoaded, time.Since(start)
+		f.mu.Unlock()
+		log.Printf("Loaded indexes from %s in %s (catalog hashed in %s): %d tokens, %d trigrams\n",
+			f.path, time.Since(start).Round(time.Millisecond), hashed.Round(time.Millisecond), len(b.vocab), b.trigramCount())
+		return
+	}
+	reason := err.Error()
+	if os.IsNotExist(err) {
+		reason = "no index file"
+	}
+	f.mu.Lock()
+	f.state, f.reason = indexRebuilding, reason
+	f.mu.Unlock()
+	log.Printf("Rebuilding indexes in the background, searches scan until done: %s\n", reason)
+
+	go func() {
+		start := time.Now()
+		s.store.mutationLock.Lock()
+		b := s.store.buildIndexes()
+		// Hashed again under the lock, as writes may have come in since
+		sum := s.store.catalogHash()
+		s.store.installIndexes(b)
+		s.store.mutationLock.Unlock()
+		took := time.Since(start)
+		f.mu.Lock()
+		f.state, f.rebuild, f.hash = indexRebuilt, took, hex.EncodeToString(sum[:8])
+		f.mu.Unlock()
+		if err := writeIndexFile(f.path, sum, s.store.trigramBudget, b); err != nil {
+			log.Printf("Rebuilt indexes in %s but couldn't save them: %v\n", took.Round(time.Millisecond), err)
+			adminErrors.record("index_file", err.Error())
+			return
+		}
+		log.Printf("Rebuilt indexes in %s and saved them to %s: %d tokens, %d trigrams\n",
+			took.Round(time.Millisecond), f.path, len(b.vocab), b.trigramCount())
+	}()
+}
+
+func (b builtIndexes) trigramCount() int {
+	if b.trigrams == nil {
+		return 0
+	}
+	return len(b.trigrams.postings)
+}
+
+func writeIndexFile(path string, sum [32]byte, trigramBudget int64, b builtIndexes) error {
+	buf := binary.LittleEndian.AppendUint32([]byte(indexFileMagic), indexFileVersion)
+	buf = append(buf, sum[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(trigramBudget))
+	if b.overBudget {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	tokens := make([]string, 0, len(b.vocab))
+	for t := range b.vocab {
+		tokens = append(tokens, t)
+	}
+	sort.Strings(tokens)
+	buf = binary.AppendUvarint(buf, uint64(len(tokens)))
+	for _, t := range tokens {
+		buf = binary.AppendUvarint(buf, uint64(len(t)))
+		buf = append(buf, t...)
+		buf = binary.AppendUvarint(buf, uint64(b.vocab[t]))
+	}
+
+	var grams []uint32
+	if b.trigrams != nil {
+		grams = make([]uint32, 0, len(b.trigrams.postings))
+		for t := range b.trigrams.postings {
+			grams = append(grams, t)
+		}
+		sort.Slice(grams, func(i, j int) bool { return grams[i] < grams[j] })
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(grams)))
+	for _, t := range grams {
+		ids := b.trigrams.postings[t]
+		buf = binary.AppendUvarint(buf, uint64(t))
+		buf = binary.AppendUvarint(buf, uint64(len(ids)))
+		var prev ProductID
+		for _, id := range ids {
+			buf = binary.AppendUvarint(buf, uint64(id-prev))
+			prev = id
+		}
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readIndexFile decodes the index file, failing unless it is intact, of
+// this version and built from the catalog hashing to sum with the same
+// trigram budget
+func readIndexFile(path string, sum [32]byte, trigramBudget int64) (builtIndexes, error) {
+	var b builtIndexes
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return b, err
+	}
+	header := len(indexFileMagic) + 4 + len(sum) + 8 + 1
+	if len(data) < header+4 || string(data[:len(indexFileMagic)]) != indexFileMagic {
+		return b, fmt.Errorf("%s: %w: not an index file", path, errIndexCorrupt)
+	}
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(trailer) {
+		return b, fmt.Errorf("%s: %w: checksum mismatch", path, errIndexCorrupt)
+	}
+	if v := binary.LittleEndian.Uint32(data[len(indexFileMagic):]); v != indexFileVersion {
+		return b, fmt.Errorf("%s: version %d, want %d", path, v, indexFileVersion)
+	}
+	if !bytes.Equal(data[len(indexFileMagic)+4:header-9], sum[:]) {
+		return b, fmt.Errorf("%s: built from a different catalog", path)
+	}
+	if budget := int64(binary.LittleEndian.Uint64(data[header-9:])); budget != trigramBudget {
+		return b, fmt.Errorf("%s: built with a trigram budget of %d bytes, not %d", path, budget, trigramBudget)
+	}
+	b.overBudget = data[header-1] == 1
+
+	r := indexReader{b: body[header:]}
+	b.vocab = make(vocabulary)
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		t := string(r.bytes(r.count()))
+		c := int(r.uvarint())
+		b.vocab[t] = c
+		b.tokens += int64(c)
+	}
+	grams := r.count()
+	switch {
+	case trigramBudget > 0 && !b.overBudget:
+		b.trigrams = newTrigramIndex(trigramBudget)
+	case grams > 0:
+		r.err = errIndexCorrupt
+	}
+	for ; grams > 0 && r.err == nil; grams-- {
+		t := uint32(r.uvarint())
+		ids := make([]ProductID, r.count())
+		var prev ProductID
+		for i := range ids {
+			prev += ProductID(r.uvarint())
+			ids[i] = prev
+		}
+		b.trigrams.postings[t] = ids
+		b.trigrams.entries += int64(len(ids))
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errIndexCorrupt
+	}
+	if r.err != nil {
+		return builtIndexes{}, fmt.Errorf("%s: %w", path, r.err)
+	}
+	if b.trigrams != nil && b.trigrams.bytes() > trigramBudget {
+		return builtIndexes{}, fmt.Errorf("%s: %w: trigram index over its budget", path, errIndexCorrupt)
+	}
+	return b, nil
+}
+
+// indexReader decodes an index file body, remembering the first error
+// so a caller can check once at the end
+type indexReader struct {
+	b   []byte
+	err error
+}
+
+func (r *indexReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errIndexCorrupt
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// count reads a length or count, which can't exceed the bytes left since
+// every item takes at least one
+func (r *indexReader) count() int {
+	v := r.uvarint()
+	if v > uint64(len(r.b)) {
+		r.err = errIndexCorrupt
+		return 0
+	}
+	return int(v)
+}
+
+func (r *indexReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (f *indexFile) stats() map[string]interface{} {
+	if f == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := map[string]interface{}{
+		"enabled":      true,
+		"path":         f.path,
+		"state":        f.state,
+		"catalog_hash": f.hash,
+	}
+	if f.reason != "" {
+		st["rebuild_reason"] = f.reason
+	}
+	switch f.state {
+	case indexLoaded:
+		st["load_ms"] = durationMS(f.load)
+	case indexRebuilt:
+		st["rebuild_ms"] = durationMS(f.rebuild)
+	}
+	return st
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newIndexTestServer loads a test catalog with its indexes kept in path,
+// waiting for a background rebuild to finish
+func newIndexTestServer(t *testing.T, path string, configure func(*Config)) *Server {
+	t.Helper()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.IndexFile = path
+		cfg.TrigramBudget = 1 << 20
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	for deadline := time.Now().Add(10 * time.Second); s.indexFile.stats()["state"] == indexRebuilding; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the index rebuild never finished")
+		}
+	}
+	return s
+}
+
+// checkIndexes compares s's installed indexes with ones built afresh
+func checkIndexes(t *testing.T, s *Server) {
+	t.Helper()
+	s.store.mutationLock.Lock()
+	want := s.store.buildIndexes()
+	s.store.mutationLock.Unlock()
+	s.store.listLock.RLock()
+	defer s.store.listLock.RUnlock()
+	if s.store.indexesPending || !reflect.DeepEqual(s.store.vocab, want.vocab) || s.store.totals.tokens != want.tokens {
+		t.Errorf("installed vocabulary differs from the catalog's")
+	}
+	if s.store.trigrams == nil || !reflect.DeepEqual(s.store.trigrams.postings, want.trigrams.postings) {
+		t.Errorf("installed trigram index differs from the catalog's")
+	}
+}
+
+// rechecksum replaces data's CRC trailer with one matching its body
+func rechecksum(data []byte) []byte {
+	body := data[:len(data)-4]
+	return binary.LittleEndian.AppendUint32(append([]byte{}, body...), crc32.ChecksumIEEE(body))
+}
+
+// TestIndexFileCorruptRebuilds starts on index files that are damaged or
+// for another catalog: each is refused, the indexes rebuilt from the
+// catalog and the file replaced, so the next start loads it
+func TestIndexFileCorruptRebuilds(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index")
+	s := newIndexTestServer(t, path, nil)
+	if st := s.indexFile.stats(); st["state"] != indexRebuilt || st["rebuild_reason"] != "no index file" {
+		t.Fatalf("first start: %v", st)
+	}
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := newIndexTestServer(t, path, nil).indexFile.stats(); st["state"] != indexLoaded {
+		t.Fatalf("second start: %v", st)
+	}
+
+	flipped := append([]byte{}, good...)
+	flipped[len(flipped)/2] ^= 0x40
+	version := append([]byte{}, good...)
+	binary.LittleEndian.PutUint32(version[len(indexFileMagic):], indexFileVersion+1)
+	// A valid checksum over a body with a byte too many
+	trailing := rechecksum(append(append([]byte{}, good[:len(good)-4]...), 0, 0, 0, 0, 0))
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		configure func(*Config)
+	}{
+		{"empty", []byte{}, nil},
+		{"garbage", []byte("not an index file at all"), nil},
+		{"wrong magic", append([]byte("XXXX"), good[4:]...), nil},
+		{"truncated", good[:len(good)/2], nil},
+		{"header only", good[:len(indexFileMagic)+4+32+8+1+4], nil},
+		{"flipped byte", flipped, nil},
+		{"other version", rechecksum(version), nil},
+		{"trailing bytes", trailing, nil},
+		{"other catalog", good, func(cfg *Config) { cfg.NumProducts = testProducts + 1 }},
+		{"other trigram budget", good, func(cfg *Config) { cfg.TrigramBudget = 1 << 21 }},
+	} {
+		if err := os.WriteFile(path, tc.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		s := newIndexTestServer(t, path, tc.configure)
+		st := s.indexFile.stats()
+		if st["state"] != indexRebuilt || st["rebuild_reason"] == nil {
+			t.Errorf("%s: %v, want a rebuild with its reason", tc.name, st)
+			continue
+		}
+		checkIndexes(t, s)
+		if st := newIndexTestServer(t, path, tc.configure).indexFile.stats(); st["state"] != indexLoaded {
+			t.Errorf("%s: the rebuilt file wasn't loaded on the next start: %v", tc.name, st)
+		}
+	}
+}
+
+// TestIndexFileCutsRefused cuts an intact file short at every length
+// with a fresh checksum, which the decoder must refuse, never panic on
+// or take part of
+func TestIndexFileCutsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	s := newIndexTestServer(t, path, nil)
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := s.store.catalogHash()
+	header := len(indexFileMagic) + 4 + len(sum) + 8 + 1
+	for n := header + 4; n < len(good); n++ {
+		if err := os.WriteFile(path, rechecksum(append(good[:n-4:n-4], 0, 0, 0, 0)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readIndexFile(path, sum, s.cfg.TrigramBudget); err == nil {
+			t.Errorf("cut to %d of %d bytes was accepted", n, len(good))
+		}
+	}
+}
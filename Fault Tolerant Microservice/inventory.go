@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// inventoryService simulates a flaky downstream that knows how many units
+// of each product are in stock. It runs in-process but behaves like a
+// remote call: every call takes latency, plus up to jitter more, and fails
+// errorRate of the time, or every time for a failing category.
+type inventoryService struct {
+	// errorRate holds the float64 bits of the failure rate
+	errorRate uint64
+	latency   time.Duration
+	jitter    time.Duration
+	clock     Clock
+	// failing are the inventory categories whose calls all fail
+	failing map[string]bool
+}
+
+var (
+	errInventoryFailed      = newError(ErrInternal, "inventory: simulated failure")
+	errInventoryTimeout     = newError(ErrTimeout, "inventory: call timed out")
+	errInventoryUnavailable = newError(ErrCircuitOpen, "inventory: circuit open")
+)
+
+func newInventoryService(errorRate float64, latency, jitter time.Duration, clock Clock, failing []string) *inventoryService {
+	inv := &inventoryService{errorRate: math.Float64bits(errorRate), latency: latency, jitter: jitter, clock: clock, failing: make(map[string]bool)}
+	for _, c := range failing {
+		inv.failing[inventoryCategory(c)] = true
+	}
+	return inv
+}
+
+func (inv *inventoryService) ErrorRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&inv.errorRate))
+}
+
+// stock returns the units in stock for each ID, all of them products of
+// category. Quantities are derived from the ID so repeated calls agree.
+func (inv *inventoryService) stock(ctx context.Context, category string, ids []ProductID, rnd *rand.Rand) (map[ProductID]int, error) {
+	d := inv.latency
+	if inv.jitter > 0 {
+		d += time.Duration(rnd.Int63n(int64(inv.jitter)))
+	}
+	if d > 0 {
+		t := inv.clock.NewTimer(d)
+		select {
+		case <-t.C():
+		case <-ctx.Done():
+			t.Stop()
+			return nil, errInventoryTimeout
+		}
+	}
+	if inv.failing[category] {
+		return nil, errInventoryFailed
+	}
+	if rate := inv.ErrorRate(); rate > 0 && rnd.Float64() < rate {
+		return nil, errInventoryFailed
+	}
+	out := make(map[ProductID]int, len(ids))
+	for _, id := range ids {
+		out[id] = int(uint32(id)*2654435761>>16) % 50
+	}
+	return out, nil
+}
+
+// otherCategory is the inventory category of products outside the
+// catalog's fixed categories, so created products can't add breakers
+const otherCategory = "other"
+
+// inventoryCategories are the categories inventory calls are made, and
+// breakers kept, for: the catalog's, then otherCategory
+var inventoryCategories = append(append([]string(nil), categories...), otherCategory)
+
+// inventoryCategory is the inventory category a product category is
+// looked up under
+func inventoryCategory(category string) string {
+	for _, c := range categories {
+		if strings.EqualFold(c, category) {
+			return c
+		}
+	}
+	return otherCategory
+}
+
+// checkInventoryCategories refuses names that aren't inventoryCategories
+func checkInventoryCategories(names []string) error {
+	for _, c := range names {
+		if inventoryCategory(c) == otherCategory && !strings.EqualFold(c, otherCategory) {
+			return fmt.Errorf("inventory: unknown category %q; categories are %s", c, strings.Join(inventoryCategories, ", "))
+		}
+	}
+	return nil
+}
+
+// inventoryClient is the search handler's side of the inventory call: a
+// breaker per inventory category, so a category failing doesn't cut the
+// others off, a per-call timeout and a few retries with jittered
+// exponential backoff
+type inventoryClient struct {
+	service *inventoryService
+	// breakers has one entry per inventoryCategories, fixed once built
+	breakers map[string]*resilience.Breaker
+	timeout  time.Duration
+	retries  int
+	backoff  time.Duration
+	clock    Clock
+
+	calls    int64
+	retried  int64
+	failures int64
+	timeouts int64
+	rejected int64
+	degraded int64
+}
+
+func newInventoryClient(service *inventoryService, bcfg resilience.BreakerConfig, clock Clock, onTransition func(category string, from, to int32)) (*inventoryClient, error) {
+	c := &inventoryClient{service: service, breakers: make(map[string]*resilience.Breaker, len(inventoryCategories)), clock: clock}
+	for _, category := range inventoryCategories {
+		category := category
+		b, err := resilience.NewBreaker(bcfg, clock, func(from, to int32) { onTransition(category, from, to) })
+		if err != nil {
+			return nil, err
+		}
+		c.breakers[category] = b
+	}
+	return c, nil
+}
+
+// stock looks up ids, products of the inventory category given, returning
+// errInventoryUnavailable without calling the service while the
+// category's breaker is open
+func (c *inventoryClient) stock(ctx context.Context, category string, ids []ProductID, rnd *rand.Rand) (map[ProductID]int, error) {
+	breaker := c.breakers[category]
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			atomic.AddInt64(&c.retried, 1)
+			// Full jitter: anywhere up to backoff * 2^(attempt-1)
+			if wait := c.backoff << (attempt - 1); wait > 0 && !c.wait(ctx, time.Duration(rnd.Int63n(int64(wait)))) {
+				return nil, err
+			}
+		}
+		if ok, _ := breaker.Allow(); !ok {
+			atomic.AddInt64(&c.rejected, 1)
+			return nil, errInventoryUnavailable
+		}
+		atomic.AddInt64(&c.calls, 1)
+		var stock map[ProductID]int
+		stock, err = c.call(ctx, category, ids, rnd)
+		if err == nil {
+			breaker.RecordSuccess()
+			return stock, nil
+		}
+		if ctx.Err() != nil {
+			// The caller hung up, which says nothing about the inventory
+			return nil, ctx.Err()
+		}
+		atomic.AddInt64(&c.failures, 1)
+		if errors.Is(err, ErrTimeout) {
+			atomic.AddInt64(&c.timeouts, 1)
+		}
+		if breakerFailure(err) {
+			breaker.RecordFailure()
+		}
+	}
+	return nil, err
+}
+
+// call makes one attempt, cancelled once the timeout passes on c.clock
+func (c *inventoryClient) call(ctx context.Context, category string, ids []ProductID, rnd *rand.Rand) (map[ProductID]int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t := c.clock.NewTimer(c.timeout)
+	defer t.Stop()
+	go func() {
+		select {
+		case <-t.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return c.service.stock(ctx, category, ids, rnd)
+}
+
+// wait sleeps for d unless ctx ends first
+func (c *inventoryClient) wait(ctx context.Context, d time.Duration) bool {
+	return sleepCtx(ctx, c.clock, d)
+}
+
+func (c *inventoryClient) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"error_rate": c.service.ErrorRate(),
+		"calls":      atomic.LoadInt64(&c.calls),
+		"retries":    atomic.LoadInt64(&c.retried),
+		"failures":   atomic.LoadInt64(&c.failures),
+		"timeouts":   atomic.LoadInt64(&c.timeouts),
+		"rejected":   atomic.LoadInt64(&c.rejected),
+		"degraded":   atomic.LoadInt64(&c.degraded),
+		"circuits":   c.circuits(),
+	}
+}
+
+// circuits is each inventory category's breaker state
+func (c *inventoryClient) circuits() map[string]string {
+	out := make(map[string]string, len(c.breakers))
+	for category, b := range c.breakers {
+		out[category] = resilience.StateName(b.State())
+	}
+	return out
+}
+
+// circuitStates are the category breakers for /circuit, named
+// inventory:<category>
+func (c *inventoryClient) circuitStates() map[string]circuitState {
+	out := make(map[string]circuitState, len(c.breakers))
+	for category, b := range c.breakers {
+		out["inventory:"+category] = breakerCircuitState(b)
+	}
+	return out
+}
+
+// onInventoryTransition announces a change of a category's inventory
+// breaker. It doesn't affect readiness: searches still work without
+// stock.
+func (s *Server) onInventoryTransition(category string, from, to int32) {
+	log.Printf("Inventory circuit for %s %s -> %s", category, resilience.StateName(from), resilience.StateName(to))
+	s.statsd.incr("inventory.breaker.transition", "category:"+category, "from:"+resilience.StateName(from), "to:"+resilience.StateName(to))
+}
+
+// enrichStock fills in Stock on results with one inventory call per
+// category, made concurrently, and returns the categories that couldn't
+// be reached, whose results go out without it
+func (s *Server) enrichStock(ctx context.Context, results []Product, rnd *rand.Rand) []string {
+	byCategory := map[string][]ProductID{}
+	for _, p := range results {
+		c := inventoryCategory(p.Category)
+		byCategory[c] = append(byCategory[c], p.ID)
+	}
+	stock, skipped := s.stockOf(ctx, byCategory, rnd)
+	for i := range results {
+		if n, ok := stock[results[i].ID]; ok {
+			results[i].Stock = &n
+		}
+	}
+	return skipped
+}
+
+// candidateStock is the stock of every one of ids still in the catalog,
+// for a search filtering on it, and the categories that couldn't be
+// reached, whose products are missing from it
+func (s *Server) candidateStock(ctx context.Context, ids []ProductID, rnd *rand.Rand) (map[ProductID]int, []string) {
+	byCategory := map[string][]ProductID{}
+	for _, id := range ids {
+		if sp, ok := s.store.lookup(id); ok {
+			c := inventoryCategory(sp.Category)
+			byCategory[c] = append(byCategory[c], id)
+		}
+	}
+	return s.stockOf(ctx, byCategory, rnd)
+}
+
+// stockOf makes one inventory call per category of byCategory,
+// concurrently, for the IDs under it, and returns the stock they gave
+// and the categories that couldn't be reached
+func (s *Server) stockOf(ctx context.Context, byCategory map[string][]ProductID, rnd *rand.Rand) (map[ProductID]int, []string) {
+	order := make([]string, 0, len(byCategory))
+	for c := range byCategory {
+		order = append(order, c)
+	}
+	sort.Strings(order)
+
+	answers := make([]map[ProductID]int, len(order))
+	var wg sync.WaitGroup
+	for i, category := range order {
+		// Each call backs off and fails on its own draws, taken in
+		// category order so a seeded search repeats them
+		crnd := rand.New(rand.NewSource(rnd.Int63()))
+		wg.Add(1)
+		go func(i int, category string, ids []ProductID) {
+			defer wg.Done()
+			// Each goroutine writes only its own category's answer
+			if stock, err := s.inventory.stock(ctx, category, ids, crnd); err == nil {
+				answers[i] = stock
+			}
+		}(i, category, byCategory[category])
+	}
+	wg.Wait()
+
+	out := map[ProductID]int{}
+	var skipped []string
+	for i, category := range order {
+		if answers[i] == nil {
+			skipped = append(skipped, category)
+			continue
+		}
+		for id, n := range answers[i] {
+			out[id] = n
+		}
+	}
+	if skipped != nil {
+		atomic.AddInt64(&s.inventory.degraded, 1)
+		s.statsd.incr("inventory.degraded")
+	}
+	return out, skipped
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// TestInventoryCategoryBreakers fails one category's inventory calls: its
+// breaker must open alone, rejecting its calls without making them, while
+// every other category's results keep their stock
+func TestInventoryCategoryBreakers(t *testing.T) {
+	const threshold = 3
+	clock := newManualClock(time.Unix(0, 0))
+	failing := categories[1]
+	service := newInventoryService(0, 0, 0, clock, []string{failing})
+	bcfg := resilience.BreakerConfig{Policy: resilience.PolicyConsecutive, Threshold: threshold, Cooldown: time.Minute}
+	c, err := newInventoryClient(service, bcfg, clock, func(string, int32, int32) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.timeout = time.Second
+	s := &Server{inventory: c}
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < threshold+2; round++ {
+		results := make([]Product, 2*len(categories)+1)
+		for i := range results {
+			results[i] = Product{ID: ProductID(i + 1), Category: strings.ToLower(categories[i%len(categories)])}
+		}
+		results[len(results)-1].Category = "Garden"
+		skipped := s.enrichStock(context.Background(), results, rnd)
+		if len(skipped) != 1 || skipped[0] != failing {
+			t.Errorf("round %d skipped stock for %v, want only %s", round, skipped, failing)
+		}
+		for _, p := range results {
+			if (p.Stock == nil) != (inventoryCategory(p.Category) == failing) {
+				t.Errorf("round %d: %s result has stock %v", round, p.Category, p.Stock)
+			}
+		}
+	}
+	for category, state := range c.circuits() {
+		if want := category == failing; want != (state == resilience.StateName(resilience.StateOpen)) {
+			t.Errorf("%s breaker %s with only %s failing", category, state, failing)
+		}
+	}
+	if calls, rejected := atomic.LoadInt64(&c.calls), atomic.LoadInt64(&c.rejected); rejected != 2 || calls != int64((threshold+2)*(len(inventoryCategories)-1)+threshold) {
+		t.Errorf("%d calls and %d rejected, want the open breaker to stop %s's calls", calls, rejected, failing)
+	}
+	if len(c.circuitStates()) != len(inventoryCategories) {
+		t.Errorf("%d inventory breakers, want one per category", len(c.circuitStates()))
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	maxLoadTestRPS      = 10000
+	maxLoadTestDuration = 300
+	// loadTestOutstanding caps synthetic requests in flight; beyond it
+	// ticks are counted as skipped rather than piling up goroutines
+	loadTestOutstanding = 1000
+	loadTestTick        = 10 * time.Millisecond
+)
+
+// loadTestRequest is the body of POST /admin/loadtest
+type loadTestRequest struct {
+	RPS       int      `json:"rps"`
+	DurationS int      `json:"duration_s"`
+	QueryMix  []string `json:"query_mix"`
+}
+
+// loadTestReport summarises one run
+type loadTestReport struct {
+	RPS         int                `json:"rps"`
+	DurationS   int                `json:"duration_s"`
+	ElapsedS    float64            `json:"elapsed_s"`
+	Cancelled   bool               `json:"cancelled"`
+	Sent        int                `json:"sent"`
+	Skipped     int                `json:"skipped"`
+	AchievedRPS float64            `json:"achieved_rps"`
+	Succeeded   int                `json:"succeeded"`
+	ByStatus    map[string]int     `json:"by_status"`
+	Rejected    map[string]int     `json:"rejected"`
+	LatencyMS   map[string]float64 `json:"latency_ms"`
+}
+
+// loadTester allows one run at a time
+type loadTester struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// loadTestHandler runs a load test against this server's own routes and
+// responds with the report once it finishes or is cancelled. Synthetic
+// requests carry the caller's credentials and pass through the same auth,
+// rate limit, breaker and bulkhead as real traffic.
+func (s *Server) loadTestHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.EnableLoadTest {
+		writeErr(w, r, newError(ErrNotFound, "Load testing is disabled; start with -enable-loadtest"))
+		return
+	}
+	var req loadTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+		return
+	}
+	if req.RPS < 1 || req.RPS > maxLoadTestRPS {
+		writeErr(w, r, invalid("rps", fmt.Sprintf("rps must be between 1 and %d", maxLoadTestRPS)))
+		return
+	}
+	if req.DurationS < 1 || req.DurationS > maxLoadTestDuration {
+		writeErr(w, r, invalid("duration_s", fmt.Sprintf("duration_s must be between 1 and %d", maxLoadTestDuration)))
+		return
+	}
+	if len(req.QueryMix) == 0 {
+		req.QueryMix = []string{"alpha"}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.DurationS)*time.Second)
+	defer cancel()
+	s.loadTest.mu.Lock()
+	if s.loadTest.cancel != nil {
+		s.loadTest.mu.Unlock()
+		writeErr(w, r, newError(ErrConflict, "A load test is already running"))
+		return
+	}
+	s.loadTest.cancel = cancel
+	s.loadTest.mu.Unlock()
+	noteAudit(r, "loadtest", "", fmt.Sprintf("%d rps for %ds", req.RPS, req.DurationS))
+	defer func() {
+		s.loadTest.mu.Lock()
+		s.loadTest.cancel = nil
+		s.loadTest.mu.Unlock()
+	}()
+
+	writeJSON(w, http.StatusOK, s.runLoadTest(ctx, req, r.Header))
+}
+
+// cancelLoadTestHandler stops the running load test; its POST returns the
+// partial report
+func (s *Server) cancelLoadTestHandler(w http.ResponseWriter, r *http.Request) {
+	s.loadTest.mu.Lock()
+	cancel := s.loadTest.cancel
+	s.loadTest.mu.Unlock()
+	if cancel == nil {
+		writeErr(w, r, newError(ErrNotFound, "No load test is running"))
+		return
+	}
+	cancel()
+	noteAudit(r, "loadtest", "running", "cancelled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) runLoadTest(ctx context.Context, req loadTestRequest, auth http.Header) loadTestReport {
+	rep := loadTestReport{
+		RPS:       req.RPS,
+		DurationS: req.DurationS,
+		ByStatus:  make(map[string]int),
+		Rejected:  make(map[string]int),
+	}
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		latencies []time.Duration
+	)
+	slots := make(chan struct{}, loadTestOutstanding)
+	fire := func(q string, n int) {
+		defer wg.Done()
+		defer func() { <-slots }()
+		target := "/v1/products/search?q=" + url.QueryEscape(q)
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		// One port per request: the load stands for many clients, each
+		// with its own connection, not one client over the concurrency cap
+		r.RemoteAddr = "loadtest:" + strconv.Itoa(n)
+		for _, h := range []string{"Authorization", "X-API-Key"} {
+			if v := auth.Get(h); v != "" {
+				r.Header.Set(h, v)
+			}
+		}
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		s.mux.ServeHTTP(rec, r)
+		d := time.Since(start)
+
+		mu.Lock()
+		defer mu.Unlock()
+		latencies = append(latencies, d)
+		rep.ByStatus[fmt.Sprint(rec.Code)]++
+		if rec.Code < 300 {
+			rep.Succeeded++
+			return
+		}
+		reason := rec.Header().Get("X-Error-Code")
+		// Bulkhead and concurrency rejections share a code; tell them apart
+		if reason == codeOverloaded {
+			var body apiError
+			if json.Unmarshal(rec.Body.Bytes(), &body) == nil && body.Error.Reason == rejectBulkhead {
+				reason = "bulkhead"
+			}
+		}
+		if reason == "" {
+			reason = "unknown"
+		}
+		rep.Rejected[reason]++
+	}
+
+	start := time.Now()
+	tick := time.NewTicker(loadTestTick)
+	defer tick.Stop()
+	n := 0
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case now := <-tick.C:
+			due := int(now.Sub(start).Seconds() * float64(req.RPS))
+			for ; rep.Sent+rep.Skipped < due; n++ {
+				select {
+				case slots <- struct{}{}:
+					rep.Sent++
+					wg.Add(1)
+					go fire(req.QueryMix[n%len(req.QueryMix)], n)
+				default:
+					rep.Skipped++
+				}
+			}
+		}
+	}
+	rep.Cancelled = ctx.Err() == context.Canceled
+	// Achieved rate is over the send window; elapsed includes the drain
+	if sending := time.Since(start).Seconds(); sending > 0 {
+		rep.AchievedRPS = float64(rep.Sent) / sending
+	}
+	wg.Wait()
+	rep.ElapsedS = time.Since(start).Seconds()
+	rep.LatencyMS = latencyPercentiles(latencies)
+	return rep
+}
+
+// latencyPercentiles reports p50/p90/p99/max in milliseconds
+func latencyPercentiles(ds []time.Duration) map[string]float64 {
+	out := map[string]float64{"p50": 0, "p90": 0, "p99": 0, "max": 0}
+	if len(ds) == 0 {
+		return out
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	ms := func(d time.Duration) float64 {
+		return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000
+	}
+	at := func(p float64) float64 {
+		return ms(ds[int(p*float64(len(ds)-1))])
+	}
+	out["p50"], out["p90"], out["p99"] = at(0.50), at(0.90), at(0.99)
+	out["max"] = ms(ds[len(ds)-1])
+	return out
+}
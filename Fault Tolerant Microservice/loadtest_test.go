@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadTestDisabled(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	if rec := serve(h, http.MethodPost, "/admin/loadtest", `{"rps":10,"duration_s":1}`, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("without -enable-loadtest: %d", rec.Code)
+	}
+}
+
+// decodeLoadTestReport fails t unless rec is a 200 with a report
+func decodeLoadTestReport(t *testing.T, rec *httptest.ResponseRecorder) loadTestReport {
+	t.Helper()
+	var rep loadTestReport
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+// TestLoadTestReport runs a short load test through the server's own
+// routes: every search is sent and answered, and the report adds up
+func TestLoadTestReport(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) { cfg.EnableLoadTest = true }).Routes()
+	for _, body := range []string{
+		`{"rps":0,"duration_s":1}`,
+		`{"rps":10,"duration_s":0}`,
+		`{"rps":10,"duration_s":301}`,
+		`not json`,
+	} {
+		if rec := serve(h, http.MethodPost, "/admin/loadtest", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", body, rec.Code)
+		}
+	}
+
+	rep := decodeLoadTestReport(t, serve(h, http.MethodPost, "/admin/loadtest", `{"rps":100,"duration_s":1,"query_mix":["alpha","books",""]}`, nil))
+	if rep.Cancelled || rep.Sent < 50 || rep.Sent > 100 || rep.Skipped != 0 {
+		t.Errorf("sent %d, skipped %d, cancelled %v: want about 100 over the second", rep.Sent, rep.Skipped, rep.Cancelled)
+	}
+	if rep.Succeeded != rep.Sent || rep.ByStatus["200"] != rep.Sent || len(rep.Rejected) != 0 {
+		t.Errorf("%d of %d succeeded, by status %v, rejected %v", rep.Succeeded, rep.Sent, rep.ByStatus, rep.Rejected)
+	}
+	if rep.AchievedRPS <= 0 || rep.ElapsedS < 1 || rep.LatencyMS["p50"] > rep.LatencyMS["p99"] || rep.LatencyMS["p99"] > rep.LatencyMS["max"] {
+		t.Errorf("achieved %.1f rps over %.2fs, latencies %v", rep.AchievedRPS, rep.ElapsedS, rep.LatencyMS)
+	}
+}
+
+// TestLoadTestCancel runs one load test at a time against an open
+// breaker: a second is refused, DELETE stops the first, whose report
+// counts its searches rejected by reason
+func TestLoadTestCancel(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.EnableLoadTest = true })
+	h := s.Routes()
+	s.breaker.ForceOpen()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(h, http.MethodPost, "/admin/loadtest", `{"rps":200,"duration_s":300}`, nil)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.loadTest.mu.Lock()
+		running := s.loadTest.cancel != nil
+		s.loadTest.mu.Unlock()
+		if running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the load test never started")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if rec := serve(h, http.MethodPost, "/admin/loadtest", `{"rps":10,"duration_s":1}`, nil); rec.Code != http.StatusConflict {
+		t.Errorf("a second load test: %d", rec.Code)
+	}
+	if rec := serve(h, http.MethodDelete, "/admin/loadtest", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("cancel: %d", rec.Code)
+	}
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the load test didn't stop when cancelled")
+	}
+	rep := decodeLoadTestReport(t, rec)
+	if !rep.Cancelled || rep.Sent == 0 || rep.Succeeded != 0 || rep.Rejected[codeCircuitOpen] != rep.Sent || rep.ByStatus["503"] != rep.Sent {
+		t.Errorf("report %+v, want every search rejected by the open breaker", rep)
+	}
+	if rec := serve(h, http.MethodDelete, "/admin/loadtest", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("cancel with none running: %d", rec.Code)
+	}
+}
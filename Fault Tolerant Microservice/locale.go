@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultLocale is the language of Product.Name. Names holds the others.
+const defaultLocale = "en"
+
+// locales are the languages a product name may be given in
+var locales = []string{"en", "de", "fr"}
+
+func supportedLocale(l string) bool {
+	for _, s := range locales {
+		if s == l {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryTag lowercases a language tag and drops any region, so "de-AT"
+// and "de_at" both give "de"
+func primaryTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
+
+// resolveLocale picks the response language from lang=, then
+// Accept-Language, then the default. Unsupported languages are skipped
+// rather than rejected.
+func resolveLocale(r *http.Request) string {
+	if l := primaryTag(r.URL.Query().Get("lang")); supportedLocale(l) {
+		return l
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if f, err := strconv.ParseFloat(params[2:], 64); err == nil {
+				q = f
+			}
+		}
+		if l := primaryTag(tag); q > 0 && supportedLocale(l) {
+			prefs = append(prefs, weighted{l, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	if len(prefs) > 0 {
+		return prefs[0].tag
+	}
+	return defaultLocale
+}
+
+// setLocaleHeaders reports the language chosen and that it depended on
+// Accept-Language
+func setLocaleHeaders(w http.ResponseWriter, locale string) {
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+}
+
+// localized returns p with its name in locale, if it has one
+func (p Product) localized(locale string) Product {
+	if n := p.Names[locale]; n != "" {
+		p.Name = n
+	}
+	return p
+}
+
+// lowerNames lowercases a product's localized names for matching
+func lowerNames(names map[string]string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(names))
+	for l, n := range names {
+		out[l] = strings.ToLower(n)
+	}
+	return out
+}
+
+// validateNames checks localized names the way checkProductField checks
+// name itself
+func validateNames(names map[string]string) error {
+	for l, n := range names {
+		if !supportedLocale(l) {
+			return invalid("names", fmt.Sprintf("names: unsupported locale %q, expected some of %s", l, strings.Join(locales, ",")))
+		}
+		if c := utf8.RuneCountInString(n); c > maxNameChars {
+			return invalid("names."+l, fmt.Sprintf("names.%s must be at most %d characters, got %d", l, maxNameChars, c))
+		}
+		for _, c := range n {
+			if unicode.IsControl(c) {
+				return invalid("names."+l, fmt.Sprintf("names.%s must not contain control characters", l))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	cfg := DefaultConfig()
+	listen := flag.String("listen", ":8080", "address to serve on")
+	tlsCert := flag.String("tls-cert", os.Getenv("TLS_CERT_FILE"), "serve HTTPS, with HTTP/2, using this certificate file; needs -tls-key")
+	tlsKey := flag.String("tls-key", os.Getenv("TLS_KEY_FILE"), "private key file for -tls-cert")
+	h2c := flag.Bool("h2c", os.Getenv("H2C") == "1", "also accept cleartext HTTP/2 from clients with prior knowledge, for trusted load balancers; without TLS only")
+	origins := flag.String("cors-origins", os.Getenv("CORS_ALLOWED_ORIGINS"),
+		"comma separated list of allowed CORS origins (exact, https://*.example.com, or *)")
+	flag.IntVar(&cfg.CORSMaxAge, "cors-max-age", cfg.CORSMaxAge, "seconds browsers may cache a CORS preflight")
+	keysFile := flag.String("api-keys-file", os.Getenv("API_KEYS_FILE"),
+		`JSON file of API keys [{"name":"ci","key":"...","role":"read|write|admin"}]; API_KEYS="name:role:key,..." adds more`)
+	flag.BoolVar(&cfg.RequireAuthForReads, "require-auth-for-reads", false, "require a read key for search and other read endpoints")
+	flag.BoolVar(&cfg.AccessLog, "access-log", false, "log one line per request")
+	hooksFile := flag.String("webhooks-file", os.Getenv("WEBHOOKS_FILE"),
+		`JSON file of webhook targets [{"url":"...","secret":"...","events":["breaker.open","readiness.*"]}]`)
+	auditFile := flag.String("audit-file", os.Getenv("AUDIT_FILE"), "append a JSON line per admin call and product change to this file; /admin/audit keeps the latest either way")
+	auditMaxMB := flag.Int64("audit-max-mb", 100, "rotate the audit file once it would grow past this many MB, 0 never rotates")
+	auditKeep := flag.Int("audit-keep", 5, "rotated audit files kept, as -audit-file.1 (the newest) on up")
+	adminAllowList := flag.String("admin-allowlist", "", "comma separated CIDRs or addresses allowed to reach /admin routes, empty allows all")
+	adminAllowFile := flag.String("admin-allowlist-file", "", "file of admin allowlist entries, one per line; re-read on SIGHUP")
+	proxies := flag.String("trusted-proxies", "", "comma separated CIDRs of proxies whose X-Forwarded-For is believed")
+	flag.Float64Var(&cfg.RateLimitRPS, "rate-limit-rps", 0, "per client token refill rate, 0 disables rate limiting")
+	flag.IntVar(&cfg.RateLimitBurst, "rate-limit-burst", cfg.RateLimitBurst, "per client bucket capacity")
+	flag.StringVar(&cfg.RateLimitStore, "rate-limit-store", cfg.RateLimitStore, "where rate limit buckets are kept: memory, per instance, or redis, shared by every instance using the same Redis and prefix")
+	flag.StringVar(&cfg.RateLimitRedisAddr, "rate-limit-redis-addr", os.Getenv("REDIS_ADDR"), "host:port of the Redis for -rate-limit-store redis; REDIS_PASSWORD is sent with AUTH when set")
+	flag.StringVar(&cfg.RateLimitRedisPrefix, "rate-limit-redis-prefix", cfg.RateLimitRedisPrefix, "prefix of rate limit bucket keys in Redis")
+	flag.DurationVar(&cfg.RateLimitRedisTimeout, "rate-limit-redis-timeout", cfg.RateLimitRedisTimeout, "longest a Redis bucket call may take before the instance limits on its own buckets")
+	flag.IntVar(&cfg.ChangeJournal, "change-journal", cfg.ChangeJournal, "catalog changes kept for /products/changes and event stream resumes")
+	flag.BoolVar(&cfg.Coalesce, "coalesce", cfg.Coalesce, "let identical concurrent searches share one execution; debug and seeded searches never do")
+	flag.StringVar(&cfg.SearchMode, "search-mode", cfg.SearchMode, "mode of searches that don't give one: "+strings.Join(searchModes, ", "))
+	flag.StringVar(&cfg.SampleStrategy, "sample-strategy", cfg.SampleStrategy, "how sampled searches draw products: uniform, or stratified-by-category or stratified-by-brand to give every category or brand at least one check")
+	flag.IntVar(&cfg.BulkheadQueue, "bulkhead-queue", 0, "searches that may wait for a bulkhead slot instead of being rejected, 0 rejects at once")
+	flag.DurationVar(&cfg.BulkheadQueueTimeout, "bulkhead-queue-timeout", cfg.BulkheadQueueTimeout, "longest a search waits for a bulkhead slot")
+	flag.StringVar(&cfg.BulkheadQueueOrder, "bulkhead-queue-order", cfg.BulkheadQueueOrder, "order waiting searches get slots in: fifo (arrival order) or lifo (newest first, better tail latency under overload)")
+	flag.IntVar(&cfg.ClientConcurrency, "client-concurrency", cfg.ClientConcurrency, "requests one client address may have in flight at once, 0 disables the cap")
+	flag.StringVar(&cfg.BreakerPolicy, "breaker-policy", cfg.BreakerPolicy, "circuit breaker trip policy: windowed (failure rate over a window) or consecutive")
+	flag.IntVar(&cfg.FailThreshold, "breaker-consecutive", cfg.FailThreshold, "consecutive policy: failures in a row that open the breaker")
+	flag.DurationVar(&cfg.BreakerWindow, "breaker-window", cfg.BreakerWindow, "windowed policy: how far back outcomes count")
+	flag.Float64Var(&cfg.BreakerFailureRate, "breaker-failure-rate", cfg.BreakerFailureRate, "windowed policy: failure rate that opens the breaker")
+	flag.IntVar(&cfg.BreakerMinRequests, "breaker-min-requests", cfg.BreakerMinRequests, "windowed policy: outcomes needed in the window before it can open")
+	flag.DurationVar(&cfg.BreakerSlowCall, "breaker-slow-call", 0, "also open the breaker when the search latency percentile stays above this; 0 disables")
+	flag.Float64Var(&cfg.BreakerSlowPercentile, "breaker-slow-percentile", cfg.BreakerSlowPercentile, "latency percentile compared with -breaker-slow-call")
+	flag.DurationVar(&cfg.BreakerSlowWindow, "breaker-slow-window", cfg.BreakerSlowWindow, "how far back search latencies count")
+	flag.DurationVar(&cfg.BreakerSlowSustain, "breaker-slow-sustain", cfg.BreakerSlowSustain, "how long the percentile must stay above -breaker-slow-call before the breaker opens")
+	flag.IntVar(&cfg.BreakerSlowMinCalls, "breaker-slow-min-calls", cfg.BreakerSlowMinCalls, "searches needed in the window before latency can open the breaker")
+	selfTest := flag.Bool("self-test", false, "run the internal checks against a small generated catalog, print the report and exit, nonzero on failure, without serving")
+	flag.IntVar(&cfg.ExportSnapshots, "export-snapshots", cfg.ExportSnapshots, "pinned catalog exports kept for Range resumes of /products/export; 0 disables snapshot=true there")
+	flag.DurationVar(&cfg.ExportSnapshotTTL, "export-snapshot-ttl", cfg.ExportSnapshotTTL, "how long a pinned catalog export can be resumed")
+	flag.DurationVar(&cfg.OperationTTL, "operation-ttl", cfg.OperationTTL, "how long a finished admin operation can still be polled at /admin/operations/{id}")
+	flag.Float64Var(&cfg.SLOTarget, "slo-target", cfg.SLOTarget, "availability target GET /slo measures product API requests against, e.g. 0.995")
+	flag.BoolVar(&cfg.SLOCountShed, "slo-count-shed", false, "count requests shed by the breaker, the bulkhead or a limit as SLO failures; by default they are left out, like client errors")
+	flag.Float64Var(&cfg.SLOFastBurn, "slo-fast-burn", cfg.SLOFastBurn, "error budget burn rate over both the 5m and 1h windows that logs an slo.fast_burn event and sends its webhook")
+	flag.Float64Var(&cfg.ChaosGuardBurn, "chaos-guard-burn", 0, "cap chaos once the error budget burns this fast over the SLO's 5m window for -chaos-guard-sustain, sending a chaos.guard_tripped webhook, until POST /admin/chaos/guard/ack; 0 disables the guard")
+	flag.DurationVar(&cfg.ChaosGuardSustain, "chaos-guard-sustain", cfg.ChaosGuardSustain, "how long the burn rate must stay over -chaos-guard-burn before the guard trips")
+	flag.BoolVar(&cfg.ChaosPartial, "chaos-partial", false, "answer a chaos failure with the results already matched, a 200 with a warning, instead of a 500")
+	flag.Float64Var(&cfg.ChaosPartialTruncate, "chaos-partial-truncate", 0, "fraction of -chaos-partial answers that also lose some of their results")
+	flag.BoolVar(&cfg.ChaosPartialBreaker, "chaos-partial-breaker", cfg.ChaosPartialBreaker, "count -chaos-partial answers as breaker failures")
+	flag.Float64Var(&cfg.ChaosGuardCap, "chaos-guard-cap", 0, "failure rate a tripped guard holds chaos to; added latency is dropped whatever the cap")
+	flag.StringVar(&cfg.SigningKeysFile, "signing-keys", "", `JSON file of response signing keys [{"id":"2026-10","secret":"..."}]; each signs every response body with HMAC-SHA256 in X-Signature, a trailer for streamed ones; re-read on SIGHUP`)
+	flag.StringVar(&cfg.ValidationRulesFile, "validation-rules", "", `JSON file of per field product rules, {"fields":{"category":{"required":true,"max_length":50,"pattern":"...","enum":[...] or "enum_from":"categories"}}}, applied by create, update and import; re-read on SIGHUP`)
+	flag.BoolVar(&cfg.ResponseEnvelope, "v1-envelope", cfg.ResponseEnvelope, "answer v1 search, list and related requests with a data, meta and links envelope; false keeps the flat v1 shapes")
+	flag.DurationVar(&cfg.StreamWriteTimeout, "stream-write-timeout", cfg.StreamWriteTimeout, "abort a CSV, NDJSON or export stream when one write stalls this long on a slow consumer; 0 disables")
+	flag.DurationVar(&cfg.MaxStreamDuration, "max-stream-duration", cfg.MaxStreamDuration, "cut a CSV, NDJSON or export stream that has run this long, however many items are left; 0 disables")
+	flag.IntVar(&cfg.ResponseCache, "response-cache", 0, "exhaustive and indexed search responses cached until a mutation could change them, 0 disables the cache")
+	flag.IntVar(&cfg.ResponseCacheShards, "response-cache-shards", cfg.ResponseCacheShards, "independently locked shards the response cache is split into")
+	flag.IntVar(&cfg.CacheWarmup, "cache-warmup", cfg.CacheWarmup, "most requested cached searches saved with -state-file on shutdown and replayed into the response cache before the next start reports ready; 0 disables")
+	flag.IntVar(&cfg.CacheWarmupConcurrency, "cache-warmup-concurrency", cfg.CacheWarmupConcurrency, "cache warmup searches run at once")
+	flag.DurationVar(&cfg.CacheWarmupMaxDelay, "cache-warmup-max-delay", cfg.CacheWarmupMaxDelay, "longest readiness waits for the cache warmup; searches not run by then are abandoned, 0 waits for all")
+	flag.IntVar(&cfg.DebugTraceMax, "debug-trace-max", cfg.DebugTraceMax, "candidates listed, with why each matched or not, in debug=true search output; 0 disables the trace")
+	flag.BoolVar(&cfg.EnableLoadTest, "enable-loadtest", false, "allow POST /admin/loadtest to generate synthetic load in-process")
+	brownout := flag.String("brownout", "", "comma separated utilization thresholds, e.g. 0.5,0.7,0.9, at which searches check fewer products instead of being rejected")
+	flag.Int64Var(&cfg.MaxProductBytes, "max-product-bytes", cfg.MaxProductBytes, "largest accepted body for creating or updating one product")
+	flag.Int64Var(&cfg.MaxImportBytes, "max-import-bytes", cfg.MaxImportBytes, "largest accepted body for POST /products/import")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long responses to mutations sent with an Idempotency-Key are replayed")
+	flag.IntVar(&cfg.SearchSnapshots, "search-snapshots", cfg.SearchSnapshots, "search result snapshots kept for consistent paging; 0 disables snapshot=true")
+	flag.DurationVar(&cfg.SearchSnapshotTTL, "search-snapshot-ttl", cfg.SearchSnapshotTTL, "how long a search result snapshot can be paged")
+	flag.Int64Var(&cfg.IdempotencyMaxBytes, "idempotency-max-bytes", cfg.IdempotencyMaxBytes, "memory for stored Idempotency-Key responses; least recently used are evicted")
+	flag.BoolVar(&cfg.Inventory, "inventory", false, "enrich search results with stock from the simulated inventory dependency")
+	flag.Float64Var(&cfg.InventoryErrorRate, "inventory-error-rate", cfg.InventoryErrorRate, "fraction of inventory calls that fail")
+	inventoryFailing := flag.String("inventory-failing-categories", "", "comma separated categories whose inventory calls all fail, opening their breakers alone: "+strings.Join(inventoryCategories, ", "))
+	flag.DurationVar(&cfg.InventoryLatency, "inventory-latency", cfg.InventoryLatency, "base latency of an inventory call")
+	flag.DurationVar(&cfg.InventoryJitter, "inventory-jitter", cfg.InventoryJitter, "extra random latency of up to this much per inventory call")
+	flag.DurationVar(&cfg.InventoryTimeout, "inventory-timeout", cfg.InventoryTimeout, "per attempt timeout for inventory calls")
+	flag.IntVar(&cfg.InventoryRetries, "inventory-retries", cfg.InventoryRetries, "retries after a failed inventory call")
+	flag.DurationVar(&cfg.InventoryBackoff, "inventory-backoff", cfg.InventoryBackoff, "base of the jittered exponential backoff between inventory retries")
+	flag.Float64Var(&cfg.HedgePercentile, "hedge-percentile", 0, "hedge sampled scans slower than this percentile of recent scans, e.g. 0.95; 0 disables hedging")
+	flag.IntVar(&cfg.HedgeBudget, "hedge-budget", cfg.HedgeBudget, "most hedged scans running at once, separate from the bulkhead")
+	flag.DurationVar(&cfg.ChecksTuneTarget, "checks-tune-target", 0, "tune the products each sampled search checks to keep their p95 latency under this, e.g. 20ms; 0 keeps the fixed sample size")
+	flag.IntVar(&cfg.ChecksTuneMin, "checks-tune-min", cfg.ChecksTuneMin, "fewest products a tuned sampled search checks")
+	flag.IntVar(&cfg.ChecksTuneMax, "checks-tune-max", cfg.ChecksTuneMax, "most products a tuned sampled search checks")
+	flag.StringVar(&cfg.IndexFile, "index-file", "", "keep the vocabulary and trigram index here, with a hash of the catalog they were built from, and load them on start instead of rebuilding; a mismatched or corrupt file is rebuilt in the background while searches scan")
+	flag.StringVar(&cfg.StateFile, "state-file", "", "save breaker and rate limit state here on shutdown and restore it on start; ignored in deterministic mode")
+	flag.StringVar(&cfg.WALFile, "wal-file", "", "log every product mutation here, fsynced before it is acknowledged, and replay it on start; ignored in deterministic mode")
+	flag.DurationVar(&cfg.WALSyncInterval, "wal-sync-interval", 0, "fsync the write-ahead log this often for all writes since, each waiting for it, e.g. 5ms; 0 fsyncs every write")
+	flag.StringVar(&cfg.CatalogSnapshotFile, "catalog-snapshot", "", "save the catalog here periodically and on shutdown, load it on start and truncate the write-ahead log it covers; needs -wal-file")
+	flag.DurationVar(&cfg.CatalogSnapshotInterval, "catalog-snapshot-interval", cfg.CatalogSnapshotInterval, "how often to save the catalog snapshot; 0 saves it only on shutdown")
+	flag.DurationVar(&cfg.StateMaxAge, "state-max-age", cfg.StateMaxAge, "ignore a state file saved longer ago than this")
+	flag.Float64Var(&cfg.ShadowPercent, "shadow-percent", 0, "percent of searches to re-run in the shadow mode and compare, 0 disables shadowing")
+	flag.StringVar(&cfg.ShadowMode, "shadow-mode", cfg.ShadowMode, "search mode shadow searches run in: exhaustive or indexed")
+	flag.IntVar(&cfg.ShadowPool, "shadow-pool", cfg.ShadowPool, "most shadow searches running at once; extra ones are dropped")
+	flag.StringVar(&cfg.MirrorURL, "mirror-url", "", "copy a share of GET requests to this instance, e.g. a canary, and compare its answers on /stats/mirror; empty disables mirroring")
+	flag.Float64Var(&cfg.MirrorPercent, "mirror-percent", cfg.MirrorPercent, "percent of GET requests to mirror")
+	flag.IntVar(&cfg.MirrorWorkers, "mirror-workers", cfg.MirrorWorkers, "most mirrored requests in flight at once; extra ones are dropped")
+	flag.DurationVar(&cfg.MirrorTimeout, "mirror-timeout", cfg.MirrorTimeout, "how long a mirrored request may take")
+	flag.BoolVar(&cfg.MirrorCredentials, "mirror-credentials", false, "send mirrored requests with the client's Authorization, X-API-Key and Cookie headers, for a target that checks the same keys; off, they are dropped")
+	flag.StringVar(&cfg.WatchdogDir, "watchdog-dir", "", "write heap and CPU profiles here when a watchdog threshold is breached, empty disables the watchdog")
+	flag.DurationVar(&cfg.WatchdogInterval, "watchdog-interval", cfg.WatchdogInterval, "how often the watchdog samples the process")
+	watchdogHeapMB := flag.Uint64("watchdog-heap-mb", 0, "capture when heap in use exceeds this many MB, 0 disables the check")
+	flag.IntVar(&cfg.WatchdogGoroutines, "watchdog-goroutines", 0, "capture when more goroutines than this are running, 0 disables the check")
+	flag.DurationVar(&cfg.WatchdogLag, "watchdog-lag", cfg.WatchdogLag, "capture when the watchdog's timer fires this much late, 0 disables the check")
+	flag.DurationVar(&cfg.WatchdogCPU, "watchdog-cpu", cfg.WatchdogCPU, "how long each captured CPU profile runs")
+	flag.DurationVar(&cfg.WatchdogMinGap, "watchdog-min-gap", cfg.WatchdogMinGap, "least time between captures, however long a breach lasts")
+	flag.IntVar(&cfg.WatchdogKeep, "watchdog-keep", cfg.WatchdogKeep, "captures kept in the watchdog directory; older ones are deleted")
+	memorySoftMB := flag.Uint64("memory-soft-limit-mb", 0, "shed caches, the trigram index and the change journal while heap in use exceeds this many MB, 0 disables")
+	flag.DurationVar(&cfg.MemoryCheckInterval, "memory-check-interval", cfg.MemoryCheckInterval, "how often heap in use is compared with -memory-soft-limit-mb")
+	flag.StringVar(&cfg.DiskCheckPath, "disk-check-path", "", "filesystem checked for free space; defaults to the state file's directory, then -watchdog-dir")
+	diskMinFreeMB := flag.Uint64("disk-min-free-mb", cfg.DiskMinFreeBytes>>20, "persistence is degraded, pausing watchdog captures, below this much free space")
+	flag.Float64Var(&cfg.DiskMinFreePercent, "disk-min-free-percent", cfg.DiskMinFreePercent, "persistence is also degraded below this percentage free, 0 disables")
+	flag.DurationVar(&cfg.DiskCheckCache, "disk-check-cache", cfg.DiskCheckCache, "how long a free space reading is reused")
+	trigramMB := flag.Int64("trigram-budget-mb", 0, "build a trigram index for mode=indexed searches within this many MB, 0 disables it")
+	flag.BoolVar(&cfg.Deterministic, "deterministic", os.Getenv("DETERMINISTIC") == "1",
+		"disable chaos, fix the sampling seed and freeze SearchTime, for integration tests; ignored when PRODUCTION is set")
+	flag.BoolVar(&cfg.DemoMode, "demo-mode", os.Getenv("DEMO_MODE") == "1",
+		"public demo preset: no write or admin routes, no chaos, small pages and samples, strict rate limits, and CORS for any origin on reads")
+	statsdAddr := flag.String("statsd-addr", os.Getenv("STATSD_ADDR"), "host:port of a StatsD/DogStatsD collector, empty disables metrics")
+	statsdPrefix := flag.String("statsd-prefix", "productsearch.", "prefix for every StatsD metric name")
+	statsdTags := flag.String("statsd-tags", os.Getenv("STATSD_TAGS"), "comma separated DogStatsD tags added to every metric, e.g. env:prod,region:us")
+	statsdFlush := flag.Duration("statsd-flush", time.Second, "how often buffered StatsD metrics are sent")
+	recordFile := flag.String("record-file", "", "append sampled GET/HEAD request records here for productctl replay")
+	recordSample := flag.Float64("record-sample", 1, "fraction of requests to record")
+	recordMax := flag.Int64("record-max-bytes", 64<<20, "stop recording once the file reaches this size")
+	consulAddr := flag.String("consul-addr", os.Getenv("CONSUL_HTTP_ADDR"), "Consul agent to register with, empty disables registration")
+	consulName := flag.String("consul-service", "productsearch", "service name to register in Consul")
+	consulAdvertise := flag.String("consul-advertise", "", "address Consul should hand out for this instance, defaults to the agent's")
+	consulTags := flag.String("consul-tags", "", "comma separated extra tags for the Consul registration")
+	flag.IntVar(&cfg.SpillQueue, "spill-queue", 0, "searches that would be shed and sent Prefer: respond-async to accept with 202 and run once there is room, 0 disables")
+	flag.DurationVar(&cfg.SpillMaxAge, "spill-max-age", cfg.SpillMaxAge, "longest a spilled search waits for room before it expires")
+	flag.DurationVar(&cfg.SpillResultTTL, "spill-result-ttl", cfg.SpillResultTTL, "how long a spilled search's result can be polled for")
+	features := flag.String("features", "", "comma separated X-Features flags callers may turn on for their own requests: "+strings.Join(featureNames(), ", ")+"; others are ignored with a warning")
+	spillHosts := flag.String("spill-callback-hosts", "", "comma separated host[:port]s a spilled search's X-Callback-URL may name, empty allows polling only")
+	flag.StringVar(&cfg.SpillCallbackSecret, "spill-callback-secret", os.Getenv("SPILL_CALLBACK_SECRET"), "HMAC-SHA256 key spilled search callbacks are signed with in X-Webhook-Signature")
+	flag.Float64Var(&cfg.BackpressureThreshold, "backpressure-threshold", cfg.BackpressureThreshold, "search utilization past which responses carry X-Backpressure, a suggested delay in ms before the next request; 0 disables it")
+	flag.DurationVar(&cfg.BackpressureMaxDelay, "backpressure-max-delay", cfg.BackpressureMaxDelay, "largest delay X-Backpressure suggests")
+	flag.Int64Var(&cfg.SearchWorkBudget, "search-work-budget", 0, "most work, in product checks, one search may do; a search estimated over it checks what fits and is marked degraded, 0 is unlimited")
+	flag.Int64Var(&cfg.SearchCostBudget, "search-cost-budget", 0, "most estimated work, in product checks, all searches in flight may hold between them; searches with no room are rejected as overloaded, 0 is unlimited")
+	flag.StringVar(&cfg.TenantsFile, "tenants-file", "", `JSON file of tenants [{"id":"team-a","products":5000,"bulkhead":10,"rate_limit_rps":50,"rate_limit_burst":100}], each a catalog with its own caches and limits behind X-Tenant-Id or /t/{tenant}; zero fields take the instance's`)
+	flag.BoolVar(&cfg.TenantAutoProvision, "tenant-auto-provision", false, "create a tenant on first use instead of answering 404 for one not in -tenants-file")
+	flag.IntVar(&cfg.TenantProducts, "tenant-products", cfg.TenantProducts, "catalog size of a tenant that doesn't set products")
+	flag.IntVar(&cfg.TenantMax, "tenant-max", cfg.TenantMax, "most tenants, listed and auto provisioned, which also bounds the /stats breakdown")
+	flag.IntVar(&cfg.ShardIndex, "shard-index", 0, "this instance's shard, from 0, with -shard-count")
+	flag.IntVar(&cfg.ShardCount, "shard-count", 0, "split the catalog by consistent hash of product ID across this many instances, this one holding -shard-index's share; 0 or 1 is unsharded")
+	flag.StringVar(&cfg.ShardForeign, "shard-foreign", cfg.ShardForeign, "what a sharded instance does with a request for another shard's product: reject with 421 or proxy to its -shard-peers entry")
+	shardPeers := flag.String("shard-peers", "", "comma separated base URLs of every shard in index order, this one's included, for -shard-foreign proxy")
+	flag.IntVar(&cfg.LocalShards, "local-shards", 0, "also split the catalog across this many in-process shards, searched together by /shards/search")
+	flag.IntVar(&cfg.TrackedQueries, "tracked-queries", cfg.TrackedQueries, "distinct queries counted for /stats/zero-results and the cache warmup; new ones past it displace the least counted")
+	flag.IntVar(&cfg.TrackedQueryBytes, "tracked-query-bytes", cfg.TrackedQueryBytes, "longest query tracked; longer ones are cut, or left out of the warmup, which couldn't replay them")
+	rejections := flag.String("rejection-status", "", "comma separated reason=status overrides of the status rejections are sent with, e.g. rate_limit=503,circuit_open=429; reasons are "+strings.Join(rejectionReasons(), ", "))
+	flag.Parse()
+	cfg.CORSOrigins = parseOrigins(*origins)
+	if cfg.DemoMode {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		// CORS_ALLOWED_ORIGINS counts as setting -cors-origins
+		set["cors-origins"] = set["cors-origins"] || len(cfg.CORSOrigins) > 0
+		if err := checkDemoOverrides(set); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.TrigramBudget = *trigramMB << 20
+	cfg.WatchdogHeapBytes = *watchdogHeapMB << 20
+	cfg.RateLimitRedisPassword = os.Getenv("REDIS_PASSWORD")
+	cfg.DiskMinFreeBytes = *diskMinFreeMB << 20
+	cfg.MemorySoftLimit = *memorySoftMB << 20
+	thresholds, err := parseThresholds(*brownout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.BrownoutThresholds = thresholds
+	cfg.Features = parseList(*features)
+	cfg.InventoryFailing = parseList(*inventoryFailing)
+	cfg.SpillCallbackHosts = parseList(*spillHosts)
+	cfg.ShardPeers = parseList(*shardPeers)
+	if cfg.RejectionStatus, err = parseRejectionStatus(*rejections); err != nil {
+		log.Fatal(err)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key go together")
+	}
+	if *h2c && *tlsCert != "" {
+		log.Fatal("-h2c is for cleartext; with -tls-cert HTTP/2 is already on")
+	}
+	if cfg.Deterministic && os.Getenv("PRODUCTION") != "" {
+		log.Println("Warning: ignoring deterministic mode because PRODUCTION is set")
+		cfg.Deterministic = false
+	}
+
+	if cfg.TrustedProxies, err = parseCIDRs(parseList(*proxies)); err != nil {
+		log.Fatal("trusted proxies: ", err)
+	}
+	if cfg.AdminAllow, err = loadAllowlist(*adminAllowList, *adminAllowFile); err != nil {
+		log.Fatal("admin allowlist: ", err)
+	}
+
+	if cfg.APIKeys, err = loadAPIKeys(*keysFile, os.Getenv("API_KEYS")); err != nil {
+		log.Fatal(err)
+	}
+	if len(cfg.APIKeys) == 0 {
+		log.Println("No API keys configured: write and admin endpoints are unauthenticated")
+	}
+
+	if *selfTest {
+		report := runSelfTest(cfg, nil)
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if !report.Passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The client goes in the Config so every component NewServer builds,
+	// and every tenant and local shard, holds it before any goroutine
+	// that could emit starts
+	if *statsdAddr != "" {
+		if cfg.Statsd, err = newStatsd(*statsdAddr, *statsdPrefix, *statsdTags); err != nil {
+			log.Fatal(err)
+		}
+		go cfg.Statsd.flushLoop(*statsdFlush)
+		log.Println("Sending StatsD metrics to", *statsdAddr)
+	}
+	if cfg.Webhooks, err = newWebhookSender(*hooksFile); err != nil {
+		log.Fatal(err)
+	}
+	if *consulAddr != "" {
+		_, portStr, err := net.SplitHostPort(*listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			log.Fatalf("listen port %q: %v", portStr, err)
+		}
+		cfg.Consul = newConsulRegistration(*consulAddr, *consulName, *consulAdvertise, port, *tlsCert != "", parseList(*consulTags))
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Deterministic {
+		log.Println("Deterministic mode: chaos disabled, fixed seed, zero timings")
+	}
+	if cfg.DemoMode {
+		log.Println("Demo mode: write and admin routes off, chaos off, CORS open to reads from any origin")
+	}
+
+	if *auditFile != "" {
+		if err := audit.openFile(*auditFile, *auditMaxMB<<20, *auditKeep); err != nil {
+			log.Fatalf("Audit log: %v", err)
+		}
+		log.Println("Audit log writing to", *auditFile)
+	}
+	audit.statsd = s.statsd
+	go audit.run()
+
+	if hooks := cfg.Webhooks; hooks != nil {
+		for i := 0; i < 2; i++ {
+			go hooks.worker()
+		}
+		// Subscribed here, before any state is restored, so no transition
+		// goes out without its webhook
+		sub, _ := s.transitions.subscribe(transitionWebhookBuffer)
+		go hooks.forwardTransitions(sub)
+		if hooks.wantsProducts() {
+			events := s.store.events
+			sub, last := events.subscribe(subscriberWebhook, productWebhookBuffer, overflowDropOldest)
+			go hooks.forwardProducts(events, sub, last)
+		}
+	}
+	if *adminAllowFile != "" {
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				s.reloadAdminAllowlist(*adminAllowList, *adminAllowFile)
+			}
+		}()
+	}
+	if cfg.ValidationRulesFile != "" {
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				s.reloadValidationRules()
+				s.tenants.each((*Server).reloadValidationRules)
+			}
+		}()
+	}
+	if s.signer != nil {
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				s.signer.reload()
+			}
+		}()
+	}
+
+	s.RestoreState()
+	if s.watchdog != nil {
+		go s.watchdog.run()
+		log.Println("Watchdog writing profiles to", cfg.WatchdogDir)
+	}
+	if s.memory != nil {
+		go s.memory.run()
+		log.Printf("Memory governor keeping heap in use under %dMB", cfg.MemorySoftLimit>>20)
+	}
+	if s.limiter.Enabled() {
+		go s.limiter.SweepLoop(context.Background(), time.Minute)
+	}
+	if rb := s.limiter.redis; rb != nil && s.limiter.Enabled() {
+		if err := rb.ping(); err != nil {
+			log.Printf("Rate limit store redis at %s unreachable, limiting locally until it is: %v", rb.addr, err)
+		} else {
+			log.Printf("Rate limit buckets shared in redis at %s", rb.addr)
+		}
+	}
+	go s.slo.run()
+	if s.chaosGuard != nil {
+		go s.chaosGuard.run()
+	}
+	if s.backpressure.enabled() {
+		go s.backpressure.run(s)
+	}
+	if s.spill != nil {
+		for i := 0; i < spillWorkers; i++ {
+			go s.runSpill()
+		}
+		go s.spill.runCallbacks()
+	}
+
+	if *recordFile != "" {
+		if *recordSample <= 0 || *recordSample > 1 {
+			log.Fatal("-record-sample must be in (0, 1]")
+		}
+		if recorder, err = newTrafficRecorder(*recordFile, *recordSample, *recordMax); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Recording %.0f%% of requests to %s", *recordSample*100, *recordFile)
+	}
+
+	s.LoadCatalog()
+	s.WarmCache()
+
+	if cfg.Consul != nil {
+		go cfg.Consul.registerLoop()
+	}
+
+	// Over either protocol every HTTP/2 stream is a request of its own, so
+	// the per client caps and limits count streams, not connections
+	srv := &http.Server{Addr: *listen, Handler: s.Routes()}
+	if *h2c {
+		enableH2C(srv)
+	}
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Printf("Received %s, shutting down", <-sig)
+		// Leave discovery first so no new traffic is routed here while
+		// in-flight requests drain
+		if cfg.Consul != nil {
+			cfg.Consul.deregister()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Shutdown:", err)
+		}
+		// Admin operations stop between items, leaving nothing half done
+		s.ops.shutdown(ctx)
+		if err := s.SaveState(); err != nil {
+			log.Println("Saving state:", err)
+		}
+		s.closeCatalog()
+		close(done)
+	}()
+
+	switch {
+	case *tlsCert != "":
+		log.Println("Starting Product API on", *listen, "over TLS with HTTP/2")
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	case *h2c:
+		log.Println("Starting Product API on", *listen, "with cleartext HTTP/2")
+		err = srv.ListenAndServe()
+	default:
+		log.Println("Starting Product API on", *listen)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+// matchQuery is a search as a matcher sees it
+type matchQuery struct {
+	text            searchText
+	brand, category string
+	// n is how many products a sampled search checks, drawn by strategy
+	// from rnd
+	n        int
+	strategy string
+	rnd      *rand.Rand
+	page     searchPage
+	traceMax int
+}
+
+// filtered reports whether q keeps products by more than text, which a
+// sample would under-count
+func (q matchQuery) filtered() bool {
+	return q.indexFiltered() || q.text.price.set() || q.text.stock.set()
+}
+
+// indexFiltered reports whether the secondary indexes narrow q
+func (q matchQuery) indexFiltered() bool {
+	return q.brand != "" || q.category != ""
+}
+
+// matchStats is what one match did
+type matchStats struct {
+	Checked int
+	Matched int
+}
+
+// searchMatcher is a search mode: how a search picks the products it
+// checks, and how it checks them
+type searchMatcher interface {
+	// candidates picks the IDs to check and names the mode answering,
+	// another matcher's when this one can't: filtered searches are always
+	// answered exhaustively, from the secondary indexes where they apply
+	candidates(s *Server, q matchQuery) ([]ProductID, string)
+	match(ctx context.Context, s *Server, q matchQuery, candidates []ProductID) (*scanResult, matchStats, error)
+}
+
+// catalogIndexer is a matcher keeping a structure of its own over the
+// catalog. The store calls it, holding listLock, as each product is added
+// and removed, an update being both, except while a catalog load defers
+// indexing to build everything at once.
+type catalogIndexer interface {
+	indexLocked(s *productStore, sp *storedProduct)
+	unindexLocked(s *productStore, sp *storedProduct)
+}
+
+// matchers are the search modes, selected by mode= or Config.SearchMode.
+// A new mode is a row here; the handler, the spec and the tests all work
+// from this table.
+var matchers = []struct {
+	mode    string
+	matcher searchMatcher
+	about   string
+}{
+	{modeSample, sampleMatcher{}, "checks a random sample"},
+	{modeExhaustive, scanMatcher{}, "checks every product"},
+	{modeIndexed, indexedMatcher{}, "uses the trigram index when enabled and q has at least 3 characters, otherwise scans"},
+}
+
+var (
+	searchModes     = matcherModes()
+	matcherIndexers = catalogIndexers()
+)
+
+func matcherModes() []string {
+	modes := make([]string, len(matchers))
+	for i, m := range matchers {
+		modes[i] = m.mode
+	}
+	return modes
+}
+
+func catalogIndexers() []catalogIndexer {
+	var out []catalogIndexer
+	for _, m := range matchers {
+		if ix, ok := m.matcher.(catalogIndexer); ok {
+			out = append(out, ix)
+		}
+	}
+	return out
+}
+
+// lookupMatcher finds a registered mode's matcher
+func lookupMatcher(mode string) (searchMatcher, bool) {
+	for _, m := range matchers {
+		if m.mode == mode {
+			return m.matcher, true
+		}
+	}
+	return nil, false
+}
+
+// matcherFor is the matcher of a mode known to be registered
+func matcherFor(mode string) searchMatcher {
+	m, _ := lookupMatcher(mode)
+	return m
+}
+
+// modesDescription describes each mode for the spec, marking the default
+func modesDescription(def string) string {
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		name := m.mode
+		if m.mode == def {
+			name += " (default)"
+		}
+		parts[i] = name + " " + m.about
+	}
+	return strings.Join(parts, "; ")
+}
+
+// scanMatcher is exhaustive mode, checking every product, or every one
+// the filters allow. The other matchers check their candidates with it.
+type scanMatcher struct{}
+
+func (scanMatcher) candidates(s *Server, q matchQuery) ([]ProductID, string) {
+	if q.indexFiltered() {
+		return s.store.filterIDs(q.brand, q.category), modeExhaustive
+	}
+	return s.store.allIDs(), modeExhaustive
+}
+
+func (scanMatcher) match(ctx context.Context, s *Server, q matchQuery, candidates []ProductID) (*scanResult, matchStats, error) {
+	sr := s.scan(ctx, candidates, q.text, q.brand, q.category, q.page, q.traceMax)
+	return sr, matchStats{Checked: len(candidates), Matched: sr.matches}, nil
+}
+
+// sampleMatcher checks q.n products drawn by q.strategy
+type sampleMatcher struct{ scanMatcher }
+
+func (sampleMatcher) candidates(s *Server, q matchQuery) ([]ProductID, string) {
+	if q.filtered() {
+		return scanMatcher{}.candidates(s, q)
+	}
+	return s.store.sample(q.n, q.rnd, q.strategy), modeSample
+}
+
+// indexedMatcher narrows the check to trigram index candidates, which
+// may be false positives, and keeps the index as products change
+type indexedMatcher struct{ scanMatcher }
+
+func (indexedMatcher) candidates(s *Server, q matchQuery) ([]ProductID, string) {
+	ids, ok := s.store.trigramCandidates(q.text.q)
+	if !ok {
+		return scanMatcher{}.candidates(s, q)
+	}
+	if q.indexFiltered() {
+		ids = intersect(ids, s.store.filterIDs(q.brand, q.category))
+	}
+	return ids, modeIndexed
+}
+
+func (indexedMatcher) indexLocked(s *productStore, sp *storedProduct) {
+	s.trigramAddLocked(sp)
+}
+
+func (indexedMatcher) unindexLocked(s *productStore, sp *storedProduct) {
+	s.trigramRemoveLocked(sp)
+}
+
+// matcherCounters totals one mode's matches for /stats
+type matcherCounters struct {
+	searches int64
+	checked  int64
+	matched  int64
+	errors   int64
+}
+
+func newMatcherCounters() map[string]*matcherCounters {
+	m := make(map[string]*matcherCounters, len(matchers))
+	for _, e := range matchers {
+		m[e.mode] = &matcherCounters{}
+	}
+	return m
+}
+
+func (c *matcherCounters) record(st matchStats, err error) {
+	atomic.AddInt64(&c.searches, 1)
+	if err != nil {
+		atomic.AddInt64(&c.errors, 1)
+		return
+	}
+	atomic.AddInt64(&c.checked, int64(st.Checked))
+	atomic.AddInt64(&c.matched, int64(st.Matched))
+}
+
+func (s *Server) matcherStats() map[string]interface{} {
+	out := make(map[string]interface{}, len(s.matchCounts))
+	for mode, c := range s.matchCounts {
+		out[mode] = map[string]interface{}{
+			"searches": atomic.LoadInt64(&c.searches),
+			"checked":  atomic.LoadInt64(&c.checked),
+			"matched":  atomic.LoadInt64(&c.matched),
+			"errors":   atomic.LoadInt64(&c.errors),
+		}
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// matcherTestSearches is how many searches TestMatchersAgreeWithScan runs
+// through each mode
+const matcherTestSearches = 200
+
+func newIndexedTestServer(t *testing.T) *Server {
+	return newTestServer(t, func(cfg *Config) { cfg.TrigramBudget = 1 << 20 })
+}
+
+// TestMatchersAgreeWithScan runs the same searches, names of products
+// across the catalog, through every mode's matcher and holds each answer
+// to an exhaustive scan's: the same count, or for a sample only products
+// the scan matched too
+func TestMatchersAgreeWithScan(t *testing.T) {
+	s := newIndexedTestServer(t)
+	for _, m := range matchers {
+		mode := m.mode
+		t.Run(mode, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < matcherTestSearches; i++ {
+				p, ok := s.store.get(ProductID(1 + i*s.cfg.NumProducts/matcherTestSearches%s.cfg.NumProducts))
+				if !ok {
+					continue
+				}
+				q := matchQuery{text: newSearchText(parseQuery(p.Name), defaultLocale, false), n: s.cfg.ChecksPerSearch,
+					strategy: s.cfg.SampleStrategy, rnd: rnd, page: searchPage{limit: s.cfg.MaxResults}}
+				ids, answered := matcherFor(mode).candidates(s, q)
+				sr, _, err := matcherFor(answered).match(context.Background(), s, q, ids)
+				if err != nil {
+					t.Fatalf("%s for %q: %v", answered, p.Name, err)
+				}
+				all, _ := scanMatcher{}.candidates(s, q)
+				want, _, _ := scanMatcher{}.match(context.Background(), s, q, all)
+				got := make(map[ProductID]bool, len(want.results))
+				for _, w := range want.results {
+					got[w.ID] = true
+				}
+				switch {
+				case answered != modeSample && sr.matches != want.matches:
+					t.Errorf("%s matched %d for %q where a scan matched %d", answered, sr.matches, p.Name, want.matches)
+				case want.matches <= s.cfg.MaxResults:
+					for _, r := range sr.results {
+						if !got[r.ID] {
+							t.Errorf("%s returned product %d for %q, which a scan didn't match", answered, r.ID, p.Name)
+						}
+					}
+				}
+				sr.release()
+				want.release()
+			}
+		})
+	}
+}
+
+// TestSearchAfterDeletes deletes products from the front of the catalog,
+// each delete swapping the last product into the freed list position:
+// every mode must answer with live products only, found by their own ID,
+// and those that scan the catalog must still find the products that moved
+func TestSearchAfterDeletes(t *testing.T) {
+	s := newIndexedTestServer(t)
+	const deletes = 10
+	deleted := make(map[ProductID]bool, deletes)
+	for i := 0; i < deletes; i++ {
+		id := ProductID(i)
+		if _, err := s.store.delete(id); err != nil {
+			t.Fatal(err)
+		}
+		deleted[id] = true
+	}
+	s.store.listLock.RLock()
+	for pos, id := range s.store.list {
+		if s.store.pos[id] != pos || deleted[id] {
+			t.Errorf("list position %d holds product %d, recorded at %d", pos, id, s.store.pos[id])
+		}
+	}
+	s.store.listLock.RUnlock()
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, id := range s.store.sample(testProducts, rnd, sampleUniform) {
+		if deleted[id] {
+			t.Errorf("sampled deleted product %d", id)
+		}
+	}
+	moved := ProductID(testProducts - 1)
+	want, ok := s.store.get(moved)
+	if !ok {
+		t.Fatalf("product %d, swapped into position 0, is gone", moved)
+	}
+	for _, name := range []string{want.Name, generatedProduct(0).Name} {
+		for _, m := range matchers {
+			q := matchQuery{text: newSearchText(parseQuery(name), defaultLocale, false), n: testProducts,
+				strategy: sampleUniform, rnd: rnd, page: searchPage{limit: testProducts}}
+			ids, answered := m.matcher.candidates(s, q)
+			sr, _, err := matcherFor(answered).match(context.Background(), s, q, ids)
+			if err != nil {
+				t.Fatalf("%s for %q: %v", answered, name, err)
+			}
+			found := false
+			for _, p := range sr.results {
+				live, ok := s.store.get(p.ID)
+				if deleted[p.ID] || !ok || live.Name != p.Name {
+					t.Errorf("%s for %q returned product %d %q, not the live product by that ID", answered, name, p.ID, p.Name)
+				}
+				found = found || p.ID == moved
+			}
+			if name == want.Name && answered != modeSample && !found {
+				t.Errorf("%s for %q didn't find product %d after it moved", answered, name, moved)
+			}
+			sr.release()
+		}
+	}
+}
+
+// BenchmarkMatchers runs one search through the handler in every
+// registered mode, so a new row in matchers gets a benchmark of its own
+func BenchmarkMatchers(b *testing.B) {
+	h := newTestServer(b, func(cfg *Config) {
+		cfg.NumProducts = 10000
+		cfg.TrigramBudget = 1 << 26
+	}).Routes()
+	for _, m := range matchers {
+		target := "/v1/products/search?q=alpha+12&mode=" + m.mode
+		b.Run(m.mode, func(b *testing.B) {
+			if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != http.StatusOK {
+				b.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+			}
+		})
+	}
+}
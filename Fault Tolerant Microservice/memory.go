@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memoryRecoverFraction is how far under the soft limit heap in use must
+// fall before the governor restores the last thing it shed. The gap keeps
+// a restore from pushing the heap straight back over.
+const memoryRecoverFraction = 0.8
+
+// memoryCacheDivisor is how much the caches shrink while shed: they keep
+// a quarter of their configured size
+const memoryCacheDivisor = 4
+
+// memoryStep is one level of shedding and how to undo it
+type memoryStep struct {
+	name    string
+	shed    func()
+	restore func()
+}
+
+// memoryGovernor keeps heap in use under a soft limit by shedding
+// memory the service can do without, one step per sample while over the
+// limit, and restoring the steps in reverse order, again one per sample,
+// once comfortably under it. Like the watchdog it reads the real clock.
+type memoryGovernor struct {
+	limit    uint64
+	interval time.Duration
+	steps    []memoryStep
+	statsd   *statsdClient
+
+	mu       sync.Mutex
+	level    int
+	heap     uint64
+	samples  int64
+	sheds    int64
+	restores int64
+	changed  time.Time
+}
+
+func newMemoryGovernor(limit uint64, interval time.Duration, steps []memoryStep) (*memoryGovernor, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("memory governor: check interval must be positive")
+	}
+	return &memoryGovernor{limit: limit, interval: interval, steps: steps}, nil
+}
+
+// memorySteps lists what the governor may shed, cheapest to lose first:
+// the idempotency, snapshot, export and response caches shrink, then the trigram
+// index goes and indexed searches scan, then the change journal is cut
+// down. A step only appears when the thing it sheds is configured.
+func (s *Server) memorySteps() []memoryStep {
+	cfg := s.cfg
+	steps := []memoryStep{{
+		name: "caches",
+		shed: func() {
+			s.idem.resize(cfg.IdempotencyMaxBytes / memoryCacheDivisor)
+			if s.responses != nil {
+				s.responses.resize(cfg.ResponseCache / memoryCacheDivisor)
+			}
+			if cfg.SearchSnapshots > 0 {
+				s.snapshots.resize(max(1, cfg.SearchSnapshots/memoryCacheDivisor))
+			}
+			if cfg.ExportSnapshots > 0 {
+				s.exports.resize(max(1, cfg.ExportSnapshots/memoryCacheDivisor))
+			}
+		},
+		restore: func() {
+			s.idem.resize(cfg.IdempotencyMaxBytes)
+			if s.responses != nil {
+				s.responses.resize(cfg.ResponseCache)
+			}
+			s.snapshots.resize(cfg.SearchSnapshots)
+			s.exports.resize(cfg.ExportSnapshots)
+		},
+	}}
+	if cfg.TrigramBudget > 0 {
+		steps = append(steps, memoryStep{name: "trigram_index", shed: s.store.shedTrigrams, restore: s.store.restoreTrigrams})
+	}
+	if cfg.ChangeJournal > 0 {
+		steps = append(steps, memoryStep{
+			name:    "change_journal",
+			shed:    func() { s.store.events.resize(cfg.ChangeJournal / memoryCacheDivisor) },
+			restore: func() { s.store.events.resize(cfg.ChangeJournal) },
+		})
+	}
+	return steps
+}
+
+// run samples forever
+func (g *memoryGovernor) run() {
+	for {
+		time.Sleep(g.interval)
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		g.check(ms.HeapInuse)
+	}
+}
+
+// check takes one heap reading and sheds or restores at most one step.
+// Only run calls it, so steps never run concurrently; the lock is for
+// stats.
+func (g *memoryGovernor) check(heap uint64) {
+	g.mu.Lock()
+	g.samples++
+	g.heap = heap
+	level := g.level
+	g.mu.Unlock()
+
+	switch {
+	case heap > g.limit && level < len(g.steps):
+		step := g.steps[level]
+		step.shed()
+		g.moved(level+1, true)
+		log.Printf("Heap in use %dMB over the %dMB soft limit: shed %s (level %d)", heap>>20, g.limit>>20, step.name, level+1)
+		g.statsd.incr("memory.shed", "step:"+step.name)
+		// Collect now so the next reading shows what the step freed
+		runtime.GC()
+	case heap < uint64(float64(g.limit)*memoryRecoverFraction) && level > 0:
+		step := g.steps[level-1]
+		step.restore()
+		g.moved(level-1, false)
+		log.Printf("Heap in use %dMB back under the %dMB soft limit: restored %s (level %d)", heap>>20, g.limit>>20, step.name, level-1)
+		g.statsd.incr("memory.restore", "step:"+step.name)
+	}
+}
+
+func (g *memoryGovernor) moved(level int, shed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.level = level
+	g.changed = time.Now().UTC()
+	if shed {
+		g.sheds++
+	} else {
+		g.restores++
+	}
+}
+
+func (g *memoryGovernor) stats() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	shed := make([]string, 0, g.level)
+	for _, step := range g.steps[:g.level] {
+		shed = append(shed, step.name)
+	}
+	st := map[string]interface{}{
+		"enabled":          true,
+		"soft_limit_bytes": g.limit,
+		"heap_inuse_bytes": g.heap,
+		"level":            g.level,
+		"max_level":        len(g.steps),
+		"shed":             shed,
+		"samples":          g.samples,
+		"sheds":            g.sheds,
+		"restores":         g.restores,
+	}
+	if !g.changed.IsZero() {
+		st["changed"] = g.changed
+	}
+	return st
+}
+
+func (s *Server) memoryStats() map[string]interface{} {
+	if s.memory == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return s.memory.stats()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the route latency
+// histograms; Prometheus' defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// unmatchedRoute labels requests no route served
+const unmatchedRoute = "unmatched"
+
+// routeKey is a metric series: the route template, never the concrete
+// path, so /products/1 and /products/2 share one series, and the
+// X-Features flags turned on, so an experiment can be compared with the
+// requests without it
+type routeKey struct {
+	route    string
+	method   string
+	features string
+}
+
+type routeSeries struct {
+	inFlight int64
+	classes  map[string]int64
+	buckets  []int64
+	count    int64
+	sum      time.Duration
+	max      time.Duration
+}
+
+// routeMetrics counts requests by route template, method, feature flags
+// and status class, with a latency histogram and in-flight gauge per
+// route. The router reports the route it matched through setRequestRoute,
+// so the label set is bounded by the route table and the flag registry.
+type routeMetrics struct {
+	mu     sync.Mutex
+	series map[routeKey]*routeSeries
+}
+
+func newRouteMetrics() *routeMetrics {
+	return &routeMetrics{series: make(map[routeKey]*routeSeries)}
+}
+
+// metricMethod keeps the method label bounded: anything not in the route
+// table's vocabulary is "other"
+func metricMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return m
+	}
+	return "other"
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// get returns k's series; the caller holds mu
+func (m *routeMetrics) get(k routeKey) *routeSeries {
+	sr, ok := m.series[k]
+	if !ok {
+		sr = &routeSeries{classes: make(map[string]int64), buckets: make([]int64, len(latencyBuckets))}
+		m.series[k] = sr
+	}
+	return sr
+}
+
+// start counts a request in flight on route
+func (m *routeMetrics) start(route, method, features string) {
+	m.mu.Lock()
+	m.get(routeKey{route, metricMethod(method), features}).inFlight++
+	m.mu.Unlock()
+}
+
+// finish records a completed request. started says whether start was
+// called for it, which it wasn't for unmatched requests.
+func (m *routeMetrics) finish(route, method, features string, started bool, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sr := m.get(routeKey{route, metricMethod(method), features})
+	if started {
+		sr.inFlight--
+	}
+	sr.classes[statusClass(status)]++
+	sr.count++
+	sr.sum += elapsed
+	if elapsed > sr.max {
+		sr.max = elapsed
+	}
+	secs := elapsed.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			sr.buckets[i]++
+			break
+		}
+	}
+}
+
+// middleware times every request and records it against the route the
+// router matched. It sits inside accessLogMiddleware, which attaches the
+// requestInfo the route is reported through.
+func (m *routeMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r)
+		if info != nil {
+			info.metrics = m
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		route, started, features := unmatchedRoute, false, ""
+		if info != nil {
+			if info.Route != "" {
+				route, started = info.Route, true
+			}
+			features = info.Features.label()
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.finish(route, r.Method, features, started, status, time.Since(start))
+	})
+}
+
+// totals sums the requests served on path, in every API version, and
+// their latency
+func (m *routeMetrics) totals(path string) (count int64, sum time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range apiVersions {
+		for k, sr := range m.series {
+			if k.route == v.Prefix+path {
+				count += sr.count
+				sum += sr.sum
+			}
+		}
+	}
+	return count, sum
+}
+
+// sortedKeys returns the series keys by route, method then features; the
+// caller holds mu
+func (m *routeMetrics) sortedKeys() []routeKey {
+	keys := make([]routeKey, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].features < keys[j].features
+	})
+	return keys
+}
+
+// stats is the /stats view: one entry per route, method and feature set
+func (m *routeMetrics) stats() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]map[string]interface{}, 0, len(m.series))
+	for _, k := range m.sortedKeys() {
+		sr := m.series[k]
+		classes := make(map[string]int64, len(sr.classes))
+		for c, n := range sr.classes {
+			classes[c] = n
+		}
+		var mean float64
+		if sr.count > 0 {
+			mean = float64(sr.sum) / float64(sr.count) / float64(time.Millisecond)
+		}
+		entry := map[string]interface{}{
+			"route":     k.route,
+			"method":    k.method,
+			"requests":  classes,
+			"in_flight": sr.inFlight,
+			"mean_ms":   mean,
+			"max_ms":    float64(sr.max) / float64(time.Millisecond),
+		}
+		if k.features != "" {
+			entry["features"] = k.features
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// promLabel quotes a label value for the text exposition format
+func promLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+// writePrometheus writes the route metrics in the Prometheus text format
+func (m *routeMetrics) writePrometheus(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.sortedKeys()
+	labels := func(k routeKey) string {
+		return "route=" + promLabel(k.route) + ",method=" + promLabel(k.method) + ",features=" + promLabel(k.features)
+	}
+
+	b.WriteString("# HELP http_requests_total Requests served, by route template, method, feature flags and status class.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	for _, k := range keys {
+		sr := m.series[k]
+		classes := make([]string, 0, len(sr.classes))
+		for c := range sr.classes {
+			classes = append(classes, c)
+		}
+		sort.Strings(classes)
+		for _, c := range classes {
+			fmt.Fprintf(b, "http_requests_total{%s,class=%s} %d\n", labels(k), promLabel(c), sr.classes[c])
+		}
+	}
+
+	b.WriteString("# HELP http_requests_in_flight Requests being served, by route template, method and feature flags.\n")
+	b.WriteString("# TYPE http_requests_in_flight gauge\n")
+	for _, k := range keys {
+		if k.route != unmatchedRoute {
+			fmt.Fprintf(b, "http_requests_in_flight{%s} %d\n", labels(k), m.series[k].inFlight)
+		}
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds Request latency, by route template, method and feature flags.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		sr := m.series[k]
+		var cum int64
+		for i, le := range latencyBuckets {
+			cum += sr.buckets[i]
+			fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels(k), le, cum)
+		}
+		fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(k), sr.count)
+		fmt.Fprintf(b, "http_request_duration_seconds_sum{%s} %g\n", labels(k), sr.sum.Seconds())
+		fmt.Fprintf(b, "http_request_duration_seconds_count{%s} %d\n", labels(k), sr.count)
+	}
+}
+
+// metricsHandler serves GET /metrics for Prometheus to scrape
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	s.metrics.writePrometheus(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestInfo is filled in by inner layers for the access log
+type requestInfo struct {
+	RequestID string
+	KeyName   string
+	Route     string
+	// Streaming is set when the route holds its connection open
+	Streaming bool
+	// Backpressure is the X-Backpressure delay the response carries, in
+	// milliseconds
+	Backpressure int
+	// metrics, when set, is told the route as soon as it is matched, for
+	// its in-flight gauge
+	metrics *routeMetrics
+	// audit, on audited routes, is what the handler says it changed
+	audit *auditNote
+	// Features are the X-Features flags the request sent, nil for none
+	Features *requestFeatures
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// routeLabel writes a route template's {name} segments as :name, the
+// form metrics and logs label routes with: /products/{id} is
+// /products/:id
+var routeLabel = strings.NewReplacer("{", ":", "}", "").Replace
+
+// setRequestRoute notes which route template served the request, so
+// metrics can be tagged without an unbounded set of concrete paths
+func setRequestRoute(r *http.Request, rt route) {
+	if info := requestInfoFrom(r); info != nil {
+		info.Route = routeLabel(rt.Path)
+		info.Streaming = rt.Streaming
+		if info.metrics != nil {
+			info.metrics.start(info.Route, r.Method, info.Features.label())
+		}
+	}
+}
+
+// statusRecorder captures the response status while still allowing
+// WebSocket hijacking and streaming flushes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, for stream
+// write deadlines
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+// accessLogMiddleware logs one line per request when -access-log is set,
+// and emits the per route request count and latency to StatsD. It reads
+// the requestInfo requestIDMiddleware attached, attaching one itself if
+// it runs outside the stack.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r)
+		if info == nil {
+			info = &requestInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		}
+		if !s.cfg.AccessLog && s.statsd == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if s.statsd != nil {
+			route := info.Route
+			if route == "" {
+				route = "unmatched"
+			}
+			tags := []string{"method:" + r.Method, "route:" + route}
+			if f := info.Features.label(); f != "" {
+				tags = append(tags, "features:"+f)
+			}
+			s.statsd.incr("http.requests", append(tags, "status:"+strconv.Itoa(rec.status))...)
+			s.statsd.timing("http.latency", elapsed, tags...)
+		}
+		if !s.cfg.AccessLog {
+			return
+		}
+		key := info.KeyName
+		if key == "" {
+			key = "-"
+		}
+		log.Printf("%s %s %s %d %dB %s key=%s id=%s", r.RemoteAddr, r.Method, r.URL.RequestURI(),
+			rec.status, rec.bytes, elapsed.Round(time.Microsecond), key, info.RequestID)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRouteLabel(t *testing.T) {
+	for path, want := range map[string]string{
+		"/products/{id}":            "/products/:id",
+		"/v1/products/{id}/related": "/v1/products/:id/related",
+		"/products/search":          "/products/search",
+	} {
+		if got := routeLabel(path); got != want {
+			t.Errorf("routeLabel(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// TestRouteMetricsLabels checks concrete paths are counted under their
+// route template, never on their own
+func TestRouteMetricsLabels(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for _, target := range []string{"/products/7", "/products/8", "/products/9999", "/nowhere/1"} {
+		serve(h, http.MethodGet, target, "", nil)
+	}
+	body := serve(h, http.MethodGet, "/metrics", "", nil).Body.String()
+	for _, want := range []string{
+		`http_requests_total{route="/products/:id",method="GET",features="",class="2xx"} 2`,
+		`http_requests_total{route="/products/:id",method="GET",features="",class="4xx"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %s in\n%s", want, body)
+		}
+	}
+	for _, leaked := range []string{`route="/products/7"`, `route="/nowhere/1"`, `route="/products/id"`} {
+		if strings.Contains(body, leaked) {
+			t.Errorf("metrics have %s", leaked)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxMirrorBody is how much of a mirrored response is read before the
+	// rest is dropped with the connection
+	maxMirrorBody = 1 << 20
+	// maxMirrorMismatches is how many recent status disagreements
+	// /stats/mirror lists
+	maxMirrorMismatches = 20
+)
+
+// requestMirror copies a fraction of GET requests to a second instance,
+// say a canary before an upgrade, and records how its answers compare.
+// A copy is sent once the primary response is written, so it never
+// delays or changes it; each carries X-Mirrored: true and the primary's
+// request ID, but none of mirrorDropped, nor the client's credentials
+// unless credentials is set. At most cap(pool) are in flight, and a copy
+// there is no room for is dropped rather than queued. Only GETs are
+// copied, never admin, debug, streaming or already mirrored ones, so the
+// target sees no writes.
+type requestMirror struct {
+	target      string
+	percent     float64
+	timeout     time.Duration
+	credentials bool
+	client      *http.Client
+	pool        chan struct{}
+	seen        uint64
+
+	sent     int64
+	dropped  int64
+	failed   int64
+	timeouts int64
+	matched  int64
+	// classes counts the target's answers by status class, 1xx to 5xx
+	classes [5]int64
+
+	mirrorLatency  latencyTotals
+	primaryLatency latencyTotals
+
+	mu         sync.Mutex
+	mismatches []mirrorMismatch
+}
+
+// mirrorDropped are the headers a copy never carries: the hop-by-hop
+// ones, which describe the primary's connection rather than the request,
+// and X-Callback-URL, so a copy spilled to the queue doesn't call the
+// client back a second time
+var mirrorDropped = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "X-Callback-Url"}
+
+// mirrorCredentials are the headers that authenticate the client, which
+// a copy carries only when asked to
+var mirrorCredentials = []string{"Authorization", "X-Api-Key", "Cookie"}
+
+// mirrorJob is one request to copy, with what the primary answered
+type mirrorJob struct {
+	uri       string
+	header    http.Header
+	status    int
+	latency   time.Duration
+	requestID string
+}
+
+// mirrorMismatch is a copy the target answered with a different status
+type mirrorMismatch struct {
+	Path          string `json:"path"`
+	RequestID     string `json:"request_id"`
+	PrimaryStatus int    `json:"primary_status"`
+	// MirrorStatus is 0 when the target didn't answer
+	MirrorStatus int    `json:"mirror_status"`
+	Error        string `json:"error,omitempty"`
+	At           string `json:"at"`
+}
+
+// latencyTotals is a count, sum and maximum of durations in nanoseconds
+type latencyTotals struct {
+	n, sum, max int64
+}
+
+func (lt *latencyTotals) observe(d time.Duration) {
+	atomic.AddInt64(&lt.n, 1)
+	addSaturating(&lt.sum, int64(d))
+	for {
+		old := atomic.LoadInt64(&lt.max)
+		if int64(d) <= old || atomic.CompareAndSwapInt64(&lt.max, old, int64(d)) {
+			return
+		}
+	}
+}
+
+func (lt *latencyTotals) stats() map[string]interface{} {
+	out := map[string]interface{}{"mean_ms": nil, "max_ms": durationMS(time.Duration(atomic.LoadInt64(&lt.max)))}
+	if n := atomic.LoadInt64(&lt.n); n > 0 {
+		out["mean_ms"] = float64(atomic.LoadInt64(&lt.sum)) / float64(n) / float64(time.Millisecond)
+	}
+	return out
+}
+
+func newRequestMirror(target string, percent float64, workers int, timeout time.Duration, credentials bool) (*requestMirror, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("mirror: target must be an http or https URL without a query, got %q", target)
+	}
+	if percent <= 0 || percent > 100 || workers < 1 || timeout <= 0 {
+		return nil, fmt.Errorf("mirror: percent must be in (0, 100], workers at least 1 and the timeout positive")
+	}
+	return &requestMirror{
+		target:      strings.TrimSuffix(target, "/"),
+		percent:     percent,
+		timeout:     timeout,
+		credentials: credentials,
+		// Redirects are answers to compare, not to follow
+		client: &http.Client{Timeout: timeout, CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+		pool: make(chan struct{}, workers),
+	}, nil
+}
+
+// mirrored reports whether r is one of the requests copied at all, as
+// far as can be told before routing; streams are only known after
+func mirrored(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("X-Mirrored") != "" {
+		return false
+	}
+	path := r.URL.Path
+	for _, v := range apiVersions {
+		if v.Prefix != "" && strings.HasPrefix(path, v.Prefix+"/") {
+			path = strings.TrimPrefix(path, v.Prefix)
+			break
+		}
+	}
+	return !isAdminPath(path)
+}
+
+// pick reports whether this request is copied. Picks are spread evenly,
+// as shadow searches' are.
+func (m *requestMirror) pick() bool {
+	n := atomic.AddUint64(&m.seen, 1)
+	p := m.percent / 100
+	return math.Floor(float64(n)*p) > math.Floor(float64(n-1)*p)
+}
+
+// header is what a copy of a request with h carries
+func (m *requestMirror) header(h http.Header) http.Header {
+	out := h.Clone()
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			out.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range mirrorDropped {
+		out.Del(name)
+	}
+	if !m.credentials {
+		for _, name := range mirrorCredentials {
+			out.Del(name)
+		}
+	}
+	return out
+}
+
+// middleware sends picked requests on once answered. A route marked
+// Streaming, known once the router has matched it, is never picked: its
+// copy would hold a worker until the timeout.
+func (m *requestMirror) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !mirrored(r) {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if info := requestInfoFrom(r); (info != nil && info.Streaming) || !m.pick() {
+			return
+		}
+		header := m.header(r.Header)
+		job := mirrorJob{uri: r.URL.RequestURI(), header: header, status: rec.status, latency: time.Since(start), requestID: requestID(r)}
+		if job.status == 0 {
+			job.status = http.StatusOK
+		}
+		select {
+		case m.pool <- struct{}{}:
+		default:
+			atomic.AddInt64(&m.dropped, 1)
+			return
+		}
+		go func() {
+			defer func() { <-m.pool }()
+			m.send(job)
+		}()
+	}
+}
+
+func (m *requestMirror) send(job mirrorJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.target+job.uri, nil)
+	if err != nil {
+		m.record(job, 0, err)
+		return
+	}
+	req.Header = job.header
+	req.Header.Set("X-Mirrored", "true")
+	if job.requestID != "" {
+		req.Header.Set("X-Request-Id", job.requestID)
+	}
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		m.record(job, 0, err)
+		return
+	}
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxMirrorBody))
+	resp.Body.Close()
+	if err != nil {
+		m.record(job, 0, err)
+		return
+	}
+	m.mirrorLatency.observe(time.Since(start))
+	m.record(job, resp.StatusCode, nil)
+}
+
+// record counts one copy's outcome against its primary
+func (m *requestMirror) record(job mirrorJob, status int, err error) {
+	atomic.AddInt64(&m.sent, 1)
+	m.primaryLatency.observe(job.latency)
+	switch {
+	case err != nil && (errors.Is(err, context.DeadlineExceeded) || isTimeout(err)):
+		atomic.AddInt64(&m.timeouts, 1)
+	case err != nil:
+		atomic.AddInt64(&m.failed, 1)
+	default:
+		if c := status/100 - 1; c >= 0 && c < len(m.classes) {
+			atomic.AddInt64(&m.classes[c], 1)
+		}
+		if status == job.status {
+			atomic.AddInt64(&m.matched, 1)
+			return
+		}
+	}
+	mm := mirrorMismatch{Path: job.uri, RequestID: job.requestID, PrimaryStatus: job.status, MirrorStatus: status, At: time.Now().UTC().Format(time.RFC3339)}
+	if err != nil {
+		mm.Error = err.Error()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.mismatches) == maxMirrorMismatches {
+		m.mismatches = append(m.mismatches[:0], m.mismatches[1:]...)
+	}
+	m.mismatches = append(m.mismatches, mm)
+}
+
+// isTimeout reports a client timeout, which net/http doesn't always wrap
+// as the context's
+func isTimeout(err error) bool {
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
+}
+
+func (s *Server) mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	m := s.mirror
+	if m == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	classes := make(map[string]int64, len(m.classes))
+	for i := range m.classes {
+		classes[fmt.Sprintf("%dxx", i+1)] = atomic.LoadInt64(&m.classes[i])
+	}
+	m.mu.Lock()
+	mismatches := append([]mirrorMismatch{}, m.mismatches...)
+	m.mu.Unlock()
+	for i, j := 0, len(mismatches)-1; i < j; i, j = i+1, j-1 {
+		mismatches[i], mismatches[j] = mismatches[j], mismatches[i]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":           true,
+		"target":            m.target,
+		"percent":           m.percent,
+		"workers":           cap(m.pool),
+		"busy":              len(m.pool),
+		"timeout_ms":        durationMS(m.timeout),
+		"credentials":       m.credentials,
+		"sent":              atomic.LoadInt64(&m.sent),
+		"dropped":           atomic.LoadInt64(&m.dropped),
+		"failed":            atomic.LoadInt64(&m.failed),
+		"timeouts":          atomic.LoadInt64(&m.timeouts),
+		"status":            classes,
+		"status_matched":    atomic.LoadInt64(&m.matched),
+		"mirror_latency":    m.mirrorLatency.stats(),
+		"primary_latency":   m.primaryLatency.stats(),
+		"recent_mismatches": mismatches,
+	})
+}
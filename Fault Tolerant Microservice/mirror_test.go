@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// roundTripFunc answers an http.Client's requests itself
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TestMirror mirrors through one worker to a target answered in memory: a
+// GET must arrive there marked X-Mirrored with its query and request ID
+// and without the client's credentials or hop-by-hop headers, writes,
+// admin reads, streams and mirrored requests must not, a copy arriving
+// while the worker is busy must be dropped without holding up its
+// primary, and a target slower than the timeout must count as a timeout
+func TestMirror(t *testing.T) {
+	type arrival struct {
+		uri, mirrored, id string
+		header            http.Header
+	}
+	arrived := make(chan arrival, 8)
+	release := make(chan struct{})
+	defer close(release)
+	m, err := newRequestMirror("http://canary.test", 100, 1, 200*time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		arrived <- arrival{r.URL.RequestURI(), r.Header.Get("X-Mirrored"), r.Header.Get("X-Request-Id"), r.Header}
+		if r.URL.Query().Get("hold") != "" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+		}
+		return &http.Response{StatusCode: http.StatusTeapot, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	})
+	// The streaming routes say so as the router would, as plain GETs with
+	// nothing in their headers to tell
+	streams := map[string]bool{"/v1/products/events": true, "/v1/circuit/wait": true}
+	handler := requestIDMiddleware(m.middleware(func(w http.ResponseWriter, r *http.Request) {
+		if streams[r.URL.Path] {
+			setRequestRoute(r, route{Path: strings.TrimPrefix(r.URL.Path, "/v1"), Streaming: true})
+		}
+		w.Write([]byte("primary"))
+	}))
+	send := func(method, path string, header http.Header) {
+		t.Helper()
+		rec := serve(handler, method, path, "", header)
+		if rec.Code != http.StatusOK || rec.Body.String() != "primary" {
+			t.Fatalf("%s %s: the primary answered %d %q", method, path, rec.Code, rec.Body)
+		}
+	}
+	waitIdle := func() {
+		for i := 0; i < 200 && len(m.pool) != 0; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	client := http.Header{
+		"X-Request-Id": {"mirror-check"}, "Accept-Language": {"de"},
+		"Authorization": {"Bearer secret"}, "X-Api-Key": {"secret"}, "Cookie": {"session=secret"},
+		"Connection": {"X-Hop"}, "X-Hop": {"1"}, "Keep-Alive": {"timeout=5"}, "X-Callback-Url": {"http://callback/"},
+	}
+	send(http.MethodGet, "/v1/products/search?q=caf%C3%A9", client)
+	select {
+	case a := <-arrived:
+		if a.uri != "/v1/products/search?q=caf%C3%A9" || a.mirrored != "true" || a.id != "mirror-check" {
+			t.Errorf("the target got %s with X-Mirrored %q and request ID %q", a.uri, a.mirrored, a.id)
+		}
+		if a.header.Get("Accept-Language") != "de" {
+			t.Errorf("the copy lost the client's Accept-Language")
+		}
+		for _, name := range []string{"Authorization", "X-Api-Key", "Cookie", "X-Hop", "Keep-Alive", "X-Callback-Url"} {
+			if v := a.header.Get(name); v != "" {
+				t.Errorf("the copy carried %s: %s", name, v)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a GET wasn't mirrored")
+	}
+	waitIdle()
+	for _, c := range []struct {
+		method, path string
+		header       http.Header
+	}{
+		{http.MethodPost, "/v1/products", nil},
+		{http.MethodDelete, "/v1/products/1", nil},
+		{http.MethodGet, "/v1/admin/chaos", nil},
+		{http.MethodGet, "/debug/pprof/", nil},
+		{http.MethodGet, "/v1/products/1", http.Header{"X-Mirrored": {"true"}}},
+		{http.MethodGet, "/v1/products/events", nil},
+		{http.MethodGet, "/v1/circuit/wait?state=open", nil},
+	} {
+		send(c.method, c.path, c.header)
+	}
+	waitIdle()
+	if len(arrived) != 0 {
+		t.Fatalf("the target got %s, which isn't mirrored", (<-arrived).uri)
+	}
+
+	send(http.MethodGet, "/v1/products/1?hold=1", nil)
+	<-arrived
+	began := time.Now()
+	send(http.MethodGet, "/v1/products/2", nil)
+	if took := time.Since(began); took > 100*time.Millisecond || atomic.LoadInt64(&m.dropped) != 1 {
+		t.Errorf("with the worker busy the primary took %v and %d copies were dropped", took, atomic.LoadInt64(&m.dropped))
+	}
+	waitIdle()
+	if atomic.LoadInt64(&m.timeouts) != 1 || atomic.LoadInt64(&m.sent) != 2 || atomic.LoadInt64(&m.classes[3]) != 1 {
+		t.Errorf("sent %d, timeouts %d, 4xx %d, want 2, 1 and 1", atomic.LoadInt64(&m.sent), atomic.LoadInt64(&m.timeouts), atomic.LoadInt64(&m.classes[3]))
+	}
+	m.mu.Lock()
+	mismatches := append([]mirrorMismatch(nil), m.mismatches...)
+	m.mu.Unlock()
+	if len(mismatches) != 2 || mismatches[0].MirrorStatus != http.StatusTeapot || mismatches[1].MirrorStatus != 0 {
+		t.Errorf("mismatches %+v, want a 418 and a timeout", mismatches)
+	}
+	if h := (&requestMirror{credentials: true}).header(client); h.Get("Authorization") == "" || h.Get("Cookie") == "" || h.Get("X-Hop") != "" {
+		t.Errorf("with credentials the copy carries %v", h)
+	}
+}
+
+func TestMirrorTargetValidation(t *testing.T) {
+	for _, bad := range []string{"ftp://canary", "http://canary/?x=1", "canary:8080"} {
+		if _, err := newRequestMirror(bad, 10, 1, time.Second, false); err == nil {
+			t.Errorf("mirror target %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"productsearch/resilience"
+)
+
+type object = map[string]interface{}
+
+var breakerStates = []string{"closed", "open", "half_open"}
+
+// valueCountsSchema lists brands or categories, lowercased as indexed,
+// with their product counts
+var valueCountsSchema = object{
+	"type":        "array",
+	"description": "values as the catalog spells them, most products first, at most " + strconv.Itoa(catalogStatsTop) + "; indexes gives the distinct count",
+	"items": object{"type": "object", "properties": object{
+		"value": object{"type": "string"},
+		"count": object{"type": "integer"},
+	}},
+}
+
+// shardSchema is which shard answered, on searches and /health
+var shardSchema = object{
+	"type":        "object",
+	"description": "set when sharded with -shard-count: this shard's index, the shard count and the products this shard holds",
+	"properties": object{
+		"index":    object{"type": "integer"},
+		"count":    object{"type": "integer"},
+		"products": object{"type": "integer"},
+	},
+}
+
+// persistenceSchema is the disk space check, on /readyz and /health
+var persistenceSchema = object{
+	"type":        "object",
+	"description": "free space where state and watchdog captures are written; degraded pauses watchdog captures but not traffic",
+	"properties": object{
+		"enabled":          object{"type": "boolean"},
+		"path":             object{"type": "string"},
+		"degraded":         object{"type": "boolean"},
+		"free_bytes":       object{"type": "integer"},
+		"total_bytes":      object{"type": "integer"},
+		"free_percent":     object{"type": "number"},
+		"min_free_bytes":   object{"type": "integer"},
+		"min_free_percent": object{"type": "number"},
+		"error":            object{"type": "string", "description": "why the filesystem couldn't be checked, which also counts as degraded"},
+		"checked_at":       object{"type": "string", "format": "date-time"},
+		"paused_writes":    object{"type": "integer", "description": "automatic writes skipped while degraded"},
+	},
+}
+
+// apiSchemas are the response bodies referenced by apiResponse.Schema
+var apiSchemas = map[string]object{
+	"Product": {
+		"type": "object",
+		"properties": object{
+			"id":          object{"type": "integer"},
+			"name":        object{"type": "string"},
+			"category":    object{"type": "string"},
+			"description": object{"type": "string"},
+			"brand":       object{"type": "string"},
+			"price":       object{"type": "integer", "description": "in cents, from 0 to 1000000000; left out when the product has none"},
+			"names": object{"type": "object", "description": "name in other languages, by language; responses put the requested language's in name",
+				"additionalProperties": object{"type": "string"}},
+			"stock": object{"type": "integer", "description": "search results only: units in stock, when -inventory is set and the inventory dependency answered"},
+			"matches": object{"type": "array", "description": "search results with positions=true only: each occurrence of the query in a returned field, as a byte offset and length into that field's text",
+				"items": object{"type": "object", "properties": object{
+					"field":  object{"type": "string", "enum": []string{"name", "category"}},
+					"offset": object{"type": "integer"},
+					"length": object{"type": "integer"},
+				}}},
+		},
+	},
+	"ProductList": {
+		"type": "object",
+		"properties": object{
+			"products": object{"type": "array", "items": object{"$ref": "#/components/schemas/Product"}},
+			"total":    object{"type": "integer", "description": "products in the catalog"},
+			"offset":   object{"type": "integer"},
+			"limit":    object{"type": "integer"},
+		},
+	},
+	"Envelope": {
+		"type":        "object",
+		"description": "v1 search, list and related responses, unless the server runs with -v1-envelope=false; Link headers carry the same next and prev",
+		"properties": object{
+			"data": object{"type": "array", "items": object{"$ref": "#/components/schemas/Product"}},
+			"meta": object{"type": "object", "properties": object{
+				"total":           object{"type": "integer", "description": "matching products, or for a sampled search the estimate"},
+				"estimated":       object{"type": "boolean", "description": "whether total is extrapolated from a sample"},
+				"limit":           object{"type": "integer"},
+				"offset":          object{"type": "integer"},
+				"elapsed_ms":      object{"type": "number"},
+				"search":          object{"$ref": "#/components/schemas/QueryResult", "description": "searches only: the remaining QueryResult fields, without products and search_time_ms"},
+				"backpressure_ms": object{"type": "integer", "description": "the X-Backpressure delay clients should wait before their next request; absent while the service isn't busy, and on responses the response cache stores"},
+				"features":        object{"type": "array", "items": object{"type": "string"}, "description": "the X-Features flags the request turned on"},
+				"warnings":        featureWarningsSchema,
+			}},
+			"links": object{"type": "object", "properties": object{
+				"next": object{"type": "string", "description": "relative URL of the next page, absent on the last; sampled searches pin the seed, snapshots their snapshot_id"},
+				"prev": object{"type": "string", "description": "relative URL of the previous page, absent on the first"},
+			}},
+		},
+	},
+	"QueryResult": {
+		"type": "object",
+		"properties": object{
+			"products":        object{"type": "array", "items": object{"$ref": "#/components/schemas/Product"}},
+			"total_found":     object{"type": "integer", "description": "matches within the checked products; exact unless sampling"},
+			"search_time":     object{"type": "string", "example": "0.0012s", "description": "legacy routes only; v1 sends search_time_ms"},
+			"search_time_ms":  object{"type": "number", "example": 1.2, "description": "v1 only: search duration in milliseconds"},
+			"checked_request": object{"type": "integer", "description": "debug only: products checked by this request"},
+			"total_checked":   object{"type": "integer", "description": "debug only: products checked since startup"},
+			"seed":            object{"type": "integer", "description": "debug only: seed of this request's sampling and chaos; pass it back as seed to repeat them"},
+			"mode":            object{"type": "string", "enum": searchModes, "description": "debug only: search mode used after any fallback"},
+			"sampled":         object{"type": "boolean", "description": "v1 only: true when total_found counts matches in a random sample rather than the catalog"},
+			"estimated_total": object{"type": "integer", "description": "v1 sampled searches only: total_found extrapolated to the whole catalog"},
+			"estimate_interval": object{"type": "object", "description": "v1 sampled searches only: Wilson score interval for estimated_total", "properties": object{
+				"low":        object{"type": "integer"},
+				"high":       object{"type": "integer"},
+				"confidence": object{"type": "number", "example": 0.95},
+			}},
+			"sample_matches":    object{"type": "integer", "description": "debug only, v1 sampled searches: raw matches within the sample"},
+			"sample_strategy":   object{"type": "string", "description": "debug only, sampled searches: how the sample was drawn", "enum": sampleStrategies},
+			"checks_per_search": object{"type": "integer", "description": "debug only, sampled searches with -checks-tune-target: the tuned sample size in force"},
+			"timings_ms": object{"type": "object", "description": "debug only, v1: per-phase durations in milliseconds; the Server-Timing header adds encode", "properties": object{
+				"admission": object{"type": "number", "description": "breaker, bulkhead and overload checks"},
+				"scan":      object{"type": "number"},
+				"chaos":     object{"type": "number", "description": "failure injection decision"},
+				"inventory": object{"type": "number", "description": "stock lookup, including retries; 0 without -inventory"},
+			}},
+			"snapshot": object{"type": "object", "description": "set on pages of a pinned snapshot: its id to pass as snapshot_id, the catalog generation (X-Catalog-Seq) it was taken at, and when it expires", "properties": object{
+				"id":         object{"type": "string"},
+				"generation": object{"type": "integer"},
+				"expires":    object{"type": "string", "format": "date-time"},
+			}},
+			"suggestions": object{"type": "array", "items": object{"type": "string"}, "description": "up to three corrected queries when nothing matched, using catalog words within edit distance 2; not computed under brownout"},
+			"shard":       shardSchema,
+			"warnings": object{"type": "array", "description": "how a 200 fell short: chaos_partial when, under -chaos-partial, a simulated failure kept the results matching had found, perhaps fewer of them, also sent as X-Partial-Results; feature_ignored for each X-Features flag unknown or not allowed, which an envelope gives in its meta instead", "items": object{"type": "object", "properties": object{
+				"code":    object{"type": "string", "enum": []string{warnChaosPartial, codeFeatureIgnored}},
+				"message": object{"type": "string"},
+			}}},
+			"features": object{"type": "array", "items": object{"type": "string"}, "description": "the X-Features flags the search turned on, which an envelope gives in its meta instead"},
+			"chaos": object{"type": "object", "description": "debug only, when chaos failed the search partially", "properties": object{
+				"mode":      object{"type": "string", "enum": []string{"partial"}},
+				"found":     object{"type": "integer", "description": "results matching produced for the page"},
+				"returned":  object{"type": "integer"},
+				"truncated": object{"type": "boolean"},
+				"breaker":   object{"type": "boolean", "description": "whether it counted as a breaker failure"},
+			}},
+			"hedge": object{"type": "object", "description": "debug only, sampled searches with -hedge-percentile: the hedge delay, whether a second scan started and which scan answered", "properties": object{
+				"delay_ms": object{"type": "number"},
+				"started":  object{"type": "boolean"},
+				"winner":   object{"type": "string", "enum": []string{"primary", "hedge"}},
+			}},
+			"cost": object{"type": "object", "description": "debug only: the search's estimated work in product checks, absent on snapshot pages", "properties": object{
+				"estimate":  object{"type": "integer", "description": "the whole search as asked for"},
+				"checks":    object{"type": "integer", "description": "candidates checked, cut to the work budget when truncated"},
+				"extras":    object{"type": "integer", "description": "tracing, snapshot pinning, stock and a hedge's second sample, at their worst case"},
+				"budget":    object{"type": "integer", "description": "-search-work-budget, absent when unlimited"},
+				"truncated": object{"type": "boolean"},
+				"charged":   object{"type": "integer", "description": "what the search held of -search-cost-budget, absent when that is off"},
+			}},
+			"trace": object{"type": "object", "description": "debug only, unless -debug-trace-max is 0: the candidates checked, in order, up to that many, with why each failed to match", "properties": object{
+				"seed":    object{"type": "integer"},
+				"checked": object{"type": "integer", "description": "candidates checked, traced or not"},
+				"omitted": object{"type": "integer", "description": "candidates checked beyond the trace cap"},
+				"candidates": object{"type": "array", "items": object{"type": "object", "properties": object{
+					"id":      object{"type": "integer"},
+					"matched": object{"type": "boolean"},
+					"reason":  object{"type": "string", "enum": []string{traceDeleted, traceFilteredBrand, traceFilteredCategory, traceFilteredPrice, traceFilteredStock, traceScopeMismatch, traceNoTextMatch}},
+				}}},
+			}},
+			"degraded": object{"type": "object", "description": "set when brownout or the work budget reduced the work done or stock couldn't be fetched for some categories; also sent as X-Degraded", "properties": object{
+				"level":             object{"type": "integer"},
+				"checks_per_search": object{"type": "integer", "description": "reduced sample size"},
+				"scan_limit":        object{"type": "integer", "description": "cap on products checked by non-sampling searches"},
+				"skipped":           object{"type": "array", "items": object{"type": "string", "enum": []string{"sample", "scan", "budget", "stock"}}},
+				"stock_skipped":     object{"type": "array", "items": object{"type": "string", "enum": inventoryCategories}, "description": "with stock skipped: the categories whose inventory call failed or whose breaker is open; the others' results have stock"},
+			}},
+		},
+	},
+	"ImportResult": {
+		"type": "object",
+		"properties": object{
+			"imported": object{"type": "integer"},
+			"created":  object{"type": "integer"},
+			"updated":  object{"type": "integer"},
+		},
+	},
+	"Stats": {
+		"type":        "object",
+		"description": "the counters count from startup and are never reset, stopping at the int64 maximum rather than wrapping; windows has the search outcomes over recent seconds",
+		"properties": object{
+			"requests":  object{"type": "integer"},
+			"successes": object{"type": "integer"},
+			"failures":  object{"type": "integer"},
+			"rejected": object{"type": "object", "properties": object{
+				"circuit_open": object{"type": "integer"},
+				"bulkhead":     object{"type": "integer"},
+				"overload":     object{"type": "integer"},
+				"rate_limited": object{"type": "integer"},
+			}},
+			"in_flight":          object{"type": "integer"},
+			"bulkhead_used":      object{"type": "integer"},
+			"bulkhead_size":      object{"type": "integer"},
+			"bulkhead_queue":     object{"type": "object", "description": "searches waiting for a bulkhead slot: enabled, order, capacity, timeout_ms, waiting, queued, timed_out, abandoned (the caller went away while queued), max_wait_ms"},
+			"client_cancelled":   object{"type": "integer", "description": "searches abandoned because the client disconnected, counted as neither success nor failure"},
+			"partial_failures":   object{"type": "integer", "description": "chaos failures answered with partial results under -chaos-partial; they count as successes too"},
+			"total_checked":      object{"type": "integer"},
+			"oversized_requests": object{"type": "integer", "description": "write requests refused with 413"},
+			"products":           object{"type": "integer"},
+			"circuit":            object{"type": "string", "enum": breakerStates},
+			"webhooks":           object{"type": "array", "items": object{"type": "object"}},
+			"recorder":           object{"type": "object", "description": "traffic recorder: enabled, sample, written, dropped, bytes, max_bytes"},
+			"trigram_index":      object{"type": "object", "description": "trigram index: enabled, over_budget, shed by the memory governor, trigrams, postings, estimated bytes, budget_bytes"},
+			"index_file":         object{"type": "object", "description": "persisted vocabulary and trigram index: enabled, path, state (loading, loaded, rebuilding or rebuilt), catalog_hash prefix, rebuild_reason, load_ms or rebuild_ms"},
+			"wal":                object{"type": "object", "description": "write-ahead log of product mutations: enabled, path, sync_interval_ms (0 fsyncs every write), bytes, prev_bytes awaiting a catalog snapshot, seq, durable_seq, records appended, fsyncs with fsync_mean_ms and fsync_max_ms, replayed on start, corrupt_bytes truncated on start, rotations, and failed once it refuses writes"},
+			"catalog_snapshot":   object{"type": "object", "description": "catalog snapshots: enabled, path, interval_s (0 only on shutdown), saved, failed and, once one is saved, last_seq, last_saved and last_ms"},
+			"brownout":           object{"type": "object", "description": "brownout: enabled, thresholds, current level, and searches degraded per level"},
+			"audit":              object{"type": "object", "description": "the audit log: file (empty when only kept in memory), recorded, dropped when the write buffer was full, pending, written, failed writes and rotated files"},
+			"rate_limit_store":   object{"type": "object", "description": "where rate limit buckets are kept, store memory or redis; for redis also addr, prefix, timeout_ms, calls, errors, last_error, idle_conns, circuit and local_fallbacks, the calls limited on this instance's own buckets while Redis failed"},
+			"search_cost":        object{"type": "object", "description": "search cost, in product checks: work_budget per search (0 unlimited) and searches truncated to it, concurrent_limit over searches in flight (0 unlimited), in_use, admitted, rejected, estimated_total and highest_estimate"},
+			"backpressure":       object{"type": "object", "description": "X-Backpressure: enabled, threshold, max_delay_ms, the delay_ms now suggested, and the utilization, queued searches and smoothed search latency_ms it came from, refreshed every 250ms; signalled counts responses that carried it"},
+			"admin_allowlist":    object{"type": "object", "description": "admin IP allowlist: enabled, entries, denied"},
+			"idempotency":        object{"type": "object", "description": "stored Idempotency-Key responses: entries, bytes, max_bytes, replays, conflicts, evictions"},
+			"hedging":            object{"type": "object", "description": "hedged scans: enabled, percentile, current delay_ms, budget, in_flight, started, won, exhausted budget"},
+			"operations":         object{"type": "object", "description": "admin operations: ttl_s, kept, the types running, and started, conflicts (refused while one of the type ran), done, failed and cancelled"},
+			"cardinality":        object{"type": "object", "description": "aggregations keyed by user input, zero_results, popular (the cache warmup's counts) and tenants: max_keys, max_key_bytes and overflow, the new keys there was no room for; the query trackers add enabled, tracked and total"},
+			"features":           object{"type": "object", "description": "X-Features flags: those allowed, the requests turning on each, and flags ignored as unknown or not allowed"},
+			"shards":             object{"type": "object", "description": "enabled, local_shards and, on one shard of several, its index, count, foreign handling, products held, and requests rejected and proxied for other shards' products"},
+			"matchers":           object{"type": "object", "description": "per search mode that answered, after any fallback: searches, products checked, matched, and errors"},
+			"checks_tuner":       object{"type": "object", "description": "sample size tuning: enabled, target_ms, min, max, the checks_per_search in force, p95_ms of the last window, searches in the current window, and decisions raised, lowered and held"},
+			"events":             object{"type": "object", "description": "catalog mutation hub: published, logged and log_size, and per subscriber kind (sse, watch, webhook) subscribers, delivered, dropped and disconnected"},
+			"circuit_waits":      object{"type": "object", "description": "GET /circuit/wait: parked waiters, transitions published, hub subscribers including the webhook forwarder, and transitions dropped for subscribers that fell behind"},
+			"coalescing":         object{"type": "object", "description": "identical concurrent searches sharing one execution: enabled, in_flight, leaders, coalesced, abandoned waits"},
+			"response_cache":     object{"type": "object", "description": "cached search responses: enabled, entries, capacity, hits, misses, evictions, invalidated, bloom_skips, raced fills, and the same per shard with bloom_fill"},
+			"snapshots":          object{"type": "object", "description": "pinned search snapshots: enabled, entries, max_entries, ttl_s, products held, max_products per snapshot, created, served, gone, evicted, refused"},
+			"export_snapshots":   object{"type": "object", "description": "pinned catalog exports, reported like snapshots"},
+			"streams":            object{"type": "object", "description": "CSV, NDJSON and export streams: write_timeout_ms, max_duration_ms, started, completed, aborted for slow_consumers, and max_duration_cuts"},
+			"signing":            object{"type": "object", "description": "response signing: enabled, key_ids, responses signed in a header, in_trailer and unsigned (streamed with a Content-Length), and key file reloads"},
+			"spill":              object{"type": "object", "description": "spill-over queue: enabled, depth (waiting to run), open (accepted, not finished), capacity, max_age_ms, result_ttl_ms, results kept, accepted, full (shed anyway), completed, expired, callbacks_sent, callbacks_dropped, callback_hosts, workers"},
+			"tenants":            object{"type": "object", "description": "on the instance's own /stats: enabled, auto_provision, max, refused (unknown or over the limit), and per tenant ready, auto_provisioned, products, requests, rejected, in_flight, bulkhead_size, circuit; a tenant's /stats covers that tenant alone"},
+			"rejection_status":   object{"type": "object", "description": "the status sent for each rejection reason, the defaults with any -rejection-status overrides", "additionalProperties": object{"type": "integer"}},
+			"memory":             object{"type": "object", "description": "memory governor: enabled, soft_limit_bytes, heap_inuse_bytes, level, max_level, the steps currently shed, samples, sheds, restores"},
+			"inventory":          object{"type": "object", "description": "inventory dependency: enabled, error_rate, calls, retries, failures, timeouts, rejected by a category's breaker, degraded searches, and circuits, each category's breaker state"},
+			"chaos_rate":         object{"type": "number"},
+			"routes": object{"type": "array", "description": "per route template and method, as on /metrics", "items": object{"type": "object", "properties": object{
+				"route":     object{"type": "string", "description": "the route template with parameters as :name, e.g. /v1/products/:id, or unmatched"},
+				"method":    object{"type": "string"},
+				"requests":  object{"type": "object", "description": "count per status class, e.g. 2xx", "additionalProperties": object{"type": "integer"}},
+				"in_flight": object{"type": "integer"},
+				"mean_ms":   object{"type": "number"},
+				"max_ms":    object{"type": "number"},
+			}}},
+			"windows": object{"$ref": "#/components/schemas/StatsWindows"},
+		},
+	},
+	"StatsWindows": {
+		"type":        "object",
+		"description": "search outcomes over the last 10s, 1m and 5m in per second buckets on the server clock; POST /stats/reset empties them, and a window never reaches back past since",
+		"properties": object{
+			"since":    object{"type": "string", "format": "date-time", "description": "startup or the last reset"},
+			"resets":   object{"type": "integer"},
+			"bucket_s": object{"type": "integer"},
+			"10s":      object{"$ref": "#/components/schemas/StatsWindow"},
+			"1m":       object{"$ref": "#/components/schemas/StatsWindow"},
+			"5m":       object{"$ref": "#/components/schemas/StatsWindow"},
+		},
+	},
+	"StatsWindow": {
+		"type": "object",
+		"properties": object{
+			"seconds":           object{"type": "integer", "description": "seconds covered, fewer than the window's until that long since startup or a reset"},
+			"requests":          object{"type": "integer"},
+			"successes":         object{"type": "integer"},
+			"failures":          object{"type": "integer"},
+			"rejected":          object{"type": "integer", "description": "by the breaker, the bulkhead or overload"},
+			"cancelled":         object{"type": "integer"},
+			"checked":           object{"type": "integer"},
+			"requests_per_s":    object{"type": "number"},
+			"success_ratio":     object{"type": "number", "nullable": true, "description": "successes over successes and failures, null without either"},
+			"mean_latency_ms":   object{"type": "number", "nullable": true, "description": "of successful searches, null without any"},
+			"checks_per_search": object{"type": "number", "nullable": true},
+		},
+	},
+	"CircuitTransition": {
+		"type": "object",
+		"properties": object{
+			"seq":                   object{"type": "integer", "description": "pass back as since on the next wait"},
+			"from":                  object{"type": "string", "enum": breakerStates},
+			"to":                    object{"type": "string", "enum": breakerStates},
+			"reason":                object{"type": "string", "description": "why it opened: failures, latency or forced"},
+			"failures":              object{"type": "integer"},
+			"forced":                object{"type": "boolean"},
+			"latency_percentile_ms": object{"type": "number"},
+			"at":                    object{"type": "string", "format": "date-time"},
+		},
+	},
+	"Circuit": {
+		"type": "object",
+		"properties": object{
+			"state":                  object{"type": "string", "enum": breakerStates},
+			"open_reason":            object{"type": "string", "enum": []string{resilience.ReasonFailures, resilience.ReasonLatency, resilience.ReasonForced}, "description": "why the breaker last opened; absent while closed"},
+			"policy":                 object{"type": "string", "enum": resilience.Policies},
+			"forced":                 object{"type": "boolean"},
+			"failures":               object{"type": "integer", "description": "consecutive failures"},
+			"threshold":              object{"type": "integer", "description": "consecutive policy: failures in a row that open the breaker"},
+			"cooldown_ms":            object{"type": "integer"},
+			"last_failure":           object{"type": "string", "format": "date-time"},
+			"restored_from":          object{"type": "string", "format": "date-time", "description": "when the state restored at startup was saved; absent if the breaker started fresh"},
+			"window_ms":              object{"type": "integer", "description": "windowed policy only"},
+			"window_requests":        object{"type": "integer", "description": "windowed policy only"},
+			"window_failures":        object{"type": "integer", "description": "windowed policy only"},
+			"failure_rate":           object{"type": "number", "description": "windowed policy only: failure rate over the window"},
+			"failure_rate_threshold": object{"type": "number", "description": "windowed policy only"},
+			"min_requests":           object{"type": "integer", "description": "windowed policy only"},
+			"failure_opens":          object{"type": "integer", "description": "times the trip policy opened the breaker"},
+			"latency": object{
+				"type":        "object",
+				"description": "slow call detector, absent unless -breaker-slow-call is set",
+				"properties": object{
+					"slow_call_ms":   object{"type": "number"},
+					"percentile":     object{"type": "number"},
+					"window_ms":      object{"type": "integer"},
+					"sustain_ms":     object{"type": "integer"},
+					"min_calls":      object{"type": "integer"},
+					"slow_calls":     object{"type": "integer", "description": "searches slower than slow_call_ms since start"},
+					"opens":          object{"type": "integer", "description": "times latency opened the breaker"},
+					"window_samples": object{"type": "integer"},
+					"window_slow":    object{"type": "integer"},
+					"percentile_ms":  object{"type": "number", "description": "the percentile latency over the window, to histogram bucket precision"},
+					"slow_since":     object{"type": "string", "format": "date-time", "description": "when the percentile went above slow_call_ms; absent while below"},
+				},
+			},
+			"dependencies": object{
+				"type":                 "object",
+				"description":          "breakers guarding downstream calls in the same shape: inventory:<category> for each category's inventory breaker, products outside the catalog's categories sharing inventory:other",
+				"additionalProperties": object{"type": "object"},
+			},
+		},
+	},
+	"Chaos": {
+		"type": "object",
+		"properties": object{
+			"failure_rate": object{"type": "number", "minimum": 0, "maximum": 1, "description": "base rate when set, rate in force when read"},
+			"base_rate":    object{"type": "number", "description": "read only: the rate outside any schedule or spike"},
+			"latency_ms":   object{"type": "number", "minimum": 0, "maximum": maxChaosLatencyMS, "description": "added to every search, for slowness drills"},
+			"schedule": object{"type": "object", "properties": object{
+				"phases": object{"type": "array", "items": object{"type": "object", "properties": object{
+					"duration_s":   object{"type": "number"},
+					"failure_rate": object{"type": "number", "minimum": 0, "maximum": 1},
+				}}},
+				"loop":              object{"type": "boolean", "description": "start over after the last phase instead of returning to the base rate"},
+				"phase":             object{"type": "integer", "description": "read only: index of the running phase"},
+				"phase_remaining_s": object{"type": "number", "description": "read only"},
+			}},
+			"spike": object{"type": "object", "description": "read only: a running spike", "properties": object{
+				"failure_rate": object{"type": "number"},
+				"remaining_s":  object{"type": "number"},
+			}},
+			"disabled": object{"type": "boolean", "description": "true in deterministic mode"},
+			"partial":  object{"type": "boolean", "description": "read only: set with -chaos-partial, when failures answer 200 with the results matched and a warning"},
+			"guard": object{"type": "object", "description": "read only, with -chaos-guard-burn: the guard capping chaos when the error budget burns too fast", "properties": object{
+				"state":     object{"type": "string", "enum": []string{guardArmed, guardTripped, guardAcknowledged}, "description": "acknowledged re-arms once the burn rate falls under the threshold"},
+				"since":     object{"type": "string", "format": "date-time"},
+				"threshold": object{"type": "number"},
+				"sustain_s": object{"type": "number"},
+				"cap":       object{"type": "number", "description": "failure rate chaos is held to while tripped"},
+				"burn_rate": object{"type": "number", "nullable": true, "description": "over the SLO's 5m window at the last check"},
+				"over_s":    object{"type": "number", "description": "how long the burn rate has been over the threshold"},
+				"trips":     object{"type": "integer"},
+			}},
+		},
+	},
+	"LoadTestReport": {
+		"type": "object",
+		"properties": object{
+			"rps":          object{"type": "integer"},
+			"duration_s":   object{"type": "integer"},
+			"elapsed_s":    object{"type": "number"},
+			"cancelled":    object{"type": "boolean"},
+			"sent":         object{"type": "integer"},
+			"skipped":      object{"type": "integer", "description": "ticks dropped because too many requests were outstanding"},
+			"achieved_rps": object{"type": "number"},
+			"succeeded":    object{"type": "integer"},
+			"by_status":    object{"type": "object", "additionalProperties": object{"type": "integer"}},
+			"rejected":     object{"type": "object", "additionalProperties": object{"type": "integer"}, "description": "by error code, with bulkhead split out from overloaded"},
+			"latency_ms":   object{"type": "object", "additionalProperties": object{"type": "number"}, "description": "p50, p90, p99 and max"},
+		},
+	},
+	"SelfTestReport": {
+		"type": "object",
+		"properties": object{
+			"passed": object{"type": "boolean"},
+			"checks": object{"type": "array", "items": object{
+				"type": "object",
+				"properties": object{
+					"name":        object{"type": "string", "example": "breaker"},
+					"passed":      object{"type": "boolean"},
+					"error":       object{"type": "string"},
+					"duration_ms": object{"type": "number"},
+				},
+			}},
+			"duration_ms": object{"type": "number"},
+		},
+	},
+	"Error": {
+		"type": "object",
+		"properties": object{
+			"error": object{"type": "object", "properties": object{
+				"code":    object{"type": "string", "example": "circuit_open"},
+				"message": object{"type": "string"},
+				"field":   object{"type": "string", "description": "the parameter, header or body field a bad_request is about, when there is one"},
+				"reason":  object{"type": "string", "enum": rejectionReasons(), "description": "the admission check that rejected the request. Rate limits default to 429 and the rest to 503; -rejection-status may map them otherwise, the code staying the same"},
+				"violations": object{"type": "array", "description": "every field at fault when a product body failed validation in more than one, field holding the first", "items": object{"type": "object", "properties": object{
+					"field":   object{"type": "string"},
+					"message": object{"type": "string"},
+				}}},
+			}},
+		},
+	},
+	"CatalogChanges": {
+		"type": "object",
+		"properties": object{
+			"changes": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"seq":     object{"type": "integer"},
+				"type":    object{"type": "string", "enum": []string{eventCreated, eventUpdated, eventDeleted}},
+				"id":      object{"type": "integer"},
+				"product": object{"$ref": "#/components/schemas/Product", "description": "the new value, or the removed one for a delete"},
+			}}},
+			"next":   object{"type": "integer", "description": "since for the next call"},
+			"latest": object{"type": "integer", "description": "latest sequence assigned"},
+			"more":   object{"type": "boolean", "description": "whether changes after next were left out by limit"},
+		},
+	},
+	"RelatedProducts": {
+		"type": "object",
+		"properties": object{
+			"id": object{"type": "integer"},
+			"products": object{"type": "array", "items": object{"allOf": []object{
+				{"$ref": "#/components/schemas/Product"},
+				{"type": "object", "properties": object{"score": object{"type": "number", "description": "2 for the same brand, 1 for the same category, plus the inverse document frequency of each shared name or category word"}}},
+			}}},
+		},
+	},
+	"Clients": {
+		"type": "object",
+		"properties": object{
+			"enabled":  object{"type": "boolean"},
+			"cap":      object{"type": "integer", "description": "requests in flight allowed per client address"},
+			"tracked":  object{"type": "integer", "description": "addresses with requests in flight"},
+			"rejected": object{"type": "integer", "description": "requests refused with 429 for exceeding the cap"},
+			"clients": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"client":    object{"type": "string"},
+				"in_flight": object{"type": "integer"},
+			}}},
+		},
+	},
+	"ZeroResults": {
+		"type": "object",
+		"properties": object{
+			"queries": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"query": object{"type": "string"},
+				"count": object{"type": "integer"},
+				"error": object{"type": "integer", "description": "how much of count may belong to queries it displaced"},
+			}}},
+			"total":    object{"type": "integer", "description": "zero-result searches seen, tracked or not"},
+			"capacity": object{"type": "integer", "description": "distinct queries tracked, -tracked-queries"},
+			"overflow": object{"type": "integer", "description": "searches for a new query once capacity was reached, each displacing the least counted"},
+		},
+	},
+	"Shadow": {
+		"type": "object",
+		"properties": object{
+			"enabled":            object{"type": "boolean"},
+			"mode":               object{"type": "string", "enum": []string{modeExhaustive, modeIndexed}},
+			"percent":            object{"type": "number"},
+			"pool":               object{"type": "integer", "description": "most shadow searches running at once"},
+			"in_flight":          object{"type": "integer"},
+			"compared":           object{"type": "integer"},
+			"dropped":            object{"type": "integer", "description": "shadows skipped because the pool was full"},
+			"count_mismatches":   object{"type": "integer", "description": "like-for-like comparisons whose totals differed"},
+			"id_mismatches":      object{"type": "integer", "description": "sorted like-for-like comparisons whose pages differed"},
+			"inside_interval":    object{"type": "integer", "description": "full counts inside the sampled search's estimate interval"},
+			"outside_interval":   object{"type": "integer"},
+			"missing_candidates": object{"type": "integer", "description": "sampled searches returning a product the full search didn't consider"},
+		},
+	},
+	"Mirror": {
+		"type":        "object",
+		"description": "with -mirror-url: GET requests copied to the target once answered, and how its answers compared; enabled alone otherwise",
+		"properties": object{
+			"enabled":         object{"type": "boolean"},
+			"target":          object{"type": "string"},
+			"percent":         object{"type": "number"},
+			"workers":         object{"type": "integer", "description": "copies sent at once"},
+			"busy":            object{"type": "integer"},
+			"timeout_ms":      object{"type": "number"},
+			"credentials":     object{"type": "boolean", "description": "whether copies carry the client's Authorization, X-API-Key and Cookie headers, with -mirror-credentials"},
+			"sent":            object{"type": "integer"},
+			"dropped":         object{"type": "integer", "description": "copies skipped because every worker was busy"},
+			"failed":          object{"type": "integer", "description": "copies the target didn't answer, other than timeouts"},
+			"timeouts":        object{"type": "integer"},
+			"status":          object{"type": "object", "description": "the target's answers by status class", "additionalProperties": object{"type": "integer"}},
+			"status_matched":  object{"type": "integer", "description": "copies answered with the primary's status"},
+			"mirror_latency":  object{"type": "object", "description": "the target's answers: mean_ms, null before any, and max_ms"},
+			"primary_latency": object{"type": "object", "description": "this instance's answers to the same requests: mean_ms and max_ms"},
+			"recent_mismatches": object{"type": "array", "description": "the latest copies answered otherwise or not at all, newest first", "items": object{"type": "object", "properties": object{
+				"path":           object{"type": "string"},
+				"request_id":     object{"type": "string"},
+				"primary_status": object{"type": "integer"},
+				"mirror_status":  object{"type": "integer", "description": "0 when the target didn't answer"},
+				"error":          object{"type": "string"},
+				"at":             object{"type": "string", "format": "date-time"},
+			}}},
+		},
+	},
+	"RateLimit": {
+		"type": "object",
+		"properties": object{
+			"enabled":       object{"type": "boolean"},
+			"client":        object{"type": "string"},
+			"limit":         object{"type": "integer"},
+			"remaining":     object{"type": "integer"},
+			"reset_s":       object{"type": "number"},
+			"retry_after_s": object{"type": "number"},
+			"rate_per_s":    object{"type": "number"},
+		},
+	},
+	"SpillJob": {
+		"type": "object",
+		"properties": object{
+			"id":       object{"type": "string"},
+			"state":    object{"type": "string", "enum": []string{spillQueued, spillRunning}},
+			"created":  object{"type": "string", "format": "date-time"},
+			"expires":  object{"type": "string", "format": "date-time", "description": "when it expires if it hasn't run by then"},
+			"poll":     object{"type": "string", "description": "the poll URL, also sent as Location"},
+			"callback": object{"type": "string", "description": "the X-Callback-URL the result is POSTed to as a search.done or search.expired event"},
+		},
+	},
+	"ShardSearch": {
+		"type": "object",
+		"properties": object{
+			"products":    object{"type": "array", "items": object{"$ref": "#/components/schemas/Product"}},
+			"total_found": object{"type": "integer", "description": "matches summed over the shards"},
+			"mode":        object{"type": "string", "enum": searchModes},
+			"sort":        object{"type": "string", "enum": searchSorts},
+			"shards": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"index":      object{"type": "integer"},
+				"products":   object{"type": "integer"},
+				"mode":       object{"type": "string", "description": "the mode that answered, after any fallback"},
+				"checked":    object{"type": "integer"},
+				"matched":    object{"type": "integer"},
+				"elapsed_ms": object{"type": "number"},
+			}}},
+		},
+	},
+	"Operation": {
+		"type": "object",
+		"properties": object{
+			"id":               object{"type": "string"},
+			"type":             object{"type": "string", "enum": []string{opImport, opExport, opReload, opPurge}},
+			"summary":          object{"type": "string"},
+			"state":            object{"type": "string", "enum": []string{opRunning, opDone, opFailed, opCancelled}},
+			"started":          object{"type": "string", "format": "date-time"},
+			"finished":         object{"type": "string", "format": "date-time"},
+			"expires":          object{"type": "string", "format": "date-time", "description": "when a finished operation is forgotten, after -operation-ttl"},
+			"processed":        object{"type": "integer"},
+			"total":            object{"type": "integer"},
+			"errors":           object{"type": "integer"},
+			"eta_s":            object{"type": "number", "description": "while running, the rate so far extrapolated over what is left"},
+			"cancel_requested": object{"type": "boolean"},
+			"result":           object{"type": "object", "description": "what it did, as far as it got if cancelled: imported, created and updated for an import; snapshot_id, products, bytes and the download URL for an export; restored and removed for a reload; deleted for a purge"},
+			"error":            object{"type": "string"},
+		},
+	},
+	"CatalogStats": {
+		"type": "object",
+		"properties": object{
+			"products":               object{"type": "integer"},
+			"brands":                 valueCountsSchema,
+			"categories":             valueCountsSchema,
+			"avg_description_length": object{"type": "number", "description": "in characters"},
+			"indexes":                object{"type": "object", "description": "brand and category: values, postings and estimated_bytes; vocabulary: distinct tokens and postings; trigram: as in /stats"},
+		},
+	},
+	"SLO": {
+		"type": "object",
+		"properties": object{
+			"target":     object{"type": "number"},
+			"count_shed": object{"type": "boolean", "description": "whether requests shed by the breaker, the bulkhead or a limit count as failures; client errors never do"},
+			"windows": object{"type": "object", "description": "by window, 5m, 1h and 6h", "additionalProperties": object{"type": "object", "properties": object{
+				"good":         object{"type": "integer"},
+				"bad":          object{"type": "integer"},
+				"excluded":     object{"type": "integer"},
+				"availability": object{"type": "number", "nullable": true},
+				"burn_rate":    object{"type": "number", "nullable": true, "description": "error rate over the error budget; 1 spends it exactly"},
+			}}},
+			"error_budget": object{"type": "object", "properties": object{
+				"window":    object{"type": "string"},
+				"remaining": object{"type": "number", "nullable": true, "description": "fraction of the window's budget left, negative once overspent"},
+			}},
+			"fast_burn": object{"type": "object", "properties": object{
+				"threshold": object{"type": "number"},
+				"firing":    object{"type": "boolean"},
+				"alerts":    object{"type": "integer"},
+				"since":     object{"type": "string", "format": "date-time"},
+			}},
+		},
+	},
+	"Readiness": {
+		"type": "object",
+		"properties": object{
+			"ready":          object{"type": "boolean"},
+			"catalog_loaded": object{"type": "boolean"},
+			"circuit":        object{"type": "string", "enum": breakerStates},
+			"persistence":    persistenceSchema,
+			"cache_warmup":   object{"type": "object", "description": "progress replaying the previous run's most requested searches into the response cache; readiness waits for it, at most -cache-warmup-max-delay. Absent when there is nothing to warm"},
+		},
+	},
+	"AdminErrors": {
+		"type": "object",
+		"properties": object{
+			"total": object{"type": "integer"},
+			"errors": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"time":    object{"type": "string", "format": "date-time"},
+				"source":  object{"type": "string"},
+				"message": object{"type": "string"},
+			}}},
+		},
+	},
+	"Audit": {
+		"type": "object",
+		"properties": object{
+			"recorded": object{"type": "integer", "description": "events recorded since start, the dropped included"},
+			"dropped":  object{"type": "integer", "description": "events lost because the write buffer was full"},
+			"events": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"ts":         object{"type": "string", "format": "date-time"},
+				"actor":      object{"type": "string", "description": "key:name of the caller's API key, or else its address"},
+				"ip":         object{"type": "string"},
+				"action":     object{"type": "string", "description": "method and route, like PUT /admin/chaos"},
+				"target":     object{"type": "string", "description": "like product:42, chaos or circuit; the path when the handler names none"},
+				"status":     object{"type": "integer"},
+				"before":     object{"type": "string", "description": "summary of the target before the call, when it changed something"},
+				"after":      object{"type": "string", "description": "summary of the target after it"},
+				"request_id": object{"type": "string"},
+				"tenant":     object{"type": "string"},
+			}}},
+		},
+	},
+	"ValidationRules": {
+		"type": "object",
+		"properties": object{
+			"source":          object{"type": "string", "description": "the -validation-rules file, empty for the built-in limits alone"},
+			"loaded":          object{"type": "string", "format": "date-time"},
+			"reloads":         object{"type": "integer"},
+			"reload_failures": object{"type": "integer", "description": "SIGHUP reloads that failed and kept the rules before them"},
+			"last_error":      object{"type": "string"},
+			"fields": object{"type": "array", "items": object{"type": "object", "properties": object{
+				"field":      object{"type": "string", "enum": []string{"name", "category", "brand", "description"}},
+				"required":   object{"type": "boolean"},
+				"max_length": object{"type": "integer", "description": "in characters"},
+				"multiline":  object{"type": "boolean", "description": "whether newlines and tabs are allowed"},
+				"pattern":    object{"type": "string", "description": "a Go regular expression non-empty values must match"},
+				"enum":       object{"type": "array", "items": object{"type": "string"}, "description": "allowed values ignoring case; for enum_from, the catalog's current ones, lowercased"},
+				"enum_from":  object{"type": "string", "enum": []string{enumFromCategories, enumFromBrands}},
+			}}},
+		},
+	},
+	"Watchdog": {
+		"type": "object",
+		"properties": object{
+			"enabled":  object{"type": "boolean"},
+			"dir":      object{"type": "string"},
+			"interval": object{"type": "string"},
+			"thresholds": object{"type": "object", "description": "zero means the check is off", "properties": object{
+				"heap_inuse_bytes": object{"type": "integer"},
+				"goroutines":       object{"type": "integer"},
+				"sched_lag":        object{"type": "string"},
+			}},
+			"keep":       object{"type": "integer"},
+			"min_gap":    object{"type": "string"},
+			"samples":    object{"type": "integer"},
+			"breaches":   object{"type": "integer", "description": "samples over a threshold"},
+			"captures":   object{"type": "integer"},
+			"suppressed": object{"type": "integer", "description": "breaches that didn't capture, being within min_gap of the last capture"},
+			"last": object{"type": "object", "properties": object{
+				"time":             object{"type": "string", "format": "date-time"},
+				"heap_inuse_bytes": object{"type": "integer"},
+				"goroutines":       object{"type": "integer"},
+				"sched_lag_ms":     object{"type": "number"},
+				"breaches":         object{"type": "array", "items": object{"type": "string"}},
+			}},
+			"last_capture": object{"type": "object", "description": "null before the first capture", "properties": object{
+				"time":   object{"type": "string", "format": "date-time"},
+				"reason": object{"type": "string"},
+				"dir":    object{"type": "string"},
+				"error":  object{"type": "string"},
+				"done":   object{"type": "boolean"},
+			}},
+			"stored": object{"type": "array", "items": object{"type": "string"}, "description": "capture directories, oldest first"},
+		},
+	},
+	"Health": {
+		"type": "object",
+		"properties": object{
+			"message":           object{"type": "string"},
+			"num_products":      object{"type": "integer"},
+			"checks_per_search": object{"type": "integer"},
+			"sample_strategy":   object{"type": "string", "enum": sampleStrategies},
+			"version":           object{"type": "string"},
+			"deterministic":     object{"type": "boolean"},
+			"persistence":       persistenceSchema,
+			"shard":             shardSchema,
+			"registration": object{
+				"type": "object",
+				"properties": object{
+					"enabled":    object{"type": "boolean"},
+					"registered": object{"type": "boolean"},
+					"service_id": object{"type": "string"},
+					"agent":      object{"type": "string"},
+					"attempts":   object{"type": "integer"},
+					"last_error": object{"type": "string"},
+				},
+			},
+		},
+	},
+}
+
+// featureWarningsSchema is an envelope's warnings, one per X-Features flag
+// ignored
+var featureWarningsSchema = object{"type": "array", "description": "one feature_ignored per X-Features flag unknown or not allowed", "items": object{"type": "object", "properties": object{
+	"code":    object{"type": "string", "enum": []string{codeFeatureIgnored}},
+	"message": object{"type": "string"},
+}}}
+
+// buildOpenAPI renders the route table as an OpenAPI 3 document
+func buildOpenAPI(rs []route) object {
+	paths := object{}
+	for _, rt := range rs {
+		params := make([]object, 0, len(rt.Params))
+		for _, p := range rt.Params {
+			schema := object{"type": p.Type}
+			if len(p.Enum) > 0 {
+				schema["enum"] = p.Enum
+			}
+			params = append(params, object{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"required":    p.Required || p.In == "path",
+				"schema":      schema,
+			})
+		}
+
+		responses := object{}
+		for _, resp := range rt.Responses {
+			r := object{"description": resp.Description}
+			if resp.Schema != "" {
+				schema := resp.Schema
+				if resp.Enveloped && rt.Version >= 1 {
+					schema = "Envelope"
+				}
+				r["content"] = object{"application/json": object{
+					"schema": object{"$ref": "#/components/schemas/" + schema},
+				}}
+			} else if resp.Status >= 400 && rt.Version >= 1 {
+				r["content"] = object{"application/json": object{
+					"schema": object{"$ref": "#/components/schemas/Error"},
+				}}
+			} else if resp.Status >= 400 {
+				r["content"] = object{"text/plain": object{"schema": object{"type": "string"}}}
+			}
+			responses[strconv.Itoa(resp.Status)] = r
+		}
+
+		if rt.Role != roleNone {
+			if _, ok := responses["401"]; !ok {
+				responses["401"] = object{"description": "Missing or invalid API key (when auth is configured)"}
+			}
+			if _, ok := responses["403"]; !ok && rt.Role != roleRead {
+				responses["403"] = object{"description": "API key lacks the " + rt.Role + " role"}
+			}
+		}
+
+		params = append(params, object{
+			"name":        "X-Features",
+			"in":          "header",
+			"description": "comma separated experimental flags for this request alone, echoed in the X-Features response header when -features allows them and ignored with a warning otherwise; " + featuresDescription(),
+			"required":    false,
+			"schema":      object{"type": "string"},
+		})
+
+		if rt.Idempotent {
+			params = append(params, object{
+				"name":        "Idempotency-Key",
+				"in":          "header",
+				"description": "repeat a request with the same key to get the original response (Idempotent-Replayed: true) instead of applying it twice",
+				"required":    false,
+				"schema":      object{"type": "string", "maxLength": maxIdempotencyKey},
+			})
+			if _, ok := responses["409"]; !ok {
+				responses["409"] = object{"description": "Idempotency-Key already used with a different request"}
+			}
+		}
+
+		if rt.RateLimited {
+			responses["429"] = object{"description": "Rate limit exceeded (when -rate-limit-rps is set) or too many concurrent requests from this address, unless -rejection-status maps them otherwise; see Retry-After"}
+			limitHeaders := object{
+				"X-RateLimit-Limit":     object{"schema": object{"type": "integer"}, "description": "bucket capacity"},
+				"X-RateLimit-Remaining": object{"schema": object{"type": "integer"}, "description": "tokens left"},
+				"X-RateLimit-Reset":     object{"schema": object{"type": "integer"}, "description": "seconds until the bucket is full"},
+			}
+			for _, r := range responses {
+				r.(object)["headers"] = limitHeaders
+			}
+		}
+
+		op := object{"summary": rt.Summary, "responses": responses}
+		if rt.Role != roleNone {
+			security := []object{{"bearerAuth": []string{}}, {"apiKeyHeader": []string{}}}
+			if rt.Role == roleRead {
+				// Reads are open unless -require-auth-for-reads is set
+				security = append(security, object{})
+			}
+			op["security"] = security
+			op["x-required-role"] = rt.Role
+		}
+		if rt.Deprecated {
+			op["deprecated"] = true
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		item, ok := paths[rt.Path].(object)
+		if !ok {
+			item = object{}
+			paths[rt.Path] = item
+		}
+		item[strings.ToLower(rt.Method)] = op
+	}
+
+	schemas := object{}
+	for name, s := range apiSchemas {
+		schemas[name] = s
+	}
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "Product Search API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"bearerAuth":   object{"type": "http", "scheme": "bearer"},
+				"apiKeyHeader": object{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rs := s.routes
+	if s.cfg.DemoMode {
+		rs = demoRoutes(rs)
+	}
+	json.NewEncoder(w).Encode(buildOpenAPI(rs))
+}
+
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
+
+// docsPage renders /openapi.json client side with no external assets
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Product Search API</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 60em; }
+.op { border: 1px solid #ccc; border-radius: 4px; margin: 1em 0; padding: 0.5em 1em; }
+.method { font-weight: bold; text-transform: uppercase; margin-right: 0.5em; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; max-height: 20em; }
+td { padding: 0.2em 0.6em; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1 id="title">Product Search API</h1>
+<div id="ops"></div>
+<script>
+function el(tag, text) { var e = document.createElement(tag); if (text) e.textContent = text; return e; }
+fetch("/openapi.json").then(function (r) { return r.json(); }).then(function (spec) {
+  document.getElementById("title").textContent = spec.info.title + " " + spec.info.version;
+  var ops = document.getElementById("ops");
+  Object.keys(spec.paths).forEach(function (path) {
+    Object.keys(spec.paths[path]).forEach(function (method) {
+      var op = spec.paths[path][method];
+      var div = el("div"); div.className = "op";
+      var h = el("h3"); var m = el("span", method); m.className = "method";
+      h.appendChild(m); h.appendChild(document.createTextNode(path)); div.appendChild(h);
+      div.appendChild(el("p", op.summary));
+      var params = op.parameters || [];
+      var inputs = {};
+      if (params.length) {
+        var t = el("table");
+        params.forEach(function (p) {
+          var tr = el("tr"); tr.appendChild(el("td", p.name + " (" + p.in + ")"));
+          var td = el("td"); var inp = el("input"); inputs[p.name] = inp; td.appendChild(inp); tr.appendChild(td);
+          tr.appendChild(el("td", p.description || "")); t.appendChild(tr);
+        });
+        div.appendChild(t);
+      }
+      var codes = el("p", "Responses: " + Object.keys(op.responses).map(function (c) {
+        return c + " " + op.responses[c].description; }).join("; "));
+      div.appendChild(codes);
+      if (method === "get") {
+        var btn = el("button", "Try it"); var out = el("pre"); out.hidden = true;
+        btn.onclick = function () {
+          var url = path; var qs = [];
+          params.forEach(function (p) {
+            var v = inputs[p.name].value; if (!v) return;
+            if (p.in === "path") url = url.replace("{" + p.name + "}", encodeURIComponent(v));
+            else qs.push(encodeURIComponent(p.name) + "=" + encodeURIComponent(v));
+          });
+          if (qs.length) url += "?" + qs.join("&");
+          fetch(url).then(function (r) { return r.text().then(function (b) {
+            out.hidden = false; out.textContent = r.status + " " + url + "\n\n" + b; }); });
+        };
+        div.appendChild(btn); div.appendChild(out);
+      }
+      ops.appendChild(div);
+    });
+  });
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPICoversEveryRoute holds /openapi.json to the route table the
+// mux is built from: every route is in it with a summary and responses,
+// and every {name} in a path is a documented path parameter
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec := serve(s.Routes(), http.MethodGet, "/openapi.json", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /openapi.json: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Summary    string                     `json:"summary"`
+			Responses  map[string]json.RawMessage `json:"responses"`
+			Parameters []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi %q, want 3.x", spec.OpenAPI)
+	}
+	segment := regexp.MustCompile(`\{([^}]+)\}`)
+	operations := 0
+	for _, rt := range s.routes {
+		op, ok := spec.Paths[rt.Path][strings.ToLower(rt.Method)]
+		if !ok {
+			t.Errorf("%s %s is routed but not in the spec", rt.Method, rt.Path)
+			continue
+		}
+		operations++
+		if op.Summary == "" || len(op.Responses) == 0 {
+			t.Errorf("%s %s: no summary or responses in the spec", rt.Method, rt.Path)
+		}
+		for _, m := range segment.FindAllStringSubmatch(rt.Path, -1) {
+			found := false
+			for _, p := range op.Parameters {
+				found = found || p.In == "path" && p.Name == m[1]
+			}
+			if !found {
+				t.Errorf("%s %s: path parameter %s is undocumented", rt.Method, rt.Path, m[1])
+			}
+		}
+		for code := range op.Responses {
+			if _, err := strconv.Atoi(code); err != nil {
+				t.Errorf("%s %s: response %q is not a status code", rt.Method, rt.Path, code)
+			}
+		}
+	}
+	total := 0
+	for _, ops := range spec.Paths {
+		total += len(ops)
+	}
+	if total != operations {
+		t.Errorf("the spec has %d operations, the route table %d", total, operations)
+	}
+	refs := regexp.MustCompile(`"#/components/schemas/([^"]+)"`)
+	for _, m := range refs.FindAllStringSubmatch(rec.Body.String(), -1) {
+		if _, ok := spec.Components.Schemas[m[1]]; !ok {
+			t.Errorf("the spec references missing schema %s", m[1])
+		}
+	}
+}
+
+// TestValidateRoutesRefusesUndocumented is what stops an endpoint being
+// added without its spec entries: NewServer refuses the route table
+func TestValidateRoutesRefusesUndocumented(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	documented := route{Method: http.MethodGet, Path: "/things", Summary: "Things",
+		Responses: []apiResponse{{Status: http.StatusOK, Description: "The things"}}, Handler: ok}
+	if err := validateRoutes([]route{documented}); err != nil {
+		t.Fatalf("a documented route was refused: %v", err)
+	}
+	for name, change := range map[string]func(*route){
+		"no summary":       func(rt *route) { rt.Summary = "" },
+		"no responses":     func(rt *route) { rt.Responses = nil },
+		"no handler":       func(rt *route) { rt.Handler = nil },
+		"unknown schema":   func(rt *route) { rt.Responses = []apiResponse{{Status: http.StatusOK, Schema: "Nothing"}} },
+		"stray path param": func(rt *route) { rt.Params = []apiParam{{Name: "id", In: "path"}} },
+		"registered twice": nil,
+	} {
+		rs := []route{documented}
+		if change == nil {
+			rs = append(rs, documented)
+		} else {
+			rt := documented
+			change(&rt)
+			rs = []route{rt}
+		}
+		if err := validateRoutes(rs); err == nil {
+			t.Errorf("%s: route table accepted", name)
+		}
+	}
+}
+
+func TestDocsPage(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	rec := serve(h, http.MethodGet, "/docs", "", nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /docs: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `fetch("/openapi.json")`) {
+		t.Error("the docs page doesn't load /openapi.json")
+	}
+}
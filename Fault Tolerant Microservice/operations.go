@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admin operation kinds; one of each runs at a time
+const (
+	opImport = "import"
+	opExport = "export"
+	opReload = "reload"
+	opPurge  = "purge"
+)
+
+// Admin operation states
+const (
+	opRunning   = "running"
+	opDone      = "done"
+	opFailed    = "failed"
+	opCancelled = "cancelled"
+)
+
+var (
+	errOperationUnknown  = newError(ErrNotFound, "Operation expired or unknown")
+	errOperationFinished = newError(ErrConflict, "The operation has already finished")
+)
+
+// operation is one long admin operation, run in the background so it
+// neither depends on nor holds up the request that started it. The task
+// advances processed and failed as it goes; the outcome is written once,
+// under the registry lock, when it returns.
+type operation struct {
+	id      string
+	kind    string
+	summary string
+	started time.Time
+	cancel  context.CancelFunc
+	// done is closed once the outcome is written
+	done chan struct{}
+
+	total     int64
+	processed int64
+	failed    int64
+
+	cancelRequested bool
+	state           string
+	finished        time.Time
+	result          interface{}
+	err             string
+}
+
+// advance counts one item handled, and whether it failed. A nil op, for
+// a synchronous call, counts nothing.
+func (op *operation) advance(failed bool) {
+	if op == nil {
+		return
+	}
+	atomic.AddInt64(&op.processed, 1)
+	if failed {
+		atomic.AddInt64(&op.failed, 1)
+	}
+}
+
+// operationTask does an operation's work, returning ctx.Err() if it stops
+// because it was cancelled, with its result as far as it got
+type operationTask func(ctx context.Context, op *operation) (interface{}, error)
+
+// operationRegistry runs the admin operations and keeps the finished ones
+// for ttl, so a client whose connection dropped can still find out how
+// its operation went
+type operationRegistry struct {
+	ttl time.Duration
+	// onFinish announces an operation's outcome
+	onFinish func(operationView)
+	statsd   *statsdClient
+
+	mu      sync.Mutex
+	ops     map[string]*operation
+	order   []*operation
+	running map[string]*operation
+
+	started   int64
+	conflicts int64
+	completed int64
+	failures  int64
+	cancelled int64
+}
+
+func newOperationRegistry(ttl time.Duration, onFinish func(operationView)) *operationRegistry {
+	return &operationRegistry{ttl: ttl, onFinish: onFinish, ops: make(map[string]*operation), running: make(map[string]*operation)}
+}
+
+// start runs task as a new operation of kind over total items, unless
+// one of that kind is running already
+func (reg *operationRegistry) start(kind, summary string, total int, task operationTask) (*operation, error) {
+	var b [16]byte
+	rand.Read(b[:])
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &operation{
+		id:      hex.EncodeToString(b[:]),
+		kind:    kind,
+		summary: summary,
+		started: time.Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		total:   int64(total),
+		state:   opRunning,
+	}
+
+	reg.mu.Lock()
+	if running := reg.running[kind]; running != nil {
+		reg.conflicts++
+		reg.mu.Unlock()
+		cancel()
+		return nil, newError(ErrConflict, fmt.Sprintf("A %s is already running as operation %s", kind, running.id))
+	}
+	reg.pruneLocked(op.started)
+	reg.running[kind] = op
+	reg.ops[op.id] = op
+	reg.order = append(reg.order, op)
+	reg.started++
+	reg.mu.Unlock()
+
+	reg.statsd.incr("operations.started", "type:"+kind)
+	log.Printf("Operation %s started: %s of %s", op.id, kind, summary)
+	go reg.supervise(ctx, op, task)
+	return op, nil
+}
+
+// supervise runs op's task, turning a panic into a failure rather than
+// taking the process down, and records how it ended
+func (reg *operationRegistry) supervise(ctx context.Context, op *operation, task operationTask) {
+	var result interface{}
+	var err error
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("Operation %s panicked: %v\n%s", op.id, p, debug.Stack())
+				err = fmt.Errorf("internal error: %v", p)
+			}
+		}()
+		result, err = task(ctx, op)
+	}()
+	op.cancel()
+
+	reg.mu.Lock()
+	op.result, op.finished = result, time.Now()
+	switch {
+	case errors.Is(err, context.Canceled):
+		op.state = opCancelled
+		reg.cancelled++
+	case err != nil:
+		op.state, op.err = opFailed, err.Error()
+		reg.failures++
+	default:
+		op.state = opDone
+		reg.completed++
+	}
+	delete(reg.running, op.kind)
+	view := reg.viewLocked(op)
+	reg.mu.Unlock()
+	close(op.done)
+
+	reg.statsd.incr("operations.finished", "type:"+op.kind, "state:"+op.state)
+	log.Printf("Operation %s %s: %d of %d processed, %d errors, in %s", op.id, op.state, view.Processed, view.Total, view.Errors, op.finished.Sub(op.started).Round(time.Millisecond))
+	if op.state == opFailed {
+		adminErrors.record("operation", fmt.Sprintf("%s failed: %s", op.kind, op.err))
+	}
+	if reg.onFinish != nil {
+		reg.onFinish(view)
+	}
+}
+
+// cancel asks a running operation to stop. It stops cooperatively, at the
+// task's next check, so it may still be running when cancel returns.
+func (reg *operationRegistry) cancel(id string) (operationView, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	op := reg.ops[id]
+	if op == nil {
+		return operationView{}, errOperationUnknown
+	}
+	if op.state != opRunning {
+		return operationView{}, errOperationFinished
+	}
+	op.cancelRequested = true
+	op.cancel()
+	return reg.viewLocked(op), nil
+}
+
+// shutdown cancels the running operations and waits for them to stop, as
+// long as ctx allows
+func (reg *operationRegistry) shutdown(ctx context.Context) {
+	reg.mu.Lock()
+	var running []*operation
+	for _, op := range reg.running {
+		op.cancelRequested = true
+		op.cancel()
+		running = append(running, op)
+	}
+	reg.mu.Unlock()
+	for _, op := range running {
+		select {
+		case <-op.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneLocked forgets operations finished more than ttl ago. They are
+// kept in the order they started, which a long one can finish well
+// after, so the scan doesn't stop at one still running.
+func (reg *operationRegistry) pruneLocked(now time.Time) {
+	kept := reg.order[:0]
+	for _, op := range reg.order {
+		if op.state != opRunning && now.Sub(op.finished) >= reg.ttl {
+			delete(reg.ops, op.id)
+			continue
+		}
+		kept = append(kept, op)
+	}
+	for i := len(kept); i < len(reg.order); i++ {
+		reg.order[i] = nil
+	}
+	reg.order = kept
+}
+
+// operationView is an operation as GET /admin/operations/{id} reports it
+type operationView struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Summary  string     `json:"summary"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Expires is when a finished operation is forgotten
+	Expires   *time.Time `json:"expires,omitempty"`
+	Processed int64      `json:"processed"`
+	Total     int64      `json:"total"`
+	Errors    int64      `json:"errors"`
+	// ETAS extrapolates the rate so far over what is left, while running
+	ETAS            *float64 `json:"eta_s,omitempty"`
+	CancelRequested bool     `json:"cancel_requested,omitempty"`
+	// Result is what the operation did, as far as it got if cancelled
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func (reg *operationRegistry) viewLocked(op *operation) operationView {
+	v := operationView{
+		ID:              op.id,
+		Type:            op.kind,
+		Summary:         op.summary,
+		State:           op.state,
+		Started:         op.started.UTC(),
+		Processed:       atomic.LoadInt64(&op.processed),
+		Total:           op.total,
+		Errors:          atomic.LoadInt64(&op.failed),
+		CancelRequested: op.cancelRequested,
+		Result:          op.result,
+		Error:           op.err,
+	}
+	if op.state != opRunning {
+		finished, expires := op.finished.UTC(), op.finished.Add(reg.ttl).UTC()
+		v.Finished, v.Expires = &finished, &expires
+	} else if v.Processed > 0 && v.Total > v.Processed {
+		elapsed := time.Since(op.started).Seconds()
+		eta := elapsed * float64(v.Total-v.Processed) / float64(v.Processed)
+		v.ETAS = &eta
+	}
+	return v
+}
+
+func (reg *operationRegistry) get(id string) (operationView, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.pruneLocked(time.Now())
+	op := reg.ops[id]
+	if op == nil {
+		return operationView{}, false
+	}
+	return reg.viewLocked(op), true
+}
+
+func (reg *operationRegistry) stats() map[string]interface{} {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	running := make([]string, 0, len(reg.running))
+	for kind := range reg.running {
+		running = append(running, kind)
+	}
+	return map[string]interface{}{
+		"ttl_s":     reg.ttl.Seconds(),
+		"kept":      len(reg.ops),
+		"running":   running,
+		"started":   reg.started,
+		"conflicts": reg.conflicts,
+		"done":      reg.completed,
+		"failed":    reg.failures,
+		"cancelled": reg.cancelled,
+	}
+}
+
+// onOperationFinished sends an operation's outcome to the webhooks as
+// operation.finished, for clients that stopped polling
+func (s *Server) onOperationFinished(v operationView) {
+	s.cfg.Webhooks.notify("operation.finished", map[string]interface{}{
+		"id":        v.ID,
+		"type":      v.Type,
+		"state":     v.State,
+		"processed": v.Processed,
+		"total":     v.Total,
+		"errors":    v.Errors,
+		"error":     v.Error,
+	})
+}
+
+// versionPrefix is the path prefix of the request's API version
+func versionPrefix(r *http.Request) string {
+	prefix := apiVersions[0].Prefix
+	for _, v := range apiVersions {
+		if v.Number == requestAPIVersion(r) {
+			prefix = v.Prefix
+		}
+	}
+	return prefix
+}
+
+// startOperation starts task and answers 202 with the operation, its
+// poll URL in Location
+func (s *Server) startOperation(w http.ResponseWriter, r *http.Request, kind, summary string, total int, task operationTask) {
+	op, err := s.ops.start(kind, summary, total, task)
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	noteAudit(r, "operation", "", fmt.Sprintf("%s of %s started as %s", kind, summary, op.id))
+	v, _ := s.ops.get(op.id)
+	w.Header().Set("Location", versionPrefix(r)+"/admin/operations/"+op.id)
+	w.Header().Set("Retry-After", "1")
+	writeJSON(w, http.StatusAccepted, v)
+}
+
+func (s *Server) operationHandler(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.ops.get(pathParam(r, "id"))
+	if !ok {
+		writeErr(w, r, errOperationUnknown)
+		return
+	}
+	if v.State == opRunning {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// cancelOperationHandler asks a running operation to stop; poll it to
+// see when it has
+func (s *Server) cancelOperationHandler(w http.ResponseWriter, r *http.Request) {
+	v, err := s.ops.cancel(pathParam(r, "id"))
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	noteAudit(r, "operation", v.ID+" running", "cancel requested")
+	writeJSON(w, http.StatusAccepted, v)
+}
+
+// importOperationHandler imports like POST /products/import, after the
+// same checks, as an operation
+func (s *Server) importOperationHandler(w http.ResponseWriter, r *http.Request) {
+	entries, ok := s.readImport(w, r)
+	if !ok {
+		return
+	}
+	s.startOperation(w, r, opImport, fmt.Sprintf("%d products", len(entries)), len(entries), s.importTask(entries))
+}
+
+func (s *Server) importTask(entries []importProduct) operationTask {
+	return func(ctx context.Context, op *operation) (interface{}, error) {
+		return s.applyImport(ctx, entries, op)
+	}
+}
+
+// exportOperationHandler pins an export snapshot as an operation; its
+// result says where to download it, resumably
+func (s *Server) exportOperationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.exports.enabled() {
+		writeErr(w, r, newError(ErrNotFound, "Export snapshots are disabled; start with -export-snapshots"))
+		return
+	}
+	download := versionPrefix(r) + "/products/export?snapshot_id="
+	s.startOperation(w, r, opExport, "the catalog", s.store.size(), func(ctx context.Context, op *operation) (interface{}, error) {
+		ss, err := s.pinExport(ctx, op)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"snapshot_id": ss.id,
+			"products":    len(ss.products),
+			"bytes":       ss.size(),
+			"download":    download + ss.id,
+		}, nil
+	})
+}
+
+// reloadOperationHandler puts the generated catalog back as it was at
+// start: each generated product restored, and every other removed
+func (s *Server) reloadOperationHandler(w http.ResponseWriter, r *http.Request) {
+	n := s.cfg.NumProducts
+	var generated, extra []ProductID
+	for i := 0; i < n; i++ {
+		// A shard restores only its own share
+		if id := ProductID(i); s.shards.owns(id) {
+			generated = append(generated, id)
+		}
+	}
+	for _, id := range s.store.allIDs() {
+		if id >= ProductID(n) {
+			extra = append(extra, id)
+		}
+	}
+	s.startOperation(w, r, opReload, fmt.Sprintf("%d generated products", len(generated)), len(generated)+len(extra), func(ctx context.Context, op *operation) (interface{}, error) {
+		restored, removed := 0, 0
+		res := func() map[string]int { return map[string]int{"restored": restored, "removed": removed} }
+		for _, id := range generated {
+			if err := ctx.Err(); err != nil {
+				return res(), err
+			}
+			if _, err := s.store.put(generatedProduct(id)); err != nil {
+				return res(), err
+			}
+			restored++
+			op.advance(false)
+		}
+		for _, id := range extra {
+			if err := ctx.Err(); err != nil {
+				return res(), err
+			}
+			_, err := s.store.delete(id)
+			switch {
+			case err == nil:
+				removed++
+			case !errors.Is(err, ErrNotFound):
+				return res(), err
+			}
+			// Gone already is as good as removed
+			op.advance(false)
+		}
+		return res(), nil
+	})
+}
+
+// purgeOperationHandler deletes every product, or those of brand and
+// category when given
+func (s *Server) purgeOperationHandler(w http.ResponseWriter, r *http.Request) {
+	brand, category := r.URL.Query().Get("brand"), r.URL.Query().Get("category")
+	ids := s.store.allIDs()
+	summary := "every product"
+	if brand != "" || category != "" {
+		ids = s.store.filterIDs(brand, category)
+		var of []string
+		if brand != "" {
+			of = append(of, fmt.Sprintf("brand %q", brand))
+		}
+		if category != "" {
+			of = append(of, fmt.Sprintf("category %q", category))
+		}
+		summary = "products of " + strings.Join(of, " and ")
+	}
+	s.startOperation(w, r, opPurge, summary, len(ids), func(ctx context.Context, op *operation) (interface{}, error) {
+		deleted := 0
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return map[string]int{"deleted": deleted}, err
+			}
+			_, err := s.store.delete(id)
+			switch {
+			case err == nil:
+				deleted++
+			case !errors.Is(err, ErrNotFound):
+				return map[string]int{"deleted": deleted}, err
+			}
+			op.advance(false)
+		}
+		return map[string]int{"deleted": deleted}, nil
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOperationCancel cancels an import operation mid-way. Holding the
+// store's mutation lock parks the import on a product, so the cancel
+// lands while it runs; it must stop there, keeping exactly the products
+// it counted, and a second import meanwhile must be refused.
+func TestOperationCancel(t *testing.T) {
+	s := newTestServer(t, nil)
+	entries := make([]importProduct, 50)
+	for i := range entries {
+		entries[i].productBody = productBody{Name: fmt.Sprintf("Test import %d", i), Category: "Home", Brand: "Alpha"}
+	}
+	reg := newOperationRegistry(time.Minute, nil)
+	before := s.store.size()
+
+	s.store.mutationLock.Lock()
+	op, err := reg.start(opImport, "test", len(entries), s.importTask(entries))
+	if err != nil {
+		s.store.mutationLock.Unlock()
+		t.Fatal(err)
+	}
+	_, conflict := reg.start(opImport, "test", len(entries), s.importTask(entries))
+	_, cancelErr := reg.cancel(op.id)
+	s.store.mutationLock.Unlock()
+	if conflict == nil {
+		t.Errorf("a second import started while one ran")
+	}
+	if cancelErr != nil {
+		t.Fatalf("cancel: %v", cancelErr)
+	}
+	select {
+	case <-op.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the import didn't stop within 5s of its cancel")
+	}
+
+	v, _ := reg.get(op.id)
+	res, _ := v.Result.(importResult)
+	switch {
+	case v.State != opCancelled:
+		t.Errorf("state %s after cancelling, want %s", v.State, opCancelled)
+	case v.Processed >= v.Total:
+		t.Errorf("processed all %d products despite the cancel", v.Total)
+	case int64(res.Created) != v.Processed || s.store.size() != before+res.Created:
+		t.Errorf("catalog grew by %d for %d products processed and %d reported created", s.store.size()-before, v.Processed, res.Created)
+	}
+	if _, err := reg.cancel(op.id); err != errOperationFinished {
+		t.Errorf("cancelling a finished operation: %v", err)
+	}
+}
+
+// runOperation starts an operation with a POST to target and polls its
+// Location until it finishes
+func runOperation(t *testing.T, h http.Handler, target string) operationView {
+	t.Helper()
+	rec := serve(h, http.MethodPost, target, "", nil)
+	loc := rec.Header().Get("Location")
+	if rec.Code != http.StatusAccepted || !strings.HasPrefix(loc, "/v1/admin/operations/") {
+		t.Fatalf("POST %s: %d at %q %s", target, rec.Code, loc, rec.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		rec = serve(h, http.MethodGet, loc, "", nil)
+		var v operationView
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET %s: %d %s", loc, rec.Code, rec.Body)
+		}
+		if v.State != opRunning {
+			return v
+		}
+	}
+	t.Fatalf("%s still running after 5s", target)
+	return operationView{}
+}
+
+// TestOperationPurgeAndReload purges a brand and reloads the generated
+// catalog over HTTP, polling each to its outcome
+func TestOperationPurgeAndReload(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	if _, err := s.store.create(Product{Name: "Extra", Category: "Books", Brand: "Beta"}); err != nil {
+		t.Fatal(err)
+	}
+
+	v := runOperation(t, h, "/v1/admin/catalog/purge?brand=Alpha")
+	perBrand := testProducts / len(brands)
+	if v.State != opDone || v.Processed != int64(perBrand) || v.Finished == nil || fmt.Sprint(v.Result) != fmt.Sprintf("map[deleted:%d]", perBrand) {
+		t.Errorf("purge: %+v", v)
+	}
+	if len(s.store.filterIDs("Alpha", "")) != 0 || s.store.size() != testProducts+1-perBrand {
+		t.Errorf("after the purge: %d products, %d of them Alpha", s.store.size(), len(s.store.filterIDs("Alpha", "")))
+	}
+	if rec := serve(h, http.MethodDelete, "/v1/admin/operations/"+v.ID, "", nil); rec.Code != http.StatusConflict {
+		t.Errorf("cancelling a finished operation: %d", rec.Code)
+	}
+
+	v = runOperation(t, h, "/v1/admin/catalog/reload")
+	if v.State != opDone || fmt.Sprint(v.Result) != fmt.Sprintf("map[removed:1 restored:%d]", testProducts) {
+		t.Errorf("reload: %+v", v)
+	}
+	if p, ok := s.store.get(0); s.store.size() != testProducts || !ok || p.Name != generatedProduct(0).Name {
+		t.Errorf("after the reload: %d products, product 0 %+v", s.store.size(), p)
+	}
+	if rec := serve(h, http.MethodGet, "/v1/admin/operations/nothing", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("an unknown operation: %d", rec.Code)
+	}
+}
+
+// TestOperationPanics checks a panicking task fails its operation, frees
+// its kind for the next and is kept for the ttl only
+func TestOperationPanics(t *testing.T) {
+	finished := make(chan operationView, 2)
+	reg := newOperationRegistry(time.Minute, func(v operationView) { finished <- v })
+	op, err := reg.start(opPurge, "test", 1, func(ctx context.Context, op *operation) (interface{}, error) { panic("boom") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-op.done
+	if v, _ := reg.get(op.id); v.State != opFailed || !strings.Contains(v.Error, "boom") {
+		t.Errorf("after a panic: %+v", v)
+	}
+	next, err := reg.start(opPurge, "test", 0, func(ctx context.Context, op *operation) (interface{}, error) { return nil, nil })
+	if err != nil {
+		t.Fatalf("a purge after the failed one: %v", err)
+	}
+	<-next.done
+	if first, second := <-finished, <-finished; first.State != opFailed || second.State != opDone {
+		t.Errorf("announced %s then %s", first.State, second.State)
+	}
+	reg.mu.Lock()
+	reg.pruneLocked(time.Now().Add(2 * time.Minute))
+	reg.mu.Unlock()
+	if _, ok := reg.get(op.id); ok {
+		t.Errorf("kept past its ttl")
+	}
+}
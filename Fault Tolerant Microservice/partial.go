@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// warnChaosPartial is the warning code of a search chaos failed after it
+// had matched, answered with what it found
+const warnChaosPartial = "chaos_partial"
+
+// searchWarning tells the client a 200 carries less than it asked for
+type searchWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// chaosPartial is what a partial failure did to a search, in debug output
+type chaosPartial struct {
+	Mode string `json:"mode"`
+	// Found is the page of results matching produced, Returned how many
+	// of them survived truncation
+	Found     int  `json:"found"`
+	Returned  int  `json:"returned"`
+	Truncated bool `json:"truncated"`
+	// Breaker is whether the search counted as a breaker failure
+	Breaker bool `json:"breaker"`
+}
+
+// partialFailure answers a chaos failure fired after matching with the
+// results already found, cutting ChaosPartialTruncate of them to fewer,
+// so clients can exercise their handling of partial data
+func (s *Server) partialFailure(results []Product, rnd *rand.Rand) ([]Product, *chaosPartial, searchWarning) {
+	p := &chaosPartial{Mode: "partial", Found: len(results), Breaker: s.cfg.ChaosPartialBreaker}
+	if len(results) > 0 && rnd.Float64() < s.cfg.ChaosPartialTruncate {
+		results = results[:rnd.Intn(len(results))]
+		p.Truncated = true
+	}
+	p.Returned = len(results)
+	msg := "A simulated failure hit this search after matching; these are the results it had"
+	if p.Truncated {
+		msg = fmt.Sprintf("A simulated failure hit this search after matching and cut its results to %d of %d", p.Returned, p.Found)
+	}
+	return results, p, searchWarning{Code: warnChaosPartial, Message: msg}
+}
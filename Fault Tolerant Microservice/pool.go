@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+var (
+	// maxPooledBuffer is the largest encode buffer returned to the pool, so
+	// one huge response doesn't pin its memory for the life of the process
+	maxPooledBuffer = 1 << 20
+	// maxPooledProducts is the same cap for result slices
+	maxPooledProducts = 10000
+
+	bufferPool  = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	productPool = sync.Pool{New: func() interface{} {
+		ps := make([]Product, 0, 64)
+		return &ps
+	}}
+)
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// getProducts returns an empty pooled slice. The caller must be done with
+// it, including encoding the response, before calling putProducts.
+func getProducts() *[]Product {
+	ps := productPool.Get().(*[]Product)
+	*ps = (*ps)[:0]
+	return ps
+}
+
+func putProducts(ps *[]Product) {
+	if cap(*ps) > maxPooledProducts {
+		return
+	}
+	// Drop the string references so pooled slices don't keep deleted
+	// products alive. That goes up to cap, not len, so a holder that
+	// shortened the slice without clearing what it cut off leaves
+	// nothing behind either.
+	all := (*ps)[:cap(*ps)]
+	for i := range all {
+		all[i] = Product{}
+	}
+	productPool.Put(ps)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestEncodeJSONMatchesEncoder(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		v := map[string]interface{}{"products": []Product{generatedProduct(ProductID(i))}, "total_found": i}
+		buf, err := encodeJSON(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(v)
+		// A reused buffer must come back empty
+		if got := buf.String(); got != string(want)+"\n" {
+			t.Errorf("round %d: got %s, want %s", i, got, want)
+		}
+		putBuffer(buf)
+	}
+	if _, err := encodeJSON(func() {}); err == nil {
+		t.Error("encoding a func should fail")
+	}
+}
+
+func TestEncodedResponseHeaders(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	rec := serve(h, http.MethodGet, "/products/7", "", nil)
+	if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("headers %v for a %d byte body", rec.Header(), rec.Body.Len())
+	}
+}
+
+func TestPutProductsClearsToCap(t *testing.T) {
+	ps := getProducts()
+	*ps = append(*ps, generatedProduct(1), generatedProduct(2), generatedProduct(3))
+	// Shortened without clearing what was cut off
+	*ps = (*ps)[:1]
+	putProducts(ps)
+	for i, p := range (*ps)[:3] {
+		if p.Name != "" {
+			t.Errorf("slot %d still holds %q", i, p.Name)
+		}
+	}
+}
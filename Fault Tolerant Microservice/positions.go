@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// matchPosition is one occurrence of a query term in a returned field, as
+// a byte offset and length into the field's text as it is returned, so a
+// client can highlight it without matching again
+type matchPosition struct {
+	Field  string `json:"field"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// readPositions reads positions=, which asks for each result's matches
+func readPositions(q url.Values, errs *fieldErrors) bool {
+	v := q.Get("positions")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		errs.add("positions", "positions must be true or false")
+		return false
+	}
+	return on
+}
+
+// withPositions sets p.Matches to where t's terms occur in p as it is
+// returned, localized, when t asks for positions. The free text is
+// looked for in the name and category and name: scopes in the name, as
+// the matchers compare them.
+func (t searchText) withPositions(p Product) Product {
+	if !t.positions {
+		return p
+	}
+	var out []matchPosition
+	for _, term := range append([]string{t.q}, t.names...) {
+		out = appendSpans(out, "name", p.Name, term, t.fold)
+	}
+	out = appendSpans(out, "category", p.Category, t.q, t.fold)
+	// Scopes repeating the free text would report it twice
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Field != out[j].Field {
+			return out[i].Field == "name"
+		}
+		if out[i].Offset != out[j].Offset {
+			return out[i].Offset < out[j].Offset
+		}
+		return out[i].Length < out[j].Length
+	})
+	kept := out[:0]
+	for i, m := range out {
+		if i == 0 || m != out[i-1] {
+			kept = append(kept, m)
+		}
+	}
+	p.Matches = kept
+	return p
+}
+
+// appendSpans appends every occurrence of term, already prepared like a
+// searchText's, in text. The text is lowercased, and folded with fold,
+// rune by rune as the stored fields are, noting the rune each byte came
+// from, so an occurrence maps back onto text exactly however the case
+// mapping or folding changed its length. An occurrence starting or
+// ending inside a rune's expansion, like one s of ß, covers that rune,
+// and one ending before combining marks folding dropped covers them.
+func appendSpans(out []matchPosition, field, text, term string, fold bool) []matchPosition {
+	if term == "" || text == "" {
+		return out
+	}
+	cmp := make([]byte, 0, len(text))
+	from := make([]int, 0, len(text))
+	for i, r := range text {
+		n := len(cmp)
+		if fold {
+			cmp = appendFolded(cmp, unicode.ToLower(r))
+		} else {
+			cmp = utf8.AppendRune(cmp, unicode.ToLower(r))
+		}
+		for ; n < len(cmp); n++ {
+			from = append(from, i)
+		}
+	}
+	want := []byte(term)
+	for at := 0; ; {
+		j := bytes.Index(cmp[at:], want)
+		if j < 0 {
+			return out
+		}
+		start, end := at+j, at+j+len(want)
+		stop := len(text)
+		if end < len(cmp) {
+			stop = from[end]
+		}
+		if last := from[end-1]; stop <= last {
+			_, size := utf8.DecodeRuneInString(text[last:])
+			stop = last + size
+		}
+		out = append(out, matchPosition{Field: field, Offset: from[start], Length: stop - from[start]})
+		at = end
+	}
+}
+
+// keepPositions drops the matches in fields fs leaves out of the response
+func (fs fieldSet) keepPositions(ms []matchPosition) []matchPosition {
+	if fs == 0 || ms == nil {
+		return ms
+	}
+	out := []matchPosition{}
+	for _, m := range ms {
+		for i, f := range selectFields {
+			if f == m.Field && fs&(1<<i) != 0 {
+				out = append(out, m)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestMatchPositions searches accented, combining and CJK names with
+// positions=true, folded and not: every match must be exactly where
+// expected, in bytes of the text returned, and cover whole characters,
+// and select= must drop those in fields left out
+func TestMatchPositions(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.NumProducts = 0 })
+	for _, p := range []Product{
+		{Name: "Épsilon Café épsilon", Category: "Books", Brand: "Alpha"},
+		{Name: "東京タワー 模型 東京", Category: "Home", Brand: "Beta"},
+		{Name: "Cafe\u0301 Noir", Category: "Home", Brand: "Gamma"},
+		{Name: "Black Tea", Category: "Bookshelves", Brand: "Delta", Names: map[string]string{"fr": "Thé Noir"}},
+	} {
+		if _, err := s.store.create(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := s.Routes()
+	type span = matchPosition
+	for _, c := range []struct {
+		query string
+		want  map[ProductID][]span
+	}{
+		{"q=epsilon", map[ProductID][]span{0: {{"name", 0, 8}, {"name", 15, 8}}}},
+		{"q=epsilon&fold=false", map[ProductID][]span{}},
+		{"q=%C3%89PSILON&fold=false", map[ProductID][]span{0: {{"name", 0, 8}, {"name", 15, 8}}}},
+		{"q=" + url.QueryEscape(`name:"épsilon" café`), map[ProductID][]span{0: {{"name", 0, 8}, {"name", 9, 5}, {"name", 15, 8}}}},
+		{"q=" + url.QueryEscape("東京"), map[ProductID][]span{1: {{"name", 0, 6}, {"name", 23, 6}}}},
+		{"q=" + url.QueryEscape("模型"), map[ProductID][]span{1: {{"name", 16, 6}}}},
+		{"q=cafe", map[ProductID][]span{0: {{"name", 9, 5}}, 2: {{"name", 0, 6}}}},
+		{"q=book", map[ProductID][]span{0: {{"category", 0, 4}}, 3: {{"category", 0, 4}}}},
+		{"q=noir&lang=fr", map[ProductID][]span{2: {{"name", 7, 4}}, 3: {{"name", 5, 4}}}},
+		{"q=book&select=id,name", map[ProductID][]span{0: nil, 3: nil}},
+		{"q=cafe&select=name,id", map[ProductID][]span{0: {{"name", 9, 5}}, 2: {{"name", 0, 6}}}},
+	} {
+		res := search(t, h, "/products/search?mode=exhaustive&positions=true&"+c.query)
+		if len(res.Products) != len(c.want) {
+			t.Errorf("%s: %d results, want %d", c.query, len(res.Products), len(c.want))
+			continue
+		}
+		for _, p := range res.Products {
+			want, ok := c.want[p.ID]
+			if !ok || fmt.Sprint(p.Matches) != fmt.Sprint(want) {
+				t.Errorf("%s: product %d matches %v, want %v", c.query, p.ID, p.Matches, want)
+				continue
+			}
+			for _, m := range p.Matches {
+				text := p.Name
+				if m.Field == "category" {
+					text = p.Category
+				}
+				if text == "" {
+					t.Errorf("%s: product %d has matches in %s, which it doesn't return", c.query, p.ID, m.Field)
+				} else if !utf8.ValidString(text[m.Offset:m.Offset+m.Length]) || !utf8.RuneStart(text[m.Offset]) {
+					t.Errorf("%s: match %v splits a character of %q", c.query, m, text)
+				}
+			}
+		}
+	}
+}
+
+func TestMatchPositionsRefused(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, q := range []string{"q=cafe&positions=maybe", "q=cafe&positions=true&format=csv", "q=cafe&positions=true&snapshot=true"} {
+		_, errs := s.parseSearchRequest(&http.Request{URL: &url.URL{RawQuery: q}, Header: http.Header{}})
+		if len(errs) != 1 || errs[0].Field != "positions" {
+			t.Errorf("%s: errors %v, want one for positions", q, errs)
+		}
+	}
+}
+
+// TestWithPositions checks spans map back onto the text returned where
+// case mapping or folding changed its length: a dotted capital I that
+// lowercases to one byte, a ß that folds to two letters, a combining
+// accent folding drops and full-width letters. A span reaching into one
+// letter of an expansion covers it whole, and is reported once however
+// many terms find it.
+func TestWithPositions(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		q    string
+		fold bool
+		want []matchPosition
+	}{
+		{"İstanbul", "ist", false, []matchPosition{{"name", 0, 4}}},
+		{"Straße", "ss", true, []matchPosition{{"name", 4, 2}}},
+		{"Straße", "s", true, []matchPosition{{"name", 0, 1}, {"name", 4, 2}}},
+		{"Straße", "ss", false, nil},
+		{"Cafe\u0301 Noir", "cafe", true, []matchPosition{{"name", 0, 6}}},
+		{"Cafe\u0301 Noir", "cafe", false, []matchPosition{{"name", 0, 4}}},
+		{"ＡＢＣ abc", "abc", true, []matchPosition{{"name", 0, 9}, {"name", 10, 3}}},
+	} {
+		st := searchText{q: tc.q, fold: tc.fold, names: []string{tc.q}, positions: true}
+		got := st.withPositions(Product{Name: tc.text, Category: "Home"}).Matches
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q in %q, fold %v: %v, want %v", tc.q, tc.text, tc.fold, got, tc.want)
+		}
+	}
+	if p := (searchText{q: "home"}).withPositions(Product{Name: "Home", Category: "Home"}); p.Matches != nil {
+		t.Errorf("positions without asking: %v", p.Matches)
+	}
+}
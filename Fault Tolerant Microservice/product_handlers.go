@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// productBody is the accepted JSON for create and update. Any id in the
+// body is ignored in favour of the server assigned or path ID.
+type productBody struct {
+	Name        string `json:"name"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	Brand       string `json:"brand"`
+	// Price is in cents and optional
+	Price *int `json:"price,omitempty"`
+	// Names are the name in other locales, keyed by language
+	Names map[string]string `json:"names,omitempty"`
+}
+
+// writeJSON encodes v into a pooled buffer and writes it in one go with
+// its Content-Length
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := encodeJSON(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	defer putBuffer(buf)
+	writeEncoded(w, status, buf)
+}
+
+// encodeJSON encodes v into a pooled buffer, to be returned with
+// putBuffer once written
+func encodeJSON(v interface{}) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeEncoded writes a body from encodeJSON
+func writeEncoded(w http.ResponseWriter, status int, buf *bytes.Buffer) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// decodeProduct reads and validates a product body
+func (s *Server) decodeProduct(w http.ResponseWriter, r *http.Request) (Product, bool) {
+	body, ok := s.readBody(w, r, s.cfg.MaxProductBytes)
+	if !ok {
+		return Product{}, false
+	}
+	var b productBody
+	if err := json.Unmarshal(body, &b); err != nil {
+		writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+		return Product{}, false
+	}
+	if v := s.validateProduct(&b); len(v) > 0 {
+		writeErr(w, r, &ValidationErrors{Violations: v})
+		return Product{}, false
+	}
+	return Product{Name: b.Name, Category: b.Category, Description: b.Description, Brand: b.Brand, Price: b.Price, Names: b.Names}, true
+}
+
+// productID parses the {id} path parameter, writing a 404 when it isn't a
+// valid ID
+func productID(w http.ResponseWriter, r *http.Request) (ProductID, bool) {
+	id, err := strconv.Atoi(pathParam(r, "id"))
+	if err != nil || id < 0 {
+		writeErr(w, r, errProductNotFound)
+		return 0, false
+	}
+	return ProductID(id), true
+}
+
+var (
+	defaultListLimit = 100
+	maxListLimit     = 10000
+)
+
+// listProductsHandler pages through the catalog in insertion order
+func (s *Server) listProductsHandler(w http.ResponseWriter, r *http.Request) {
+	start := s.clock.Now()
+	offset, limit := 0, defaultListLimit
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeErr(w, r, invalid("offset", "offset must be a non-negative integer"))
+			return
+		}
+		offset = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeErr(w, r, invalid("limit", fmt.Sprintf("limit must be between 1 and %d", maxListLimit)))
+			return
+		}
+		limit = n
+	}
+	var errs fieldErrors
+	sel := readSelect(r.URL.Query(), &errs)
+	format := readFormat(r.URL.Query(), sel, &errs)
+	if err := errs.err(); err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	w.Header().Set(catalogSeqHeader, strconv.FormatInt(s.store.events.lastID(), 10))
+	ids, total := s.store.listIDs(offset, limit)
+	if format != nil {
+		// Rows are fetched as they're written so a large page streams
+		// rather than being built up in memory
+		i := 0
+		s.writeStream(w, r, format, "products", func() (Product, bool) {
+			for i < len(ids) {
+				i++
+				if p, ok := s.store.get(ids[i-1]); ok {
+					return p, true
+				}
+			}
+			return Product{}, false
+		})
+		return
+	}
+	products := make([]Product, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := s.store.get(id); ok {
+			products = append(products, p)
+		}
+	}
+	if s.envelopes(r) {
+		meta := envelopeMeta{Total: total, Limit: limit, Offset: offset, ElapsedMS: durationMS(s.reported(s.clock.Since(start)))}
+		writeJSON(w, http.StatusOK, newEnvelope(w, r, projectProducts(products, sel), total, meta, nil))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"products": projectProducts(products, sel),
+		"total":    total,
+		"offset":   offset,
+		"limit":    limit,
+	})
+}
+
+// product fetches id for a handler: ErrStoreUnavailable until the
+// catalog has loaded, so an empty store isn't mistaken for a missing
+// product, then whatever the store says
+func (s *Server) product(id ProductID) (Product, error) {
+	if atomic.LoadInt32(&s.catalogLoaded) == 0 {
+		return Product{}, newError(ErrStoreUnavailable, "The catalog is still loading")
+	}
+	return s.store.fetch(id)
+}
+
+func (s *Server) getProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := productID(w, r)
+	if !ok {
+		return
+	}
+	var errs fieldErrors
+	sel := readSelect(r.URL.Query(), &errs)
+	if err := errs.err(); err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	p, err := s.product(id)
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	locale := resolveLocale(r)
+	setLocaleHeaders(w, locale)
+	writeJSON(w, http.StatusOK, projectProduct(p.localized(locale), sel))
+}
+
+func (s *Server) createProductHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.decodeProduct(w, r)
+	if !ok {
+		return
+	}
+	p, err := s.store.create(p)
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	noteAudit(r, productTarget(p.ID), "", productSummary(p))
+	w.Header().Set("Location", "/products/"+p.ID.String())
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := productID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.decodeProduct(w, r)
+	if !ok {
+		return
+	}
+	p.ID = id
+	old, _ := s.store.get(id)
+	if err := s.store.update(p); err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	noteAudit(r, productTarget(id), productSummary(old), productSummary(p))
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := productID(w, r)
+	if !ok {
+		return
+	}
+	old, err := s.store.delete(id)
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	noteAudit(r, productTarget(id), productSummary(old), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func productTarget(id ProductID) string {
+	return "product:" + id.String()
+}
+
+// productSummary is a product as the audit log shows it
+func productSummary(p Product) string {
+	return fmt.Sprintf("%q, %s by %s", p.Name, p.Category, p.Brand)
+}
+
+// importProduct is one entry of an import. Entries with an id replace or
+// create that product, entries without one get a fresh ID.
+type importProduct struct {
+	ID *ProductID `json:"id"`
+	productBody
+}
+
+// maxImportViolations is how many violations a rejected import reports;
+// validation stops at that many
+const maxImportViolations = 50
+
+// importProductsHandler accepts a JSON array or newline delimited JSON.
+// All entries are validated before any is applied.
+func (s *Server) importProductsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, ok := s.readImport(w, r)
+	if !ok {
+		return
+	}
+	before := s.store.size()
+	res, err := s.applyImport(context.Background(), entries, nil)
+	noteAudit(r, "catalog", fmt.Sprintf("%d products", before), fmt.Sprintf("%d products, %d created and %d updated", s.store.size(), res.Created, res.Updated))
+	if err != nil {
+		// The entries before the one that failed are stored
+		writeErr(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// readImport reads and validates an import body, answering the request
+// itself when it is refused
+func (s *Server) readImport(w http.ResponseWriter, r *http.Request) ([]importProduct, bool) {
+	body, ok := s.readBody(w, r, s.cfg.MaxImportBytes)
+	if !ok {
+		return nil, false
+	}
+	var entries []importProduct
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+			return nil, false
+		}
+		if delim, ok := tok.(json.Delim); ok && delim == '[' {
+			for dec.More() {
+				var e importProduct
+				if err := dec.Decode(&e); err != nil {
+					writeErr(w, r, invalid("", "Invalid JSON body: "+err.Error()))
+					return nil, false
+				}
+				entries = append(entries, e)
+			}
+			continue
+		}
+		if delim, ok := tok.(json.Delim); ok && delim == ']' {
+			continue
+		}
+		writeErr(w, r, invalid("", "Expected a JSON array of products"))
+		return nil, false
+	}
+
+	var violations []*ValidationError
+	for i := range entries {
+		e := &entries[i]
+		if e.ID != nil && *e.ID < 0 {
+			violations = append(violations, &ValidationError{Field: fmt.Sprintf("[%d].id", i), Message: fmt.Sprintf("product %d: id must not be negative", i)})
+		} else if e.ID != nil && !s.shards.owns(*e.ID) {
+			violations = append(violations, &ValidationError{Field: fmt.Sprintf("[%d].id", i), Message: fmt.Sprintf("product %d: id %d belongs to shard %d", i, *e.ID, s.shards.ring.owner(*e.ID))})
+		}
+		for _, v := range s.validateProduct(&e.productBody) {
+			violations = append(violations, &ValidationError{Field: fmt.Sprintf("[%d].%s", i, v.Field), Message: fmt.Sprintf("product %d: %s", i, v.Message)})
+		}
+		if len(violations) >= maxImportViolations {
+			violations = violations[:maxImportViolations]
+			break
+		}
+	}
+	if len(violations) > 0 {
+		writeErr(w, r, &ValidationErrors{Violations: violations})
+		return nil, false
+	}
+	return entries, true
+}
+
+// importResult is what an import did, as far as it got
+type importResult struct {
+	Imported int `json:"imported"`
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+}
+
+// applyImport stores validated entries in order, stopping between them
+// once ctx is done or at the first the store refuses; op, when the import is an operation, counts them
+func (s *Server) applyImport(ctx context.Context, entries []importProduct, op *operation) (importResult, error) {
+	var res importResult
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		p := Product{Name: e.Name, Category: e.Category, Description: e.Description, Brand: e.Brand, Price: e.Price, Names: e.Names}
+		switch {
+		case e.ID == nil:
+			if _, err := s.store.create(p); err != nil {
+				return res, err
+			}
+			res.Created++
+		default:
+			p.ID = *e.ID
+			created, err := s.store.put(p)
+			if err != nil {
+				return res, err
+			}
+			if created {
+				res.Created++
+			} else {
+				res.Updated++
+			}
+		}
+		res.Imported++
+		op.advance(false)
+	}
+	return res, nil
+}
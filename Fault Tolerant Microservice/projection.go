@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// selectFields are the Product fields select= can keep, in output order
+var selectFields = []string{"id", "name", "category", "description", "brand", "price", "stock"}
+
+// fieldSet is a set of selectFields, bit i standing for selectFields[i].
+// The zero value selects nothing, meaning select= wasn't given.
+type fieldSet uint8
+
+const (
+	selectID fieldSet = 1 << iota
+	selectName
+	selectCategory
+	selectDescription
+	selectBrand
+	selectPrice
+	selectStock
+)
+
+// columns lists the selected fields in output order
+func (fs fieldSet) columns() []string {
+	var out []string
+	for i, f := range selectFields {
+		if fs&(1<<i) != 0 {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// readSelect reads select=, a comma separated list of selectFields
+func readSelect(q url.Values, errs *fieldErrors) fieldSet {
+	v := q.Get("select")
+	if v == "" {
+		return 0
+	}
+	var fs fieldSet
+	for _, f := range strings.Split(v, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		bit := -1
+		for i, name := range selectFields {
+			if name == f {
+				bit = i
+			}
+		}
+		if bit < 0 {
+			errs.add("select", fmt.Sprintf("unknown select field %q, expected some of %s", f, strings.Join(selectFields, ",")))
+			return 0
+		}
+		fs |= 1 << bit
+	}
+	return fs
+}
+
+// productView is a Product cut down to a fieldSet. Unselected fields are
+// nil and left out, so it encodes with the same field names and order as
+// Product without building anything per request.
+type productView struct {
+	ID          *ProductID `json:"id,omitempty"`
+	Name        *string    `json:"name,omitempty"`
+	Category    *string    `json:"category,omitempty"`
+	Description *string    `json:"description,omitempty"`
+	Brand       *string    `json:"brand,omitempty"`
+	Price       *int       `json:"price,omitempty"`
+	Stock       *int       `json:"stock,omitempty"`
+	// Matches are only those in the selected fields
+	Matches []matchPosition `json:"matches,omitempty"`
+}
+
+// project points v at the selected fields of p
+func (fs fieldSet) project(p *Product) productView {
+	var v productView
+	if fs&selectID != 0 {
+		v.ID = &p.ID
+	}
+	if fs&selectName != 0 {
+		v.Name = &p.Name
+	}
+	if fs&selectCategory != 0 {
+		v.Category = &p.Category
+	}
+	if fs&selectDescription != 0 {
+		v.Description = &p.Description
+	}
+	if fs&selectBrand != 0 {
+		v.Brand = &p.Brand
+	}
+	if fs&selectPrice != 0 {
+		v.Price = p.Price
+	}
+	if fs&selectStock != 0 {
+		v.Stock = p.Stock
+	}
+	v.Matches = fs.keepPositions(p.Matches)
+	return v
+}
+
+// projectProducts returns ps unchanged without a selection, so the
+// response is exactly what it was before select= existed. The views point
+// into ps, which must outlive encoding.
+func projectProducts(ps []Product, fs fieldSet) interface{} {
+	if fs == 0 {
+		return ps
+	}
+	views := make([]productView, len(ps))
+	for i := range ps {
+		views[i] = fs.project(&ps[i])
+	}
+	return views
+}
+
+// legacyProduct is a Product in the shape the unprefixed routes have
+// always sent, without the fields added since. Matches stay, as only a
+// caller asking for positions= gets them.
+type legacyProduct struct {
+	ID          ProductID       `json:"id"`
+	Name        string          `json:"name"`
+	Category    string          `json:"category"`
+	Description string          `json:"description"`
+	Brand       string          `json:"brand"`
+	Matches     []matchPosition `json:"matches,omitempty"`
+}
+
+// legacyProducts cuts ps down to legacyProduct. It is never nil, so an
+// empty page encodes as [] as it always has.
+func legacyProducts(ps []Product) []legacyProduct {
+	out := make([]legacyProduct, len(ps))
+	for i, p := range ps {
+		out[i] = legacyProduct{ID: p.ID, Name: p.Name, Category: p.Category, Description: p.Description, Brand: p.Brand, Matches: p.Matches}
+	}
+	return out
+}
+
+// projectProduct is projectProducts for a single product
+func projectProduct(p Product, fs fieldSet) interface{} {
+	if fs == 0 {
+		return p
+	}
+	return fs.project(&p)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// queryFields are the field:value scopes a query may contain
+var queryFields = []string{"brand", "category", "name"}
+
+// fieldTerm is one field:value scope of a query
+type fieldTerm struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// parsedQuery is q split into its field scopes and the text left over.
+// brand: and category: filter exactly like the brand and category
+// parameters; name: has to appear in the name. A leading - excludes
+// instead. Values may be quoted to hold spaces, as in name:"Product
+// Alpha". Comparisons, as in price:<2000, narrow the price range like
+// min_price and max_price. Anything else, including an unknown
+// field:value, is text.
+type parsedQuery struct {
+	Text        string       `json:"text"`
+	Brand       string       `json:"brand,omitempty"`
+	Category    string       `json:"category,omitempty"`
+	Names       []string     `json:"names,omitempty"`
+	Exclude     []fieldTerm  `json:"exclude,omitempty"`
+	Comparisons []comparison `json:"comparisons,omitempty"`
+}
+
+// scoped reports whether q had any field scopes
+func (pq *parsedQuery) scoped() bool {
+	return pq.Brand != "" || pq.Category != "" || len(pq.Names) > 0 || len(pq.Exclude) > 0 || len(pq.Comparisons) > 0
+}
+
+// parseQuery splits q into field scopes and text. Without any scopes the
+// text is q exactly as given; otherwise it is the remaining words joined
+// by single spaces.
+func parseQuery(q string) parsedQuery {
+	var pq parsedQuery
+	var text []string
+	for _, tok := range queryTokens(q) {
+		if c, ok := comparisonToken(tok); ok {
+			pq.Comparisons = append(pq.Comparisons, c)
+			continue
+		}
+		ft, negated, ok := fieldToken(tok)
+		switch {
+		case !ok:
+			text = append(text, tok)
+		case negated:
+			pq.Exclude = append(pq.Exclude, ft)
+		case ft.Field == "name":
+			pq.Names = append(pq.Names, ft.Value)
+		case ft.Field == "brand" && pq.Brand == "":
+			pq.Brand = ft.Value
+		case ft.Field == "category" && pq.Category == "":
+			pq.Category = ft.Value
+		default:
+			// A second brand: or category: can't match as well as the
+			// first, so it is kept as text rather than silently dropped
+			text = append(text, tok)
+		}
+	}
+	if !pq.scoped() {
+		pq.Text = q
+		return pq
+	}
+	pq.Text = strings.Join(text, " ")
+	return pq
+}
+
+// mergeScopes combines the brand and category parameters with the
+// query's scopes, which must agree with them
+func mergeScopes(q url.Values, pq parsedQuery, errs *fieldErrors) (brand, category string) {
+	brand, category = q.Get("brand"), q.Get("category")
+	for _, f := range []struct {
+		name         string
+		param, scope *string
+	}{{"brand", &brand, &pq.Brand}, {"category", &category, &pq.Category}} {
+		if *f.scope == "" {
+			continue
+		}
+		if *f.param != "" && !strings.EqualFold(*f.param, *f.scope) {
+			errs.add("q", fmt.Sprintf("q has %s:%s but %s=%s; give one or make them agree", f.name, *f.scope, f.name, *f.param))
+			continue
+		}
+		*f.param = *f.scope
+	}
+	return brand, category
+}
+
+// queryTokens splits q on whitespace outside double quotes, keeping the
+// quotes in the tokens
+func queryTokens(q string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out
+}
+
+// fieldToken reads [-]field:value, unquoting the value. ok is false for
+// unknown fields and empty values, which are then plain text.
+func fieldToken(tok string) (ft fieldTerm, negated, ok bool) {
+	if strings.HasPrefix(tok, "-") {
+		negated, tok = true, tok[1:]
+	}
+	field, value, found := strings.Cut(tok, ":")
+	if !found {
+		return ft, false, false
+	}
+	field = strings.ToLower(field)
+	known := false
+	for _, f := range queryFields {
+		known = known || f == field
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	if !known || strings.TrimSpace(value) == "" || strings.Contains(value, `"`) {
+		return ft, false, false
+	}
+	return fieldTerm{Field: field, Value: value}, negated, true
+}
+
+// searchText is what a search matches product text against: a lowercased
+// query, folded when fold is set, the locale whose names also count, and
+// the query's name: scopes and exclusions prepared the same way
+type searchText struct {
+	q       string
+	locale  string
+	fold    bool
+	names   []string
+	exclude []fieldTerm
+	// price is the range min_price, max_price and q's comparisons keep
+	price numberRange
+	// stock is the range q's stock comparisons keep, checked against
+	// stocks, the candidates' stock as the inventory dependency gave it
+	stock  numberRange
+	stocks map[ProductID]int
+	// positions asks the scan for each result's matches
+	positions bool
+}
+
+// newSearchText prepares a parsed query for matching
+func newSearchText(pq parsedQuery, locale string, fold bool) searchText {
+	prepare := func(v string) string {
+		v = strings.ToLower(v)
+		if fold {
+			v = foldText(v)
+		}
+		return v
+	}
+	t := searchText{q: prepare(pq.Text), locale: locale, fold: fold}
+	for _, n := range pq.Names {
+		t.names = append(t.names, prepare(n))
+	}
+	for _, ex := range pq.Exclude {
+		if ex.Field == "name" {
+			ex.Value = prepare(ex.Value)
+		}
+		t.exclude = append(t.exclude, ex)
+	}
+	return t
+}
+
+// matchesText matches t against the lowercased or folded fields
+func (sp *storedProduct) matchesText(t searchText) bool {
+	if t.q == "" {
+		return false
+	}
+	name, category, names := sp.lowerName, sp.lowerCategory, sp.lowerNames
+	if t.fold {
+		name, category, names = sp.foldedName, sp.foldedCategory, sp.foldedNames
+	}
+	if strings.Contains(name, t.q) || strings.Contains(category, t.q) {
+		return true
+	}
+	n, ok := names[t.locale]
+	return ok && strings.Contains(n, t.q)
+}
+
+// matchesStock checks t's stock comparisons against the stock the
+// inventory dependency gave sp, which is outside them if it gave none
+func (sp *storedProduct) matchesStock(t searchText) bool {
+	if !t.stock.set() {
+		return true
+	}
+	n, ok := t.stocks[sp.ID]
+	return ok && t.stock.contains(&n)
+}
+
+// matchesScopes checks t's name: scopes, which may match the localized
+// name too, and its exclusions
+func (sp *storedProduct) matchesScopes(t searchText) bool {
+	if len(t.names) == 0 && len(t.exclude) == 0 {
+		return true
+	}
+	name, names := sp.lowerName, sp.lowerNames
+	if t.fold {
+		name, names = sp.foldedName, sp.foldedNames
+	}
+	localized := names[t.locale]
+	for _, n := range t.names {
+		if !strings.Contains(name, n) && (localized == "" || !strings.Contains(localized, n)) {
+			return false
+		}
+	}
+	for _, ex := range t.exclude {
+		switch ex.Field {
+		case "brand":
+			if strings.EqualFold(sp.Brand, ex.Value) {
+				return false
+			}
+		case "category":
+			if strings.EqualFold(sp.Category, ex.Value) {
+				return false
+			}
+		case "name":
+			if strings.Contains(name, ex.Value) || (localized != "" && strings.Contains(localized, ex.Value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
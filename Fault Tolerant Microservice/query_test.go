@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		q    string
+		want parsedQuery
+	}{
+		{"Product  Alpha", parsedQuery{Text: "Product  Alpha"}},
+		{"brand:Alpha lamp", parsedQuery{Text: "lamp", Brand: "Alpha"}},
+		{"BRAND:alpha category:Books", parsedQuery{Brand: "alpha", Category: "Books"}},
+		{`name:"Product Alpha" 5`, parsedQuery{Text: "5", Names: []string{"Product Alpha"}}},
+		{"-brand:Beta -name:5 lamp", parsedQuery{Text: "lamp", Exclude: []fieldTerm{{"brand", "Beta"}, {"name", "5"}}}},
+		{"brand:Alpha brand:Beta", parsedQuery{Text: "brand:Beta", Brand: "Alpha"}},
+		// Unknown fields and empty values stay text
+		{"colour:red", parsedQuery{Text: "colour:red"}},
+		{"brand: x", parsedQuery{Text: "brand: x"}},
+		{`brand:"" x`, parsedQuery{Text: `brand:"" x`}},
+	} {
+		if got := parseQuery(tc.q); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestQueryTokens(t *testing.T) {
+	got := queryTokens(`  a name:"b c"  -d "e f`)
+	want := []string{"a", `name:"b c"`, "-d", `"e f`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSearchFieldScopes(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	perBrand := testProducts / len(brands)
+	for _, tc := range []struct {
+		q    string
+		want int
+	}{
+		{"brand:Alpha", perBrand},
+		{"brand:alpha product", perBrand},
+		{"category:Books", perBrand},
+		{"brand:Alpha category:Books", 0},
+		{"-brand:Alpha product", testProducts - perBrand},
+		{`name:"Product Beta 96"`, 1},
+		{"brand:Beta 9", 2},
+	} {
+		target := "/products/search?mode=exhaustive&q=" + url.QueryEscape(tc.q)
+		if res := search(t, h, target); res.TotalFound != tc.want {
+			t.Errorf("q=%q found %d, want %d", tc.q, res.TotalFound, tc.want)
+		}
+	}
+	if res := search(t, h, "/products/search?mode=exhaustive&brand=ALPHA&q="+url.QueryEscape("brand:alpha")); res.TotalFound != perBrand {
+		t.Errorf("agreeing brand and scope found %d", res.TotalFound)
+	}
+	if rec := serve(h, http.MethodGet, "/products/search?brand=Beta&q="+url.QueryEscape("brand:Alpha"), "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("conflicting brand and scope: %d", rec.Code)
+	}
+}
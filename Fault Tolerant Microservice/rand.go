@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// splitMix is a SplitMix64 generator. Its state is one word, so reseeding
+// it for every request is free, unlike the default source.
+type splitMix struct {
+	state uint64
+}
+
+func (s *splitMix) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+// seedSource hands out a seed per request without locking. The sequence
+// only depends on the base seed, so a fixed Config.Seed replays the same
+// sampling and chaos decisions for the same sequence of requests.
+type seedSource struct {
+	base uint64
+	seq  uint64
+}
+
+func newSeedSource(seed int64) *seedSource {
+	return &seedSource{base: uint64(seed)}
+}
+
+func (ss *seedSource) next() int64 {
+	g := splitMix{state: ss.base + atomic.AddUint64(&ss.seq, 1)*0x9e3779b97f4a7c15}
+	return g.Int63()
+}
+
+// requestRand is the random source for one request, used for both
+// sampling and chaos decisions
+type requestRand struct {
+	*rand.Rand
+	src  splitMix
+	seed int64
+}
+
+var requestRandPool = sync.Pool{New: func() interface{} {
+	rr := &requestRand{}
+	rr.Rand = rand.New(&rr.src)
+	return rr
+}}
+
+func putRequestRand(rr *requestRand) {
+	requestRandPool.Put(rr)
+}
+
+// readSeed reads seed=, falling back to the server's seed sequence
+func (s *Server) readSeed(q url.Values, errs *fieldErrors) int64 {
+	v := q.Get("seed")
+	if v == "" {
+		return s.seeds.next()
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		errs.add("seed", "seed must be an integer")
+	}
+	return n
+}
+
+// requestRandFor returns a source seeded with seed. Return it with
+// putRequestRand.
+func requestRandFor(seed int64) *requestRand {
+	rr := requestRandPool.Get().(*requestRand)
+	rr.Seed(seed)
+	rr.seed = seed
+	return rr
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSeedSourceReplays(t *testing.T) {
+	a, b := newSeedSource(7), newSeedSource(7)
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		x, y := a.next(), b.next()
+		if x != y {
+			t.Fatalf("seed %d: %d and %d from the same base", i, x, y)
+		}
+		if seen[x] || x < 0 {
+			t.Fatalf("seed %d: %d repeated or negative", i, x)
+		}
+		seen[x] = true
+	}
+	if newSeedSource(8).next() == newSeedSource(7).next() {
+		t.Error("different bases gave the same first seed")
+	}
+}
+
+func TestRequestRandReseeds(t *testing.T) {
+	draw := func(seed int64) [5]int {
+		rr := requestRandFor(seed)
+		defer putRequestRand(rr)
+		var out [5]int
+		for i := range out {
+			out[i] = rr.Intn(1000)
+		}
+		return out
+	}
+	first := draw(42)
+	draw(43)
+	// Pooled sources must not carry state from their last request
+	if again := draw(42); again != first {
+		t.Errorf("seed 42 drew %v, then %v", first, again)
+	}
+}
+
+// TestRequestRandConcurrent is for -race: every request has its own source
+func TestRequestRandConcurrent(t *testing.T) {
+	ss := newSeedSource(1)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				rr := requestRandFor(ss.next())
+				rr.Intn(100)
+				putRequestRand(rr)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestServerSeedReplaysSamples checks two servers with the same seed
+// sample the same products for the same requests
+func TestServerSeedReplaysSamples(t *testing.T) {
+	a, b := newTestServer(t, nil).Routes(), newTestServer(t, nil).Routes()
+	for i := 0; i < 3; i++ {
+		x := serve(a, http.MethodGet, "/products/search?q=product&sort=id", "", nil).Body.String()
+		y := serve(b, http.MethodGet, "/products/search?q=product&sort=id", "", nil).Body.String()
+		if x != y {
+			t.Errorf("search %d differs:\n%s\n%s", i, x, y)
+		}
+	}
+}
+
+// benchSearchers is how many searches BenchmarkConcurrentSearches keeps
+// in flight at once
+const benchSearchers = 64
+
+// BenchmarkConcurrentSearches runs sampled searches from benchSearchers
+// goroutines, each request drawing its sample and chaos decisions from
+// its own source. Admission caps are raised and coalescing is off, so
+// every search runs its own scan.
+func BenchmarkConcurrentSearches(b *testing.B) {
+	h := newTestServer(b, func(cfg *Config) {
+		cfg.NumProducts, cfg.ChecksPerSearch = 10000, 1000
+		cfg.BulkheadSize, cfg.MaxConcurrent, cfg.ClientConcurrency = 2*benchSearchers, 2*benchSearchers, 0
+		cfg.Coalesce = false
+	}).Routes()
+	var failed int64
+	b.SetParallelism((benchSearchers + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/products/search?q=alpha", nil))
+			if rec.Code != http.StatusOK {
+				atomic.AddInt64(&failed, 1)
+			}
+		}
+	})
+	if failed > 0 {
+		b.Errorf("%d searches failed", failed)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxPrice caps a product's price, in cents, and any price compared
+// against, so a bound one past it can't overflow
+const maxPrice = 1000000000
+
+// maxStock caps any stock compared against, for the same reason
+const maxStock = 1000000000
+
+// numericFields are the query fields compared as numbers, as in
+// price:<2000, rather than matched as text
+var numericFields = []string{"price", "stock"}
+
+// comparisonOps are the operators a comparison may start with, longest
+// first; a value without one is the number itself or a lo..hi range
+var comparisonOps = []string{"<=", ">=", "<", ">"}
+
+// comparison is one field:<op>value term of a query, as written. Only
+// readRanges decides whether it is valid.
+type comparison struct {
+	Field string `json:"field"`
+	// Op is one of comparisonOps, ".." for a range or "=" for a number
+	Op    string `json:"op"`
+	Value string `json:"value"`
+	// Negated comparisons are refused rather than turned around
+	Negated bool `json:"negated,omitempty"`
+}
+
+// comparisonToken reads [-]field:<op>value. Any value of a numeric field
+// is a comparison, and so is a value of another known field starting
+// with < or >, which is refused for that field rather than matched as
+// text. ok is false for anything else.
+func comparisonToken(tok string) (c comparison, ok bool) {
+	if strings.HasPrefix(tok, "-") {
+		c.Negated, tok = true, tok[1:]
+	}
+	field, value, found := strings.Cut(tok, ":")
+	if !found || value == "" {
+		return c, false
+	}
+	c.Field = strings.ToLower(field)
+	numeric := false
+	for _, f := range numericFields {
+		numeric = numeric || f == c.Field
+	}
+	known := numeric
+	for _, f := range queryFields {
+		known = known || f == c.Field
+	}
+	if !known || (!numeric && value[0] != '<' && value[0] != '>') {
+		return c, false
+	}
+	c.Op, c.Value = "=", value
+	for _, op := range comparisonOps {
+		if strings.HasPrefix(value, op) {
+			c.Op, c.Value = op, value[len(op):]
+			return c, true
+		}
+	}
+	if strings.Contains(value, "..") {
+		c.Op = ".."
+	}
+	return c, true
+}
+
+// numberRange is the inclusive bounds a search keeps a numeric field
+// within: the price in cents, from min_price and max_price and q's price
+// comparisons, which all narrow the same range, or the stock, from q's
+// stock comparisons. Nil bounds are open; a product without the number
+// is outside any range that has a bound.
+type numberRange struct {
+	min, max *int
+}
+
+// set reports whether r filters at all
+func (r numberRange) set() bool {
+	return r.min != nil || r.max != nil
+}
+
+// contains reports whether n is in r
+func (r numberRange) contains(n *int) bool {
+	if !r.set() {
+		return true
+	}
+	return n != nil && (r.min == nil || *n >= *r.min) && (r.max == nil || *n <= *r.max)
+}
+
+// narrow keeps only what is also within lo and hi
+func (r *numberRange) narrow(lo, hi *int) {
+	if lo != nil && (r.min == nil || *lo > *r.min) {
+		r.min = lo
+	}
+	if hi != nil && (r.max == nil || *hi < *r.max) {
+		r.max = hi
+	}
+}
+
+// parsePrice reads a whole number of cents from 0 to maxPrice
+func parsePrice(v string) (int, bool) {
+	return parseWhole(v, maxPrice)
+}
+
+// parseWhole reads a whole number from 0 to limit
+func parseWhole(v string, limit int) (int, bool) {
+	n, err := strconv.Atoi(v)
+	return n, err == nil && v[0] >= '0' && v[0] <= '9' && n <= limit
+}
+
+// readRanges reads min_price and max_price and combines them with q's
+// price comparisons, and reads q's stock comparisons. Comparisons on
+// other fields, negated ones and malformed numbers are reported against
+// q.
+func readRanges(q url.Values, pq parsedQuery, errs *fieldErrors) (price, stock numberRange) {
+	r := &price
+	for _, p := range []struct {
+		name  string
+		bound **int
+	}{{"min_price", &r.min}, {"max_price", &r.max}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, ok := parsePrice(v)
+		if !ok {
+			errs.add(p.name, fmt.Sprintf("%s must be a whole number of cents from 0 to %d", p.name, maxPrice))
+			continue
+		}
+		*p.bound = &n
+	}
+	if r.min != nil && r.max != nil && *r.min > *r.max {
+		errs.add("max_price", "max_price must be at least min_price")
+	}
+	for _, c := range pq.Comparisons {
+		lo, hi, msg := c.bounds()
+		if msg != "" {
+			errs.add("q", fmt.Sprintf("q has %s; %s", c, msg))
+			continue
+		}
+		if c.Field == "stock" {
+			stock.narrow(lo, hi)
+		} else {
+			price.narrow(lo, hi)
+		}
+	}
+	return price, stock
+}
+
+// bounds is the range c keeps, or why it can't be used
+func (c comparison) bounds() (lo, hi *int, msg string) {
+	switch {
+	case c.Negated:
+		return nil, nil, "comparisons can't be negated, use the opposite operator"
+	case c.Field != "price" && c.Field != "stock":
+		return nil, nil, fmt.Sprintf("%s is text, only price and stock can be compared", c.Field)
+	}
+	limit, bad := maxPrice, fmt.Sprintf("price must be compared with a whole number of cents from 0 to %d, as in price:<2000, price:>=100 or price:100..2000", maxPrice)
+	if c.Field == "stock" {
+		limit, bad = maxStock, fmt.Sprintf("stock must be compared with a whole number of units from 0 to %d, as in stock:>=1, stock:<10 or stock:1..10", maxStock)
+	}
+	if c.Op == ".." {
+		from, to, _ := strings.Cut(c.Value, "..")
+		if (from == "" && to == "") || strings.Contains(to, "..") {
+			return nil, nil, bad
+		}
+		for _, b := range []struct {
+			v     string
+			bound **int
+		}{{from, &lo}, {to, &hi}} {
+			if b.v == "" {
+				continue
+			}
+			n, ok := parseWhole(b.v, limit)
+			if !ok {
+				return nil, nil, bad
+			}
+			*b.bound = &n
+		}
+		if lo != nil && hi != nil && *lo > *hi {
+			return nil, nil, "the range is empty, its start is past its end"
+		}
+		return lo, hi, ""
+	}
+	n, ok := parseWhole(c.Value, limit)
+	if !ok {
+		return nil, nil, bad
+	}
+	switch c.Op {
+	case "<":
+		n--
+		return nil, &n, ""
+	case "<=":
+		return nil, &n, ""
+	case ">":
+		n++
+		return &n, nil, ""
+	case ">=":
+		return &n, nil, ""
+	}
+	return &n, &n, ""
+}
+
+// String is c as it was written
+func (c comparison) String() string {
+	s := c.Field + ":"
+	if c.Negated {
+		s = "-" + s
+	}
+	if c.Op == "=" || c.Op == ".." {
+		return s + c.Value
+	}
+	return s + c.Op + c.Value
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newPricedTestServer builds a server whose catalog is lamps at prices
+// either side of 2000, one with none, and one at maxPrice. Its sample is
+// smaller than the catalog, which a price filter must not use.
+func newPricedTestServer(t *testing.T, configure func(*Config)) *Server {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.NumProducts = 0
+		cfg.ChecksPerSearch = 2
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	// A price of -1 is none
+	for _, e := range []struct {
+		name  string
+		price int
+	}{{"Desk Lamp", -1}, {"Floor Lamp", 100}, {"Table Lamp", 1999}, {"Reading Lamp", 2000}, {"Lamp Shade", 2001}, {"Chandelier", maxPrice}} {
+		p := Product{Name: e.name, Category: "Home", Brand: "Alpha"}
+		if e.price >= 0 {
+			price := e.price
+			p.Price = &price
+		}
+		if _, err := s.store.create(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// TestPriceFilters searches the priced catalog with q's price comparisons
+// and the price params, expecting each to keep exactly the products in
+// range and the two ways of writing a range to agree
+func TestPriceFilters(t *testing.T) {
+	h := newPricedTestServer(t, nil).Routes()
+	cases := []struct {
+		query string
+		want  []ProductID
+	}{
+		{"q=lamp", []ProductID{0, 1, 2, 3, 4}},
+		{"q=" + url.QueryEscape("lamp price:<2000"), []ProductID{1, 2}},
+		{"q=" + url.QueryEscape("price:<=2000 lamp"), []ProductID{1, 2, 3}},
+		{"q=" + url.QueryEscape("price:>2000"), []ProductID{4, 5}},
+		{"q=" + url.QueryEscape("PRICE:>=2000 category:home"), []ProductID{3, 4, 5}},
+		{"q=" + url.QueryEscape("lamp price:100..2000"), []ProductID{1, 2, 3}},
+		{"q=lamp&min_price=100&max_price=2000", []ProductID{1, 2, 3}},
+		{"q=" + url.QueryEscape("price:..1999"), []ProductID{1, 2}},
+		{"q=" + url.QueryEscape("price:2001.."), []ProductID{4, 5}},
+		{"q=" + url.QueryEscape("price:2000"), []ProductID{3}},
+		{"q=" + url.QueryEscape("lamp price:>100") + "&min_price=1999", []ProductID{2, 3, 4}},
+		{"q=" + url.QueryEscape("price:>100 price:<100"), nil},
+		{"q=" + url.QueryEscape("price:<0"), nil},
+		{"q=" + url.QueryEscape("price:>=0"), []ProductID{1, 2, 3, 4, 5}},
+		{"q=" + url.QueryEscape("price:1000000000"), []ProductID{5}},
+	}
+	for _, mode := range []string{modeExhaustive, modeIndexed, modeSample} {
+		for _, c := range cases {
+			// Only price-filtered searches are exact in sample mode
+			if mode == modeSample && !strings.Contains(c.query, "price") {
+				continue
+			}
+			target := "/products/search?mode=" + mode + "&" + c.query
+			res := search(t, h, target)
+			got := productIDs(res.Products)
+			sortIDs(got)
+			if res.TotalFound != len(c.want) || fmt.Sprint(got) != fmt.Sprint(c.want) {
+				t.Errorf("%s: got %v of %d, want %v", target, got, res.TotalFound, c.want)
+			}
+		}
+	}
+}
+
+// newStockedTestServer is the priced catalog with the inventory dependency
+// on and never failing, so products 0 to 5 have stock 0, 3, 20, 24, 41
+// and 9
+func newStockedTestServer(t *testing.T) *Server {
+	return newPricedTestServer(t, func(cfg *Config) {
+		cfg.Inventory = true
+		cfg.InventoryErrorRate = 0
+		cfg.InventoryLatency, cfg.InventoryJitter = 0, 0
+	})
+}
+
+// TestStockFilters searches with q's stock comparisons, alone and beside
+// price ones, expecting each to keep exactly the products in range
+func TestStockFilters(t *testing.T) {
+	h := newStockedTestServer(t).Routes()
+	for _, c := range []struct {
+		q    string
+		want []ProductID
+	}{
+		{"stock:>=1", []ProductID{1, 2, 3, 4, 5}},
+		{"lamp stock:<10", []ProductID{0, 1}},
+		{"stock:20..24", []ProductID{2, 3}},
+		{"STOCK:0", []ProductID{0}},
+		{"stock:>=20 price:<2000", []ProductID{2}},
+		{"stock:>9 price:>=2000", []ProductID{3, 4}},
+		{"stock:>41", nil},
+	} {
+		for _, mode := range []string{modeExhaustive, modeIndexed, modeSample} {
+			target := "/products/search?mode=" + mode + "&q=" + url.QueryEscape(c.q)
+			res := search(t, h, target)
+			got := productIDs(res.Products)
+			sortIDs(got)
+			if res.TotalFound != len(c.want) || fmt.Sprint(got) != fmt.Sprint(c.want) {
+				t.Errorf("%s: got %v of %d, want %v", target, got, res.TotalFound, c.want)
+			}
+		}
+	}
+}
+
+// TestPriceStockFields asks for price and stock by fields= and select=,
+// expecting a missing price as an empty column or a left out key
+func TestPriceStockFields(t *testing.T) {
+	h := newStockedTestServer(t).Routes()
+	rec := serve(h, http.MethodGet, "/products/search?mode=exhaustive&sort=id&q=lamp&limit=2&format=csv&fields=id,price,stock", "", nil)
+	if want := "id,price,stock\r\n0,,0\r\n1,100,3\r\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("fields=id,price,stock: %d %q, want %q", rec.Code, rec.Body, want)
+	}
+	rec = serve(h, http.MethodGet, "/products/search?mode=exhaustive&sort=id&q=lamp&limit=2&select=price,stock", "", nil)
+	var res struct {
+		Products []map[string]any `json:"products"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("select=price,stock: decoding %q: %v", rec.Body, err)
+	}
+	if got := fmt.Sprint(res.Products); got != "[map[stock:0] map[price:100 stock:3]]" {
+		t.Errorf("select=price,stock: products %s", got)
+	}
+}
+
+// TestComparisonErrors feeds the parser malformed operators, huge numbers
+// and comparisons of other fields, expecting each refused against the
+// parameter at fault
+func TestComparisonErrors(t *testing.T) {
+	s := newPricedTestServer(t, nil)
+	for _, c := range []struct{ query, field string }{
+		{"price:<>5", "q"}, {"price:=<5", "q"}, {"price:<<5", "q"}, {"price:<", "q"}, {"price:>=", "q"},
+		{"price:..", "q"}, {"price:1..2..3", "q"}, {"price:1...5", "q"}, {"price:5..3", "q"},
+		{"price:1.5", "q"}, {"price:-5", "q"}, {"price:+5", "q"}, {"price:-0", "q"}, {"price:abc", "q"}, {"price:0x10", "q"},
+		{"price:<9223372036854775808", "q"}, {"price:>9223372036854775807", "q"},
+		{"price:<" + strings.Repeat("9", 400), "q"}, {"price:1000000001", "q"},
+		{"brand:<alpha", "q"}, {"name:>=lamp", "q"}, {"category:<5", "q"}, {"stock:>=1", "q"}, {"-price:<5", "q"},
+	} {
+		_, errs := s.parseSearchRequest(&http.Request{URL: &url.URL{RawQuery: "q=" + url.QueryEscape(c.query)}, Header: http.Header{}})
+		if len(errs) != 1 || errs[0].Field != c.field {
+			t.Errorf("q=%s: errors %v, want one for %s", c.query, errs, c.field)
+		}
+	}
+	for _, c := range []struct{ query, field string }{
+		{"min_price=-1", "min_price"}, {"max_price=1e3", "max_price"}, {"min_price=9223372036854775808", "min_price"},
+		{"max_price=1000000001", "max_price"}, {"min_price=2000&max_price=1999", "max_price"},
+	} {
+		_, errs := s.parseSearchRequest(&http.Request{URL: &url.URL{RawQuery: c.query}, Header: http.Header{}})
+		if len(errs) != 1 || errs[0].Field != c.field {
+			t.Errorf("%s: errors %v, want one for %s", c.query, errs, c.field)
+		}
+	}
+	// Unknown fields, and known text fields compared with neither < nor >,
+	// are text as before
+	for _, q := range []string{"weight:<5", "price:", "name:a..b"} {
+		if pq := parseQuery(q); len(pq.Comparisons) != 0 {
+			t.Errorf("%q parsed as comparisons %v", q, pq.Comparisons)
+		}
+	}
+}
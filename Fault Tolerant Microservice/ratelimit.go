@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"productsearch/resilience"
+)
+
+// rateLimiter is the HTTP side of the per client token buckets: it keys
+// them by client and counts rejections
+type rateLimiter struct {
+	*resilience.RateLimiter
+	rejected int64
+	statsd   *statsdClient
+	proxies  ipAllowlist
+	// status is what a rejection is sent with
+	status rejectionStatuses
+	// redis is the shared bucket store and its breaker, nil when the
+	// buckets are in memory
+	redis        *redisBuckets
+	storeBreaker *resilience.Breaker
+}
+
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	return &rateLimiter{RateLimiter: resilience.NewRateLimiter(rate, burst, clock)}
+}
+
+// client identifies the caller: its API key when it presented a valid
+// one, otherwise its address as resolved through any trusted proxies, so
+// clients behind a load balancer don't share its bucket
+func (l *rateLimiter) client(r *http.Request) string {
+	if info := requestInfoFrom(r); info != nil && info.KeyName != "" {
+		return "key:" + info.KeyName
+	}
+	if ip := clientIP(r, l.proxies); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, st resilience.BucketState) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(st.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(st.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(st.Reset.Seconds()))))
+}
+
+// limit wraps a handler with the per client token bucket
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.Enabled() {
+			next(w, r)
+			return
+		}
+		st := l.Take(l.client(r))
+		setRateLimitHeaders(w, st)
+		if !st.Allowed {
+			atomic.AddInt64(&l.rejected, 1)
+			l.statsd.incr("ratelimit.rejected")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(st.RetryAfter.Seconds()))))
+			writeErr(w, r, l.status.reject(ErrRateLimited, rejectRateLimit, "Rate limit exceeded"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// storeStats reports where the buckets are kept and, for a shared store,
+// how calls to it went and how many fell back to local buckets
+func (l *rateLimiter) storeStats() map[string]interface{} {
+	if l.redis == nil {
+		return map[string]interface{}{"store": rateLimitStoreMemory}
+	}
+	_, fallbacks := l.Shared()
+	st := l.redis.stats()
+	st["store"] = rateLimitStoreRedis
+	st["circuit"] = resilience.StateName(l.storeBreaker.State())
+	st["local_fallbacks"] = fallbacks
+	return st
+}
+
+// rateLimitHandler reports the caller's bucket without consuming from it
+func (s *Server) rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	client := s.limiter.client(r)
+	if !s.limiter.Enabled() {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false, "client": client})
+		return
+	}
+	st := s.limiter.Peek(client)
+	setRateLimitHeaders(w, st)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":       true,
+		"client":        client,
+		"limit":         st.Limit,
+		"remaining":     st.Remaining,
+		"reset_s":       st.Reset.Seconds(),
+		"retry_after_s": st.RetryAfter.Seconds(),
+		"rate_per_s":    s.limiter.Rate(),
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"productsearch/resilience"
+)
+
+// isReady reports whether the instance should receive traffic: the
+// catalog is loaded, the cache warmup is over and the breaker isn't
+// open. Degraded persistence doesn't count: searches don't need the disk.
+func (s *Server) isReady() bool {
+	return atomic.LoadInt32(&s.catalogLoaded) == 1 && atomic.LoadInt32(&s.warming) == 0 &&
+		s.breaker.State() != resilience.StateOpen
+}
+
+// updateReadiness re-evaluates readiness and announces a change
+func (s *Server) updateReadiness() {
+	s.readyLock.Lock()
+	now := s.isReady()
+	changed := now != s.ready
+	s.ready = now
+	s.readyLock.Unlock()
+	if !changed || s.tenant != "" {
+		// A tenant's readiness isn't the instance's, which /readyz and the
+		// webhooks report
+		return
+	}
+	event := "readiness.down"
+	if now {
+		event = "readiness.up"
+	}
+	log.Println("Readiness:", event)
+	s.cfg.Webhooks.notify(event, map[string]interface{}{
+		"ready":   now,
+		"circuit": resilience.StateName(s.breaker.State()),
+	})
+}
+
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if !s.isReady() {
+		status = http.StatusServiceUnavailable
+	}
+	resp := map[string]interface{}{
+		"ready":          status == http.StatusOK,
+		"catalog_loaded": atomic.LoadInt32(&s.catalogLoaded) == 1,
+		"circuit":        resilience.StateName(s.breaker.State()),
+		"persistence":    s.persistenceStatus(),
+	}
+	if wu := s.warmupStatus(); wu != nil {
+		resp["cache_warmup"] = wu
+	}
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// recordedHeaders are the only headers kept in a traffic record.
+// Credentials and cookies are never written.
+var recordedHeaders = []string{"Accept", "Accept-Encoding", "User-Agent", "X-Request-Id"}
+
+// trafficRecord is one line of a recording. productctl replay reads the
+// same format.
+type trafficRecord struct {
+	OffsetMS float64           `json:"t_ms"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Query    string            `json:"query,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// trafficRecorder appends sampled request records to a file. Requests
+// only enqueue; a single writer goroutine does the I/O and stops writing
+// once maxBytes is reached.
+type trafficRecorder struct {
+	start    time.Time
+	sample   float64
+	maxBytes int64
+	queue    chan trafficRecord
+
+	written int64
+	dropped int64
+	bytes   int64
+}
+
+var recorder *trafficRecorder
+
+// newTrafficRecorder truncates file and starts the writer
+func newTrafficRecorder(file string, sample float64, maxBytes int64) (*trafficRecorder, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	rec := &trafficRecorder{
+		start:    time.Now(),
+		sample:   sample,
+		maxBytes: maxBytes,
+		queue:    make(chan trafficRecord, 1024),
+	}
+	go rec.writeLoop(f)
+	return rec, nil
+}
+
+func (t *trafficRecorder) writeLoop(f *os.File) {
+	bw := bufio.NewWriter(f)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case rec := <-t.queue:
+			b, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			if atomic.LoadInt64(&t.bytes)+int64(len(b))+1 > t.maxBytes {
+				atomic.AddInt64(&t.dropped, 1)
+				continue
+			}
+			bw.Write(b)
+			bw.WriteByte('\n')
+			atomic.AddInt64(&t.bytes, int64(len(b))+1)
+			atomic.AddInt64(&t.written, 1)
+		case <-flush.C:
+			if err := bw.Flush(); err != nil {
+				log.Println("Traffic recorder:", err)
+			}
+		}
+	}
+}
+
+// record enqueues r if it is sampled, dropping it when the writer is
+// behind or the file is full
+func (t *trafficRecorder) record(r *http.Request) {
+	if t.sample < 1 && rand.Float64() >= t.sample {
+		return
+	}
+	if atomic.LoadInt64(&t.bytes) >= t.maxBytes {
+		atomic.AddInt64(&t.dropped, 1)
+		return
+	}
+	rec := trafficRecord{
+		OffsetMS: float64(time.Since(t.start).Microseconds()) / 1000,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+	}
+	for _, h := range recordedHeaders {
+		if v := r.Header.Get(h); v != "" {
+			if rec.Headers == nil {
+				rec.Headers = make(map[string]string)
+			}
+			rec.Headers[h] = v
+		}
+	}
+	select {
+	case t.queue <- rec:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// recordMiddleware records GET and HEAD requests when a recorder is
+// configured. Request bodies aren't kept, so writes couldn't be replayed
+// faithfully and aren't recorded at all.
+func recordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if recorder != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			recorder.record(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recorderStats reports the recorder for /stats
+func recorderStats() map[string]interface{} {
+	if recorder == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return map[string]interface{}{
+		"enabled":   true,
+		"sample":    recorder.sample,
+		"written":   atomic.LoadInt64(&recorder.written),
+		"dropped":   atomic.LoadInt64(&recorder.dropped),
+		"bytes":     atomic.LoadInt64(&recorder.bytes),
+		"max_bytes": recorder.maxBytes,
+	}
+}
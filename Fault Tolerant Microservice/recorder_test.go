@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newRecordingTestServer records every request to path, up to maxBytes,
+// for the life of the test
+func newRecordingTestServer(t *testing.T, path string, maxBytes int64) http.Handler {
+	t.Helper()
+	rec, err := newTrafficRecorder(path, 1, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = rec
+	t.Cleanup(func() { recorder = nil })
+	return newTestServer(t, nil).Routes()
+}
+
+// readRecording waits for the writer to flush want records to path
+func readRecording(t *testing.T, path string, want int) []trafficRecord {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recs []trafficRecord
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var r trafficRecord
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				t.Fatalf("line %d: %v", len(recs)+1, err)
+			}
+			recs = append(recs, r)
+		}
+		f.Close()
+		if len(recs) >= want || time.Now().After(deadline) {
+			return recs
+		}
+	}
+}
+
+// TestRecorderSanitizes records reads in order with the headers a replay
+// needs and no credentials, and leaves writes out
+func TestRecorderSanitizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	h := newRecordingTestServer(t, path, 1<<20)
+	header := http.Header{"Accept": {"application/json"}, "X-Request-Id": {"req-1"}}
+	header.Set("Authorization", "Bearer secret-key")
+	header.Set("X-Api-Key", "secret-key")
+	header.Set("Cookie", "session=secret")
+	serve(h, http.MethodGet, "/products/search?q=alpha&limit=5", "", header)
+	serve(h, http.MethodPost, "/products", `{"name":"Lamp","category":"Home","brand":"Delta"}`, http.Header{"Content-Type": {"application/json"}})
+	serve(h, http.MethodGet, "/products/7", "", nil)
+
+	recs := readRecording(t, path, 2)
+	if len(recs) != 2 {
+		t.Fatalf("recorded %+v, want the two reads", recs)
+	}
+	first, second := recs[0], recs[1]
+	if first.Method != http.MethodGet || first.Path != "/products/search" || first.Query != "q=alpha&limit=5" || second.Path != "/products/7" {
+		t.Errorf("recorded %+v", recs)
+	}
+	if len(first.Headers) != 2 || first.Headers["Accept"] != "application/json" || first.Headers["X-Request-Id"] != "req-1" {
+		t.Errorf("recorded headers %v, want only Accept and X-Request-Id", first.Headers)
+	}
+	if first.OffsetMS < 0 || second.OffsetMS < first.OffsetMS {
+		t.Errorf("offsets %v then %v", first.OffsetMS, second.OffsetMS)
+	}
+}
+
+// TestRecorderCapped stops writing at the size cap, counting what it
+// dropped, while requests are still served
+func TestRecorderCapped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	const maxBytes = 300
+	h := newRecordingTestServer(t, path, maxBytes)
+	for i := 0; i < 20; i++ {
+		if rec := serve(h, http.MethodGet, "/products/search?q=alpha", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("search %d: %d", i, rec.Code)
+		}
+	}
+	var st struct {
+		Recorder struct {
+			Written int64 `json:"written"`
+			Dropped int64 `json:"dropped"`
+			Bytes   int64 `json:"bytes"`
+		} `json:"recorder"`
+	}
+	// Reading /stats is recorded too, so the counts pass 20 once every
+	// search is in them
+	for deadline := time.Now().Add(10 * time.Second); st.Recorder.Written+st.Recorder.Dropped < 20 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if err := json.Unmarshal(serve(h, http.MethodGet, "/stats", "", nil).Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.Recorder.Written == 0 || st.Recorder.Dropped == 0 || st.Recorder.Written+st.Recorder.Dropped < 20 || st.Recorder.Bytes > maxBytes {
+		t.Errorf("recorder stats %+v for 20 searches capped at %d bytes", st.Recorder, maxBytes)
+	}
+	recs := readRecording(t, path, int(st.Recorder.Written))
+	if info, err := os.Stat(path); err != nil || info.Size() > maxBytes || int64(len(recs)) != st.Recorder.Written {
+		t.Errorf("file of %d records, %v: %v", len(recs), info.Size(), err)
+	}
+}
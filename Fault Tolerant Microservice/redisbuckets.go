@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// Rate limit bucket stores
+const (
+	rateLimitStoreMemory = "memory"
+	rateLimitStoreRedis  = "redis"
+)
+
+// redisPoolSize is how many idle connections are kept for reuse; more are
+// dialled while every one is busy and closed once done
+const redisPoolSize = 8
+
+// redisFailThreshold is how many failed calls in a row open the store's
+// breaker, limiting locally until it half-opens again
+const redisFailThreshold = 3
+
+// redisBucketScript is MemoryStore's token bucket as one Lua script, so
+// the refill and the take are a single atomic step in Redis however many
+// instances share the key. ARGV is rate, burst, now in milliseconds, and
+// 1 to take or 0 to peek; it returns whether a token was available and
+// the tokens left. A peek writes nothing. A bucket expires once it would
+// have refilled, since a full bucket is the same as none.
+//
+// Tokens are returned as a string, since Redis truncates Lua numbers to
+// integers.
+const redisBucketScript = `
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local now, take = tonumber(ARGV[3]), ARGV[4] == '1'
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(b[1]), tonumber(b[2])
+if not tokens then
+  tokens, last = burst, now
+end
+if now > last then
+  tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+  last = now
+end
+local allowed = tokens >= 1
+if take then
+  if allowed then
+    tokens = tokens - 1
+  end
+  redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(last))
+  redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+end
+return {allowed and 1 or 0, tostring(tokens)}
+`
+
+var redisBucketSHA = func() string {
+	sum := sha1.Sum([]byte(redisBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisError is an error reply. The connection is still good after one,
+// unlike after any other error.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisBuckets is a resilience.BucketStore in Redis, shared by every
+// instance configured with the same address and key prefix. It speaks
+// just enough RESP for the bucket script, over a small pool of
+// connections, each call bounded by timeout.
+type redisBuckets struct {
+	addr     string
+	password string
+	prefix   string
+	timeout  time.Duration
+	idle     chan *redisConn
+
+	calls  int64
+	errors int64
+
+	mu      sync.Mutex
+	lastErr string
+}
+
+func newRedisBuckets(addr, password, prefix string, timeout time.Duration) *redisBuckets {
+	return &redisBuckets{addr: addr, password: password, prefix: prefix, timeout: timeout, idle: make(chan *redisConn, redisPoolSize)}
+}
+
+func (rb *redisBuckets) Take(key string, rate float64, burst int, now time.Time) (resilience.BucketState, error) {
+	return rb.run(key, rate, burst, now, true)
+}
+
+func (rb *redisBuckets) Peek(key string, rate float64, burst int, now time.Time) (resilience.BucketState, error) {
+	return rb.run(key, rate, burst, now, false)
+}
+
+func (rb *redisBuckets) run(key string, rate float64, burst int, now time.Time, take bool) (resilience.BucketState, error) {
+	atomic.AddInt64(&rb.calls, 1)
+	op := "0"
+	if take {
+		op = "1"
+	}
+	args := []string{rb.prefix + key, strconv.FormatFloat(rate, 'g', -1, 64), strconv.Itoa(burst), strconv.FormatInt(now.UnixMilli(), 10), op}
+	reply, err := rb.do(append([]string{"EVALSHA", redisBucketSHA, "1"}, args...)...)
+	if e, ok := err.(redisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		// First use since Redis started, or its script cache was
+		// flushed; EVAL caches it again
+		reply, err = rb.do(append([]string{"EVAL", redisBucketScript, "1"}, args...)...)
+	}
+	if err == nil {
+		var st resilience.BucketState
+		if st, err = bucketReply(reply, rate, burst); err == nil {
+			return st, nil
+		}
+	}
+	atomic.AddInt64(&rb.errors, 1)
+	rb.mu.Lock()
+	rb.lastErr = err.Error()
+	rb.mu.Unlock()
+	return resilience.BucketState{}, err
+}
+
+func bucketReply(reply interface{}, rate float64, burst int) (resilience.BucketState, error) {
+	vals, ok := reply.([]interface{})
+	if ok && len(vals) == 2 {
+		allowed, ok1 := vals[0].(int64)
+		left, ok2 := vals[1].(string)
+		if tokens, err := strconv.ParseFloat(left, 64); ok1 && ok2 && err == nil {
+			return resilience.StateOf(tokens, rate, burst, allowed == 1), nil
+		}
+	}
+	return resilience.BucketState{}, fmt.Errorf("redis: unexpected bucket script reply %v", reply)
+}
+
+// ping checks the store can be reached, for the startup log
+func (rb *redisBuckets) ping() error {
+	_, err := rb.do("PING")
+	return err
+}
+
+// do sends one command on a pooled connection. A connection that failed
+// for any reason but an error reply is closed rather than pooled, since
+// it may be part way through a reply.
+func (rb *redisBuckets) do(args ...string) (interface{}, error) {
+	c, err := rb.conn()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(rb.timeout))
+	reply, err := c.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.Close()
+		return nil, err
+	}
+	select {
+	case rb.idle <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+func (rb *redisBuckets) conn() (*redisConn, error) {
+	select {
+	case c := <-rb.idle:
+		return c, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", rb.addr, rb.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if rb.password != "" {
+		c.SetDeadline(time.Now().Add(rb.timeout))
+		if _, err := c.do("AUTH", rb.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (rb *redisBuckets) stats() map[string]interface{} {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return map[string]interface{}{
+		"addr":       rb.addr,
+		"prefix":     rb.prefix,
+		"timeout_ms": durationMS(rb.timeout),
+		"calls":      atomic.LoadInt64(&rb.calls),
+		"errors":     atomic.LoadInt64(&rb.errors),
+		"last_error": rb.lastErr,
+		"idle_conns": len(rb.idle),
+	}
+}
+
+// redisConn is one connection to Redis
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do writes args as a RESP array of bulk strings and reads the reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses one reply: a string for simple and bulk strings, int64 for
+// integers, []interface{} for arrays, nil for null, and a redisError
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		vals := make([]interface{}, n)
+		for i := range vals {
+			v, err := c.read()
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+			vals[i] = v
+		}
+		return vals, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// onRateLimitStoreTransition announces the shared store's breaker
+// opening, when every instance starts limiting alone, and closing again
+func (s *Server) onRateLimitStoreTransition(from, to int32) {
+	log.Printf("Rate limit store circuit %s -> %s", resilience.StateName(from), resilience.StateName(to))
+	s.statsd.incr("ratelimit.store.transition", "from:"+resilience.StateName(from), "to:"+resilience.StateName(to))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks enough RESP to run the bucket script, in Go: its
+// script cache starts empty, so the first EVALSHA gets NOSCRIPT
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	scripts map[string]bool
+	buckets map[string][2]float64
+	evals   int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, scripts: map[string]bool{}, buckets: map[string][2]float64{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "EVAL" || cmd == "EVALSHA":
+			reply = f.eval(cmd, args[1:])
+		default:
+			reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+// eval runs redisBucketScript, as Redis would, on script, numkeys, key,
+// rate, burst, now and take
+func (f *fakeRedis) eval(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cmd == "EVAL" {
+		if args[0] != redisBucketScript {
+			return "-ERR not the bucket script\r\n"
+		}
+		f.scripts[redisBucketSHA] = true
+	} else if !f.scripts[args[0]] {
+		return "-NOSCRIPT No matching script\r\n"
+	}
+	f.evals++
+	key := args[2]
+	rate, _ := strconv.ParseFloat(args[3], 64)
+	burst, _ := strconv.ParseFloat(args[4], 64)
+	now, _ := strconv.ParseFloat(args[5], 64)
+	b, ok := f.buckets[key]
+	if !ok {
+		b = [2]float64{burst, now}
+	}
+	if now > b[1] {
+		b = [2]float64{math.Min(burst, b[0]+(now-b[1])/1000*rate), now}
+	}
+	allowed := 0
+	if b[0] >= 1 {
+		allowed = 1
+	}
+	if args[6] == "1" {
+		b[0] -= float64(allowed)
+		f.buckets[key] = b
+	}
+	tokens := strconv.FormatFloat(b[0], 'g', -1, 64)
+	return fmt.Sprintf("*2\r\n:%d\r\n$%d\r\n%s\r\n", allowed, len(tokens), tokens)
+}
+
+// readCommand reads one RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisBucketsTake(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	rb := newRedisBuckets(f.ln.Addr().String(), "secret", "test:", time.Second)
+	if err := rb.ping(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	for i, want := range []bool{true, true, false} {
+		st, err := rb.Take("client", 1, 2, now)
+		if err != nil || st.Allowed != want || st.Limit != 2 {
+			t.Fatalf("take %d: %+v %v", i, st, err)
+		}
+	}
+	// A peek after half a second sees half a token, and doesn't write
+	st, err := rb.Peek("client", 1, 2, now.Add(500*time.Millisecond))
+	if err != nil || st.Allowed || st.RetryAfter != 500*time.Millisecond {
+		t.Errorf("peek: %+v %v", st, err)
+	}
+	if st, _ := rb.Take("client", 1, 2, now.Add(time.Second)); !st.Allowed || st.Remaining != 0 {
+		t.Errorf("a second later: %+v", st)
+	}
+	f.mu.Lock()
+	_, prefixed := f.buckets["test:client"]
+	evals := f.evals
+	f.mu.Unlock()
+	if !prefixed {
+		t.Errorf("no bucket under the key prefix")
+	}
+	// Only the first call missed the script cache
+	if st := rb.stats(); st["calls"] != int64(5) || st["errors"] != int64(0) || evals != 5 {
+		t.Errorf("stats %v after %d evaluations", st, evals)
+	}
+}
+
+func TestRedisBucketsErrors(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	rb := newRedisBuckets(f.ln.Addr().String(), "wrong", "test:", time.Second)
+	if _, err := rb.Take("client", 1, 2, time.Unix(1000, 0)); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("with the wrong password: %v", err)
+	}
+	f.ln.Close()
+	rb = newRedisBuckets(f.ln.Addr().String(), "secret", "test:", 100*time.Millisecond)
+	if _, err := rb.Take("client", 1, 2, time.Unix(1000, 0)); err == nil {
+		t.Errorf("took a token from a closed server")
+	}
+	if st := rb.stats(); st["errors"] != int64(1) || st["last_error"] == "" {
+		t.Errorf("stats after a failure: %v", st)
+	}
+}
+
+// TestRedisRateLimitShared runs two servers on one Redis: a client gets
+// one burst between them, not one each
+func TestRedisRateLimitShared(t *testing.T) {
+	f := newFakeRedis(t, "")
+	var hs []http.Handler
+	for i := 0; i < 2; i++ {
+		hs = append(hs, newTestServer(t, func(cfg *Config) {
+			cfg.RateLimitRPS, cfg.RateLimitBurst = 0.001, 2
+			cfg.RateLimitStore, cfg.RateLimitRedisAddr = rateLimitStoreRedis, f.ln.Addr().String()
+		}).Routes())
+	}
+	var codes []int
+	for i := 0; i < 4; i++ {
+		codes = append(codes, serve(hs[i%2], http.MethodGet, "/v1/products/1", "", nil).Code)
+	}
+	if fmt.Sprint(codes) != "[200 200 429 429]" {
+		t.Errorf("alternating instances answered %v", codes)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	defaultRelatedLimit = 5
+	maxRelatedLimit     = 50
+	// relatedScanLimit is how many products sharing the brand, and how
+	// many sharing the category, are scored for one request. They are
+	// taken nearest the target in ID order, which keeps the work bounded
+	// however large those groups get.
+	relatedScanLimit = 500
+)
+
+// Similarity weights. Shared name words add their inverse document
+// frequency, so a word every product has counts for next to nothing.
+const (
+	relatedBrandWeight    = 2
+	relatedCategoryWeight = 1
+)
+
+// relatedProduct is a product with its similarity to the target
+type relatedProduct struct {
+	Product
+	Score float64 `json:"score"`
+}
+
+// related returns up to limit products most similar to sp, best first.
+// Candidates come from the brand and category indexes only.
+func (s *productStore) related(sp *storedProduct, limit int) []relatedProduct {
+	s.listLock.RLock()
+	byBrand := nearestIDs(s.brandIndex[strings.ToLower(sp.Brand)], sp.ID, relatedScanLimit)
+	byCategory := nearestIDs(s.categoryIndex[sp.lowerCategory], sp.ID, relatedScanLimit)
+	weights := make(map[string]float64)
+	total := float64(len(s.list))
+	for _, t := range productTokens(sp) {
+		if df := s.vocab[t]; df > 0 {
+			weights[t] = math.Log(total / float64(df))
+		}
+	}
+	s.listLock.RUnlock()
+
+	seen := map[ProductID]struct{}{sp.ID: {}}
+	var out []relatedProduct
+	for _, ids := range [][]ProductID{byBrand, byCategory} {
+		for _, id := range ids {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			c, ok := s.lookup(id)
+			if !ok {
+				continue
+			}
+			out = append(out, relatedProduct{Product: c.Product, Score: similarity(sp, &c, weights)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		di, dj := abs(int(out[i].ID-sp.ID)), abs(int(out[j].ID-sp.ID))
+		if di != dj {
+			return di < dj
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// similarity scores c against target: brand and category matches plus
+// the weight of every name or category word they share
+func similarity(target, c *storedProduct, weights map[string]float64) float64 {
+	score := 0.0
+	if target.Brand != "" && strings.EqualFold(c.Brand, target.Brand) {
+		score += relatedBrandWeight
+	}
+	if target.lowerCategory != "" && c.lowerCategory == target.lowerCategory {
+		score += relatedCategoryWeight
+	}
+	for _, t := range productTokens(c) {
+		score += weights[t]
+	}
+	return math.Round(score*1000) / 1000
+}
+
+// nearestIDs takes up to n IDs from a sorted list, walking outwards from
+// where id sits in it
+func nearestIDs(ids []ProductID, id ProductID, n int) []ProductID {
+	if len(ids) <= n {
+		return append([]ProductID(nil), ids...)
+	}
+	i := searchID(ids, id)
+	lo, hi := i-1, i
+	out := make([]ProductID, 0, n)
+	for len(out) < n {
+		switch {
+		case lo >= 0 && (hi >= len(ids) || id-ids[lo] <= ids[hi]-id):
+			out = append(out, ids[lo])
+			lo--
+		default:
+			out = append(out, ids[hi])
+			hi++
+		}
+	}
+	return out
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// relatedProductsHandler lists the products most like the given one
+func (s *Server) relatedProductsHandler(w http.ResponseWriter, r *http.Request) {
+	start := s.clock.Now()
+	id, ok := productID(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultRelatedLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRelatedLimit {
+			writeErr(w, r, invalid("limit", fmt.Sprintf("limit must be between 1 and %d", maxRelatedLimit)))
+			return
+		}
+		limit = n
+	}
+	sp, ok := s.store.lookup(id)
+	if !ok {
+		writeErr(w, r, errProductNotFound)
+		return
+	}
+	related := s.store.related(&sp, limit)
+	if s.envelopes(r) {
+		// One page: the best matches, however many there are
+		meta := envelopeMeta{Total: len(related), Limit: limit, ElapsedMS: durationMS(s.reported(s.clock.Since(start)))}
+		writeJSON(w, http.StatusOK, newEnvelope(w, r, related, len(related), meta, nil))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":       id,
+		"products": related,
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestRelatedProducts ranks products sharing the brand, the category and
+// rare name words above ones sharing less, scoring only products from the
+// brand and category indexes, and leaves out the product itself and
+// deleted ones
+func TestRelatedProducts(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	create := func(body string) ProductID {
+		t.Helper()
+		rec := serve(h, http.MethodPost, "/products", body, http.Header{"Content-Type": {"application/json"}})
+		var p Product
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("create %s: %d %s", body, rec.Code, rec.Body)
+		}
+		return p.ID
+	}
+	target := create(`{"name":"Quasar Lantern","category":"Home","brand":"Delta","description":"d"}`)
+	mini := create(`{"name":"Quasar Lantern Mini","category":"Home","brand":"Delta","description":"d"}`)
+	desk := create(`{"name":"Quasar Desk","category":"Home","brand":"Nobody","description":"d"}`)
+	toy := create(`{"name":"Quasar Lantern Toy","category":"Toys","brand":"Nobody","description":"d"}`)
+
+	related := func(target string) []relatedProduct {
+		t.Helper()
+		rec := serve(h, http.MethodGet, target, "", nil)
+		var res struct {
+			Products []relatedProduct `json:"products"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+		return res.Products
+	}
+	got := related(fmt.Sprintf("/products/%d/related?limit=10", target))
+	if len(got) != 10 || got[0].ID != mini || got[1].ID != desk {
+		t.Fatalf("related %+v, want %d then %d first", got, mini, desk)
+	}
+	for i, p := range got {
+		switch {
+		case p.ID == target:
+			t.Errorf("the product itself is related to itself")
+		case p.ID == toy || p.Brand != "Delta" && p.Category != "Home":
+			t.Errorf("%+v shares neither brand nor category, yet was scored", p)
+		case i > 0 && p.Score > got[i-1].Score:
+			t.Errorf("%d: score %v above %v", i, p.Score, got[i-1].Score)
+		}
+	}
+	if got := related(fmt.Sprintf("/products/%d/related", target)); len(got) != defaultRelatedLimit {
+		t.Errorf("%d related by default, want %d", len(got), defaultRelatedLimit)
+	}
+
+	if rec := serve(h, http.MethodDelete, fmt.Sprintf("/products/%d", mini), "", nil); rec.Code != http.StatusNoContent && rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	if got := related(fmt.Sprintf("/products/%d/related", target)); got[0].ID != desk {
+		t.Errorf("after deleting %d: %+v", mini, got)
+	}
+
+	for target, want := range map[string]int{
+		"/products/999999/related":                           http.StatusNotFound,
+		fmt.Sprintf("/products/%d/related", mini):            http.StatusNotFound,
+		fmt.Sprintf("/products/%d/related?limit=0", target):  http.StatusBadRequest,
+		fmt.Sprintf("/products/%d/related?limit=51", target): http.StatusBadRequest,
+	} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != want {
+			t.Errorf("%s: %d, want %d", target, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package resilience
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Breaker states
+const (
+	StateClosed int32 = iota
+	StateOpen
+	StateHalfOpen
+)
+
+// StateName is the lowercase name of a breaker state: closed, open or
+// half_open
+func StateName(s int32) string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// StateByName is the inverse of StateName; unknown names are closed
+func StateByName(name string) int32 {
+	switch name {
+	case "open":
+		return StateOpen
+	case "half_open":
+		return StateHalfOpen
+	}
+	return StateClosed
+}
+
+// Breaker trip policies. Consecutive opens after Threshold failures in a
+// row, so any success in between starts the count again. Windowed opens
+// once the failure rate over the recent Window reaches FailureRate, given
+// at least MinRequests outcomes.
+const (
+	PolicyWindowed    = "windowed"
+	PolicyConsecutive = "consecutive"
+)
+
+// Policies are the trip policies a BreakerConfig may name
+var Policies = []string{PolicyWindowed, PolicyConsecutive}
+
+// Why a breaker last opened. Failures is the trip policy; Latency is the
+// slow call detector.
+const (
+	ReasonFailures = "failures"
+	ReasonLatency  = "latency"
+	ReasonForced   = "forced"
+)
+
+// BreakerConfig holds the trip policy and its parameters. Cooldown is how
+// long an open breaker waits before letting a trial call through.
+//
+// SlowCall, when positive, also opens the breaker on latency, whatever
+// the policy: once the SlowPercentile latency of successful calls over
+// SlowWindow has stayed above SlowCall for SlowSustain, given at least
+// SlowMinCalls calls in the window. A half-open trial slower than
+// SlowCall reopens it.
+type BreakerConfig struct {
+	Policy      string
+	Threshold   int
+	Window      time.Duration
+	FailureRate float64
+	MinRequests int
+	Cooldown    time.Duration
+
+	SlowCall       time.Duration
+	SlowPercentile float64
+	SlowWindow     time.Duration
+	SlowSustain    time.Duration
+	SlowMinCalls   int
+}
+
+// Validate checks the parameters the policy needs
+func (c BreakerConfig) Validate() error {
+	switch c.Policy {
+	case PolicyConsecutive:
+		if c.Threshold < 1 {
+			return fmt.Errorf("breaker: consecutive threshold must be at least 1")
+		}
+	case PolicyWindowed:
+		if c.Window <= 0 || c.FailureRate <= 0 || c.FailureRate > 1 || c.MinRequests < 1 {
+			return fmt.Errorf("breaker: windowed policy needs a positive window, a failure rate in (0, 1] and min requests of at least 1")
+		}
+	default:
+		return fmt.Errorf("breaker: unknown policy %q, want windowed or consecutive", c.Policy)
+	}
+	if c.SlowCall > 0 && (c.SlowPercentile <= 0 || c.SlowPercentile >= 1 || c.SlowWindow <= 0 || c.SlowSustain < 0 || c.SlowMinCalls < 1) {
+		return fmt.Errorf("breaker: slow call detection needs a percentile in (0, 1), a positive window, a sustain of at least 0 and min calls of at least 1")
+	}
+	return nil
+}
+
+// OpenError is returned by Do while the breaker is open. RetryAfter is
+// the cooldown left, zero when the breaker was forced open.
+type OpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("circuit open, retry in %s", e.RetryAfter.Round(time.Millisecond))
+	}
+	return "circuit open"
+}
+
+// Breaker is a circuit breaker. It is safe for concurrent use; the hot
+// path is lock free except for the windowed policy's counters.
+type Breaker struct {
+	state int32
+	// failures counts consecutive failures under either policy
+	failures int64
+	forced   int32
+	// lastFailure is the UnixNano time of the latest failure, 0 if none
+	lastFailure int64
+	// restoredFrom is the UnixNano save time of the state this breaker
+	// was restored from, 0 if it started fresh
+	restoredFrom int64
+	cfg          BreakerConfig
+	window       *outcomeWindow
+	clock        Clock
+	onTransition func(from, to int32)
+
+	// reason is why the breaker last opened, one of the Reason constants
+	reason       atomic.Value
+	latency      *latencyWindow
+	slowCalls    int64
+	failureOpens int64
+	latencyOpens int64
+}
+
+// NewBreaker makes a closed breaker. onTransition, if not nil, is called
+// once for every state change, from the goroutine that caused it.
+func NewBreaker(cfg BreakerConfig, clock Clock, onTransition func(from, to int32)) (*Breaker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	b := &Breaker{cfg: cfg, clock: orSystem(clock), onTransition: onTransition}
+	if cfg.Policy == PolicyWindowed {
+		b.window = newOutcomeWindow(cfg.Window)
+	}
+	if cfg.SlowCall > 0 {
+		b.latency = newLatencyWindow(cfg.SlowWindow, cfg.SlowCall)
+	}
+	b.reason.Store("")
+	return b, nil
+}
+
+// Config returns the configuration the breaker was made with
+func (b *Breaker) Config() BreakerConfig {
+	return b.cfg
+}
+
+// State returns the current state
+func (b *Breaker) State() int32 {
+	return atomic.LoadInt32(&b.state)
+}
+
+// transition moves the breaker from one state to another. Only the
+// caller that wins the swap reports the transition, so each one is
+// announced exactly once. reason is recorded on every move to open, before
+// the announcement, so onTransition can read it from Snapshot.
+func (b *Breaker) transition(from, to int32, reason string) bool {
+	if !atomic.CompareAndSwapInt32(&b.state, from, to) {
+		return false
+	}
+	if to == StateOpen {
+		b.reason.Store(reason)
+		switch reason {
+		case ReasonFailures:
+			atomic.AddInt64(&b.failureOpens, 1)
+		case ReasonLatency:
+			atomic.AddInt64(&b.latencyOpens, 1)
+		}
+	}
+	if b.onTransition != nil {
+		b.onTransition(from, to)
+	}
+	return true
+}
+
+// move transitions to the target state from whatever state it is in
+func (b *Breaker) move(to int32, reason string) {
+	for {
+		from := atomic.LoadInt32(&b.state)
+		if from == to || b.transition(from, to, reason) {
+			return
+		}
+	}
+}
+
+// Allow decides whether a call may pass. Once the cooldown has elapsed
+// an open breaker goes half-open and lets trial calls through; otherwise
+// it returns the cooldown remaining. Every allowed call must be followed
+// by RecordSuccess or RecordFailure.
+func (b *Breaker) Allow() (bool, time.Duration) {
+	if atomic.LoadInt32(&b.forced) == 1 {
+		return false, 0
+	}
+	if atomic.LoadInt32(&b.state) == StateOpen {
+		if remaining := b.cfg.Cooldown - b.clock.Since(time.Unix(0, atomic.LoadInt64(&b.lastFailure))); remaining > 0 {
+			return false, remaining
+		}
+		b.transition(StateOpen, StateHalfOpen, "")
+	}
+	return true, 0
+}
+
+// RecordFailure counts a failed call, opening the breaker if the policy
+// says so
+func (b *Breaker) RecordFailure() {
+	now := b.clock.Now()
+	n := atomic.AddInt64(&b.failures, 1)
+	atomic.StoreInt64(&b.lastFailure, now.UnixNano())
+
+	trip := n >= int64(b.cfg.Threshold)
+	if b.window != nil {
+		requests, failures := b.window.record(now, true)
+		trip = requests >= int64(b.cfg.MinRequests) && float64(failures)/float64(requests) >= b.cfg.FailureRate
+	}
+
+	// A failed trial call reopens the breaker straight away
+	if b.transition(StateHalfOpen, StateOpen, ReasonFailures) {
+		return
+	}
+	if trip {
+		b.transition(StateClosed, StateOpen, ReasonFailures)
+	}
+}
+
+// RecordSuccess clears the consecutive failure count and closes a
+// half-open breaker. Closing clears the window too, so the failures that
+// opened it don't reopen it at once.
+func (b *Breaker) RecordSuccess() {
+	atomic.StoreInt64(&b.failures, 0)
+	if b.window != nil {
+		b.window.record(b.clock.Now(), false)
+	}
+	if b.transition(StateHalfOpen, StateClosed, "") {
+		if b.window != nil {
+			b.window.reset()
+		}
+		if b.latency != nil {
+			b.latency.reset()
+		}
+	}
+}
+
+// RecordLatency records a successful call that took d, in place of
+// RecordSuccess, and reports whether the call was slow. Without slow call
+// detection it is just RecordSuccess. With it, a slow half-open trial
+// reopens the breaker instead of closing it, and a closed breaker opens
+// once the slow percentile has held for SlowSustain. Slow calls are a
+// failure class of their own: they restart the cooldown but are never
+// added to the failure counts the trip policy uses.
+func (b *Breaker) RecordLatency(d time.Duration) bool {
+	if b.latency == nil {
+		b.RecordSuccess()
+		return false
+	}
+	now := b.clock.Now()
+	slow := d > b.cfg.SlowCall
+	if slow {
+		atomic.AddInt64(&b.slowCalls, 1)
+	}
+	samples, slowN := b.latency.record(now, d)
+	// Written as the fast share being short of the percentile: 1-p loses
+	// precision, so 1 slow call in 10 would count as over a p90
+	over := samples >= int64(b.cfg.SlowMinCalls) && float64(samples-slowN) < b.cfg.SlowPercentile*float64(samples)
+	held := b.latency.sustained(now, over)
+
+	from := int32(-1)
+	switch state := atomic.LoadInt32(&b.state); {
+	case slow && state == StateHalfOpen:
+		from = StateHalfOpen
+	case over && held >= b.cfg.SlowSustain && state == StateClosed:
+		from = StateClosed
+	}
+	if from >= 0 {
+		atomic.StoreInt64(&b.lastFailure, now.UnixNano())
+		if b.transition(from, StateOpen, ReasonLatency) {
+			return slow
+		}
+	}
+	b.RecordSuccess()
+	return slow
+}
+
+// Reset closes the breaker, lifting a forced open
+func (b *Breaker) Reset() {
+	atomic.StoreInt32(&b.forced, 0)
+	atomic.StoreInt64(&b.failures, 0)
+	if b.window != nil {
+		b.window.reset()
+	}
+	if b.latency != nil {
+		b.latency.reset()
+	}
+	b.move(StateClosed, "")
+}
+
+// ForceOpen holds the breaker open until Reset
+func (b *Breaker) ForceOpen() {
+	atomic.StoreInt32(&b.forced, 1)
+	b.move(StateOpen, ReasonForced)
+}
+
+// Do runs fn if the breaker allows it and records the outcome: any error
+// other than the context's own counts as a failure
+func (b *Breaker) Do(ctx context.Context, fn func(context.Context) error) error {
+	if ok, remaining := b.Allow(); !ok {
+		return &OpenError{RetryAfter: remaining}
+	}
+	err := fn(ctx)
+	switch {
+	case err == nil:
+		b.RecordSuccess()
+	case ctx.Err() != nil && err == ctx.Err():
+		// The caller gave up; that says nothing about the dependency
+	default:
+		b.RecordFailure()
+	}
+	return err
+}
+
+// BreakerSnapshot is a point in time view of a breaker. The window counts
+// are only set under the windowed policy and the latency fields with slow
+// call detection. OpenReason is why the breaker last opened, empty while
+// it is closed.
+type BreakerSnapshot struct {
+	State          int32
+	OpenReason     string
+	Forced         bool
+	Failures       int64
+	LastFailure    time.Time
+	RestoredFrom   time.Time
+	WindowRequests int64
+	WindowFailures int64
+	FailureOpens   int64
+	LatencyOpens   int64
+
+	SlowCalls int64
+	// LatencySamples and LatencySlow count the calls in the slow window
+	// and those slower than SlowCall; LatencyPercentile is the
+	// SlowPercentile latency over them, to histogram bucket precision
+	LatencySamples    int64
+	LatencySlow       int64
+	LatencyPercentile time.Duration
+	// SlowSince is when the percentile went above SlowCall, zero if it
+	// isn't
+	SlowSince time.Time
+}
+
+// Snapshot reports the breaker's state and counters
+func (b *Breaker) Snapshot() BreakerSnapshot {
+	snap := BreakerSnapshot{
+		State:    b.State(),
+		Forced:   atomic.LoadInt32(&b.forced) == 1,
+		Failures: atomic.LoadInt64(&b.failures),
+
+		FailureOpens: atomic.LoadInt64(&b.failureOpens),
+		LatencyOpens: atomic.LoadInt64(&b.latencyOpens),
+		SlowCalls:    atomic.LoadInt64(&b.slowCalls),
+	}
+	if snap.State != StateClosed {
+		snap.OpenReason = b.reason.Load().(string)
+	}
+	if b.window != nil {
+		snap.WindowRequests, snap.WindowFailures = b.window.counts(b.clock.Now())
+	}
+	if b.latency != nil {
+		lc := b.latency.counts(b.clock.Now(), b.cfg.SlowPercentile)
+		snap.LatencySamples, snap.LatencySlow, snap.LatencyPercentile = lc.samples, lc.slow, lc.quantile
+		snap.SlowSince = lc.slowSince
+	}
+	if last := atomic.LoadInt64(&b.lastFailure); last != 0 {
+		snap.LastFailure = time.Unix(0, last).UTC()
+	}
+	if from := atomic.LoadInt64(&b.restoredFrom); from != 0 {
+		snap.RestoredFrom = time.Unix(0, from).UTC()
+	}
+	return snap
+}
+
+// SavedBreaker is the part of a breaker worth carrying over a restart.
+// Window counts are not: they age out within one window anyway.
+type SavedBreaker struct {
+	State       string `json:"state"`
+	Reason      string `json:"reason,omitempty"`
+	Forced      bool   `json:"forced,omitempty"`
+	Failures    int64  `json:"failures"`
+	LastFailure int64  `json:"last_failure_ns,omitempty"`
+}
+
+// Save captures the breaker for Restore
+func (b *Breaker) Save() SavedBreaker {
+	state := b.State()
+	sb := SavedBreaker{
+		State:       StateName(state),
+		Forced:      atomic.LoadInt32(&b.forced) == 1,
+		Failures:    atomic.LoadInt64(&b.failures),
+		LastFailure: atomic.LoadInt64(&b.lastFailure),
+	}
+	if state != StateClosed {
+		sb.Reason = b.reason.Load().(string)
+	}
+	return sb
+}
+
+// Restore puts the breaker back in a saved state, announcing the change
+// as any other transition. An open breaker keeps counting its cooldown
+// from the saved last failure.
+func (b *Breaker) Restore(sb SavedBreaker, savedAt time.Time) {
+	atomic.StoreInt64(&b.failures, sb.Failures)
+	atomic.StoreInt64(&b.lastFailure, sb.LastFailure)
+	atomic.StoreInt64(&b.restoredFrom, savedAt.UnixNano())
+	if sb.Forced {
+		b.ForceOpen()
+		return
+	}
+	reason := sb.Reason
+	if reason == "" {
+		// Saved before open reasons were recorded
+		reason = ReasonFailures
+	}
+	b.move(StateByName(sb.State), reason)
+}
+
+// windowBuckets is how many slices a windowed breaker's window is cut
+// into; outcomes expire one slice at a time
+const windowBuckets = 10
+
+type windowBucket struct {
+	slot      int64
+	successes int64
+	failures  int64
+}
+
+// outcomeWindow counts outcomes over a rolling window
+type outcomeWindow struct {
+	mu      sync.Mutex
+	width   int64
+	buckets [windowBuckets]windowBucket
+}
+
+func newOutcomeWindow(window time.Duration) *outcomeWindow {
+	width := int64(window) / windowBuckets
+	if width < 1 {
+		width = 1
+	}
+	return &outcomeWindow{width: width}
+}
+
+// record adds one outcome and returns the totals over the window
+func (w *outcomeWindow) record(now time.Time, failed bool) (requests, failures int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slot := now.UnixNano() / w.width
+	b := &w.buckets[(slot%windowBuckets+windowBuckets)%windowBuckets]
+	if b.slot != slot {
+		*b = windowBucket{slot: slot}
+	}
+	if failed {
+		b.failures++
+	} else {
+		b.successes++
+	}
+	return w.sumLocked(slot)
+}
+
+// counts returns the totals over the window ending now
+func (w *outcomeWindow) counts(now time.Time) (requests, failures int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sumLocked(now.UnixNano() / w.width)
+}
+
+func (w *outcomeWindow) sumLocked(slot int64) (requests, failures int64) {
+	for _, b := range w.buckets {
+		if b.slot > slot-windowBuckets && b.slot <= slot {
+			requests += b.successes + b.failures
+			failures += b.failures
+		}
+	}
+	return requests, failures
+}
+
+func (w *outcomeWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buckets = [windowBuckets]windowBucket{}
+}
@@ -0,0 +1,129 @@
+package resilience
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBreakerConcurrentUse is for -race: the last failure time is read by
+// Allow and Snapshot while failures write it
+func TestBreakerConcurrentUse(t *testing.T) {
+	var transitions sync.Map
+	b, err := NewBreaker(BreakerConfig{Policy: PolicyConsecutive, Threshold: 3, Cooldown: time.Millisecond}, nil,
+		func(from, to int32) { transitions.Store(to, true) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if ok, _ := b.Allow(); !ok {
+					continue
+				}
+				if (g+i)%3 == 0 {
+					b.RecordSuccess()
+				} else {
+					b.RecordFailure()
+				}
+				b.Snapshot()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if _, ok := transitions.Load(StateOpen); !ok {
+		t.Error("the breaker never opened")
+	}
+	if last := b.Snapshot().LastFailure; last.IsZero() || time.Since(last) > time.Minute {
+		t.Errorf("last failure %v", last)
+	}
+}
+
+func newTestBreaker(t *testing.T, cfg BreakerConfig, clock Clock) *Breaker {
+	t.Helper()
+	b, err := NewBreaker(cfg, clock, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestConsecutivePolicy(t *testing.T) {
+	clock := newTestClock()
+	b := newTestBreaker(t, BreakerConfig{Policy: PolicyConsecutive, Threshold: 3, Cooldown: time.Second}, clock)
+	// A success in between starts the count again
+	b.RecordFailure()
+	b.RecordFailure()
+	b.RecordSuccess()
+	b.RecordFailure()
+	b.RecordFailure()
+	if b.State() != StateClosed {
+		t.Fatal("opened without three failures in a row")
+	}
+	b.RecordFailure()
+	if b.State() != StateOpen || b.Snapshot().OpenReason != ReasonFailures {
+		t.Fatalf("%s after three in a row", StateName(b.State()))
+	}
+	if ok, remaining := b.Allow(); ok || remaining != time.Second {
+		t.Fatalf("open: allowed %v with %s left", ok, remaining)
+	}
+	clock.advance(time.Second)
+	if ok, _ := b.Allow(); !ok || b.State() != StateHalfOpen {
+		t.Fatal("no trial call after the cooldown")
+	}
+	b.RecordFailure()
+	if b.State() != StateOpen {
+		t.Fatal("a failed trial didn't reopen it")
+	}
+	clock.advance(time.Second)
+	b.Allow()
+	b.RecordSuccess()
+	if b.State() != StateClosed {
+		t.Fatal("a good trial didn't close it")
+	}
+}
+
+func TestWindowedPolicy(t *testing.T) {
+	clock := newTestClock()
+	b := newTestBreaker(t, BreakerConfig{Policy: PolicyWindowed, Window: 10 * time.Second, FailureRate: 0.5, MinRequests: 10, Cooldown: time.Second}, clock)
+	// Failures that never run consecutively still trip it on rate
+	for i := 0; i < 4; i++ {
+		b.RecordFailure()
+		b.RecordSuccess()
+	}
+	b.RecordFailure()
+	if b.State() != StateClosed {
+		t.Fatal("opened below MinRequests")
+	}
+	b.RecordFailure()
+	if b.State() != StateOpen {
+		t.Fatalf("6 failures of 10: %s", StateName(b.State()))
+	}
+
+	// Old outcomes age out of the window
+	b = newTestBreaker(t, b.Config(), clock)
+	for i := 0; i < 9; i++ {
+		b.RecordFailure()
+	}
+	clock.advance(11 * time.Second)
+	b.RecordFailure()
+	if snap := b.Snapshot(); b.State() != StateClosed || snap.WindowRequests != 1 {
+		t.Errorf("%s with %d requests in the window", StateName(b.State()), snap.WindowRequests)
+	}
+}
+
+func TestBreakerConfigValidate(t *testing.T) {
+	for _, cfg := range []BreakerConfig{
+		{Policy: "sometimes"},
+		{Policy: PolicyConsecutive},
+		{Policy: PolicyWindowed, Window: time.Second, FailureRate: 1.5, MinRequests: 1},
+		{Policy: PolicyWindowed, Window: time.Second, FailureRate: 0.5},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%+v validated", cfg)
+		}
+	}
+}
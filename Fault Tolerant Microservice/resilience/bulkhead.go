@@ -0,0 +1,206 @@
+package resilience
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bulkhead queue orders
+const (
+	QueueFIFO = "fifo"
+	QueueLIFO = "lifo"
+)
+
+var (
+	// ErrBulkheadFull is returned when every slot is taken and the queue,
+	// if any, is full too
+	ErrBulkheadFull = errors.New("bulkhead: full")
+	// ErrBulkheadTimeout is returned when a queued call waited its whole
+	// timeout without getting a slot
+	ErrBulkheadTimeout = errors.New("bulkhead: timed out waiting for a slot")
+)
+
+// Bulkhead caps the calls running at once. With a queue, a call that
+// finds every slot taken waits up to the timeout for one, and freed
+// slots are handed straight to a waiter, so nothing arriving later can
+// jump in between. FIFO grants slots in arrival order; LIFO grants the
+// newest waiter first, which under sustained overload serves the callers
+// most likely still waiting and lets the oldest time out. Without a
+// queue a full bulkhead rejects at once.
+type Bulkhead struct {
+	clock    Clock
+	size     int
+	maxQueue int
+	lifo     bool
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	used    int
+	waiters list.List // of *bulkheadWaiter, granted from the front
+
+	queued    int64
+	timedOut  int64
+	abandoned int64
+	maxWait   time.Duration
+}
+
+// bulkheadWaiter is one queued call. elem is nil once it has been granted
+// a slot or given up.
+type bulkheadWaiter struct {
+	ready chan struct{}
+	elem  *list.Element
+}
+
+// NewBulkhead makes a bulkhead of size slots. queue is how many calls may
+// wait, each for up to timeout, in order QueueFIFO or QueueLIFO; 0 means
+// no queue.
+func NewBulkhead(size, queue int, order string, timeout time.Duration, clock Clock) (*Bulkhead, error) {
+	if order != QueueFIFO && order != QueueLIFO {
+		return nil, fmt.Errorf("bulkhead: queue order must be fifo or lifo, got %q", order)
+	}
+	if size < 1 || queue < 0 || (queue > 0 && timeout <= 0) {
+		return nil, fmt.Errorf("bulkhead: size must be at least 1, queue length not negative, and a queue needs a positive timeout")
+	}
+	return &Bulkhead{clock: orSystem(clock), size: size, maxQueue: queue, lifo: order == QueueLIFO, timeout: timeout}, nil
+}
+
+// Acquire takes a slot, queueing for up to the timeout if there is none.
+// A slot is only taken directly when nobody is queued, so waiters are
+// never overtaken. ctx ending gives up the wait like the timeout does and
+// returns ctx.Err(); a ctx already ended takes nothing. Every nil return
+// must be paired with a Release.
+//
+// However a wait ends, the waiter is off the queue and its timer stopped
+// by the time Acquire returns, so an abandoned call holds no queue
+// position, slot or goroutine.
+func (b *Bulkhead) Acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if b.used < b.size && b.waiters.Len() == 0 {
+		b.used++
+		b.mu.Unlock()
+		return nil
+	}
+	if b.waiters.Len() >= b.maxQueue {
+		b.mu.Unlock()
+		return ErrBulkheadFull
+	}
+	wt := &bulkheadWaiter{ready: make(chan struct{})}
+	if b.lifo {
+		wt.elem = b.waiters.PushFront(wt)
+	} else {
+		wt.elem = b.waiters.PushBack(wt)
+	}
+	b.queued++
+	b.mu.Unlock()
+
+	start := b.clock.Now()
+	timer := b.clock.NewTimer(b.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-wt.ready:
+	case <-timer.C():
+		err = ErrBulkheadTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	waited := b.clock.Since(start)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if waited > b.maxWait {
+		b.maxWait = waited
+	}
+	if err == nil {
+		return nil
+	}
+	if wt.elem == nil {
+		if err == ErrBulkheadTimeout {
+			// Granted as the timeout fired; the caller is still there to
+			// use the slot
+			return nil
+		}
+		// Granted as the caller went away: pass the slot on rather than
+		// spend it on a call nobody is waiting for
+		b.releaseLocked()
+	} else {
+		b.waiters.Remove(wt.elem)
+		wt.elem = nil
+	}
+	if err == ErrBulkheadTimeout {
+		b.timedOut++
+	} else {
+		b.abandoned++
+	}
+	return err
+}
+
+// Release frees a slot, handing it to the next waiter if there is one
+func (b *Bulkhead) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.releaseLocked()
+}
+
+func (b *Bulkhead) releaseLocked() {
+	if front := b.waiters.Front(); front != nil {
+		wt := b.waiters.Remove(front).(*bulkheadWaiter)
+		wt.elem = nil
+		close(wt.ready)
+		return
+	}
+	b.used--
+}
+
+// Do runs fn holding a slot
+func (b *Bulkhead) Do(ctx context.Context, fn func(context.Context) error) error {
+	if err := b.Acquire(ctx); err != nil {
+		return err
+	}
+	defer b.Release()
+	return fn(ctx)
+}
+
+// BulkheadStats is a point in time view of a bulkhead and its queue
+type BulkheadStats struct {
+	Size     int
+	InUse    int
+	Queue    int
+	Order    string
+	Timeout  time.Duration
+	Waiting  int
+	Queued   int64
+	TimedOut int64
+	// Abandoned counts waiters whose context ended first
+	Abandoned int64
+	MaxWait   time.Duration
+}
+
+// Stats reports the slots in use and the queue's counters
+func (b *Bulkhead) Stats() BulkheadStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	order := QueueFIFO
+	if b.lifo {
+		order = QueueLIFO
+	}
+	return BulkheadStats{
+		Size:      b.size,
+		InUse:     b.used,
+		Queue:     b.maxQueue,
+		Order:     order,
+		Timeout:   b.timeout,
+		Waiting:   b.waiters.Len(),
+		Queued:    b.queued,
+		TimedOut:  b.timedOut,
+		Abandoned: b.abandoned,
+		MaxWait:   b.maxWait,
+	}
+}
@@ -0,0 +1,267 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBulkhead(t *testing.T, size, queue int, order string, clock Clock) *Bulkhead {
+	t.Helper()
+	b, err := NewBulkhead(size, queue, order, time.Second, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// queueWaiters starts n queued Acquires, one at a time so their arrival
+// order is known, and returns a channel each sends its index on once it
+// gets a slot
+func queueWaiters(t *testing.T, b *Bulkhead, n int) <-chan int {
+	t.Helper()
+	granted := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			if err := b.Acquire(context.Background()); err != nil {
+				t.Errorf("waiter %d: %v", i, err)
+				return
+			}
+			granted <- i
+		}(i)
+		for b.Stats().Waiting != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return granted
+}
+
+func TestBulkheadQueueOrder(t *testing.T) {
+	for order, want := range map[string][]int{QueueFIFO: {0, 1, 2}, QueueLIFO: {2, 1, 0}} {
+		b := newTestBulkhead(t, 1, 3, order, newTestClock())
+		if err := b.Acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		granted := queueWaiters(t, b, 3)
+		for _, w := range want {
+			b.Release()
+			if got := <-granted; got != w {
+				t.Errorf("%s: slot went to waiter %d, want %d", order, got, w)
+			}
+		}
+		if st := b.Stats(); st.InUse != 1 || st.Waiting != 0 || st.Queued != 3 {
+			t.Errorf("%s: %+v", order, st)
+		}
+	}
+}
+
+// TestBulkheadNoOvertaking checks a freed slot is handed to the waiter
+// rather than freed, so a call arriving meanwhile queues behind it
+func TestBulkheadNoOvertaking(t *testing.T) {
+	b := newTestBulkhead(t, 1, 1, QueueFIFO, newTestClock())
+	b.Acquire(context.Background())
+	granted := queueWaiters(t, b, 1)
+	b.Release()
+	if st := b.Stats(); st.InUse != 1 || st.Waiting != 0 {
+		t.Fatalf("after the release: %+v", st)
+	}
+	<-granted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Acquire(ctx) }()
+	for b.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled waiter: %v", err)
+	}
+	if st := b.Stats(); st.Abandoned != 1 || st.Waiting != 0 || st.InUse != 1 {
+		t.Errorf("%+v", st)
+	}
+}
+
+func TestBulkheadFullAndTimeout(t *testing.T) {
+	clock := newTestClock()
+	b := newTestBulkhead(t, 1, 1, QueueFIFO, clock)
+	b.Acquire(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Acquire(context.Background()) }()
+	for b.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Acquire(context.Background()); !errors.Is(err, ErrBulkheadFull) {
+		t.Errorf("queue full: %v", err)
+	}
+	clock.advance(time.Second)
+	if err := <-done; !errors.Is(err, ErrBulkheadTimeout) {
+		t.Errorf("after the timeout: %v", err)
+	}
+	if st := b.Stats(); st.TimedOut != 1 || st.Waiting != 0 || st.MaxWait != time.Second {
+		t.Errorf("%+v", st)
+	}
+}
+
+func TestNewBulkheadValidates(t *testing.T) {
+	for _, tc := range []struct {
+		size, queue int
+		order       string
+		timeout     time.Duration
+	}{
+		{0, 0, QueueFIFO, 0},
+		{1, -1, QueueFIFO, 0},
+		{1, 1, QueueFIFO, 0},
+		{1, 0, "random", 0},
+	} {
+		if _, err := NewBulkhead(tc.size, tc.queue, tc.order, tc.timeout, nil); err == nil {
+			t.Errorf("%+v accepted", tc)
+		}
+	}
+}
+
+// TestBulkheadCancelled checks a caller whose context has ended takes no
+// slot, and one that gives up waiting leaves the queue, counted as
+// abandoned, with the slot going to the waiter behind it
+func TestBulkheadCancelled(t *testing.T) {
+	b := newTestBulkhead(t, 1, 2, QueueFIFO, newTestClock())
+	ended, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Acquire(ended); !errors.Is(err, context.Canceled) || b.Stats().InUse != 0 {
+		t.Fatalf("an ended context with a free slot: %v, %+v", err, b.Stats())
+	}
+
+	b.Acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() { first <- b.Acquire(ctx) }()
+	second := make(chan error, 1)
+	go func() { second <- b.Acquire(context.Background()) }()
+	for b.Stats().Waiting != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("the cancelled waiter: %v", err)
+	}
+	if st := b.Stats(); st.Waiting != 1 || st.Abandoned != 1 || st.TimedOut != 0 {
+		t.Errorf("after one waiter gave up: %+v", st)
+	}
+	b.Release()
+	if err := <-second; err != nil {
+		t.Errorf("the waiter behind: %v", err)
+	}
+	b.Release()
+	if st := b.Stats(); st.InUse != 0 || st.Waiting != 0 {
+		t.Errorf("after both released: %+v", st)
+	}
+}
+
+// Leak test sizes: a few slots, a queue that fills, and far more callers
+// than both, most of which give up
+const (
+	leakTestSlots   = 4
+	leakTestQueue   = 64
+	leakTestCallers = 512
+	// leakTestWait bounds how long the callers left may take to get a
+	// slot, so a bulkhead that strands them fails rather than hangs
+	leakTestWait = 5 * time.Second
+)
+
+// TestBulkheadNoLeaks runs many callers through a queued bulkhead on a
+// clock that never moves, so no wait times out, cancelling three in four
+// at random points while they wait or hold a slot. Afterwards nothing may
+// be left behind: no slot in use or waiter queued, no timer pending on
+// the clock, every slot free to take, and no goroutine more than before.
+func TestBulkheadNoLeaks(t *testing.T) {
+	for _, order := range []string{QueueFIFO, QueueLIFO} {
+		t.Run(order, func(t *testing.T) {
+			clock := newTestClock()
+			b, err := NewBulkhead(leakTestSlots, leakTestQueue, order, time.Hour, clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := runtime.NumGoroutine()
+			rnd := rand.New(rand.NewSource(1))
+			var wg sync.WaitGroup
+			var finished int32
+			cancels := make([]context.CancelFunc, leakTestCallers)
+			for i := range cancels {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[i] = cancel
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer atomic.AddInt32(&finished, 1)
+					if b.Acquire(ctx) != nil {
+						return
+					}
+					defer b.Release()
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Millisecond):
+					}
+				}()
+			}
+			for _, i := range rnd.Perm(leakTestCallers)[:leakTestCallers*3/4] {
+				cancels[i]()
+				if rnd.Intn(8) == 0 {
+					runtime.Gosched()
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(leakTestWait):
+				stuck := leakTestCallers - int(atomic.LoadInt32(&finished))
+				for _, cancel := range cancels {
+					cancel()
+				}
+				<-done
+				t.Fatalf("%d callers still waiting for a slot after %s", stuck, leakTestWait)
+			}
+			for _, cancel := range cancels {
+				cancel()
+			}
+
+			if st := b.Stats(); st.InUse != 0 || st.Waiting != 0 {
+				t.Errorf("%d slots in use and %d waiters left after every caller returned", st.InUse, st.Waiting)
+			}
+			clock.mu.Lock()
+			timers := len(clock.timers)
+			clock.mu.Unlock()
+			if timers != 0 {
+				t.Errorf("%d wait timers never stopped", timers)
+			}
+			for i := 0; i < leakTestSlots; i++ {
+				// Taken at once or never: nobody is queued to hand one back
+				ctx, cancel := context.WithTimeout(context.Background(), leakTestWait)
+				err := b.Acquire(ctx)
+				cancel()
+				if err != nil {
+					t.Fatalf("slot %d lost: %v", i, err)
+				}
+			}
+			for i := 0; i < leakTestSlots; i++ {
+				b.Release()
+			}
+			// Goroutines that called wg.Done may not have exited quite yet
+			deadline := time.Now().Add(time.Second)
+			for leaked := runtime.NumGoroutine() - before; leaked > 0; leaked = runtime.NumGoroutine() - before {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d more goroutines than before the run", leaked)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package resilience
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosInjector decides which calls fail, for failure drills, and can
+// simulate the cost of those failures. A disabled injector never fails a
+// call.
+//
+// The failure rate is the base rate unless a schedule or spike overrides
+// it. Both are worked out from the clock when the rate is read, so phase
+// changes need no timers and are logged by the first read that sees them.
+type ChaosInjector struct {
+	// Logf reports schedule and spike changes; nil means log.Printf
+	Logf func(format string, args ...interface{})
+
+	// rate holds the float64 bits of the base failure rate
+	rate     uint64
+	delay    int64
+	disabled int32
+	clock    Clock
+	loadLock sync.Mutex
+	// ceiling holds the float64 bits of the most Rate returns while capped
+	// is 1, whatever the base rate, schedule or spike say
+	ceiling uint64
+	capped  int32
+
+	// overridden is 1 while a schedule or spike is set, so reads can skip mu
+	overridden int32
+	mu         sync.Mutex
+	schedule   *runningSchedule
+	spike      *chaosSpike
+}
+
+// ChaosPhase is one step of a chaos schedule
+type ChaosPhase struct {
+	DurationS   float64 `json:"duration_s"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// ChaosSchedule is a list of phases run in order, once or over and over
+type ChaosSchedule struct {
+	Phases []ChaosPhase `json:"phases"`
+	Loop   bool         `json:"loop,omitempty"`
+}
+
+// MaxChaosPhases bounds the schedule a caller can set
+const MaxChaosPhases = 100
+
+func (cs *ChaosSchedule) Validate() error {
+	if len(cs.Phases) == 0 || len(cs.Phases) > MaxChaosPhases {
+		return fmt.Errorf("schedule needs between 1 and %d phases", MaxChaosPhases)
+	}
+	for i, p := range cs.Phases {
+		if p.DurationS <= 0 {
+			return fmt.Errorf("phase %d: duration_s must be positive", i)
+		}
+		if p.FailureRate < 0 || p.FailureRate > 1 {
+			return fmt.Errorf("phase %d: failure_rate must be between 0 and 1", i)
+		}
+	}
+	return nil
+}
+
+type runningSchedule struct {
+	ChaosSchedule
+	start time.Time
+	total time.Duration
+	// phase is the last phase logged
+	phase int
+}
+
+// at finds the phase running at now and how long it has left; ok is
+// false once a schedule that doesn't loop has finished
+func (rs *runningSchedule) at(now time.Time) (phase int, remaining time.Duration, ok bool) {
+	elapsed := now.Sub(rs.start)
+	if !rs.Loop && elapsed >= rs.total {
+		return 0, 0, false
+	}
+	elapsed %= rs.total
+	for i, p := range rs.Phases {
+		d := seconds(p.DurationS)
+		if elapsed < d {
+			return i, d - elapsed, true
+		}
+		elapsed -= d
+	}
+	// Rounding can leave elapsed a hair past the last phase
+	return len(rs.Phases) - 1, 0, true
+}
+
+// chaosSpike is a one-shot burst laid over whatever else is running
+type chaosSpike struct {
+	rate  float64
+	until time.Time
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func NewChaosInjector(rate float64, clock Clock) *ChaosInjector {
+	return &ChaosInjector{rate: math.Float64bits(rate), clock: orSystem(clock)}
+}
+
+func (c *ChaosInjector) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Disable stops the injector failing anything, for good
+func (c *ChaosInjector) Disable() {
+	atomic.StoreInt32(&c.disabled, 1)
+}
+
+func (c *ChaosInjector) Disabled() bool {
+	return atomic.LoadInt32(&c.disabled) == 1
+}
+
+// Rate is the failure rate in force now
+func (c *ChaosInjector) Rate() float64 {
+	if atomic.LoadInt32(&c.overridden) == 0 {
+		return c.ceil(c.BaseRate())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ceil(c.currentLocked(c.clock.Now()))
+}
+
+// Cap holds the rate in force to at most rate until Uncap, leaving the
+// base rate, schedule and spike as they are to come back afterwards. A
+// capped injector adds no latency either.
+func (c *ChaosInjector) Cap(rate float64) {
+	atomic.StoreUint64(&c.ceiling, math.Float64bits(rate))
+	atomic.StoreInt32(&c.capped, 1)
+	c.logf("Chaos capped at failure rate %.2f\n", rate)
+}
+
+// Uncap lifts the cap
+func (c *ChaosInjector) Uncap() {
+	if atomic.SwapInt32(&c.capped, 0) == 1 {
+		c.logf("Chaos cap lifted\n")
+	}
+}
+
+// Ceiling is the cap and whether one is set
+func (c *ChaosInjector) Ceiling() (float64, bool) {
+	return math.Float64frombits(atomic.LoadUint64(&c.ceiling)), atomic.LoadInt32(&c.capped) == 1
+}
+
+func (c *ChaosInjector) ceil(rate float64) float64 {
+	if ceiling, ok := c.Ceiling(); ok && rate > ceiling {
+		return ceiling
+	}
+	return rate
+}
+
+func (c *ChaosInjector) BaseRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.rate))
+}
+
+// Delay is the latency added to every call, for slowness drills; zero
+// when disabled or capped
+func (c *ChaosInjector) Delay() time.Duration {
+	if c.Disabled() || atomic.LoadInt32(&c.capped) == 1 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&c.delay))
+}
+
+// SetDelay adds d to every call from now on; 0 stops it
+func (c *ChaosInjector) SetDelay(d time.Duration) {
+	atomic.StoreInt64(&c.delay, int64(d))
+	c.logf("Chaos latency %s\n", d)
+}
+
+// SetRate sets the base rate and drops any schedule
+func (c *ChaosInjector) SetRate(rate float64) {
+	atomic.StoreUint64(&c.rate, math.Float64bits(rate))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.schedule != nil {
+		c.logf("Chaos schedule cleared, failure rate %.2f\n", rate)
+		c.schedule = nil
+	}
+	c.updateOverriddenLocked()
+}
+
+// SetSchedule starts cs from its first phase, replacing any schedule. cs
+// should have passed Validate.
+func (c *ChaosInjector) SetSchedule(cs ChaosSchedule) {
+	rs := &runningSchedule{ChaosSchedule: cs, start: c.clock.Now(), phase: -1}
+	for _, p := range cs.Phases {
+		rs.total += seconds(p.DurationS)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule = rs
+	c.updateOverriddenLocked()
+	c.currentLocked(rs.start)
+}
+
+// Spike fails calls at rate for d, then returns to what was running
+func (c *ChaosInjector) Spike(rate float64, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spike = &chaosSpike{rate: rate, until: c.clock.Now().Add(d)}
+	c.updateOverriddenLocked()
+	c.logf("Chaos spike: failure rate %.2f for %s\n", rate, d)
+}
+
+func (c *ChaosInjector) updateOverriddenLocked() {
+	var v int32
+	if c.schedule != nil || c.spike != nil {
+		v = 1
+	}
+	atomic.StoreInt32(&c.overridden, v)
+}
+
+// currentLocked works out the rate at now, logging and dropping a spike
+// or schedule that has ended and logging phase changes
+func (c *ChaosInjector) currentLocked(now time.Time) float64 {
+	if c.spike != nil && !now.Before(c.spike.until) {
+		c.spike = nil
+		c.logf("Chaos spike over\n")
+	}
+	rate := c.BaseRate()
+	if rs := c.schedule; rs != nil {
+		phase, remaining, ok := rs.at(now)
+		switch {
+		case !ok:
+			c.schedule = nil
+			c.logf("Chaos schedule finished, failure rate back to %.2f\n", rate)
+		default:
+			if phase != rs.phase {
+				rs.phase = phase
+				c.logf("Chaos phase %d/%d: failure rate %.2f for %s\n", phase+1, len(rs.Phases),
+					rs.Phases[phase].FailureRate, remaining.Round(time.Millisecond))
+			}
+			rate = rs.Phases[phase].FailureRate
+		}
+	}
+	if c.spike != nil {
+		rate = c.spike.rate
+	}
+	c.updateOverriddenLocked()
+	return rate
+}
+
+// ChaosScheduleState reports a running schedule
+type ChaosScheduleState struct {
+	ChaosSchedule
+	Phase      int     `json:"phase"`
+	RemainingS float64 `json:"phase_remaining_s"`
+}
+
+// ChaosSpikeState reports a running spike
+type ChaosSpikeState struct {
+	FailureRate float64 `json:"failure_rate"`
+	RemainingS  float64 `json:"remaining_s"`
+}
+
+// State reports the rate in force and any schedule or spike behind it
+func (c *ChaosInjector) State() (rate float64, schedule *ChaosScheduleState, spike *ChaosSpikeState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	rate = c.ceil(c.currentLocked(now))
+	if rs := c.schedule; rs != nil {
+		phase, remaining, _ := rs.at(now)
+		schedule = &ChaosScheduleState{ChaosSchedule: rs.ChaosSchedule, Phase: phase, RemainingS: remaining.Seconds()}
+	}
+	if c.spike != nil {
+		spike = &ChaosSpikeState{FailureRate: c.spike.rate, RemainingS: c.spike.until.Sub(now).Seconds()}
+	}
+	return rate, schedule, spike
+}
+
+// ShouldFail rolls the dice for one call using the caller's source, so a
+// seeded caller gets repeatable failures. Disabled injectors don't draw
+// from it.
+func (c *ChaosInjector) ShouldFail(rnd *rand.Rand) bool {
+	if c.Disabled() {
+		return false
+	}
+	return rnd.Float64() < c.Rate()
+}
+
+// Burn makes a failure expensive: CPU busy work, then holding a lock
+// shared by every burning call while 50ms pass on the clock
+func (c *ChaosInjector) Burn() {
+	dummy := 0
+	for i := 0; i < 30_000_000; i++ {
+		dummy += i % 7
+	}
+	c.loadLock.Lock()
+	Sleep(c.clock, 50*time.Millisecond)
+	c.loadLock.Unlock()
+}
@@ -0,0 +1,33 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+// TestChaosCap checks a cap bounds whatever rate is in force, the base
+// rate or a spike, and drops added latency, leaving both as they were
+// once lifted
+func TestChaosCap(t *testing.T) {
+	clock := newTestClock()
+	c := NewChaosInjector(0.5, clock)
+	c.Logf = func(string, ...interface{}) {}
+	c.SetDelay(time.Second)
+	c.Cap(0.1)
+	if ceiling, ok := c.Ceiling(); c.Rate() != 0.1 || c.BaseRate() != 0.5 || c.Delay() != 0 || !ok || ceiling != 0.1 {
+		t.Errorf("capped: rate %g, base %g, delay %v, ceiling %g %v", c.Rate(), c.BaseRate(), c.Delay(), ceiling, ok)
+	}
+	c.Spike(0.9, time.Minute)
+	c.SetRate(0.05)
+	if c.Rate() != 0.1 {
+		t.Errorf("a spike under the cap runs at %g", c.Rate())
+	}
+	c.Uncap()
+	if _, ok := c.Ceiling(); c.Rate() != 0.9 || c.Delay() != time.Second || ok {
+		t.Errorf("uncapped: rate %g, delay %v, still capped %v", c.Rate(), c.Delay(), ok)
+	}
+	clock.advance(time.Minute)
+	if c.Rate() != 0.05 {
+		t.Errorf("after the spike: rate %g, want the base 0.05", c.Rate())
+	}
+}
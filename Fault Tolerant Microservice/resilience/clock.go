@@ -0,0 +1,43 @@
+package resilience
+
+import "time"
+
+// Clock is the time source of every primitive here. SystemClock is the
+// real one; tests and deterministic runs can supply their own.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of *time.Timer the primitives use
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock reads the real time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time                  { return time.Now() }
+func (SystemClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (SystemClock) NewTimer(d time.Duration) Timer  { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+// orSystem returns clock, or the system clock if it is nil
+func orSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock{}
+	}
+	return clock
+}
+
+// Sleep blocks for d as measured by clock
+func Sleep(clock Clock, d time.Duration) {
+	t := orSystem(clock).NewTimer(d)
+	<-t.C()
+}
@@ -0,0 +1,72 @@
+package resilience
+
+import (
+	"sync"
+	"time"
+)
+
+// testClock only moves when advanced; its timers fire as it passes them
+type testClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*testTimer
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Unix(1000, 0)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *testClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &testTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+type testTimer struct {
+	clock *testClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *testTimer) C() <-chan time.Time { return t.c }
+
+func (t *testTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, pt := range t.clock.timers {
+		if pt == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package resilience_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"productsearch/resilience"
+)
+
+func ExampleGuard() {
+	breaker, _ := resilience.NewBreaker(resilience.BreakerConfig{
+		Policy:    resilience.PolicyConsecutive,
+		Threshold: 2,
+		Cooldown:  time.Minute,
+	}, nil, nil)
+	bulkhead, _ := resilience.NewBulkhead(4, 0, resilience.QueueFIFO, 0, nil)
+	g := resilience.Guard{Breaker: breaker, Bulkhead: bulkhead}
+
+	failing := func(context.Context) error { return errors.New("dependency down") }
+	for i := 0; i < 3; i++ {
+		err := g.Do(context.Background(), failing)
+		var open *resilience.OpenError
+		fmt.Println(errors.As(err, &open), resilience.StateName(breaker.State()))
+	}
+	// Output:
+	// false closed
+	// false open
+	// true open
+}
+
+func ExampleRateLimiter() {
+	limiter := resilience.NewRateLimiter(1, 2, nil)
+	for i := 0; i < 3; i++ {
+		st := limiter.Take("client-a")
+		fmt.Println(st.Allowed, st.Remaining)
+	}
+	// Output:
+	// true 1
+	// true 0
+	// false 0
+}
@@ -0,0 +1,38 @@
+package resilience
+
+import "context"
+
+// Guard runs calls behind a breaker and a bulkhead, checked in that
+// order, so an open breaker rejects without taking a slot. Either may be
+// nil to skip it.
+type Guard struct {
+	Breaker  *Breaker
+	Bulkhead *Bulkhead
+}
+
+// Do runs fn once the breaker allows it and a slot is free, recording the
+// outcome on the breaker. It returns an *OpenError, ErrBulkheadFull,
+// ErrBulkheadTimeout, the context's error while queued, or fn's error.
+func (g Guard) Do(ctx context.Context, fn func(context.Context) error) error {
+	run := fn
+	if g.Bulkhead != nil {
+		run = func(ctx context.Context) error { return g.Bulkhead.Do(ctx, fn) }
+	}
+	if g.Breaker == nil {
+		return run(ctx)
+	}
+	if ok, remaining := g.Breaker.Allow(); !ok {
+		return &OpenError{RetryAfter: remaining}
+	}
+	err := run(ctx)
+	switch {
+	case err == nil:
+		g.Breaker.RecordSuccess()
+	case err == ErrBulkheadFull || err == ErrBulkheadTimeout || err == ctx.Err():
+		// Rejected here or abandoned by the caller; the call never got a
+		// verdict from the dependency
+	default:
+		g.Breaker.RecordFailure()
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGuardOrder(t *testing.T) {
+	clock := newTestClock()
+	b := newTestBreaker(t, BreakerConfig{Policy: PolicyConsecutive, Threshold: 2, Cooldown: time.Second}, clock)
+	bh := newTestBulkhead(t, 1, 0, QueueFIFO, clock)
+	g := Guard{Breaker: b, Bulkhead: bh}
+	boom := errors.New("boom")
+
+	if err := g.Do(context.Background(), func(context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// A full bulkhead rejects without the breaker counting it
+	bh.Acquire(context.Background())
+	for i := 0; i < 3; i++ {
+		if err := g.Do(context.Background(), func(context.Context) error { return nil }); !errors.Is(err, ErrBulkheadFull) {
+			t.Fatalf("full bulkhead: %v", err)
+		}
+	}
+	bh.Release()
+	if b.State() != StateClosed || b.Snapshot().Failures != 0 {
+		t.Fatal("bulkhead rejections counted as failures")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := g.Do(context.Background(), func(context.Context) error { return boom }); err != boom {
+			t.Fatalf("got %v, want fn's error", err)
+		}
+	}
+	// An open breaker rejects before taking a slot
+	ran := false
+	err := g.Do(context.Background(), func(context.Context) error { ran = true; return nil })
+	var open *OpenError
+	if !errors.As(err, &open) || open.RetryAfter != time.Second || ran || bh.Stats().InUse != 0 {
+		t.Errorf("open breaker: %v, ran %v, %d slots in use", err, ran, bh.Stats().InUse)
+	}
+}
+
+func TestGuardNilParts(t *testing.T) {
+	calls := 0
+	if err := (Guard{}).Do(context.Background(), func(context.Context) error { calls++; return nil }); err != nil || calls != 1 {
+		t.Errorf("empty guard: %v after %d calls", err, calls)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := newTestBreaker(t, BreakerConfig{Policy: PolicyConsecutive, Threshold: 1, Cooldown: time.Second}, nil)
+	if err := (Guard{Breaker: b}).Do(ctx, func(ctx context.Context) error { return ctx.Err() }); err != context.Canceled || b.State() != StateClosed {
+		t.Errorf("a caller giving up opened the breaker: %v", err)
+	}
+}
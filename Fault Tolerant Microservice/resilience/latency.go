@@ -0,0 +1,141 @@
+package resilience
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the histogram a latency window
+// keeps for reporting; anything slower lands in an overflow bucket
+var latencyBounds = [...]time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+type latencyBucket struct {
+	slot    int64
+	samples int64
+	slow    int64
+	hist    [len(latencyBounds) + 1]int64
+}
+
+// latencyWindow counts call latencies over a rolling window, cut into
+// slices like outcomeWindow. The trip decision only needs how many calls
+// were slower than the threshold: the percentile latency is above it
+// exactly when more than 1-percentile of calls are. The histogram is for
+// reporting the percentile itself.
+type latencyWindow struct {
+	mu        sync.Mutex
+	width     int64
+	threshold time.Duration
+	buckets   [windowBuckets]latencyBucket
+	// slowSince is when the percentile was first seen above the threshold
+	// in the current run, zero while it is below
+	slowSince time.Time
+}
+
+func newLatencyWindow(window, threshold time.Duration) *latencyWindow {
+	width := int64(window) / windowBuckets
+	if width < 1 {
+		width = 1
+	}
+	return &latencyWindow{width: width, threshold: threshold}
+}
+
+// record adds one latency and returns the totals over the window
+func (w *latencyWindow) record(now time.Time, d time.Duration) (samples, slow int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slot := now.UnixNano() / w.width
+	b := &w.buckets[(slot%windowBuckets+windowBuckets)%windowBuckets]
+	if b.slot != slot {
+		*b = latencyBucket{slot: slot}
+	}
+	b.samples++
+	if d > w.threshold {
+		b.slow++
+	}
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	b.hist[i]++
+	return w.sumLocked(slot)
+}
+
+// sustained tracks how long the window has been over: over says whether
+// it is now, and the result is how long it has been, zero if it isn't
+func (w *latencyWindow) sustained(now time.Time, over bool) time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !over {
+		w.slowSince = time.Time{}
+		return 0
+	}
+	if w.slowSince.IsZero() {
+		w.slowSince = now
+	}
+	return now.Sub(w.slowSince)
+}
+
+func (w *latencyWindow) sumLocked(slot int64) (samples, slow int64) {
+	for _, b := range w.buckets {
+		if b.slot > slot-windowBuckets && b.slot <= slot {
+			samples += b.samples
+			slow += b.slow
+		}
+	}
+	return samples, slow
+}
+
+// latencyCounts is a point in time view of the window
+type latencyCounts struct {
+	samples, slow int64
+	// quantile is the percentile latency, as the upper bound of the
+	// histogram bucket it falls in; zero without samples
+	quantile  time.Duration
+	slowSince time.Time
+}
+
+func (w *latencyWindow) counts(now time.Time, percentile float64) latencyCounts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slot := now.UnixNano() / w.width
+	var c latencyCounts
+	var hist [len(latencyBounds) + 1]int64
+	for _, b := range w.buckets {
+		if b.slot > slot-windowBuckets && b.slot <= slot {
+			c.samples += b.samples
+			c.slow += b.slow
+			for i, n := range b.hist {
+				hist[i] += n
+			}
+		}
+	}
+	c.slowSince = w.slowSince
+	if c.samples == 0 {
+		return c
+	}
+	rank := int64(percentile * float64(c.samples))
+	var seen int64
+	for i, n := range hist {
+		seen += n
+		if seen > rank || i == len(hist)-1 {
+			if i >= len(latencyBounds) {
+				i = len(latencyBounds) - 1
+			}
+			c.quantile = latencyBounds[i]
+			break
+		}
+	}
+	return c
+}
+
+func (w *latencyWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buckets = [windowBuckets]latencyBucket{}
+	w.slowSince = time.Time{}
+}
@@ -0,0 +1,82 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+func slowBreaker(t *testing.T, clock Clock) *Breaker {
+	return newTestBreaker(t, BreakerConfig{
+		Policy: PolicyConsecutive, Threshold: 100, Cooldown: time.Second,
+		SlowCall: 100 * time.Millisecond, SlowPercentile: 0.9, SlowWindow: 10 * time.Second,
+		SlowSustain: 2 * time.Second, SlowMinCalls: 10,
+	}, clock)
+}
+
+func TestBreakerOpensOnSustainedLatency(t *testing.T) {
+	clock := newTestClock()
+	b := slowBreaker(t, clock)
+	// One slow call in ten keeps the p90 at or below the threshold
+	for i := 0; i < 9; i++ {
+		b.RecordLatency(10 * time.Millisecond)
+	}
+	if !b.RecordLatency(time.Second) {
+		t.Error("a second long call wasn't reported slow")
+	}
+	if snap := b.Snapshot(); !snap.SlowSince.IsZero() || snap.SlowCalls != 1 {
+		t.Fatalf("p90 over after one slow call in ten: %+v", snap)
+	}
+	// A second makes the p90 slow; it has to stay so for SlowSustain
+	b.RecordLatency(time.Second)
+	if b.State() != StateClosed || b.Snapshot().SlowSince.IsZero() {
+		t.Fatal("opened at once, or didn't start the sustain clock")
+	}
+	clock.advance(time.Second)
+	b.RecordLatency(time.Second)
+	if b.State() != StateClosed {
+		t.Fatal("opened before SlowSustain")
+	}
+	clock.advance(time.Second)
+	b.RecordLatency(time.Second)
+	snap := b.Snapshot()
+	if b.State() != StateOpen || snap.OpenReason != ReasonLatency || snap.LatencyOpens != 1 || snap.FailureOpens != 0 {
+		t.Fatalf("after SlowSustain: %s %+v", StateName(b.State()), snap)
+	}
+	if snap.Failures != 0 || snap.LatencyPercentile != time.Second {
+		t.Errorf("slow calls counted as failures, or p90 %s", snap.LatencyPercentile)
+	}
+}
+
+func TestBreakerSlowTrialReopens(t *testing.T) {
+	clock := newTestClock()
+	b := slowBreaker(t, clock)
+	for b.State() != StateOpen {
+		b.RecordFailure()
+	}
+	clock.advance(time.Second)
+	if ok, _ := b.Allow(); !ok {
+		t.Fatal("no trial after the cooldown")
+	}
+	b.RecordLatency(time.Second)
+	if b.State() != StateOpen || b.Snapshot().OpenReason != ReasonLatency {
+		t.Fatalf("slow trial left it %s", StateName(b.State()))
+	}
+	// The slow trial restarted the cooldown
+	if ok, remaining := b.Allow(); ok || remaining != time.Second {
+		t.Errorf("allowed %v, %s left", ok, remaining)
+	}
+	clock.advance(time.Second)
+	b.Allow()
+	b.RecordLatency(time.Millisecond)
+	if b.State() != StateClosed {
+		t.Error("a fast trial didn't close it")
+	}
+}
+
+func TestRecordLatencyWithoutDetection(t *testing.T) {
+	b := newTestBreaker(t, BreakerConfig{Policy: PolicyConsecutive, Threshold: 2, Cooldown: time.Second}, newTestClock())
+	b.RecordFailure()
+	if b.RecordLatency(time.Hour) || b.Snapshot().Failures != 0 {
+		t.Error("without SlowCall, RecordLatency should be RecordSuccess")
+	}
+}
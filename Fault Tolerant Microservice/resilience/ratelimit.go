@@ -0,0 +1,272 @@
+package resilience
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is one key's bucket. All fields are guarded by mu so a take
+// and the state derived from it are always consistent.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// BucketState is a point in time view of a bucket
+type BucketState struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token, zero if one is available
+	RetryAfter time.Duration
+}
+
+// BucketStore keeps token buckets. Take and Peek must each be atomic for
+// a key, so a take of the last token is seen by every later call, from
+// any limiter sharing the store. An error means the store couldn't be
+// reached and the call decided nothing.
+type BucketStore interface {
+	Take(key string, rate float64, burst int, now time.Time) (BucketState, error)
+	Peek(key string, rate float64, burst int, now time.Time) (BucketState, error)
+}
+
+// MemoryStore is the in-process BucketStore. It never fails.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*tokenBucket)}
+}
+
+// RateLimiter keeps one token bucket per key, each refilling at rate
+// tokens a second up to burst. A rate of 0 disables limiting.
+//
+// The buckets are in memory unless Share gives it a store other instances
+// use too. Then each instance's limit is the deployment's, rather than
+// the deployment letting a client have the limit once per instance. The
+// local buckets stay as the fallback while the shared store fails.
+type RateLimiter struct {
+	rate  float64
+	burst int
+	clock Clock
+
+	local *MemoryStore
+	// shared, when set, is tried first unless breaker is open
+	shared    BucketStore
+	breaker   *Breaker
+	fallbacks int64
+}
+
+func NewRateLimiter(rate float64, burst int, clock Clock) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: burst, clock: orSystem(clock), local: NewMemoryStore()}
+}
+
+// Share keeps the buckets in store, falling back to the local ones for
+// any call store fails and for as long as breaker is open after.
+//
+// The fallback trades accuracy for availability: every instance limits on
+// its own buckets again, so a client spread over N instances gets up to N
+// times its limit, and starts from buckets that were full, or whatever
+// they held last time, since shared calls don't drain them. When the
+// store is back its buckets resume as they were, refilled for the time
+// they weren't used. Refills run off the caller's clock, so instances
+// with skewed clocks refill a bucket early or late by the skew.
+func (l *RateLimiter) Share(store BucketStore, breaker *Breaker) {
+	l.shared, l.breaker = store, breaker
+}
+
+// Shared reports whether the buckets are in a shared store, and how many
+// calls fell back to the local buckets
+func (l *RateLimiter) Shared() (bool, int64) {
+	return l.shared != nil, atomic.LoadInt64(&l.fallbacks)
+}
+
+func (l *RateLimiter) Enabled() bool {
+	return l.rate > 0
+}
+
+// Rate is the refill rate in tokens a second
+func (l *RateLimiter) Rate() float64 {
+	return l.rate
+}
+
+func (m *MemoryStore) bucket(key string, burst int, now time.Time) *tokenBucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	return b
+}
+
+// refill adds the tokens earned since the last call. Caller holds b.mu.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+		b.last = now
+	}
+}
+
+// state reports the bucket after a refill. Caller holds b.mu.
+func (b *tokenBucket) state(rate float64, burst int, allowed bool) BucketState {
+	return StateOf(b.tokens, rate, burst, allowed)
+}
+
+// StateOf reports a bucket holding tokens, for stores that keep buckets
+// elsewhere
+func StateOf(tokens, rate float64, burst int, allowed bool) BucketState {
+	st := BucketState{
+		Allowed:   allowed,
+		Limit:     burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(burst) - tokens) / rate * float64(time.Second)),
+	}
+	if tokens < 1 {
+		st.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return st
+}
+
+// Take consumes a token from key's bucket if one is available
+func (m *MemoryStore) Take(key string, rate float64, burst int, now time.Time) (BucketState, error) {
+	b := m.bucket(key, burst, now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now, rate, burst)
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return b.state(rate, burst, allowed), nil
+}
+
+// Peek reports key's bucket without consuming a token
+func (m *MemoryStore) Peek(key string, rate float64, burst int, now time.Time) (BucketState, error) {
+	b := m.bucket(key, burst, now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now, rate, burst)
+	return b.state(rate, burst, b.tokens >= 1), nil
+}
+
+// Take consumes a token from key's bucket if one is available
+func (l *RateLimiter) Take(key string) BucketState {
+	return l.call(BucketStore.Take, key)
+}
+
+// Peek reports key's bucket without consuming a token
+func (l *RateLimiter) Peek(key string) BucketState {
+	return l.call(BucketStore.Peek, key)
+}
+
+// call runs op against the shared store when there is one and its
+// breaker allows, otherwise, or when it fails, against the local buckets
+func (l *RateLimiter) call(op func(BucketStore, string, float64, int, time.Time) (BucketState, error), key string) BucketState {
+	now := l.clock.Now()
+	if l.shared != nil {
+		if ok, _ := l.breaker.Allow(); ok {
+			st, err := op(l.shared, key, l.rate, l.burst, now)
+			if err == nil {
+				l.breaker.RecordSuccess()
+				return st
+			}
+			l.breaker.RecordFailure()
+		}
+		atomic.AddInt64(&l.fallbacks, 1)
+	}
+	st, _ := op(l.local, key, l.rate, l.burst, now)
+	return st
+}
+
+// Sweep drops local buckets that have refilled completely, since a full
+// bucket is indistinguishable from a new one. A shared store expires its
+// own.
+func (l *RateLimiter) Sweep() {
+	now := l.clock.Now()
+	m := l.local
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, b := range m.buckets {
+		b.mu.Lock()
+		b.refill(now, l.rate, l.burst)
+		full := b.tokens >= float64(l.burst)
+		b.mu.Unlock()
+		if full {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// SweepLoop sweeps every interval until ctx ends
+func (l *RateLimiter) SweepLoop(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.Sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SaveBuckets lists the whole tokens left in local buckets that aren't
+// full, keeping the max emptiest, since those keys are the ones a reset
+// would let stampede. A shared store outlives the instance anyway.
+func (l *RateLimiter) SaveBuckets(max int) map[string]int {
+	now := l.clock.Now()
+	type entry struct {
+		key    string
+		tokens int
+	}
+	var entries []entry
+	m := l.local
+	m.mu.Lock()
+	for key, b := range m.buckets {
+		b.mu.Lock()
+		b.refill(now, l.rate, l.burst)
+		tokens := b.tokens
+		b.mu.Unlock()
+		if tokens < float64(l.burst) {
+			entries = append(entries, entry{key, int(math.Floor(tokens))})
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tokens < entries[j].tokens })
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	out := make(map[string]int, len(entries))
+	for _, e := range entries {
+		out[e.key] = e.tokens
+	}
+	return out
+}
+
+// RestoreBuckets refills saved buckets for the time since they were
+// saved, capped at the current burst
+func (l *RateLimiter) RestoreBuckets(buckets map[string]int, savedAt time.Time) {
+	m := l.local
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, tokens := range buckets {
+		if tokens < 0 {
+			tokens = 0
+		}
+		b := &tokenBucket{tokens: math.Min(float64(tokens), float64(l.burst)), last: savedAt}
+		b.refill(l.clock.Now(), l.rate, l.burst)
+		m.buckets[key] = b
+	}
+}
@@ -0,0 +1,91 @@
+package resilience
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRefills(t *testing.T) {
+	m := NewMemoryStore()
+	now := time.Unix(1000, 0)
+	for i := 0; i < 2; i++ {
+		if st, _ := m.Take("a", 2, 2, now); !st.Allowed {
+			t.Fatalf("take %d refused with a full bucket", i)
+		}
+	}
+	st, _ := m.Take("a", 2, 2, now)
+	if st.Allowed || st.Remaining != 0 || st.RetryAfter != 500*time.Millisecond || st.Reset != time.Second {
+		t.Errorf("empty bucket: %+v", st)
+	}
+	// Half a second earns one token; a peek reports it without taking it
+	now = now.Add(500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if st, _ := m.Peek("a", 2, 2, now); !st.Allowed || st.Remaining != 1 {
+			t.Errorf("peek %d: %+v", i, st)
+		}
+	}
+	if st, _ := m.Take("b", 2, 2, now); !st.Allowed || st.Remaining != 1 {
+		t.Errorf("another key's bucket: %+v", st)
+	}
+}
+
+// TestRateLimiterShare checks two limiters sharing a store share each
+// bucket, as instances sharing Redis do
+func TestRateLimiterShare(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+	a, b := NewRateLimiter(1, 2, clock), NewRateLimiter(1, 2, clock)
+	for _, l := range []*RateLimiter{a, b} {
+		l.Share(store, newTestBreaker(t, BreakerConfig{Policy: PolicyConsecutive, Threshold: 3, Cooldown: time.Second}, clock))
+	}
+	if !a.Take("client").Allowed || !b.Take("client").Allowed {
+		t.Fatal("the burst was refused")
+	}
+	if a.Take("client").Allowed || b.Take("client").Allowed {
+		t.Error("two instances gave one client twice its burst")
+	}
+	if shared, fallbacks := a.Shared(); !shared || fallbacks != 0 {
+		t.Errorf("shared %v with %d fallbacks", shared, fallbacks)
+	}
+}
+
+// failingStore fails every call while down
+type failingStore struct {
+	BucketStore
+	down  bool
+	calls int
+}
+
+func (f *failingStore) Take(key string, rate float64, burst int, now time.Time) (BucketState, error) {
+	f.calls++
+	if f.down {
+		return BucketState{}, errors.New("unreachable")
+	}
+	return f.BucketStore.Take(key, rate, burst, now)
+}
+
+// TestRateLimiterFallsBack checks a failing shared store is replaced by
+// the local buckets, and after the breaker opens isn't called at all
+// until its cooldown
+func TestRateLimiterFallsBack(t *testing.T) {
+	clock := newTestClock()
+	store := &failingStore{BucketStore: NewMemoryStore(), down: true}
+	breaker := newTestBreaker(t, BreakerConfig{Policy: PolicyConsecutive, Threshold: 2, Cooldown: time.Second}, clock)
+	l := NewRateLimiter(1, 5, clock)
+	l.Share(store, breaker)
+	for i := 0; i < 4; i++ {
+		if !l.Take("client").Allowed {
+			t.Fatalf("take %d refused by the local buckets", i)
+		}
+	}
+	if _, fallbacks := l.Shared(); store.calls != 2 || fallbacks != 4 || breaker.State() != StateOpen {
+		t.Errorf("store called %d times, %d fallbacks, breaker %s", store.calls, fallbacks, StateName(breaker.State()))
+	}
+	// The store's buckets resume where they were, full, once it is back
+	store.down = false
+	clock.advance(time.Second)
+	if st := l.Take("client"); !st.Allowed || st.Remaining != 4 || breaker.State() != StateClosed {
+		t.Errorf("after recovery: %+v, breaker %s", st, StateName(breaker.State()))
+	}
+}
@@ -0,0 +1,14 @@
+// Package resilience holds the fault tolerance primitives of the product
+// search service: a circuit breaker, a bulkhead with an ordered wait
+// queue, per key token bucket rate limiting and a chaos injector for
+// failure drills. None of them know about HTTP; the service's handlers
+// adapt them.
+//
+// Guard combines a breaker and a bulkhead around an arbitrary call:
+//
+//	g := resilience.Guard{Breaker: b, Bulkhead: bh}
+//	err := g.Do(ctx, func(ctx context.Context) error { return callDependency(ctx) })
+//
+// Every primitive takes a Clock, nil meaning the system clock, so tests
+// can drive cooldowns and refills without sleeping.
+package resilience
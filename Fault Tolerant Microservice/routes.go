@@ -0,0 +1,992 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiParam describes a single request parameter for the OpenAPI spec
+type apiParam struct {
+	Name        string
+	In          string // "query" or "path"
+	Type        string // "string", "integer", "number" or "boolean"
+	Description string
+	Required    bool
+	Enum        []string
+}
+
+// apiResponse describes one response status of a route. Schema names a
+// component in apiSchemas; empty means a plain text body.
+type apiResponse struct {
+	Status      int
+	Description string
+	Schema      string
+	// Enveloped responses come as an Envelope from v1 on, its data the
+	// products Schema lists
+	Enveloped bool
+}
+
+// route is the single source of truth for an endpoint: the mux is built
+// from it and so is the OpenAPI document served at /openapi.json
+type route struct {
+	Method    string
+	Path      string
+	Summary   string
+	Params    []apiParam
+	Responses []apiResponse
+	Handler   http.HandlerFunc
+	// Role is the API key role needed once auth is configured. Read
+	// routes are only enforced with -require-auth-for-reads.
+	Role string
+	// RateLimited routes take a token from the caller's bucket
+	RateLimited bool
+	// Idempotent routes replay the stored response for a repeated
+	// Idempotency-Key
+	Idempotent bool
+	// Coalesced routes share one execution between identical concurrent
+	// requests
+	Coalesced bool
+	// Cached routes are served from the response cache when it is on
+	Cached bool
+	// Owned routes name a product by {id}; on a sharded instance another
+	// shard's product is refused with 421 or proxied to its owner
+	Owned bool
+	// Streaming routes hold their connection open, so they are left out
+	// of the per client concurrency cap and have limits of their own
+	Streaming bool
+	// Version is the API version the route belongs to, 0 for legacy and
+	// unversioned routes
+	Version    int
+	Deprecated bool
+}
+
+var (
+	debugParam = apiParam{Name: "debug", In: "query", Type: "string",
+		Description: "set to 1 or true to include checked_request and total_checked", Enum: []string{"1", "true"}}
+	idParam      = apiParam{Name: "id", In: "path", Type: "integer", Description: "product ID"}
+	formatParams = []apiParam{
+		{Name: "format", In: "query", Type: "string", Description: "response format, csv streams RFC 4180 rows with a header and ndjson one product object per line, honouring select", Enum: []string{"json", "ndjson", "csv"}},
+		{Name: "fields", In: "query", Type: "string", Description: "csv only: comma separated columns from " + strings.Join(selectFields, ",")},
+		{Name: "download", In: "query", Type: "string", Description: "csv and ndjson: set to 1 to add Content-Disposition: attachment", Enum: []string{"1", "true"}},
+	}
+	foldParam         = apiParam{Name: "fold", In: "query", Type: "boolean", Description: "match ignoring diacritics and full-width forms, so epsilon finds Épsilon; default true"}
+	langParam         = apiParam{Name: "lang", In: "query", Type: "string", Description: "language of product names, e.g. de; overrides Accept-Language, and unsupported ones fall back to en", Enum: locales}
+	selectParam       = apiParam{Name: "select", In: "query", Type: "string", Description: "comma separated product fields to return, from " + strings.Join(selectFields, ",") + "; JSON leaves the others out and CSV uses them as columns"}
+	overloadResponses = []apiResponse{
+		{Status: http.StatusInternalServerError, Description: "Simulated failure (Overload failure simulation)"},
+		{Status: http.StatusServiceUnavailable, Description: "Circuit Open, Request overload, or Server overloaded"},
+	}
+	misdirectedResponse = apiResponse{Status: http.StatusMisdirectedRequest, Description: "Sharded, and the product is another shard's, named in X-Shard-Owner"}
+	walResponse         = apiResponse{Status: http.StatusServiceUnavailable, Description: "The write-ahead log couldn't take the change; an import keeps the entries before it"}
+)
+
+// apiRoutes lists every endpoint the service exposes: the unversioned
+// service routes plus the resource routes mounted once per API version
+func (s *Server) apiRoutes() []route {
+	rs := s.unversionedRoutes()
+	for _, v := range apiVersions {
+		rs = append(rs, v.mount(s.resourceRoutes(), s)...)
+	}
+	return rs
+}
+
+// unversionedRoutes are served at the same path regardless of API version
+func (s *Server) unversionedRoutes() []route {
+	return []route{
+		{
+			Method:  http.MethodGet,
+			Path:    "/",
+			Summary: "Service health and configuration",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Service is running", Schema: "Health"},
+			},
+			Handler: s.healthHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/health",
+			Summary: "Service health, version and discovery registration",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Service is running", Schema: "Health"},
+			},
+			Handler: s.healthHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/readyz",
+			Summary: "Readiness: catalog loaded, cache warmup over and circuit not open",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Ready for traffic", Schema: "Readiness"},
+				{Status: http.StatusServiceUnavailable, Description: "Not ready", Schema: "Readiness"},
+			},
+			Handler: s.readyzHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/openapi.json",
+			Summary: "This OpenAPI document",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "OpenAPI 3 document"},
+			},
+			Handler: s.openAPIHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/docs",
+			Summary: "Interactive API documentation",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "HTML page rendering /openapi.json"},
+			},
+			Handler: docsHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/ui",
+			Summary: "Demo UI: search, live breaker and load panel, and chaos and breaker controls, all through this API",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "HTML page"},
+			},
+			Handler: uiHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/ui/{file}",
+			Summary: "The demo UI's static assets",
+			Params:  []apiParam{{Name: "file", In: "path", Type: "string", Description: "asset name, e.g. app.js"}},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The asset, as text/html, text/javascript or text/css"},
+				{Status: http.StatusNotFound, Description: "No such asset"},
+			},
+			Handler: uiHandler,
+		},
+	}
+}
+
+// resourceRoutes are the product and admin routes, relative to the API
+// version prefix. Handlers check requestAPIVersion for shape differences.
+func (s *Server) resourceRoutes() []route {
+	return []route{
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/search",
+			Summary: "Search a random sample of the catalog by name or category, or the whole catalog by brand, category and price",
+			Params: append([]apiParam{
+				{Name: "q", In: "query", Type: "string", Description: "case insensitive substring matched against name, the name in the requested language, and category. brand:, category: and name: scopes filter instead, -field:value excludes, and quoted values may hold spaces, as in name:\"Product Alpha\". price:<2000, price:<=, price:>, price:>=, price:100..2000, price:100.. and price:..2000 compare the price in cents, with the price params and each other, all of which must hold. stock: takes the same comparisons of the units in stock, as in stock:>=1; it needs -inventory, checks every product and leaves out the categories the inventory dependency couldn't answer for, marked degraded. Comparing any other field is a 400"},
+				{Name: "brand", In: "query", Type: "string", Description: "exact brand, ignoring case; filtered searches use the index and check every product"},
+				{Name: "category", In: "query", Type: "string", Description: "exact category, ignoring case; filtered searches use the index and check every product"},
+				{Name: "min_price", In: "query", Type: "integer", Description: "lowest price kept, in cents, inclusive; products without a price are left out, and a price filter here or in q checks every product"},
+				{Name: "max_price", In: "query", Type: "integer", Description: "highest price kept, in cents, inclusive; products without a price are left out, and a price filter here or in q checks every product"},
+				{Name: "offset", In: "query", Type: "integer", Description: "matches to skip, default 0"},
+				{Name: "snapshot", In: "query", Type: "boolean", Description: "pin every match, up to 10000, so later pages fetched with snapshot_id are consistent however the catalog changes"},
+				{Name: "snapshot_id", In: "query", Type: "string", Description: "page through a pinned snapshot instead of searching again; the query and mode params are ignored"},
+				{Name: "limit", In: "query", Type: "integer", Description: "page size, default and maximum the configured max results"},
+				{Name: "mode", In: "query", Type: "string", Description: modesDescription(s.cfg.SearchMode), Enum: searchModes},
+				{Name: "sort", In: "query", Type: "string", Description: "order matches before paging; filtered and indexed searches default to ID order", Enum: searchSorts},
+				{Name: "seed", In: "query", Type: "integer", Description: "seed for this request's sampling and chaos decisions, to reproduce an earlier response"},
+				{Name: "sample_strategy", In: "query", Type: "string", Description: "debug only: how a sampled search draws products, overriding -sample-strategy; the stratified ones give every category or brand at least one check", Enum: sampleStrategies},
+				debugParam,
+				selectParam,
+				langParam,
+				foldParam,
+				{Name: "positions", In: "query", Type: "boolean", Description: "give each product its matches: the byte offset and length of every occurrence of q in the name and category returned, and of name: scopes in the name, to highlight without matching again; under select only the selected fields', and not with snapshot, snapshot_id or format=csv"},
+				{Name: "Prefer", In: "header", Type: "string", Description: "with -spill-queue, respond-async takes a 202 and a poll URL rather than a 503 when the search would be shed", Enum: []string{"respond-async"}},
+				{Name: "X-Callback-URL", In: "header", Type: "string", Description: "with Prefer: respond-async, also POST the result here, signed in X-Webhook-Signature; its host must be in -spill-callback-hosts"},
+			}, formatParams...),
+			Responses: append([]apiResponse{
+				{Status: http.StatusOK, Description: "Search results, or text/csv or application/x-ndjson with format", Schema: "QueryResult", Enveloped: true},
+				{Status: http.StatusAccepted, Description: "Would have been shed; queued, to poll at Location", Schema: "SpillJob"},
+				{Status: http.StatusBadRequest, Description: "Invalid q comparison, min_price, max_price, format, fields, select, offset, limit, sort, mode, seed, sample_strategy, snapshot, positions or X-Callback-URL, every one at fault listed in violations, or too many matches to snapshot"},
+				{Status: http.StatusGone, Description: "snapshot_id expired, was evicted or never existed"},
+			}, overloadResponses...),
+			Handler:     s.searchHandler,
+			Role:        roleRead,
+			RateLimited: true,
+			Cached:      true,
+			Coalesced:   true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/search/jobs/{id}",
+			Summary: "Poll a search accepted with 202 instead of shed: 202 until it has run, then its response",
+			Params:  []apiParam{{Name: "id", In: "path", Type: "string", Description: "job ID from the 202 and its Location"}},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The search's own response, with X-Job-State: done; it may also be an error status"},
+				{Status: http.StatusAccepted, Description: "Still queued or running", Schema: "SpillJob"},
+				{Status: http.StatusNotFound, Description: "The spill-over queue is not enabled"},
+				{Status: http.StatusGone, Description: "Unknown job, result kept past -spill-result-ttl, or taken with another API key"},
+				{Status: http.StatusServiceUnavailable, Description: "The search expired in the queue before there was room for it"},
+			},
+			Handler:     s.spillJobHandler,
+			Role:        roleRead,
+			RateLimited: true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/shards/search",
+			Summary: "Search every local shard at once and merge their pages",
+			Params: []apiParam{
+				{Name: "q", In: "query", Type: "string", Description: "as for /products/search, except that stock can't be compared"},
+				{Name: "brand", In: "query", Type: "string", Description: "exact brand, ignoring case"},
+				{Name: "category", In: "query", Type: "string", Description: "exact category, ignoring case"},
+				{Name: "min_price", In: "query", Type: "integer", Description: "as for /products/search"},
+				{Name: "max_price", In: "query", Type: "integer", Description: "as for /products/search"},
+				{Name: "offset", In: "query", Type: "integer", Description: "matches to skip, default 0; offset plus limit is at most 10000"},
+				{Name: "limit", In: "query", Type: "integer", Description: "page size, default and maximum the configured max results"},
+				{Name: "mode", In: "query", Type: "string", Description: "search mode each shard runs, default exhaustive", Enum: searchModes},
+				{Name: "sort", In: "query", Type: "string", Description: "order of the merged page, default id", Enum: searchSorts},
+				{Name: "seed", In: "query", Type: "integer", Description: "seed for the sampled mode's draws"},
+				{Name: "positions", In: "query", Type: "boolean", Description: "as for /products/search"},
+				langParam,
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The merged page and what each shard did", Schema: "ShardSearch"},
+				{Status: http.StatusBadRequest, Description: "Invalid offset, limit, sort, mode, seed or positions"},
+				{Status: http.StatusNotFound, Description: "Local shards are off; start with -local-shards"},
+			},
+			Handler:     s.shardSearchHandler,
+			Role:        roleRead,
+			RateLimited: true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/search/watch",
+			Summary: "WebSocket stream of match set changes for a query",
+			Params:  []apiParam{langParam, foldParam},
+			Responses: []apiResponse{
+				{Status: http.StatusSwitchingProtocols, Description: `Upgraded. Send {"q":"term","limit":20}, q as search takes it but for stock comparisons; receive initial, add, remove, update and resync messages`},
+				{Status: http.StatusBadRequest, Description: "Invalid fold"},
+				{Status: http.StatusUpgradeRequired, Description: "Not a WebSocket upgrade request"},
+				{Status: http.StatusForbidden, Description: "Origin not allowed"},
+				{Status: http.StatusServiceUnavailable, Description: "Too many watch connections"},
+			},
+			Handler:     s.watchHandler,
+			Role:        roleRead,
+			RateLimited: true,
+			Streaming:   true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/changes",
+			Summary: "Catalog changes after a sequence number, oldest first, for incremental sync",
+			Params: []apiParam{
+				{Name: "since", In: "query", Type: "integer", Description: "return changes after this sequence; 0 before any change, or the X-Catalog-Seq of a full listing"},
+				{Name: "limit", In: "query", Type: "integer", Description: "most changes to return, default 500, at most 1000"},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Changes in sequence order", Schema: "CatalogChanges"},
+				{Status: http.StatusBadRequest, Description: "since missing, invalid or ahead of the latest sequence, or limit out of range"},
+				{Status: http.StatusGone, Description: "Changes after since are no longer retained; refetch the catalog"},
+			},
+			Handler:     s.productChangesHandler,
+			Role:        roleRead,
+			RateLimited: true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/events",
+			Summary: "Server-Sent Events stream of catalog changes",
+			Params: []apiParam{
+				{Name: "last_event_id", In: "query", Type: "integer", Description: "Resume after this event ID; the Last-Event-ID header takes precedence"},
+				{Name: "on_overflow", In: "query", Type: "string", Description: "when the client falls behind, resync catches up from the log in the same stream and disconnect closes it, to be resumed with Last-Event-ID", Enum: []string{"resync", "disconnect"}},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "text/event-stream of created, updated and deleted events, or reset when the requested ID is no longer retained"},
+				{Status: http.StatusBadRequest, Description: "Invalid Last-Event-ID or on_overflow"},
+				{Status: http.StatusServiceUnavailable, Description: "Too many event subscribers"},
+			},
+			Handler:     s.productEventsHandler,
+			Role:        roleRead,
+			RateLimited: true,
+			Streaming:   true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products",
+			Summary: "Page through the catalog",
+			Params: append([]apiParam{
+				{Name: "offset", In: "query", Type: "integer", Description: "index of the first product, default 0"},
+				{Name: "limit", In: "query", Type: "integer", Description: "page size, default 100, at most 10000"},
+				selectParam,
+			}, formatParams...),
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "A page of products, or text/csv or application/x-ndjson with format. X-Catalog-Seq is the change sequence to sync from afterwards", Schema: "ProductList", Enveloped: true},
+				{Status: http.StatusBadRequest, Description: "Invalid offset, limit, format, fields or select"},
+			},
+			Handler:     s.listProductsHandler,
+			Role:        roleRead,
+			RateLimited: true,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/products",
+			Summary: "Create a product; the ID is assigned by the server",
+			Responses: []apiResponse{
+				{Status: http.StatusCreated, Description: "Product created", Schema: "Product"},
+				{Status: http.StatusBadRequest, Description: "Invalid product body"},
+				{Status: http.StatusRequestEntityTooLarge, Description: "Body larger than -max-product-bytes"},
+				walResponse,
+			},
+			Handler:     s.createProductHandler,
+			Role:        roleWrite,
+			RateLimited: true,
+			Idempotent:  true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/export",
+			Summary: "The whole catalog as newline delimited JSON, resumable from a pinned snapshot with Range",
+			Params: []apiParam{
+				{Name: "snapshot", In: "query", Type: "boolean", Description: "pin the catalog first; the response carries its ID in X-Export-Snapshot, Content-Length and Accept-Ranges: bytes and is never compressed"},
+				{Name: "snapshot_id", In: "query", Type: "string", Description: "serve a pinned export again; send Range: bytes=N- to resume after N bytes, optionally with If-Range set to its ETag"},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "application/x-ndjson, one product per line; gzipped for a plain export when Accept-Encoding allows"},
+				{Status: http.StatusPartialContent, Description: "The requested byte range of a pinned export"},
+				{Status: http.StatusBadRequest, Description: "Invalid snapshot, or export snapshots are disabled"},
+				{Status: http.StatusGone, Description: "snapshot_id expired, was evicted or never existed"},
+				{Status: http.StatusRequestedRangeNotSatisfiable, Description: "Range starts past the end of the export"},
+			},
+			Handler:     s.exportHandler,
+			Role:        roleRead,
+			RateLimited: true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/{id}",
+			Summary: "Fetch a product by ID",
+			Params:  []apiParam{idParam, selectParam, langParam},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The product", Schema: "Product"},
+				{Status: http.StatusBadRequest, Description: "Invalid select"},
+				{Status: http.StatusNotFound, Description: "Product not found"},
+				misdirectedResponse,
+			},
+			Handler:     s.getProductHandler,
+			Role:        roleRead,
+			RateLimited: true,
+			Owned:       true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/products/{id}/related",
+			Summary: "Products most like this one: same brand, same category and shared name words",
+			Params: []apiParam{
+				idParam,
+				{Name: "limit", In: "query", Type: "integer", Description: "how many to return, default 5, at most 50"},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Related products, most similar first", Schema: "RelatedProducts", Enveloped: true},
+				{Status: http.StatusBadRequest, Description: "Invalid limit"},
+				{Status: http.StatusNotFound, Description: "Product not found"},
+				misdirectedResponse,
+			},
+			Handler:     s.relatedProductsHandler,
+			Role:        roleRead,
+			RateLimited: true,
+			Owned:       true,
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/products/{id}",
+			Summary: "Replace an existing product",
+			Params:  []apiParam{idParam},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Product updated", Schema: "Product"},
+				{Status: http.StatusBadRequest, Description: "Invalid product body"},
+				{Status: http.StatusRequestEntityTooLarge, Description: "Body larger than -max-product-bytes"},
+				{Status: http.StatusNotFound, Description: "Product not found"},
+				misdirectedResponse,
+				walResponse,
+			},
+			Handler:     s.updateProductHandler,
+			Role:        roleWrite,
+			RateLimited: true,
+			Idempotent:  true,
+			Owned:       true,
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/products/{id}",
+			Summary: "Delete a product",
+			Params:  []apiParam{idParam},
+			Responses: []apiResponse{
+				{Status: http.StatusNoContent, Description: "Product deleted"},
+				{Status: http.StatusNotFound, Description: "Product not found"},
+				misdirectedResponse,
+				walResponse,
+			},
+			Handler:     s.deleteProductHandler,
+			Role:        roleWrite,
+			RateLimited: true,
+			Idempotent:  true,
+			Owned:       true,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/products/import",
+			Summary: "Bulk create or replace products from a JSON array or newline delimited JSON",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Import summary", Schema: "ImportResult"},
+				{Status: http.StatusBadRequest, Description: "Invalid body; nothing was imported"},
+				{Status: http.StatusRequestEntityTooLarge, Description: "Body larger than -max-import-bytes; nothing was imported"},
+				walResponse,
+			},
+			Handler:     s.importProductsHandler,
+			Role:        roleWrite,
+			RateLimited: true,
+			Idempotent:  true,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/stats",
+			Summary: "Request counters and resilience state",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Current counters", Schema: "Stats"},
+			},
+			Handler: s.statsHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/stats/reset",
+			Summary: "Start the windowed search counters afresh; lifetime counters are never reset",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The emptied windows", Schema: "StatsWindows"},
+			},
+			Handler: s.statsResetHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/slo",
+			Summary: "Product API availability against the SLO target over 5m, 1h and 6h, with burn rates",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Availability per window, error budget left and the fast burn alert", Schema: "SLO"},
+			},
+			Handler: s.sloHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/metrics",
+			Summary: "Per route request counts, latency histograms and in-flight gauges in the Prometheus text format",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Prometheus text exposition format, labeled by route template, method and status class"},
+			},
+			Handler: s.metricsHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/stats/catalog",
+			Summary: "Shape of the catalog: products, top brands and categories, description length and index sizes",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Catalog statistics, from counters kept with the indexes", Schema: "CatalogStats"},
+			},
+			Handler: s.catalogStatsHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/stats/zero-results",
+			Summary: "Most frequent search queries that matched nothing",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Tracked queries, most frequent first", Schema: "ZeroResults"},
+			},
+			Handler: s.zeroResultsHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/stats/shadow",
+			Summary: "How often shadow searches disagreed with the searches they copied",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Shadow comparison counters", Schema: "Shadow"},
+			},
+			Handler: s.shadowHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/stats/mirror",
+			Summary: "How a mirror target, such as a canary, answered copies of GET requests next to this instance",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Mirror counters, latencies and recent status mismatches", Schema: "Mirror"},
+			},
+			Handler: s.mirrorHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/stats/clients",
+			Summary: "Client addresses with the most requests in flight, against the per client concurrency cap",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Top clients by requests in flight", Schema: "Clients"},
+			},
+			Handler: s.clientsHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/ratelimit",
+			Summary: "The caller's rate limit bucket, without consuming a token",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Bucket state", Schema: "RateLimit"},
+			},
+			Handler: s.rateLimitHandler,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/circuit",
+			Summary: "Circuit breaker state",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Breaker state", Schema: "Circuit"},
+			},
+			Handler: s.circuitHandler,
+			Role:    roleRead,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/circuit/wait",
+			Summary: "Long-poll until the breaker changes state",
+			Params: []apiParam{
+				{Name: "state", In: "query", Type: "string", Description: "wait for a transition into open, half_open or closed; any transition when omitted"},
+				{Name: "timeout_s", In: "query", Type: "number", Description: "how long to wait, default 30, at most 300"},
+				{Name: "since", In: "query", Type: "integer", Description: "the seq of the last transition seen; a later one already made answers at once"},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The transition", Schema: "CircuitTransition"},
+				{Status: http.StatusNoContent, Description: "No matching transition before the timeout"},
+				{Status: http.StatusBadRequest, Description: "Invalid state, timeout_s or since"},
+				{Status: http.StatusServiceUnavailable, Description: "Too many circuit waiters"},
+			},
+			Handler:   s.circuitWaitHandler,
+			Role:      roleRead,
+			Streaming: true,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/circuit",
+			Summary: `Force the breaker open or close it with {"state":"open"|"closed"}`,
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "New breaker state", Schema: "Circuit"},
+				{Status: http.StatusBadRequest, Description: "Invalid state"},
+			},
+			Handler: s.adminCircuitHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/errors",
+			Summary: "Most recent internal errors, newest first",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Error ring contents", Schema: "AdminErrors"},
+			},
+			Handler: adminErrorsHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/audit",
+			Summary: "Recent admin calls and product changes, newest first",
+			Params: []apiParam{
+				{Name: "actor", In: "query", Type: "string", Description: "key:name of an API key, or a client address"},
+				{Name: "action", In: "query", Type: "string", Description: "any part of the action, a method and route like DELETE /products/{id}"},
+				{Name: "target", In: "query", Type: "string", Description: "what was acted on, like product:42, chaos or circuit"},
+				{Name: "request_id", In: "query", Type: "string", Description: "the X-Request-Id of the call"},
+				{Name: "since", In: "query", Type: "string", Description: "RFC 3339 time of the oldest event to return"},
+				{Name: "limit", In: "query", Type: "integer", Description: "events to return, 100 by default and at most 1000"},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Matching events", Schema: "Audit"},
+				{Status: http.StatusBadRequest, Description: "Invalid since or limit"},
+			},
+			Handler: auditHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/watchdog",
+			Summary: "Latest watchdog sample, its thresholds and the profile captures kept",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Watchdog state", Schema: "Watchdog"},
+			},
+			Handler: s.watchdogHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/chaos",
+			Summary: "Current failure injection settings",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Chaos settings", Schema: "Chaos"},
+			},
+			Handler: s.chaosHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPut,
+			Path:    "/admin/chaos",
+			Summary: "Change the simulated failure rate or added latency, or run a schedule of rates",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "New chaos settings", Schema: "Chaos"},
+				{Status: http.StatusConflict, Description: "Chaos is disabled in deterministic mode"},
+				{Status: http.StatusBadRequest, Description: "Neither failure_rate nor schedule given, or either out of range"},
+			},
+			Handler: s.setChaosHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/chaos/spike",
+			Summary: "Fail searches in a one-shot burst, by default all of them for 30 seconds",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Chaos settings with the spike running", Schema: "Chaos"},
+				{Status: http.StatusConflict, Description: "Chaos is disabled in deterministic mode"},
+				{Status: http.StatusBadRequest, Description: "failure_rate or duration_s out of range"},
+			},
+			Handler: s.chaosSpikeHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/chaos/guard/ack",
+			Summary: "Acknowledge a tripped chaos guard, lifting its cap so chaos runs as it was set",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Chaos settings with the guard acknowledged", Schema: "Chaos"},
+				{Status: http.StatusNotFound, Description: "The chaos guard is off"},
+				{Status: http.StatusConflict, Description: "The guard hasn't tripped"},
+			},
+			Handler: s.chaosGuardAckHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/loadtest",
+			Summary: "Drive synthetic searches through this instance and report the outcome",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Report, returned when the run finishes or is cancelled", Schema: "LoadTestReport"},
+				{Status: http.StatusBadRequest, Description: "Invalid rps, duration_s or body"},
+				{Status: http.StatusNotFound, Description: "Load testing is disabled; start with -enable-loadtest"},
+				{Status: http.StatusConflict, Description: "A load test is already running"},
+			},
+			Handler: s.loadTestHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/admin/loadtest",
+			Summary: "Cancel the running load test",
+			Responses: []apiResponse{
+				{Status: http.StatusNoContent, Description: "Cancelled; the POST returns the partial report"},
+				{Status: http.StatusNotFound, Description: "No load test is running"},
+			},
+			Handler: s.cancelLoadTestHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/selftest",
+			Summary: "Run the self-test checks against a scratch catalog and this instance's own",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Every check passed", Schema: "SelfTestReport"},
+				{Status: http.StatusInternalServerError, Description: "At least one check failed", Schema: "SelfTestReport"},
+			},
+			Handler: s.selfTestHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/catalog/import",
+			Summary: "Import like POST /products/import, checked the same way, as an operation run in the background",
+			Responses: []apiResponse{
+				{Status: http.StatusAccepted, Description: "Started; poll the operation at Location", Schema: "Operation"},
+				{Status: http.StatusBadRequest, Description: "Invalid body; nothing will be imported"},
+				{Status: http.StatusConflict, Description: "An import is already running"},
+				{Status: http.StatusRequestEntityTooLarge, Description: "Body larger than -max-import-bytes"},
+			},
+			Handler: s.importOperationHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/catalog/export",
+			Summary: "Pin an export snapshot of the catalog as an operation; its result names the snapshot to download from /products/export",
+			Responses: []apiResponse{
+				{Status: http.StatusAccepted, Description: "Started; poll the operation at Location", Schema: "Operation"},
+				{Status: http.StatusNotFound, Description: "Export snapshots are disabled"},
+				{Status: http.StatusConflict, Description: "An export is already running"},
+			},
+			Handler: s.exportOperationHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/catalog/reload",
+			Summary: "Put the generated catalog back as an operation: every generated product restored and every other removed",
+			Responses: []apiResponse{
+				{Status: http.StatusAccepted, Description: "Started; poll the operation at Location", Schema: "Operation"},
+				{Status: http.StatusConflict, Description: "A reload is already running"},
+			},
+			Handler: s.reloadOperationHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodPost,
+			Path:    "/admin/catalog/purge",
+			Summary: "Delete every product, or those of a brand or category, as an operation",
+			Params: []apiParam{
+				{Name: "brand", In: "query", Type: "string", Description: "only purge this brand, ignoring case"},
+				{Name: "category", In: "query", Type: "string", Description: "only purge this category, ignoring case"},
+			},
+			Responses: []apiResponse{
+				{Status: http.StatusAccepted, Description: "Started; poll the operation at Location", Schema: "Operation"},
+				{Status: http.StatusConflict, Description: "A purge is already running"},
+			},
+			Handler: s.purgeOperationHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/operations/{id}",
+			Summary: "Progress of an admin operation, or how it ended, until -operation-ttl after",
+			Params:  []apiParam{{Name: "id", In: "path", Type: "string", Description: "operation ID from the 202 and its Location"}},
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "The operation", Schema: "Operation"},
+				{Status: http.StatusNotFound, Description: "Unknown operation, or finished more than -operation-ttl ago"},
+			},
+			Handler: s.operationHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/admin/operations/{id}",
+			Summary: "Cancel a running admin operation; it stops between items, keeping what it finished",
+			Params:  []apiParam{{Name: "id", In: "path", Type: "string", Description: "operation ID"}},
+			Responses: []apiResponse{
+				{Status: http.StatusAccepted, Description: "Cancel requested; poll until the state is cancelled", Schema: "Operation"},
+				{Status: http.StatusNotFound, Description: "Unknown operation"},
+				{Status: http.StatusConflict, Description: "The operation has already finished"},
+			},
+			Handler: s.cancelOperationHandler,
+			Role:    roleAdmin,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/admin/validation",
+			Summary: "Product validation rules in force for create, update and import: the built-in limits with -validation-rules on top",
+			Responses: []apiResponse{
+				{Status: http.StatusOK, Description: "Active rules per field", Schema: "ValidationRules"},
+			},
+			Handler: s.validationHandler,
+			// Read, so client developers can check products against it
+			Role: roleRead,
+		},
+	}
+}
+
+// validateRoutes makes sure every route carries enough metadata for the spec
+func validateRoutes(rs []route) error {
+	seen := make(map[string]bool)
+	for _, rt := range rs {
+		key := rt.Method + " " + rt.Path
+		switch {
+		case seen[key]:
+			return fmt.Errorf("route %s registered twice", key)
+		case rt.Handler == nil:
+			return fmt.Errorf("route %s has no handler", key)
+		case rt.Summary == "":
+			return fmt.Errorf("route %s has no summary", key)
+		case len(rt.Responses) == 0:
+			return fmt.Errorf("route %s documents no responses", key)
+		}
+		for _, resp := range rt.Responses {
+			if _, ok := apiSchemas[resp.Schema]; resp.Schema != "" && !ok {
+				return fmt.Errorf("route %s references unknown schema %q", key, resp.Schema)
+			}
+		}
+		for _, p := range rt.Params {
+			if p.In == "path" && !strings.Contains(rt.Path, "{"+p.Name+"}") {
+				return fmt.Errorf("route %s documents path parameter %q not in its path", key, p.Name)
+			}
+		}
+		path := strings.TrimPrefix(rt.Path, apiVersions[rt.Version].Prefix)
+		if err := checkGroup(routeGroup(path, rt), rt); err != nil {
+			return fmt.Errorf("route %s: %w", key, err)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+type pathParamsKey struct{}
+
+// muxPattern converts a templated path like /products/{id} into the
+// ServeMux subtree pattern /products/
+func muxPattern(path string) string {
+	if i := strings.Index(path, "{"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// matchPath matches a request path against a template, returning the
+// values of its {name} segments
+func matchPath(tmpl, path string) (map[string]string, bool) {
+	ts := strings.Split(strings.Trim(tmpl, "/"), "/")
+	ps := strings.Split(strings.Trim(path, "/"), "/")
+	if len(ts) != len(ps) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, t := range ts {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if ps[i] == "" {
+				return nil, false
+			}
+			params[t[1:len(t)-1]] = ps[i]
+		} else if t != ps[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// pathParam returns a path parameter captured for the current route
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// registerRoutes adds the routes to mux, grouping methods that share a
+// mux pattern. Templated paths share one subtree pattern per prefix.
+func registerRoutes(mux *http.ServeMux, rs []route) {
+	byPattern := make(map[string][]route)
+	var order []string
+	for _, rt := range rs {
+		pattern := muxPattern(rt.Path)
+		if _, ok := byPattern[pattern]; !ok {
+			order = append(order, pattern)
+		}
+		byPattern[pattern] = append(byPattern[pattern], rt)
+	}
+	for _, pattern := range order {
+		mux.HandleFunc(pattern, methodDispatch(byPattern[pattern]))
+	}
+}
+
+// methodDispatch picks the route matching the request method and path.
+// The router is the one place methods are handled: HEAD runs a GET route
+// with the body counted rather than sent, OPTIONS outside a CORS
+// preflight lists the methods in Allow, and any other method the path
+// has no route for is a 405 with Allow, never another method's handler.
+func methodDispatch(rs []route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var matched []route
+		var reqs []*http.Request
+		for _, rt := range rs {
+			req := r
+			if strings.Contains(rt.Path, "{") {
+				params, ok := matchPath(rt.Path, r.URL.Path)
+				if !ok {
+					continue
+				}
+				req = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+			}
+			if rt.Method == r.Method {
+				setRequestRoute(r, rt)
+				rt.Handler(w, req)
+				return
+			}
+			matched, reqs = append(matched, rt), append(reqs, req)
+		}
+		if len(matched) == 0 {
+			writeErr(w, r, newError(ErrNotFound, "404 page not found"))
+			return
+		}
+		for i, rt := range matched {
+			if r.Method == http.MethodHead && headable(rt) {
+				setRequestRoute(r, rt)
+				hw := &headResponse{ResponseWriter: w}
+				rt.Handler(hw, reqs[i])
+				hw.finish()
+				return
+			}
+		}
+		setRequestRoute(r, matched[0])
+		allow := allowedMethods(matched)
+		w.Header().Set("Allow", allow)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeErr(w, r, newError(ErrMethodNotAllowed, fmt.Sprintf("%s is not allowed here; use %s", r.Method, allow)))
+	}
+}
+
+// headable reports whether HEAD may run rt: a GET route that answers
+// and returns, unlike a stream, which would hold a HEAD open
+func headable(rt route) bool {
+	return rt.Method == http.MethodGet && !rt.Streaming
+}
+
+// allowedMethods is the Allow header for a path's routes, in
+// methodOrder, with HEAD for its GET routes and OPTIONS always
+func allowedMethods(rs []route) string {
+	has := map[string]bool{http.MethodOptions: true}
+	for _, rt := range rs {
+		has[rt.Method] = true
+		if headable(rt) {
+			has[http.MethodHead] = true
+		}
+	}
+	var out []string
+	for _, m := range methodOrder {
+		if has[m] {
+			out = append(out, m)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+var methodOrder = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// headResponse answers HEAD with what GET would send but the body, whose
+// length it counts for Content-Length unless the handler set one. The
+// status and headers wait for the handler to finish, so the length is
+// known before they are written.
+type headResponse struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (h *headResponse) WriteHeader(code int) {
+	if h.status == 0 {
+		h.status = code
+	}
+}
+
+func (h *headResponse) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	h.n += int64(len(b))
+	return len(b), nil
+}
+
+// Flush does nothing: nothing is sent until finish
+func (h *headResponse) Flush() {}
+
+func (h *headResponse) finish() {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	if h.Header().Get("Content-Length") == "" && h.status >= 200 && h.status != http.StatusNoContent && h.status != http.StatusNotModified {
+		h.Header().Set("Content-Length", strconv.FormatInt(h.n, 10))
+	}
+	h.ResponseWriter.WriteHeader(h.status)
+}
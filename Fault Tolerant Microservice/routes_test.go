@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// TestMethodDispatch sends each method the router handles itself to a
+// path with a GET and a PUT route: HEAD must answer as GET does but for
+// the body, OPTIONS and anything unrouted must list the methods in Allow,
+// and neither may reach a handler
+func TestMethodDispatch(t *testing.T) {
+	const body = `{"id":7}`
+	var ran []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ran = append(ran, r.Method)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"7"`)
+		w.Write([]byte(body))
+	}
+	dispatch := methodDispatch([]route{
+		{Method: http.MethodGet, Path: "/things/{id}", Handler: handler},
+		{Method: http.MethodPut, Path: "/things/{id}", Handler: handler},
+	})
+	send := func(method, path string) *httptest.ResponseRecorder {
+		ran = nil
+		rec := httptest.NewRecorder()
+		dispatch(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	const allow = "GET, HEAD, PUT, OPTIONS"
+
+	rec := send(http.MethodHead, "/things/7")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || len(ran) != 1 {
+		t.Errorf("HEAD: status %d, %d body bytes, handlers run %v", rec.Code, rec.Body.Len(), ran)
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("HEAD: Content-Length %q, want %d", got, len(body))
+	}
+	if rec.Header().Get("ETag") != `"7"` || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("HEAD dropped the GET headers: %v", rec.Header())
+	}
+	rec = send(http.MethodOptions, "/things/7")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != allow || len(ran) != 0 {
+		t.Errorf("OPTIONS: status %d, Allow %q, handlers run %v", rec.Code, rec.Header().Get("Allow"), ran)
+	}
+	for _, m := range []string{http.MethodPost, http.MethodPatch, http.MethodDelete} {
+		rec = send(m, "/things/7")
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != allow || len(ran) != 0 {
+			t.Errorf("%s: status %d, Allow %q, handlers run %v", m, rec.Code, rec.Header().Get("Allow"), ran)
+		}
+	}
+	if rec = send(http.MethodHead, "/other"); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD on an unrouted path: status %d", rec.Code)
+	}
+}
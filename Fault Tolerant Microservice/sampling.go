@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Sampling strategies. Uniform draws the sample from the whole catalog,
+// so a category holding 1% of it gets about one of a hundred checks, and
+// often none. The stratified ones give every value of the field at
+// least one draw and the rest in proportion to its size.
+const (
+	sampleUniform    = "uniform"
+	sampleByCategory = "stratified-by-category"
+	sampleByBrand    = "stratified-by-brand"
+)
+
+var sampleStrategies = []string{sampleUniform, sampleByCategory, sampleByBrand}
+
+func validSampleStrategy(strategy string) bool {
+	for _, v := range sampleStrategies {
+		if v == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// readSampleStrategy reads sample_strategy, which only debug searches
+// may set. It defaults to Config.SampleStrategy.
+func (s *Server) readSampleStrategy(q url.Values, debug bool, errs *fieldErrors) string {
+	v := q.Get("sample_strategy")
+	switch {
+	case v == "":
+	case !debug:
+		errs.add("sample_strategy", "sample_strategy is only honoured with debug")
+	case !validSampleStrategy(v):
+		errs.add("sample_strategy", "sample_strategy must be one of "+strings.Join(sampleStrategies, ", "))
+	default:
+		return v
+	}
+	return s.cfg.SampleStrategy
+}
+
+// stratum is one value of the stratifying field, or its absence, and the
+// products in it
+type stratum struct {
+	ids   []ProductID
+	quota int
+}
+
+// sampleStratifiedLocked draws n products, with replacement like the
+// uniform sample, giving each of ix's values, and the products in none,
+// max(1, n*share) draws and topping up from the whole catalog what
+// rounding leaves. With more strata than n, n of them are picked at
+// random for one draw each. The small strata this favours slightly skew
+// a sampled estimate towards them. Callers hold listLock.
+func (s *productStore) sampleStratifiedLocked(n int, rnd *rand.Rand, ix postingIndex, none []ProductID) []ProductID {
+	total := len(s.list)
+	n = min(n, total)
+	if n == 0 {
+		return nil
+	}
+	// Sorted, so a seed draws the same sample whatever the map order
+	values := make([]string, 0, len(ix))
+	for v := range ix {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	strata := make([]stratum, 0, len(values)+1)
+	for _, v := range values {
+		strata = append(strata, stratum{ids: ix[v]})
+	}
+	if len(none) > 0 {
+		strata = append(strata, stratum{ids: none})
+	}
+
+	if len(strata) > n {
+		for _, i := range rnd.Perm(len(strata))[:n] {
+			strata[i].quota = 1
+		}
+	} else {
+		given := 0
+		for i := range strata {
+			strata[i].quota = max(1, n*len(strata[i].ids)/total)
+			given += strata[i].quota
+		}
+		// The minimum of one can overshoot n; take the excess back from
+		// the largest quotas
+		for ; given > n; given-- {
+			largest := 0
+			for i := range strata {
+				if strata[i].quota > strata[largest].quota {
+					largest = i
+				}
+			}
+			strata[largest].quota--
+		}
+	}
+
+	ids := make([]ProductID, 0, n)
+	for _, st := range strata {
+		for i := 0; i < st.quota; i++ {
+			ids = append(ids, st.ids[rnd.Intn(len(st.ids))])
+		}
+	}
+	for len(ids) < n {
+		ids = append(ids, s.list[rnd.Intn(total)])
+	}
+	// Strata are drawn in value order; shuffle so the first page isn't
+	// all from the first of them
+	rnd.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	return ids
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// skewedStrata are the test catalog's category and brand sizes: one
+// value holds nearly everything, one a fifth of a percent, and a few
+// products have none
+var skewedStrata = []struct {
+	value string
+	size  int
+}{{"Books", 955}, {"Home", 30}, {"Garden", 10}, {"Toys", 2}, {"", 3}}
+
+// newSkewedStore fills a store with skewedStrata for both the category
+// and the brand, returning each product's stratum
+func newSkewedStore(t *testing.T) (*productStore, map[ProductID]string) {
+	s := newProductStore(0)
+	stratumOf := make(map[ProductID]string)
+	for _, st := range skewedStrata {
+		for i := 0; i < st.size; i++ {
+			p, err := s.create(Product{Name: "Skewed Product", Category: st.value, Brand: st.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stratumOf[p.ID] = st.value
+		}
+	}
+	return s, stratumOf
+}
+
+// TestStratifiedSampleCoversEveryStratum draws small samples from a
+// skewed catalog: every stratum, products with no value included, gets
+// a draw in every one of them, which a uniform sample rarely manages
+func TestStratifiedSampleCoversEveryStratum(t *testing.T) {
+	s, stratumOf := newSkewedStore(t)
+	const n, seeds = 20, 200
+	for _, strategy := range []string{sampleByCategory, sampleByBrand} {
+		for seed := int64(0); seed < seeds; seed++ {
+			ids := s.sample(n, rand.New(rand.NewSource(seed)), strategy)
+			if len(ids) != n {
+				t.Fatalf("%s seed %d: %d drawn, want %d", strategy, seed, len(ids), n)
+			}
+			drawn := make(map[string]int)
+			for _, id := range ids {
+				drawn[stratumOf[id]]++
+			}
+			for _, st := range skewedStrata {
+				if drawn[st.value] == 0 {
+					t.Errorf("%s seed %d: stratum %q never drawn: %v", strategy, seed, st.value, drawn)
+				}
+			}
+			// The rest goes in proportion, so the big stratum keeps most
+			if drawn["Books"] < n-len(skewedStrata) {
+				t.Errorf("%s seed %d: Books drew %d of %d", strategy, seed, drawn["Books"], n)
+			}
+		}
+	}
+
+	missed := 0
+	for seed := int64(0); seed < seeds; seed++ {
+		covered := false
+		for _, id := range s.sample(n, rand.New(rand.NewSource(seed)), sampleUniform) {
+			covered = covered || stratumOf[id] == "Toys"
+		}
+		if !covered {
+			missed++
+		}
+	}
+	if missed < seeds/2 {
+		t.Errorf("uniform samples reached the smallest stratum %d times in %d; the skew isn't testing anything", seeds-missed, seeds)
+	}
+}
+
+// TestStratifiedSampleFewerDrawsThanStrata gives n strata one draw each
+// when there are more strata than draws
+func TestStratifiedSampleFewerDrawsThanStrata(t *testing.T) {
+	s, stratumOf := newSkewedStore(t)
+	for seed := int64(0); seed < 50; seed++ {
+		ids := s.sample(3, rand.New(rand.NewSource(seed)), sampleByCategory)
+		drawn := make(map[string]int)
+		for _, id := range ids {
+			drawn[stratumOf[id]]++
+		}
+		if len(ids) != 3 || len(drawn) != 3 {
+			t.Errorf("seed %d: %v, want 3 strata drawn once each", seed, drawn)
+		}
+	}
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+type QueryResult struct {
+	// Products is a []Product, or a []productView under select=. Only an
+	// envelope's search meta leaves it out.
+	Products   interface{} `json:"products,omitempty"`
+	TotalFound int         `json:"total_found"`
+	// SearchTime is the legacy formatted duration, e.g. "0.0123s"; v1
+	// sends SearchTimeMS instead
+	SearchTime   string   `json:"search_time,omitempty"`
+	SearchTimeMS *float64 `json:"search_time_ms,omitempty"`
+	CheckedCount int      `json:"checked_request,omitempty"`
+	TotalChecked int64    `json:"total_checked,omitempty"`
+	Seed         *int64   `json:"seed,omitempty"`
+	Mode         string   `json:"mode,omitempty"`
+	// SampleStrategy is set in debug output for sampled searches
+	SampleStrategy string `json:"sample_strategy,omitempty"`
+	// ChecksPerSearch is set in debug output for sampled searches while
+	// the sample size is tuned: the size in force for this one
+	ChecksPerSearch int `json:"checks_per_search,omitempty"`
+	// Degraded is set when brownout cut this search short
+	Degraded *degradation `json:"degraded,omitempty"`
+	// Suggestions are corrected queries offered when nothing matched
+	Suggestions []string `json:"suggestions,omitempty"`
+	// Warnings describe how a 200 fell short, like a partial failure or
+	// a refused feature flag
+	Warnings []searchWarning `json:"warnings,omitempty"`
+	// Features are the X-Features flags the search turned on
+	Features []string `json:"features,omitempty"`
+	// Shard is set on a sharded instance: which shard answered, from only
+	// its own products
+	Shard *searchShard `json:"shard,omitempty"`
+
+	// From v1 on: whether TotalFound only counts a sample and, if so, the
+	// catalog-wide estimate extrapolated from it
+	Sampled          *bool             `json:"sampled,omitempty"`
+	EstimatedTotal   *int              `json:"estimated_total,omitempty"`
+	EstimateInterval *estimateInterval `json:"estimate_interval,omitempty"`
+	SampleMatches    *int              `json:"sample_matches,omitempty"`
+	// Timings break a v1 debug search down by phase. Encoding happens
+	// after the body is built, so it is only in the Server-Timing header.
+	Timings *searchTimings `json:"timings_ms,omitempty"`
+	// Hedge is set in debug output for sampled searches while hedging is on
+	Hedge *hedgeInfo `json:"hedge,omitempty"`
+	// Cost is the search's estimated work in debug output, unless it was
+	// a snapshot page
+	Cost *searchCost `json:"cost,omitempty"`
+	// Trace lists the candidates a debug search checked and why each
+	// matched or didn't, unless Config.DebugTraceMax is 0
+	Trace *scanTrace `json:"trace,omitempty"`
+	// Chaos is set in debug output when chaos failed the search partially
+	Chaos *chaosPartial `json:"chaos,omitempty"`
+	// Query is how q was parsed, in debug output when it had field scopes
+	Query *parsedQuery `json:"parsed_query,omitempty"`
+	// Snapshot is set on pages of a pinned result set
+	Snapshot *snapshotInfo `json:"snapshot,omitempty"`
+}
+
+// snapshotInfo tells the client which snapshot a page came from; pass id
+// back as snapshot_id for the other pages
+type snapshotInfo struct {
+	ID         string `json:"id"`
+	Generation int64  `json:"generation"`
+	Expires    string `json:"expires"`
+}
+
+// searchTimings are per-phase durations in milliseconds
+type searchTimings struct {
+	// Admission covers the breaker, bulkhead and overload checks
+	Admission float64 `json:"admission"`
+	Scan      float64 `json:"scan"`
+	Chaos     float64 `json:"chaos"`
+	Inventory float64 `json:"inventory"`
+}
+
+// readSnapshot reads snapshot_id, naming a snapshot to page through, or
+// snapshot, which asks for a new one
+func (s *Server) readSnapshot(q url.Values, errs *fieldErrors) (id string, create bool) {
+	if id := q.Get("snapshot_id"); id != "" {
+		return id, false
+	}
+	v := q.Get("snapshot")
+	if v == "" {
+		return "", false
+	}
+	create, err := strconv.ParseBool(v)
+	switch {
+	case err != nil:
+		errs.add("snapshot", "snapshot must be true or false")
+	case create && !s.snapshots.enabled():
+		errs.add("snapshot", "Snapshots are disabled")
+	default:
+		return "", create
+	}
+	return "", false
+}
+
+// scanResult is the outcome of checking a list of candidate IDs. Its
+// slices are pooled, so release it once the response is written.
+type scanResult struct {
+	pooled, pooledAll *[]Product
+	results           []Product
+	matches           int
+	cancelled         bool
+	// trace is nil unless the scan was asked to trace
+	trace *scanTrace
+}
+
+func (sr *scanResult) release() {
+	if sr.pooled == nil {
+		// A snapshot page
+		return
+	}
+	putProducts(sr.pooled)
+	putProducts(sr.pooledAll)
+}
+
+// scanCheckEvery is how many candidates a scan checks between looks at
+// its context
+const scanCheckEvery = 64
+
+// scan checks ids against the query text and filters and keeps the
+// requested page, named for the text's locale. It stops early, with
+// cancelled set, once ctx is done. With traceMax above 0 it also traces
+// up to that many candidates; otherwise nothing is allocated for it.
+func (s *Server) scan(ctx context.Context, ids []ProductID, text searchText, brand, category string, page searchPage, traceMax int) *scanResult {
+	// Results come from pooled slices; appends are stored back so the pool
+	// keeps any growth
+	sr := &scanResult{pooled: getProducts(), pooledAll: getProducts(), trace: newScanTrace(traceMax, len(ids))}
+	trace := sr.trace
+	results := *sr.pooled
+	// A sorted page only needs the best offset+limit matches, so that is
+	// all it keeps; every match is still counted
+	top := &topN{by: page.sort, n: page.offset + page.limit, ps: *sr.pooledAll}
+	defer func() { *sr.pooled, *sr.pooledAll = results, top.ps }()
+
+	for i, id := range ids {
+		if i%scanCheckEvery == scanCheckEvery-1 && ctx.Err() != nil {
+			sr.cancelled = true
+			return sr
+		}
+		sp, ok := s.store.lookup(id)
+		if !ok {
+			trace.record(id, traceDeleted)
+			continue
+		}
+		// Recheck the filters in case of an update racing the index
+		reason := sp.scanMatch(text, brand, category)
+		trace.record(id, reason)
+		if reason != "" {
+			continue
+		}
+		sr.matches++
+		if page.sort != "" {
+			top.offer(sp.localized(text.locale))
+		} else if sr.matches > page.offset && len(results) < page.limit {
+			results = append(results, text.withPositions(sp.localized(text.locale)))
+		}
+	}
+	if page.sort != "" {
+		if sorted := top.sorted(); page.offset < len(sorted) {
+			// Only the page kept needs its matches
+			for _, p := range sorted[page.offset:] {
+				results = append(results, text.withPositions(p))
+			}
+		}
+	}
+	sr.results = results
+	return sr
+}
+
+// snapshotScan scans every match, pins them as a snapshot and returns the
+// requested page of it. A search matching more than a snapshot holds is
+// refused rather than pinned in part.
+func (s *Server) snapshotScan(w http.ResponseWriter, r *http.Request, ids []ProductID, text searchText, brand, category string, page searchPage, mode string) (*scanResult, *searchSnapshot, bool) {
+	// Taken first, so the snapshot is at least as new as its generation
+	gen := s.store.events.lastID()
+	sr := s.scan(r.Context(), ids, text, brand, category, searchPage{limit: snapshotMaxProducts, sort: page.sort}, 0)
+	if sr.cancelled {
+		return sr, nil, true
+	}
+	if sr.matches > snapshotMaxProducts {
+		sr.release()
+		s.snapshots.refuse()
+		writeErr(w, r, invalid("snapshot", fmt.Sprintf("Search matches %d products, more than the %d a snapshot holds; narrow it", sr.matches, snapshotMaxProducts)))
+		return nil, nil, false
+	}
+	snap := s.snapshots.add(gen, mode, len(ids), sr.results)
+	sr.release()
+	return snap.page(page), snap, true
+}
+
+// clientGone reports whether the client has given up on r, recording the
+// search as client_cancelled at stage if so. The deferred bulkhead
+// Release frees the slot, and no outcome reaches the breaker: a client
+// hanging up says nothing about the service.
+func (s *Server) clientGone(r *http.Request, stage string) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+	s.recordCancelled(stage)
+	return true
+}
+
+func (s *Server) recordCancelled(stage string) {
+	s.count(&s.stats.clientCancelled, windowCancelled, 1)
+	s.statsd.incr("search.client_cancelled", "stage:"+stage)
+}
+
+// sleepCtx waits d on the clock, reporting false if ctx ended first
+func sleepCtx(ctx context.Context, clock Clock, d time.Duration) bool {
+	t := clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// reported is d as a response reports it: zero in deterministic mode,
+// which freezes what clients see but leaves the clock itself running
+func (s *Server) reported(d time.Duration) time.Duration {
+	if s.cfg.Deterministic {
+		return 0
+	}
+	return d
+}
+
+// estimateInterval bounds EstimatedTotal at the given confidence
+type estimateInterval struct {
+	Low        int     `json:"low"`
+	High       int     `json:"high"`
+	Confidence float64 `json:"confidence"`
+}
+
+// estimateZ is the normal quantile for a 95% interval
+const estimateZ = 1.96
+
+// estimateTotal extrapolates matches among sampled products to a catalog
+// of the given size, with a Wilson score interval for the match rate
+func estimateTotal(matches, sampled, catalog int) (int, estimateInterval) {
+	ci := estimateInterval{Confidence: 0.95}
+	if sampled == 0 {
+		return 0, ci
+	}
+	n := float64(sampled)
+	p := float64(matches) / n
+	z2 := estimateZ * estimateZ
+	center := (p + z2/(2*n)) / (1 + z2/n)
+	half := estimateZ * math.Sqrt(p*(1-p)/n+z2/(4*n*n)) / (1 + z2/n)
+	size := float64(catalog)
+	ci.Low = int(math.Floor(math.Max(0, center-half) * size))
+	ci.High = int(math.Ceil(math.Min(1, center+half) * size))
+	return int(math.Round(p * size)), ci
+}
+
+// Search modes, each a matcher in matchers. Sampling checks
+// ChecksPerSearch random products; exhaustive checks them all; indexed
+// narrows the check to trigram index candidates, scanning exhaustively
+// when it can't be used.
+const (
+	modeSample     = "sample"
+	modeExhaustive = "exhaustive"
+	modeIndexed    = "indexed"
+)
+
+// errSimulatedFailure is the chaos failure a search answers with
+var errSimulatedFailure = newError(ErrInternal, "Overload failure simulation")
+
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	s.count(&s.stats.requests, windowRequests, 1)
+	received := s.clock.Now()
+	req, ok := s.searchRequestFor(w, r)
+	if !ok {
+		return
+	}
+
+	// Circuit breaker implementation
+	if ok, remaining := s.breaker.Allow(); !ok {
+		s.count(&s.stats.rejectedCircuit, windowRejected, 1)
+		s.statsd.incr("search.rejected", "reason:circuit_open")
+		if remaining > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+		}
+		s.shed(w, r, req, s.cfg.RejectionStatus.reject(ErrCircuitOpen, rejectCircuitOpen, "Circuit Open"))
+		return
+	}
+
+	if err := s.bulkhead.Acquire(r.Context()); err != nil {
+		if s.clientGone(r, "admission") {
+			// Gave up while queued for a slot
+			return
+		}
+		s.count(&s.stats.rejectedBulkhead, windowRejected, 1)
+		kind, reason := ErrOverloaded, rejectBulkhead
+		if err == resilience.ErrBulkheadTimeout {
+			kind, reason = ErrTimeout, rejectBulkheadTimeout
+		}
+		s.statsd.incr("search.rejected", "reason:"+reason)
+		s.shed(w, r, req, s.cfg.RejectionStatus.reject(kind, reason, "Request overload"))
+		return
+	}
+	defer s.bulkhead.Release()
+	// Increment the concurrent request counter at start
+	atomic.AddInt32(&s.inFlight, 1)
+
+	// Decrement it when the request finishes
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	start := s.clock.Now()
+	debug, sel, format, page, strategy := req.debug, req.sel, req.format, req.page, req.strategy
+	brand, category, wantSnapshot := req.brand, req.category, req.snapshot
+	rnd := requestRandFor(req.seed)
+	defer putRequestRand(rnd)
+	mode := req.mode
+	if mode == "" {
+		mode = s.cfg.SearchMode
+		if featureOn(r, featureIndexed) {
+			mode = modeIndexed
+		}
+	}
+	var snap *searchSnapshot
+	if req.snapshotID != "" {
+		if snap, ok = s.snapshots.get(req.snapshotID); !ok {
+			writeErr(w, r, newError(ErrGone, "Snapshot expired or unknown; search again with snapshot=true"))
+			return
+		}
+	}
+	text := newSearchText(req.query, req.locale, req.fold)
+	text.positions = req.positions
+	text.price, text.stock = req.price, req.stock
+	q := text.q
+	setLocaleHeaders(w, text.locale)
+
+	// How many products to check for this request
+	checks := s.checksPerSearch()
+	n := min(checks, s.store.size())
+
+	// If there are too many requests, this keeps the service from being overwhelmed and fails fast
+	if s.searchLoad(r) > s.cfg.MaxConcurrent {
+		s.count(&s.stats.rejectedOverload, windowRejected, 1)
+		s.statsd.incr("search.rejected", "reason:overload")
+		s.shed(w, r, req, s.cfg.RejectionStatus.reject(ErrOverloaded, rejectOverload, "Server overloaded, try again later"))
+		return
+	}
+
+	// Under brownout, check fewer products rather than reject
+	var deg *degradation
+	level := s.brownout.observe(float64(s.searchLoad(r)) / float64(s.cfg.MaxConcurrent))
+	if level > 0 {
+		step := brownoutLadder[level-1]
+		deg = &degradation{Level: level}
+		if reduced := int(float64(n) * step.checks); reduced < n {
+			n = reduced
+			if n < 1 {
+				n = 1
+			}
+			deg.ChecksPerSearch = n
+		}
+		deg.ScanLimit = step.scanLimit
+	}
+
+	admitted := s.clock.Now()
+	requested := mode
+	fromSnapshot := snap != nil
+	traceMax := 0
+	if debug {
+		traceMax = s.cfg.DebugTraceMax
+	}
+	var ids []ProductID
+	var cost *searchCost
+	mq := matchQuery{text: text, brand: brand, category: category, n: n, strategy: strategy, rnd: rnd.Rand, page: page, traceMax: traceMax}
+	if fromSnapshot {
+		// A snapshot page scans nothing for brownout to cut
+		mode, n, deg = snap.mode, snap.checked, nil
+	} else {
+		ids, mode = matcherFor(mode).candidates(s, mq)
+		if deg != nil {
+			if mode == modeSample && deg.ChecksPerSearch > 0 {
+				deg.Skipped = append(deg.Skipped, "sample")
+			}
+			if mode != modeSample && deg.ScanLimit > 0 && len(ids) > deg.ScanLimit {
+				ids = ids[:deg.ScanLimit]
+				deg.Skipped = append(deg.Skipped, "scan")
+			}
+			if len(deg.Skipped) == 0 {
+				deg = nil
+			}
+		}
+		// A query over the work budget checks what fits and says so, like
+		// a brownout cut
+		c := s.estimateCost(len(ids), mode, page, traceMax, wantSnapshot)
+		if fit := c.fit(len(ids)); fit < len(ids) {
+			ids = ids[:fit]
+			if deg == nil {
+				deg = &degradation{Level: level}
+			}
+			deg.Skipped = append(deg.Skipped, "budget")
+		}
+		s.costs.observe(c)
+		charged, ok := s.costs.acquire(c.work())
+		if !ok {
+			s.statsd.incr("search.rejected", "reason:"+rejectCost)
+			s.shed(w, r, req, s.cfg.RejectionStatus.reject(ErrOverloaded, rejectCost, "Too much search work in flight, try again later"))
+			return
+		}
+		defer s.costs.release(charged)
+		c.Charged = charged
+		cost = &c
+		n = len(ids)
+	}
+	// Stock comparisons need every candidate's stock before the scan, so
+	// it counts and pages only products in range; a category the
+	// inventory dependency couldn't give is left out, marked degraded
+	if text.stock.set() && !fromSnapshot {
+		var skipped []string
+		text.stocks, skipped = s.candidateStock(r.Context(), ids, rnd.Rand)
+		mq.text.stocks = text.stocks
+		if skipped != nil {
+			if deg == nil {
+				deg = &degradation{Level: level}
+			}
+			deg.Skipped = append(deg.Skipped, "stock")
+			deg.StockSkipped = skipped
+		}
+	}
+
+	var sr *scanResult
+	var hedge *hedgeInfo
+	var checked matchStats
+	switch {
+	case fromSnapshot:
+		sr = snap.page(page)
+	case wantSnapshot:
+		if sr, snap, ok = s.snapshotScan(w, r, ids, text, brand, category, page, mode); !ok {
+			return
+		}
+		checked = matchStats{Checked: len(ids), Matched: sr.matches}
+	case mode == modeSample && s.hedger != nil:
+		// Hedging races two of the sample matcher's scans
+		sr, ids, hedge = s.hedgedScan(r.Context(), ids, n, strategy, text, page, traceMax, rnd.Rand)
+		checked = matchStats{Checked: len(ids), Matched: sr.matches}
+	default:
+		var err error
+		if sr, checked, err = matcherFor(mode).match(r.Context(), s, mq, ids); err != nil {
+			s.matchCounts[mode].record(checked, err)
+			writeErr(w, r, err)
+			return
+		}
+	}
+	if !fromSnapshot {
+		s.matchCounts[mode].record(checked, nil)
+	}
+	defer sr.release()
+	if sr.cancelled {
+		// The client went away; nobody is left to answer
+		s.recordCancelled("scan")
+		return
+	}
+	// The tuner judges the sample size by full scans of it alone, before
+	// chaos adds its delay
+	if s.checksTuner != nil && mode == modeSample && !fromSnapshot && deg == nil {
+		s.checksTuner.observe(s.clock.Since(admitted))
+	}
+	results, matches := sr.results, sr.matches
+	// The injected delay is chaos's time, not the scan's
+	scanned := s.clock.Now()
+	if d := s.chaos.Delay(); d > 0 {
+		sleepCtx(r.Context(), s.clock, d)
+	}
+	if s.clientGone(r, "scan") {
+		return
+	}
+
+	// Simulate crashes (20% by default) to demonstrate partial failure.
+	// Matching is done by now, so under ChaosPartial the failure keeps
+	// what it found.
+	var partial *chaosPartial
+	var warnings []searchWarning
+	if s.chaos.ShouldFail(rnd.Rand) {
+		if !s.cfg.ChaosPartial && !featureOn(r, featurePartial) {
+			s.count(&s.stats.failures, windowFailures, 1)
+			s.statsd.incr("search.failures")
+			s.breaker.RecordFailure()
+			log.Println("Product search failed")
+			s.chaos.Burn()
+
+			writeErr(w, r, errSimulatedFailure)
+			return
+		}
+		var warn searchWarning
+		results, partial, warn = s.partialFailure(results, rnd.Rand)
+		warnings = append(warnings, warn)
+		addSaturating(&s.stats.partial, 1)
+		s.statsd.incr("search.partial")
+		if partial.Breaker {
+			s.breaker.RecordFailure()
+		}
+		log.Println("Product search failed after matching, answering with partial results")
+		s.chaos.Burn()
+	}
+	chaosDone := s.clock.Now()
+
+	// Offer corrections for a query that found nothing, unless brownout
+	// is already cutting work
+	var suggestions []string
+	if matches == 0 && q != "" && !fromSnapshot {
+		s.zeroResults.record(q)
+		if level == 0 {
+			suggestions = s.store.suggest(q)
+		}
+	}
+
+	// Stock comes from the inventory dependency, a call per category;
+	// results of a category it couldn't give still go out, marked
+	// degraded. A stock filter has fetched it already.
+	if s.inventory != nil {
+		if text.stocks != nil {
+			for i := range results {
+				if n, ok := text.stocks[results[i].ID]; ok {
+					results[i].Stock = &n
+				}
+			}
+		} else if skipped := s.enrichStock(r.Context(), results, rnd.Rand); skipped != nil {
+			if deg == nil {
+				deg = &degradation{Level: level}
+			}
+			deg.Skipped = append(deg.Skipped, "stock")
+			deg.StockSkipped = skipped
+		}
+	}
+	enriched := s.clock.Now()
+	// Last look before the outcome is recorded and the body encoded
+	if s.clientGone(r, "encode") {
+		return
+	}
+	// The outcome is recorded only now so a slow call counts as slow; a
+	// partial answer the breaker counted has been recorded already
+	if (partial == nil || !partial.Breaker) && s.breaker.RecordLatency(enriched.Sub(start)) {
+		s.statsd.incr("search.slow")
+	}
+	if partial != nil {
+		w.Header().Set("X-Partial-Results", partial.Mode)
+	}
+	if deg != nil {
+		w.Header().Set("X-Degraded", deg.header())
+	}
+	s.count(&s.stats.successes, windowSuccesses, 1)
+
+	if !fromSnapshot {
+		s.count(&s.stats.checkTotal, windowChecked, int64(n))
+	}
+	ct := atomic.LoadInt64(&s.stats.checkTotal)
+
+	var tags []string
+	features := featuresFrom(r)
+	if features != nil {
+		warnings = append(warnings, features.ignored...)
+		if f := features.label(); f != "" {
+			tags = append(tags, "features:"+f)
+		}
+	}
+	s.statsd.incr("search.successes", tags...)
+	elapsed := s.clock.Since(start)
+	s.statsd.timing("search.latency", elapsed, tags...)
+	s.count(nil, windowLatency, int64(elapsed))
+	resp := QueryResult{
+		Products:    projectProducts(results, sel),
+		TotalFound:  matches,
+		Degraded:    deg,
+		Suggestions: suggestions,
+		Warnings:    warnings,
+		Shard:       s.searchMeta(),
+	}
+	if features != nil {
+		resp.Features = features.active
+	}
+	if snap != nil {
+		resp.Snapshot = &snapshotInfo{ID: snap.id, Generation: snap.gen, Expires: snap.expires.UTC().Format(time.RFC3339)}
+	}
+	// The unprefixed route keeps the shape it always had: fields added
+	// since, suggestions and the debug fields past the first two are v1's
+	v1 := requestAPIVersion(r) >= 1
+	took := s.reported(elapsed)
+	if v1 {
+		ms := durationMS(took)
+		resp.SearchTimeMS = &ms
+	} else {
+		resp.SearchTime = fmt.Sprintf("%.4fs", took.Seconds())
+		resp.Suggestions = nil
+		if sel == 0 {
+			resp.Products = legacyProducts(results)
+		}
+	}
+	var est int
+	var estimate *estimateInterval
+	if mode == modeSample {
+		var ci estimateInterval
+		est, ci = estimateTotal(matches, n, s.store.size())
+		estimate = &ci
+	}
+	if s.shadow != nil && !fromSnapshot && partial == nil && requested != s.shadow.mode && s.shadow.pick() {
+		ids := make([]ProductID, len(results))
+		for i, p := range results {
+			ids[i] = p.ID
+		}
+		s.shadowSearch(text, brand, category, page, n, shadowPrimary{mode: mode, seed: rnd.seed, matches: matches, ids: ids, estimate: estimate})
+	}
+	// Sampled, debug, degraded and partial responses aren't a function of
+	// the catalog alone, and suggestions can change without a match changing
+	if fill := cacheFillFrom(r); fill != nil && !debug && snap == nil && mode != modeSample && deg == nil && partial == nil && suggestions == nil && s.inventory == nil {
+		fill.ok = true
+		fill.text, fill.brand, fill.category = text, brand, category
+		fill.ids = make([]ProductID, len(results))
+		for i, p := range results {
+			fill.ids[i] = p.ID
+		}
+	}
+	if format != nil {
+		s.writeStream(w, r, format, "search", productSlice(results))
+		return
+	}
+	if v1 {
+		sampled := mode == modeSample
+		resp.Sampled = &sampled
+		if sampled {
+			resp.EstimatedTotal, resp.EstimateInterval = &est, estimate
+		}
+	}
+	if debug {
+		resp.CheckedCount = n
+		resp.TotalChecked = ct
+	}
+	if debug && v1 {
+		seed := rnd.seed
+		resp.Seed = &seed
+		resp.Mode = mode
+		if mode == modeSample {
+			resp.SampleStrategy = strategy
+			if s.checksTuner != nil {
+				resp.ChecksPerSearch = checks
+			}
+		}
+		if resp.Sampled != nil && *resp.Sampled {
+			resp.SampleMatches = &matches
+		}
+		resp.Hedge = hedge
+		resp.Cost = cost
+		resp.Chaos = partial
+		if sr.trace != nil {
+			sr.trace.Seed = rnd.seed
+			resp.Trace = sr.trace
+		}
+		if req.query.scoped() {
+			resp.Query = &req.query
+		}
+		resp.Timings = &searchTimings{
+			Admission: durationMS(s.reported(admitted.Sub(received))),
+			Scan:      durationMS(s.reported(scanned.Sub(admitted))),
+			Chaos:     durationMS(s.reported(chaosDone.Sub(scanned))),
+			Inventory: durationMS(s.reported(enriched.Sub(chaosDone))),
+		}
+	}
+
+	var body interface{} = resp
+	if s.envelopes(r) {
+		body = searchEnvelope(w, r, &resp, page, took, rnd.seed)
+	}
+	encodeStart := s.clock.Now()
+	buf, err := encodeJSON(body)
+	if err != nil {
+		writeErr(w, r, newError(ErrInternal, "Failed to encode response"))
+		return
+	}
+	defer putBuffer(buf)
+	if resp.Timings != nil {
+		w.Header().Set("Server-Timing", fmt.Sprintf("admission;dur=%g, scan;dur=%g, chaos;dur=%g, inventory;dur=%g, encode;dur=%g",
+			resp.Timings.Admission, resp.Timings.Scan, resp.Timings.Chaos, resp.Timings.Inventory, durationMS(s.reported(s.clock.Since(encodeStart)))))
+	}
+	if err := writeEncoded(w, http.StatusOK, buf); err != nil {
+		// The search succeeded but the client went before it was sent
+		s.recordCancelled("write")
+	}
+}
+
+// searchEnvelope moves a v1 search response into an envelope. Links to
+// further pages of a snapshot name it, and those of a sampled search
+// carry its seed so they page through the same sample.
+func searchEnvelope(w http.ResponseWriter, r *http.Request, resp *QueryResult, page searchPage, elapsed time.Duration, seed int64) *envelope {
+	meta := envelopeMeta{Total: resp.TotalFound, Limit: page.limit, Offset: page.offset, ElapsedMS: durationMS(elapsed)}
+	sampled := resp.Sampled != nil && *resp.Sampled
+	if sampled {
+		meta.Total, meta.Estimated = *resp.EstimatedTotal, true
+	}
+	pin := map[string]string{}
+	switch {
+	case resp.Snapshot != nil:
+		pin["snapshot_id"], pin["snapshot"] = resp.Snapshot.ID, ""
+	case sampled:
+		pin["seed"] = strconv.FormatInt(seed, 10)
+	}
+	rest := *resp
+	rest.Products, rest.SearchTimeMS = nil, nil
+	// The envelope gives the flags, and their warnings, in its own meta
+	rest.Features, rest.Warnings = nil, nil
+	for _, w := range resp.Warnings {
+		if w.Code != codeFeatureIgnored {
+			rest.Warnings = append(rest.Warnings, w)
+		}
+	}
+	meta.Search = &rest
+	return newEnvelope(w, r, resp.Products, resp.TotalFound, meta, pin)
+}
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":           "Go Product Search Service running",
+		"num_products":      s.cfg.NumProducts,
+		"checks_per_search": s.checksPerSearch(),
+		"sample_strategy":   s.cfg.SampleStrategy,
+		"version":           serviceVersion,
+		"deterministic":     s.cfg.Deterministic,
+		"registration":      s.cfg.Consul.status(),
+		"persistence":       s.persistenceStatus(),
+		"demo_mode":         s.demoStatus(),
+		"shard":             s.searchMeta(),
+	})
+}
+
+// searchPage is the requested window of search results
+type searchPage struct {
+	offset int
+	limit  int
+	// sort is "", "id" or "name". Unsorted results are in ID order for
+	// filtered and indexed searches, catalog order for exhaustive ones and
+	// sample order otherwise.
+	sort string
+}
+
+var searchSorts = []string{"id", "name"}
+
+// readSearchPage reads offset, limit and sort. limit defaults to and is
+// capped at MaxResults.
+func (s *Server) readSearchPage(q url.Values, errs *fieldErrors) searchPage {
+	page := searchPage{limit: s.cfg.MaxResults}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs.add("offset", "offset must be a non-negative integer")
+		} else {
+			page.offset = n
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > s.cfg.MaxResults {
+			errs.add("limit", fmt.Sprintf("limit must be between 1 and %d", s.cfg.MaxResults))
+		} else {
+			page.limit = n
+		}
+	}
+	if v := q.Get("sort"); v != "" {
+		if v != "id" && v != "name" {
+			errs.add("sort", "sort must be one of "+strings.Join(searchSorts, ", "))
+		} else {
+			page.sort = v
+		}
+	}
+	return page
+}
+
+// sortProducts orders ps by ID or by name, breaking ties by ID
+func sortProducts(ps []Product, by string) {
+	sort.Slice(ps, func(i, j int) bool { return productLess(&ps[i], &ps[j], by) })
+}
+
+func productLess(a, b *Product, by string) bool {
+	if by == "name" && a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
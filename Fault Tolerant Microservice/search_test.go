@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSearchClientGone checks a search whose client has gone writes
+// nothing, counts as client_cancelled and leaves the breaker and bulkhead
+// as it found them
+func TestSearchClientGone(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	for _, target := range []string{"/products/search?q=alpha", "/products/search?mode=exhaustive&q=alpha", "/v1/products/search?q=alpha"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+		if rec.Body.Len() != 0 {
+			t.Errorf("%s: answered a client that had gone: %s", target, rec.Body)
+		}
+	}
+	if n := atomic.LoadInt64(&s.stats.clientCancelled); n != 3 {
+		t.Errorf("client_cancelled %d, want 3", n)
+	}
+	snap := s.breaker.Snapshot()
+	if snap.Failures != 0 || snap.WindowRequests != 0 {
+		t.Errorf("the breaker heard about it: %+v", snap)
+	}
+	if st := s.bulkhead.Stats(); st.InUse != 0 {
+		t.Errorf("%d bulkhead slots still held", st.InUse)
+	}
+}
+
+func TestScanStopsWhenCancelled(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sr := s.scan(ctx, s.store.allIDs(), searchText{q: "product"}, "", "", searchPage{limit: 20}, 0)
+	defer sr.release()
+	if !sr.cancelled || sr.matches >= testProducts {
+		t.Errorf("cancelled %v after %d matches", sr.cancelled, sr.matches)
+	}
+}
+
+// BenchmarkScan checks a sample of 1000 against a query, once against the
+// precomputed lowercase fields and once lowercasing each product's name
+// and category per check as searches did before
+func BenchmarkScan(b *testing.B) {
+	s := newTestServer(b, func(cfg *Config) { cfg.NumProducts, cfg.ChecksPerSearch = 10000, 1000 })
+	ids := s.store.sample(s.cfg.ChecksPerSearch, rand.New(rand.NewSource(1)), "")
+	text := newSearchText(parseQuery("alpha"), defaultLocale, false)
+	b.Run("precomputed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.scan(context.Background(), ids, text, "", "", searchPage{limit: 20}, 0).release()
+		}
+	})
+	b.Run("lowercase-per-check", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			matches := 0
+			for _, id := range ids {
+				p, ok := s.store.get(id)
+				if ok && (strings.Contains(strings.ToLower(p.Name), text.q) || strings.Contains(strings.ToLower(p.Category), text.q)) {
+					matches++
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkSearchHandler sends an exhaustive search answering a full page
+// through the whole handler stack, counting what each request allocates
+func BenchmarkSearchHandler(b *testing.B) {
+	h := newTestServer(b, func(cfg *Config) { cfg.NumProducts = 10000 }).Routes()
+	const target = "/v1/products/search?mode=exhaustive&q=product&limit=20"
+	if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != http.StatusOK {
+		b.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// searchRequest is a search's parameters, validated and normalised by
+// parseSearchRequest. A new search parameter is read there and added
+// here; the search handler, /shards/search and spilled search jobs take
+// it from this struct rather than the URL.
+type searchRequest struct {
+	// query is q parsed into free text and field scopes. brand and
+	// category are its scopes merged with the brand and category
+	// parameters.
+	query           parsedQuery
+	brand, category string
+	// price is the query's price comparisons merged with min_price and
+	// max_price, and stock its stock comparisons
+	price, stock numberRange
+	// mode is the mode= asked for, a registered one, or "" for the
+	// handler's default
+	mode   string
+	page   searchPage
+	fold   bool
+	locale string
+	debug  bool
+	sel    fieldSet
+	// positions asks for each result's match offsets
+	positions bool
+	// format is nil for a JSON response
+	format   *streamFormat
+	strategy string
+	// seed seeds the search's sampling and chaos, from seed= or else the
+	// server's seed sequence
+	seed int64
+	// snapshotID names a pinned snapshot to page through; snapshot asks
+	// to pin a new one
+	snapshotID string
+	snapshot   bool
+	// async is whether the client would take a 202 over being shed, and
+	// callback where to POST the result then
+	async    bool
+	callback string
+}
+
+// searchRequestKey carries the searchRequest a spilled search job was
+// accepted with, so its replay runs that rather than parsing again
+type searchRequestKey struct{}
+
+// parseSearchRequest reads every search parameter of r, reporting all
+// those at fault rather than stopping at the first
+func (s *Server) parseSearchRequest(r *http.Request) (searchRequest, []*ValidationError) {
+	q := r.URL.Query()
+	var errs fieldErrors
+	req := searchRequest{
+		query:  parseQuery(q.Get("q")),
+		fold:   readFold(q, &errs),
+		locale: resolveLocale(r),
+		debug:  q.Get("debug") == "1" || strings.ToLower(q.Get("debug")) == "true",
+		page:   s.readSearchPage(q, &errs),
+		seed:   s.readSeed(q, &errs),
+	}
+	req.brand, req.category = mergeScopes(q, req.query, &errs)
+	req.price, req.stock = readRanges(q, req.query, &errs)
+	if req.stock.set() && s.inventory == nil {
+		errs.add("q", "q compares stock, which comes from the inventory dependency; start with -inventory")
+	}
+	if mode := q.Get("mode"); mode != "" {
+		if _, ok := lookupMatcher(mode); ok {
+			req.mode = mode
+		} else {
+			errs.add("mode", "mode must be one of "+strings.Join(searchModes, ", "))
+		}
+	}
+	req.strategy = s.readSampleStrategy(q, req.debug, &errs)
+	req.sel = readSelect(q, &errs)
+	req.format = readFormat(q, req.sel, &errs)
+	req.snapshotID, req.snapshot = s.readSnapshot(q, &errs)
+	if req.positions = readPositions(q, &errs); req.positions {
+		// A snapshot pins its products as they were first returned, and
+		// CSV has no column for the matches
+		switch {
+		case req.snapshot || req.snapshotID != "":
+			errs.add("positions", "positions can't be used with snapshot or snapshot_id")
+		case req.format != nil && !req.format.NDJSON:
+			errs.add("positions", "positions can't be used with format=csv")
+		}
+	}
+	req.async, req.callback = s.readSpill(r, &errs)
+	return req, errs
+}
+
+// searchRequestFor is the request a spilled job was accepted with, or r's
+// parameters parsed, writing a 400 naming every one at fault
+func (s *Server) searchRequestFor(w http.ResponseWriter, r *http.Request) (*searchRequest, bool) {
+	if req, ok := r.Context().Value(searchRequestKey{}).(*searchRequest); ok {
+		return req, true
+	}
+	req, errs := s.parseSearchRequest(r)
+	if err := fieldErrors(errs).err(); err != nil {
+		writeErr(w, r, err)
+		return nil, false
+	}
+	return &req, true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// searchRequestRounds is how many random requests
+// TestParseSearchRequestRandom parses
+const searchRequestRounds = 5000
+
+// searchRequestParams are the parameters the random and fuzzed requests
+// are built from, with one the parser doesn't know
+var searchRequestParams = []string{"q", "brand", "category", "offset", "limit", "sort", "mode", "seed", "fold", "debug",
+	"sample_strategy", "select", "format", "fields", "download", "snapshot", "snapshot_id", "lang", "min_price", "max_price", "x"}
+
+// searchRequestValues are hostile values for any parameter: numbers out
+// of range or in other bases, every field prefix and comparison, broken
+// escapes and quotes, and the valid names of modes, sorts and formats
+func searchRequestValues() []string {
+	values := []string{"", "0", "1", "-1", "10", "007", "100000", "1e3", "0x10", "NaN", "9223372036854775808", "-9223372036854775809",
+		"true", "false", "id", "name", "csv", "ndjson", "uniform", "brand:", "category:", "-name:", `name:"`, `"`, `brand:a brand:b`,
+		"price:<", "price:<2000", "price:>=9223372036854775808", "price:1..", "price:..", "-price:5", "stock:>1", "brand:<a",
+		"\x00", "%", "%zz", "É", "\uFFFD", strings.Repeat("a", 4096), "id,name,,", ",", "de", "zz-ZZ;q=2"}
+	return append(values, searchModes...)
+}
+
+// TestParseSearchRequestReportsEveryField feeds parseSearchRequest a
+// request bad in every parameter it validates, expecting each named in
+// the errors
+func TestParseSearchRequestReportsEveryField(t *testing.T) {
+	s := newTestServer(t, nil)
+	bad := "offset=-1&limit=0&sort=price&mode=fast&fold=maybe&seed=x&sample_strategy=weighted&select=weight&format=xml&snapshot=perhaps&min_price=-1&max_price=1e3"
+	_, errs := s.parseSearchRequest(&http.Request{URL: &url.URL{RawQuery: bad}, Header: http.Header{}})
+	reported := make(map[string]bool, len(errs))
+	for _, e := range errs {
+		reported[e.Field] = true
+	}
+	for _, f := range []string{"offset", "limit", "sort", "mode", "fold", "seed", "sample_strategy", "select", "format", "snapshot", "min_price", "max_price"} {
+		if !reported[f] {
+			t.Errorf("%s wasn't reported among %d errors for %s", f, len(errs), bad)
+		}
+	}
+}
+
+// TestParseSearchRequestRandom parses random query strings built from
+// hostile values, expecting no panic and, when nothing is reported, a
+// page and mode the handlers can use as they are
+func TestParseSearchRequestRandom(t *testing.T) {
+	s := newTestServer(t, nil)
+	params, values := searchRequestParams, searchRequestValues()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < searchRequestRounds; i++ {
+		var raw []string
+		for n := rnd.Intn(8); n > 0; n-- {
+			k := params[rnd.Intn(len(params))]
+			v := values[rnd.Intn(len(values))]
+			if rnd.Intn(4) == 0 {
+				// Unescaped, so the URL's own decoding is tested too
+				raw = append(raw, k+"="+v)
+			} else {
+				raw = append(raw, url.QueryEscape(k)+"="+url.QueryEscape(v))
+			}
+		}
+		r := &http.Request{URL: &url.URL{RawQuery: strings.Join(raw, "&")}, Header: http.Header{}}
+		if rnd.Intn(2) == 0 {
+			r.Header.Set("Accept-Language", values[rnd.Intn(len(values))])
+		}
+		if err := checkSearchRequest(s, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkSearchRequest parses r, turning a panic, an error without a
+// message or a request the handlers can't use as it is into an error
+func checkSearchRequest(s *Server, r *http.Request) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("parsing %s panicked: %v", r.URL.RawQuery, p)
+		}
+	}()
+	req, errs := s.parseSearchRequest(r)
+	switch {
+	case len(errs) > 0:
+		for _, e := range errs {
+			if e.Message == "" {
+				return fmt.Errorf("an error for %s has no message", r.URL.RawQuery)
+			}
+		}
+	case req.page.offset < 0 || req.page.limit < 1 || req.page.limit > s.cfg.MaxResults:
+		return fmt.Errorf("%s passed with offset %d and limit %d", r.URL.RawQuery, req.page.offset, req.page.limit)
+	case req.mode != "":
+		if _, ok := lookupMatcher(req.mode); !ok {
+			return fmt.Errorf("%s passed with mode %q", r.URL.RawQuery, req.mode)
+		}
+	}
+	return nil
+}
+
+// FuzzParseSearchRequest holds any query string and Accept-Language to
+// what checkSearchRequest expects. The corpus seeds each hostile value
+// under a parameter, escaped, as the random test builds them.
+func FuzzParseSearchRequest(f *testing.F) {
+	for i, v := range searchRequestValues() {
+		f.Add(url.QueryEscape(searchRequestParams[i%len(searchRequestParams)])+"="+url.QueryEscape(v), v)
+	}
+	s := newTestServer(f, nil)
+	f.Fuzz(func(t *testing.T, rawQuery, acceptLanguage string) {
+		r := &http.Request{URL: &url.URL{RawQuery: rawQuery}, Header: http.Header{}}
+		r.Header.Set("Accept-Language", acceptLanguage)
+		if err := checkSearchRequest(s, r); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// docsCSP only lets the docs page run its own inline script and style
+// and fetch from this origin
+var docsCSP = fmt.Sprintf("default-src 'none'; script-src '%s'; style-src '%s'; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'",
+	inlineHash(docsPage, "script"), inlineHash(docsPage, "style"))
+
+// inlineHash is the CSP source for the contents of the first <tag> block
+// in page
+func inlineHash(page, tag string) string {
+	open, end := "<"+tag+">", "</"+tag+">"
+	i := strings.Index(page, open)
+	j := strings.Index(page, end)
+	if i < 0 || j < i {
+		return "none"
+	}
+	sum := sha256.Sum256([]byte(page[i+len(open) : j]))
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// securityHeadersMiddleware sets headers every response should carry.
+// API responses are never cached; the docs page and the UI get a
+// restrictive CSP.
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		switch {
+		case r.URL.Path == "/docs":
+			h.Set("Content-Security-Policy", docsCSP)
+		case r.URL.Path == "/ui" || strings.HasPrefix(r.URL.Path, "/ui/"):
+			h.Set("Content-Security-Policy", uiCSP)
+		default:
+			h.Set("Cache-Control", "no-store")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipAllowlist is a set of networks. Bare addresses are single hosts.
+type ipAllowlist []*net.IPNet
+
+// parseCIDRs reads CIDRs or bare IPv4/IPv6 addresses
+func parseCIDRs(entries []string) (ipAllowlist, error) {
+	var out ipAllowlist
+	for _, e := range entries {
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", e)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", e)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (l ipAllowlist) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAllowlist combines a comma separated list with a file of one entry
+// per line, where # starts a comment. Both may be empty.
+func loadAllowlist(list, file string) (ipAllowlist, error) {
+	entries := parseList(list)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	l, err := parseCIDRs(entries)
+	if err != nil {
+		if file != "" {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return nil, err
+	}
+	// A configured but empty allowlist denies everyone rather than
+	// silently allowing them
+	if l == nil && (list != "" || file != "") {
+		l = ipAllowlist{}
+	}
+	return l, nil
+}
+
+// setAdminAllowlist swaps in a new allowlist; nil allows every address
+func (s *Server) setAdminAllowlist(l ipAllowlist) {
+	s.adminAllowLock.Lock()
+	s.adminAllow = l
+	s.adminAllowLock.Unlock()
+}
+
+// parseHostIP parses an address that may carry an IPv6 zone, as a
+// link-local peer's does. The zone names an interface on the host that
+// wrote it, so it is dropped rather than compared.
+func parseHostIP(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only
+// believed when the connection is from one of proxies, and then only up
+// to the first hop that isn't one: anything left of it could be forged.
+func clientIP(r *http.Request, proxies ipAllowlist) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := parseHostIP(host)
+	if ip == nil || !proxies.contains(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := parseHostIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			// A garbled entry ends the trusted chain at the last good hop
+			break
+		}
+		ip = hop
+		if !proxies.contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// isAdminPath reports whether a path, relative to its version prefix, is
+// covered by the admin allowlist
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/")
+}
+
+// requireAllowedIP rejects clients outside the admin allowlist with a
+// 403, before any API key check
+func (s *Server) requireAllowedIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.adminAllowLock.RLock()
+		allow := s.adminAllow
+		s.adminAllowLock.RUnlock()
+		if allow != nil {
+			if ip := clientIP(r, s.cfg.TrustedProxies); ip == nil || !allow.contains(ip) {
+				atomic.AddInt64(&s.adminDenied, 1)
+				writeErr(w, r, newError(ErrForbidden, "Client address not allowed"))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// adminAllowlistStats reports the allowlist for /stats
+func (s *Server) adminAllowlistStats() map[string]interface{} {
+	s.adminAllowLock.RLock()
+	defer s.adminAllowLock.RUnlock()
+	return map[string]interface{}{
+		"enabled": s.adminAllow != nil,
+		"entries": len(s.adminAllow),
+		"denied":  atomic.LoadInt64(&s.adminDenied),
+	}
+}
+
+// reloadAdminAllowlist re-reads the allowlist for s and its tenants,
+// keeping the current one if the new one doesn't parse
+func (s *Server) reloadAdminAllowlist(list, file string) {
+	l, err := loadAllowlist(list, file)
+	if err != nil {
+		log.Println("Admin allowlist reload failed, keeping the current one:", err)
+		return
+	}
+	s.setAdminAllowlist(l)
+	s.tenants.each(func(t *Server) { t.setAdminAllowlist(l) })
+	log.Printf("Admin allowlist reloaded: %d entries\n", len(l))
+}
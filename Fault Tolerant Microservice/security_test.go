@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	for _, tc := range []struct {
+		entry string
+		in    []string
+		out   []string
+	}{
+		{"10.0.0.0/8", []string{"10.255.0.1", "::ffff:10.1.2.3"}, []string{"11.0.0.1", "2001:db8::1"}},
+		{"192.0.2.7", []string{"192.0.2.7"}, []string{"192.0.2.8"}},
+		{"2001:db8::/32", []string{"2001:db8:ffff::1"}, []string{"2001:db9::1", "10.0.0.1"}},
+		{"::1", []string{"::1"}, []string{"::2", "127.0.0.1"}},
+		{"fe80::/10", []string{"fe80::1"}, []string{"fec0::1"}},
+	} {
+		l, err := parseCIDRs([]string{tc.entry})
+		if err != nil {
+			t.Errorf("%s: %v", tc.entry, err)
+			continue
+		}
+		for _, ip := range tc.in {
+			if !l.contains(parseHostIP(ip)) {
+				t.Errorf("%s doesn't contain %s", tc.entry, ip)
+			}
+		}
+		for _, ip := range tc.out {
+			if l.contains(parseHostIP(ip)) {
+				t.Errorf("%s contains %s", tc.entry, ip)
+			}
+		}
+	}
+	// A zone only means something on the host that wrote it
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "2001:db8::/129", "fe80::1%eth0", "10.0.0.1/8/8"} {
+		if _, err := parseCIDRs([]string{bad}); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+// TestClientIP walks X-Forwarded-For from the right through trusted
+// proxies only, so nothing an untrusted hop wrote is believed
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8:1::/48", "fe80::/10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "198.51.100.9:4000", nil, "198.51.100.9"},
+		{"spoofed by an untrusted peer", "198.51.100.9:4000", []string{"10.0.0.5"}, "198.51.100.9"},
+		{"one trusted proxy", "10.0.0.1:4000", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"chain of trusted proxies", "10.0.0.1:4000", []string{"198.51.100.9, 10.1.1.1, 10.2.2.2"}, "198.51.100.9"},
+		{"forgery left of the first untrusted hop", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.9, 10.1.1.1"}, "198.51.100.9"},
+		{"chain split over headers", "10.0.0.1:4000", []string{"198.51.100.9", "10.1.1.1"}, "198.51.100.9"},
+		{"garbled hop", "10.0.0.1:4000", []string{"198.51.100.9, junk, 10.1.1.1"}, "10.1.1.1"},
+		{"trusted all the way", "10.0.0.1:4000", []string{"10.3.3.3"}, "10.3.3.3"},
+		{"trusted proxy sending nothing", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"IPv6 proxy", "[2001:db8:1::5]:443", []string{"2001:db8:ffff::9"}, "2001:db8:ffff::9"},
+		{"IPv6 client of an IPv4 proxy", "10.0.0.1:4000", []string{"2001:db8:ffff::9"}, "2001:db8:ffff::9"},
+		{"IPv4-mapped proxy", "[::ffff:10.0.0.1]:4000", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"link-local proxy with a zone", "[fe80::1%eth0]:443", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"zoned hop", "10.0.0.1:4000", []string{"fe80::7%en0, 10.1.1.1"}, "fe80::7"},
+		{"untrusted peer with a zone", "[fd00::1%eth0]:443", []string{"198.51.100.9"}, "fd00::1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		r.Header["X-Forwarded-For"] = tc.xff
+		if got := clientIP(r, proxies); got.String() != tc.want {
+			t.Errorf("%s: %v, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "pipe"
+	if got := clientIP(r, proxies); got != nil {
+		t.Errorf("RemoteAddr without an address: %v", got)
+	}
+}
+
+// TestRequireAllowedIP lets admin routes through only from the
+// allowlist, judging callers behind trusted proxies by their own address
+func TestRequireAllowedIP(t *testing.T) {
+	allow, err := parseCIDRs([]string{"192.0.2.0/24", "2001:db8:a::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(cfg *Config) { cfg.AdminAllow, cfg.TrustedProxies = allow, proxies })
+	h := s.Routes()
+	for _, tc := range []struct {
+		remote string
+		xff    string
+		want   int
+	}{
+		{"192.0.2.10:1000", "", http.StatusOK},
+		{"[2001:db8:a::1]:1000", "", http.StatusOK},
+		{"198.51.100.9:1000", "", http.StatusForbidden},
+		{"198.51.100.9:1000", "192.0.2.10", http.StatusForbidden},
+		{"10.0.0.1:1000", "192.0.2.10", http.StatusOK},
+		{"10.0.0.1:1000", "192.0.2.10, 198.51.100.9", http.StatusForbidden},
+		{"10.0.0.1:1000", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/errors", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("from %s forwarding %q: %d, want %d", tc.remote, tc.xff, rec.Code, tc.want)
+		}
+	}
+
+	// An empty list, as a reload of an emptied file gives, denies everyone
+	s.setAdminAllowlist(ipAllowlist{})
+	r := httptest.NewRequest(http.MethodGet, "/admin/errors", nil)
+	r.RemoteAddr = "192.0.2.10:1000"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("empty allowlist: %d", rec.Code)
+	}
+}
+
+// TestRateLimitKeyedByClientIP gives clients behind a trusted proxy a
+// bucket each, rather than one shared by everything it forwards
+func TestRateLimitKeyedByClientIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimitRPS, cfg.RateLimitBurst = 0.001, 1
+		cfg.TrustedProxies = proxies
+	}).Routes()
+	get := func(remote, xff string) int {
+		r := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if code := get("10.0.0.1:1000", "198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("first client: %d", code)
+	}
+	if code := get("10.0.0.1:1000", "198.51.100.2"); code != http.StatusOK {
+		t.Errorf("second client through the same proxy shared the first's bucket: %d", code)
+	}
+	if code := get("10.0.0.1:1000", "198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("first client again: %d", code)
+	}
+	// Untrusted peers can't mint fresh buckets by forging the header
+	if code := get("198.51.100.3:1000", "192.0.2.1"); code != http.StatusOK {
+		t.Fatalf("untrusted peer: %d", code)
+	}
+	if code := get("198.51.100.3:1000", "192.0.2.2"); code != http.StatusTooManyRequests {
+		t.Errorf("untrusted peer with a new forged address: %d", code)
+	}
+}
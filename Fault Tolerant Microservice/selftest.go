@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// selfTestProducts is the size of the catalog the self-test generates
+const selfTestProducts = 100
+
+// selfTestResult is the outcome of one check
+type selfTestResult struct {
+	Name       string  `json:"name"`
+	Passed     bool    `json:"passed"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// selfTestReport is what -self-test prints and POST /admin/selftest returns
+type selfTestReport struct {
+	Passed     bool             `json:"passed"`
+	Checks     []selfTestResult `json:"checks"`
+	DurationMS float64          `json:"duration_ms"`
+}
+
+// selfTestCheck is one named check; a nil error is a pass
+type selfTestCheck struct {
+	name string
+	run  func() error
+}
+
+// runSelfTest runs the checks against a scratch server built from cfg:
+// a small generated catalog, a manual clock and nothing that touches
+// disk, the network or the inventory dependency. live, when set, is the
+// running instance, and adds a check that its own catalog can be searched.
+// Nothing here changes live's state.
+func runSelfTest(cfg Config, live *Server) selfTestReport {
+	cfg.NumProducts = selfTestProducts
+	cfg.Clock = newManualClock(time.Unix(0, 0).UTC())
+	cfg.ChaosRate = 0
+	cfg.StateFile, cfg.WatchdogDir, cfg.DiskCheckPath = "", "", ""
+	cfg.WALFile, cfg.CatalogSnapshotFile = "", ""
+	cfg.Inventory = false
+	cfg.ShadowPercent, cfg.MirrorURL = 0, ""
+	cfg.HedgePercentile = 0
+	cfg.ShardCount, cfg.LocalShards = 0, 0
+
+	var scratch *Server
+	checks := []selfTestCheck{
+		{"config", func() (err error) {
+			scratch, err = NewServer(cfg)
+			return err
+		}},
+		{"search", func() error {
+			if scratch == nil {
+				return fmt.Errorf("no server: config check failed")
+			}
+			return selfTestSearch(scratch)
+		}},
+		{"breaker", func() error { return selfTestBreaker(cfg) }},
+		{"json", selfTestJSON},
+	}
+	if live != nil {
+		checks = append(checks, selfTestCheck{"live_catalog", func() error { return selfTestLive(live) }})
+	}
+
+	start := time.Now()
+	report := selfTestReport{Passed: true}
+	for _, c := range checks {
+		began := time.Now()
+		res := selfTestResult{Name: c.name, Passed: true}
+		if err := c.run(); err != nil {
+			res.Passed, res.Error = false, err.Error()
+			report.Passed = false
+		}
+		res.DurationMS = durationMS(time.Since(began))
+		report.Checks = append(report.Checks, res)
+	}
+	report.DurationMS = durationMS(time.Since(start))
+	return report
+}
+
+// selfTestSearch fills the scratch catalog and searches it through the
+// handler for a product by name, expecting that product back
+func selfTestSearch(s *Server) error {
+	s.store.generate(s.cfg.NumProducts)
+	atomic.StoreInt32(&s.catalogLoaded, 1)
+	want, ok := s.store.get(ProductID(s.cfg.NumProducts / 2))
+	if !ok {
+		return fmt.Errorf("product %d missing after generating the catalog", s.cfg.NumProducts/2)
+	}
+	q := "/products/search?mode=exhaustive&limit=" + strconv.Itoa(s.cfg.MaxResults) + "&q=" + url.QueryEscape(want.Name)
+	rec := httptest.NewRecorder()
+	s.searchHandler(rec, httptest.NewRequest(http.MethodGet, q, nil))
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("search returned %d: %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+	var res struct {
+		Products []Product `json:"products"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		return fmt.Errorf("decoding search response: %v", err)
+	}
+	for _, p := range res.Products {
+		if p.ID == want.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("searching for %q did not return product %d (%d results)", want.Name, want.ID, len(res.Products))
+}
+
+// selfTestBreaker drives a breaker configured like the service's through
+// open, half-open and closed on a manual clock
+func selfTestBreaker(cfg Config) error {
+	clock := newManualClock(time.Unix(0, 0).UTC())
+	b, err := resilience.NewBreaker(resilience.BreakerConfig{
+		Policy:      cfg.BreakerPolicy,
+		Threshold:   cfg.FailThreshold,
+		Window:      cfg.BreakerWindow,
+		FailureRate: cfg.BreakerFailureRate,
+		MinRequests: cfg.BreakerMinRequests,
+		Cooldown:    cfg.Cooldown,
+	}, clock, nil)
+	if err != nil {
+		return err
+	}
+	// Enough failures to trip either policy
+	for i := 0; i < cfg.FailThreshold+cfg.BreakerMinRequests+1 && b.State() != resilience.StateOpen; i++ {
+		if ok, _ := b.Allow(); !ok {
+			return fmt.Errorf("breaker refused call %d while %s", i, resilience.StateName(b.State()))
+		}
+		b.RecordFailure()
+	}
+	if b.State() != resilience.StateOpen {
+		return fmt.Errorf("breaker still %s after repeated failures", resilience.StateName(b.State()))
+	}
+	if ok, _ := b.Allow(); ok {
+		return fmt.Errorf("open breaker allowed a call")
+	}
+	clock.Advance(cfg.Cooldown + time.Millisecond)
+	if ok, _ := b.Allow(); !ok {
+		return fmt.Errorf("breaker refused the trial call after the cooldown")
+	}
+	b.RecordSuccess()
+	if b.State() != resilience.StateClosed {
+		return fmt.Errorf("breaker %s after a successful trial, want closed", resilience.StateName(b.State()))
+	}
+	return nil
+}
+
+// selfTestJSON round trips a product with every optional field set
+func selfTestJSON() error {
+	stock := 7
+	want := Product{
+		ID: 1, Name: "Self Test ü ☃ \"quoted\"", Category: "Books", Description: "<b>&</b>", Brand: "Alpha",
+		Names: map[string]string{"fr": "Essai", "ja": "テスト"},
+		Stock: &stock,
+	}
+	buf, err := encodeJSON(want)
+	if err != nil {
+		return err
+	}
+	defer putBuffer(buf)
+	var got Product
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("round trip changed the product: got %+v", got)
+	}
+	return nil
+}
+
+// selfTestLive matches the live catalog's first product against its own
+// name, without going through the handler, so live stats, the breaker and
+// the bulkhead are left alone
+func selfTestLive(s *Server) error {
+	ids, total := s.store.listIDs(0, 1)
+	if total == 0 {
+		return fmt.Errorf("the catalog is empty")
+	}
+	p, ok := s.store.get(ids[0])
+	if !ok {
+		return fmt.Errorf("product %d listed but missing", ids[0])
+	}
+	text := newSearchText(parseQuery(p.Name), defaultLocale, false)
+	sr := s.scan(context.Background(), ids, text, "", "", searchPage{limit: 1}, 0)
+	defer sr.release()
+	if sr.matches != 1 {
+		return fmt.Errorf("product %d did not match its own name %q", p.ID, p.Name)
+	}
+	return nil
+}
+
+// selfTestHandler runs the self-test against this instance. The status
+// says whether every check passed; the body has the details either way.
+func (s *Server) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	report := runSelfTest(s.cfg, s)
+	status := http.StatusOK
+	if !report.Passed {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, report)
+}
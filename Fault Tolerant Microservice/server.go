@@ -0,0 +1,895 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// Config holds the tunables of a Server. DefaultConfig matches the
+// service's historical behaviour.
+type Config struct {
+	NumProducts     int
+	ChecksPerSearch int
+	MaxResults      int
+	BulkheadSize    int
+	// SampleStrategy is how sampled searches draw their products, one of
+	// sampleStrategies; debug searches may pick another as sample_strategy
+	SampleStrategy string
+	// SearchMode is the mode of searches that don't give one, one of
+	// searchModes
+	SearchMode string
+	// BulkheadQueue, when positive, lets that many searches wait up to
+	// BulkheadQueueTimeout for a bulkhead slot instead of being rejected,
+	// granted in BulkheadQueueOrder, fifo or lifo
+	BulkheadQueue        int
+	BulkheadQueueTimeout time.Duration
+	BulkheadQueueOrder   string
+	MaxConcurrent        int32
+	// BreakerPolicy is "windowed" or "consecutive". FailThreshold is the
+	// consecutive policy's failure count; the window fields belong to the
+	// windowed policy.
+	BreakerPolicy      string
+	FailThreshold      int
+	BreakerWindow      time.Duration
+	BreakerFailureRate float64
+	BreakerMinRequests int
+	// BreakerSlowCall, when positive, also opens the breaker once the
+	// BreakerSlowPercentile search latency over BreakerSlowWindow has been
+	// above it for BreakerSlowSustain, given BreakerSlowMinCalls searches
+	BreakerSlowCall       time.Duration
+	BreakerSlowPercentile float64
+	BreakerSlowWindow     time.Duration
+	BreakerSlowSustain    time.Duration
+	BreakerSlowMinCalls   int
+	Cooldown              time.Duration
+	ChaosRate             float64
+	RateLimitRPS          float64
+	RateLimitBurst        int
+	// RateLimitStore is where the buckets are kept: memory, per instance,
+	// or redis, at RateLimitRedisAddr under RateLimitRedisPrefix, shared
+	// by every instance. Redis calls give up after RateLimitRedisTimeout,
+	// limiting locally instead.
+	RateLimitStore         string
+	RateLimitRedisAddr     string
+	RateLimitRedisPassword string
+	RateLimitRedisPrefix   string
+	RateLimitRedisTimeout  time.Duration
+	// ClientConcurrency caps the requests one client address may have in
+	// flight on rate limited routes; 0 disables the cap
+	ClientConcurrency int
+	// Coalesce lets identical concurrent searches share one execution
+	Coalesce bool
+	// ChangeJournal is how many catalog changes are kept for
+	// /products/changes and resuming event streams
+	ChangeJournal int
+	// Seed is the base of the per-request seeds used for sampling and
+	// chaos; 0 picks one from the current time
+	Seed  int64
+	Clock Clock
+	// Statsd receives the metrics; nil drops them. Tenants and local
+	// shards share it through their copies of the Config, as they do
+	// Webhooks and Consul.
+	Statsd *statsdClient
+	// Webhooks delivers events to the configured targets; nil drops them
+	Webhooks *webhookSender
+	// Consul is the service registration /health reports, nil when off
+	Consul *consulRegistration
+	// CORSOrigins are the origins browsers may call from (exact,
+	// https://*.example.com, or *); empty sends no CORS headers.
+	// CORSAllowMethods and CORSMaxAge answer preflights.
+	CORSOrigins      []string
+	CORSAllowMethods []string
+	CORSMaxAge       int
+	// APIKeys authenticate callers; with none every route is open
+	APIKeys []*apiKey
+	// RequireAuthForReads makes read routes need a read key too
+	RequireAuthForReads bool
+	// TrustedProxies may set X-Forwarded-For on behalf of a client
+	TrustedProxies ipAllowlist
+	// AdminAllow, when set, limits admin routes to these networks. It is
+	// where the Server starts; setAdminAllowlist swaps it at run time.
+	AdminAllow ipAllowlist
+	// RejectionStatus maps a rejection reason to the status it is sent
+	// with; nil is defaultRejectionStatus
+	RejectionStatus rejectionStatuses
+	// AccessLog logs one line per request
+	AccessLog bool
+	// BrownoutThresholds are ascending utilization levels (in-flight
+	// searches over MaxConcurrent) at which searches do progressively less
+	// work; empty disables brownout
+	BrownoutThresholds []float64
+	// SpillQueue, when positive, answers up to that many searches that
+	// would be shed, and sent Prefer: respond-async, with 202 and runs
+	// them once there is room, if within SpillMaxAge. Results are kept
+	// SpillResultTTL for the poll URL, and POSTed to an X-Callback-URL
+	// whose host is in SpillCallbackHosts, signed with
+	// SpillCallbackSecret. Queued searches count as in flight for
+	// brownout and the overload check.
+	SpillQueue          int
+	SpillMaxAge         time.Duration
+	SpillResultTTL      time.Duration
+	SpillCallbackHosts  []string
+	SpillCallbackSecret string
+	// BackpressureThreshold is the utilization past which every response
+	// carries X-Backpressure, a suggested delay of at most
+	// BackpressureMaxDelay before the next request; 0 disables it
+	BackpressureThreshold float64
+	BackpressureMaxDelay  time.Duration
+	// SearchWorkBudget caps one search's estimated work, in product
+	// checks: one over it checks what fits and is marked degraded.
+	// SearchCostBudget caps the work of all searches in flight, turning
+	// away those with no room. 0 leaves either unlimited.
+	SearchWorkBudget int64
+	SearchCostBudget int64
+	// MaxProductBytes and MaxImportBytes cap request bodies for single
+	// product writes and for imports
+	MaxProductBytes int64
+	MaxImportBytes  int64
+	// IdempotencyTTL is how long responses to keyed mutations are kept,
+	// within IdempotencyMaxBytes
+	IdempotencyTTL      time.Duration
+	IdempotencyMaxBytes int64
+	// SearchSnapshots is how many pinned search result sets are kept for
+	// paging, each for SearchSnapshotTTL; 0 disables snapshot=true
+	SearchSnapshots   int
+	SearchSnapshotTTL time.Duration
+	// Inventory enables stock enrichment of search results from the
+	// simulated inventory dependency. Each call takes InventoryLatency plus
+	// up to InventoryJitter and fails InventoryErrorRate of the time; the
+	// client gives up on an attempt after InventoryTimeout and retries up
+	// to InventoryRetries times, backing off from InventoryBackoff. Each
+	// category has its own breaker, opening after InventoryFailThreshold
+	// failures in a row, and InventoryFailing categories' calls all fail.
+	Inventory              bool
+	InventoryFailing       []string
+	InventoryErrorRate     float64
+	InventoryLatency       time.Duration
+	InventoryJitter        time.Duration
+	InventoryTimeout       time.Duration
+	InventoryRetries       int
+	InventoryBackoff       time.Duration
+	InventoryFailThreshold int
+	// HedgePercentile, when positive, starts a second sampled scan once
+	// the first has run longer than this percentile of recent scans. At
+	// most HedgeBudget hedges run at once.
+	HedgePercentile float64
+	HedgeBudget     int
+	// ChecksTuneTarget, when positive, lets the sample size follow
+	// sampled searches' p95 latency toward it, between ChecksTuneMin and
+	// ChecksTuneMax, starting from ChecksPerSearch
+	ChecksTuneTarget time.Duration
+	ChecksTuneMin    int
+	ChecksTuneMax    int
+	// ShadowPercent, when positive, re-runs that percent of searches in
+	// ShadowMode in the background and counts disagreements, with at most
+	// ShadowPool running at once
+	ShadowPercent float64
+	ShadowMode    string
+	ShadowPool    int
+	// MirrorURL, when set, copies MirrorPercent of GET requests to that
+	// instance once answered, with MirrorWorkers sending them and giving
+	// each MirrorTimeout, and compares its answers on /stats/mirror.
+	// Copies carry the client's credentials only with MirrorCredentials.
+	MirrorURL         string
+	MirrorPercent     float64
+	MirrorWorkers     int
+	MirrorTimeout     time.Duration
+	MirrorCredentials bool
+	// TenantsFile lists tenants, each with a catalog, caches and limits of
+	// its own, selected by X-Tenant-Id or a /t/{tenant} prefix. With
+	// TenantAutoProvision an unlisted tenant is created on first use, with
+	// TenantProducts products, up to TenantMax tenants in all.
+	TenantsFile         string
+	TenantAutoProvision bool
+	TenantProducts      int
+	TenantMax           int
+	// TrackedQueries caps the distinct queries counted for /stats/zero-results
+	// and, at four times CacheWarmup if that is more, for the warmup;
+	// TrackedQueryBytes cuts each query tracked
+	TrackedQueries    int
+	TrackedQueryBytes int
+	// ShardCount, above 1, makes this instance shard ShardIndex of that
+	// many, holding only the products whose IDs hash to it. A request for
+	// another shard's product is refused with 421 under ShardForeign
+	// reject, or proxied to that shard's entry in ShardPeers under proxy.
+	ShardIndex   int
+	ShardCount   int
+	ShardForeign string
+	ShardPeers   []string
+	// LocalShards, above 1, also splits the catalog across that many
+	// in-process shards searched together by /shards/search
+	LocalShards int
+	// StateFile, when set, is where breaker and rate limit state is saved
+	// on shutdown and restored from on start, if under StateMaxAge old
+	StateFile   string
+	StateMaxAge time.Duration
+	// IndexFile, when set, keeps the vocabulary and trigram index built
+	// from the catalog, loaded instead of rebuilt on a start with the
+	// same catalog
+	IndexFile string
+	// WALFile, when set, logs every product mutation before it is
+	// acknowledged, replayed on start on top of the catalog snapshot or
+	// the generated catalog. WALSyncInterval, when set, fsyncs the log
+	// that often for every write made since, instead of once per write.
+	WALFile         string
+	WALSyncInterval time.Duration
+	// CatalogSnapshotFile, when set, is where the catalog is saved every
+	// CatalogSnapshotInterval and on shutdown, and loaded from on start,
+	// truncating the write-ahead log it holds the changes of
+	CatalogSnapshotFile     string
+	CatalogSnapshotInterval time.Duration
+	// ValidationRulesFile, when set, holds per field product rules
+	// applied on top of the built-in limits, re-read on SIGHUP
+	ValidationRulesFile string
+	// SigningKeysFile, when set, lists the keys every response body is
+	// signed with, re-read on SIGHUP
+	SigningKeysFile string
+	// WatchdogDir, when set, enables the watchdog: every WatchdogInterval
+	// it checks heap in use, goroutines and scheduler lag against the
+	// thresholds that are non-zero, and on a breach writes heap and CPU
+	// (over WatchdogCPU) profiles here, at most once per WatchdogMinGap,
+	// keeping the newest WatchdogKeep captures
+	WatchdogDir        string
+	WatchdogInterval   time.Duration
+	WatchdogHeapBytes  uint64
+	WatchdogGoroutines int
+	WatchdogLag        time.Duration
+	WatchdogCPU        time.Duration
+	WatchdogMinGap     time.Duration
+	WatchdogKeep       int
+	// DiskCheckPath is the filesystem whose free space decides whether
+	// persistence is degraded; empty means the state file's directory, or
+	// failing that WatchdogDir. It is degraded under DiskMinFreeBytes or
+	// DiskMinFreePercent free, checked at most every DiskCheckCache.
+	DiskCheckPath      string
+	DiskMinFreeBytes   uint64
+	DiskMinFreePercent float64
+	DiskCheckCache     time.Duration
+	// ExportSnapshots is how many pinned catalog exports are kept for
+	// ranged resumes, each for ExportSnapshotTTL; 0 disables them
+	ExportSnapshots   int
+	ExportSnapshotTTL time.Duration
+	// OperationTTL is how long a finished admin operation stays pollable
+	OperationTTL time.Duration
+	// ResponseEnvelope wraps v1 search, list and related responses in
+	// data, meta and links with Link headers; off, v1 keeps the flat shapes
+	ResponseEnvelope bool
+	// Features are the X-Features flags callers may turn on for their own
+	// requests, none by default; others they send are ignored
+	Features []string
+	// StreamWriteTimeout is how long one write of a CSV, NDJSON or export
+	// stream may stall before the consumer is taken to be gone and the
+	// stream aborted; MaxStreamDuration caps a whole stream. 0 disables
+	// either.
+	StreamWriteTimeout time.Duration
+	MaxStreamDuration  time.Duration
+	// ResponseCache is how many search responses are cached, spread over
+	// ResponseCacheShards independently locked shards; 0 turns it off
+	ResponseCache       int
+	ResponseCacheShards int
+	// CacheWarmup is how many of the most requested cached searches are
+	// saved with the state file on shutdown and replayed into the cache
+	// on start, before the instance reports ready; 0 turns it off. At
+	// most CacheWarmupConcurrency run at once, and readiness waits for
+	// them no longer than CacheWarmupMaxDelay.
+	CacheWarmup            int
+	CacheWarmupConcurrency int
+	CacheWarmupMaxDelay    time.Duration
+	// DebugTraceMax is how many candidates a debug search traces; 0
+	// turns tracing off
+	DebugTraceMax int
+	// MemorySoftLimit, when set, enables the memory governor: every
+	// MemoryCheckInterval it compares heap in use with this many bytes and
+	// sheds caches, the trigram index and the change journal while over
+	MemorySoftLimit     uint64
+	MemoryCheckInterval time.Duration
+	// TrigramBudget enables the trigram index for mode=indexed searches,
+	// capped at this many bytes; 0 leaves it off
+	TrigramBudget int64
+	// EnableLoadTest allows POST /admin/loadtest
+	EnableLoadTest bool
+	// SLOTarget is the availability GET /slo measures the product API
+	// against; requests shed by design count as failures only with
+	// SLOCountShed. The fast burn alert fires when the error budget burns
+	// SLOFastBurn times too fast over both the 5 minute and hour windows.
+	SLOTarget    float64
+	SLOCountShed bool
+	SLOFastBurn  float64
+	// ChaosGuardBurn, when positive, caps chaos at ChaosGuardCap once the
+	// error budget has burned this fast over the SLO's 5 minute window
+	// for ChaosGuardSustain, until an admin acknowledges
+	ChaosGuardBurn    float64
+	ChaosGuardSustain time.Duration
+	ChaosGuardCap     float64
+	// ChaosPartial answers a chaos failure, which fires once matching is
+	// done, with the results found and a warning instead of a 500.
+	// ChaosPartialTruncate of those answers lose some of the results too,
+	// and with ChaosPartialBreaker they count as breaker failures.
+	ChaosPartial         bool
+	ChaosPartialTruncate float64
+	ChaosPartialBreaker  bool
+	// Deterministic disables chaos, fixes the seed unless it is set
+	// explicitly and reports every duration as zero, so a given request
+	// sequence always produces the same responses
+	Deterministic bool
+	// DemoMode applies the public demo preset, applyDemoPreset, and takes
+	// away every write and admin route
+	DemoMode bool
+}
+
+// deterministicSeed is the sampling seed used in deterministic mode
+const deterministicSeed = 1
+
+func DefaultConfig() Config {
+	return Config{
+		NumProducts:             100000,
+		ChecksPerSearch:         100,
+		MaxResults:              20,
+		SampleStrategy:          sampleUniform,
+		CORSAllowMethods:        []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		CORSMaxAge:              600,
+		SearchMode:              modeSample,
+		BulkheadSize:            50,
+		BulkheadQueueTimeout:    100 * time.Millisecond,
+		BulkheadQueueOrder:      resilience.QueueFIFO,
+		MaxConcurrent:           50,
+		BreakerPolicy:           resilience.PolicyWindowed,
+		FailThreshold:           100,
+		BreakerWindow:           10 * time.Second,
+		BreakerFailureRate:      0.5,
+		BreakerMinRequests:      20,
+		BreakerSlowPercentile:   0.99,
+		BreakerSlowWindow:       10 * time.Second,
+		BreakerSlowSustain:      5 * time.Second,
+		BreakerSlowMinCalls:     20,
+		MaxProductBytes:         64 << 10,
+		MaxImportBytes:          32 << 20,
+		IdempotencyTTL:          24 * time.Hour,
+		SearchSnapshots:         100,
+		SearchSnapshotTTL:       5 * time.Minute,
+		IdempotencyMaxBytes:     16 << 20,
+		Cooldown:                5 * time.Second,
+		InventoryErrorRate:      0.1,
+		InventoryLatency:        5 * time.Millisecond,
+		InventoryJitter:         10 * time.Millisecond,
+		InventoryTimeout:        25 * time.Millisecond,
+		InventoryRetries:        2,
+		InventoryBackoff:        5 * time.Millisecond,
+		InventoryFailThreshold:  5,
+		HedgeBudget:             5,
+		ChecksTuneMin:           10,
+		ChecksTuneMax:           1000,
+		ShadowMode:              modeIndexed,
+		ShadowPool:              2,
+		MirrorPercent:           10,
+		MirrorWorkers:           4,
+		MirrorTimeout:           2 * time.Second,
+		TenantProducts:          1000,
+		TenantMax:               16,
+		TrackedQueries:          100,
+		TrackedQueryBytes:       200,
+		ChaosRate:               0.2,
+		RateLimitBurst:          100,
+		RateLimitStore:          rateLimitStoreMemory,
+		RateLimitRedisPrefix:    "productsearch:ratelimit:",
+		RateLimitRedisTimeout:   50 * time.Millisecond,
+		ClientConcurrency:       5,
+		Coalesce:                true,
+		ChangeJournal:           1000,
+		StateMaxAge:             5 * time.Minute,
+		CatalogSnapshotInterval: 5 * time.Minute,
+		SpillMaxAge:             30 * time.Second,
+		SpillResultTTL:          5 * time.Minute,
+		BackpressureThreshold:   0.8,
+		BackpressureMaxDelay:    2 * time.Second,
+		WatchdogInterval:        5 * time.Second,
+		WatchdogLag:             time.Second,
+		WatchdogCPU:             10 * time.Second,
+		WatchdogMinGap:          10 * time.Minute,
+		WatchdogKeep:            5,
+		DiskMinFreeBytes:        100 << 20,
+		DiskMinFreePercent:      5,
+		DiskCheckCache:          5 * time.Second,
+		MemoryCheckInterval:     5 * time.Second,
+		DebugTraceMax:           100,
+		ResponseCacheShards:     16,
+		CacheWarmup:             100,
+		CacheWarmupConcurrency:  4,
+		CacheWarmupMaxDelay:     10 * time.Second,
+		SLOTarget:               0.995,
+		SLOFastBurn:             14.4,
+		ChaosGuardSustain:       10 * time.Minute,
+		ChaosPartialBreaker:     true,
+		ShardForeign:            shardReject,
+		ExportSnapshots:         4,
+		ExportSnapshotTTL:       10 * time.Minute,
+		OperationTTL:            time.Hour,
+		ResponseEnvelope:        true,
+		StreamWriteTimeout:      10 * time.Second,
+		MaxStreamDuration:       5 * time.Minute,
+	}
+}
+
+// searchStats are the search outcome counters reported by /stats. They
+// count from startup and are never reset; Server.windows counts the same
+// outcomes over recent seconds.
+type searchStats struct {
+	requests         int64
+	successes        int64
+	failures         int64
+	rejectedCircuit  int64
+	rejectedBulkhead int64
+	rejectedOverload int64
+	checkTotal       int64
+	// partial counts chaos failures answered with partial results, all of
+	// them successes too
+	partial int64
+	// clientCancelled counts searches abandoned because the client went
+	// away; they are neither successes nor failures
+	clientCancelled int64
+	// oversized counts write requests refused for their body size
+	oversized int64
+}
+
+// Server is one instance of the product search service. Each Server has
+// its own catalog, breaker, bulkhead and limiter, so several can run side
+// by side in one process.
+type Server struct {
+	cfg      Config
+	clock    Clock
+	seeds    *seedSource
+	store    *productStore
+	breaker  *resilience.Breaker
+	bulkhead *resilience.Bulkhead
+	limiter  *rateLimiter
+	// concurrency caps requests in flight per client address
+	concurrency *clientConcurrency
+	chaos       *resilience.ChaosInjector
+	brownout    *brownout
+	idem        *idempotencyStore
+	// backpressure suggests clients slow down; main starts it
+	backpressure *backpressure
+	// costs admits searches by the work they hold between them
+	costs *costGate
+	// validation is the deployment's product rules, empty by default
+	validation *validationState
+	// signer is nil unless Config.SigningKeysFile is set
+	signer *responseSigner
+	// transitions fans the breaker's state changes out to /circuit/wait
+	// and the webhooks
+	transitions *transitionHub
+	// zeroResults tracks the queries that found nothing
+	zeroResults *queryTracker
+	// inventory is nil unless Config.Inventory is set
+	inventory *inventoryClient
+	// hedger is nil unless hedging is on
+	hedger *hedger
+	// matchCounts totals each search mode's matches
+	matchCounts map[string]*matcherCounters
+	// checksTuner is nil unless Config.ChecksTuneTarget is set
+	checksTuner *checksTuner
+	// chaosGuard is nil unless Config.ChaosGuardBurn is set
+	chaosGuard *chaosGuard
+	// shadow is nil unless shadow searches are on
+	shadow *shadowRunner
+	// mirror is nil unless Config.MirrorURL is set
+	mirror *requestMirror
+	// coalescer shares responses between identical concurrent searches
+	coalescer *coalescer
+	// responses is nil unless Config.ResponseCache is set
+	responses *responseCache
+	// popular counts the searches the cache serves, nil unless both the
+	// cache and its warmup are on; warmup is nil unless the state file
+	// had some to replay
+	popular *queryTracker
+	warmup  *cacheWarmup
+	// spill is nil unless Config.SpillQueue is set
+	spill *spillQueue
+	// tenants is nil unless tenants are listed or auto provisioned;
+	// tenant is the ID of a tenant's own server, empty for the instance's
+	tenants *tenantRouter
+	tenant  string
+	// snapshots pin search results for consistent paging, exports the
+	// whole catalog for resumable exports
+	snapshots *snapshotStore
+	exports   *snapshotStore
+	// ops runs the long admin operations
+	ops *operationRegistry
+	// features resolves the X-Features flags a request turns on
+	features *featureGate
+	// shards is nil unless Config.ShardCount is above 1
+	shards *shardPlan
+	// localShards are the in-process shards, with Config.LocalShards
+	localShards []*Server
+	// metrics counts requests per route template for /metrics and /stats,
+	// streams the CSV, NDJSON and export streams
+	metrics *routeMetrics
+	streams streamStats
+	statsd  *statsdClient
+	// slo tracks the product API's availability for /slo
+	slo *sloTracker
+	// watchdog is nil unless Config.WatchdogDir is set; main starts it
+	watchdog *watchdog
+	// memory is nil unless Config.MemorySoftLimit is set; main starts it
+	memory *memoryGovernor
+	// indexFile is nil unless Config.IndexFile is set
+	indexFile *indexFile
+	// wal is nil unless Config.WALFile is set; LoadCatalog replays it and
+	// attaches it to the store
+	wal *writeAheadLog
+	// catalogSnaps is nil unless Config.CatalogSnapshotFile is set
+	catalogSnaps *catalogSnapshots
+	// disk is nil when nothing is written to disk
+	disk  *diskHealth
+	stats searchStats
+	// windows are the windowed outcome counters, which /stats/reset
+	// empties
+	windows *statsWindows
+	routes  []route
+	// mux serves the routes without the outer middleware
+	mux      http.Handler
+	loadTest loadTester
+
+	// adminAllow starts as Config.AdminAllow; reloadAdminAllowlist swaps it
+	adminAllow     ipAllowlist
+	adminAllowLock sync.RWMutex
+	adminDenied    int64
+	// unknownKeyDenials counts requests presenting a key that matched nothing
+	unknownKeyDenials int64
+
+	inFlight     int32
+	watchers     int32
+	eventStreams int32
+	// circuitWaiters counts parked GET /circuit/wait calls
+	circuitWaiters int32
+
+	catalogLoaded int32
+	warming       int32
+	ready         bool
+	readyLock     sync.Mutex
+}
+
+// NewServer builds a Server with an empty catalog; call LoadCatalog to
+// fill it
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.DemoMode {
+		cfg.applyDemoPreset()
+	}
+	if cfg.Deterministic {
+		cfg.ChaosRate = 0
+		cfg.InventoryErrorRate = 0
+		cfg.InventoryLatency, cfg.InventoryJitter = 0, 0
+		cfg.StateFile = ""
+		cfg.WALFile, cfg.CatalogSnapshotFile = "", ""
+		cfg.CacheWarmup = 0
+		if cfg.Seed == 0 {
+			cfg.Seed = deterministicSeed
+		}
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = resilience.SystemClock{}
+	}
+	if cfg.RejectionStatus == nil {
+		cfg.RejectionStatus = defaultRejectionStatus
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	s := &Server{
+		cfg:     cfg,
+		clock:   cfg.Clock,
+		statsd:  cfg.Statsd,
+		seeds:   newSeedSource(cfg.Seed),
+		limiter: newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.Clock),
+
+		adminAllow: cfg.AdminAllow,
+
+		transitions: newTransitionHub(),
+	}
+	bh, err := resilience.NewBulkhead(cfg.BulkheadSize, cfg.BulkheadQueue, cfg.BulkheadQueueOrder, cfg.BulkheadQueueTimeout, s.clock)
+	if err != nil {
+		return nil, err
+	}
+	s.bulkhead = bh
+	s.limiter.statsd, s.limiter.status = s.statsd, cfg.RejectionStatus
+	s.limiter.proxies = cfg.TrustedProxies
+	s.concurrency = newClientConcurrency(cfg.ClientConcurrency)
+	s.concurrency.statsd, s.concurrency.status = s.statsd, cfg.RejectionStatus
+	s.concurrency.proxies = cfg.TrustedProxies
+	s.coalescer = newCoalescer(cfg.Coalesce)
+	s.metrics = newRouteMetrics()
+	if !validSampleStrategy(cfg.SampleStrategy) {
+		return nil, fmt.Errorf("sample strategy must be one of %v", sampleStrategies)
+	}
+	if _, ok := lookupMatcher(cfg.SearchMode); !ok {
+		return nil, fmt.Errorf("search mode must be one of %v", searchModes)
+	}
+	s.matchCounts = newMatcherCounters()
+	if cfg.SLOTarget <= 0 || cfg.SLOTarget >= 1 || cfg.SLOFastBurn <= 0 {
+		return nil, fmt.Errorf("SLO target must be between 0 and 1 exclusive and the fast burn threshold positive")
+	}
+	s.windows = newStatsWindows(s.clock)
+	s.slo = newSLOTracker(s.clock, cfg.SLOTarget, cfg.SLOFastBurn, cfg.SLOCountShed)
+	s.slo.statsd, s.slo.hooks = s.statsd, cfg.Webhooks
+	s.store = newProductStore(cfg.ChangeJournal)
+	switch {
+	case cfg.ShardCount < 0 || cfg.LocalShards < 0:
+		return nil, fmt.Errorf("shard counts can't be negative")
+	case cfg.ShardCount > 1 && cfg.LocalShards > 1:
+		return nil, fmt.Errorf("an instance that is one shard of several can't host local shards too")
+	case cfg.ShardCount > 1:
+		if s.shards, err = newShardPlan(cfg); err != nil {
+			return nil, err
+		}
+		s.shards.statsd = s.statsd
+		s.store.owns = s.shards.owns
+	case cfg.LocalShards > 1:
+		if s.localShards, err = newLocalShards(cfg, cfg.LocalShards); err != nil {
+			return nil, err
+		}
+	}
+	if s.validation, err = loadValidationRules(cfg.ValidationRulesFile); err != nil {
+		return nil, fmt.Errorf("validation rules: %w", err)
+	}
+	if cfg.SigningKeysFile != "" {
+		if s.signer, err = loadSigningKeys(cfg.SigningKeysFile); err != nil {
+			return nil, fmt.Errorf("signing keys: %w", err)
+		}
+	}
+	s.chaos = resilience.NewChaosInjector(cfg.ChaosRate, s.clock)
+	if cfg.Deterministic || cfg.DemoMode {
+		s.chaos.Disable()
+	}
+	if cfg.ChaosPartialTruncate < 0 || cfg.ChaosPartialTruncate > 1 {
+		return nil, fmt.Errorf("chaos partial truncate must be between 0 and 1")
+	}
+	if cfg.ChaosGuardBurn > 0 && !s.chaos.Disabled() {
+		if cfg.ChaosGuardSustain <= 0 || cfg.ChaosGuardCap < 0 || cfg.ChaosGuardCap > 1 {
+			return nil, fmt.Errorf("chaos guard: sustain must be positive and the cap between 0 and 1")
+		}
+		s.chaosGuard = newChaosGuard(s.clock, s.chaos, s.slo, cfg.ChaosGuardBurn, cfg.ChaosGuardSustain, cfg.ChaosGuardCap, s.onChaosGuardChange)
+	}
+	bo, err := newBrownout(cfg.BrownoutThresholds)
+	if err != nil {
+		return nil, err
+	}
+	s.brownout = bo
+	if cfg.BackpressureThreshold < 0 || cfg.BackpressureThreshold >= 1 || cfg.BackpressureMaxDelay < 0 {
+		return nil, fmt.Errorf("backpressure: threshold must be in [0, 1) and max delay not negative")
+	}
+	s.backpressure = newBackpressure(cfg.BackpressureThreshold, cfg.BackpressureMaxDelay)
+	if cfg.SearchWorkBudget < 0 || cfg.SearchCostBudget < 0 {
+		return nil, fmt.Errorf("search budgets can't be negative")
+	}
+	s.costs = newCostGate(cfg.SearchCostBudget)
+	switch cfg.RateLimitStore {
+	case rateLimitStoreMemory:
+	case rateLimitStoreRedis:
+		if cfg.RateLimitRedisAddr == "" || cfg.RateLimitRedisTimeout <= 0 {
+			return nil, fmt.Errorf("rate limit store: redis needs an address and a positive timeout")
+		}
+		rcfg := resilience.BreakerConfig{Policy: resilience.PolicyConsecutive, Threshold: redisFailThreshold, Cooldown: cfg.Cooldown}
+		rb, err := resilience.NewBreaker(rcfg, s.clock, s.onRateLimitStoreTransition)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit store %w", err)
+		}
+		s.limiter.redis = newRedisBuckets(cfg.RateLimitRedisAddr, cfg.RateLimitRedisPassword, cfg.RateLimitRedisPrefix, cfg.RateLimitRedisTimeout)
+		s.limiter.Share(s.limiter.redis, rb)
+		s.limiter.storeBreaker = rb
+	default:
+		return nil, fmt.Errorf("rate limit store must be %s or %s", rateLimitStoreMemory, rateLimitStoreRedis)
+	}
+	if cfg.SpillQueue > 0 {
+		switch {
+		case cfg.SpillMaxAge <= 0 || cfg.SpillResultTTL <= 0:
+			return nil, fmt.Errorf("spill queue: max age and result TTL must be positive")
+		case len(cfg.SpillCallbackHosts) > 0 && len(cfg.SpillCallbackSecret) < 16:
+			return nil, fmt.Errorf("spill queue: callbacks need a secret of at least 16 bytes to sign them")
+		}
+		s.spill = newSpillQueue(cfg.SpillQueue, cfg.SpillMaxAge, cfg.SpillResultTTL, cfg.SpillCallbackHosts, cfg.SpillCallbackSecret)
+		s.spill.statsd = s.statsd
+	}
+	if cfg.TrackedQueries < 1 || cfg.TrackedQueries > maxTrackedQueries || cfg.TrackedQueryBytes < 1 {
+		return nil, fmt.Errorf("tracked queries must be between 1 and %d, each at least a byte", maxTrackedQueries)
+	}
+	s.zeroResults = newQueryTracker(newKeyGuard(cfg.TrackedQueries, cfg.TrackedQueryBytes))
+	if s.features, err = newFeatureGate(cfg.Features); err != nil {
+		return nil, err
+	}
+	s.idem = newIdempotencyStore(cfg.IdempotencyTTL, cfg.IdempotencyMaxBytes, s.clock)
+	s.snapshots = newSnapshotStore(cfg.SearchSnapshots, snapshotMaxProducts, cfg.SearchSnapshotTTL, s.clock)
+	s.exports = newSnapshotStore(cfg.ExportSnapshots, 0, cfg.ExportSnapshotTTL, s.clock)
+	if cfg.OperationTTL <= 0 {
+		return nil, fmt.Errorf("operation TTL must be positive")
+	}
+	s.ops = newOperationRegistry(cfg.OperationTTL, s.onOperationFinished)
+	s.ops.statsd = s.statsd
+	if cfg.ResponseCache > 0 {
+		if s.responses, err = newResponseCache(cfg.ResponseCache, cfg.ResponseCacheShards, cfg.MaxResults, s.store.events.lastID); err != nil {
+			return nil, err
+		}
+		s.store.changed = s.responses.changed
+		if cfg.CacheWarmup > 0 && cfg.StateFile != "" {
+			s.popular = newQueryTracker(newKeyGuard(max(cfg.TrackedQueries, 4*cfg.CacheWarmup), cfg.TrackedQueryBytes))
+		}
+	}
+	bcfg := resilience.BreakerConfig{
+		Policy:      cfg.BreakerPolicy,
+		Threshold:   cfg.FailThreshold,
+		Window:      cfg.BreakerWindow,
+		FailureRate: cfg.BreakerFailureRate,
+		MinRequests: cfg.BreakerMinRequests,
+		Cooldown:    cfg.Cooldown,
+
+		SlowCall:       cfg.BreakerSlowCall,
+		SlowPercentile: cfg.BreakerSlowPercentile,
+		SlowWindow:     cfg.BreakerSlowWindow,
+		SlowSustain:    cfg.BreakerSlowSustain,
+		SlowMinCalls:   cfg.BreakerSlowMinCalls,
+	}
+	if s.breaker, err = resilience.NewBreaker(bcfg, s.clock, s.onBreakerTransition); err != nil {
+		return nil, err
+	}
+	// Hedging races on timing, which deterministic mode can't allow
+	if cfg.HedgePercentile > 0 && !cfg.Deterministic {
+		if cfg.HedgePercentile >= 1 || cfg.HedgeBudget < 1 {
+			return nil, fmt.Errorf("hedge: percentile must be in (0, 1) and budget at least 1")
+		}
+		s.hedger = newHedger(cfg.HedgePercentile, cfg.HedgeBudget)
+	}
+	// Tuning follows latency too, and would make sampling vary with it
+	if cfg.ChecksTuneTarget > 0 && !cfg.Deterministic {
+		if cfg.ChecksTuneMin < 1 || cfg.ChecksTuneMax < cfg.ChecksTuneMin {
+			return nil, fmt.Errorf("checks tuning: min must be at least 1 and max at least min")
+		}
+		s.checksTuner = newChecksTuner(cfg.ChecksTuneTarget, cfg.ChecksTuneMin, cfg.ChecksTuneMax, cfg.ChecksPerSearch)
+	}
+	if cfg.ShadowPercent > 0 {
+		if s.shadow, err = newShadowRunner(cfg.ShadowMode, cfg.ShadowPercent, cfg.ShadowPool); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MirrorURL != "" {
+		if s.mirror, err = newRequestMirror(cfg.MirrorURL, cfg.MirrorPercent, cfg.MirrorWorkers, cfg.MirrorTimeout, cfg.MirrorCredentials); err != nil {
+			return nil, err
+		}
+	}
+	diskPath := cfg.DiskCheckPath
+	switch {
+	case diskPath != "":
+	case cfg.StateFile != "":
+		diskPath = filepath.Dir(cfg.StateFile)
+	case cfg.IndexFile != "":
+		diskPath = filepath.Dir(cfg.IndexFile)
+	case cfg.WALFile != "":
+		diskPath = filepath.Dir(cfg.WALFile)
+	default:
+		diskPath = cfg.WatchdogDir
+	}
+	if diskPath != "" && diskCheckSupported {
+		if s.disk, err = newDiskHealth(diskPath, cfg.DiskMinFreeBytes, cfg.DiskMinFreePercent, cfg.DiskCheckCache, statfsDisk{}, s.clock); err != nil {
+			return nil, err
+		}
+		s.disk.statsd, s.disk.hooks = s.statsd, cfg.Webhooks
+	}
+	if cfg.WatchdogDir != "" {
+		if s.watchdog, err = newWatchdog(cfg); err != nil {
+			return nil, err
+		}
+		s.watchdog.statsd = s.statsd
+		if s.disk != nil {
+			s.watchdog.diskOK = s.disk.ok
+		}
+	}
+	if cfg.MemorySoftLimit > 0 {
+		if s.memory, err = newMemoryGovernor(cfg.MemorySoftLimit, cfg.MemoryCheckInterval, s.memorySteps()); err != nil {
+			return nil, err
+		}
+		s.memory.statsd = s.statsd
+	}
+	if cfg.Inventory {
+		if err := checkInventoryCategories(cfg.InventoryFailing); err != nil {
+			return nil, err
+		}
+		icfg := resilience.BreakerConfig{Policy: resilience.PolicyConsecutive, Threshold: cfg.InventoryFailThreshold, Cooldown: cfg.Cooldown}
+		service := newInventoryService(cfg.InventoryErrorRate, cfg.InventoryLatency, cfg.InventoryJitter, s.clock, cfg.InventoryFailing)
+		if s.inventory, err = newInventoryClient(service, icfg, s.clock, s.onInventoryTransition); err != nil {
+			return nil, fmt.Errorf("inventory %w", err)
+		}
+		s.inventory.timeout = cfg.InventoryTimeout
+		s.inventory.retries = cfg.InventoryRetries
+		s.inventory.backoff = cfg.InventoryBackoff
+	}
+	if cfg.IndexFile != "" {
+		s.indexFile = &indexFile{path: cfg.IndexFile}
+	}
+	if cfg.WALSyncInterval < 0 {
+		return nil, fmt.Errorf("WAL sync interval must not be negative, got %s", cfg.WALSyncInterval)
+	}
+	if cfg.WALFile != "" {
+		s.wal = newWriteAheadLog(cfg.WALFile, cfg.WALSyncInterval)
+		s.wal.statsd = s.statsd
+	}
+	if cfg.CatalogSnapshotFile != "" {
+		if cfg.WALFile == "" {
+			return nil, fmt.Errorf("a catalog snapshot needs a write-ahead log to hold the changes made since")
+		}
+		if cfg.CatalogSnapshotInterval < 0 {
+			return nil, fmt.Errorf("catalog snapshot interval must not be negative, got %s", cfg.CatalogSnapshotInterval)
+		}
+		s.catalogSnaps = &catalogSnapshots{path: cfg.CatalogSnapshotFile, interval: cfg.CatalogSnapshotInterval}
+	}
+	s.routes = s.apiRoutes()
+	if err := validateRoutes(s.routes); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	registerRoutes(mux, s.routes)
+	s.mux = mux
+	if s.tenants, err = newTenantRouter(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Routes returns the complete handler: every API route behind the outer
+// stack of recovery, request IDs, CORS, security headers, access log,
+// route metrics and traffic recorder
+func (s *Server) Routes() http.Handler {
+	return chain(s.mux.ServeHTTP, s.outerStack()...)
+}
+
+// LoadCatalog generates the configured number of products, or loads the
+// catalog snapshot, replays the write-ahead log and marks the server
+// ready. With an index file the vocabulary and trigram index are
+// loaded from it or rebuilt in the background, and searches scan until
+// they are in place.
+func (s *Server) LoadCatalog() {
+	if s.cfg.TrigramBudget > 0 {
+		s.store.enableTrigrams(s.cfg.TrigramBudget)
+	}
+	if s.indexFile != nil {
+		s.store.deferIndexes()
+	}
+	s.restoreCatalog(s.wal)
+	if s.catalogSnaps != nil && s.catalogSnaps.interval > 0 {
+		s.catalogSnaps.stop = make(chan struct{})
+		go s.runSnapshots()
+	}
+	for i, sh := range s.localShards {
+		start := time.Now()
+		sh.store.generate(sh.cfg.NumProducts)
+		atomic.StoreInt32(&sh.catalogLoaded, 1)
+		log.Printf("Local shard %d: %d products in %s", i, sh.store.size(), time.Since(start).Round(time.Millisecond))
+	}
+	if s.indexFile != nil {
+		s.loadIndexes()
+	}
+	atomic.StoreInt32(&s.catalogLoaded, 1)
+	s.updateReadiness()
+}
+
+// onBreakerTransition announces a breaker state change to the log,
+// statsd and the transition hub, which feeds the webhooks and long
+// polls. Opens carry their reason, so a latency open can be told from a
+// failure one.
+func (s *Server) onBreakerTransition(from, to int32) {
+	snap := s.breaker.Snapshot()
+	tags := []string{"from:" + resilience.StateName(from), "to:" + resilience.StateName(to)}
+	if to == resilience.StateOpen {
+		tags = append(tags, "reason:"+snap.OpenReason)
+		log.Printf("Circuit %s -> %s (%s)", resilience.StateName(from), resilience.StateName(to), snap.OpenReason)
+	} else {
+		log.Printf("Circuit %s -> %s", resilience.StateName(from), resilience.StateName(to))
+	}
+	s.statsd.incr("breaker.transition", tags...)
+	s.publishTransition(from, to, snap)
+	s.updateReadiness()
+}
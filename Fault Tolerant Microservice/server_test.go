@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProducts is the size of the catalog newTestServer generates
+const testProducts = 100
+
+// newTestServer builds a Server with a small generated catalog, chaos
+// off, a fixed seed and a manual clock, after configure has adjusted its
+// config
+func newTestServer(t testing.TB, configure func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.NumProducts = testProducts
+	cfg.ChaosRate = 0
+	cfg.Seed = 1
+	cfg.Clock = newManualClock(time.Unix(0, 0).UTC())
+	if configure != nil {
+		configure(&cfg)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	s.LoadCatalog()
+	return s
+}
+
+// serve sends a request through h and returns the recorded response
+func serve(h http.Handler, method, target string, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// searchResponse is the part of a flat search response the tests read
+type searchResponse struct {
+	Products     []Product `json:"products"`
+	TotalFound   int       `json:"total_found"`
+	CheckedCount int       `json:"checked_request"`
+	TotalChecked int64     `json:"total_checked"`
+}
+
+// search runs a GET search through the full handler, failing t unless it
+// answers 200
+func search(t *testing.T, h http.Handler, target string) searchResponse {
+	t.Helper()
+	rec := serve(h, http.MethodGet, target, "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+	}
+	var res searchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("GET %s: decoding %q: %v", target, rec.Body, err)
+	}
+	return res
+}
+
+func productIDs(ps []Product) []ProductID {
+	ids := make([]ProductID, len(ps))
+	for i, p := range ps {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestSearchMatch(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for _, tc := range []struct {
+		q    string
+		want []ProductID
+	}{
+		{"Product Alpha 5", []ProductID{5, 50, 55}},
+		{"product alpha 5", []ProductID{5, 50, 55}},
+		{"Beta 96", []ProductID{96}},
+	} {
+		res := search(t, h, "/products/search?mode=exhaustive&sort=id&q="+url.QueryEscape(tc.q))
+		if got := productIDs(res.Products); !equalIDs(got, tc.want) || res.TotalFound != len(tc.want) {
+			t.Errorf("q=%q: got %v of %d, want %v", tc.q, got, res.TotalFound, tc.want)
+		}
+	}
+}
+
+func TestSearchMatchesCategory(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	res := search(t, h, "/products/search?mode=exhaustive&q=books")
+	if res.TotalFound != testProducts/len(categories) {
+		t.Fatalf("q=books found %d, want %d", res.TotalFound, testProducts/len(categories))
+	}
+	for _, p := range res.Products {
+		if p.Category != "Books" {
+			t.Errorf("q=books returned product %d in %s", p.ID, p.Category)
+		}
+	}
+}
+
+func TestSearchNoMatch(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for _, target := range []string{
+		"/products/search?mode=exhaustive&q=nothing-like-it",
+		"/products/search?q=nothing-like-it",
+		"/v1/products/search?q=nothing-like-it",
+	} {
+		rec := serve(h, http.MethodGet, target, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+		if !strings.Contains(rec.Body.String(), `"total_found":0`) {
+			t.Errorf("GET %s: want total_found 0, got %s", target, rec.Body)
+		}
+	}
+	// An empty query matches nothing rather than everything
+	if res := search(t, h, "/products/search?mode=exhaustive"); res.TotalFound != 0 || len(res.Products) != 0 {
+		t.Errorf("empty q found %d products", res.TotalFound)
+	}
+}
+
+func TestSearchLimits(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	res := search(t, h, "/products/search?mode=exhaustive&q=product")
+	if res.TotalFound != testProducts || len(res.Products) != s.cfg.MaxResults {
+		t.Errorf("q=product: %d products of %d, want %d of %d", len(res.Products), res.TotalFound, s.cfg.MaxResults, testProducts)
+	}
+	res = search(t, h, "/products/search?mode=exhaustive&sort=id&q=product&limit=3&offset=10")
+	if got := productIDs(res.Products); !equalIDs(got, []ProductID{10, 11, 12}) || res.TotalFound != testProducts {
+		t.Errorf("limit=3&offset=10: got %v of %d", got, res.TotalFound)
+	}
+	for _, bad := range []string{"limit=0", "limit=21", "limit=x", "offset=-1"} {
+		if rec := serve(h, http.MethodGet, "/products/search?q=product&"+bad, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", bad, rec.Code)
+		}
+	}
+	// A sample checks ChecksPerSearch products however many match
+	res = search(t, h, "/products/search?debug=1&q=product")
+	if res.CheckedCount != s.cfg.ChecksPerSearch || res.TotalFound > s.cfg.ChecksPerSearch {
+		t.Errorf("sampled search checked %d and found %d, want %d checked", res.CheckedCount, res.TotalFound, s.cfg.ChecksPerSearch)
+	}
+}
+
+func TestSearchDebugFields(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	plain := serve(h, http.MethodGet, "/products/search?q=alpha", "", nil)
+	for _, field := range []string{"checked_request", "total_checked"} {
+		if strings.Contains(plain.Body.String(), `"`+field+`"`) {
+			t.Errorf("search without debug has %s: %s", field, plain.Body)
+		}
+	}
+	first := search(t, h, "/products/search?debug=1&q=alpha")
+	second := search(t, h, "/products/search?debug=true&q=alpha")
+	if first.CheckedCount != 100 || second.CheckedCount != 100 {
+		t.Errorf("checked_request %d and %d, want 100", first.CheckedCount, second.CheckedCount)
+	}
+	// total_checked counts every search so far, the plain one included
+	if first.TotalChecked != 200 || second.TotalChecked != 300 {
+		t.Errorf("total_checked %d then %d, want 200 then 300", first.TotalChecked, second.TotalChecked)
+	}
+}
+
+func TestSearchSeedRepeats(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	a := serve(h, http.MethodGet, "/products/search?seed=42&q=alpha", "", nil)
+	b := serve(h, http.MethodGet, "/products/search?seed=42&q=alpha", "", nil)
+	trim := func(body string) string {
+		// search_time is the only part that may differ
+		i := strings.Index(body, `"search_time"`)
+		return body[:i]
+	}
+	if trim(a.Body.String()) != trim(b.Body.String()) {
+		t.Errorf("same seed, different answers:\n%s\n%s", a.Body, b.Body)
+	}
+}
+
+func equalIDs(a, b []ProductID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestDeterministicKeepsRealTime checks deterministic mode only freezes
+// what responses report: the limiter still refills as time passes
+func TestDeterministicKeepsRealTime(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) {
+		cfg.Deterministic = true
+		cfg.Clock = nil
+		cfg.RateLimitRPS, cfg.RateLimitBurst = 200, 1
+	}).Routes()
+	for i := 0; i < 3; i++ {
+		rec := serve(h, http.MethodGet, "/products/search?mode=exhaustive&q=alpha", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("search %d: %d %s", i, rec.Code, rec.Body)
+		}
+		if !strings.Contains(rec.Body.String(), `"search_time":"0.0000s"`) {
+			t.Errorf("search %d reports time: %s", i, rec.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// shadowRunner re-runs a fraction of searches in a second mode, in the
+// background, and counts where the two disagree. Shadow searches only
+// touch the store: they skip the breaker, bulkhead, chaos, stats and the
+// HTTP middleware, so they never show up in breaker accounting or the
+// access log. At most cap(pool) run at once; the rest are dropped.
+type shadowRunner struct {
+	mode    string
+	percent float64
+	pool    chan struct{}
+	seen    uint64
+
+	compared          int64
+	dropped           int64
+	countMismatches   int64
+	idMismatches      int64
+	insideInterval    int64
+	outsideInterval   int64
+	missingCandidates int64
+}
+
+func newShadowRunner(mode string, percent float64, pool int) (*shadowRunner, error) {
+	if mode != modeExhaustive && mode != modeIndexed {
+		return nil, fmt.Errorf("shadow: mode must be exhaustive or indexed, got %q", mode)
+	}
+	if percent <= 0 || percent > 100 || pool < 1 {
+		return nil, fmt.Errorf("shadow: percent must be in (0, 100] and pool at least 1")
+	}
+	return &shadowRunner{mode: mode, percent: percent, pool: make(chan struct{}, pool)}, nil
+}
+
+// pick reports whether this search is shadowed. Picks are spread evenly
+// rather than drawn at random, so they don't disturb the request's seeded
+// sampling.
+func (sh *shadowRunner) pick() bool {
+	n := atomic.AddUint64(&sh.seen, 1)
+	p := sh.percent / 100
+	return math.Floor(float64(n)*p) > math.Floor(float64(n-1)*p)
+}
+
+// shadowPrimary is what the client was sent, for the shadow to compare to
+type shadowPrimary struct {
+	mode     string
+	seed     int64
+	matches  int
+	ids      []ProductID
+	estimate *estimateInterval
+}
+
+// shadowSearch compares a finished search against the shadow mode
+// without blocking the caller
+func (s *Server) shadowSearch(text searchText, brand, category string, page searchPage, n int, primary shadowPrimary) {
+	sh := s.shadow
+	select {
+	case sh.pool <- struct{}{}:
+	default:
+		atomic.AddInt64(&sh.dropped, 1)
+		return
+	}
+	go func() {
+		defer func() { <-sh.pool }()
+		rnd := requestRandPool.Get().(*requestRand)
+		defer putRequestRand(rnd)
+		rnd.Seed(primary.seed)
+		q := matchQuery{text: text, brand: brand, category: category, n: n, strategy: s.cfg.SampleStrategy, rnd: rnd.Rand, page: page}
+		ids, mode := matcherFor(sh.mode).candidates(s, q)
+		sr, _, err := matcherFor(mode).match(context.Background(), s, q, ids)
+		if err != nil {
+			return
+		}
+		defer sr.release()
+		sh.compare(text.q, page, primary, mode, ids, sr)
+	}()
+}
+
+func (sh *shadowRunner) compare(q string, page searchPage, primary shadowPrimary, mode string, candidates []ProductID, sr *scanResult) {
+	atomic.AddInt64(&sh.compared, 1)
+	shadowIDs := make([]ProductID, len(sr.results))
+	for i, p := range sr.results {
+		shadowIDs[i] = p.ID
+	}
+	sampled := primary.mode == modeSample
+	if sampled == (mode == modeSample) {
+		// Like for like: totals should agree exactly, and so should pages,
+		// though unsorted ones come back in each mode's own order
+		if primary.matches != sr.matches {
+			atomic.AddInt64(&sh.countMismatches, 1)
+			log.Printf("Shadow %s matched %d where %s matched %d for q=%q\n", mode, sr.matches, primary.mode, primary.matches, q)
+		}
+		if page.sort != "" && !sameIDs(primary.ids, shadowIDs) {
+			atomic.AddInt64(&sh.idMismatches, 1)
+			log.Printf("Shadow %s returned %v where %s returned %v for q=%q\n", mode, shadowIDs, primary.mode, primary.ids, q)
+		}
+		return
+	}
+	if sampled && primary.estimate != nil {
+		// A full count should land inside the sample's interval, and every
+		// sampled result should be among the full search's candidates
+		if sr.matches >= primary.estimate.Low && sr.matches <= primary.estimate.High {
+			atomic.AddInt64(&sh.insideInterval, 1)
+		} else {
+			atomic.AddInt64(&sh.outsideInterval, 1)
+			log.Printf("Shadow %s matched %d, outside %s estimate [%d, %d] for q=%q\n", mode, sr.matches, primary.mode,
+				primary.estimate.Low, primary.estimate.High, q)
+		}
+		sorted := append([]ProductID(nil), candidates...)
+		sortIDs(sorted)
+		for _, id := range primary.ids {
+			if i := searchID(sorted, id); i == len(sorted) || sorted[i] != id {
+				atomic.AddInt64(&sh.missingCandidates, 1)
+				log.Printf("Shadow %s missed product %d that %s found for q=%q\n", mode, id, primary.mode, q)
+				break
+			}
+		}
+	}
+}
+
+func sameIDs(a, b []ProductID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) shadowHandler(w http.ResponseWriter, r *http.Request) {
+	sh := s.shadow
+	if sh == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":            true,
+		"mode":               sh.mode,
+		"percent":            sh.percent,
+		"pool":               cap(sh.pool),
+		"in_flight":          len(sh.pool),
+		"compared":           atomic.LoadInt64(&sh.compared),
+		"dropped":            atomic.LoadInt64(&sh.dropped),
+		"count_mismatches":   atomic.LoadInt64(&sh.countMismatches),
+		"id_mismatches":      atomic.LoadInt64(&sh.idMismatches),
+		"inside_interval":    atomic.LoadInt64(&sh.insideInterval),
+		"outside_interval":   atomic.LoadInt64(&sh.outsideInterval),
+		"missing_candidates": atomic.LoadInt64(&sh.missingCandidates),
+	})
+}
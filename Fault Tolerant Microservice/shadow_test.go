@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// shadowStats reads /stats/shadow once compared and dropped add up to
+// want, failing t if they never do
+func shadowStats(t *testing.T, h http.Handler, want int64) map[string]interface{} {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		var st map[string]interface{}
+		if err := json.Unmarshal(serve(h, http.MethodGet, "/stats/shadow", "", nil).Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st["enabled"] != true {
+			return st
+		}
+		if int64(st["compared"].(float64)+st["dropped"].(float64)) >= want && st["in_flight"] == 0.0 || time.Now().After(deadline) {
+			return st
+		}
+	}
+}
+
+// TestShadowSearches shadows half the exhaustive searches in indexed
+// mode, which agrees with them, and leaves the client's answers and the
+// breaker's counts as they would have been
+func TestShadowSearches(t *testing.T) {
+	plain := newTestServer(t, nil).Routes()
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ShadowPercent = 50
+		cfg.ShadowMode = modeIndexed
+		// Room for every shadow, however far behind they run
+		cfg.ShadowPool = 20
+	})
+	h := s.Routes()
+	targets := []string{
+		"/products/search?mode=exhaustive&q=alpha&sort=id",
+		"/products/search?mode=exhaustive&q=books",
+		"/products/search?mode=exhaustive&q=product&sort=name&limit=5",
+		"/products/search?mode=exhaustive&q=nothing-matches",
+	}
+	for i := 0; i < 5; i++ {
+		for _, target := range targets {
+			got, want := serve(h, http.MethodGet, target, "", nil), serve(plain, http.MethodGet, target, "", nil)
+			if got.Code != http.StatusOK || got.Body.String() != want.Body.String() {
+				t.Errorf("%s shadowed: %d %s, want %s", target, got.Code, got.Body, want.Body)
+			}
+		}
+	}
+	// Searches already in the shadow's mode have nothing to compare to
+	for i := 0; i < 4; i++ {
+		search(t, h, "/products/search?mode=indexed&q=alpha")
+	}
+	st := shadowStats(t, h, 10)
+	if st["compared"] != 10.0 || st["dropped"] != 0.0 || st["count_mismatches"] != 0.0 || st["id_mismatches"] != 0.0 {
+		t.Errorf("shadow stats %v, want half of 20 searches compared and agreeing", st)
+	}
+	if snap := s.breaker.Snapshot(); snap.Failures != 0 {
+		t.Errorf("breaker counted %d failures", snap.Failures)
+	}
+}
+
+// TestShadowPoolFull drops shadows when its pool is busy, never holding
+// up the search
+func TestShadowPoolFull(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ShadowPercent = 100
+		cfg.ShadowPool = 1
+	})
+	h := s.Routes()
+	s.shadow.pool <- struct{}{}
+	for i := 0; i < 3; i++ {
+		search(t, h, "/products/search?mode=exhaustive&q=alpha")
+	}
+	var st map[string]interface{}
+	if err := json.Unmarshal(serve(h, http.MethodGet, "/stats/shadow", "", nil).Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st["dropped"] != 3.0 || st["compared"] != 0.0 || st["in_flight"] != 1.0 {
+		t.Errorf("stats with the pool busy %v", st)
+	}
+	<-s.shadow.pool
+	search(t, h, "/products/search?mode=exhaustive&q=alpha")
+	if st := shadowStats(t, h, 4); st["compared"] != 1.0 {
+		t.Errorf("stats once the pool is free %v", st)
+	}
+}
+
+// TestShadowCountsDisagreements counts a shadow whose total or sorted
+// page differs from what the client was sent
+func TestShadowCountsDisagreements(t *testing.T) {
+	sh, err := newShadowRunner(modeIndexed, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := &scanResult{matches: 2, results: []Product{{ID: 1}, {ID: 2}}}
+	sh.compare("q", searchPage{sort: "id"}, shadowPrimary{mode: modeExhaustive, matches: 2, ids: []ProductID{1, 2}}, modeIndexed, nil, sr)
+	sh.compare("q", searchPage{sort: "id"}, shadowPrimary{mode: modeExhaustive, matches: 3, ids: []ProductID{1, 3}}, modeIndexed, nil, sr)
+	// Unsorted pages come in each mode's own order
+	sh.compare("q", searchPage{}, shadowPrimary{mode: modeExhaustive, matches: 2, ids: []ProductID{2, 1}}, modeIndexed, nil, sr)
+	if sh.compared != 3 || sh.countMismatches != 1 || sh.idMismatches != 1 {
+		t.Errorf("compared %d, %d count and %d ID mismatches", sh.compared, sh.countMismatches, sh.idMismatches)
+	}
+	for _, bad := range []struct {
+		mode    string
+		percent float64
+		pool    int
+	}{{modeSample, 10, 1}, {modeIndexed, 0, 1}, {modeIndexed, 101, 1}, {modeIndexed, 10, 0}} {
+		if _, err := newShadowRunner(bad.mode, bad.percent, bad.pool); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestShadowDisabled(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	if st := shadowStats(t, h, 0); st["enabled"] != false {
+		t.Errorf("%v", st)
+	}
+}
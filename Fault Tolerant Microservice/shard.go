@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a shard does with a request for a product another shard owns
+const (
+	shardReject = "reject"
+	shardProxy  = "proxy"
+)
+
+var shardForeignModes = []string{shardReject, shardProxy}
+
+const (
+	// shardOwnerHeader names the shard owning the product a request was
+	// for, when it isn't this one
+	shardOwnerHeader = "X-Shard-Owner"
+	// shardProxiedHeader marks a request one shard proxied to another,
+	// which never proxies it again
+	shardProxiedHeader = "X-Shard-Proxied-By"
+	// shardVirtualNodes is how many points each shard has on the ring.
+	// More spread the catalog more evenly.
+	shardVirtualNodes = 64
+	// shardFanOutMax bounds offset+limit of a fan-out search, which asks
+	// every shard for that many
+	shardFanOutMax = 10000
+)
+
+// shardRing assigns product IDs to shards by consistent hashing: each
+// shard has shardVirtualNodes points on a ring of hashes, and an ID
+// belongs to the shard of the first point at or after its own hash.
+// Adding a shard moves only the IDs between its points and the points
+// before them, about 1/n of the catalog, rather than reshuffling it all.
+type shardRing struct {
+	count  int
+	points []uint64
+	owners []int
+}
+
+func newShardRing(count int) *shardRing {
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	ps := make([]point, 0, count*shardVirtualNodes)
+	for i := 0; i < count; i++ {
+		for v := 0; v < shardVirtualNodes; v++ {
+			ps = append(ps, point{shardHash(fmt.Sprintf("shard-%d-%d", i, v)), i})
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].hash < ps[j].hash })
+	ring := &shardRing{count: count, points: make([]uint64, len(ps)), owners: make([]int, len(ps))}
+	for i, p := range ps {
+		ring.points[i], ring.owners[i] = p.hash, p.owner
+	}
+	return ring
+}
+
+// shardHash is FNV-1a with a final mix, as FNV alone leaves short keys
+// like small IDs clustered on the ring
+func shardHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// owner is the shard product id belongs to
+func (ring *shardRing) owner(id ProductID) int {
+	h := shardHash(id.String())
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[i]
+}
+
+// shardPlan is this instance's place among Config.ShardCount shards: the
+// products it owns and what it does about requests for the others
+type shardPlan struct {
+	ring    *shardRing
+	index   int
+	foreign string
+	// peers proxy to the other shards by index, with shardProxy
+	peers  []*httputil.ReverseProxy
+	statsd *statsdClient
+
+	rejected int64
+	proxied  int64
+}
+
+func newShardPlan(cfg Config) (*shardPlan, error) {
+	switch {
+	case cfg.ShardIndex < 0 || cfg.ShardIndex >= cfg.ShardCount:
+		return nil, fmt.Errorf("shard index must be in [0, %d)", cfg.ShardCount)
+	case cfg.ShardForeign == shardReject:
+	case cfg.ShardForeign == shardProxy:
+		if len(cfg.ShardPeers) != cfg.ShardCount {
+			return nil, fmt.Errorf("shard proxying needs a peer URL for each of the %d shards, this one's included", cfg.ShardCount)
+		}
+	default:
+		return nil, fmt.Errorf("shard foreign mode must be one of %v", shardForeignModes)
+	}
+	p := &shardPlan{ring: newShardRing(cfg.ShardCount), index: cfg.ShardIndex, foreign: cfg.ShardForeign}
+	if cfg.ShardForeign == shardProxy {
+		p.peers = make([]*httputil.ReverseProxy, cfg.ShardCount)
+		for i, peer := range cfg.ShardPeers {
+			if i == cfg.ShardIndex {
+				continue
+			}
+			u, err := url.Parse(peer)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("shard peer %d: %q is not an absolute URL", i, peer)
+			}
+			rp := httputil.NewSingleHostReverseProxy(u)
+			owner := i
+			rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Proxying %s %s to shard %d: %v", r.Method, r.URL.Path, owner, err)
+				writeErr(w, r, newError(ErrStoreUnavailable, fmt.Sprintf("Shard %d, which owns the product, is unreachable", owner)))
+			}
+			p.peers[i] = rp
+		}
+	}
+	return p, nil
+}
+
+// owns reports whether product id is this shard's; every product is
+// when the catalog isn't sharded
+func (p *shardPlan) owns(id ProductID) bool {
+	return p == nil || p.ring.owner(id) == p.index
+}
+
+// guard is the layer of routes naming a product by {id}: a product
+// another shard owns is a 421, or is proxied to its owner, named in
+// X-Shard-Owner either way. A request already proxied once is never
+// proxied again, so peers that disagree about the ring can't loop.
+func (p *shardPlan) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(pathParam(r, "id"))
+		if err != nil {
+			// The handler answers a malformed ID
+			next(w, r)
+			return
+		}
+		owner := p.ring.owner(ProductID(id))
+		if owner == p.index {
+			next(w, r)
+			return
+		}
+		w.Header().Set(shardOwnerHeader, strconv.Itoa(owner))
+		if p.foreign == shardProxy && r.Header.Get(shardProxiedHeader) == "" {
+			atomic.AddInt64(&p.proxied, 1)
+			p.statsd.incr("shard.proxied")
+			r2 := r.Clone(r.Context())
+			r2.Header.Set(shardProxiedHeader, strconv.Itoa(p.index))
+			p.peers[owner].ServeHTTP(w, r2)
+			return
+		}
+		atomic.AddInt64(&p.rejected, 1)
+		p.statsd.incr("shard.rejected")
+		writeErr(w, r, newError(ErrMisdirected, fmt.Sprintf("Product %d belongs to shard %d of %d", id, owner, p.ring.count)))
+	}
+}
+
+// searchShard is the shard metadata of a search response
+type searchShard struct {
+	Index int `json:"index"`
+	Count int `json:"count"`
+	// Products is how many this shard holds: the search only saw them
+	Products int `json:"products"`
+}
+
+// searchMeta is the metadata for a search on s, nil unless it is a shard
+func (s *Server) searchMeta() *searchShard {
+	if s.shards == nil {
+		return nil
+	}
+	return &searchShard{Index: s.shards.index, Count: s.shards.ring.count, Products: s.store.size()}
+}
+
+func (s *Server) shardStats() map[string]interface{} {
+	out := map[string]interface{}{"enabled": s.shards != nil, "local_shards": len(s.localShards)}
+	if p := s.shards; p != nil {
+		out["index"] = p.index
+		out["count"] = p.ring.count
+		out["foreign"] = p.foreign
+		out["products"] = s.store.size()
+		out["rejected"] = atomic.LoadInt64(&p.rejected)
+		out["proxied"] = atomic.LoadInt64(&p.proxied)
+	}
+	return out
+}
+
+// newLocalShards builds n shard servers from cfg, each owning its slice
+// of the same generated catalog, for the fan-out search. Like tenants
+// they leave out what only one instance-wide server may run.
+func newLocalShards(cfg Config, n int) ([]*Server, error) {
+	cfg.LocalShards = 0
+	cfg.ShardCount, cfg.ShardForeign, cfg.ShardPeers = n, shardReject, nil
+	cfg.StateFile, cfg.CacheWarmup, cfg.IndexFile = "", 0, ""
+	cfg.WALFile, cfg.CatalogSnapshotFile = "", ""
+	cfg.MirrorURL = ""
+	cfg.WatchdogDir, cfg.DiskCheckPath = "", ""
+	cfg.MemorySoftLimit = 0
+	cfg.SigningKeysFile = ""
+	cfg.SpillQueue = 0
+	cfg.TenantsFile, cfg.TenantAutoProvision = "", false
+	shards := make([]*Server, n)
+	for i := range shards {
+		cfg.ShardIndex = i
+		sh, err := NewServer(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("local shard %d: %w", i, err)
+		}
+		shards[i] = sh
+	}
+	return shards, nil
+}
+
+// shardPart is one shard's share of a fan-out search
+type shardPart struct {
+	Index    int `json:"index"`
+	Products int `json:"products"`
+	// Mode is the mode that answered on the shard, after any fallback
+	Mode      string  `json:"mode"`
+	Checked   int     `json:"checked"`
+	Matched   int     `json:"matched"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+}
+
+// shardSearchResult is a fan-out search's response
+type shardSearchResult struct {
+	Products   []Product   `json:"products"`
+	TotalFound int         `json:"total_found"`
+	Mode       string      `json:"mode"`
+	Sort       string      `json:"sort"`
+	Shards     []shardPart `json:"shards"`
+}
+
+// fanOut runs q on every shard at once and merges their pages into the
+// one q asks for. Each shard is asked for its first offset+limit in
+// q.page's order, ID order when unsorted, since the page could come
+// from any of them.
+func fanOut(ctx context.Context, shards []*Server, q matchQuery, mode string) (shardSearchResult, error) {
+	page := q.page
+	if page.sort == "" {
+		page.sort = "id"
+	}
+	q.page = searchPage{limit: page.offset + page.limit, sort: page.sort}
+	res := shardSearchResult{Mode: mode, Sort: page.sort, Shards: make([]shardPart, len(shards))}
+	pages := make([][]Product, len(shards))
+	errs := make([]error, len(shards))
+	// A sampled search's source isn't safe to share, so each shard draws
+	// from one seeded by it
+	rnds := make([]*rand.Rand, len(shards))
+	for i := range rnds {
+		rnds[i] = rand.New(rand.NewSource(q.rnd.Int63()))
+	}
+	var wg sync.WaitGroup
+	for i, sh := range shards {
+		wg.Add(1)
+		go func(i int, sh *Server) {
+			defer wg.Done()
+			start := time.Now()
+			q := q
+			q.rnd = rnds[i]
+			ids, answered := matcherFor(mode).candidates(sh, q)
+			sr, st, err := matcherFor(answered).match(ctx, sh, q, ids)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			pages[i] = append([]Product(nil), sr.results...)
+			sr.release()
+			res.Shards[i] = shardPart{Index: i, Products: sh.store.size(), Mode: answered, Checked: st.Checked, Matched: st.Matched, ElapsedMS: durationMS(time.Since(start))}
+		}(i, sh)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return res, fmt.Errorf("shard %d: %w", i, err)
+		}
+		res.TotalFound += res.Shards[i].Matched
+	}
+	res.Products = mergeShardPages(pages, page)
+	return res, ctx.Err()
+}
+
+// mergeShardPages merges pages, each already in page.sort order, and
+// returns the page.offset..offset+limit slice of the merged order
+func mergeShardPages(pages [][]Product, page searchPage) []Product {
+	out := make([]Product, 0, page.limit)
+	next := make([]int, len(pages))
+	for seen := 0; len(out) < page.limit; seen++ {
+		best := -1
+		for i, ps := range pages {
+			if next[i] < len(ps) && (best < 0 || productLess(&ps[next[i]], &pages[best][next[best]], page.sort)) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		if seen >= page.offset {
+			out = append(out, pages[best][next[best]])
+		}
+		next[best]++
+	}
+	return out
+}
+
+// shardSearchHandler searches the local shards, merging their answers
+func (s *Server) shardSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if len(s.localShards) == 0 {
+		writeErr(w, r, newError(ErrNotFound, "Local shards are off; start with -local-shards"))
+		return
+	}
+	req, errs := s.parseSearchRequest(r)
+	if req.page.offset+req.page.limit > shardFanOutMax {
+		errs = append(errs, &ValidationError{Field: "offset", Message: fmt.Sprintf("offset plus limit must be at most %d for a fan-out search", shardFanOutMax)})
+	}
+	if req.stock.set() && s.inventory != nil {
+		// The shards have no inventory dependency to ask
+		errs = append(errs, &ValidationError{Field: "q", Message: "q compares stock, which a fan-out search can't check"})
+	}
+	if err := fieldErrors(errs).err(); err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	mode := req.mode
+	if mode == "" {
+		mode = modeExhaustive
+	}
+	text := newSearchText(req.query, req.locale, req.fold)
+	text.positions = req.positions
+	text.price = req.price
+	setLocaleHeaders(w, text.locale)
+	rnd := requestRandFor(req.seed)
+	defer putRequestRand(rnd)
+	q := matchQuery{text: text, brand: req.brand, category: req.category, n: s.checksPerSearch(), strategy: req.strategy, rnd: rnd.Rand, page: req.page}
+	res, err := fanOut(r.Context(), s.localShards, q, mode)
+	if err != nil {
+		if r.Context().Err() != nil {
+			s.recordCancelled("scan")
+			return
+		}
+		writeErr(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// testShards is how many local shards TestShardMerge splits the catalog
+// across
+const testShards = 3
+
+// TestShardMerge splits a catalog across local shards and holds it to an
+// unsharded one: every product stored once, by its owner, and fanned out
+// exhaustive searches merging to the same pages and totals as a scan of
+// the whole
+func TestShardMerge(t *testing.T) {
+	whole := newTestServer(t, nil)
+	shards, err := newLocalShards(whole.cfg, testShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := 0
+	for i, sh := range shards {
+		sh.store.generate(testProducts)
+		for _, id := range sh.store.allIDs() {
+			if owner := sh.shards.ring.owner(id); owner != i {
+				t.Errorf("shard %d holds product %d, which is shard %d's", i, id, owner)
+			}
+		}
+		held += sh.store.size()
+	}
+	if held != whole.store.size() {
+		t.Errorf("shards hold %d products between them, the catalog %d", held, whole.store.size())
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, term := range []string{"", "product", "alpha", "electronics", "1"} {
+		for _, sort := range []string{"", "id", "name"} {
+			for _, offset := range []int{0, 5} {
+				q := matchQuery{text: newSearchText(parseQuery(term), defaultLocale, false), rnd: rnd, page: searchPage{offset: offset, limit: 7, sort: sort}}
+				got, err := fanOut(context.Background(), shards, q, modeExhaustive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q.page.sort = got.Sort
+				all, _ := scanMatcher{}.candidates(whole, q)
+				want, _, _ := scanMatcher{}.match(context.Background(), whole, q, all)
+				switch {
+				case got.TotalFound != want.matches:
+					t.Errorf("fan-out found %d for %q where a scan found %d", got.TotalFound, term, want.matches)
+				case len(got.Products) != len(want.results):
+					t.Errorf("fan-out returned %d for %q sorted %q from %d, a scan %d", len(got.Products), term, got.Sort, offset, len(want.results))
+				default:
+					for i := range got.Products {
+						if got.Products[i].ID != want.results[i].ID {
+							t.Errorf("fan-out result %d for %q sorted %q from %d is product %d, a scan's %d", i, term, got.Sort, offset, got.Products[i].ID, want.results[i].ID)
+							break
+						}
+					}
+				}
+				want.release()
+			}
+		}
+	}
+}
+
+// TestShardRingGrowth checks adding a shard moves only about its share
+// of IDs
+func TestShardRingGrowth(t *testing.T) {
+	from, to := newShardRing(testShards), newShardRing(testShards+1)
+	const ids = 1000
+	moved := 0
+	for id := ProductID(0); id < ids; id++ {
+		if from.owner(id) != to.owner(id) {
+			moved++
+		}
+	}
+	// A shard of testShards+1 takes a quarter; allow for the hash's skew
+	if moved > ids*2/5 {
+		t.Errorf("growing from %d shards to %d moved %d of %d IDs", testShards, testShards+1, moved, ids)
+	}
+}
+
+// TestShardGuard runs two shards, checking each holds and creates only
+// its own products, and answers another's with 421 naming its owner or,
+// proxying, with the owner's answer, but never proxies a request twice
+func TestShardGuard(t *testing.T) {
+	var handlers [2]http.Handler
+	var peers []string
+	for i := range handlers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i].ServeHTTP(w, r) }))
+		defer ts.Close()
+		peers = append(peers, ts.URL)
+	}
+	var shards [2]*Server
+	for i := range shards {
+		shards[i] = newTestServer(t, func(cfg *Config) {
+			cfg.ShardCount, cfg.ShardIndex, cfg.ShardForeign, cfg.ShardPeers = 2, i, shardProxy, peers
+		})
+		handlers[i] = shards[i].Routes()
+	}
+	reject := newTestServer(t, func(cfg *Config) { cfg.ShardCount, cfg.ShardIndex = 2, 0 }).Routes()
+
+	ring := newShardRing(2)
+	var own, foreign ProductID
+	for id := ProductID(0); id < testProducts; id++ {
+		if ring.owner(id) == 0 {
+			own = id
+		} else {
+			foreign = id
+		}
+	}
+	if _, ok := shards[0].store.get(foreign); ok || shards[0].store.size()+shards[1].store.size() != testProducts {
+		t.Errorf("shard 0 holds shard 1's product %d, or the shards hold %d and %d", foreign, shards[0].store.size(), shards[1].store.size())
+	}
+	p, err := shards[0].store.create(Product{Name: "Sharded", Category: "Books", Brand: "Alpha"})
+	if err != nil || ring.owner(p.ID) != 0 {
+		t.Errorf("shard 0 created product %d, owned by shard %d: %v", p.ID, ring.owner(p.ID), err)
+	}
+
+	target := "/v1/products/" + strconv.Itoa(int(foreign))
+	if rec := serve(reject, http.MethodGet, "/v1/products/"+strconv.Itoa(int(own)), "", nil); rec.Code != http.StatusOK {
+		t.Errorf("its own product: %d", rec.Code)
+	}
+	if rec := serve(reject, http.MethodGet, target, "", nil); rec.Code != http.StatusMisdirectedRequest || rec.Header().Get(shardOwnerHeader) != "1" {
+		t.Errorf("rejecting shard 1's product: %d owner %q", rec.Code, rec.Header().Get(shardOwnerHeader))
+	}
+	rec := serve(handlers[0], http.MethodGet, target, "", nil)
+	var got Product
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusOK || got.ID != foreign || rec.Header().Get(shardOwnerHeader) != "1" {
+		t.Errorf("proxying shard 1's product: %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(handlers[1], http.MethodGet, "/v1/products/"+strconv.Itoa(int(own)), "", http.Header{shardProxiedHeader: {"0"}})
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("a request proxied already was proxied again: %d", rec.Code)
+	}
+}
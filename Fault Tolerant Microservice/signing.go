@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// signatureHeader carries a response's HMAC-SHA256 signatures, one value
+// per active key, like the webhook signature: keyid=<id>,sha256=<hex>
+const signatureHeader = "X-Signature"
+
+// signMaxBuffer is how much of a response is held back to sign it in a
+// header. A longer one, or one the handler flushes, is passed through as
+// it is written and signed in a trailer.
+const signMaxBuffer = 1 << 20
+
+// signingKey is one entry of the -signing-keys file. Every listed key
+// signs, so a key can be added, rolled out to verifiers and the old one
+// dropped without any response they can't check.
+type signingKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// responseSigner signs every response body with the active keys. The
+// bytes signed are the ones sent, after any compression the handler
+// chose.
+type responseSigner struct {
+	mu       sync.RWMutex
+	file     string
+	keys     []signingKey
+	reloads  int64
+	failures int64
+	lastErr  string
+
+	signed   int64
+	trailers int64
+	unsigned int64
+}
+
+func loadSigningKeys(file string) (*responseSigner, error) {
+	keys, err := readSigningKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	return &responseSigner{file: file, keys: keys}, nil
+}
+
+func readSigningKeys(file string) ([]signingKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []signingKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", file)
+	}
+	seen := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		switch {
+		case k.ID == "":
+			return nil, fmt.Errorf("%s: key %d has no id", file, i)
+		case len(k.Secret) < 16:
+			return nil, fmt.Errorf("%s: key %q: secret must be at least 16 bytes", file, k.ID)
+		case seen[k.ID]:
+			return nil, fmt.Errorf("%s: key %q listed twice", file, k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return keys, nil
+}
+
+// reload re-reads the key file, keeping the current keys if the new ones
+// don't load. main calls it on SIGHUP.
+func (rs *responseSigner) reload() {
+	keys, err := readSigningKeys(rs.file)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err != nil {
+		rs.failures++
+		rs.lastErr = err.Error()
+		log.Println("Signing keys reload failed, keeping the current ones:", err)
+		return
+	}
+	rs.keys, rs.lastErr = keys, ""
+	rs.reloads++
+	log.Printf("Signing keys reloaded: %d keys\n", len(keys))
+}
+
+// sign wraps every route, outside everything that writes a response
+func (rs *responseSigner) sign(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs.mu.RLock()
+		keys := rs.keys
+		rs.mu.RUnlock()
+		sw := &signingWriter{ResponseWriter: w, rs: rs, keys: keys}
+		for _, k := range keys {
+			sw.macs = append(sw.macs, hmac.New(sha256.New, []byte(k.Secret)))
+		}
+		next(sw, r)
+		sw.finish()
+	}
+}
+
+// signingWriter holds the response back until it is complete, to put the
+// signatures in a header, and switches to passing it through, with the
+// signatures in a trailer, once the handler flushes or it outgrows
+// signMaxBuffer. A response that must stream but has a Content-Length
+// can't carry a trailer and goes out unsigned.
+type signingWriter struct {
+	http.ResponseWriter
+	rs   *responseSigner
+	keys []signingKey
+	macs []hash.Hash
+	// status is the handler's, sent when the response is released
+	status int
+	buf    bytes.Buffer
+	// passing is set once the header has gone out; signed tells whether
+	// a trailer was announced for the signatures
+	passing  bool
+	signed   bool
+	hijacked bool
+	err      error
+}
+
+func (sw *signingWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		// Informational responses go out as they come
+		sw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if sw.status == 0 {
+		sw.status = code
+	}
+}
+
+func (sw *signingWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	for _, m := range sw.macs {
+		m.Write(b)
+	}
+	if sw.passing {
+		return sw.ResponseWriter.Write(b)
+	}
+	sw.buf.Write(b)
+	if sw.buf.Len() > signMaxBuffer {
+		sw.release()
+	}
+	return len(b), sw.err
+}
+
+// release sends the header and what is held back, and passes the rest
+// through
+func (sw *signingWriter) release() {
+	sw.passing = true
+	if sw.ResponseWriter.Header().Get("Content-Length") == "" {
+		sw.signed = true
+		sw.ResponseWriter.Header().Add("Trailer", signatureHeader)
+	}
+	sw.ResponseWriter.WriteHeader(sw.status)
+	if sw.buf.Len() > 0 {
+		_, sw.err = sw.ResponseWriter.Write(sw.buf.Bytes())
+		sw.buf = bytes.Buffer{}
+	}
+}
+
+func (sw *signingWriter) Flush() {
+	if !sw.passing {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		sw.release()
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok && sw.err == nil {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over unsigned, for WebSocket upgrades
+func (sw *signingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	sw.hijacked = true
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the connection, for stream
+// write deadlines
+func (sw *signingWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *signingWriter) signatures() []string {
+	values := make([]string, len(sw.keys))
+	for i, k := range sw.keys {
+		values[i] = "keyid=" + k.ID + ",sha256=" + hex.EncodeToString(sw.macs[i].Sum(nil))
+	}
+	return values
+}
+
+func (sw *signingWriter) finish() {
+	switch {
+	case sw.hijacked:
+	case sw.passing && sw.signed:
+		// Set after the body, a declared trailer goes out with the end of
+		// the chunked stream
+		sw.ResponseWriter.Header()[signatureHeader] = sw.signatures()
+		atomic.AddInt64(&sw.rs.trailers, 1)
+	case sw.passing:
+		atomic.AddInt64(&sw.rs.unsigned, 1)
+	default:
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		sw.ResponseWriter.Header()[signatureHeader] = sw.signatures()
+		sw.ResponseWriter.WriteHeader(sw.status)
+		sw.ResponseWriter.Write(sw.buf.Bytes())
+		atomic.AddInt64(&sw.rs.signed, 1)
+	}
+}
+
+func (s *Server) signingStats() map[string]interface{} {
+	rs := s.signer
+	if rs == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	ids := make([]string, len(rs.keys))
+	for i, k := range rs.keys {
+		ids[i] = k.ID
+	}
+	out := map[string]interface{}{
+		"enabled":         true,
+		"key_ids":         ids,
+		"signed":          atomic.LoadInt64(&rs.signed),
+		"in_trailer":      atomic.LoadInt64(&rs.trailers),
+		"unsigned":        atomic.LoadInt64(&rs.unsigned),
+		"reloads":         rs.reloads,
+		"reload_failures": rs.failures,
+		"max_buffer":      signMaxBuffer,
+	}
+	if rs.lastErr != "" {
+		out["last_error"] = rs.lastErr
+	}
+	return out
+}
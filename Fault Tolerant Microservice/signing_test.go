@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"productsearch/client"
+)
+
+// writeSigningKeys writes a -signing-keys file, returning its path
+func writeSigningKeys(t *testing.T, path, keys string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testSigningKeys = `[{"id":"old","secret":"0123456789abcdef-old"},{"id":"new","secret":"0123456789abcdef-new"}]`
+
+func TestReadSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	for name, keys := range map[string]string{
+		"not json":     `keys`,
+		"no keys":      `[]`,
+		"no id":        `[{"secret":"0123456789abcdef"}]`,
+		"short secret": `[{"id":"a","secret":"short"}]`,
+		"listed twice": `[{"id":"a","secret":"0123456789abcdef"},{"id":"a","secret":"0123456789abcdefg"}]`,
+	} {
+		if _, err := readSigningKeys(writeSigningKeys(t, filepath.Join(dir, "keys"), keys)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	keys, err := readSigningKeys(writeSigningKeys(t, filepath.Join(dir, "keys"), testSigningKeys))
+	if err != nil || len(keys) != 2 {
+		t.Errorf("%v, %v", keys, err)
+	}
+}
+
+// TestSignedResponsesVerify signs with two keys while they roll over:
+// a client knowing either verifies, one knowing neither, or a key ID with
+// the wrong secret, refuses the response
+func TestSignedResponsesVerify(t *testing.T) {
+	path := writeSigningKeys(t, filepath.Join(t.TempDir(), "keys"), testSigningKeys)
+	_, ts := newClientServer(t, func(cfg *Config) { cfg.SigningKeysFile = path })
+	ctx := context.Background()
+	for _, keys := range []map[string]string{
+		{"old": "0123456789abcdef-old"},
+		{"new": "0123456789abcdef-new"},
+		{"retired": "0123456789abcdef-xxx", "new": "0123456789abcdef-new"},
+	} {
+		c := client.New(ts.URL, client.WithSignatureKeys(keys))
+		if _, err := c.GetProduct(ctx, 1); err != nil {
+			t.Errorf("keys %v: GetProduct: %v", keys, err)
+		}
+		if _, err := c.Search(ctx, client.SearchRequest{Query: "alpha", Mode: "exhaustive"}); err != nil {
+			t.Errorf("keys %v: Search: %v", keys, err)
+		}
+	}
+	for _, keys := range []map[string]string{
+		{"retired": "0123456789abcdef-xxx"},
+		{"new": "0123456789abcdef-old"},
+	} {
+		c := client.New(ts.URL, client.WithSignatureKeys(keys))
+		if _, err := c.GetProduct(ctx, 1); !errors.Is(err, client.ErrBadSignature) {
+			t.Errorf("keys %v: %v, want ErrBadSignature", keys, err)
+		}
+	}
+}
+
+// TestSignatureCatchesTampering puts a proxy that changes responses
+// between the server and a verifying client
+func TestSignatureCatchesTampering(t *testing.T) {
+	path := writeSigningKeys(t, filepath.Join(t.TempDir(), "keys"), testSigningKeys)
+	h := newTestServer(t, func(cfg *Config) { cfg.SigningKeysFile = path }).Routes()
+	for name, tamper := range map[string]func(body []byte, header http.Header) []byte{
+		"renamed product": func(body []byte, _ http.Header) []byte {
+			return bytes.Replace(body, []byte("Product"), []byte("Produce"), 1)
+		},
+		"byte appended": func(body []byte, _ http.Header) []byte {
+			return append(body, ' ')
+		},
+		"signature dropped": func(body []byte, header http.Header) []byte {
+			header.Del(signatureHeader)
+			return body
+		},
+		"signature from another body": func(body []byte, header http.Header) []byte {
+			other := serve(h, http.MethodGet, "/products/2", "", nil)
+			header[signatureHeader] = other.Header()[signatureHeader]
+			return body
+		},
+	} {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			header := rec.Header().Clone()
+			body := tamper(rec.Body.Bytes(), header)
+			header.Del("Content-Length")
+			for k, vs := range header {
+				w.Header()[k] = vs
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(body)
+		}))
+		c := client.New(proxy.URL, client.WithSignatureKeys(map[string]string{"new": "0123456789abcdef-new"}))
+		if _, err := c.GetProduct(context.Background(), 1); !errors.Is(err, client.ErrBadSignature) {
+			t.Errorf("%s: %v, want ErrBadSignature", name, err)
+		}
+		proxy.Close()
+	}
+}
+
+// TestSignatureTrailer signs a response too long to hold back in a
+// trailer, over the bytes actually sent
+func TestSignatureTrailer(t *testing.T) {
+	path := writeSigningKeys(t, filepath.Join(t.TempDir(), "keys"), testSigningKeys)
+	s, ts := newClientServer(t, func(cfg *Config) {
+		cfg.SigningKeysFile = path
+		cfg.NumProducts = 10000
+	})
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/products/export", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) <= signMaxBuffer || resp.Header.Get(signatureHeader) != "" {
+		t.Fatalf("%d bytes, header signature %q", len(body), resp.Header.Get(signatureHeader))
+	}
+	keys := map[string][]byte{"old": []byte("0123456789abcdef-old")}
+	if err := client.VerifySignature(keys, body, resp.Trailer.Values(signatureHeader)); err != nil {
+		t.Errorf("trailer %v: %v", resp.Trailer, err)
+	}
+	if err := client.VerifySignature(keys, body[1:], resp.Trailer.Values(signatureHeader)); err == nil {
+		t.Errorf("a cut body verified")
+	}
+	if st := s.signingStats(); st["in_trailer"] != int64(1) {
+		t.Errorf("stats %v", st)
+	}
+}
+
+// TestSigningKeysReload drops the old key on reload, and keeps the keys
+// when the new file doesn't load
+func TestSigningKeysReload(t *testing.T) {
+	path := writeSigningKeys(t, filepath.Join(t.TempDir(), "keys"), testSigningKeys)
+	s, ts := newClientServer(t, func(cfg *Config) { cfg.SigningKeysFile = path })
+	old := client.New(ts.URL, client.WithSignatureKeys(map[string]string{"old": "0123456789abcdef-old"}))
+	ctx := context.Background()
+
+	writeSigningKeys(t, path, `[{"id":"new","secret":"short"}]`)
+	s.signer.reload()
+	if _, err := old.GetProduct(ctx, 1); err != nil {
+		t.Errorf("after a failed reload: %v", err)
+	}
+	writeSigningKeys(t, path, `[{"id":"new","secret":"0123456789abcdef-new"}]`)
+	s.signer.reload()
+	if _, err := old.GetProduct(ctx, 1); !errors.Is(err, client.ErrBadSignature) {
+		t.Errorf("old key after it was dropped: %v", err)
+	}
+	st := s.signingStats()
+	if st["reloads"] != int64(1) || st["reload_failures"] != int64(1) || st["last_error"] != nil {
+		t.Errorf("stats %v", st)
+	}
+}
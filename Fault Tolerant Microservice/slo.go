@@ -0,0 +1,252 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// sloMinutes is how far back availability is kept, one bucket a minute:
+// the longest window /slo reports
+const sloMinutes = 6 * 60
+
+// sloMinRequests is how many counted requests the short window needs
+// before a fast burn can fire, so one failure at 3am isn't an alert
+const sloMinRequests = 20
+
+// sloCheckInterval is how often the burn rate is checked for an alert
+const sloCheckInterval = 30 * time.Second
+
+// sloWindows are the windows /slo reports, shortest first. The fast burn
+// alert needs the first two over the threshold, so a short spike alone
+// doesn't fire it and it clears soon after the errors stop.
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{
+	{"5m", 5},
+	{"1h", 60},
+	{"6h", sloMinutes},
+}
+
+// shedCodes are the error codes of requests refused by design, to
+// protect the service, rather than failed
+var shedCodes = map[string]bool{codeCircuitOpen: true, codeOverloaded: true, codeRateLimited: true}
+
+// sloBucket counts one minute of product API requests
+type sloBucket struct {
+	minute   int64
+	good     int64
+	bad      int64
+	excluded int64
+}
+
+// sloTracker keeps the availability of the product API over the last
+// sloMinutes in a ring of per minute buckets. Client errors never count;
+// requests shed by the breaker, the bulkhead or a limit count as failures
+// only with Config.SLOCountShed. Minutes are on the server clock.
+type sloTracker struct {
+	mu        sync.Mutex
+	clock     resilience.Clock
+	target    float64
+	countShed bool
+	fastBurn  float64
+	buckets   [sloMinutes]sloBucket
+	statsd    *statsdClient
+	hooks     *webhookSender
+
+	burning bool
+	since   time.Time
+	alerts  int64
+}
+
+func newSLOTracker(clock resilience.Clock, target, fastBurn float64, countShed bool) *sloTracker {
+	return &sloTracker{clock: clock, target: target, fastBurn: fastBurn, countShed: countShed}
+}
+
+// sloCounted reports whether a route is part of the product API, the
+// thing promised available, and not a probe or an operator endpoint
+func sloCounted(route string) bool {
+	for _, v := range apiVersions {
+		if v.Prefix != "" && strings.HasPrefix(route, v.Prefix+"/") {
+			route = strings.TrimPrefix(route, v.Prefix)
+			break
+		}
+	}
+	return strings.HasPrefix(route, "/products")
+}
+
+// middleware counts each product API request once it is answered
+func (t *sloTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		info := requestInfoFrom(r)
+		if info == nil || !sloCounted(info.Route) {
+			return
+		}
+		t.record(rec.status, rec.Header().Get("X-Error-Code"))
+	})
+}
+
+func (t *sloTracker) record(status int, code string) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	minute := t.clock.Now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[minute%sloMinutes]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	switch {
+	case status < http.StatusOK:
+		// Upgraded to a WebSocket; its end says nothing
+		b.excluded++
+	case shedCodes[code]:
+		if t.countShed {
+			b.bad++
+		} else {
+			b.excluded++
+		}
+	case status >= http.StatusInternalServerError:
+		b.bad++
+	case status >= http.StatusBadRequest:
+		b.excluded++
+	default:
+		b.good++
+	}
+}
+
+// sloWindow is one window's counts as /slo reports them. Availability
+// and the burn rate are nil while nothing counted was seen.
+type sloWindow struct {
+	Good         int64    `json:"good"`
+	Bad          int64    `json:"bad"`
+	Excluded     int64    `json:"excluded"`
+	Availability *float64 `json:"availability"`
+	// BurnRate is how fast the error budget is going: 1 spends exactly
+	// the budget over the window, 14.4 spends a 30 day budget in 2 days
+	BurnRate *float64 `json:"burn_rate"`
+}
+
+// windowLocked sums the last minutes, the current one included
+func (t *sloTracker) windowLocked(now int64, minutes int) sloWindow {
+	var w sloWindow
+	for m := now; m > now-int64(minutes); m-- {
+		b := &t.buckets[m%sloMinutes]
+		if b.minute != m {
+			continue
+		}
+		w.Good += b.good
+		w.Bad += b.bad
+		w.Excluded += b.excluded
+	}
+	if total := w.Good + w.Bad; total > 0 {
+		avail := float64(w.Good) / float64(total)
+		burn := (1 - avail) / (1 - t.target)
+		w.Availability, w.BurnRate = &avail, &burn
+	}
+	return w
+}
+
+// burnRate is the burn rate over the last minutes and the requests it
+// counted, 0 while none were
+func (t *sloTracker) burnRate(minutes int) (float64, int64) {
+	now := t.clock.Now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w := t.windowLocked(now, minutes)
+	if w.BurnRate == nil {
+		return 0, 0
+	}
+	return *w.BurnRate, w.Good + w.Bad
+}
+
+// check fires or clears the fast burn alert; run calls it
+func (t *sloTracker) check() {
+	now := t.clock.Now()
+	t.mu.Lock()
+	short := t.windowLocked(now.Unix()/60, sloWindows[0].minutes)
+	long := t.windowLocked(now.Unix()/60, sloWindows[1].minutes)
+	burning := short.Good+short.Bad >= sloMinRequests &&
+		*short.BurnRate >= t.fastBurn && *long.BurnRate >= t.fastBurn
+	changed := burning != t.burning
+	if changed {
+		t.burning, t.since = burning, now
+		if burning {
+			t.alerts++
+		}
+	}
+	t.mu.Unlock()
+	if !changed {
+		return
+	}
+	data := map[string]interface{}{
+		"target":    t.target,
+		"threshold": t.fastBurn,
+		"burn_rate": map[string]*float64{sloWindows[0].name: short.BurnRate, sloWindows[1].name: long.BurnRate},
+	}
+	if burning {
+		log.Printf("SLO fast burn: error budget burning at %.1fx over %s and %.1fx over %s, threshold %.1fx",
+			*short.BurnRate, sloWindows[0].name, *long.BurnRate, sloWindows[1].name, t.fastBurn)
+		t.statsd.incr("slo.fast_burn")
+		adminErrors.record("slo", "fast burn over the threshold against the target")
+		t.hooks.notify("slo.fast_burn", data)
+		return
+	}
+	log.Println("SLO fast burn cleared")
+	t.hooks.notify("slo.recovered", data)
+}
+
+// run checks for a fast burn every sloCheckInterval; main starts it
+func (t *sloTracker) run() {
+	for {
+		time.Sleep(sloCheckInterval)
+		t.check()
+	}
+}
+
+// sloHandler reports availability against the target over each window,
+// and what is left of the longest window's error budget
+func (s *Server) sloHandler(w http.ResponseWriter, r *http.Request) {
+	t := s.slo
+	now := t.clock.Now().Unix() / 60
+	t.mu.Lock()
+	windows := make(map[string]sloWindow, len(sloWindows))
+	for _, sw := range sloWindows {
+		windows[sw.name] = t.windowLocked(now, sw.minutes)
+	}
+	burning, since, alerts := t.burning, t.since, t.alerts
+	t.mu.Unlock()
+
+	longest := windows[sloWindows[len(sloWindows)-1].name]
+	var remaining *float64
+	if longest.BurnRate != nil {
+		left := 1 - *longest.BurnRate
+		remaining = &left
+	}
+	fast := map[string]interface{}{
+		"threshold": t.fastBurn,
+		"firing":    burning,
+		"alerts":    alerts,
+	}
+	if !since.IsZero() {
+		fast["since"] = since.UTC()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"target":     t.target,
+		"count_shed": t.countShed,
+		"windows":    windows,
+		"error_budget": map[string]interface{}{
+			"window":    sloWindows[len(sloWindows)-1].name,
+			"remaining": remaining,
+		},
+		"fast_burn": fast,
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// snapshotMaxProducts is the most matches one snapshot holds. With the
+// count cap it bounds snapshot memory; larger searches are refused one.
+const snapshotMaxProducts = 10000
+
+// searchSnapshot pins a search's matches, in page order, as they were at
+// catalog generation gen. Later pages slice it instead of searching
+// again, so updates and deletes can't shift, skip or drop entries.
+// Export snapshots pin the whole catalog the same way.
+type searchSnapshot struct {
+	id       string
+	gen      int64
+	mode     string
+	checked  int
+	products []Product
+	// offsets, on export snapshots only, is where each product's line
+	// of the export ends
+	offsets []int64
+	expires time.Time
+}
+
+// page returns one page of the snapshot as a scan result, in a slice of
+// its own rather than a pooled one
+func (ss *searchSnapshot) page(page searchPage) *scanResult {
+	sr := &scanResult{matches: len(ss.products)}
+	if page.offset < len(ss.products) {
+		// Copied, since stock enrichment writes to the results
+		sr.results = append([]Product(nil), ss.products[page.offset:min(page.offset+page.limit, len(ss.products))]...)
+	}
+	return sr
+}
+
+// snapshotStore keeps at most max snapshots, each for ttl, of at most
+// maxProducts products, which callers enforce; 0 means no cap. Snapshots all
+// live as long, so creation order is expiry order and the oldest is both
+// the first to expire and the one evicted for a new one.
+type snapshotStore struct {
+	max         int
+	maxProducts int
+	ttl         time.Duration
+	clock       Clock
+
+	mu      sync.Mutex
+	byID    map[string]*searchSnapshot
+	order   []*searchSnapshot
+	created int64
+	served  int64
+	gone    int64
+	evicted int64
+	refused int64
+}
+
+func newSnapshotStore(max, maxProducts int, ttl time.Duration, clock Clock) *snapshotStore {
+	return &snapshotStore{max: max, maxProducts: maxProducts, ttl: ttl, clock: clock, byID: make(map[string]*searchSnapshot)}
+}
+
+func (st *snapshotStore) enabled() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.max > 0
+}
+
+// resize changes how many snapshots are kept, evicting the oldest beyond
+// it
+func (st *snapshotStore) resize(max int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.max = max
+	st.evictLocked(max)
+}
+
+// evictLocked drops the oldest snapshots until at most keep remain
+func (st *snapshotStore) evictLocked(keep int) {
+	for len(st.order) > keep {
+		delete(st.byID, st.order[0].id)
+		st.order[0] = nil
+		st.order = st.order[1:]
+		st.evicted++
+	}
+}
+
+// add stores a copy of products and returns the snapshot
+func (st *snapshotStore) add(gen int64, mode string, checked int, products []Product) *searchSnapshot {
+	return st.insert(&searchSnapshot{
+		gen:      gen,
+		mode:     mode,
+		checked:  checked,
+		products: append([]Product(nil), products...),
+	})
+}
+
+// insert gives ss an ID and expiry and stores it as it is
+func (st *snapshotStore) insert(ss *searchSnapshot) *searchSnapshot {
+	var b [16]byte
+	rand.Read(b[:])
+	ss.id = hex.EncodeToString(b[:])
+	ss.expires = st.clock.Now().Add(st.ttl)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+	st.evictLocked(st.max - 1)
+	st.byID[ss.id] = ss
+	st.order = append(st.order, ss)
+	st.created++
+	return ss
+}
+
+// get returns a live snapshot, or false if id expired, was evicted or
+// never existed
+func (st *snapshotStore) get(id string) (*searchSnapshot, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+	ss, ok := st.byID[id]
+	if !ok {
+		st.gone++
+		return nil, false
+	}
+	st.served++
+	return ss, true
+}
+
+func (st *snapshotStore) refuse() {
+	st.mu.Lock()
+	st.refused++
+	st.mu.Unlock()
+}
+
+// pruneLocked drops expired snapshots from the front
+func (st *snapshotStore) pruneLocked() {
+	now := st.clock.Now()
+	n := 0
+	for n < len(st.order) && !now.Before(st.order[n].expires) {
+		delete(st.byID, st.order[n].id)
+		n++
+	}
+	if n > 0 {
+		// Copy down so the backing array doesn't keep expired entries
+		st.order = append(st.order[:0:0], st.order[n:]...)
+	}
+}
+
+func (st *snapshotStore) stats() map[string]interface{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pruneLocked()
+	held := 0
+	for _, ss := range st.order {
+		held += len(ss.products)
+	}
+	return map[string]interface{}{
+		"enabled":      st.max > 0,
+		"entries":      len(st.order),
+		"max_entries":  st.max,
+		"ttl_s":        st.ttl.Seconds(),
+		"products":     held,
+		"max_products": st.maxProducts,
+		"created":      st.created,
+		"served":       st.served,
+		"gone":         st.gone,
+		"evicted":      st.evicted,
+		"refused":      st.refused,
+	}
+}
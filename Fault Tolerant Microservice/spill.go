@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Spilled search states, as the poll URL reports them
+const (
+	spillQueued  = "queued"
+	spillRunning = "running"
+	spillDone    = "done"
+	spillExpired = "expired"
+)
+
+// spillWorkers is how many queued searches run at once. Each still takes
+// a bulkhead slot like any search, so this only bounds how fast the
+// queue drains once there is room.
+const spillWorkers = 4
+
+// spillRetryInterval is how long a worker waits before retrying a queued
+// search that was shed again
+const spillRetryInterval = 250 * time.Millisecond
+
+// spillResultMax caps the finished results kept for polling, per queue
+// slot
+const spillResultMax = 4
+
+// spillReplayKey marks a queued search being run, which must not spill
+// again and doesn't count the queue against itself
+type spillReplayKey struct{}
+
+func isSpillReplay(r *http.Request) bool {
+	replay, _ := r.Context().Value(spillReplayKey{}).(bool)
+	return replay
+}
+
+// spillJob is one search accepted with 202 instead of shed. The request
+// fields are fixed when it is queued; the result fields are written once,
+// under the queue lock, when it finishes.
+type spillJob struct {
+	id        string
+	uri       string
+	header    http.Header
+	version   int
+	requestID string
+	keyName   string
+	route     string
+	features  *requestFeatures
+	callback  string
+	created   time.Time
+	deadline  time.Time
+	// search is the request as parsed when it was accepted, which the
+	// job runs rather than parsing its URI again
+	search searchRequest
+
+	state    string
+	finished time.Time
+	status   int
+	// result holds the response headers and body, replayed as they are
+	// to the poll URL
+	result *httptest.ResponseRecorder
+}
+
+// spillQueue holds searches clients chose to have answered later rather
+// than refused. It has a hard depth, and a search still queued at its
+// deadline is dropped, so under sustained overload it fills and searches
+// are shed as before; its depth counts as load for brownout and the
+// overload check meanwhile.
+type spillQueue struct {
+	// work holds the jobs no worker has taken yet. Its capacity is the
+	// queue depth, which open never exceeds, so sends never block.
+	work      chan *spillJob
+	maxAge    time.Duration
+	resultTTL time.Duration
+	hosts     map[string]bool
+	secret    string
+	callbacks chan webhookDelivery
+	statsd    *statsdClient
+
+	// waiting counts the jobs taken and not running a search at the
+	// moment, whether queued or between retries
+	waiting int32
+
+	mu    sync.Mutex
+	jobs  map[string]*spillJob
+	order []*spillJob
+	// open counts the jobs accepted and not yet finished
+	open int
+
+	accepted         int64
+	full             int64
+	completed        int64
+	expired          int64
+	callbacksSent    int64
+	callbacksDropped int64
+}
+
+func newSpillQueue(depth int, maxAge, resultTTL time.Duration, hosts []string, secret string) *spillQueue {
+	q := &spillQueue{
+		work:      make(chan *spillJob, depth),
+		maxAge:    maxAge,
+		resultTTL: resultTTL,
+		hosts:     make(map[string]bool, len(hosts)),
+		secret:    secret,
+		callbacks: make(chan webhookDelivery, depth),
+		jobs:      make(map[string]*spillJob),
+	}
+	for _, h := range hosts {
+		q.hosts[strings.ToLower(h)] = true
+	}
+	return q
+}
+
+// depth is how many accepted searches are waiting to run; those running
+// are already in flight
+func (q *spillQueue) depth() int32 {
+	if q == nil {
+		return 0
+	}
+	return atomic.LoadInt32(&q.waiting)
+}
+
+// searchLoad is the in-flight count brownout and the overload check go
+// by: searches running plus those queued to run, except for a queued one
+// itself, which would otherwise wait behind the queue it is in
+func (s *Server) searchLoad(r *http.Request) int32 {
+	load := atomic.LoadInt32(&s.inFlight)
+	if !isSpillReplay(r) {
+		load += s.spill.depth()
+	}
+	return load
+}
+
+// readSpill reads whether the client would take a 202 over being shed,
+// from Prefer: respond-async, and where to POST the result, from
+// X-Callback-URL, which must be a callback it will call. It reports false
+// for the preference when the queue is off, as Prefer allows.
+func (s *Server) readSpill(r *http.Request, errs *fieldErrors) (async bool, callback string) {
+	if s.spill == nil || isSpillReplay(r) || !preferAsync(r) {
+		return false, ""
+	}
+	callback = r.Header.Get("X-Callback-URL")
+	if callback == "" {
+		return true, ""
+	}
+	u, err := url.Parse(callback)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		errs.add("X-Callback-URL", "X-Callback-URL must be an absolute http or https URL")
+		return false, ""
+	case !s.spill.hosts[strings.ToLower(u.Host)]:
+		errs.add("X-Callback-URL", "X-Callback-URL host is not allowed; poll the Location instead")
+		return false, ""
+	}
+	return true, callback
+}
+
+func preferAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shed answers a search refused to protect the service: with 202 when
+// the client asked for it and the queue has room, with err otherwise
+func (s *Server) shed(w http.ResponseWriter, r *http.Request, req *searchRequest, err error) {
+	if req.async && s.spill.offer(w, r, req) {
+		return
+	}
+	writeErr(w, r, err)
+}
+
+// offer queues r, to run as req, and writes the 202, or reports false
+// when the queue is full
+func (q *spillQueue) offer(w http.ResponseWriter, r *http.Request, req *searchRequest) bool {
+	var b [16]byte
+	rand.Read(b[:])
+	now := time.Now()
+	job := &spillJob{
+		id:        hex.EncodeToString(b[:]),
+		uri:       r.URL.RequestURI(),
+		header:    http.Header{},
+		version:   requestAPIVersion(r),
+		requestID: requestID(r),
+		search:    *req,
+		callback:  req.callback,
+		created:   now,
+		deadline:  now.Add(q.maxAge),
+		state:     spillQueued,
+	}
+	// Run, it is shed like any search rather than queued again
+	job.search.async = false
+	for _, h := range []string{"Accept", "Accept-Language"} {
+		if v := r.Header.Get(h); v != "" {
+			job.header.Set(h, v)
+		}
+	}
+	if info := requestInfoFrom(r); info != nil {
+		job.keyName, job.route, job.features = info.KeyName, info.Route, info.Features
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.open >= cap(q.work) {
+		q.full++
+		q.statsd.incr("spill.full")
+		return false
+	}
+	q.open++
+	atomic.AddInt32(&q.waiting, 1)
+	q.work <- job
+	q.pruneLocked(now)
+	q.jobs[job.id] = job
+	q.order = append(q.order, job)
+	q.accepted++
+	q.statsd.incr("spill.accepted")
+
+	poll := apiVersions[0].Prefix
+	for _, v := range apiVersions {
+		if v.Number == job.version {
+			poll = v.Prefix
+		}
+	}
+	poll += "/products/search/jobs/" + job.id
+	w.Header().Set("Location", poll)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.Header().Set("Retry-After", "1")
+	writeJSON(w, http.StatusAccepted, q.viewLocked(job, poll))
+	return true
+}
+
+// viewLocked is what the 202 and the poll URL say about a job that hasn't
+// finished
+func (q *spillQueue) viewLocked(job *spillJob, poll string) map[string]interface{} {
+	out := map[string]interface{}{
+		"id":      job.id,
+		"state":   job.state,
+		"created": job.created.UTC(),
+		"expires": job.deadline.UTC(),
+		"poll":    poll,
+	}
+	if job.callback != "" {
+		out["callback"] = job.callback
+	}
+	return out
+}
+
+// pruneLocked forgets results kept past the result TTL, and the oldest
+// beyond spillResultMax per queue slot. Jobs finish about in the order
+// they were queued, so the oldest are at the front.
+func (q *spillQueue) pruneLocked(now time.Time) {
+	keep := spillResultMax * cap(q.work)
+	for len(q.order) > 0 {
+		job := q.order[0]
+		if job.finished.IsZero() || (len(q.order) <= keep && now.Before(job.finished.Add(q.resultTTL))) {
+			return
+		}
+		delete(q.jobs, job.id)
+		q.order[0] = nil
+		q.order = q.order[1:]
+	}
+}
+
+// runSpill is one of the spillWorkers; main starts them
+func (s *Server) runSpill() {
+	q := s.spill
+	for job := range q.work {
+		s.runSpillJob(job)
+	}
+}
+
+// runSpillJob runs job's search, again and again while it is shed, until
+// it answers or the job's deadline passes
+func (s *Server) runSpillJob(job *spillJob) {
+	q := s.spill
+	q.mu.Lock()
+	job.state = spillRunning
+	q.mu.Unlock()
+
+	ctx, cancel := context.WithDeadline(context.Background(), job.deadline)
+	defer cancel()
+	ctx = context.WithValue(ctx, spillReplayKey{}, true)
+	ctx = context.WithValue(ctx, searchRequestKey{}, &job.search)
+	ctx = context.WithValue(ctx, apiVersionKey{}, job.version)
+	ctx = context.WithValue(ctx, requestInfoKey{}, &requestInfo{RequestID: job.requestID, KeyName: job.keyName, Route: job.route, Features: job.features})
+	var rec *httptest.ResponseRecorder
+	for ctx.Err() == nil {
+		r := httptest.NewRequest(http.MethodGet, job.uri, nil).WithContext(ctx)
+		r.Header = job.header.Clone()
+		rec = httptest.NewRecorder()
+		atomic.AddInt32(&q.waiting, -1)
+		s.searchHandler(rec, r)
+		if !shedCodes[rec.Header().Get("X-Error-Code")] {
+			break
+		}
+		rec = nil
+		atomic.AddInt32(&q.waiting, 1)
+		t := time.NewTimer(spillRetryInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+
+	if rec == nil {
+		atomic.AddInt32(&q.waiting, -1)
+	}
+	q.mu.Lock()
+	q.open--
+	job.finished = time.Now()
+	// A search cut off by the deadline returns without writing anything
+	if rec == nil || (ctx.Err() != nil && rec.Body.Len() == 0) {
+		job.state = spillExpired
+		q.expired++
+	} else {
+		job.state, job.status, job.result = spillDone, rec.Code, rec
+		q.completed++
+	}
+	q.mu.Unlock()
+	s.statsd.incr("spill." + job.state)
+	if job.callback != "" {
+		q.sendCallback(job)
+	}
+}
+
+// sendCallback queues the POST of job's outcome to its callback URL,
+// signed like a webhook with X-Webhook-Signature, here keyed with
+// Config.SpillCallbackSecret. The search result is the data's body: the
+// JSON itself, or a string for CSV and NDJSON.
+func (q *spillQueue) sendCallback(job *spillJob) {
+	data := map[string]interface{}{"id": job.id, "state": job.state, "request_id": job.requestID}
+	if job.result != nil {
+		data["status"] = job.status
+		data["content_type"] = job.result.Header().Get("Content-Type")
+		body := job.result.Body.Bytes()
+		if json.Valid(body) {
+			data["body"] = json.RawMessage(body)
+		} else {
+			data["body"] = string(body)
+		}
+	}
+	event := "search." + job.state
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"service":   "productsearch",
+		"data":      data,
+	})
+	if err != nil {
+		return
+	}
+	d := webhookDelivery{target: &webhookTarget{URL: job.callback, Secret: q.secret}, event: event, body: body}
+	select {
+	case q.callbacks <- d:
+	default:
+		atomic.AddInt64(&q.callbacksDropped, 1)
+		adminErrors.record("spill", "callback for job "+job.id+" dropped: queue full")
+	}
+}
+
+// runCallbacks delivers queued callbacks with the webhook retries; main
+// starts it
+func (q *spillQueue) runCallbacks() {
+	for d := range q.callbacks {
+		d.deliver()
+		if atomic.LoadInt64(&d.target.delivered) > 0 {
+			atomic.AddInt64(&q.callbacksSent, 1)
+		}
+	}
+}
+
+// spillJobHandler answers a job's poll URL: 202 while it waits or runs,
+// then the search's own response until the result TTL passes. Jobs taken
+// with an API key are only shown to that key.
+func (s *Server) spillJobHandler(w http.ResponseWriter, r *http.Request) {
+	q := s.spill
+	if q == nil {
+		writeErr(w, r, newError(ErrNotFound, "Spill-over queue is not enabled"))
+		return
+	}
+	q.mu.Lock()
+	q.pruneLocked(time.Now())
+	job := q.jobs[pathParam(r, "id")]
+	keyName := ""
+	if info := requestInfoFrom(r); info != nil {
+		keyName = info.KeyName
+	}
+	if job == nil || job.keyName != keyName {
+		q.mu.Unlock()
+		writeErr(w, r, newError(ErrGone, "Job expired or unknown"))
+		return
+	}
+	state, result := job.state, job.result
+	var view map[string]interface{}
+	if state == spillQueued || state == spillRunning {
+		view = q.viewLocked(job, r.URL.Path)
+	}
+	q.mu.Unlock()
+
+	w.Header().Set("X-Job-State", state)
+	switch state {
+	case spillQueued, spillRunning:
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusAccepted, view)
+	case spillExpired:
+		writeErr(w, r, newError(ErrTimeout, "Search expired in the queue before there was capacity for it"))
+	default:
+		for k, v := range result.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(result.Code)
+		w.Write(result.Body.Bytes())
+	}
+}
+
+func (s *Server) spillStats() map[string]interface{} {
+	q := s.spill
+	if q == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":           true,
+		"depth":             atomic.LoadInt32(&q.waiting),
+		"open":              q.open,
+		"capacity":          cap(q.work),
+		"max_age_ms":        durationMS(q.maxAge),
+		"result_ttl_ms":     durationMS(q.resultTTL),
+		"kept":              len(q.jobs),
+		"accepted":          q.accepted,
+		"full":              q.full,
+		"completed":         q.completed,
+		"expired":           q.expired,
+		"callbacks_sent":    atomic.LoadInt64(&q.callbacksSent),
+		"callbacks_dropped": atomic.LoadInt64(&q.callbacksDropped),
+		"callback_hosts":    len(q.hosts),
+		"workers":           spillWorkers,
+	}
+}
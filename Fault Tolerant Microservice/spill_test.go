@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSpillSecret = "0123456789abcdef-spill"
+
+// newSpillTestServer queues up to depth shed searches, with callbacks
+// allowed to hosts. Nothing drains the queue until the test starts a
+// worker.
+func newSpillTestServer(t *testing.T, depth int, hosts ...string) *Server {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.SpillQueue = depth
+		cfg.SpillCallbackHosts = hosts
+		cfg.SpillCallbackSecret = testSpillSecret
+		cfg.MaxConcurrent = int32(depth)
+	})
+	t.Cleanup(func() {
+		close(s.spill.work)
+		close(s.spill.callbacks)
+	})
+	return s
+}
+
+var asyncHeader = http.Header{"Prefer": {"respond-async"}}
+
+// TestSpillCallbackHosts takes a callback only for an allowed host,
+// judged by the host the URL actually names
+func TestSpillCallbackHosts(t *testing.T) {
+	h := newSpillTestServer(t, 2, "hooks.example", "10.0.0.5:8443").Routes()
+	for _, tc := range []struct {
+		callback string
+		want     int
+	}{
+		{"", http.StatusOK},
+		{"https://hooks.example/done", http.StatusOK},
+		{"https://HOOKS.example/done", http.StatusOK},
+		{"http://10.0.0.5:8443/done", http.StatusOK},
+		{"https://evil.example/done", http.StatusBadRequest},
+		{"https://hooks.example.evil.example/done", http.StatusBadRequest},
+		{"https://hooks.example@evil.example/done", http.StatusBadRequest},
+		{"https://evil.example/#@hooks.example", http.StatusBadRequest},
+		{"https://hooks.example:8443/done", http.StatusBadRequest},
+		{"http://10.0.0.5/done", http.StatusBadRequest},
+		{"ftp://hooks.example/done", http.StatusBadRequest},
+		{"//hooks.example/done", http.StatusBadRequest},
+		{"/done", http.StatusBadRequest},
+		{"https:///done", http.StatusBadRequest},
+	} {
+		header := http.Header{"Prefer": {"respond-async"}}
+		if tc.callback != "" {
+			header.Set("X-Callback-URL", tc.callback)
+		}
+		rec := serve(h, http.MethodGet, "/products/search?q=alpha", "", header)
+		if rec.Code != tc.want {
+			t.Errorf("%q: %d, want %d: %s", tc.callback, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+// TestSpillQueueFull fills the queue while the breaker sheds everything:
+// each search up to its depth gets a 202 and a poll URL, the next the
+// 503 it would have had, and the queued ones count as load for searches
+// that didn't ask to wait
+func TestSpillQueueFull(t *testing.T) {
+	const depth = 3
+	s := newSpillTestServer(t, depth)
+	h := s.Routes()
+	s.breaker.ForceOpen()
+	var polls []string
+	for i := 0; i < depth; i++ {
+		rec := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpha", "", asyncHeader)
+		if rec.Code != http.StatusAccepted || rec.Header().Get("Location") == "" || rec.Header().Get("Preference-Applied") != "respond-async" {
+			t.Fatalf("search %d: %d %v", i, rec.Code, rec.Header())
+		}
+		polls = append(polls, rec.Header().Get("Location"))
+	}
+	rec := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpha", "", asyncHeader)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Error-Code") != codeCircuitOpen {
+		t.Errorf("search past the depth: %d %s", rec.Code, rec.Body)
+	}
+	st := s.spillStats()
+	if st["depth"] != int32(depth) || st["open"] != depth || st["accepted"] != int64(depth) || st["full"] != int64(1) {
+		t.Errorf("stats %v", st)
+	}
+
+	// With the breaker closed the queue is still load enough to shed
+	s.breaker.Reset()
+	rec = serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpha", "", nil)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Error-Code") != codeOverloaded {
+		t.Errorf("search behind a full queue: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(h, http.MethodGet, polls[0], "", nil); rec.Code != http.StatusAccepted || rec.Header().Get("X-Job-State") != spillQueued {
+		t.Errorf("poll while queued: %d %v", rec.Code, rec.Header())
+	}
+
+	// A worker drains it, and each poll URL gives its search's answer
+	go s.runSpill()
+	for _, poll := range polls {
+		var rec *httptest.ResponseRecorder
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			if rec = serve(h, http.MethodGet, poll, "", nil); rec.Code != http.StatusAccepted || time.Now().After(deadline) {
+				break
+			}
+		}
+		direct := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpha", "", nil)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Job-State") != spillDone || resultTotal(t, rec) != resultTotal(t, direct) {
+			t.Errorf("poll %s: %d %v", poll, rec.Code, rec.Header())
+		}
+	}
+	if rec := serve(h, http.MethodGet, "/v1/products/search/jobs/unknown", "", nil); rec.Code != http.StatusGone {
+		t.Errorf("unknown job: %d", rec.Code)
+	}
+}
+
+// resultTotal reads total_found from a search response
+func resultTotal(t *testing.T, rec *httptest.ResponseRecorder) int {
+	t.Helper()
+	var res struct {
+		Total int `json:"total_found"`
+		Meta  struct {
+			Total int `json:"total"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return max(res.Total, res.Meta.Total)
+}
+
+// TestSpillCallback POSTs a finished search to its callback, signed with
+// the spill secret
+func TestSpillCallback(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- r
+		bodies <- b
+	}))
+	defer hook.Close()
+	host := hook.Listener.Addr().String()
+	s := newSpillTestServer(t, 2, host)
+	h := s.Routes()
+	go s.runSpill()
+	go s.spill.runCallbacks()
+
+	s.breaker.ForceOpen()
+	header := http.Header{"Prefer": {"respond-async"}}
+	header.Set("X-Callback-URL", hook.URL+"/done")
+	if rec := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpha", "", header); rec.Code != http.StatusAccepted {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	s.breaker.Reset()
+	var r *http.Request
+	select {
+	case r = <-got:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no callback: %v", s.spillStats())
+	}
+	body := <-bodies
+	mac := hmac.New(sha256.New, []byte(testSpillSecret))
+	mac.Write(body)
+	if sig := r.Header.Get("X-Webhook-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature %q doesn't match the body", sig)
+	}
+	var payload struct {
+		Event string `json:"event"`
+		Data  struct {
+			State  string          `json:"state"`
+			Status int             `json:"status"`
+			Body   json.RawMessage `json:"body"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if r.URL.Path != "/done" || payload.Event != "search.done" || payload.Data.Status != http.StatusOK || len(payload.Data.Body) == 0 {
+		t.Errorf("callback to %s: %s", r.URL, body)
+	}
+}
+
+// TestSpillCallbacksDropWhenFull drops callbacks past the queue's depth
+// rather than block a worker
+func TestSpillCallbacksDropWhenFull(t *testing.T) {
+	const depth = 2
+	s := newSpillTestServer(t, depth, "hooks.example")
+	for i := 0; i < depth+2; i++ {
+		s.spill.sendCallback(&spillJob{id: "job", state: spillExpired, callback: "https://hooks.example/done"})
+	}
+	if st := s.spillStats(); st["callbacks_dropped"] != int64(2) || len(s.spill.callbacks) != depth {
+		t.Errorf("stats %v, %d queued", st, len(s.spill.callbacks))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxEventStreams   int32 = 100
+	eventStreamBuffer       = 256
+	eventHeartbeat          = 15 * time.Second
+)
+
+// catalogEvent is the data payload of one SSE event. Deletes carry the
+// product as it was before removal.
+type catalogEvent struct {
+	Type    string  `json:"type"`
+	Product Product `json:"product"`
+}
+
+// productEventsHandler streams catalog mutations as Server-Sent Events.
+// A client reconnecting with Last-Event-ID (or ?last_event_id= for the
+// first connection) gets the events it missed from the in-memory log, or a
+// reset event when they're no longer available and it should refetch.
+// A client that falls behind catches up from the log in the same stream,
+// or with on_overflow=disconnect has the stream closed and resumes the
+// same way when it reconnects.
+func (s *Server) productEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErr(w, r, newError(ErrInternal, "Streaming unsupported"))
+		return
+	}
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("last_event_id")
+	}
+	var lastID int64 = -1
+	if resume != "" {
+		id, err := strconv.ParseInt(resume, 10, 64)
+		if err != nil || id < 0 {
+			writeErr(w, r, invalid("Last-Event-ID", "Last-Event-ID must be a non-negative integer"))
+			return
+		}
+		lastID = id
+	}
+	policy := overflowDropOldest
+	switch r.URL.Query().Get("on_overflow") {
+	case "", "resync":
+	case "disconnect":
+		policy = overflowDisconnect
+	default:
+		writeErr(w, r, invalid("on_overflow", "on_overflow must be resync or disconnect"))
+		return
+	}
+	if atomic.AddInt32(&s.eventStreams, 1) > maxEventStreams {
+		atomic.AddInt32(&s.eventStreams, -1)
+		writeErr(w, r, s.cfg.RejectionStatus.reject(ErrOverloaded, rejectSubscribers, "Too many event subscribers"))
+		return
+	}
+	defer atomic.AddInt32(&s.eventStreams, -1)
+
+	// Subscribe before reading the log so nothing falls between the two
+	events := s.store.events
+	sub, subscribed := events.subscribe(subscriberSSE, eventStreamBuffer, policy)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	write := func(ev productEvent) error {
+		if ev.ID <= lastID {
+			return nil
+		}
+		data := catalogEvent{Type: ev.Type}
+		if ev.Product != nil {
+			data.Product = *ev.Product
+		} else if ev.Old != nil {
+			data.Product = *ev.Old
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		lastID = ev.ID
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b)
+		return err
+	}
+	// catchUp replays the log after lastID, or tells the client to refetch
+	catchUp := func() error {
+		evs, ok := events.since(lastID)
+		if !ok {
+			lastID = events.lastID()
+			_, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {\"type\":\"reset\"}\n\n", lastID)
+			return err
+		}
+		for _, ev := range evs {
+			if err := write(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if lastID >= 0 {
+		if err := catchUp(); err != nil {
+			return
+		}
+	} else {
+		lastID = subscribed
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.Gone():
+			return
+		case ev := <-sub.C:
+			// Events dropped while the buffer was full are still in the
+			// log, unless it has been trimmed since; ev comes after them,
+			// and is skipped if the catch up already sent it
+			if sub.takeOverflow() {
+				err = catchUp()
+			}
+			if err == nil {
+				err = write(ev)
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// middleware wraps a handler in one layer of cross-cutting behaviour
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// chain wraps h in layers, the first outermost, so the list reads in the
+// order a request passes through it
+func chain(h http.HandlerFunc, layers ...middleware) http.HandlerFunc {
+	for i := len(layers) - 1; i >= 0; i-- {
+		h = layers[i](h)
+	}
+	return h
+}
+
+// handlerLayer adapts an http.Handler middleware
+func handlerLayer(m func(http.Handler) http.Handler) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return m(next).ServeHTTP
+	}
+}
+
+// Route groups. Each gets its own stack below; the group is decided by
+// the path for admin and debug routes and by the role for the rest, so a
+// read that needs an admin key, like /stats/clients, is still a read.
+const (
+	groupRead  = "read"
+	groupWrite = "write"
+	groupAdmin = "admin"
+)
+
+// routeGroup places a route, given its path without the version prefix
+func routeGroup(path string, rt route) string {
+	switch {
+	case isAdminPath(path):
+		return groupAdmin
+	case rt.Role == roleWrite:
+		return groupWrite
+	}
+	return groupRead
+}
+
+// outerStack is what every request passes through, before routing.
+// Recovery is outermost so it catches panics in any layer; the request ID
+// comes next so everything after it, the access log included, can use it.
+// Response signing, when on, follows, so it signs what every inner layer
+// wrote. The backpressure hint is set before any handler can write.
+// Mirroring sits inside the access log and copies requests once answered.
+// Feature flags are resolved inside the metrics, which tag requests with
+// them. Tenant routing is innermost, so a tenant's requests pass through
+// all of it.
+func (s *Server) outerStack() []middleware {
+	layers := []middleware{recoverMiddleware, requestIDMiddleware}
+	if s.signer != nil {
+		layers = append(layers, s.signer.sign)
+	}
+	layers = append(layers,
+		handlerLayer(s.corsMiddleware),
+		handlerLayer(securityHeadersMiddleware),
+		s.backpressure.middleware,
+		handlerLayer(s.accessLogMiddleware),
+	)
+	if s.mirror != nil {
+		layers = append(layers, s.mirror.middleware)
+	}
+	layers = append(layers,
+		handlerLayer(s.metrics.middleware),
+		s.features.middleware,
+		handlerLayer(s.slo.middleware),
+		handlerLayer(recordMiddleware),
+	)
+	if s.tenants != nil {
+		layers = append(layers, s.tenants.route)
+	}
+	return layers
+}
+
+// routeStack is the one place the per route layers are ordered, outermost
+// first. In demo mode write routes and any needing an admin key are a
+// 404 and nothing else. Admin and write routes are audited first of all, so refused
+// calls are too. Admin routes check the caller's address before its key. Auth
+// runs before rate limiting so limits are keyed by the authenticated
+// key, and the per client concurrency cap sits inside the rate limit.
+// Idempotency replays, the response cache and coalescing are innermost,
+// just outside the handler, whose admission control (breaker, bulkhead,
+// overload) is the last thing before the work itself.
+//
+// A flag outside its group, say Coalesced on a write, would be dropped
+// here, so validateRoutes refuses it.
+func (s *Server) routeStack(group string, rt route) []middleware {
+	var layers []middleware
+	if s.cfg.DemoMode && demoLockedGroup(group, rt) {
+		return []middleware{demoLocked}
+	}
+	if group == groupAdmin || group == groupWrite {
+		layers = append(layers, s.audited(rt))
+	}
+	if group == groupAdmin {
+		layers = append(layers, s.requireAllowedIP)
+	}
+	role := rt.Role
+	layers = append(layers, func(next http.HandlerFunc) http.HandlerFunc { return s.requireRole(role, next) })
+	if rt.Owned && s.shards != nil {
+		layers = append(layers, s.shards.guard)
+	}
+	if group != groupAdmin && rt.RateLimited {
+		layers = append(layers, s.limiter.limit)
+		if !rt.Streaming {
+			layers = append(layers, s.concurrency.limit)
+		}
+	}
+	if group == groupWrite && rt.Idempotent {
+		layers = append(layers, s.idempotent)
+	}
+	if group == groupRead && rt.Cached {
+		layers = append(layers, s.cache)
+	}
+	if group == groupRead && rt.Coalesced {
+		layers = append(layers, s.coalesce)
+	}
+	return layers
+}
+
+// checkGroup reports route flags the route's group doesn't apply
+func checkGroup(group string, rt route) error {
+	switch {
+	case rt.RateLimited && group == groupAdmin:
+		return fmt.Errorf("admin routes are not rate limited")
+	case rt.Idempotent && group != groupWrite:
+		return fmt.Errorf("only write routes take Idempotency-Key")
+	case rt.Coalesced && group != groupRead:
+		return fmt.Errorf("only read routes are coalesced")
+	case rt.Cached && group != groupRead:
+		return fmt.Errorf("only read routes are cached")
+	}
+	return nil
+}
+
+// recoverMiddleware turns a panic into a 500, logged with the request ID
+// and kept in the admin error ring, instead of a dropped connection. An
+// http.ErrAbortHandler is re-raised, as net/http expects.
+func recoverMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			id := requestID(r)
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, id, v, debug.Stack())
+			adminErrors.record("panic", fmt.Sprintf("%s %s (request %s): %v", r.Method, r.URL.Path, id, v))
+			// If the handler had started its response this only adds to it
+			writeErr(w, r, newError(ErrInternal, "Internal server error"))
+		}()
+		next(w, r)
+	}
+}
+
+// maxRequestIDLen bounds a client supplied X-Request-Id
+const maxRequestIDLen = 64
+
+// validRequestID accepts the characters that are safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDMiddleware gives every request an ID, the caller's X-Request-Id
+// if it sent a usable one, echoes it, and attaches the requestInfo inner
+// layers fill in
+func requestIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		info := &requestInfo{RequestID: id}
+		next(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	}
+}
+
+// requestID returns the request's ID, empty outside the stack
+func requestID(r *http.Request) string {
+	if info := requestInfoFrom(r); info != nil {
+		return info.RequestID
+	}
+	return ""
+}
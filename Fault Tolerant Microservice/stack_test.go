@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	layer := func(name string) middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next(w, r)
+			}
+		}
+	}
+	h := chain(func(w http.ResponseWriter, r *http.Request) { order = append(order, "handler") }, layer("outer"), layer("inner"))
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := strings.Join(order, ","); got != "outer,inner,handler" {
+		t.Errorf("ran %s", got)
+	}
+}
+
+func TestRouteGroups(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		rt   route
+		want string
+	}{
+		{"/products/search", route{Role: roleRead}, groupRead},
+		{"/products", route{Role: roleWrite}, groupWrite},
+		{"/admin/chaos", route{Role: roleAdmin}, groupAdmin},
+		{"/stats/clients", route{Role: roleAdmin}, groupRead},
+	} {
+		if got := routeGroup(tc.path, tc.rt); got != tc.want {
+			t.Errorf("%s: group %s, want %s", tc.path, got, tc.want)
+		}
+	}
+	if checkGroup(groupWrite, route{Coalesced: true}) == nil || checkGroup(groupAdmin, route{RateLimited: true}) == nil ||
+		checkGroup(groupRead, route{Idempotent: true}) == nil || checkGroup(groupRead, route{Cached: true, Coalesced: true}) != nil {
+		t.Error("checkGroup disagrees with routeStack")
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	h := chain(func(w http.ResponseWriter, r *http.Request) { panic("boom") }, recoverMiddleware, requestIDMiddleware)
+	rec := serve(h, http.MethodGet, "/", "", http.Header{"X-Request-Id": {"req-1"}})
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("X-Request-Id") != "req-1" {
+		t.Errorf("%d with request ID %q", rec.Code, rec.Header().Get("X-Request-Id"))
+	}
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", v)
+		}
+	}()
+	serve(recoverMiddleware(func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) }), http.MethodGet, "/", "", nil)
+}
+
+func TestRequestIDs(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for sent, echoed := range map[string]bool{"abc-123_x.y:z": true, "has space": false, strings.Repeat("a", 65): false, "": false} {
+		got := serve(h, http.MethodGet, "/products/1", "", http.Header{"X-Request-Id": {sent}}).Header().Get("X-Request-Id")
+		if (got == sent) != echoed || got == "" {
+			t.Errorf("sent %q, got back %q", sent, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// stateVersion is bumped whenever savedState changes shape; files of any
+// other version are ignored
+const stateVersion = 1
+
+// maxSavedBuckets caps how many rate limit buckets are written. The
+// emptiest are kept, since those clients are the ones a reset would
+// let stampede.
+const maxSavedBuckets = 10000
+
+// savedState is what a graceful shutdown leaves for the next start, so a
+// rolling restart doesn't reset every breaker to closed and every client
+// to a full bucket
+type savedState struct {
+	Version  int                                `json:"version"`
+	SavedAt  time.Time                          `json:"saved_at"`
+	Breakers map[string]resilience.SavedBreaker `json:"breakers"`
+	// Buckets holds whole tokens left per rate limit client. Full buckets
+	// are left out, as they are no different from new ones.
+	Buckets map[string]int `json:"buckets,omitempty"`
+	// Queries are the most requested cached searches, for the warmup.
+	// Older files without them just don't warm the cache.
+	Queries []savedQuery `json:"queries,omitempty"`
+}
+
+// SaveState writes breaker and rate limit state to the state file,
+// replacing it atomically. It does nothing without a state file.
+func (s *Server) SaveState() error {
+	path := s.cfg.StateFile
+	if path == "" {
+		return nil
+	}
+	st := savedState{
+		Version:  stateVersion,
+		SavedAt:  s.clock.Now().UTC(),
+		Breakers: map[string]resilience.SavedBreaker{"search": s.breaker.Save()},
+	}
+	if s.inventory != nil {
+		for category, b := range s.inventory.breakers {
+			st.Breakers["inventory:"+category] = b.Save()
+		}
+	}
+	if s.limiter.Enabled() {
+		st.Buckets = s.limiter.SaveBuckets(maxSavedBuckets)
+	}
+	st.Queries = s.popularQueries()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Printf("Saved breaker and rate limit state to %s (%d buckets, %d searches to warm)\n", path, len(st.Buckets), len(st.Queries))
+	return nil
+}
+
+// RestoreState loads the state file if there is one and it is fresh
+// enough. A missing, corrupt, stale or mismatched file is logged and
+// ignored, leaving everything freshly initialized.
+func (s *Server) RestoreState() {
+	path := s.cfg.StateFile
+	if path == "" {
+		return
+	}
+	st, err := readState(path, s.clock.Now(), s.cfg.StateMaxAge)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Ignoring state file:", err)
+		}
+		return
+	}
+	if sb, ok := st.Breakers["search"]; ok {
+		s.breaker.Restore(sb, st.SavedAt)
+	}
+	if s.inventory != nil {
+		for category, b := range s.inventory.breakers {
+			if sb, ok := st.Breakers["inventory:"+category]; ok {
+				b.Restore(sb, st.SavedAt)
+			}
+		}
+	}
+	if s.limiter.Enabled() {
+		s.limiter.RestoreBuckets(st.Buckets, st.SavedAt)
+	}
+	s.planWarmup(st.Queries)
+	log.Printf("Restored breaker and rate limit state saved %s ago (%d buckets, %d searches to warm)\n",
+		s.clock.Since(st.SavedAt).Round(time.Second), len(st.Buckets), len(st.Queries))
+}
+
+func readState(path string, now time.Time, maxAge time.Duration) (savedState, error) {
+	var st savedState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("%s: %w", path, err)
+	}
+	if st.Version != stateVersion {
+		return st, fmt.Errorf("%s: version %d, want %d", path, st.Version, stateVersion)
+	}
+	age := now.Sub(st.SavedAt)
+	if age < 0 || age > maxAge {
+		return st, fmt.Errorf("%s: saved %s ago, older than %s or in the future", path, age.Round(time.Second), maxAge)
+	}
+	// Everything is checked before anything is restored, so a file that
+	// is wrong anywhere is ignored whole rather than half applied
+	for name, sb := range st.Breakers {
+		switch sb.State {
+		case "closed", "open", "half_open":
+		default:
+			return st, fmt.Errorf("%s: breaker %q has unknown state %q", path, name, sb.State)
+		}
+		if sb.Failures < 0 || sb.LastFailure < 0 {
+			return st, fmt.Errorf("%s: breaker %q has negative counts", path, name)
+		}
+	}
+	for key, tokens := range st.Buckets {
+		if key == "" || tokens < 0 {
+			return st, fmt.Errorf("%s: bad rate limit bucket %q: %d", path, key, tokens)
+		}
+	}
+	for _, q := range st.Queries {
+		if !validSavedPath(q.Path) || q.Count < 0 {
+			return st, fmt.Errorf("%s: bad search to warm %q", path, q.Path)
+		}
+	}
+	return st, nil
+}
+
+// validSavedPath reports whether p is a bare request path, which a
+// warmup replay can be built from
+func validSavedPath(p string) bool {
+	u, err := url.ParseRequestURI(p)
+	return err == nil && strings.HasPrefix(p, "/") && u.Path == p && u.RawQuery == "" && !strings.ContainsAny(p, " \t\r\n")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStateTestServer is a test server saving state to path, with a rate
+// limit and the response cache on so there is something of each kind to
+// restore
+func newStateTestServer(t *testing.T, path string, clock *manualClock) *Server {
+	return newTestServer(t, func(cfg *Config) {
+		cfg.Clock = clock
+		cfg.StateFile = path
+		cfg.RateLimitRPS, cfg.RateLimitBurst = 0.001, 5
+		cfg.ResponseCache = 100
+	})
+}
+
+// savedTestState saves the state of a server whose breaker is forced
+// open, whose one client has spent its bucket and which has served a
+// search worth warming, returning the file's contents
+func savedTestState(t *testing.T, path string, clock *manualClock) []byte {
+	t.Helper()
+	s := newStateTestServer(t, path, clock)
+	h := s.Routes()
+	for i := 0; i < 3; i++ {
+		serve(h, http.MethodGet, "/products/search?mode=exhaustive&q=alpha", "", nil)
+	}
+	s.breaker.ForceOpen()
+	if err := s.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestStateRoundTrip restores what a graceful shutdown saved
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	clock := newManualClock(time.Unix(1000, 0))
+	savedTestState(t, path, clock)
+	clock.Advance(time.Minute)
+
+	s := newStateTestServer(t, path, clock)
+	s.RestoreState()
+	snap := s.breaker.Snapshot()
+	if !snap.Forced || snap.RestoredFrom.IsZero() {
+		t.Errorf("breaker forced %v, restored from %v", snap.Forced, snap.RestoredFrom)
+	}
+	if buckets := s.limiter.SaveBuckets(maxSavedBuckets); buckets["ip:192.0.2.1"] != 2 {
+		t.Errorf("buckets %v, want the client's 2 tokens back", buckets)
+	}
+	if s.warmup == nil || len(s.warmup.queries) != 1 {
+		t.Errorf("warmup %+v, want the one search", s.warmup)
+	}
+}
+
+// TestStateIgnoredWhole gives startup state files that are corrupt,
+// stale or wrong in one place, and expects each ignored outright:
+// nothing restored, not even the parts that were fine
+func TestStateIgnoredWhole(t *testing.T) {
+	dir := t.TempDir()
+	clock := newManualClock(time.Unix(1000, 0))
+	good := savedTestState(t, filepath.Join(dir, "good.json"), clock)
+	edit := func(f func(st map[string]interface{})) []byte {
+		var st map[string]interface{}
+		if err := json.Unmarshal(good, &st); err != nil {
+			t.Fatal(err)
+		}
+		f(st)
+		data, err := json.Marshal(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	search := func(st map[string]interface{}) map[string]interface{} {
+		return st["breakers"].(map[string]interface{})["search"].(map[string]interface{})
+	}
+	for name, data := range map[string][]byte{
+		"empty":           {},
+		"truncated":       good[:len(good)/2],
+		"garbage":         []byte("\x00\x01not json"),
+		"trailing data":   append(append([]byte{}, good...), []byte(`{"version":1}`)...),
+		"null":            []byte("null"),
+		"array":           []byte("[]"),
+		"old version":     edit(func(st map[string]interface{}) { st["version"] = 0 }),
+		"stale":           edit(func(st map[string]interface{}) { st["saved_at"] = time.Unix(1000, 0).Add(-time.Hour) }),
+		"from the future": edit(func(st map[string]interface{}) { st["saved_at"] = time.Unix(1000, 0).Add(time.Hour) }),
+		"bad timestamp":   edit(func(st map[string]interface{}) { st["saved_at"] = "yesterday" }),
+		"unknown state":   edit(func(st map[string]interface{}) { search(st)["state"] = "ajar" }),
+		"negative count":  edit(func(st map[string]interface{}) { search(st)["failures"] = -1 }),
+		"wrong type":      edit(func(st map[string]interface{}) { search(st)["failures"] = "many" }),
+		"negative bucket": edit(func(st map[string]interface{}) {
+			st["buckets"].(map[string]interface{})["198.51.100.1"] = -3
+		}),
+		"bad warmup path": edit(func(st map[string]interface{}) {
+			st["queries"].([]interface{})[0].(map[string]interface{})["path"] = "products search"
+		}),
+		"warmup path with a query": edit(func(st map[string]interface{}) {
+			st["queries"].([]interface{})[0].(map[string]interface{})["path"] = "/products/search?q=x"
+		}),
+	} {
+		t.Run(strings.ReplaceAll(name, " ", "_"), func(t *testing.T) {
+			path := filepath.Join(dir, "state.json")
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			s := newStateTestServer(t, path, clock)
+			s.RestoreState()
+			if snap := s.breaker.Snapshot(); snap.Forced || !snap.RestoredFrom.IsZero() {
+				t.Errorf("breaker forced %v, restored from %v", snap.Forced, snap.RestoredFrom)
+			}
+			if buckets := s.limiter.SaveBuckets(maxSavedBuckets); len(buckets) != 0 {
+				t.Errorf("buckets restored: %v", buckets)
+			}
+			if s.warmup != nil {
+				t.Errorf("warmup planned from an ignored file")
+			}
+			if rec := serve(s.Routes(), http.MethodGet, "/products/search?q=alpha", "", nil); rec.Code != http.StatusOK {
+				t.Errorf("search after ignoring the file: %d", rec.Code)
+			}
+		})
+	}
+}
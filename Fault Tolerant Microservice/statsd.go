@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsdClient aggregates metrics in memory and flushes them over UDP on
+// an interval, so the request path only touches a map under a mutex. A
+// nil client is valid and drops everything, which is how emission is
+// disabled when no address is configured.
+type statsdClient struct {
+	prefix  string
+	tags    string // pre-rendered DogStatsD "|#a:b,c:d" suffix
+	conn    net.Conn
+	maxPkt  int
+	maxTime int
+
+	mu      sync.Mutex
+	counts  map[string]int64
+	timings map[string][]float64
+	nTiming int
+
+	sent    int64
+	dropped int64
+}
+
+// newStatsd dials the collector. UDP dialing doesn't need the collector to
+// be up, so this only fails on a malformed address.
+func newStatsd(addr, prefix, tags string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &statsdClient{
+		prefix:  prefix,
+		conn:    conn,
+		maxPkt:  1432,
+		maxTime: 10000,
+		counts:  make(map[string]int64),
+		timings: make(map[string][]float64),
+	}
+	if tags = strings.Trim(tags, ", "); tags != "" {
+		c.tags = "|#" + tags
+	}
+	return c, nil
+}
+
+// key renders a metric name with per call tags appended to the globals
+func (c *statsdClient) key(name string, tags []string) string {
+	if len(tags) == 0 {
+		return c.prefix + name + "|" + c.tags
+	}
+	t := c.tags
+	if t == "" {
+		t = "|#"
+	} else {
+		t += ","
+	}
+	return c.prefix + name + "|" + t + strings.Join(tags, ",")
+}
+
+// incr counts one occurrence of name
+func (c *statsdClient) incr(name string, tags ...string) {
+	if c == nil {
+		return
+	}
+	k := c.key(name, tags)
+	c.mu.Lock()
+	c.counts[k]++
+	c.mu.Unlock()
+}
+
+// timing records a duration in milliseconds. Past maxTime samples per
+// interval further samples are dropped rather than growing the buffer.
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
+	}
+	k := c.key(name, tags)
+	c.mu.Lock()
+	if c.nTiming < c.maxTime {
+		c.timings[k] = append(c.timings[k], float64(d)/float64(time.Millisecond))
+		c.nTiming++
+	}
+	c.mu.Unlock()
+}
+
+// flush sends everything buffered since the last flush. Send errors are
+// counted and otherwise ignored so an absent collector is harmless.
+func (c *statsdClient) flush() {
+	c.mu.Lock()
+	counts, timings := c.counts, c.timings
+	c.counts = make(map[string]int64, len(counts))
+	c.timings = make(map[string][]float64, len(timings))
+	c.nTiming = 0
+	c.mu.Unlock()
+
+	var lines []string
+	for k, n := range counts {
+		name, tags := splitKey(k)
+		lines = append(lines, fmt.Sprintf("%s:%d|c%s", name, n, tags))
+	}
+	for k, vals := range timings {
+		name, tags := splitKey(k)
+		for _, v := range vals {
+			lines = append(lines, fmt.Sprintf("%s:%.3f|ms%s", name, v, tags))
+		}
+	}
+	sort.Strings(lines)
+
+	var pkt strings.Builder
+	send := func() {
+		if pkt.Len() == 0 {
+			return
+		}
+		if _, err := c.conn.Write([]byte(pkt.String())); err != nil {
+			atomic.AddInt64(&c.dropped, 1)
+		} else {
+			atomic.AddInt64(&c.sent, 1)
+		}
+		pkt.Reset()
+	}
+	for _, l := range lines {
+		if pkt.Len() > 0 && pkt.Len()+1+len(l) > c.maxPkt {
+			send()
+		}
+		if pkt.Len() > 0 {
+			pkt.WriteByte('\n')
+		}
+		pkt.WriteString(l)
+	}
+	send()
+}
+
+// splitKey separates "name|tags" back into the name and statsd tag suffix
+func splitKey(k string) (string, string) {
+	i := strings.IndexByte(k, '|')
+	return k[:i], k[i+1:]
+}
+
+func (c *statsdClient) flushLoop(every time.Duration) {
+	for range time.Tick(every) {
+		c.flush()
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ProductID identifies a product. It is kept apart from int so that a
+// position, in the catalog list or a slice of candidates, can't be taken
+// for an ID, nor an ID used to index one.
+type ProductID int
+
+func (id ProductID) String() string {
+	return strconv.Itoa(int(id))
+}
+
+type Product struct {
+	ID          ProductID `json:"id"`
+	Name        string    `json:"name"`
+	Category    string    `json:"category"`
+	Description string    `json:"description"`
+	Brand       string    `json:"brand"`
+	// Price is in cents; products created without one have none
+	Price *int `json:"price,omitempty"`
+	// Names holds the name in locales other than defaultLocale
+	Names map[string]string `json:"names,omitempty"`
+	// Stock is only set on search results, from the inventory dependency
+	Stock *int `json:"stock,omitempty"`
+	// Matches is only set on search results asked for with positions=
+	Matches []matchPosition `json:"matches,omitempty"`
+}
+
+var (
+	brands     = []string{"Alpha", "Beta", "Gamma", "Delta", "Epsilon"}
+	categories = []string{"Electronics", "Books", "Home", "Outdoors", "Clothes"}
+)
+
+// storedProduct is a catalog entry with its searchable fields lowercased
+// once at write time, so matching doesn't allocate
+type storedProduct struct {
+	Product
+	lowerName     string
+	lowerCategory string
+	// lowerNames are the localized names, lowercased, by locale
+	lowerNames map[string]string
+	// The folded fields are the lowercased ones through foldText. They
+	// share memory with the lowercased ones when folding changes nothing.
+	foldedName     string
+	foldedCategory string
+	foldedNames    map[string]string
+}
+
+func newStoredProduct(p Product) storedProduct {
+	sp := storedProduct{Product: p, lowerName: strings.ToLower(p.Name), lowerCategory: strings.ToLower(p.Category),
+		lowerNames: lowerNames(p.Names)}
+	sp.foldedName, sp.foldedCategory = foldLower(sp.lowerName), foldLower(sp.lowerCategory)
+	sp.foldedNames = foldNames(sp.lowerNames)
+	return sp
+}
+
+// matches is productMatches against the precomputed fields
+func (sp *storedProduct) matches(q string) bool {
+	return q != "" && (strings.Contains(sp.lowerName, q) || strings.Contains(sp.lowerCategory, q))
+}
+
+// scanMatch is a scan's test of one product: empty if it matches the
+// query text and filters, otherwise the trace reason it doesn't
+func (sp *storedProduct) scanMatch(text searchText, brand, category string) string {
+	switch {
+	case brand != "" && !strings.EqualFold(sp.Brand, brand):
+		return traceFilteredBrand
+	case category != "" && !strings.EqualFold(sp.Category, category):
+		return traceFilteredCategory
+	case !text.price.contains(sp.Price):
+		return traceFilteredPrice
+	case !sp.matchesStock(text):
+		return traceFilteredStock
+	case !sp.matchesScopes(text):
+		return traceScopeMismatch
+	}
+	// Filters or name: scopes alone match; otherwise q must, including on
+	// index candidates, which may be false positives
+	filtered := brand != "" || category != "" || text.price.set() || text.stock.set()
+	if (text.q != "" || !(filtered || len(text.names) > 0)) && !sp.matchesText(text) {
+		return traceNoTextMatch
+	}
+	return ""
+}
+
+// searchFields are the lowercased fields the indexes cover: the
+// canonical name and category and every localized name, each as is and
+// folded
+func (sp *storedProduct) searchFields() []string {
+	fields := []string{sp.lowerName, sp.lowerCategory}
+	for _, n := range sp.lowerNames {
+		fields = append(fields, n)
+	}
+	if sp.foldedName != sp.lowerName {
+		fields = append(fields, sp.foldedName)
+	}
+	if sp.foldedCategory != sp.lowerCategory {
+		fields = append(fields, sp.foldedCategory)
+	}
+	for l, n := range sp.foldedNames {
+		if n != sp.lowerNames[l] {
+			fields = append(fields, n)
+		}
+	}
+	return fields
+}
+
+// productStore is the in-memory catalog. Every mutation is published on
+// events.
+type productStore struct {
+	// products maps ID to storedProduct
+	products sync.Map
+	// listLock guards list, pos and the secondary indexes. Lookups by ID
+	// still go straight to the products sync.Map.
+	listLock sync.RWMutex
+	// list holds the live IDs, and pos each one's position in it
+	list          []ProductID
+	pos           map[ProductID]int
+	brandIndex    postingIndex
+	categoryIndex postingIndex
+	// noBrand and noCategory are the sorted IDs the indexes leave out for
+	// having no value, for stratified sampling
+	noBrand    []ProductID
+	noCategory []ProductID
+	// vocab counts name and category tokens for suggestions
+	vocab vocabulary
+	// totals are kept with the indexes for /stats/catalog
+	totals catalogTotals
+	// trigrams is nil unless enabled, or once it went over budget
+	trigrams          *trigramIndex
+	trigramBudget     int64
+	trigramOverBudget bool
+	// trigramShed is set while the memory governor has dropped the index
+	trigramShed bool
+	// indexesPending is set from deferIndexes until installIndexes: the
+	// vocabulary and trigram index are being loaded or rebuilt, and
+	// indexLocked leaves them to that
+	indexesPending bool
+	// mutationLock serializes writers so events are published in the
+	// same order the changes were applied
+	mutationLock sync.Mutex
+	// nextID is the ID handed to the next created product
+	nextID int64
+	// owns, when set, is the IDs a shard's store holds: generate skips
+	// the others and create never hands one out
+	owns   func(id ProductID) bool
+	events *eventBus
+	// changed, if set, is called after each change is published, under
+	// mutationLock. old and new are nil for a create and a delete; moved
+	// is the product a delete swapped into the freed list position.
+	changed func(old, new, moved *storedProduct)
+	// wal, when set, logs each mutation before it is applied, and the
+	// writer waits for it to be durable before it is acknowledged
+	wal *writeAheadLog
+}
+
+// newProductStore makes an empty store whose event log, and so its change
+// journal, keeps the latest journal events
+func newProductStore(journal int) *productStore {
+	return &productStore{
+		pos:           make(map[ProductID]int),
+		brandIndex:    make(postingIndex),
+		categoryIndex: make(postingIndex),
+		vocab:         make(vocabulary),
+		events:        newEventBus(journal),
+	}
+}
+
+// generate fills the catalog with n synthetic products without publishing
+// events
+func (s *productStore) generate(n int) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	for i := 0; i < n; i++ {
+		id := ProductID(i)
+		if s.owns != nil && !s.owns(id) {
+			continue
+		}
+		p := generatedProduct(id)
+		sp := newStoredProduct(p)
+		s.products.Store(id, sp)
+		s.pos[id] = len(s.list)
+		s.list = append(s.list, id)
+		s.indexLocked(&sp)
+	}
+	atomic.StoreInt64(&s.nextID, int64(n))
+}
+
+// restore fills the catalog with a snapshot's products without
+// publishing events, as generate does
+func (s *productStore) restore(products []Product, nextID int64) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	for _, p := range products {
+		if s.owns != nil && !s.owns(p.ID) {
+			continue
+		}
+		sp := newStoredProduct(p)
+		s.products.Store(p.ID, sp)
+		s.pos[p.ID] = len(s.list)
+		s.list = append(s.list, p.ID)
+		s.indexLocked(&sp)
+	}
+	atomic.StoreInt64(&s.nextID, nextID)
+}
+
+// generatedProduct is the product generate makes with ID id
+func generatedProduct(id ProductID) Product {
+	i := int(id)
+	brand := brands[i%len(brands)]
+	// Spread over 0.99 to 500.98, unrelated to brand and category
+	price := 99 + i*7919%50000
+	return Product{
+		ID:          id,
+		Name:        fmt.Sprintf("Product %s %d", brand, i),
+		Category:    categories[i%len(categories)],
+		Description: fmt.Sprintf("Product Description %d", i),
+		Brand:       brand,
+		Price:       &price,
+		Names:       generatedNames(brand, i),
+	}
+}
+
+// generatedNames localizes some generated products: every second one in
+// German and every third in French
+func generatedNames(brand string, i int) map[string]string {
+	var names map[string]string
+	if i%2 == 0 {
+		names = map[string]string{"de": fmt.Sprintf("Produkt %s %d", brand, i)}
+	}
+	if i%3 == 0 {
+		if names == nil {
+			names = make(map[string]string, 1)
+		}
+		names["fr"] = fmt.Sprintf("Produit %s %d", brand, i)
+	}
+	return names
+}
+
+// productMatches reports whether p matches a lowercased search term.
+// Stored products use the precomputed storedProduct.matches instead.
+func productMatches(p Product, q string) bool {
+	return q != "" && (strings.Contains(strings.ToLower(p.Name), q) ||
+		strings.Contains(strings.ToLower(p.Category), q))
+}
+
+// errProductNotFound is the store's ErrNotFound
+var errProductNotFound = newError(ErrNotFound, "Product not found")
+
+// get looks up a product by ID
+func (s *productStore) get(id ProductID) (Product, bool) {
+	sp, ok := s.lookup(id)
+	return sp.Product, ok
+}
+
+// fetch is get for callers that answer with the error: ErrNotFound when
+// there is no such product
+func (s *productStore) fetch(id ProductID) (Product, error) {
+	sp, ok := s.lookup(id)
+	if !ok {
+		return Product{}, errProductNotFound
+	}
+	return sp.Product, nil
+}
+
+// lookup returns the stored entry, including its search fields
+func (s *productStore) lookup(id ProductID) (storedProduct, bool) {
+	val, ok := s.products.Load(id)
+	if !ok {
+		return storedProduct{}, false
+	}
+	return val.(storedProduct), true
+}
+
+// put inserts or replaces a product and publishes the change. An error
+// is the write-ahead log's: a change that couldn't be logged isn't made,
+// while one whose fsync failed is, but mustn't be acknowledged.
+func (s *productStore) put(p Product) (created bool, err error) {
+	s.mutationLock.Lock()
+	seq, err := s.wal.append(walRecord{op: walPut, product: p})
+	if err != nil {
+		s.mutationLock.Unlock()
+		return false, walError(err)
+	}
+	created = s.putLocked(p)
+	s.mutationLock.Unlock()
+	return created, walError(s.wal.await(seq))
+}
+
+// update replaces a product only if it still exists, returning
+// ErrNotFound if it doesn't
+func (s *productStore) update(p Product) error {
+	s.mutationLock.Lock()
+	if _, ok := s.get(p.ID); !ok {
+		s.mutationLock.Unlock()
+		return errProductNotFound
+	}
+	seq, err := s.wal.append(walRecord{op: walPut, product: p})
+	if err != nil {
+		s.mutationLock.Unlock()
+		return walError(err)
+	}
+	s.putLocked(p)
+	s.mutationLock.Unlock()
+	return walError(s.wal.await(seq))
+}
+
+func (s *productStore) putLocked(p Product) (created bool) {
+	oldSP, existed := s.lookup(p.ID)
+	old := oldSP.Product
+	sp := newStoredProduct(p)
+	s.products.Store(p.ID, sp)
+	if !existed {
+		// Keep generated IDs clear of explicitly chosen ones
+		for next := atomic.LoadInt64(&s.nextID); int64(p.ID) >= next; next = atomic.LoadInt64(&s.nextID) {
+			if atomic.CompareAndSwapInt64(&s.nextID, next, int64(p.ID)+1) {
+				break
+			}
+		}
+		s.listLock.Lock()
+		s.pos[p.ID] = len(s.list)
+		s.list = append(s.list, p.ID)
+		s.indexLocked(&sp)
+		s.listLock.Unlock()
+		s.events.publish(productEvent{Type: eventCreated, Product: &p})
+		if s.changed != nil {
+			s.changed(nil, &sp, nil)
+		}
+		return true
+	}
+	if old.Brand != p.Brand || old.Category != p.Category || old.Name != p.Name {
+		s.listLock.Lock()
+		s.unindexLocked(&oldSP)
+		s.indexLocked(&sp)
+		s.listLock.Unlock()
+	}
+	s.events.publish(productEvent{Type: eventUpdated, Product: &p, Old: &old})
+	if s.changed != nil {
+		s.changed(&oldSP, &sp, nil)
+	}
+	return false
+}
+
+// create stores p under a freshly assigned ID
+func (s *productStore) create(p Product) (Product, error) {
+	for {
+		p.ID = ProductID(atomic.AddInt64(&s.nextID, 1) - 1)
+		if s.owns == nil || s.owns(p.ID) {
+			break
+		}
+	}
+	_, err := s.put(p)
+	return p, err
+}
+
+// delete removes a product and publishes the change, returning
+// ErrNotFound if there was none
+func (s *productStore) delete(id ProductID) (Product, error) {
+	s.mutationLock.Lock()
+	oldSP, ok := s.lookup(id)
+	if !ok {
+		s.mutationLock.Unlock()
+		return Product{}, errProductNotFound
+	}
+	seq, err := s.wal.append(walRecord{op: walDelete, id: id})
+	if err != nil {
+		s.mutationLock.Unlock()
+		return Product{}, walError(err)
+	}
+	s.deleteLocked(oldSP)
+	s.mutationLock.Unlock()
+	return oldSP.Product, walError(s.wal.await(seq))
+}
+
+func (s *productStore) deleteLocked(oldSP storedProduct) {
+	id, old := oldSP.ID, oldSP.Product
+	s.products.Delete(id)
+
+	// Swap-remove so sampling stays uniform over live products
+	movedID := ProductID(-1)
+	s.listLock.Lock()
+	if pos, ok := s.pos[id]; ok {
+		last := len(s.list) - 1
+		s.list[pos] = s.list[last]
+		s.pos[s.list[pos]] = pos
+		s.list = s.list[:last]
+		delete(s.pos, id)
+		if pos < last {
+			movedID = s.list[pos]
+		}
+	}
+	s.unindexLocked(&oldSP)
+	s.listLock.Unlock()
+
+	s.events.publish(productEvent{Type: eventDeleted, Old: &old})
+	if s.changed != nil {
+		var moved *storedProduct
+		if sp, ok := s.lookup(movedID); ok {
+			moved = &sp
+		}
+		s.changed(&oldSP, nil, moved)
+	}
+}
+
+// sample picks n random product IDs (with replacement) using rnd, by
+// one of the sampleStrategies
+func (s *productStore) sample(n int, rnd *rand.Rand, strategy string) []ProductID {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+
+	switch strategy {
+	case sampleByCategory:
+		return s.sampleStratifiedLocked(n, rnd, s.categoryIndex, s.noCategory)
+	case sampleByBrand:
+		return s.sampleStratifiedLocked(n, rnd, s.brandIndex, s.noBrand)
+	}
+	n = min(n, len(s.list))
+	ids := make([]ProductID, n)
+	for i := 0; i < n; i++ {
+		ids[i] = s.list[rnd.Intn(len(s.list))]
+	}
+	return ids
+}
+
+// size returns the number of live products
+func (s *productStore) size() int {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	return len(s.list)
+}
+
+// allIDs returns every live ID in catalog order
+func (s *productStore) allIDs() []ProductID {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	return append([]ProductID(nil), s.list...)
+}
+
+// listIDs returns up to limit IDs in catalog order starting at offset,
+// along with the catalog size
+func (s *productStore) listIDs(offset, limit int) ([]ProductID, int) {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	total := len(s.list)
+	if offset >= total {
+		return nil, total
+	}
+	end := min(offset+limit, total)
+	ids := make([]ProductID, end-offset)
+	copy(ids, s.list[offset:end])
+	return ids, total
+}
+
+// scan calls fn for every live product until it returns false
+func (s *productStore) scan(fn func(*storedProduct) bool) {
+	for _, id := range s.allIDs() {
+		if sp, ok := s.lookup(id); ok && !fn(&sp) {
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestStoredProductLowercases(t *testing.T) {
+	p := Product{ID: 1, Name: "Trail LANTERN", Category: "Outdoors", Brand: "Gamma", Names: map[string]string{"de": "Wander Laterne"}}
+	sp := newStoredProduct(p)
+	if sp.lowerName != "trail lantern" || sp.lowerCategory != "outdoors" || sp.lowerNames["de"] != "wander laterne" {
+		t.Errorf("lowercased %q %q %v", sp.lowerName, sp.lowerCategory, sp.lowerNames)
+	}
+	for _, q := range []string{"lantern", "trail l", "outdoors", "door", "gamma", "laterne", "", "x"} {
+		if got, want := sp.matches(q), productMatches(p, q); got != want {
+			t.Errorf("q=%q: stored match %v, plain match %v", q, got, want)
+		}
+	}
+}
+
+func TestStoreRefreshesLowercaseOnUpdate(t *testing.T) {
+	s := newTestServer(t, nil)
+	p, _ := s.store.get(7)
+	p.Name = "Renamed LAMP"
+	if err := s.store.update(p); err != nil {
+		t.Fatal(err)
+	}
+	sp, ok := s.store.lookup(7)
+	if !ok || sp.lowerName != "renamed lamp" || !sp.matches("lamp") || sp.matches("product") {
+		t.Errorf("after the rename: %q", sp.lowerName)
+	}
+}
+
+func TestSortedIDLists(t *testing.T) {
+	var ids []ProductID
+	for _, id := range []ProductID{5, 1, 9, 5, 3} {
+		ids, _ = insertID(ids, id)
+	}
+	if !equalIDs(ids, []ProductID{1, 3, 5, 9}) {
+		t.Fatalf("inserted into %v", ids)
+	}
+	if _, added := insertID(ids, 3); added {
+		t.Errorf("3 was added twice")
+	}
+	ids, removed := removeID(ids, 5)
+	if _, again := removeID(ids, 5); !removed || again || !equalIDs(ids, []ProductID{1, 3, 9}) {
+		t.Errorf("removing 5 left %v", ids)
+	}
+	if got := intersect(ids, []ProductID{0, 3, 4, 9, 12}); !equalIDs(got, []ProductID{3, 9}) {
+		t.Errorf("intersected to %v", got)
+	}
+}
+
+// TestProductIDOutput checks a ProductID is written as the plain number
+// it was before it had a type of its own
+func TestProductIDOutput(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	if rec := serve(h, http.MethodGet, "/v1/products/42", "", nil); !strings.HasPrefix(rec.Body.String(), `{"id":42,`) {
+		t.Errorf("GET /v1/products/42: %s", rec.Body)
+	}
+	rec := serve(h, http.MethodGet, "/products/search?mode=exhaustive&sort=id&q=beta+96&format=csv&fields=id,name", "", nil)
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 2 || lines[1] != "96,Product Beta 96" {
+		t.Errorf("CSV search: %q", rec.Body)
+	}
+}
+
+// TestDeleteThenSearch deletes products over HTTP, moving others in the
+// catalog list, then checks each search result is the live product by
+// its own ID
+func TestDeleteThenSearch(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	for id := 0; id < testProducts; id += 9 {
+		if rec := serve(h, http.MethodDelete, "/v1/products/"+strconv.Itoa(id), "", nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("DELETE product %d: %d %s", id, rec.Code, rec.Body)
+		}
+	}
+	for _, target := range []string{"/products/search?mode=exhaustive&q=product&limit=20&offset=60", "/products/search?q=product&limit=20"} {
+		for _, p := range search(t, h, target).Products {
+			live, ok := s.store.get(p.ID)
+			if p.ID%9 == 0 || !ok || live.Name != p.Name {
+				t.Errorf("%s returned product %d %q, not the live product by that ID", target, p.ID, p.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// streamTruncatedTrailer is sent as a trailer on a chunked stream cut at
+// Config.MaxStreamDuration. A stream with a Content-Length, such as an
+// export snapshot, just ends short and is resumed with a Range.
+const streamTruncatedTrailer = "X-Stream-Truncated"
+
+// errStreamTooLong ends a stream that ran past Config.MaxStreamDuration
+var errStreamTooLong = errors.New("stream: maximum duration reached")
+
+// streamStats count streamed responses for /stats
+type streamStats struct {
+	started       int64
+	completed     int64
+	slowConsumers int64
+	durationCuts  int64
+}
+
+// streamWriter is what CSV, NDJSON and export bodies are written through.
+// Every write gets its own deadline, Config.StreamWriteTimeout out, so a
+// consumer that stops reading fails the write instead of parking the
+// handler, and with it whatever the handler holds, such as a search's
+// bulkhead slot. The stream as a whole is cut at Config.MaxStreamDuration
+// however fast it goes. Deadlines are on the connection, so real time.
+type streamWriter struct {
+	http.ResponseWriter
+	s     *Server
+	r     *http.Request
+	rc    *http.ResponseController
+	start time.Time
+	// end is when the stream is cut, zero for no cap
+	end time.Time
+	// deadlines is cleared when the writer turns out not to support them,
+	// as for a recorded response that is copied out afterwards
+	deadlines bool
+	err       error
+	bytes     int64
+}
+
+// newStream starts a streamed response; finish it once the body is done.
+// Called before the header is written it announces the truncation
+// trailer, unless the response has a Content-Length.
+func (s *Server) newStream(w http.ResponseWriter, r *http.Request) *streamWriter {
+	atomic.AddInt64(&s.streams.started, 1)
+	sw := &streamWriter{ResponseWriter: w, s: s, r: r, rc: http.NewResponseController(w), start: time.Now(), deadlines: s.cfg.StreamWriteTimeout > 0}
+	if s.cfg.MaxStreamDuration > 0 {
+		sw.end = sw.start.Add(s.cfg.MaxStreamDuration)
+		if w.Header().Get("Content-Length") == "" {
+			w.Header().Set("Trailer", streamTruncatedTrailer)
+		}
+	}
+	return sw
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	now := time.Now()
+	if sw.expired(now) {
+		sw.err = errStreamTooLong
+		return 0, sw.err
+	}
+	if sw.deadlines {
+		deadline := now.Add(sw.s.cfg.StreamWriteTimeout)
+		if !sw.end.IsZero() && sw.end.Before(deadline) {
+			deadline = sw.end
+		}
+		sw.deadlines = sw.rc.SetWriteDeadline(deadline) == nil
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	if err != nil {
+		sw.err = err
+		// A write still blocked when the stream's time ran out was cut by
+		// the cap, not by a slow consumer
+		if sw.expired(time.Now()) {
+			sw.err = errStreamTooLong
+		}
+	}
+	return n, err
+}
+
+// Flush sends what the server has buffered, under the last write's
+// deadline
+func (sw *streamWriter) Flush() {
+	if sw.err == nil {
+		sw.rc.Flush()
+	}
+}
+
+func (sw *streamWriter) expired(now time.Time) bool {
+	return !sw.end.IsZero() && !now.Before(sw.end)
+}
+
+// finish records how the stream ended and clears the deadline, which
+// would otherwise outlive the response on a kept-alive connection. A
+// write that stalled past its deadline is logged as a slow consumer; the
+// connection is closed after the handler returns.
+func (sw *streamWriter) finish() {
+	s := sw.s
+	if sw.deadlines {
+		sw.rc.SetWriteDeadline(time.Time{})
+	}
+	switch {
+	case sw.err == nil:
+		atomic.AddInt64(&s.streams.completed, 1)
+	case errors.Is(sw.err, errStreamTooLong):
+		atomic.AddInt64(&s.streams.durationCuts, 1)
+		sw.Header().Set(streamTruncatedTrailer, "max_duration")
+		sw.s.statsd.incr("stream.aborted", "reason:max_duration")
+		log.Printf("Stream %s cut at the %s maximum after %d bytes (request %s)", sw.r.URL.Path, s.cfg.MaxStreamDuration, sw.bytes, requestID(sw.r))
+	case errors.Is(sw.err, os.ErrDeadlineExceeded):
+		atomic.AddInt64(&s.streams.slowConsumers, 1)
+		sw.s.statsd.incr("stream.aborted", "reason:slow_consumer")
+		msg := "Slow consumer on " + sw.r.URL.Path + ": a write stalled over " + s.cfg.StreamWriteTimeout.String()
+		adminErrors.record("stream", msg)
+		log.Printf("%s after %d bytes in %s, stream aborted (request %s): %v", msg, sw.bytes, time.Since(sw.start).Round(time.Millisecond), requestID(sw.r), sw.err)
+	default:
+		// The client hung up, which isn't reading slowly
+	}
+}
+
+func (s *Server) streamStats() map[string]interface{} {
+	return map[string]interface{}{
+		"write_timeout_ms":  durationMS(s.cfg.StreamWriteTimeout),
+		"max_duration_ms":   durationMS(s.cfg.MaxStreamDuration),
+		"started":           atomic.LoadInt64(&s.streams.started),
+		"completed":         atomic.LoadInt64(&s.streams.completed),
+		"slow_consumers":    atomic.LoadInt64(&s.streams.slowConsumers),
+		"max_duration_cuts": atomic.LoadInt64(&s.streams.durationCuts),
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallWriter is a connection whose client has stopped reading: once
+// stallAfter bytes are through, a write blocks until its deadline
+type stallWriter struct {
+	*httptest.ResponseRecorder
+	stallAfter int
+	deadline   time.Time
+}
+
+func (w *stallWriter) SetWriteDeadline(t time.Time) error {
+	w.deadline = t
+	return nil
+}
+
+func (w *stallWriter) Write(b []byte) (int, error) {
+	if w.Body.Len()+len(b) <= w.stallAfter {
+		return w.ResponseRecorder.Write(b)
+	}
+	if !w.deadline.IsZero() {
+		time.Sleep(time.Until(w.deadline))
+	}
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	rec := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&sort=id&q=alpha&limit=3&format=ndjson&select=id,name", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	sc := bufio.NewScanner(rec.Body)
+	var ids []ProductID
+	for sc.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		if len(line) != 2 || line["name"] == nil {
+			t.Errorf("line %s, want only id and name", sc.Text())
+		}
+		ids = append(ids, ProductID(line["id"].(float64)))
+	}
+	if !equalIDs(ids, []ProductID{0, 5, 10}) {
+		t.Errorf("streamed %v", ids)
+	}
+}
+
+// TestStreamSlowConsumer checks a write that stalls past its deadline
+// aborts the stream, counted as a slow consumer rather than a cut
+func TestStreamSlowConsumer(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.StreamWriteTimeout = 20 * time.Millisecond })
+	w := &stallWriter{ResponseRecorder: httptest.NewRecorder(), stallAfter: 100}
+	start := time.Now()
+	i := ProductID(0)
+	s.writeStream(w, httptest.NewRequest(http.MethodGet, "/v1/products?format=ndjson", nil), &streamFormat{NDJSON: true}, "products", func() (Product, bool) {
+		i++
+		return generatedProduct(i), i < testProducts
+	})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the stalled stream took %s to give up", d)
+	}
+	st := s.streamStats()
+	if st["slow_consumers"] != int64(1) || st["completed"] != int64(0) || st["max_duration_cuts"] != int64(0) {
+		t.Errorf("stream stats %v, want one slow consumer", st)
+	}
+}
+
+// TestStreamMaxDuration checks a stream is cut at the cap however fast
+// it goes, and says so in its trailer
+func TestStreamMaxDuration(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.MaxStreamDuration = 20 * time.Millisecond })
+	rec := httptest.NewRecorder()
+	sw := s.newStream(rec, httptest.NewRequest(http.MethodGet, "/v1/products?format=ndjson", nil))
+	if rec.Header().Get("Trailer") != streamTruncatedTrailer {
+		t.Errorf("Trailer %q, want %s announced", rec.Header().Get("Trailer"), streamTruncatedTrailer)
+	}
+	if _, err := sw.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := sw.Write([]byte("late\n")); err != errStreamTooLong {
+		t.Errorf("a write past the cap: %v", err)
+	}
+	sw.finish()
+	if rec.Header().Get(streamTruncatedTrailer) != "max_duration" || strings.Contains(rec.Body.String(), "late") {
+		t.Errorf("trailer %q, body %q", rec.Header().Get(streamTruncatedTrailer), rec.Body)
+	}
+	if st := s.streamStats(); st["max_duration_cuts"] != int64(1) {
+		t.Errorf("stream stats %v, want one cut", st)
+	}
+}
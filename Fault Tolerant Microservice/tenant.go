@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// tenantHeader selects a tenant; so does a /t/{tenant} path prefix
+const tenantHeader = "X-Tenant-Id"
+
+// maxTenantIDLen bounds a tenant ID, which is logged and a /stats key
+const maxTenantIDLen = 32
+
+// tenantSpec is one entry of the -tenants-file. Zero fields take the
+// deployment's values, Config.TenantProducts for the catalog size.
+type tenantSpec struct {
+	ID             string  `json:"id"`
+	Products       int     `json:"products"`
+	Bulkhead       int     `json:"bulkhead"`
+	RateLimitRPS   float64 `json:"rate_limit_rps"`
+	RateLimitBurst int     `json:"rate_limit_burst"`
+}
+
+// tenant is one provisioned tenant. It is built once, on first use;
+// ready is set once srv is.
+type tenant struct {
+	spec        tenantSpec
+	provisioned bool
+	once        sync.Once
+	srv         *Server
+	err         error
+	ready       int32
+}
+
+// tenantRouter gives every tenant a Server of its own, so its catalog,
+// caches, snapshots, breaker, bulkhead and rate limiter are its own and a
+// tenant can only use up its own budgets. Requests naming no tenant go to
+// the base server. The outer stack (request IDs, signing, access log,
+// route metrics and the SLO) is the base server's and runs once for every
+// tenant.
+type tenantRouter struct {
+	base *Server
+	auto bool
+	// guard caps the tenants at Config.TenantMax; auto provisioning past
+	// it is overflow
+	guard *keyGuard
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+	order   []string
+	refused int64
+}
+
+func validTenantID(id string) bool {
+	if id == "" || len(id) > maxTenantIDLen {
+		return false
+	}
+	for i, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || i > 0 && (c == '-' || c == '_')) {
+			return false
+		}
+	}
+	return true
+}
+
+func readTenantSpecs(file string) ([]tenantSpec, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var specs []tenantSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	seen := make(map[string]bool, len(specs))
+	for _, sp := range specs {
+		switch {
+		case !validTenantID(sp.ID):
+			return nil, fmt.Errorf("%s: tenant %q: IDs are lowercase letters, digits, - and _, at most %d", file, sp.ID, maxTenantIDLen)
+		case seen[sp.ID]:
+			return nil, fmt.Errorf("%s: tenant %q listed twice", file, sp.ID)
+		case sp.Products < 0 || sp.Bulkhead < 0 || sp.RateLimitRPS < 0 || sp.RateLimitBurst < 0:
+			return nil, fmt.Errorf("%s: tenant %q: limits can't be negative", file, sp.ID)
+		}
+		seen[sp.ID] = true
+	}
+	return specs, nil
+}
+
+// newTenantRouter returns nil when there are no tenants to serve: none
+// listed and none auto provisioned
+func newTenantRouter(base *Server) (*tenantRouter, error) {
+	cfg := base.cfg
+	specs, err := readTenantSpecs(cfg.TenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 && !cfg.TenantAutoProvision {
+		return nil, nil
+	}
+	if cfg.TenantMax < len(specs) {
+		return nil, fmt.Errorf("tenants: %d listed, more than the tenant limit of %d", len(specs), cfg.TenantMax)
+	}
+	tr := &tenantRouter{base: base, auto: cfg.TenantAutoProvision, guard: newKeyGuard(cfg.TenantMax, maxTenantIDLen), tenants: make(map[string]*tenant)}
+	for _, sp := range specs {
+		tr.tenants[sp.ID] = &tenant{spec: sp}
+		tr.order = append(tr.order, sp.ID)
+	}
+	return tr, nil
+}
+
+// tenantConfig is the base configuration with the spec's limits, and
+// without what only one instance-wide server may run: persistence, the
+// index file, the cache warmup, the watchdog, the memory governor,
+// signing and the spill-over queue
+func (tr *tenantRouter) tenantConfig(sp tenantSpec) Config {
+	cfg := tr.base.cfg
+	cfg.NumProducts = cfg.TenantProducts
+	if sp.Products > 0 {
+		cfg.NumProducts = sp.Products
+	}
+	if sp.Bulkhead > 0 {
+		cfg.BulkheadSize, cfg.MaxConcurrent = sp.Bulkhead, int32(sp.Bulkhead)
+	}
+	if sp.RateLimitRPS > 0 {
+		cfg.RateLimitRPS = sp.RateLimitRPS
+	}
+	if sp.RateLimitBurst > 0 {
+		cfg.RateLimitBurst = sp.RateLimitBurst
+	}
+	// Shared buckets are the tenant's own, like the local ones
+	cfg.RateLimitRedisPrefix += "t:" + sp.ID + ":"
+	cfg.StateFile, cfg.CacheWarmup, cfg.IndexFile = "", 0, ""
+	cfg.WALFile, cfg.CatalogSnapshotFile = "", ""
+	cfg.MirrorURL = ""
+	cfg.WatchdogDir, cfg.DiskCheckPath = "", ""
+	cfg.MemorySoftLimit = 0
+	cfg.SigningKeysFile = ""
+	cfg.SpillQueue = 0
+	cfg.TenantsFile, cfg.TenantAutoProvision = "", false
+	cfg.LocalShards = 0
+	return cfg
+}
+
+// server returns the tenant's server, building it on first use. It
+// returns nil for a tenant that isn't listed and can't be provisioned.
+func (tr *tenantRouter) server(id string) (*Server, error) {
+	tr.mu.Lock()
+	t := tr.tenants[id]
+	if t == nil {
+		if !tr.auto || !tr.guard.admit(len(tr.tenants)) {
+			tr.refused++
+			tr.mu.Unlock()
+			return nil, nil
+		}
+		t = &tenant{spec: tenantSpec{ID: id}, provisioned: true}
+		tr.tenants[id] = t
+		tr.order = append(tr.order, id)
+	}
+	tr.mu.Unlock()
+
+	t.once.Do(func() {
+		start := time.Now()
+		if t.srv, t.err = NewServer(tr.tenantConfig(t.spec)); t.err != nil {
+			log.Printf("Tenant %s: %v", id, t.err)
+			return
+		}
+		t.srv.tenant = id
+		t.srv.LoadCatalog()
+		if t.srv.limiter.Enabled() {
+			go t.srv.limiter.SweepLoop(context.Background(), time.Minute)
+		}
+		if t.srv.backpressure.enabled() {
+			go t.srv.backpressure.run(t.srv)
+		}
+		atomic.StoreInt32(&t.ready, 1)
+		log.Printf("Tenant %s ready in %s", id, time.Since(start).Round(time.Millisecond))
+	})
+	return t.srv, t.err
+}
+
+// each calls fn with every tenant server built so far
+func (tr *tenantRouter) each(fn func(*Server)) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	ts := make([]*tenant, 0, len(tr.order))
+	for _, id := range tr.order {
+		ts = append(ts, tr.tenants[id])
+	}
+	tr.mu.Unlock()
+	for _, t := range ts {
+		if srv := t.built(); srv != nil {
+			fn(srv)
+		}
+	}
+}
+
+// built returns the tenant's server, nil until it is ready
+func (t *tenant) built() *Server {
+	if atomic.LoadInt32(&t.ready) == 0 {
+		return nil
+	}
+	return t.srv
+}
+
+// route is the last outer layer. A request naming a tenant, by header or
+// by a /t/{tenant} prefix, which is stripped, is served by that tenant's
+// routes; any other goes on to the base server's. Links in responses are
+// relative to the tenant, so clients using the prefix add it back.
+func (tr *tenantRouter) route(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(tenantHeader)
+		if rest := strings.TrimPrefix(r.URL.Path, "/t/"); rest != r.URL.Path {
+			prefixed, path, _ := strings.Cut(rest, "/")
+			if id != "" && id != prefixed {
+				writeErr(w, r, invalid(tenantHeader, tenantHeader+" and the /t/ prefix name different tenants"))
+				return
+			}
+			id = prefixed
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path, u.RawPath = "/"+path, ""
+			r2.URL = &u
+			r = r2
+		}
+		if id == "" {
+			next(w, r)
+			return
+		}
+		if !validTenantID(id) {
+			writeErr(w, r, invalid(tenantHeader, fmt.Sprintf("tenant IDs are lowercase letters, digits, - and _, at most %d", maxTenantIDLen)))
+			return
+		}
+		srv, err := tr.server(id)
+		switch {
+		case err != nil:
+			writeErr(w, r, newError(ErrInternal, "Tenant could not be provisioned"))
+		case srv == nil:
+			writeErr(w, r, newError(ErrNotFound, "Unknown tenant"))
+		default:
+			srv.backpressure.hint(w, r)
+			srv.mux.ServeHTTP(w, r)
+		}
+	}
+}
+
+// stats breaks the key counters down by tenant. Tenants are capped at
+// Config.TenantMax, which bounds the breakdown too.
+func (tr *tenantRouter) stats() map[string]interface{} {
+	if tr == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	tr.mu.Lock()
+	ts := make(map[string]*tenant, len(tr.tenants))
+	for id, t := range tr.tenants {
+		ts[id] = t
+	}
+	refused := tr.refused
+	tr.mu.Unlock()
+	byTenant := make(map[string]interface{}, len(ts))
+	for id, t := range ts {
+		srv := t.built()
+		if srv == nil {
+			byTenant[id] = map[string]interface{}{"ready": false, "auto_provisioned": t.provisioned}
+			continue
+		}
+		byTenant[id] = map[string]interface{}{
+			"ready":            true,
+			"auto_provisioned": t.provisioned,
+			"products":         srv.store.size(),
+			"requests":         atomic.LoadInt64(&srv.stats.requests),
+			"rejected": map[string]int64{
+				"circuit_open": atomic.LoadInt64(&srv.stats.rejectedCircuit),
+				"bulkhead":     atomic.LoadInt64(&srv.stats.rejectedBulkhead),
+				"overload":     atomic.LoadInt64(&srv.stats.rejectedOverload),
+				"rate_limited": atomic.LoadInt64(&srv.limiter.rejected),
+			},
+			"in_flight":     atomic.LoadInt32(&srv.inFlight),
+			"bulkhead_size": srv.cfg.BulkheadSize,
+			"circuit":       resilience.StateName(srv.breaker.State()),
+		}
+	}
+	return map[string]interface{}{
+		"enabled":        true,
+		"auto_provision": tr.auto,
+		"max":            tr.guard.max,
+		"refused":        refused,
+		"tenants":        byTenant,
+	}
+}
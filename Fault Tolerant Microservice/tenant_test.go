@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTenantWritesIsolated creates a product as one tenant: that tenant
+// finds it by header and by prefix, another tenant and the instance's own
+// catalog don't
+func TestTenantWritesIsolated(t *testing.T) {
+	h := newTestServer(t, func(cfg *Config) {
+		cfg.TenantAutoProvision = true
+		cfg.TenantProducts = testProducts
+	}).Routes()
+	header := http.Header{"Content-Type": {"application/json"}}
+	header.Set(tenantHeader, "team-a")
+	if rec := serve(h, http.MethodPost, "/products", `{"name":"Zyzzyva Lamp","category":"Home","brand":"Delta","description":"d"}`, header); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"/t/team-a/products/search?mode=exhaustive&q=zyzzyva", 1},
+		{"/t/team-b/products/search?mode=exhaustive&q=zyzzyva", 0},
+		{"/products/search?mode=exhaustive&q=zyzzyva", 0},
+	} {
+		if res := search(t, h, tc.target); res.TotalFound != tc.want {
+			t.Errorf("%s found %d, want %d", tc.target, res.TotalFound, tc.want)
+		}
+	}
+	for id, want := range map[string]int{"team-a": 1, "team-b": 0} {
+		rec := serve(h, http.MethodGet, "/products/search?mode=exhaustive&q=zyzzyva", "", http.Header{"X-Tenant-Id": {id}})
+		if rec.Code != http.StatusOK || resultTotal(t, rec) != want {
+			t.Errorf("%s by header: %d, found %s", id, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(h, http.MethodGet, "/t/team-a/products/search?q=x", "", http.Header{"X-Tenant-Id": {"team-b"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("header and prefix disagreeing: %d", rec.Code)
+	}
+}
+
+// TestTenantUnlisted answers 404 for a tenant not in the file when tenants
+// aren't provisioned on first use
+func TestTenantUnlisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, []byte(`[{"id":"team-a","products":10}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, func(cfg *Config) { cfg.TenantsFile = path }).Routes()
+	if res := search(t, h, "/t/team-a/products/search?mode=exhaustive&q=product"); res.TotalFound != 10 {
+		t.Errorf("listed tenant found %d, want its 10", res.TotalFound)
+	}
+	for target, want := range map[string]int{
+		"/t/team-b/products/search?q=x": http.StatusNotFound,
+		"/t/Team-A/products/search?q=x": http.StatusBadRequest,
+	} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != want {
+			t.Errorf("%s: %d, want %d", target, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// timingsResponse is the part of a search response timings show in
+type timingsResponse struct {
+	SearchTime   string         `json:"search_time"`
+	SearchTimeMS *float64       `json:"search_time_ms"`
+	Timings      *searchTimings `json:"timings_ms"`
+}
+
+// pendingTimers counts the timers waiting on c
+func pendingTimers(c *manualClock) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// serveDelayed serves a search while chaos latency holds it, advancing
+// clock by the delay once the search is waiting on it
+func serveDelayed(t *testing.T, h http.Handler, clock *manualClock, target string, delay time.Duration) *httptest.ResponseRecorder {
+	t.Helper()
+	before := pendingTimers(clock)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(h, http.MethodGet, target, "", nil) }()
+	for deadline := time.Now().Add(5 * time.Second); pendingTimers(clock) == before; runtime.Gosched() {
+		if time.Now().After(deadline) {
+			t.Fatal("the search never waited on the chaos delay")
+		}
+	}
+	clock.Advance(delay)
+	return <-done
+}
+
+// TestSearchTimings holds a search on the manual clock for exactly the
+// chaos delay, so every timing is known: the delay in the chaos phase
+// and the total, nothing in the others
+func TestSearchTimings(t *testing.T) {
+	const delay = 250 * time.Millisecond
+	clock := newManualClock(time.Unix(0, 0))
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Clock = clock
+		cfg.ResponseCache = 0
+		cfg.ResponseEnvelope = false
+	})
+	s.chaos.SetDelay(delay)
+	h := s.Routes()
+
+	rec := serveDelayed(t, h, clock, "/v1/products/search?debug=1&q=product", delay)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	var got timingsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SearchTimeMS == nil || *got.SearchTimeMS != 250 || got.SearchTime != "" {
+		t.Errorf("search_time_ms %v, search_time %q; want 250 and no string", got.SearchTimeMS, got.SearchTime)
+	}
+	if want := (searchTimings{Chaos: 250}); got.Timings == nil || *got.Timings != want {
+		t.Errorf("timings %+v, want %+v", got.Timings, want)
+	}
+	if st, want := rec.Header().Get("Server-Timing"), "admission;dur=0, scan;dur=0, chaos;dur=250, inventory;dur=0, encode;dur=0"; st != want {
+		t.Errorf("Server-Timing %q, want %q", st, want)
+	}
+
+	// Phases are debug only, and the legacy route keeps its string
+	rec = serveDelayed(t, h, clock, "/v1/products/search?q=product", delay)
+	got = timingsResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if got.SearchTimeMS == nil || *got.SearchTimeMS != 250 || got.Timings != nil || rec.Header().Get("Server-Timing") != "" {
+		t.Errorf("without debug: search_time_ms %v, timings %+v, Server-Timing %q", got.SearchTimeMS, got.Timings, rec.Header().Get("Server-Timing"))
+	}
+	rec = serveDelayed(t, h, clock, "/products/search?debug=1&q=product", delay)
+	got = timingsResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if got.SearchTime != "0.2500s" || got.SearchTimeMS != nil || got.Timings != nil {
+		t.Errorf("legacy: search_time %q, search_time_ms %v, timings %+v", got.SearchTime, got.SearchTimeMS, got.Timings)
+	}
+}
+
+// steppingClock moves a millisecond every time it is read
+type steppingClock struct{ *manualClock }
+
+func (c steppingClock) Now() time.Time {
+	c.Advance(time.Millisecond)
+	return c.manualClock.Now()
+}
+
+func (c steppingClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// TestSearchTimingsDeterministic reports every timing as zero in
+// deterministic mode, however far the clock has moved
+func TestSearchTimingsDeterministic(t *testing.T) {
+	clock := steppingClock{newManualClock(time.Unix(0, 0))}
+	for _, deterministic := range []bool{false, true} {
+		h := newTestServer(t, func(cfg *Config) {
+			cfg.Clock = clock
+			cfg.Deterministic = deterministic
+			cfg.ResponseEnvelope = false
+		}).Routes()
+		rec := serve(h, http.MethodGet, "/v1/products/search?debug=1&q=product", "", nil)
+		var got timingsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.SearchTimeMS == nil || got.Timings == nil {
+			t.Fatalf("deterministic %v: %d %s", deterministic, rec.Code, rec.Body)
+		}
+		zero := *got.SearchTimeMS == 0 && *got.Timings == searchTimings{}
+		if zero != deterministic {
+			t.Errorf("deterministic %v: search_time_ms %g, timings %+v", deterministic, *got.SearchTimeMS, *got.Timings)
+		}
+		rec = serve(h, http.MethodGet, "/products/search?q=product", "", nil)
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		if deterministic && got.SearchTime != "0.0000s" {
+			t.Errorf("deterministic legacy search_time %q", got.SearchTime)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "container/heap"
+
+// topN keeps the first n products seen in a sort order. It is a heap with
+// the last kept product at the root, so each offer costs O(log n) and a
+// sorted page holds n products rather than every match. Nothing here
+// needs every match kept: totals are counted as the scan goes.
+type topN struct {
+	by string
+	n  int
+	ps []Product
+}
+
+func (t *topN) Len() int           { return len(t.ps) }
+func (t *topN) Less(i, j int) bool { return productLess(&t.ps[j], &t.ps[i], t.by) }
+func (t *topN) Swap(i, j int)      { t.ps[i], t.ps[j] = t.ps[j], t.ps[i] }
+func (t *topN) Push(x interface{}) { t.ps = append(t.ps, x.(Product)) }
+func (t *topN) Pop() interface{} {
+	last := t.ps[len(t.ps)-1]
+	t.ps[len(t.ps)-1] = Product{}
+	t.ps = t.ps[:len(t.ps)-1]
+	return last
+}
+
+// offer keeps p if it sorts before the last product kept. It appends and
+// fixes up rather than calling heap.Push, which would box p.
+func (t *topN) offer(p Product) {
+	if len(t.ps) < t.n {
+		t.ps = append(t.ps, p)
+		heap.Fix(t, len(t.ps)-1)
+		return
+	}
+	if t.n > 0 && productLess(&p, &t.ps[0], t.by) {
+		t.ps[0] = p
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted orders the kept products and returns them, first first
+func (t *topN) sorted() []Product {
+	sortProducts(t.ps, t.by)
+	return t.ps
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// TestTopNMatchesFullSort offers shuffled products and checks the kept
+// page is the head of a full sort
+func TestTopNMatchesFullSort(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	all := make([]Product, 200)
+	for i := range all {
+		all[i] = generatedProduct(ProductID(i))
+	}
+	for _, by := range []string{"id", "name"} {
+		for _, n := range []int{0, 1, 7, 200, 250} {
+			top := &topN{by: by, n: n}
+			for _, i := range rnd.Perm(len(all)) {
+				top.offer(all[i])
+			}
+			want := append([]Product(nil), all...)
+			sortProducts(want, by)
+			want = want[:min(n, len(want))]
+			if got := top.sorted(); !equalIDs(productIDs(got), productIDs(want)) {
+				t.Errorf("by %s, n %d: kept %v, want %v", by, n, productIDs(got), productIDs(want))
+			}
+		}
+	}
+}
+
+func TestSortedSearchPages(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	all := search(t, h, "/products/search?mode=exhaustive&sort=name&limit=20&q=alpha").Products
+	if len(all) != 20 {
+		t.Fatalf("got %d products", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Name > all[i].Name {
+			t.Fatalf("%q before %q", all[i-1].Name, all[i].Name)
+		}
+	}
+	for _, offset := range []int{0, 5, 15, 19} {
+		res := search(t, h, "/products/search?mode=exhaustive&sort=name&limit=3&q=alpha&offset="+strconv.Itoa(offset))
+		want := all[offset:min(offset+3, len(all))]
+		if !equalIDs(productIDs(res.Products), productIDs(want)) || res.TotalFound != 20 {
+			t.Errorf("offset %d: %v of %d, want %v", offset, productIDs(res.Products), res.TotalFound, productIDs(want))
+		}
+	}
+}
+
+// BenchmarkSortedPage sorts an exhaustive search's 50k matches by name
+// for a page of 20, keeping the best 20 as the scan goes and, for
+// comparison, collecting every match and sorting them all
+func BenchmarkSortedPage(b *testing.B) {
+	s := newTestServer(b, func(cfg *Config) { cfg.NumProducts = 50000 })
+	ids := s.store.allIDs()
+	text := newSearchText(parseQuery("product"), defaultLocale, false)
+	page := searchPage{limit: 20, sort: "name"}
+	b.Run("top-n", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sr := s.scan(context.Background(), ids, text, "", "", page, 0)
+			if sr.matches != len(ids) || len(sr.results) != page.limit {
+				b.Fatalf("%d results of %d matches", len(sr.results), sr.matches)
+			}
+			sr.release()
+		}
+	})
+	b.Run("sort-all", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var all []Product
+			for _, id := range ids {
+				if sp, ok := s.store.lookup(id); ok && sp.scanMatch(text, "", "") == "" {
+					all = append(all, sp.Product)
+				}
+			}
+			sortProducts(all, page.sort)
+			_ = all[:page.limit]
+		}
+	})
+}
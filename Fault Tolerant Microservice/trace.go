@@ -0,0 +1,56 @@
+package main
+
+// Reasons a traced candidate didn't match
+const (
+	traceDeleted          = "deleted"
+	traceFilteredBrand    = "filtered_brand"
+	traceFilteredPrice    = "filtered_price"
+	traceFilteredStock    = "filtered_stock"
+	traceFilteredCategory = "filtered_category"
+	// traceScopeMismatch is a failed name: scope or - exclusion
+	traceScopeMismatch = "scope_mismatch"
+	// traceNoTextMatch means q is in none of the name, the localized name
+	// and the category
+	traceNoTextMatch = "no_text_match"
+)
+
+// traceCandidate is one product a scan checked
+type traceCandidate struct {
+	ID      ProductID `json:"id"`
+	Matched bool      `json:"matched"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// scanTrace records a debug search's candidates in the order they were
+// checked, the first max of them, so a product that never shows up can
+// be told apart as never sampled, deleted or not matching. Samples are
+// drawn with replacement, so an ID may appear twice.
+type scanTrace struct {
+	Seed       int64            `json:"seed"`
+	Checked    int              `json:"checked"`
+	Omitted    int              `json:"omitted"`
+	Candidates []traceCandidate `json:"candidates"`
+	max        int
+}
+
+// newScanTrace returns nil when max is 0, which turns tracing off; every
+// method is a no-op on nil so the scan loop needn't check
+func newScanTrace(max, ids int) *scanTrace {
+	if max <= 0 {
+		return nil
+	}
+	return &scanTrace{max: max, Candidates: make([]traceCandidate, 0, min(max, ids))}
+}
+
+// record notes one candidate; an empty reason is a match
+func (t *scanTrace) record(id ProductID, reason string) {
+	if t == nil {
+		return
+	}
+	t.Checked++
+	if len(t.Candidates) == t.max {
+		t.Omitted++
+		return
+	}
+	t.Candidates = append(t.Candidates, traceCandidate{ID: id, Matched: reason == "", Reason: reason})
+}
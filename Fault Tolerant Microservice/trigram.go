@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// trigramEntryBytes is the estimated cost of one posting list entry and
+// trigramKeyBytes that of one map key with its slice header
+const (
+	trigramEntryBytes = 8
+	trigramKeyBytes   = 48
+)
+
+// trigramIndex maps every three byte substring of a product's lowercased
+// name and category to the sorted IDs containing it. Candidates from it
+// are a superset of the matches and are always verified with
+// storedProduct.matches.
+type trigramIndex struct {
+	postings map[uint32][]ProductID
+	entries  int64
+	budget   int64
+}
+
+func newTrigramIndex(budget int64) *trigramIndex {
+	return &trigramIndex{postings: make(map[uint32][]ProductID), budget: budget}
+}
+
+func (ix *trigramIndex) bytes() int64 {
+	return ix.entries*trigramEntryBytes + int64(len(ix.postings))*trigramKeyBytes
+}
+
+// trigrams returns the distinct trigrams of the given lowercased fields.
+// Trigrams never span two fields.
+func trigrams(fields ...string) []uint32 {
+	var out []uint32
+	seen := make(map[uint32]struct{})
+	for _, f := range fields {
+		for i := 0; i+3 <= len(f); i++ {
+			t := uint32(f[i])<<16 | uint32(f[i+1])<<8 | uint32(f[i+2])
+			if _, ok := seen[t]; !ok {
+				seen[t] = struct{}{}
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+// add indexes sp, reporting false once the index has outgrown its budget
+func (ix *trigramIndex) add(sp *storedProduct) bool {
+	for _, t := range trigrams(sp.searchFields()...) {
+		var added bool
+		ix.postings[t], added = insertID(ix.postings[t], sp.ID)
+		if added {
+			ix.entries++
+		}
+	}
+	return ix.bytes() <= ix.budget
+}
+
+func (ix *trigramIndex) remove(sp *storedProduct) {
+	for _, t := range trigrams(sp.searchFields()...) {
+		ids, removed := removeID(ix.postings[t], sp.ID)
+		if !removed {
+			continue
+		}
+		ix.entries--
+		if len(ids) == 0 {
+			delete(ix.postings, t)
+		} else {
+			ix.postings[t] = ids
+		}
+	}
+}
+
+// candidates returns the sorted IDs holding every trigram of q, which must
+// be at least three bytes
+func (ix *trigramIndex) candidates(q string) []ProductID {
+	grams := trigrams(q)
+	lists := make([][]ProductID, 0, len(grams))
+	for _, t := range grams {
+		ids := ix.postings[t]
+		if len(ids) == 0 {
+			return nil
+		}
+		lists = append(lists, ids)
+	}
+	// Shortest first keeps every intersection as small as possible
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	out := append([]ProductID(nil), lists[0]...)
+	for _, ids := range lists[1:] {
+		if len(out) == 0 {
+			break
+		}
+		out = intersect(out, ids)
+	}
+	return out
+}
+
+// trigramIndexStats is the index as reported by /stats
+type trigramIndexStats struct {
+	Enabled     bool  `json:"enabled"`
+	OverBudget  bool  `json:"over_budget"`
+	Shed        bool  `json:"shed"`
+	Trigrams    int   `json:"trigrams"`
+	Postings    int64 `json:"postings"`
+	Bytes       int64 `json:"bytes"`
+	BudgetBytes int64 `json:"budget_bytes"`
+}
+
+// enableTrigrams turns on the trigram index with a memory budget in
+// bytes. Call it before generate so the index is built with the catalog.
+func (s *productStore) enableTrigrams(budget int64) {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	s.trigramBudget = budget
+	s.trigrams = newTrigramIndex(budget)
+}
+
+// trigramAddLocked indexes sp, dropping the whole index if that takes it
+// over budget. Searches then fall back to scanning. Callers hold listLock.
+func (s *productStore) trigramAddLocked(sp *storedProduct) {
+	if s.trigrams == nil || s.trigrams.add(sp) {
+		return
+	}
+	log.Printf("Trigram index exceeded its %d byte budget; substring searches will scan\n", s.trigramBudget)
+	s.trigrams = nil
+	s.trigramOverBudget = true
+}
+
+// shedTrigrams drops the trigram index to free its memory; searches fall
+// back to scanning until restoreTrigrams
+func (s *productStore) shedTrigrams() {
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	// One still being loaded or rebuilt is shed as soon as it is
+	// installed
+	if s.trigrams != nil || s.indexesPending && s.trigramBudget > 0 {
+		s.trigrams = nil
+		s.trigramShed = true
+	}
+}
+
+// restoreTrigrams rebuilds an index dropped by shedTrigrams. Writers wait
+// for the rebuild, so none is missed, but searches only wait for the swap.
+func (s *productStore) restoreTrigrams() {
+	s.mutationLock.Lock()
+	defer s.mutationLock.Unlock()
+	s.listLock.RLock()
+	shed := s.trigramShed && !s.indexesPending
+	s.listLock.RUnlock()
+	if !shed {
+		return
+	}
+	ix := newTrigramIndex(s.trigramBudget)
+	fits := true
+	for _, id := range s.allIDs() {
+		sp, ok := s.lookup(id)
+		if ok && !ix.add(&sp) {
+			fits = false
+			break
+		}
+	}
+	s.listLock.Lock()
+	defer s.listLock.Unlock()
+	s.trigramShed = false
+	if !fits {
+		log.Printf("Trigram index exceeded its %d byte budget; substring searches will scan\n", s.trigramBudget)
+		s.trigramOverBudget = true
+		return
+	}
+	s.trigrams = ix
+}
+
+func (s *productStore) trigramRemoveLocked(sp *storedProduct) {
+	if s.trigrams != nil {
+		s.trigrams.remove(sp)
+	}
+}
+
+// trigramCandidates returns the IDs that may match q, or ok false when
+// the index is off or q is too short to use it
+func (s *productStore) trigramCandidates(q string) (ids []ProductID, ok bool) {
+	if len(q) < 3 {
+		return nil, false
+	}
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	if s.trigrams == nil {
+		return nil, false
+	}
+	return s.trigrams.candidates(q), true
+}
+
+func (s *productStore) trigramStats() trigramIndexStats {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	return s.trigramStatsLocked()
+}
+
+func (s *productStore) trigramStatsLocked() trigramIndexStats {
+	st := trigramIndexStats{OverBudget: s.trigramOverBudget, Shed: s.trigramShed, BudgetBytes: s.trigramBudget}
+	if s.trigrams != nil {
+		st.Enabled = true
+		st.Trigrams = len(s.trigrams.postings)
+		st.Postings = s.trigrams.entries
+		st.Bytes = s.trigrams.bytes()
+	}
+	return st
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"testing"
+)
+
+func TestTrigrams(t *testing.T) {
+	got := trigrams("abcd", "bcx", "ab")
+	want := []uint32{'a'<<16 | 'b'<<8 | 'c', 'b'<<16 | 'c'<<8 | 'd', 'b'<<16 | 'c'<<8 | 'x'}
+	if len(got) != len(want) {
+		t.Fatalf("got %d trigrams, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("trigram %d: %x, want %x", i, got[i], want[i])
+		}
+	}
+}
+
+// TestIndexedMatchesExhaustive checks the trigram candidates, once
+// verified, find exactly what a full scan does, before and after a change
+func TestIndexedMatchesExhaustive(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.TrigramBudget = 1 << 20 })
+	h := s.Routes()
+	if !s.store.trigramStats().Enabled {
+		t.Fatal("the trigram index is off")
+	}
+	check := func() {
+		t.Helper()
+		for _, q := range []string{"alpha 1", "duct", "books", "ta 9", "zzz", "ph"} {
+			base := "/products/search?sort=id&limit=20&q=" + url.QueryEscape(q)
+			want := search(t, h, base+"&mode=exhaustive")
+			got := search(t, h, base+"&mode=indexed")
+			if !equalIDs(productIDs(got.Products), productIDs(want.Products)) || got.TotalFound != want.TotalFound {
+				t.Errorf("q=%q: indexed %v of %d, exhaustive %v of %d", q,
+					productIDs(got.Products), got.TotalFound, productIDs(want.Products), want.TotalFound)
+			}
+		}
+	}
+	check()
+	p, _ := s.store.get(3)
+	p.Name = "Zeta Kettle"
+	if err := s.store.update(p); err != nil {
+		t.Fatal(err)
+	}
+	if ids, ok := s.store.trigramCandidates("kettle"); !ok || !equalIDs(ids, []ProductID{3}) {
+		t.Errorf("kettle candidates %v", ids)
+	}
+	check()
+}
+
+func TestTrigramBudget(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.TrigramBudget = 1000 })
+	st := s.store.trigramStats()
+	if st.Enabled || !st.OverBudget {
+		t.Fatalf("over budget index: %+v", st)
+	}
+	res := search(t, s.Routes(), "/products/search?mode=indexed&q=alpha")
+	if res.TotalFound != testProducts/len(brands) {
+		t.Errorf("the scan fallback found %d", res.TotalFound)
+	}
+}
+
+// BenchmarkSubstringQuery answers q=duct gamma 41, starting and ending
+// mid-token where no token index could help, in every mode over a 100k
+// catalog with the trigram index on
+func BenchmarkSubstringQuery(b *testing.B) {
+	s := newTestServer(b, func(cfg *Config) {
+		cfg.NumProducts = 100000
+		cfg.TrigramBudget = 1 << 30
+	})
+	if !s.store.trigramStats().Enabled {
+		b.Fatal("the trigram index is off")
+	}
+	text := newSearchText(parseQuery("duct gamma 41"), defaultLocale, false)
+	for _, m := range matchers {
+		b.Run(m.mode, func(b *testing.B) {
+			q := matchQuery{text: text, n: s.cfg.ChecksPerSearch, strategy: s.cfg.SampleStrategy,
+				rnd: rand.New(rand.NewSource(1)), page: searchPage{limit: s.cfg.MaxResults}}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ids, answered := m.matcher.candidates(s, q)
+				sr, _, err := matcherFor(answered).match(context.Background(), s, q, ids)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sr.release()
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+	"path"
+)
+
+// uiFiles are the demo UI's static assets. The page gets everything it
+// shows from the JSON API; nothing is templated on the server.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiTypes are the content types of the UI's files, by extension, rather
+// than whatever the host's MIME tables say
+var uiTypes = map[string]string{
+	".html": "text/html; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+}
+
+// uiCSP lets the UI load only its own assets and call this origin
+const uiCSP = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// uiHandler serves /ui, the page, and /ui/{file}, its assets
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathParam(r, "file")
+	if name == "" {
+		name = "index.html"
+	}
+	ctype, ok := uiTypes[path.Ext(name)]
+	b, err := uiFiles.ReadFile(path.Join("ui", name))
+	if !ok || err != nil || path.Base(name) != name {
+		writeErr(w, r, newError(ErrNotFound, "No such UI file"))
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Write(b)
+}
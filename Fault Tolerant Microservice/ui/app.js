@@ -0,0 +1,139 @@
+// The demo UI is static: everything it shows comes from the JSON API,
+// fetched from this origin. Text from responses is only ever set as
+// textContent.
+"use strict";
+
+var pollEvery = 1000;
+
+function $(id) { return document.getElementById(id); }
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (cls) e.className = cls;
+  return e;
+}
+
+function setStatus(id, text, failed) {
+  var p = $(id);
+  p.textContent = text;
+  p.className = failed ? "status error" : "status";
+}
+
+// api fetches a JSON endpoint with the key given, if any, resolving with
+// the status and the body, which is null when it isn't JSON
+function api(method, path, body) {
+  var opts = { method: method, headers: {} };
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  var key = $("key").value;
+  if (key) opts.headers["Authorization"] = "Bearer " + key;
+  return fetch(path, opts).then(function (r) {
+    return r.json().catch(function () { return null; }).then(function (b) {
+      return { status: r.status, ok: r.ok, body: b };
+    });
+  });
+}
+
+function errorText(res) {
+  var e = res.body && res.body.error;
+  return res.status + (e ? " " + e.code + ": " + e.message : "");
+}
+
+function search(ev) {
+  ev.preventDefault();
+  var q = $("q").value;
+  var list = $("results");
+  setStatus("search-status", "Searching...");
+  api("GET", "/v1/products/search?limit=10&q=" + encodeURIComponent(q)).then(function (res) {
+    list.textContent = "";
+    if (!res.ok) {
+      setStatus("search-status", "Search failed: " + errorText(res), true);
+      return;
+    }
+    // v1 wraps results in an envelope unless the server turned it off
+    var products = res.body.data || res.body.products || [];
+    var meta = res.body.meta || res.body;
+    var found = meta.search ? meta.search.total_found : meta.total_found;
+    setStatus("search-status", products.length + " shown of " + found + " found in " +
+      (meta.elapsed_ms || 0).toFixed(1) + " ms");
+    products.forEach(function (p) {
+      var li = el("li", p.name);
+      li.appendChild(el("span", " #" + p.id + " · " + p.brand + " · " + p.category, "meta"));
+      list.appendChild(li);
+    });
+  }).catch(function (err) {
+    setStatus("search-status", "Search failed: " + err, true);
+  });
+}
+
+function showCircuit(state, forced) {
+  var label = state + (forced ? " (forced)" : "");
+  $("circuit").textContent = "circuit: " + label;
+  $("circuit").className = "badge " + state;
+  $("s-circuit").textContent = label;
+  $("s-circuit").className = state;
+}
+
+function poll() {
+  Promise.all([api("GET", "/v1/stats"), api("GET", "/v1/circuit")]).then(function (res) {
+    var stats = res[0].body, circuit = res[1].body;
+    if (!res[0].ok || !res[1].ok || !stats || !circuit) {
+      $("updated").textContent = "(unavailable: " + errorText(res[0].ok ? res[1] : res[0]) + ")";
+      return;
+    }
+    showCircuit(circuit.state, circuit.forced);
+    $("s-failures").textContent = circuit.failures + (circuit.threshold ? " / " + circuit.threshold : "");
+    $("s-inflight").textContent = stats.in_flight;
+    $("s-bulkhead").textContent = stats.bulkhead_used + " / " + stats.bulkhead_size;
+    $("s-chaos").textContent = (stats.chaos_rate * 100).toFixed(0) + "%";
+    $("s-outcomes").textContent = stats.requests + " / " + stats.successes + " / " + stats.failures;
+    var w = stats.windows && stats.windows["1m"];
+    if (w) {
+      $("s-window").textContent = w.requests_per_s.toFixed(2) + " req/s, " +
+        (w.success_ratio === null ? "no outcomes" : (w.success_ratio * 100).toFixed(1) + "% ok");
+    }
+    var table = $("rejected");
+    table.textContent = "";
+    Object.keys(stats.rejected).sort().forEach(function (reason) {
+      var tr = el("tr");
+      tr.appendChild(el("th", reason));
+      tr.appendChild(el("td", stats.rejected[reason]));
+      table.appendChild(tr);
+    });
+    $("updated").textContent = "updated " + new Date().toLocaleTimeString();
+  }).catch(function (err) {
+    $("updated").textContent = "(unreachable: " + err + ")";
+  }).then(function () {
+    setTimeout(poll, pollEvery);
+  });
+}
+
+function admin(method, path, body, done) {
+  api(method, path, body).then(function (res) {
+    if (!res.ok) {
+      setStatus("admin-status", "Refused: " + errorText(res), true);
+      return;
+    }
+    setStatus("admin-status", done(res.body));
+  }).catch(function (err) {
+    setStatus("admin-status", "Failed: " + err, true);
+  });
+}
+
+$("search-form").addEventListener("submit", search);
+$("rate").addEventListener("input", function () { $("rate-value").textContent = $("rate").value; });
+$("set-chaos").addEventListener("click", function () {
+  admin("PUT", "/v1/admin/chaos", { failure_rate: parseFloat($("rate").value) }, function (b) {
+    return "Failure rate is now " + (b.failure_rate || 0);
+  });
+});
+$("trip").addEventListener("click", function () {
+  admin("POST", "/v1/admin/circuit", { state: "open" }, function (b) { return "Breaker is " + b.state; });
+});
+$("close").addEventListener("click", function () {
+  admin("POST", "/v1/admin/circuit", { state: "closed" }, function (b) { return "Breaker is " + b.state; });
+});
+poll();
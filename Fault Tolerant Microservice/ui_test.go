@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestUIFiles fetches every embedded UI file through the full handler:
+// each must come back as embedded, with its content type and the UI's
+// CSP, the page must only reference files that exist, and anything else
+// under /ui must be a 404
+func TestUIFiles(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	get := func(path string) *httptest.ResponseRecorder { return serve(h, http.MethodGet, path, "", nil) }
+	names, err := fs.Glob(uiFiles, "ui/*")
+	if err != nil || len(names) == 0 {
+		t.Fatalf("no UI files embedded: %v", err)
+	}
+	for _, name := range names {
+		want, _ := uiFiles.ReadFile(name)
+		ctype, ok := uiTypes[path.Ext(name)]
+		if !ok {
+			t.Errorf("%s has no content type", name)
+			continue
+		}
+		rec := get("/" + name)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ctype || !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Errorf("/%s: status %d, Content-Type %q, %d of %d bytes", name, rec.Code, rec.Header().Get("Content-Type"), rec.Body.Len(), len(want))
+		}
+		if rec.Header().Get("Content-Security-Policy") != uiCSP {
+			t.Errorf("/%s: CSP %q", name, rec.Header().Get("Content-Security-Policy"))
+		}
+	}
+	page := get("/ui")
+	if page.Code != http.StatusOK || page.Header().Get("Content-Type") != uiTypes[".html"] {
+		t.Fatalf("/ui: status %d, Content-Type %q", page.Code, page.Header().Get("Content-Type"))
+	}
+	for _, ref := range regexp.MustCompile(`(?:src|href)="(/[^"]*)"`).FindAllStringSubmatch(page.Body.String(), -1) {
+		if rec := get(ref[1]); rec.Code != http.StatusOK {
+			t.Errorf("the page loads %s, which answers %d", ref[1], rec.Code)
+		}
+	}
+	for _, p := range []string{"/ui/missing.js", "/ui/ui", "/ui/README"} {
+		if rec := get(p); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", p, rec.Code)
+		}
+	}
+}
+
+// TestUIPaths checks /ui serves only the embedded files, however the
+// name is dressed up, and that the UI's CSP stays on the UI
+func TestUIPaths(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for _, p := range []string{"/ui/../go.mod", "/ui/..%2fgo.mod", "/ui/%2e%2e/main.go", "/ui/ui%2fapp.js", "/ui/.", "/ui/app.js%00"} {
+		if rec := serve(h, http.MethodGet, p, "", nil); rec.Code == http.StatusOK {
+			t.Errorf("%s: status 200 with %d bytes", p, rec.Body.Len())
+		}
+	}
+	rec := serve(h, http.MethodGet, "/v1/stats", "", nil)
+	if rec.Header().Get("Content-Security-Policy") == uiCSP || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("/v1/stats: CSP %q, Cache-Control %q", rec.Header().Get("Content-Security-Policy"), rec.Header().Get("Cache-Control"))
+	}
+}
+
+// TestUIControls makes the API calls app.js makes, as it makes them, and
+// checks each answers with the fields the page reads
+func TestUIControls(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	jsonBody := http.Header{"Content-Type": {"application/json"}}
+	for _, target := range []string{"/v1/products/search?q=alpha", "/v1/stats", "/v1/circuit"} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(h, http.MethodPut, "/v1/admin/chaos", `{"failure_rate":0.25}`, jsonBody); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"failure_rate":0.25`) {
+		t.Errorf("setting chaos: %d %s", rec.Code, rec.Body)
+	}
+	for _, state := range []string{"open", "closed"} {
+		rec := serve(h, http.MethodPost, "/v1/admin/circuit", `{"state":"`+state+`"}`, jsonBody)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"state":"`+state+`"`) {
+			t.Errorf("setting the breaker %s: %d %s", state, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameChars caps a product name, canonical or localized
+const maxNameChars = 200
+
+// productFieldLimits caps each string field of a product, in characters
+var productFieldLimits = []struct {
+	name string
+	max  int
+	// multiline fields may contain newlines and tabs
+	multiline bool
+	get       func(*productBody) string
+}{
+	{"name", maxNameChars, false, func(b *productBody) string { return b.Name }},
+	{"category", 100, false, func(b *productBody) string { return b.Category }},
+	{"brand", 100, false, func(b *productBody) string { return b.Brand }},
+	{"description", 2000, true, func(b *productBody) string { return b.Description }},
+}
+
+// checkProductField applies the built-in limits to one field: name is
+// required, lengths are capped, and control characters, which would
+// otherwise end up in CSV exports and event streams, are rejected.
+// Deployment rules come on top, in validateProduct.
+func checkProductField(name, v string, max int, multiline bool) *ValidationError {
+	if name == "name" && strings.TrimSpace(v) == "" {
+		return &ValidationError{Field: name, Message: "name is required"}
+	}
+	if n := utf8.RuneCountInString(v); n > max {
+		return &ValidationError{Field: name, Message: fmt.Sprintf("%s must be at most %d characters, got %d", name, max, n)}
+	}
+	for _, c := range v {
+		if unicode.IsControl(c) && !(multiline && (c == '\n' || c == '\t')) {
+			return &ValidationError{Field: name, Message: name + " must not contain control characters"}
+		}
+	}
+	return nil
+}
+
+// readBody reads at most limit bytes of the request body. It writes a 413
+// when the body is larger, counting it in /stats, and a 400 when it
+// isn't valid UTF-8; encoding/json would otherwise quietly replace the
+// bad bytes.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			addSaturating(&s.stats.oversized, 1)
+			writeErr(w, r, newError(ErrTooLarge, fmt.Sprintf("Request body exceeds %d bytes", limit)))
+			return nil, false
+		}
+		writeErr(w, r, invalid("", "Failed to read body: "+err.Error()))
+		return nil, false
+	}
+	if !utf8.Valid(b) {
+		writeErr(w, r, invalid("", "Request body is not valid UTF-8"))
+		return nil, false
+	}
+	return b, true
+}
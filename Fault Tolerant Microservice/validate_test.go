@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var jsonHeader = http.Header{"Content-Type": {"application/json"}}
+
+// TestWriteBodyTooLarge refuses a body past its route's limit with a 413,
+// counted in /stats, and stores nothing of it
+func TestWriteBodyTooLarge(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.MaxProductBytes = 256
+		cfg.MaxImportBytes = 1024
+	})
+	h := s.Routes()
+	product := `{"name":"Padded","category":"Home","brand":"Delta","description":"` + strings.Repeat("d", 300) + `"}`
+	for _, tc := range []struct {
+		method, target, body string
+	}{
+		{http.MethodPost, "/products", product},
+		{http.MethodPut, "/products/1", product},
+		{http.MethodPost, "/products/import", "[" + strings.Repeat(`{"name":"Padded","category":"Home","brand":"Delta"},`, 30) + `{"name":"Last","category":"Home","brand":"Delta"}]`},
+	} {
+		if rec := serve(h, tc.method, tc.target, tc.body, jsonHeader); rec.Code != http.StatusRequestEntityTooLarge || rec.Header().Get("X-Error-Code") != codeTooLarge {
+			t.Errorf("%s %s of %d bytes: %d %s", tc.method, tc.target, len(tc.body), rec.Code, rec.Body)
+		}
+	}
+	if n := s.store.size(); n != testProducts {
+		t.Errorf("%d products after refused writes, want %d", n, testProducts)
+	}
+	if got := atomic.LoadInt64(&s.stats.oversized); got != 3 {
+		t.Errorf("oversized_requests %d, want 3", got)
+	}
+
+	// A body within the limit is still taken
+	if rec := serve(h, http.MethodPost, "/products", `{"name":"Small","category":"Home","brand":"Delta","description":"d"}`, jsonHeader); rec.Code != http.StatusCreated {
+		t.Errorf("small body: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// TestWriteControlCharacters refuses control characters in a product's
+// fields, naming the field, except newlines and tabs in the description,
+// and bodies that aren't UTF-8
+func TestWriteControlCharacters(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.Routes()
+	for _, tc := range []struct {
+		body, field string
+	}{
+		{`{"name":"Bell\u0007","category":"Home","brand":"Delta"}`, "name"},
+		{`{"name":"Line\nbreak","category":"Home","brand":"Delta"}`, "name"},
+		{`{"name":"Lamp","category":"Ho\u0000me","brand":"Delta"}`, "category"},
+		{`{"name":"Lamp","category":"Home","brand":"Del\tta"}`, "brand"},
+		{`{"name":"Lamp","category":"Home","brand":"Delta","description":"esc \u001b[31m"}`, "description"},
+		{`{"name":"Lamp","category":"Home","brand":"Delta","description":"next \u0085 line"}`, "description"},
+		{"{\"name\":\"Lamp\xff\",\"category\":\"Home\",\"brand\":\"Delta\"}", ""},
+	} {
+		rec := serve(h, http.MethodPost, "/v1/products", tc.body, jsonHeader)
+		var res apiError
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusBadRequest || res.Error.Field != tc.field {
+			t.Errorf("%q: %d %s, want a 400 naming %q", tc.body, rec.Code, rec.Body, tc.field)
+		}
+	}
+	if n := s.store.size(); n != testProducts {
+		t.Errorf("%d products after refused writes, want %d", n, testProducts)
+	}
+
+	// A description may run over lines
+	if rec := serve(h, http.MethodPost, "/v1/products", `{"name":"Lamp","category":"Home","brand":"Delta","description":"one\n\ttwo"}`, jsonHeader); rec.Code != http.StatusCreated {
+		t.Errorf("multiline description: %d %s", rec.Code, rec.Body)
+	}
+}
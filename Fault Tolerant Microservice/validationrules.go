@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Catalog sources an enum can be taken from
+const (
+	enumFromCategories = "categories"
+	enumFromBrands     = "brands"
+)
+
+// fieldRule is a deployment's constraint on one product field, on top of
+// the built-in limits, which it can tighten but not relax
+type fieldRule struct {
+	Required  bool   `json:"required,omitempty"`
+	MaxLength int    `json:"max_length,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	// Enum is a fixed list of allowed values; EnumFrom takes them from the
+	// catalog as it stands, "categories" or "brands". Both compare
+	// ignoring case, like the brand and category filters.
+	Enum     []string `json:"enum,omitempty"`
+	EnumFrom string   `json:"enum_from,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// validationRules is the file -validation-rules names:
+//
+//	{"fields": {"category": {"required": true, "enum": ["Books", "Toys"]},
+//	            "brand": {"enum_from": "brands", "pattern": "^[A-Z]"}}}
+type validationRules struct {
+	Fields map[string]*fieldRule `json:"fields"`
+}
+
+// parseValidationRules reads and checks a rule set, compiling patterns
+func parseValidationRules(b []byte) (*validationRules, error) {
+	var rules validationRules
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, err
+	}
+	for name, rule := range rules.Fields {
+		if !ruleField(name) {
+			return nil, fmt.Errorf("no product field %q, expected name, category, brand or description", name)
+		}
+		if rule == nil {
+			return nil, fmt.Errorf("%s: empty rule", name)
+		}
+		if rule.MaxLength < 0 {
+			return nil, fmt.Errorf("%s: max_length must not be negative", name)
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: pattern: %w", name, err)
+			}
+			rule.re = re
+		}
+		switch rule.EnumFrom {
+		case "", enumFromCategories, enumFromBrands:
+		default:
+			return nil, fmt.Errorf("%s: enum_from must be %s or %s", name, enumFromCategories, enumFromBrands)
+		}
+		if rule.EnumFrom != "" && len(rule.Enum) > 0 {
+			return nil, fmt.Errorf("%s: give enum or enum_from, not both", name)
+		}
+	}
+	return &rules, nil
+}
+
+func ruleField(name string) bool {
+	for _, f := range productFieldLimits {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validationState holds the active rules, swapped whole on a reload
+type validationState struct {
+	mu       sync.RWMutex
+	file     string
+	rules    *validationRules
+	loaded   time.Time
+	reloads  int64
+	failures int64
+	lastErr  string
+}
+
+// loadValidationRules reads file, or starts with no rules when it's empty
+func loadValidationRules(file string) (*validationState, error) {
+	vs := &validationState{file: file, rules: &validationRules{}, loaded: time.Now().UTC()}
+	if file == "" {
+		return vs, nil
+	}
+	rules, err := readValidationRules(file)
+	if err != nil {
+		return nil, err
+	}
+	vs.rules = rules
+	return vs, nil
+}
+
+func readValidationRules(file string) (*validationRules, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseValidationRules(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return rules, nil
+}
+
+// reloadValidationRules re-reads the rules file, keeping the current
+// rules if the new ones don't parse. main calls it on SIGHUP.
+func (s *Server) reloadValidationRules() {
+	vs := s.validation
+	if vs.file == "" {
+		return
+	}
+	rules, err := readValidationRules(vs.file)
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if err != nil {
+		vs.failures++
+		vs.lastErr = err.Error()
+		log.Println("Validation rules reload failed, keeping the current ones:", err)
+		return
+	}
+	vs.rules, vs.loaded, vs.lastErr = rules, time.Now().UTC(), ""
+	vs.reloads++
+	log.Printf("Validation rules reloaded: %d fields\n", len(rules.Fields))
+}
+
+func (vs *validationState) current() *validationRules {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	return vs.rules
+}
+
+// validateProduct checks b against the built-in limits and then the
+// deployment's rules, the same for create, update and import. It reports
+// every field at fault, the first problem with each, in field order.
+func (s *Server) validateProduct(b *productBody) []*ValidationError {
+	var out []*ValidationError
+	rules := s.validation.current()
+	for _, f := range productFieldLimits {
+		v := f.get(b)
+		if err := checkProductField(f.name, v, f.max, f.multiline); err != nil {
+			out = append(out, err)
+			continue
+		}
+		if rule := rules.Fields[f.name]; rule != nil {
+			if err := s.checkRule(f.name, v, rule); err != nil {
+				out = append(out, err)
+			}
+		}
+	}
+	if b.Price != nil && (*b.Price < 0 || *b.Price > maxPrice) {
+		out = append(out, &ValidationError{Field: "price", Message: fmt.Sprintf("price must be a whole number of cents from 0 to %d", maxPrice)})
+	}
+	var ve *ValidationError
+	if errors.As(validateNames(b.Names), &ve) {
+		out = append(out, ve)
+	}
+	return out
+}
+
+// checkRule applies one field's rule. An empty value passes unless the
+// field is required.
+func (s *Server) checkRule(name, v string, rule *fieldRule) *ValidationError {
+	if v == "" {
+		if rule.Required {
+			return &ValidationError{Field: name, Message: name + " is required"}
+		}
+		return nil
+	}
+	if n := utf8.RuneCountInString(v); rule.MaxLength > 0 && n > rule.MaxLength {
+		return &ValidationError{Field: name, Message: fmt.Sprintf("%s must be at most %d characters, got %d", name, rule.MaxLength, n)}
+	}
+	if rule.re != nil && !rule.re.MatchString(v) {
+		return &ValidationError{Field: name, Message: fmt.Sprintf("%s must match %s", name, rule.Pattern)}
+	}
+	switch {
+	case len(rule.Enum) > 0:
+		for _, e := range rule.Enum {
+			if strings.EqualFold(e, v) {
+				return nil
+			}
+		}
+		return &ValidationError{Field: name, Message: fmt.Sprintf("%s must be one of %s", name, strings.Join(rule.Enum, ", "))}
+	case rule.EnumFrom != "":
+		if !s.store.hasValue(rule.EnumFrom, v) {
+			return &ValidationError{Field: name, Message: fmt.Sprintf("%s %q is not one of the catalog's %s", name, v, rule.EnumFrom)}
+		}
+	}
+	return nil
+}
+
+// hasValue reports whether some product has v as its category or brand,
+// ignoring case
+func (s *productStore) hasValue(from, v string) bool {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	if from == enumFromBrands {
+		return len(s.brandIndex[strings.ToLower(v)]) > 0
+	}
+	return len(s.categoryIndex[strings.ToLower(v)]) > 0
+}
+
+// indexValues lists the catalog's categories or brands, lowercased as
+// the indexes keep them
+func (s *productStore) indexValues(from string) []string {
+	s.listLock.RLock()
+	defer s.listLock.RUnlock()
+	ix := s.categoryIndex
+	if from == enumFromBrands {
+		ix = s.brandIndex
+	}
+	values := make([]string, 0, len(ix))
+	for v := range ix {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// activeFieldRule is a field's effective constraints as GET
+// /admin/validation reports them, built-in limits and rule together
+type activeFieldRule struct {
+	Field     string `json:"field"`
+	Required  bool   `json:"required"`
+	MaxLength int    `json:"max_length"`
+	Multiline bool   `json:"multiline"`
+	Pattern   string `json:"pattern,omitempty"`
+	// Enum is the allowed values, for enum_from as the catalog stands now
+	Enum     []string `json:"enum,omitempty"`
+	EnumFrom string   `json:"enum_from,omitempty"`
+}
+
+// validationHandler returns the rules create, update and import apply,
+// so client developers can check a product before sending it
+func (s *Server) validationHandler(w http.ResponseWriter, r *http.Request) {
+	vs := s.validation
+	vs.mu.RLock()
+	rules, loaded, reloads, failures, lastErr := vs.rules, vs.loaded, vs.reloads, vs.failures, vs.lastErr
+	vs.mu.RUnlock()
+	fields := make([]activeFieldRule, 0, len(productFieldLimits))
+	for _, f := range productFieldLimits {
+		a := activeFieldRule{Field: f.name, Required: f.name == "name", MaxLength: f.max, Multiline: f.multiline}
+		if rule := rules.Fields[f.name]; rule != nil {
+			a.Required = a.Required || rule.Required
+			if rule.MaxLength > 0 && rule.MaxLength < a.MaxLength {
+				a.MaxLength = rule.MaxLength
+			}
+			a.Pattern, a.Enum, a.EnumFrom = rule.Pattern, rule.Enum, rule.EnumFrom
+			if rule.EnumFrom != "" {
+				a.Enum = s.store.indexValues(rule.EnumFrom)
+			}
+		}
+		fields = append(fields, a)
+	}
+	resp := map[string]interface{}{
+		"source":          vs.file,
+		"loaded":          loaded,
+		"reloads":         reloads,
+		"reload_failures": failures,
+		"fields":          fields,
+	}
+	if lastErr != "" {
+		resp["last_error"] = lastErr
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
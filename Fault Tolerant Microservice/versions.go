@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// apiVersion is one mounting of the resource routes. Adding a version
+// means appending here and branching on requestAPIVersion in the handlers
+// whose responses change.
+type apiVersion struct {
+	Number     int
+	Prefix     string
+	Deprecated bool
+}
+
+var apiVersions = []apiVersion{
+	// Legacy unprefixed routes keep their original response shapes
+	{Number: 0, Prefix: "", Deprecated: true},
+	// v1 uses structured JSON errors
+	{Number: 1, Prefix: "/v1"},
+}
+
+// latestAPIVersion is what deprecated routes point clients at
+var latestAPIVersion = apiVersions[len(apiVersions)-1]
+
+type apiVersionKey struct{}
+
+// requestAPIVersion returns the API version the request was routed under
+func requestAPIVersion(r *http.Request) int {
+	v, _ := r.Context().Value(apiVersionKey{}).(int)
+	return v
+}
+
+// mount prefixes the routes, tags requests with the version and wraps
+// each handler in its group's stack
+func (v apiVersion) mount(rs []route, s *Server) []route {
+	out := make([]route, len(rs))
+	for i, rt := range rs {
+		rt.Version = v.Number
+		rt.Deprecated = v.Deprecated
+		h := chain(rt.Handler, s.routeStack(routeGroup(rt.Path, rt), rt)...)
+		rt.Path = v.Prefix + rt.Path
+		rt.Handler = func(w http.ResponseWriter, r *http.Request) {
+			if v.Deprecated {
+				successor := latestAPIVersion.Prefix + strings.TrimPrefix(r.URL.Path, v.Prefix)
+				w.Header().Set("Deprecation", "true")
+				w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v.Number)))
+		}
+		out[i] = rt
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestLegacySearchShape pins the unprefixed search response byte for byte
+// to the shape it had before versioning, so fields added since only reach
+// /v1. The manual clock holds search_time at zero.
+func TestLegacySearchShape(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	for _, tc := range []struct {
+		target, want string
+	}{
+		{
+			"/products/search?mode=exhaustive&q=Product+Alpha+5",
+			`{"products":[` +
+				`{"id":5,"name":"Product Alpha 5","category":"Electronics","description":"Product Description 5","brand":"Alpha"},` +
+				`{"id":50,"name":"Product Alpha 50","category":"Electronics","description":"Product Description 50","brand":"Alpha"},` +
+				`{"id":55,"name":"Product Alpha 55","category":"Electronics","description":"Product Description 55","brand":"Alpha"}],` +
+				`"total_found":3,"search_time":"0.0000s"}`,
+		},
+		{
+			"/products/search?mode=exhaustive&debug=1&q=Beta+96",
+			`{"products":[{"id":96,"name":"Product Beta 96","category":"Books","description":"Product Description 96","brand":"Beta"}],` +
+				`"total_found":1,"search_time":"0.0000s","checked_request":100,"total_checked":200}`,
+		},
+		{
+			"/products/search?mode=exhaustive&q=alpa",
+			`{"products":[],"total_found":0,"search_time":"0.0000s"}`,
+		},
+	} {
+		rec := serve(h, http.MethodGet, tc.target, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", tc.target, rec.Code, rec.Body)
+		}
+		if got := rec.Body.String(); got != tc.want+"\n" {
+			t.Errorf("GET %s:\n got %s\nwant %s", tc.target, got, tc.want)
+		}
+		if rec.Header().Get("Deprecation") != "true" {
+			t.Errorf("GET %s: no Deprecation header", tc.target)
+		}
+	}
+}
+
+func TestV1SearchKeepsNewFields(t *testing.T) {
+	h := newTestServer(t, nil).Routes()
+	rec := serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&debug=1&q=Beta+96", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	for _, field := range []string{`"price":`, `"names":`, `"seed":`, `"mode":"exhaustive"`} {
+		if !strings.Contains(rec.Body.String(), field) {
+			t.Errorf("v1 response has no %s: %s", field, rec.Body)
+		}
+	}
+	if rec.Header().Get("Deprecation") != "" {
+		t.Error("v1 is marked deprecated")
+	}
+	rec = serve(h, http.MethodGet, "/v1/products/search?mode=exhaustive&q=alpa", "", nil)
+	if !strings.Contains(rec.Body.String(), `"suggestions":`) {
+		t.Errorf("v1 zero-result response has no suggestions: %s", rec.Body)
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WAL record ops
+const (
+	walPut    byte = 1
+	walDelete byte = 2
+)
+
+// walHeader is a record's length and CRC, uint32 LE each
+const walHeader = 8
+
+// maxWALRecord bounds a record's length, so a corrupt length isn't taken
+// for a huge record to allocate
+const maxWALRecord = 1 << 24
+
+// writeAheadLog makes product mutations durable before they are
+// acknowledged. The store appends each one, under its mutationLock so the
+// log is in the order the changes were applied, and waits for it to be
+// fsynced before answering: at once when interval is 0, otherwise with
+// every other write of the interval in one fsync, which trades an
+// interval's latency for fewer of them. The layout, per record:
+//
+//	length uint32 LE, then CRC-32 (IEEE) of the payload uint32 LE
+//	payload: seq uvarint, op byte, then the product as JSON for a put
+//	or its ID uvarint for a delete
+//
+// A catalog snapshot rotates the log to path.prev, removed once the
+// snapshot holding its records is saved, so the log only ever holds what
+// the latest snapshot doesn't.
+type writeAheadLog struct {
+	path     string
+	interval time.Duration
+	statsd   *statsdClient
+
+	// syncMu serializes fsyncs and rotations, which mu is released during
+	syncMu sync.Mutex
+	mu     sync.Mutex
+	// synced is signalled whenever durable moves, or failed is set
+	synced  *sync.Cond
+	f       *os.File
+	seq     uint64
+	durable uint64
+	size    int64
+	// failed is set once the log can't be trusted to hold what it was
+	// given, and refuses every append after
+	failed error
+
+	records     int64
+	fsyncs      int64
+	fsyncNanos  int64
+	fsyncMax    int64
+	replayed    int64
+	corrupt     int64
+	rotations   int64
+	stopSyncing chan struct{}
+}
+
+// walRecord is one logged mutation
+type walRecord struct {
+	seq     uint64
+	op      byte
+	product Product
+	id      ProductID
+}
+
+func (r walRecord) encode() ([]byte, error) {
+	payload := binary.AppendUvarint(make([]byte, walHeader, 64), r.seq)
+	payload = append(payload, r.op)
+	switch r.op {
+	case walPut:
+		b, err := json.Marshal(r.product)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, b...)
+	case walDelete:
+		payload = binary.AppendUvarint(payload, uint64(r.id))
+	}
+	binary.LittleEndian.PutUint32(payload, uint32(len(payload)-walHeader))
+	binary.LittleEndian.PutUint32(payload[4:], crc32.ChecksumIEEE(payload[walHeader:]))
+	return payload, nil
+}
+
+var errWALCorrupt = errors.New("corrupt record")
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	var r walRecord
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 || n >= len(payload) {
+		return r, errWALCorrupt
+	}
+	r.seq, r.op = seq, payload[n]
+	rest := payload[n+1:]
+	switch r.op {
+	case walPut:
+		if err := json.Unmarshal(rest, &r.product); err != nil {
+			return r, errWALCorrupt
+		}
+	case walDelete:
+		id, m := binary.Uvarint(rest)
+		if m <= 0 || m != len(rest) {
+			return r, errWALCorrupt
+		}
+		r.id = ProductID(id)
+	default:
+		return r, errWALCorrupt
+	}
+	return r, nil
+}
+
+func newWriteAheadLog(path string, interval time.Duration) *writeAheadLog {
+	w := &writeAheadLog{path: path, interval: interval}
+	w.synced = sync.NewCond(&w.mu)
+	return w
+}
+
+// prevPath is where a snapshot rotates the log to until it is saved
+func (w *writeAheadLog) prevPath() string {
+	return w.path + ".prev"
+}
+
+// replay applies the records after seq from path.prev, then path, and
+// opens path for appending. At the first record that is cut short, fails
+// its checksum or doesn't follow on from the one before, the file is
+// truncated there with a warning: nothing after a missing record can be
+// applied on top of it. A crash while appending leaves just such a tail.
+func (w *writeAheadLog) replay(after uint64, apply func(walRecord)) error {
+	last := after
+	for _, path := range []string{w.prevPath(), w.path} {
+		good, n, err := w.replayFile(path, &last, after, apply)
+		atomic.AddInt64(&w.replayed, int64(n))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case errors.Is(err, errWALCorrupt):
+			fi, statErr := os.Stat(path)
+			if statErr != nil {
+				return statErr
+			}
+			atomic.AddInt64(&w.corrupt, fi.Size()-good)
+			log.Printf("Warning: write-ahead log %s: %v at byte %d; truncating the %d bytes from there, the mutations they held are lost", path, err, good, fi.Size()-good)
+			adminErrors.record("wal", fmt.Sprintf("%s truncated at byte %d", filepath.Base(path), good))
+			if err := os.Truncate(path, good); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.mu.Lock()
+	w.f, w.seq, w.durable, w.size = f, last, last, fi.Size()
+	w.mu.Unlock()
+	return nil
+}
+
+// replayFile applies path's records after seq after, returning how many
+// bytes of it were good and the records applied. last is the seq the
+// records replayed so far reached: a record after it must be the next.
+func (w *writeAheadLog) replayFile(path string, last *uint64, after uint64, apply func(walRecord)) (int64, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var off int64
+	applied := 0
+	for int(off) < len(data) {
+		rest := data[off:]
+		if len(rest) < walHeader {
+			return off, applied, fmt.Errorf("%w: header cut short", errWALCorrupt)
+		}
+		n := binary.LittleEndian.Uint32(rest)
+		if n > maxWALRecord || int(n) > len(rest)-walHeader {
+			return off, applied, fmt.Errorf("%w: record cut short", errWALCorrupt)
+		}
+		payload := rest[walHeader : walHeader+int(n)]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(rest[4:]) {
+			return off, applied, fmt.Errorf("%w: checksum mismatch", errWALCorrupt)
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			return off, applied, err
+		}
+		if rec.seq > after {
+			if rec.seq != *last+1 {
+				return off, applied, fmt.Errorf("%w: seq %d follows %d", errWALCorrupt, rec.seq, *last)
+			}
+			apply(rec)
+			applied++
+		}
+		if rec.seq > *last {
+			*last = rec.seq
+		}
+		off += walHeader + int64(n)
+	}
+	return off, applied, nil
+}
+
+// append logs rec, giving it the next seq, and fsyncs it unless an
+// interval batches fsyncs; the caller holds the store's mutationLock. A
+// write that fails is cut off the file again, so the log never holds half
+// a record followed by whole ones.
+func (w *writeAheadLog) append(rec walRecord) (uint64, error) {
+	if w == nil {
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed != nil {
+		return 0, w.failed
+	}
+	rec.seq = w.seq + 1
+	b, err := rec.encode()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.f.Write(b); err != nil {
+		if terr := w.f.Truncate(w.size); terr != nil {
+			w.failed = fmt.Errorf("write-ahead log: %v, and couldn't cut the partial record: %v", err, terr)
+			w.synced.Broadcast()
+		}
+		return 0, fmt.Errorf("write-ahead log: %w", err)
+	}
+	w.seq = rec.seq
+	w.size += int64(len(b))
+	atomic.AddInt64(&w.records, 1)
+	if w.interval == 0 {
+		if err := w.fsyncLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return rec.seq, nil
+}
+
+// await blocks until seq is durable, or the log has failed. Only
+// batched fsyncs wait: without an interval append fsynced already.
+func (w *writeAheadLog) await(seq uint64) error {
+	if w == nil || w.interval == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.durable < seq && w.failed == nil {
+		w.synced.Wait()
+	}
+	if w.durable < seq {
+		return w.failed
+	}
+	return nil
+}
+
+// fsyncLocked makes everything appended durable, holding mu throughout
+func (w *writeAheadLog) fsyncLocked() error {
+	start := time.Now()
+	err := w.f.Sync()
+	w.recordFsync(time.Since(start))
+	if err != nil {
+		// The kernel may have dropped the pages it couldn't write, so
+		// a retry that succeeds proves nothing
+		w.failed = fmt.Errorf("write-ahead log fsync: %w", err)
+		w.synced.Broadcast()
+		return w.failed
+	}
+	w.durable = w.seq
+	w.synced.Broadcast()
+	return nil
+}
+
+func (w *writeAheadLog) recordFsync(d time.Duration) {
+	atomic.AddInt64(&w.fsyncs, 1)
+	atomic.AddInt64(&w.fsyncNanos, int64(d))
+	for {
+		max := atomic.LoadInt64(&w.fsyncMax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&w.fsyncMax, max, int64(d)) {
+			break
+		}
+	}
+	w.statsd.timing("wal.fsync", d)
+}
+
+// sync is a batched fsync: appends carry on while it runs, and those it
+// doesn't cover wait for the next
+func (w *writeAheadLog) sync() {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	target, f := w.seq, w.f
+	if target == w.durable || w.failed != nil {
+		w.mu.Unlock()
+		return
+	}
+	w.mu.Unlock()
+	start := time.Now()
+	err := f.Sync()
+	w.recordFsync(time.Since(start))
+	w.mu.Lock()
+	if err != nil {
+		w.failed = fmt.Errorf("write-ahead log fsync: %w", err)
+	} else if target > w.durable {
+		w.durable = target
+	}
+	w.synced.Broadcast()
+	w.mu.Unlock()
+}
+
+// run fsyncs every interval until close
+func (w *writeAheadLog) run() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.sync()
+		case <-w.stopSyncing:
+			return
+		}
+	}
+}
+
+func (w *writeAheadLog) start() {
+	if w.interval > 0 {
+		w.stopSyncing = make(chan struct{})
+		go w.run()
+	}
+}
+
+// rotate moves the log to path.prev for a snapshot about to be taken and
+// starts an empty one, returning the last seq the snapshot will hold. The
+// caller holds the store's mutationLock, so the snapshot is taken at
+// exactly that seq. A path.prev left by a snapshot that failed to save
+// still holds records the new one needs, so it is appended to instead.
+func (w *writeAheadLog) rotate() (uint64, error) {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed != nil {
+		return 0, w.failed
+	}
+	if err := w.fsyncLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		return 0, err
+	}
+	err := w.moveToPrev()
+	f, openErr := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if openErr != nil {
+		w.failed = fmt.Errorf("write-ahead log: %w", openErr)
+		return 0, w.failed
+	}
+	fi, statErr := f.Stat()
+	if statErr != nil {
+		f.Close()
+		w.failed = fmt.Errorf("write-ahead log: %w", statErr)
+		return 0, w.failed
+	}
+	w.f, w.size = f, fi.Size()
+	if err != nil {
+		// The log stays whole where it was, just not rotated
+		return 0, err
+	}
+	atomic.AddInt64(&w.rotations, 1)
+	return w.seq, nil
+}
+
+// moveToPrev renames the log to path.prev, or appends it there
+func (w *writeAheadLog) moveToPrev() error {
+	if _, err := os.Stat(w.prevPath()); os.IsNotExist(err) {
+		if err := os.Rename(w.path, w.prevPath()); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(w.path))
+	}
+	src, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(w.prevPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Truncate(w.path, 0)
+}
+
+// dropPrev removes path.prev once a snapshot holding it is saved
+func (w *writeAheadLog) dropPrev() error {
+	if err := os.Remove(w.prevPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// close fsyncs what is left and closes the file
+func (w *writeAheadLog) close() error {
+	if w == nil {
+		return nil
+	}
+	if w.stopSyncing != nil {
+		close(w.stopSyncing)
+	}
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.failed
+	if err == nil {
+		err = w.fsyncLocked()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	// Writes after shutdown are refused rather than lost
+	w.failed = errors.New("write-ahead log closed")
+	w.synced.Broadcast()
+	return err
+}
+
+func (w *writeAheadLog) stats() map[string]interface{} {
+	if w == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	w.mu.Lock()
+	seq, durable, size, failed := w.seq, w.durable, w.size, w.failed
+	w.mu.Unlock()
+	var prev int64
+	if fi, err := os.Stat(w.prevPath()); err == nil {
+		prev = fi.Size()
+	}
+	fsyncs := atomic.LoadInt64(&w.fsyncs)
+	var mean float64
+	if fsyncs > 0 {
+		mean = durationMS(time.Duration(atomic.LoadInt64(&w.fsyncNanos) / fsyncs))
+	}
+	out := map[string]interface{}{
+		"enabled":          true,
+		"path":             w.path,
+		"sync_interval_ms": w.interval.Milliseconds(),
+		"bytes":            size,
+		"prev_bytes":       prev,
+		"seq":              seq,
+		"durable_seq":      durable,
+		"records":          atomic.LoadInt64(&w.records),
+		"fsyncs":           fsyncs,
+		"fsync_mean_ms":    mean,
+		"fsync_max_ms":     durationMS(time.Duration(atomic.LoadInt64(&w.fsyncMax))),
+		"replayed":         atomic.LoadInt64(&w.replayed),
+		"corrupt_bytes":    atomic.LoadInt64(&w.corrupt),
+		"rotations":        atomic.LoadInt64(&w.rotations),
+	}
+	if failed != nil && w.f != nil {
+		out["failed"] = failed.Error()
+	}
+	return out
+}
+
+// walError is a log failure as a writer answers it: the catalog can't
+// take changes it can't make durable
+func walError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return newError(ErrStoreUnavailable, "The change couldn't be logged: "+err.Error())
+}
+
+// syncDir fsyncs a directory, making a rename in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// catalogSnapshot is the whole catalog as of a WAL seq, saved every
+// Config.CatalogSnapshotInterval and on shutdown, and loaded instead of
+// generating one on start
+type catalogSnapshot struct {
+	Version  int       `json:"version"`
+	Seq      uint64    `json:"seq"`
+	NextID   int64     `json:"next_id"`
+	SavedAt  time.Time `json:"saved_at"`
+	Products []Product `json:"products"`
+}
+
+const catalogSnapshotVersion = 1
+
+// catalogSnapshots saves the catalog and counts how that went
+type catalogSnapshots struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	saved   int64
+	failed  int64
+	lastSeq uint64
+	lastAt  time.Time
+	took    time.Duration
+	stop    chan struct{}
+}
+
+// saveSnapshot captures the catalog at a seq, holding mutationLock only
+// for the capture, saves it and then drops the log it made redundant
+func (s *Server) saveSnapshot() error {
+	snaps := s.catalogSnaps
+	start := time.Now()
+	st := s.store
+	st.mutationLock.Lock()
+	seq, err := st.wal.rotate()
+	if err != nil {
+		st.mutationLock.Unlock()
+		snaps.record(0, 0, err)
+		return err
+	}
+	ids := st.allIDs()
+	sortIDs(ids)
+	snap := catalogSnapshot{Version: catalogSnapshotVersion, Seq: seq, NextID: atomic.LoadInt64(&st.nextID), SavedAt: s.clock.Now().UTC(), Products: make([]Product, 0, len(ids))}
+	for _, id := range ids {
+		if p, ok := st.get(id); ok {
+			snap.Products = append(snap.Products, p)
+		}
+	}
+	st.mutationLock.Unlock()
+
+	if err := writeCatalogSnapshot(snaps.path, &snap); err != nil {
+		snaps.record(0, 0, err)
+		return err
+	}
+	if st.wal != nil {
+		if err := st.wal.dropPrev(); err != nil {
+			snaps.record(0, 0, err)
+			return err
+		}
+	}
+	snaps.record(seq, time.Since(start), nil)
+	return nil
+}
+
+func (c *catalogSnapshots) record(seq uint64, took time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failed++
+		log.Println("Catalog snapshot:", err)
+		adminErrors.record("catalog_snapshot", err.Error())
+		return
+	}
+	c.saved++
+	c.lastSeq, c.lastAt, c.took = seq, time.Now(), took
+}
+
+func writeCatalogSnapshot(path string, snap *catalogSnapshot) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The log it replaces is dropped once this returns, so it must be
+	// on disk first
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func readCatalogSnapshot(path string) (*catalogSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var snap catalogSnapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if snap.Version != catalogSnapshotVersion {
+		return nil, fmt.Errorf("%s: version %d, want %d", path, snap.Version, catalogSnapshotVersion)
+	}
+	return &snap, nil
+}
+
+// runSnapshots saves a snapshot every interval until stopped
+func (s *Server) runSnapshots() {
+	t := time.NewTicker(s.catalogSnaps.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.saveSnapshot()
+		case <-s.catalogSnaps.stop:
+			return
+		}
+	}
+}
+
+func (c *catalogSnapshots) stats() map[string]interface{} {
+	if c == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := map[string]interface{}{
+		"enabled":    true,
+		"path":       c.path,
+		"interval_s": c.interval.Seconds(),
+		"saved":      c.saved,
+		"failed":     c.failed,
+	}
+	if c.saved > 0 {
+		out["last_seq"] = c.lastSeq
+		out["last_saved"] = c.lastAt.UTC().Format(time.RFC3339)
+		out["last_ms"] = durationMS(c.took)
+	}
+	return out
+}
+
+// restoreCatalog loads the catalog snapshot, or generates the catalog
+// when there is none, and replays the write-ahead log on top. Nothing is
+// logged while replaying, and the log is attached to the store only
+// after.
+func (s *Server) restoreCatalog(wal *writeAheadLog) {
+	var after uint64
+	var snap *catalogSnapshot
+	if s.catalogSnaps != nil {
+		var err error
+		snap, err = readCatalogSnapshot(s.catalogSnaps.path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: ignoring catalog snapshot, generating the catalog instead: %v", err)
+			adminErrors.record("catalog_snapshot", err.Error())
+			snap = nil
+		}
+	}
+	start := time.Now()
+	if snap != nil {
+		s.store.restore(snap.Products, snap.NextID)
+		after = snap.Seq
+		log.Printf("%d Products loaded from the snapshot at seq %d in %s\n", s.store.size(), snap.Seq, time.Since(start).Round(time.Millisecond))
+	} else {
+		s.store.generate(s.cfg.NumProducts)
+		log.Printf("%d Products generated in %s\n", s.store.size(), time.Since(start).Round(time.Millisecond))
+	}
+	if wal == nil {
+		return
+	}
+	start = time.Now()
+	err := wal.replay(after, func(rec walRecord) {
+		switch rec.op {
+		case walPut:
+			s.store.put(rec.product)
+		case walDelete:
+			s.store.delete(rec.id)
+		}
+	})
+	if err != nil {
+		// An unreadable log mustn't be appended to, or replayed past
+		log.Fatalf("Write-ahead log %s: %v", wal.path, err)
+	}
+	s.store.wal = wal
+	wal.start()
+	if n := atomic.LoadInt64(&wal.replayed); n > 0 {
+		log.Printf("Replayed %d mutations from the write-ahead log in %s\n", n, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// closeCatalog saves a last snapshot, when snapshots are on, and closes
+// the write-ahead log
+func (s *Server) closeCatalog() {
+	if s.catalogSnaps != nil {
+		if s.catalogSnaps.stop != nil {
+			close(s.catalogSnaps.stop)
+		}
+		if err := s.saveSnapshot(); err == nil {
+			log.Println("Saved the catalog snapshot to", s.catalogSnaps.path)
+		}
+	}
+	if err := s.store.wal.close(); err != nil {
+		log.Println("Closing the write-ahead log:", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openTestWAL replays the log at path, from after on, into a store of
+// three generated products, which then logs its mutations there
+func openTestWAL(t *testing.T, path string, after uint64, interval time.Duration) (*productStore, *writeAheadLog) {
+	t.Helper()
+	st := newProductStore(0)
+	st.generate(3)
+	w := newWriteAheadLog(path, interval)
+	err := w.replay(after, func(rec walRecord) {
+		switch rec.op {
+		case walPut:
+			st.put(rec.product)
+		case walDelete:
+			st.delete(rec.id)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.wal = w
+	return st, w
+}
+
+// TestWALReplay logs mutations, cuts the log off partway through its
+// last record as a crash while appending would, and replays it: the
+// records before the cut must be applied and the torn one truncated, with
+// later writes following on from them. A catalog snapshot must then take
+// over the log, leaving replay only the writes made since.
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal")
+	st, w := openTestWAL(t, path, 0, 0)
+	var sizes []int64
+	logged := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, fi.Size())
+	}
+	_, err := st.put(Product{ID: 10, Name: "Ten", Category: categories[0], Brand: brands[0]})
+	logged(err)
+	created, err := st.create(Product{Name: "Created", Category: categories[1], Brand: brands[1]})
+	logged(err)
+	logged(st.update(Product{ID: 1, Name: "Renamed", Category: categories[1], Brand: brands[1]}))
+	_, err = st.delete(0)
+	logged(err)
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	torn := (sizes[3] - sizes[2]) / 2
+	if err := os.Truncate(path, sizes[2]+torn); err != nil {
+		t.Fatal(err)
+	}
+
+	st, w = openTestWAL(t, path, 0, 0)
+	if n, c := atomic.LoadInt64(&w.replayed), atomic.LoadInt64(&w.corrupt); n != 3 || c != torn {
+		t.Errorf("replayed %d records and truncated %d bytes, want 3 and the torn record's %d", n, c, torn)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != sizes[2] {
+		t.Errorf("log not truncated to the last whole record: %v", err)
+	}
+	p, _ := st.get(1)
+	if _, ok := st.get(10); !ok || p.Name != "Renamed" {
+		t.Errorf("the records before the cut weren't replayed")
+	}
+	if _, ok := st.get(created.ID); !ok {
+		t.Errorf("created product %d lost", created.ID)
+	}
+	if _, ok := st.get(0); !ok {
+		t.Errorf("the torn delete was applied")
+	}
+	if _, err := st.delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if w.seq != 4 {
+		t.Errorf("the write after replay is seq %d, want 4", w.seq)
+	}
+
+	s := &Server{store: st, clock: newManualClock(time.Unix(0, 0)), catalogSnaps: &catalogSnapshots{path: filepath.Join(dir, "catalog.json")}}
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.prevPath()); !os.IsNotExist(err) {
+		t.Errorf("the log the snapshot holds wasn't dropped: %v", err)
+	}
+	if _, err := st.put(Product{ID: 20, Name: "Twenty", Category: categories[0], Brand: brands[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := readCatalogSnapshot(s.catalogSnaps.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Seq != 4 || len(snap.Products) != st.size()-1 {
+		t.Errorf("snapshot at seq %d with %d products, want seq 4 and %d", snap.Seq, len(snap.Products), st.size()-1)
+	}
+	st, w = openTestWAL(t, path, snap.Seq, 0)
+	defer w.close()
+	if n := atomic.LoadInt64(&w.replayed); n != 1 || w.seq != 5 {
+		t.Errorf("replayed %d records up to seq %d after the snapshot, want only the one since", n, w.seq)
+	}
+	if _, ok := st.get(20); !ok {
+		t.Errorf("the write after the snapshot was lost")
+	}
+}
+
+// TestWALBatchedFsync checks batched fsyncs don't acknowledge a write
+// before it is durable, and take fewer fsyncs than writes
+func TestWALBatchedFsync(t *testing.T) {
+	st, w := openTestWAL(t, filepath.Join(t.TempDir(), "wal"), 0, 50*time.Millisecond)
+	w.start()
+	var wg sync.WaitGroup
+	var acked int32
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := st.put(Product{ID: ProductID(100 + i), Name: "Batched", Category: categories[0], Brand: brands[0]}); err != nil {
+				errs <- err
+				return
+			}
+			// Each acknowledged write has a seq of its own, all durable
+			n := atomic.AddInt32(&acked, 1)
+			w.mu.Lock()
+			durable := w.durable
+			w.mu.Unlock()
+			if durable < uint64(n) {
+				errs <- fmt.Errorf("%d writes acknowledged at durable seq %d", n, durable)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if w.durable != w.seq {
+		t.Errorf("batched writes all acknowledged at durable seq %d of %d", w.durable, w.seq)
+	}
+	if fsyncs := atomic.LoadInt64(&w.fsyncs); fsyncs >= 8 {
+		t.Errorf("%d fsyncs for 8 batched writes", fsyncs)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWALChecksum flips a byte in the middle of a log's second record:
+// replay must stop at it, keeping only the first, and cut the rest off
+func TestWALChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	st, w := openTestWAL(t, path, 0, 0)
+	var sizes []int64
+	for i := 0; i < 4; i++ {
+		if _, err := st.put(Product{ID: ProductID(10 + i), Name: "Logged", Category: categories[0], Brand: brands[0]}); err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := os.Stat(path)
+		sizes = append(sizes, fi.Size())
+	}
+	w.close()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[(sizes[0]+sizes[1])/2] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	st, w = openTestWAL(t, path, 0, 0)
+	defer w.close()
+	if n, c := atomic.LoadInt64(&w.replayed), atomic.LoadInt64(&w.corrupt); n != 1 || c != sizes[3]-sizes[0] {
+		t.Errorf("replayed %d records and truncated %d bytes, want 1 and %d", n, c, sizes[3]-sizes[0])
+	}
+	if _, ok := st.get(10); !ok {
+		t.Errorf("the record before the corruption wasn't replayed")
+	}
+	for id := ProductID(11); id < 14; id++ {
+		if _, ok := st.get(id); ok {
+			t.Errorf("product %d, at or after the corruption, was replayed", id)
+		}
+	}
+}
+
+// TestWALRestart changes a server's catalog over HTTP and starts another
+// on its log and snapshot: the second must hold every acknowledged change
+func TestWALRestart(t *testing.T) {
+	dir := t.TempDir()
+	configure := func(cfg *Config) {
+		cfg.WALFile, cfg.CatalogSnapshotFile = filepath.Join(dir, "wal"), filepath.Join(dir, "catalog.json")
+	}
+	s := newTestServer(t, configure)
+	h := s.Routes()
+	for _, req := range []struct{ method, target, body string }{
+		{http.MethodPost, "/v1/products", `{"name":"Durable","category":"Books","brand":"Alpha"}`},
+		{http.MethodDelete, "/v1/products/3", ""},
+	} {
+		if rec := serve(h, req.method, req.target, req.body, http.Header{"Content-Type": {"application/json"}}); rec.Code >= 300 {
+			t.Fatalf("%s %s: %d %s", req.method, req.target, rec.Code, rec.Body)
+		}
+	}
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// After the snapshot, so the second server needs the log as well
+	if rec := serve(h, http.MethodDelete, "/v1/products/4", "", nil); rec.Code >= 300 {
+		t.Fatalf("DELETE /v1/products/4: %d %s", rec.Code, rec.Body)
+	}
+	s.store.wal.close()
+
+	s = newTestServer(t, configure)
+	defer s.store.wal.close()
+	if s.store.size() != testProducts-1 || atomic.LoadInt64(&s.store.wal.replayed) != 1 {
+		t.Errorf("restarted with %d products after replaying %d records", s.store.size(), s.store.wal.replayed)
+	}
+	for id, want := range map[ProductID]bool{3: false, 4: false, testProducts: true} {
+		if _, ok := s.store.get(id); ok != want {
+			t.Errorf("after the restart, product %d present %v", id, ok)
+		}
+	}
+}
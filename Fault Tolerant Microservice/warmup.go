@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache warmup states, as /readyz reports them
+const (
+	warmupPending  = "pending"
+	warmupRunning  = "running"
+	warmupDone     = "done"
+	warmupTimedOut = "timed_out"
+	warmupSkipped  = "skipped"
+)
+
+// savedQuery is one of the most requested cached searches, as the state
+// file keeps it for the next start's warmup. Its fields are the parts of
+// the search key, which a replay reproduces.
+type savedQuery struct {
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Locale string `json:"locale"`
+	Accept string `json:"accept,omitempty"`
+	Count  int64  `json:"count"`
+}
+
+// popularQueries returns the Config.CacheWarmup most requested cached
+// searches, most requested first, nil when nothing tracks them
+func (s *Server) popularQueries() []savedQuery {
+	if s.popular == nil {
+		return nil
+	}
+	top, _ := s.popular.top()
+	if len(top) > s.cfg.CacheWarmup {
+		top = top[:s.cfg.CacheWarmup]
+	}
+	out := make([]savedQuery, 0, len(top))
+	for _, c := range top {
+		// Searches made with X-Features aren't replayed: the flags, and
+		// any refusal the response warned of, aren't kept
+		parts := strings.Split(c.Query, "\x00")
+		if len(parts) != 5 || parts[4] != "" {
+			continue
+		}
+		out = append(out, savedQuery{Path: parts[0], Query: parts[1], Locale: parts[2], Accept: parts[3], Count: c.Count})
+	}
+	return out
+}
+
+// request builds the search q stands for. The locale goes in lang, which
+// takes precedence over Accept-Language, so the replay has the same
+// search key as the requests it was counted from.
+func (q savedQuery) request(ctx context.Context) *http.Request {
+	v, _ := url.ParseQuery(q.Query)
+	v.Set("lang", q.Locale)
+	r := httptest.NewRequest(http.MethodGet, q.Path+"?"+v.Encode(), nil).WithContext(ctx)
+	if q.Accept != "" {
+		r.Header.Set("Accept", q.Accept)
+	}
+	return r
+}
+
+// cacheWarmup tracks the replay of the previous run's popular searches.
+// Counters are updated atomically while it runs; the rest is fixed once
+// it starts.
+type cacheWarmup struct {
+	queries []savedQuery
+	state   atomic.Value // string
+	started time.Time
+	// elapsed is set before the final state
+	elapsed  int64
+	replayed int64
+	failed   int64
+	canceled int64
+}
+
+// planWarmup takes the restored queries. Until the warmup ends the
+// instance isn't ready, so set it up before the catalog loads.
+func (s *Server) planWarmup(queries []savedQuery) {
+	if s.popular == nil || len(queries) == 0 {
+		return
+	}
+	if len(queries) > s.cfg.CacheWarmup {
+		queries = queries[:s.cfg.CacheWarmup]
+	}
+	wu := &cacheWarmup{queries: queries}
+	wu.state.Store(warmupPending)
+	s.warmup = wu
+	atomic.StoreInt32(&s.warming, 1)
+}
+
+// WarmCache starts replaying the planned searches, once the catalog is
+// loaded, and lets readiness flip when they are done. Replays go through
+// the routes like any search, so they are coalesced, limited and counted
+// as client ones are; with reads behind auth they would all be refused,
+// so the warmup is skipped.
+func (s *Server) WarmCache() {
+	wu := s.warmup
+	if wu == nil {
+		return
+	}
+	wu.started = time.Now()
+	if s.authEnabled() && s.cfg.RequireAuthForReads {
+		wu.state.Store(warmupSkipped)
+		log.Println("Cache warmup skipped: searches require an API key")
+		atomic.StoreInt64(&wu.elapsed, int64(time.Since(wu.started)))
+		s.endWarmup()
+		return
+	}
+	wu.state.Store(warmupRunning)
+	log.Printf("Warming the response cache with %d searches", len(wu.queries))
+	go s.runWarmup(wu)
+}
+
+func (s *Server) endWarmup() {
+	atomic.StoreInt32(&s.warming, 0)
+	s.updateReadiness()
+}
+
+// runWarmup replays wu's searches into the response cache,
+// Config.CacheWarmupConcurrency at a time. Whatever hasn't run after
+// Config.CacheWarmupMaxDelay is abandoned, so a slow catalog can't keep
+// the instance out of rotation.
+func (s *Server) runWarmup(wu *cacheWarmup) {
+	defer s.endWarmup()
+	ctx := context.Background()
+	if s.cfg.CacheWarmupMaxDelay > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.CacheWarmupMaxDelay)
+		defer cancel()
+	}
+
+	work := make(chan savedQuery)
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, s.cfg.CacheWarmupConcurrency); i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for q := range work {
+				r := q.request(ctx)
+				r.RemoteAddr = "warmup:" + strconv.Itoa(n)
+				rec := httptest.NewRecorder()
+				s.mux.ServeHTTP(rec, r)
+				switch {
+				case rec.Code == http.StatusOK:
+					atomic.AddInt64(&wu.replayed, 1)
+				case ctx.Err() != nil:
+					atomic.AddInt64(&wu.canceled, 1)
+				default:
+					atomic.AddInt64(&wu.failed, 1)
+				}
+			}
+		}(i)
+	}
+	sent := 0
+feed:
+	for _, q := range wu.queries {
+		select {
+		case work <- q:
+			sent++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	atomic.AddInt64(&wu.canceled, int64(len(wu.queries)-sent))
+
+	state := warmupDone
+	if ctx.Err() != nil {
+		state = warmupTimedOut
+	}
+	elapsed := time.Since(wu.started)
+	atomic.StoreInt64(&wu.elapsed, int64(elapsed))
+	wu.state.Store(state)
+	log.Printf("Cache warmup %s in %s: %d of %d searches replayed, %d failed, %d abandoned",
+		state, elapsed.Round(time.Millisecond), atomic.LoadInt64(&wu.replayed), len(wu.queries),
+		atomic.LoadInt64(&wu.failed), atomic.LoadInt64(&wu.canceled))
+}
+
+// warmupStatus is the warmup's progress for /readyz, nil when there is
+// none
+func (s *Server) warmupStatus() map[string]interface{} {
+	wu := s.warmup
+	if wu == nil {
+		return nil
+	}
+	var elapsed time.Duration
+	switch wu.state.Load() {
+	case warmupPending:
+	case warmupRunning:
+		elapsed = time.Since(wu.started)
+	default:
+		elapsed = time.Duration(atomic.LoadInt64(&wu.elapsed))
+	}
+	return map[string]interface{}{
+		"state":        wu.state.Load(),
+		"total":        len(wu.queries),
+		"replayed":     atomic.LoadInt64(&wu.replayed),
+		"failed":       atomic.LoadInt64(&wu.failed),
+		"abandoned":    atomic.LoadInt64(&wu.canceled),
+		"elapsed_ms":   durationMS(elapsed),
+		"max_delay_ms": durationMS(s.cfg.CacheWarmupMaxDelay),
+	}
+}
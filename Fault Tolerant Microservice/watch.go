@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxWatchers      int32 = 100
+	watchBuffer            = 256
+	watchPingPeriod        = 30 * time.Second
+	watchPongWait          = 60 * time.Second
+	watchWriteWait         = 10 * time.Second
+	watchMaxSnapshot       = 100
+)
+
+// watchRequest is the message a client sends to start or change a watch
+type watchRequest struct {
+	Q     string `json:"q"`
+	Limit int    `json:"limit"`
+}
+
+// watchStart is a validated watchRequest, handed from the reader to the
+// writer
+type watchStart struct {
+	query *watchQuery
+	limit int
+}
+
+// watchMessage is every message the server sends on a watch connection.
+// initial and resync carry the current match set, add/remove/update a
+// single product.
+type watchMessage struct {
+	Type     string    `json:"type"`
+	Query    string    `json:"query,omitempty"`
+	Total    int       `json:"total,omitempty"`
+	Products []Product `json:"products,omitempty"`
+	Product  *Product  `json:"product,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// watchQuery is a watch's q, prepared as a search prepares its own so a
+// watch matches exactly what the same search would
+type watchQuery struct {
+	q               string
+	text            searchText
+	brand, category string
+}
+
+// newWatchQuery parses q in locale, folding as fold says, or returns why
+// it can't be watched. Stock isn't in any catalog change, so unlike
+// search a watch can't compare it.
+func newWatchQuery(q, locale string, fold bool) (watchQuery, string) {
+	pq := parseQuery(q)
+	var errs fieldErrors
+	brand, category := mergeScopes(nil, pq, &errs)
+	price, stock := readRanges(nil, pq, &errs)
+	if stock.set() {
+		errs.add("q", "q compares stock, which a watch can't follow")
+	}
+	if len(errs) > 0 {
+		return watchQuery{}, errs[0].Message
+	}
+	wq := watchQuery{q: strings.TrimSpace(q), text: newSearchText(pq, locale, fold), brand: brand, category: category}
+	wq.text.price = price
+	return wq, ""
+}
+
+func (wq watchQuery) matches(sp *storedProduct) bool {
+	return sp.scanMatch(wq.text, wq.brand, wq.category) == ""
+}
+
+// eventProduct is p, from an event, named in wq's locale, or false if it
+// is nil or doesn't match
+func (wq watchQuery) eventProduct(p *Product) (*Product, bool) {
+	if p == nil {
+		return nil, false
+	}
+	sp := newStoredProduct(*p)
+	if !wq.matches(&sp) {
+		return nil, false
+	}
+	named := sp.localized(wq.text.locale)
+	return &named, true
+}
+
+// watchSnapshot scans the whole catalog for wq. Unlike search it is
+// exhaustive, since deltas are only meaningful against the full match set.
+func watchSnapshot(store *productStore, kind string, wq watchQuery, limit int) watchMessage {
+	msg := watchMessage{Type: kind, Query: wq.q, Products: make([]Product, 0, limit)}
+	store.scan(func(sp *storedProduct) bool {
+		if wq.matches(sp) {
+			msg.Total++
+			if len(msg.Products) < limit {
+				msg.Products = append(msg.Products, sp.localized(wq.text.locale))
+			}
+		}
+		return true
+	})
+	return msg
+}
+
+// watchDelta turns a mutation into an add/remove/update for wq, or
+// returns false when the match set is unaffected
+func watchDelta(ev productEvent, wq watchQuery) (watchMessage, bool) {
+	old, was := wq.eventProduct(ev.Old)
+	cur, is := wq.eventProduct(ev.Product)
+	switch {
+	case !was && is:
+		return watchMessage{Type: "add", Product: cur}, true
+	case was && !is:
+		return watchMessage{Type: "remove", Product: old}, true
+	case was && is:
+		return watchMessage{Type: "update", Product: cur}, true
+	}
+	return watchMessage{}, false
+}
+
+// watchHandler upgrades to a WebSocket and streams match set changes for
+// the query the client sends
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && len(s.cfg.CORSOrigins) > 0 &&
+		!originAllowed(origin, s.cfg.CORSOrigins) && !strings.HasSuffix(origin, "://"+r.Host) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if atomic.AddInt32(&s.watchers, 1) > maxWatchers {
+		atomic.AddInt32(&s.watchers, -1)
+		http.Error(w, "Too many watch connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt32(&s.watchers, -1)
+
+	// The query comes later, in a message; how to match it comes with
+	// the upgrade, as for a search
+	var errs fieldErrors
+	fold, locale := readFold(r.URL.Query(), &errs), resolveLocale(r)
+	if err := errs.err(); err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	// Subscribe before any snapshot so no mutation falls between the two
+	sub, _ := s.store.events.subscribe(subscriberWatch, watchBuffer, overflowDropOldest)
+	defer s.store.events.unsubscribe(sub)
+
+	var query *watchQuery
+	limit := s.cfg.MaxResults
+	requests := make(chan watchStart, 1)
+	done := make(chan struct{})
+
+	send := func(m watchMessage) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return ws.writeText(b, time.Now().Add(watchWriteWait))
+	}
+
+	// Reader: query messages and keepalive. Any frame extends the deadline.
+	go func() {
+		defer close(done)
+		extend := func() { ws.conn.SetReadDeadline(time.Now().Add(watchPongWait)) }
+		extend()
+		for {
+			_, msg, err := ws.readMessage(extend)
+			if err != nil {
+				if errors.Is(err, errWSMessageTooBig) {
+					ws.writeClose(wsCloseTooBig, "message too big")
+				} else if err != io.EOF {
+					ws.writeClose(wsCloseProtocol, "")
+				}
+				return
+			}
+			extend()
+			var req watchRequest
+			if err := json.Unmarshal(msg, &req); err != nil || strings.TrimSpace(req.Q) == "" {
+				send(watchMessage{Type: "error", Message: `expected {"q":"term","limit":20}`})
+				continue
+			}
+			wq, bad := newWatchQuery(req.Q, locale, fold)
+			if bad != "" {
+				send(watchMessage{Type: "error", Message: bad})
+				continue
+			}
+			select {
+			case <-requests:
+			default:
+			}
+			requests <- watchStart{&wq, req.Limit}
+		}
+	}()
+
+	ping := time.NewTicker(watchPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case start := <-requests:
+			query = start.query
+			limit = s.cfg.MaxResults
+			if start.limit > 0 {
+				limit = min(start.limit, watchMaxSnapshot)
+			}
+			// The snapshot already reflects anything queued so far
+			sub.takeOverflow()
+			for len(sub.C) > 0 {
+				<-sub.C
+			}
+			if err := send(watchSnapshot(s.store, "initial", *query, limit)); err != nil {
+				return
+			}
+		case ev := <-sub.C:
+			if query == nil {
+				continue
+			}
+			// Once the buffer overflowed the deltas are incomplete, so
+			// discard what is queued and resend the set
+			if sub.takeOverflow() {
+				for len(sub.C) > 0 {
+					<-sub.C
+				}
+				if err := send(watchSnapshot(s.store, "resync", *query, limit)); err != nil {
+					return
+				}
+				continue
+			}
+			if m, ok := watchDelta(ev, *query); ok {
+				if err := send(m); err != nil {
+					return
+				}
+			}
+		case <-ping.C:
+			if err := ws.writeFrame(wsOpPing, nil, time.Now().Add(watchWriteWait)); err != nil {
+				log.Println("Watch ping failed:", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWatchTestServer is the priced catalog and two Beta products, one
+// with an accent to fold and one named in German
+func newWatchTestServer(t *testing.T) *Server {
+	s := newPricedTestServer(t, nil)
+	price := 500
+	for _, p := range []Product{
+		{Name: "Épée Lamp", Category: "Home", Brand: "Beta", Price: &price},
+		{Name: "Floor Light", Names: map[string]string{"de": "Stehlampe"}, Category: "Garden", Brand: "Beta"},
+	} {
+		if _, err := s.store.create(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// TestWatchMatchesSearch holds each watch snapshot to the exhaustive
+// search with the same q, lang and fold
+func TestWatchMatchesSearch(t *testing.T) {
+	s := newWatchTestServer(t)
+	h := s.Routes()
+	for _, c := range []struct {
+		q, lang string
+		fold    bool
+		want    []ProductID
+	}{
+		{"lamp", "en", true, []ProductID{0, 1, 2, 3, 4, 6}},
+		{"lamp", "de", true, []ProductID{0, 1, 2, 3, 4, 6, 7}},
+		{"LAMP", "en", true, []ProductID{0, 1, 2, 3, 4, 6}},
+		{"epee", "en", true, []ProductID{6}},
+		{"epee", "en", false, nil},
+		{"brand:beta", "en", true, []ProductID{6, 7}},
+		{"lamp brand:beta", "en", true, []ProductID{6}},
+		{"category:garden light", "en", true, []ProductID{7}},
+		{"lamp price:<2000", "en", true, []ProductID{1, 2, 6}},
+		{"price:2000..", "en", true, []ProductID{3, 4, 5}},
+		{"lamp -brand:alpha", "en", true, []ProductID{6}},
+	} {
+		wq, bad := newWatchQuery(c.q, c.lang, c.fold)
+		if bad != "" {
+			t.Errorf("q=%s: %s", c.q, bad)
+			continue
+		}
+		msg := watchSnapshot(s.store, "initial", wq, 20)
+		target := fmt.Sprintf("/products/search?mode=exhaustive&sort=id&lang=%s&fold=%t&q=%s", c.lang, c.fold, url.QueryEscape(c.q))
+		res := search(t, h, target)
+		if got := productIDs(msg.Products); !equalIDs(got, c.want) || msg.Total != len(c.want) {
+			t.Errorf("q=%s lang=%s fold=%t: watch has %v of %d, want %v", c.q, c.lang, c.fold, got, msg.Total, c.want)
+		}
+		if got := productIDs(res.Products); !equalIDs(got, c.want) {
+			t.Errorf("%s: search found %v, want %v", target, got, c.want)
+		}
+	}
+	// Names are in the watch's language
+	wq, _ := newWatchQuery("stehlampe", "de", true)
+	if msg := watchSnapshot(s.store, "initial", wq, 20); len(msg.Products) != 1 || msg.Products[0].Name != "Stehlampe" {
+		t.Errorf("a German watch got %+v", msg.Products)
+	}
+	for _, q := range []string{"stock:>1", "lamp price:<>5"} {
+		if _, bad := newWatchQuery(q, "en", true); bad == "" {
+			t.Errorf("q=%s could be watched", q)
+		}
+	}
+}
+
+func TestWatchDelta(t *testing.T) {
+	wq, _ := newWatchQuery("lamp price:<2000", "de", true)
+	at := func(price int) *Product {
+		return &Product{ID: 2, Name: "Table Lamp", Names: map[string]string{"de": "Tischlampe"}, Brand: "Alpha", Price: &price}
+	}
+	for _, c := range []struct {
+		name     string
+		ev       productEvent
+		kind     string
+		wantName string
+	}{
+		{"create in range", productEvent{Product: at(100)}, "add", "Tischlampe"},
+		{"create out of range", productEvent{Product: at(2000)}, "", ""},
+		{"price rises out of range", productEvent{Old: at(1999), Product: at(2000)}, "remove", "Tischlampe"},
+		{"price falls into range", productEvent{Old: at(2001), Product: at(1500)}, "add", "Tischlampe"},
+		{"price changes in range", productEvent{Old: at(100), Product: at(200)}, "update", "Tischlampe"},
+		{"delete in range", productEvent{Old: at(100)}, "remove", "Tischlampe"},
+	} {
+		m, ok := watchDelta(c.ev, wq)
+		if c.kind == "" {
+			if ok {
+				t.Errorf("%s: sent %s", c.name, m.Type)
+			}
+			continue
+		}
+		if !ok || m.Type != c.kind || m.Product == nil || m.Product.Name != c.wantName {
+			t.Errorf("%s: sent %v %+v, want %s of %s", c.name, ok, m, c.kind, c.wantName)
+		}
+	}
+}
+
+// TestWatchHandler upgrades a real connection, watches a folded query
+// and sees a new product arrive
+func TestWatchHandler(t *testing.T) {
+	s := newWatchTestServer(t)
+	ts := httptest.NewServer(s.Routes())
+	defer ts.Close()
+
+	if rec := serve(s.Routes(), http.MethodGet, "/products/search/watch?fold=maybe", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("fold=maybe: %d, want 400", rec.Code)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /v1/products/search/watch HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6455 1.3's accept for its sample key
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("upgrade: %d accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	next := func() watchMessage {
+		t.Helper()
+		_, op, payload := serverFrame(t, br)
+		var m watchMessage
+		if op != wsOpText || json.Unmarshal(payload, &m) != nil {
+			t.Fatalf("op %d %q, want a text message", op, payload)
+		}
+		return m
+	}
+
+	conn.Write(clientFrame(true, wsOpText, []byte(`{"q":"stock:>1"}`), testMask))
+	if m := next(); m.Type != "error" {
+		t.Errorf("watching stock: %+v", m)
+	}
+	conn.Write(clientFrame(true, wsOpText, []byte(`{"q":"epee"}`), testMask))
+	if m := next(); m.Type != "initial" || m.Total != 1 || m.Products[0].ID != 6 {
+		t.Errorf("initial %+v", m)
+	}
+	if _, err := s.store.create(Product{Name: "Epee Stand", Category: "Home", Brand: "Gamma"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := next(); m.Type != "add" || m.Product == nil || m.Product.Name != "Epee Stand" {
+		t.Errorf("after a create %+v", m)
+	}
+	conn.Write(clientFrame(true, wsOpClose, nil, testMask))
+	if _, op, _ := serverFrame(t, br); op != wsOpClose {
+		t.Errorf("answered a close with op %d", op)
+	}
+}
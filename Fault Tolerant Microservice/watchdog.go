@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureDirPrefix names the watchdog's capture directories; pruning only
+// ever removes entries with it
+const captureDirPrefix = "capture-"
+
+// watchdogSample is one reading of the process
+type watchdogSample struct {
+	Time       time.Time `json:"time"`
+	HeapInuse  uint64    `json:"heap_inuse_bytes"`
+	Goroutines int       `json:"goroutines"`
+	SchedLagMs float64   `json:"sched_lag_ms"`
+	Breaches   []string  `json:"breaches,omitempty"`
+}
+
+// watchdogCapture is one profile capture and why it was taken
+type watchdogCapture struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Dir    string    `json:"dir,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Done   bool      `json:"done"`
+}
+
+// watchdog samples heap in use, the goroutine count and scheduler lag,
+// how late its own timer fired, every interval. When a threshold is
+// breached it writes a heap and a CPU profile into a new directory under
+// dir, keeping the newest keep of them. Captures are at least minGap
+// apart, so a problem that persists produces one capture per gap rather
+// than one per sample. It reads the real clock: lag under a frozen clock
+// would mean nothing.
+type watchdog struct {
+	dir         string
+	interval    time.Duration
+	heapLimit   uint64
+	goroutines  int
+	lagLimit    time.Duration
+	keep        int
+	minGap      time.Duration
+	cpuDuration time.Duration
+	statsd      *statsdClient
+
+	mu         sync.Mutex
+	last       watchdogSample
+	samples    int64
+	breaches   int64
+	captures   int64
+	suppressed int64
+	// lastCapture is the newest capture, running or finished
+	lastCapture *watchdogCapture
+	// diskOK, if set, is asked before each capture; captures pause while
+	// it says persistence is degraded
+	diskOK  func() bool
+	lowDisk int64
+}
+
+func newWatchdog(cfg Config) (*watchdog, error) {
+	if cfg.WatchdogInterval <= 0 || cfg.WatchdogKeep < 1 || cfg.WatchdogCPU <= 0 {
+		return nil, fmt.Errorf("watchdog: interval and cpu profile duration must be positive and keep at least 1")
+	}
+	if cfg.WatchdogHeapBytes == 0 && cfg.WatchdogGoroutines == 0 && cfg.WatchdogLag == 0 {
+		return nil, fmt.Errorf("watchdog: set at least one of the heap, goroutine and lag thresholds")
+	}
+	if err := os.MkdirAll(cfg.WatchdogDir, 0o755); err != nil {
+		return nil, fmt.Errorf("watchdog: %w", err)
+	}
+	return &watchdog{
+		dir:         cfg.WatchdogDir,
+		interval:    cfg.WatchdogInterval,
+		heapLimit:   cfg.WatchdogHeapBytes,
+		goroutines:  cfg.WatchdogGoroutines,
+		lagLimit:    cfg.WatchdogLag,
+		keep:        cfg.WatchdogKeep,
+		minGap:      cfg.WatchdogMinGap,
+		cpuDuration: cfg.WatchdogCPU,
+	}, nil
+}
+
+// run samples forever. The lag is measured against the timer's own
+// deadline, so a starved scheduler or a long stop-the-world shows up even
+// when nothing else is slow.
+func (wd *watchdog) run() {
+	for {
+		due := time.Now().Add(wd.interval)
+		time.Sleep(wd.interval)
+		lag := time.Since(due)
+		if lag < 0 {
+			lag = 0
+		}
+		wd.check(wd.sample(lag))
+	}
+}
+
+func (wd *watchdog) sample(lag time.Duration) watchdogSample {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	sm := watchdogSample{
+		Time:       time.Now().UTC(),
+		HeapInuse:  ms.HeapInuse,
+		Goroutines: runtime.NumGoroutine(),
+		SchedLagMs: float64(lag) / float64(time.Millisecond),
+	}
+	if wd.heapLimit > 0 && sm.HeapInuse > wd.heapLimit {
+		sm.Breaches = append(sm.Breaches, fmt.Sprintf("heap in use %dMB over %dMB", sm.HeapInuse>>20, wd.heapLimit>>20))
+	}
+	if wd.goroutines > 0 && sm.Goroutines > wd.goroutines {
+		sm.Breaches = append(sm.Breaches, fmt.Sprintf("%d goroutines over %d", sm.Goroutines, wd.goroutines))
+	}
+	if wd.lagLimit > 0 && lag > wd.lagLimit {
+		sm.Breaches = append(sm.Breaches, fmt.Sprintf("scheduler lag %s over %s", lag.Round(time.Millisecond), wd.lagLimit))
+	}
+	return sm
+}
+
+// check records a sample and starts a capture if it breached a threshold
+// and the last capture is far enough back
+func (wd *watchdog) check(sm watchdogSample) {
+	wd.mu.Lock()
+	wd.samples++
+	if len(sm.Breaches) == 0 {
+		wd.last = sm
+		wd.mu.Unlock()
+		return
+	}
+	wd.last = sm
+	wd.breaches++
+	prev := wd.lastCapture
+	if prev != nil && (!prev.Done || time.Since(prev.Time) < wd.minGap) {
+		wd.suppressed++
+		wd.mu.Unlock()
+		return
+	}
+	if wd.diskOK != nil && !wd.diskOK() {
+		wd.lowDisk++
+		wd.mu.Unlock()
+		return
+	}
+	c := &watchdogCapture{Time: time.Now().UTC(), Reason: strings.Join(sm.Breaches, "; ")}
+	wd.lastCapture = c
+	wd.captures++
+	wd.mu.Unlock()
+	// The CPU profile takes a while; sampling carries on meanwhile
+	go wd.capture(c)
+}
+
+// capture takes c's profiles and records the outcome in the admin error
+// ring
+func (wd *watchdog) capture(c *watchdogCapture) {
+	log.Println("Watchdog:", c.Reason, "- capturing profiles")
+	dir, err := wd.writeProfiles(c.Time)
+	msg := c.Reason + ": profiles in " + dir
+	if err != nil {
+		msg = c.Reason + ": capture failed: " + err.Error()
+	}
+	wd.mu.Lock()
+	c.Dir, c.Done = dir, true
+	if err != nil {
+		c.Error = err.Error()
+	}
+	wd.mu.Unlock()
+	adminErrors.record("watchdog", msg)
+	wd.statsd.incr("watchdog.capture")
+}
+
+// writeProfiles writes heap.pprof straight away, then cpu.pprof over
+// cpuDuration, and prunes old captures. The CPU profile fails if one is
+// already being taken elsewhere in the process; the heap profile is kept.
+func (wd *watchdog) writeProfiles(at time.Time) (string, error) {
+	dir := filepath.Join(wd.dir, captureDirPrefix+at.Format("20060102T150405.000Z"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	defer wd.prune()
+	if err := writeProfile(filepath.Join(dir, "heap.pprof"), func(f *os.File) error {
+		return pprof.Lookup("heap").WriteTo(f, 0)
+	}); err != nil {
+		return dir, fmt.Errorf("heap profile: %w", err)
+	}
+	if err := writeProfile(filepath.Join(dir, "cpu.pprof"), func(f *os.File) error {
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		time.Sleep(wd.cpuDuration)
+		pprof.StopCPUProfile()
+		return nil
+	}); err != nil {
+		return dir, fmt.Errorf("cpu profile: %w", err)
+	}
+	return dir, nil
+}
+
+func writeProfile(path string, write func(*os.File) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// prune removes all but the newest keep captures. The names sort by time.
+func (wd *watchdog) prune() {
+	names := wd.captureNames()
+	for len(names) > wd.keep {
+		if err := os.RemoveAll(filepath.Join(wd.dir, names[0])); err != nil {
+			log.Println("Watchdog prune:", err)
+		}
+		names = names[1:]
+	}
+}
+
+// captureNames lists the capture directories, oldest first
+func (wd *watchdog) captureNames() []string {
+	entries, err := os.ReadDir(wd.dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), captureDirPrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) watchdogHandler(w http.ResponseWriter, r *http.Request) {
+	wd := s.watchdog
+	if wd == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	wd.mu.Lock()
+	last, samples, breaches, captures, suppressed, lowDisk := wd.last, wd.samples, wd.breaches, wd.captures, wd.suppressed, wd.lowDisk
+	var lastCapture *watchdogCapture
+	if wd.lastCapture != nil {
+		c := *wd.lastCapture
+		lastCapture = &c
+	}
+	wd.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":  true,
+		"dir":      wd.dir,
+		"interval": wd.interval.String(),
+		"thresholds": map[string]interface{}{
+			"heap_inuse_bytes": wd.heapLimit,
+			"goroutines":       wd.goroutines,
+			"sched_lag":        wd.lagLimit.String(),
+		},
+		"keep":         wd.keep,
+		"min_gap":      wd.minGap.String(),
+		"samples":      samples,
+		"breaches":     breaches,
+		"captures":     captures,
+		"suppressed":   suppressed,
+		"low_disk":     lowDisk,
+		"last":         last,
+		"last_capture": lastCapture,
+		"stored":       wd.captureNames(),
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// webhookTarget is one configured receiver. Events filters which events
+// it receives; empty means all of them.
+type webhookTarget struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+
+	delivered  int64
+	failed     int64
+	deadLetter int64
+	dropped    int64
+}
+
+type webhookDelivery struct {
+	target *webhookTarget
+	event  string
+	body   []byte
+}
+
+// webhookSender queues events for its targets, for its workers to
+// deliver. A nil sender drops everything, which is how webhooks are off
+// when no targets are configured.
+type webhookSender struct {
+	targets []*webhookTarget
+	queue   chan webhookDelivery
+}
+
+var (
+	webhookQueueSize   = 256
+	webhookMaxAttempts = 4
+	webhookBackoff     = 500 * time.Millisecond
+	webhookClient      = &http.Client{Timeout: 5 * time.Second}
+)
+
+// loadWebhooks reads a JSON array of targets
+func loadWebhooks(file string) ([]*webhookTarget, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*webhookTarget
+	if err := json.Unmarshal(b, &targets); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, t := range targets {
+		if !strings.HasPrefix(t.URL, "http://") && !strings.HasPrefix(t.URL, "https://") {
+			return nil, fmt.Errorf("webhook URL %q must be http or https", t.URL)
+		}
+	}
+	return targets, nil
+}
+
+// newWebhookSender loads the targets in file; nil when there are none
+func newWebhookSender(file string) (*webhookSender, error) {
+	targets, err := loadWebhooks(file)
+	if err != nil || len(targets) == 0 {
+		return nil, err
+	}
+	return &webhookSender{targets: targets, queue: make(chan webhookDelivery, webhookQueueSize)}, nil
+}
+
+func (t *webhookTarget) wants(event string) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, e := range t.Events {
+		if e == event || (strings.HasSuffix(e, ".*") && strings.HasPrefix(event, strings.TrimSuffix(e, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queues an event for every interested target. It never blocks:
+// when the queue is full the delivery is dropped and counted.
+func (h *webhookSender) notify(event string, data map[string]interface{}) {
+	if h == nil {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"service":   "productsearch",
+		"data":      data,
+	})
+	if err != nil {
+		return
+	}
+	for _, t := range h.targets {
+		if !t.wants(event) {
+			continue
+		}
+		select {
+		case h.queue <- webhookDelivery{target: t, event: event, body: body}:
+		default:
+			atomic.AddInt64(&t.dropped, 1)
+			atomic.AddInt64(&t.deadLetter, 1)
+			adminErrors.record("webhook", fmt.Sprintf("%s to %s dropped: queue full", event, t.URL))
+		}
+	}
+}
+
+// productWebhookBuffer is how many mutations the product webhook
+// forwarder may fall behind by before it catches up from the log
+const productWebhookBuffer = 256
+
+// wantsProducts reports whether any target takes catalog mutations, so
+// main only subscribes the forwarder when they'd go somewhere
+func (h *webhookSender) wantsProducts() bool {
+	if h == nil {
+		return false
+	}
+	for _, t := range h.targets {
+		for _, typ := range []string{eventCreated, eventUpdated, eventDeleted} {
+			if t.wants("product." + typ) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardProducts delivers every mutation sub receives as a
+// product.<type> webhook, after last. After an overflow it replays the
+// log from the last one sent, so each goes out at least once while the
+// log holds it; past that it sends catalog.resync with the sequence to
+// sync from, for receivers to refetch. main runs it for the life of the
+// process.
+func (h *webhookSender) forwardProducts(events *eventBus, sub *eventSub, last int64) {
+	send := func(ev productEvent) {
+		if ev.ID <= last {
+			return
+		}
+		last = ev.ID
+		data := map[string]interface{}{"seq": ev.ID}
+		if ev.Product != nil {
+			data["id"], data["product"] = ev.Product.ID, ev.Product
+		}
+		if ev.Old != nil {
+			data["id"], data["old"] = ev.Old.ID, ev.Old
+		}
+		h.notify("product."+ev.Type, data)
+	}
+	for ev := range sub.C {
+		if sub.takeOverflow() {
+			evs, ok := events.since(last)
+			if !ok {
+				last = events.lastID()
+				h.notify("catalog.resync", map[string]interface{}{"seq": last})
+			}
+			for _, e := range evs {
+				send(e)
+			}
+		}
+		send(ev)
+	}
+}
+
+// worker delivers queued events with bounded retries
+func (h *webhookSender) worker() {
+	for d := range h.queue {
+		d.deliver()
+	}
+}
+
+func (d webhookDelivery) deliver() {
+	var lastErr error
+	for attempt := 0; attempt < webhookMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(webhookBackoff << (attempt - 1))
+		}
+		if lastErr = d.post(); lastErr == nil {
+			atomic.AddInt64(&d.target.delivered, 1)
+			return
+		}
+		atomic.AddInt64(&d.target.failed, 1)
+	}
+	atomic.AddInt64(&d.target.deadLetter, 1)
+	msg := fmt.Sprintf("%s to %s failed after %d attempts: %v", d.event, d.target.URL, webhookMaxAttempts, lastErr)
+	log.Println("Webhook", msg)
+	adminErrors.record("webhook", msg)
+}
+
+func (d webhookDelivery) post() error {
+	req, err := http.NewRequest(http.MethodPost, d.target.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.event)
+	if d.target.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(d.target.Secret))
+		mac.Write(d.body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// stats reports delivery counters for /stats
+func (h *webhookSender) stats() []map[string]interface{} {
+	out := []map[string]interface{}{}
+	if h == nil {
+		return out
+	}
+	for _, t := range h.targets {
+		out = append(out, map[string]interface{}{
+			"url":             t.URL,
+			"events":          t.Events,
+			"delivered":       atomic.LoadInt64(&t.delivered),
+			"failed_attempts": atomic.LoadInt64(&t.failed),
+			"dead_letter":     atomic.LoadInt64(&t.deadLetter),
+			"dropped":         atomic.LoadInt64(&t.dropped),
+		})
+	}
+	return out
+}
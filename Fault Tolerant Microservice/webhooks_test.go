@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWebhookTestServer sends webhooks to the targets listed, with a
+// worker and the breaker forwarder running as main starts them
+func newWebhookTestServer(t *testing.T, targets string) *Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	if err := os.WriteFile(path, []byte(targets), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := newWebhookSender(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(cfg *Config) { cfg.Webhooks = hooks })
+	go hooks.worker()
+	t.Cleanup(func() { close(hooks.queue) })
+	sub, _ := s.transitions.subscribe(transitionWebhookBuffer)
+	go hooks.forwardTransitions(sub)
+	return s
+}
+
+// webhookStats reads the one target's counters from /stats once delivered
+// and dead_letter add up to want, failing t if they never do
+func webhookStats(t *testing.T, h http.Handler, want int64) map[string]interface{} {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		var st struct {
+			Webhooks []map[string]interface{} `json:"webhooks"`
+		}
+		if err := json.Unmarshal(serve(h, http.MethodGet, "/stats", "", nil).Body.Bytes(), &st); err != nil || len(st.Webhooks) != 1 {
+			t.Fatalf("stats webhooks %v: %v", st.Webhooks, err)
+		}
+		w := st.Webhooks[0]
+		if int64(w["delivered"].(float64)+w["dead_letter"].(float64)) >= want || time.Now().After(deadline) {
+			return w
+		}
+	}
+}
+
+// TestWebhookBreakerTransitions POSTs each breaker transition the target
+// asked for, signed with its secret, and counts the deliveries
+func TestWebhookBreakerTransitions(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan delivery, 8)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- delivery{r.Header, b}
+	}))
+	defer hook.Close()
+	h := newWebhookTestServer(t, `[{"url":"`+hook.URL+`","secret":"hook-secret","events":["breaker.*"]}]`).Routes()
+
+	for _, state := range []string{"open", "closed"} {
+		if rec := serve(h, http.MethodPost, "/admin/circuit", `{"state":"`+state+`"}`, nil); rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", state, rec.Code, rec.Body)
+		}
+		var d delivery
+		select {
+		case d = <-got:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no webhook for breaker.%s", state)
+		}
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write(d.body)
+		if sig := d.header.Get("X-Webhook-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("breaker.%s: signature %q doesn't match the body", state, sig)
+		}
+		var payload struct {
+			Event string `json:"event"`
+			Data  struct {
+				To     string `json:"to"`
+				Forced bool   `json:"forced"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(d.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event != "breaker."+state || d.header.Get("X-Webhook-Event") != payload.Event || payload.Data.To != state {
+			t.Errorf("breaker.%s: delivered %s", state, d.body)
+		}
+	}
+	if w := webhookStats(t, h, 2); w["delivered"] != 2.0 || w["failed_attempts"] != 0.0 || w["dead_letter"] != 0.0 {
+		t.Errorf("stats %v", w)
+	}
+	// readiness.up, at startup, wasn't one the target asked for
+	select {
+	case d := <-got:
+		t.Errorf("unwanted delivery %s", d.body)
+	default:
+	}
+}
+
+// TestWebhookDeadLetter retries a failing target its bounded number of
+// times, then dead-letters the event into /stats and the admin error ring,
+// while the request that caused it was answered at once
+func TestWebhookDeadLetter(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer hook.Close()
+	h := newWebhookTestServer(t, `[{"url":"`+hook.URL+`","events":["breaker.open"]}]`).Routes()
+
+	if rec := serve(h, http.MethodPost, "/admin/circuit", `{"state":"open"}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	w := webhookStats(t, h, 1)
+	if w["delivered"] != 0.0 || w["failed_attempts"] != float64(webhookMaxAttempts) || w["dead_letter"] != 1.0 {
+		t.Errorf("stats %v", w)
+	}
+	var ring struct {
+		Errors []adminErrorEntry `json:"errors"`
+	}
+	if err := json.Unmarshal(serve(h, http.MethodGet, "/admin/errors", "", nil).Body.Bytes(), &ring); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range ring.Errors {
+		found = found || e.Source == "webhook" && strings.Contains(e.Message, hook.URL) && strings.Contains(e.Message, "status 502")
+	}
+	if !found {
+		t.Errorf("no dead letter in the admin errors %v", ring.Errors)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 server side implementation, enough for text messages,
+// ping/pong and close. Extensions and subprotocols are not supported.
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+	wsCloseTryAgain    = 1013
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWSMessageTooBig = errors.New("websocket: message too big")
+
+type wsConn struct {
+	conn       net.Conn
+	br         *bufio.Reader
+	writeLock  sync.Mutex
+	maxMessage int
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsUpgrade performs the opening handshake and hijacks the connection.
+// On failure an HTTP error has already been written.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader, maxMessage: 64 << 10}, nil
+}
+
+// writeFrame writes a single unmasked frame
+func (c *wsConn) writeFrame(op byte, payload []byte, deadline time.Time) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xFFFF:
+		hdr[1] = 126
+		hdr = hdr[:4]
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = hdr[:10]
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(deadline)
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) writeText(msg []byte, deadline time.Time) error {
+	return c.writeFrame(wsOpText, msg, deadline)
+}
+
+// writeClose sends a close frame with a status code and reason
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeFrame(wsOpClose, payload, time.Now().Add(time.Second))
+}
+
+// readFrame reads one frame, unmasking the payload
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0x0F
+	if hdr[0]&0x70 != 0 {
+		return fin, op, nil, errors.New("websocket: reserved bits set")
+	}
+	masked := hdr[1]&0x80 != 0
+	if !masked {
+		return fin, op, nil, errors.New("websocket: client frame not masked")
+	}
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (length > 125 || !fin) {
+		return fin, op, nil, errors.New("websocket: invalid control frame")
+	}
+	if length > uint64(c.maxMessage) {
+		return fin, op, nil, errWSMessageTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// readMessage returns the next complete data message. Pings are answered
+// and pongs reported through onPong; a close frame ends with io.EOF.
+func (c *wsConn) readMessage(onPong func()) (op byte, msg []byte, err error) {
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch fop {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload, time.Now().Add(time.Second)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			if onPong != nil {
+				onPong()
+			}
+			continue
+		case wsOpClose:
+			c.writeClose(wsCloseNormal, "")
+			return 0, nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if msg != nil {
+				return 0, nil, errors.New("websocket: expected continuation frame")
+			}
+			op = fop
+			msg = payload
+		case wsOpContinuation:
+			if msg == nil {
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+			if len(msg)+len(payload) > c.maxMessage {
+				return 0, nil, errWSMessageTooBig
+			}
+			msg = append(msg, payload...)
+		default:
+			return 0, nil, errors.New("websocket: unknown opcode")
+		}
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsRecorder is the connection a test wsConn writes its frames to
+type wsRecorder struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *wsRecorder) Write(b []byte) (int, error)      { return c.out.Write(b) }
+func (c *wsRecorder) SetWriteDeadline(time.Time) error { return nil }
+
+// clientFrame is a frame as a client sends it, masked with mask
+func clientFrame(fin bool, op byte, payload []byte, mask [4]byte) []byte {
+	b := []byte{op, 0x80}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b[1] |= byte(n)
+	case n <= 0xFFFF:
+		b[1] |= 126
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b[1] |= 127
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// newTestWSConn reads the frames given and records what it writes
+func newTestWSConn(frames ...[]byte) (*wsConn, *wsRecorder) {
+	rec := &wsRecorder{}
+	return &wsConn{conn: rec, br: bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil))), maxMessage: 64 << 10}, rec
+}
+
+// serverFrame reads one unmasked frame the server wrote
+func serverFrame(t *testing.T, r io.Reader) (fin bool, op byte, payload []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatalf("reading a server frame: %v", err)
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatalf("server frame is masked")
+	}
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading a %d byte payload: %v", n, err)
+	}
+	return hdr[0]&0x80 != 0, hdr[0] & 0x0F, payload
+}
+
+var testMask = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+func TestWSReadMasked(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	ws, _ := newTestWSConn(
+		clientFrame(true, wsOpText, []byte("Hello"), testMask),
+		clientFrame(true, wsOpText, []byte(long), [4]byte{1, 2, 3, 4}),
+	)
+	for _, want := range []string{"Hello", long} {
+		op, msg, err := ws.readMessage(nil)
+		if err != nil || op != wsOpText || string(msg) != want {
+			t.Errorf("read op %d %.20q %v, want text %.20q", op, msg, err, want)
+		}
+	}
+	// RFC 6455 5.7's masked "Hello", byte for byte
+	ws, _ = newTestWSConn([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	if _, msg, err := ws.readMessage(nil); err != nil || string(msg) != "Hello" {
+		t.Errorf("the RFC's example read %q %v", msg, err)
+	}
+	// Clients must mask
+	ws, _ = newTestWSConn([]byte{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'})
+	if _, _, err := ws.readMessage(nil); err == nil {
+		t.Error("an unmasked client frame was accepted")
+	}
+}
+
+// TestWSFragmented reassembles a message sent in three frames, answering
+// a ping sent between them, and refuses fragments out of order
+func TestWSFragmented(t *testing.T) {
+	ws, rec := newTestWSConn(
+		clientFrame(false, wsOpText, []byte(`{"q":`), testMask),
+		clientFrame(true, wsOpPing, []byte("mid"), testMask),
+		clientFrame(false, wsOpContinuation, []byte(`"lamp"`), testMask),
+		clientFrame(true, wsOpContinuation, []byte(`}`), testMask),
+	)
+	op, msg, err := ws.readMessage(nil)
+	if err != nil || op != wsOpText || string(msg) != `{"q":"lamp"}` {
+		t.Fatalf("read op %d %q %v", op, msg, err)
+	}
+	if fin, op, payload := serverFrame(t, &rec.out); !fin || op != wsOpPong || string(payload) != "mid" {
+		t.Errorf("answered the ping with op %d %q", op, payload)
+	}
+
+	for name, frames := range map[string][][]byte{
+		"a continuation first": {clientFrame(true, wsOpContinuation, []byte("x"), testMask)},
+		"a new message mid-way": {
+			clientFrame(false, wsOpText, []byte("a"), testMask),
+			clientFrame(true, wsOpText, []byte("b"), testMask),
+		},
+		"a fragmented ping": {clientFrame(false, wsOpPing, []byte("x"), testMask)},
+		"a long ping":       {clientFrame(true, wsOpPing, bytes.Repeat([]byte("x"), 126), testMask)},
+		"reserved bits":     {append([]byte{0xC1}, clientFrame(true, wsOpText, []byte("x"), testMask)[1:]...)},
+		"an unknown opcode": {clientFrame(true, 0x3, []byte("x"), testMask)},
+	} {
+		ws, _ := newTestWSConn(frames...)
+		if _, msg, err := ws.readMessage(nil); err == nil {
+			t.Errorf("%s: read %q", name, msg)
+		}
+	}
+}
+
+func TestWSMessageTooBig(t *testing.T) {
+	half := bytes.Repeat([]byte("x"), 40<<10)
+	for name, frames := range map[string][][]byte{
+		"one frame": {clientFrame(true, wsOpText, append(half, half...), testMask)},
+		"fragments": {clientFrame(false, wsOpText, half, testMask), clientFrame(true, wsOpContinuation, half, testMask)},
+	} {
+		ws, _ := newTestWSConn(frames...)
+		if _, _, err := ws.readMessage(nil); !errors.Is(err, errWSMessageTooBig) {
+			t.Errorf("%s of 80KB: %v", name, err)
+		}
+	}
+}
+
+func TestWSPingPongClose(t *testing.T) {
+	ws, rec := newTestWSConn(
+		clientFrame(true, wsOpPing, []byte("are you there"), testMask),
+		clientFrame(true, wsOpPong, nil, testMask),
+		clientFrame(true, wsOpClose, []byte{0x03, 0xE8}, testMask),
+	)
+	pongs := 0
+	if _, _, err := ws.readMessage(func() { pongs++ }); err != io.EOF {
+		t.Fatalf("a close frame ended the read with %v, want io.EOF", err)
+	}
+	if pongs != 1 {
+		t.Errorf("%d pongs reported, want 1", pongs)
+	}
+	if _, op, payload := serverFrame(t, &rec.out); op != wsOpPong || string(payload) != "are you there" {
+		t.Errorf("answered the ping with op %d %q", op, payload)
+	}
+	// The close is echoed with 1000
+	if _, op, payload := serverFrame(t, &rec.out); op != wsOpClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Errorf("answered the close with op %d %v", op, payload)
+	}
+	if rec.out.Len() != 0 {
+		t.Errorf("%d bytes written after the close", rec.out.Len())
+	}
+}
+
+// TestWSWriteLengths writes frames at each length encoding's edges
+func TestWSWriteLengths(t *testing.T) {
+	ws, rec := newTestWSConn()
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte("y"), n)
+		if err := ws.writeText(payload, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if fin, op, got := serverFrame(t, &rec.out); !fin || op != wsOpText || !bytes.Equal(got, payload) {
+			t.Errorf("a %d byte text frame read back as op %d of %d bytes", n, op, len(got))
+		}
+	}
+	ws.writeClose(wsCloseTooBig, "message too big")
+	if _, op, payload := serverFrame(t, &rec.out); op != wsOpClose || binary.BigEndian.Uint16(payload) != wsCloseTooBig || string(payload[2:]) != "message too big" {
+		t.Errorf("close frame op %d %q", op, payload)
+	}
+}
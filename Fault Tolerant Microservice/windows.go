@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"productsearch/resilience"
+)
+
+// statsWindowSeconds is how far back the windowed search counters go, one
+// bucket a second: the longest window /stats reports
+const statsWindowSeconds = 5 * 60
+
+// statsWindowSpans are the windows /stats reports, shortest first
+var statsWindowSpans = []struct {
+	name    string
+	seconds int64
+}{
+	{"10s", 10},
+	{"1m", 60},
+	{"5m", statsWindowSeconds},
+}
+
+// windowCounter is one of the outcomes a statsWindows bucket counts
+type windowCounter int
+
+const (
+	windowRequests windowCounter = iota
+	windowSuccesses
+	windowFailures
+	windowRejected
+	windowCancelled
+	windowChecked
+	// windowLatency sums successful searches' latency in nanoseconds
+	windowLatency
+	windowCounters
+)
+
+// windowCounterNames are the counters reported as counts, all but the
+// latency sum
+var windowCounterNames = [windowLatency]string{"requests", "successes", "failures", "rejected", "cancelled", "checked"}
+
+// statsBucket counts one second of searches
+type statsBucket struct {
+	second int64
+	counts [windowCounters]int64
+}
+
+// statsWindows keeps the search outcomes of the last statsWindowSeconds
+// in a ring of per second buckets, so /stats can give rates and averages
+// over recent traffic however long the process has run; the lifetime
+// counters beside them only ever grow. A reset empties every window and
+// starts them again from the reset, leaving the lifetime counters alone.
+// Seconds are on the server clock.
+type statsWindows struct {
+	mu      sync.Mutex
+	clock   resilience.Clock
+	buckets [statsWindowSeconds]statsBucket
+	// since is when the windows started counting, at startup or the last
+	// reset; no window reaches back past it
+	since  time.Time
+	resets int64
+}
+
+func newStatsWindows(clock resilience.Clock) *statsWindows {
+	return &statsWindows{clock: clock, since: clock.Now()}
+}
+
+// addSaturating adds n to a counter, atomically, stopping at the int64
+// range rather than wrapping, so a counter that has run for long enough
+// reads as large rather than negative
+func addSaturating(p *int64, n int64) {
+	for {
+		old := atomic.LoadInt64(p)
+		next := saturatingSum(old, n)
+		if next == old || atomic.CompareAndSwapInt64(p, old, next) {
+			return
+		}
+	}
+}
+
+// saturatingSum is a+b clamped to the int64 range
+func saturatingSum(a, b int64) int64 {
+	switch {
+	case b > 0 && a > math.MaxInt64-b:
+		return math.MaxInt64
+	case b < 0 && a < math.MinInt64-b:
+		return math.MinInt64
+	}
+	return a + b
+}
+
+func (sw *statsWindows) add(c windowCounter, n int64) {
+	if sw == nil {
+		return
+	}
+	second := sw.clock.Now().Unix()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	b := &sw.buckets[bucketIndex(second)]
+	if b.second != second {
+		*b = statsBucket{second: second}
+	}
+	b.counts[c] = saturatingSum(b.counts[c], n)
+}
+
+// bucketIndex is second's place in the ring, also before the epoch
+func bucketIndex(second int64) int64 {
+	i := second % statsWindowSeconds
+	if i < 0 {
+		i += statsWindowSeconds
+	}
+	return i
+}
+
+// reset empties every window, which start again from now
+func (sw *statsWindows) reset() {
+	now := sw.clock.Now()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.buckets = [statsWindowSeconds]statsBucket{}
+	sw.since = now
+	sw.resets++
+}
+
+// windowLocked sums the last seconds, the current one included, back to
+// since, and how many seconds that covered
+func (sw *statsWindows) windowLocked(now, seconds int64) (counts [windowCounters]int64, covered int64) {
+	from := now - seconds
+	if start := sw.since.Unix() - 1; start > from {
+		from = start
+	}
+	if from >= now {
+		// The clock went back past since
+		from = now - 1
+	}
+	for sec := now; sec > from; sec-- {
+		b := &sw.buckets[bucketIndex(sec)]
+		if b.second != sec {
+			continue
+		}
+		for c := range counts {
+			counts[c] = saturatingSum(counts[c], b.counts[c])
+		}
+	}
+	return counts, now - from
+}
+
+// stats is each window's counts, with the rate and averages they give.
+// A ratio or average comes out nil while nothing it divides by was seen.
+func (sw *statsWindows) stats() map[string]interface{} {
+	now := sw.clock.Now().Unix()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	out := map[string]interface{}{
+		"since":    sw.since.UTC().Format(time.RFC3339),
+		"resets":   sw.resets,
+		"bucket_s": 1,
+	}
+	for _, span := range statsWindowSpans {
+		counts, covered := sw.windowLocked(now, span.seconds)
+		w := map[string]interface{}{"seconds": covered}
+		for c, name := range windowCounterNames {
+			w[name] = counts[c]
+		}
+		w["requests_per_s"] = float64(counts[windowRequests]) / float64(covered)
+		var successRatio, latency, checks *float64
+		if n := saturatingSum(counts[windowSuccesses], counts[windowFailures]); n > 0 {
+			v := float64(counts[windowSuccesses]) / float64(n)
+			successRatio = &v
+		}
+		if n := counts[windowSuccesses]; n > 0 {
+			ms := float64(counts[windowLatency]) / float64(n) / float64(time.Millisecond)
+			per := float64(counts[windowChecked]) / float64(n)
+			latency, checks = &ms, &per
+		}
+		w["success_ratio"] = successRatio
+		w["mean_latency_ms"] = latency
+		w["checks_per_search"] = checks
+		out[span.name] = w
+	}
+	return out
+}
+
+// count adds n to a lifetime search counter and its windows
+func (s *Server) count(lifetime *int64, c windowCounter, n int64) {
+	if lifetime != nil {
+		addSaturating(lifetime, n)
+	}
+	s.windows.add(c, n)
+}
+
+// statsResetHandler starts the windowed counters afresh. The lifetime
+// counters, and every other section of /stats, are never reset.
+func (s *Server) statsResetHandler(w http.ResponseWriter, r *http.Request) {
+	s.windows.reset()
+	writeJSON(w, http.StatusOK, s.windows.stats())
+}
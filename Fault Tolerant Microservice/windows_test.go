@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatsWindows counts searches on a manual clock across window
+// boundaries: each window must drop a second once it is older than the
+// window, including when the ring reuses its bucket, and a reset must
+// empty the windows and nothing else
+func TestStatsWindows(t *testing.T) {
+	clock := newManualClock(time.Unix(1000, 0))
+	s := &Server{windows: newStatsWindows(clock)}
+	expect := func(step string, want map[string][2]int64) {
+		t.Helper()
+		for name, w := range want {
+			if got, secs := windowStat(s, name, "requests"), windowStat(s, name, "seconds"); got != w[0] || secs != w[1] {
+				t.Errorf("%s: %s window has %d requests over %ds, want %d over %ds", step, name, got, secs, w[0], w[1])
+			}
+		}
+	}
+	for i := 0; i < 3; i++ {
+		s.count(&s.stats.requests, windowRequests, 1)
+	}
+	clock.Advance(5 * time.Second)
+	s.count(&s.stats.requests, windowRequests, 2)
+	s.count(&s.stats.successes, windowSuccesses, 1)
+	s.count(nil, windowLatency, int64(10*time.Millisecond))
+	expect("after 5s", map[string][2]int64{"10s": {5, 6}, "1m": {5, 6}, "5m": {5, 6}})
+	if ms := s.windows.stats()["1m"].(map[string]interface{})["mean_latency_ms"].(*float64); ms == nil || *ms != 10 {
+		t.Errorf("mean latency %v, want 10ms", ms)
+	}
+	clock.Advance(5 * time.Second)
+	expect("after 10s", map[string][2]int64{"10s": {2, 10}, "1m": {5, 11}})
+	clock.Advance(5 * time.Second)
+	expect("after 15s", map[string][2]int64{"10s": {0, 10}, "1m": {5, 16}})
+	// 1305 shares its bucket with 1005, which must not be read back
+	clock.Advance(statsWindowSeconds * time.Second)
+	expect("a ring later", map[string][2]int64{"1m": {0, 60}, "5m": {0, statsWindowSeconds}})
+	s.count(&s.stats.requests, windowRequests, 1)
+	expect("in a reused bucket", map[string][2]int64{"10s": {1, 10}, "5m": {1, statsWindowSeconds}})
+
+	rec := httptest.NewRecorder()
+	s.statsResetHandler(rec, httptest.NewRequest(http.MethodPost, "/stats/reset", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"resets":1`) {
+		t.Fatalf("reset: status %d: %s", rec.Code, rec.Body)
+	}
+	expect("after the reset", map[string][2]int64{"10s": {0, 1}, "5m": {0, 1}})
+	if s.stats.requests != 6 || s.stats.successes != 1 {
+		t.Errorf("the reset left %d requests and %d successes since startup, want 6 and 1", s.stats.requests, s.stats.successes)
+	}
+	clock.Advance(2 * time.Second)
+	s.count(&s.stats.requests, windowRequests, 1)
+	expect("2s after the reset", map[string][2]int64{"10s": {1, 3}, "1m": {1, 3}})
+}
+
+// TestCountersSaturate checks counters stop at the int64 maximum rather
+// than wrap
+func TestCountersSaturate(t *testing.T) {
+	s := &Server{windows: newStatsWindows(newManualClock(time.Unix(1000, 0)))}
+	s.stats.requests = math.MaxInt64 - 1
+	s.count(&s.stats.requests, windowRequests, math.MaxInt64)
+	s.count(&s.stats.requests, windowRequests, math.MaxInt64)
+	if s.stats.requests != math.MaxInt64 || windowStat(s, "5m", "requests") != math.MaxInt64 {
+		t.Errorf("counters wrapped: %d since startup, %d in the window", s.stats.requests, windowStat(s, "5m", "requests"))
+	}
+	if _, err := json.Marshal(s.windows.stats()); err != nil {
+		t.Errorf("saturated windows don't encode: %v", err)
+	}
+}
+
+func windowStat(s *Server, name, field string) int64 {
+	return s.windows.stats()[name].(map[string]interface{})[field].(int64)
+}